@@ -31,12 +31,37 @@ var (
 func main() {
 	cli.SetBuildInfo(version, commit, date)
 
+	if len(os.Args) > 1 && os.Args[1] == cli.PrintDefaultConfigCommand {
+		if err := cli.PrintDefaultConfig(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// "apt-proxy mirrors-test [flags]", "apt-proxy --check-config [flags]"
+	// and "apt-proxy --list-modes [flags]" take the same flags as the server.
+	command := ""
+	if len(os.Args) > 1 && (os.Args[1] == cli.MirrorsTestCommand || os.Args[1] == cli.CheckConfigCommand || os.Args[1] == cli.ListModesCommand) {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	flags, err := cli.ParseFlags()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	if err := cli.Daemon(flags); err != nil {
+	run := cli.Daemon
+	switch command {
+	case cli.MirrorsTestCommand:
+		run = func(cfg *cli.Config) error { return cli.MirrorsTest(cfg, os.Stdout) }
+	case cli.CheckConfigCommand:
+		run = func(cfg *cli.Config) error { return cli.CheckConfig(cfg, os.Stdout) }
+	case cli.ListModesCommand:
+		run = func(cfg *cli.Config) error { return cli.ListModes(cfg, os.Stdout) }
+	}
+	if err := run(flags); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,169 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api provides HTTP API handlers for apt-proxy management endpoints.
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bandwidthChunk caps how many bytes are written between two throttle
+// pauses, so a single large Write is spread evenly instead of bursting.
+const bandwidthChunk = 16 * 1024
+
+// BandwidthLimiter caps the download rate of each client IP. Every
+// concurrent response to the same client draws from one shared budget, so
+// opening more connections does not buy more bandwidth.
+type BandwidthLimiter struct {
+	bytesPerSecond int64
+	clientIP       *ClientIPExtractor
+
+	mu      sync.Mutex
+	clients map[string]*bandwidthBucket
+}
+
+type bandwidthBucket struct {
+	// next is the instant at which this client's budget is free again.
+	// Each write books len(p)/rate seconds starting at max(now, next).
+	next     time.Time
+	lastUsed time.Time
+}
+
+// NewBandwidthLimiter creates a limiter allowing bytesPerSecond per client
+// IP. Pass 0 to disable throttling (Wrap returns next unchanged). A nil
+// clientIP keys on r.RemoteAddr only.
+func NewBandwidthLimiter(bytesPerSecond int64, clientIP *ClientIPExtractor) *BandwidthLimiter {
+	if clientIP == nil {
+		clientIP = &ClientIPExtractor{}
+	}
+	return &BandwidthLimiter{
+		bytesPerSecond: bytesPerSecond,
+		clientIP:       clientIP,
+		clients:        make(map[string]*bandwidthBucket),
+	}
+}
+
+// Wrap throttles the response body written by next. Headers are sent
+// immediately; only body bytes count against the budget.
+func (l *BandwidthLimiter) Wrap(next http.Handler) http.Handler {
+	if l == nil || l.bytesPerSecond <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &throttledWriter{
+			ResponseWriter: w,
+			limiter:        l,
+			key:            l.clientIP.ClientIP(r),
+			ctx:            r.Context(),
+		}
+		next.ServeHTTP(tw, r)
+	})
+}
+
+// reserve books n bytes for key and returns how long the caller must wait
+// before the booking is honoured.
+func (l *BandwidthLimiter) reserve(key string, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.clients[key]
+	if !ok {
+		b = &bandwidthBucket{next: now}
+		l.clients[key] = b
+		// Same opportunistic GC as RateLimitMiddleware: drop clients that
+		// have been idle for a while once the map grows.
+		if len(l.clients) > 1024 {
+			cutoff := now.Add(-2 * time.Minute)
+			for k, v := range l.clients {
+				if v.lastUsed.Before(cutoff) {
+					delete(l.clients, k)
+				}
+			}
+		}
+	}
+	if b.next.Before(now) {
+		b.next = now
+	}
+	b.next = b.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	b.lastUsed = now
+	return b.next.Sub(now)
+}
+
+// throttledWriter is an http.ResponseWriter whose Write paces output to the
+// limiter's per-client rate, flushing before each pause.
+type throttledWriter struct {
+	http.ResponseWriter
+	limiter *BandwidthLimiter
+	key     string
+	ctx     context.Context
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > bandwidthChunk {
+			chunk = chunk[:bandwidthChunk]
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if d := w.limiter.reserve(w.key, n); d > 0 {
+			// Push what was written to the client before pausing: a
+			// buffering writer underneath, such as the fasthttp adaptor,
+			// would otherwise collect the whole body at full speed.
+			w.Flush()
+			if err := w.wait(d); err != nil {
+				return written, err
+			}
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// wait sleeps for d, returning the context error if the client went away
+// first.
+func (w *throttledWriter) wait(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+}
+
+// Flush forwards to the underlying writer when it supports flushing so
+// streaming responses still reach the client chunk by chunk.
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func payloadHandler(body []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	}
+}
+
+// TestBandwidthLimiterDisabled ensures 0 returns the next handler unchanged.
+func TestBandwidthLimiterDisabled(t *testing.T) {
+	next := payloadHandler(nil)
+	wrapped := NewBandwidthLimiter(0, nil).Wrap(next)
+	if _, ok := wrapped.(http.HandlerFunc); !ok {
+		t.Fatalf("expected the original handler back, got %T", wrapped)
+	}
+}
+
+// TestBandwidthLimiterThrottles checks that a throttled response takes
+// roughly size/rate to complete and is delivered intact.
+func TestBandwidthLimiterThrottles(t *testing.T) {
+	const rate = 40 * 1024
+	body := bytes.Repeat([]byte("x"), 20*1024) // ~500ms at 40 KiB/s
+
+	wrapped := NewBandwidthLimiter(rate, nil).Wrap(payloadHandler(body))
+	req := httptest.NewRequest(http.MethodGet, "/ubuntu/pool/a.deb", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rr := httptest.NewRecorder()
+
+	start := time.Now()
+	wrapped.ServeHTTP(rr, req)
+	elapsed := time.Since(start)
+
+	if rr.Body.Len() != len(body) {
+		t.Fatalf("body length = %d, want %d", rr.Body.Len(), len(body))
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("throttled response took %v, want ~500ms", elapsed)
+	}
+	if !rr.Flushed {
+		t.Error("throttled response was not flushed before pausing")
+	}
+}
+
+// TestBandwidthLimiterPerClient ensures one client's budget does not slow
+// down another client.
+func TestBandwidthLimiterPerClient(t *testing.T) {
+	l := NewBandwidthLimiter(1024, nil)
+	if d := l.reserve("1.1.1.1", 1024); d < 900*time.Millisecond {
+		t.Fatalf("first reservation wait = %v, want ~1s", d)
+	}
+	if d := l.reserve("1.1.1.1", 1024); d < 1900*time.Millisecond {
+		t.Fatalf("second reservation for same client = %v, want ~2s", d)
+	}
+	if d := l.reserve("2.2.2.2", 1024); d > 1100*time.Millisecond {
+		t.Fatalf("other client should start with a fresh budget, got %v", d)
+	}
+}
@@ -15,6 +15,9 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 
 	logger "github.com/soulteary/logger-kit"
@@ -23,17 +26,55 @@ import (
 	httpcache "github.com/soulteary/httpcache-kit"
 )
 
+// DistroScope is implemented by caches that can purge or clean up the
+// objects of some distributions only. ids are distribution IDs; an unknown
+// or unsupported one is reported as an *apperrors.AppError.
+type DistroScope interface {
+	PurgeDistros(ids []string) (httpcache.CleanupResult, error)
+	CleanupDistros(ids []string) (httpcache.CleanupResult, error)
+}
+
+// CachePools is implemented by caches split into pools with size limits
+// of their own. Pools returns nil when the cache is not split.
+type CachePools interface {
+	Pools() []CachePool
+}
+
+// CachePool is the size limit and statistics of one pool of a CachePools
+// cache. MaxSize is in bytes, 0 when unlimited.
+type CachePool struct {
+	Name    string
+	MaxSize int64
+	Stats   httpcache.CacheStats
+}
+
+// CacheScopeRequest is the optional body of the purge and cleanup
+// endpoints. Without distros they act on the whole cache.
+type CacheScopeRequest struct {
+	Distros []string `json:"distros"`
+}
+
 // CacheHandler handles cache-related API endpoints
 type CacheHandler struct {
-	cache httpcache.ExtendedCache
-	log   *logger.Logger
+	cache   httpcache.ExtendedCache
+	history *CacheHistory
+	log     *logger.Logger
 }
 
-// NewCacheHandler creates a new CacheHandler
+// NewCacheHandler creates a new CacheHandler whose statistics cover this
+// process only.
 func NewCacheHandler(cache httpcache.ExtendedCache, log *logger.Logger) *CacheHandler {
+	history, _ := LoadCacheHistory("")
+	return NewCacheHandlerWithHistory(cache, history, log)
+}
+
+// NewCacheHandlerWithHistory creates a CacheHandler reporting the
+// cumulative statistics of history next to those of this process.
+func NewCacheHandlerWithHistory(cache httpcache.ExtendedCache, history *CacheHistory, log *logger.Logger) *CacheHandler {
 	return &CacheHandler{
-		cache: cache,
-		log:   log,
+		cache:   cache,
+		history: history,
+		log:     log,
 	}
 }
 
@@ -50,14 +91,40 @@ func (h *CacheHandler) HandleCacheStats(w http.ResponseWriter, r *http.Request)
 		metrics.UpdateCacheStats(stats)
 	}
 
+	cumulative, uptime := h.history.Totals(stats)
 	resp := CacheStatsResponse{
 		TotalSizeBytes: stats.TotalSize,
 		TotalSizeHuman: FormatBytes(stats.TotalSize),
 		ItemCount:      stats.ItemCount,
 		StaleCount:     stats.StaleCount,
-		HitCount:       stats.HitCount,
-		MissCount:      stats.MissCount,
-		HitRate:        CalculateHitRate(stats.HitCount, stats.MissCount),
+		HitCount:       cumulative.HitCount,
+		MissCount:      cumulative.MissCount,
+		HitRate:        CalculateHitRate(cumulative.HitCount, cumulative.MissCount),
+		BytesServed:    cumulative.BytesServed,
+		Since:          cumulative.Since,
+		Uptime: CacheUptimeStats{
+			HitCount:    uptime.HitCount,
+			MissCount:   uptime.MissCount,
+			HitRate:     CalculateHitRate(uptime.HitCount, uptime.MissCount),
+			BytesServed: uptime.BytesServed,
+			Since:       uptime.Since,
+		},
+	}
+
+	if pools, ok := h.cache.(CachePools); ok {
+		for _, pool := range pools.Pools() {
+			resp.Pools = append(resp.Pools, CachePoolStats{
+				Name:           pool.Name,
+				MaxSizeBytes:   pool.MaxSize,
+				TotalSizeBytes: pool.Stats.TotalSize,
+				TotalSizeHuman: FormatBytes(pool.Stats.TotalSize),
+				ItemCount:      pool.Stats.ItemCount,
+				StaleCount:     pool.Stats.StaleCount,
+				HitCount:       pool.Stats.HitCount,
+				MissCount:      pool.Stats.MissCount,
+				HitRate:        CalculateHitRate(pool.Stats.HitCount, pool.Stats.MissCount),
+			})
+		}
 	}
 
 	if err := WriteJSON(w, http.StatusOK, resp); err != nil {
@@ -65,12 +132,22 @@ func (h *CacheHandler) HandleCacheStats(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-// HandleCachePurge clears all cached items
+// HandleCachePurge clears all cached items, or with a CacheScopeRequest
+// body only those of the listed distributions.
 func (h *CacheHandler) HandleCachePurge(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		WriteAppError(w, apperrors.New(apperrors.ErrMethodNotAllowed, "Method not allowed"))
 		return
 	}
+	distros, appErr := readCacheScope(r)
+	if appErr != nil {
+		WriteAppError(w, appErr)
+		return
+	}
+	if len(distros) > 0 {
+		h.purgeDistros(w, distros)
+		return
+	}
 
 	// Get stats before purge
 	statsBefore := h.cache.Stats()
@@ -97,20 +174,71 @@ func (h *CacheHandler) HandleCachePurge(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-// HandleCacheCleanup triggers a manual cleanup cycle
+func (h *CacheHandler) purgeDistros(w http.ResponseWriter, distros []string) {
+	scope, appErr := h.scope()
+	if appErr != nil {
+		WriteAppError(w, appErr)
+		return
+	}
+	result, err := scope.PurgeDistros(distros)
+	if err != nil {
+		h.log.Error().Err(err).Strs("distros", distros).Msg("failed to purge distributions from cache")
+		writeScopeError(w, err, apperrors.ErrCachePurge, "Failed to purge cache")
+		return
+	}
+
+	h.log.Info().
+		Strs("distros", distros).
+		Int("items_removed", result.RemovedItems).
+		Int64("bytes_freed", result.RemovedBytes).
+		Msg("cache purged for distributions")
+
+	resp := CachePurgeResponse{
+		Success:      true,
+		ItemsRemoved: result.RemovedItems,
+		BytesFreed:   result.RemovedBytes,
+		Distros:      distros,
+	}
+	if err := WriteJSON(w, http.StatusOK, resp); err != nil {
+		h.log.Error().Err(err).Msg("failed to write cache purge response")
+	}
+}
+
+// HandleCacheCleanup triggers a manual cleanup cycle, or with a
+// CacheScopeRequest body one over the listed distributions' stores.
 func (h *CacheHandler) HandleCacheCleanup(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		WriteAppError(w, apperrors.New(apperrors.ErrMethodNotAllowed, "Method not allowed"))
 		return
 	}
+	distros, appErr := readCacheScope(r)
+	if appErr != nil {
+		WriteAppError(w, appErr)
+		return
+	}
 
-	result := h.cache.Cleanup()
+	var result httpcache.CleanupResult
+	if len(distros) > 0 {
+		scope, appErr := h.scope()
+		if appErr != nil {
+			WriteAppError(w, appErr)
+			return
+		}
+		var err error
+		if result, err = scope.CleanupDistros(distros); err != nil {
+			writeScopeError(w, err, apperrors.ErrCacheCleanup, "Failed to clean up cache")
+			return
+		}
+	} else {
+		result = h.cache.Cleanup()
+	}
 
 	h.log.Info().
 		Int("items_removed", result.RemovedItems).
 		Int64("bytes_freed", result.RemovedBytes).
 		Int("stale_entries_removed", result.RemovedStaleEntries).
 		Dur("duration", result.Duration).
+		Strs("distros", distros).
 		Msg("manual cache cleanup completed")
 
 	resp := CacheCleanupResponse{
@@ -119,9 +247,45 @@ func (h *CacheHandler) HandleCacheCleanup(w http.ResponseWriter, r *http.Request
 		BytesFreed:          result.RemovedBytes,
 		StaleEntriesRemoved: result.RemovedStaleEntries,
 		DurationMs:          result.Duration.Milliseconds(),
+		Distros:             distros,
 	}
 
 	if err := WriteJSON(w, http.StatusOK, resp); err != nil {
 		h.log.Error().Err(err).Msg("failed to write cache cleanup response")
 	}
 }
+
+// readCacheScope parses the optional CacheScopeRequest body of r, returning
+// the requested distribution IDs (none for the whole cache).
+func readCacheScope(r *http.Request) ([]string, *apperrors.AppError) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	var req CacheScopeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, apperrors.New(apperrors.ErrRequestInvalid, "request body must be JSON like {\"distros\": [\"ubuntu\"]}")
+	}
+	return req.Distros, nil
+}
+
+// scope returns the cache's DistroScope, or an error for a server whose
+// cache cannot be scoped.
+func (h *CacheHandler) scope() (DistroScope, *apperrors.AppError) {
+	scope, ok := h.cache.(DistroScope)
+	if !ok {
+		return nil, apperrors.New(apperrors.ErrNotImplemented, "per-distribution purge and cleanup are not supported by this server")
+	}
+	return scope, nil
+}
+
+// writeScopeError sends err from a DistroScope call.
+func writeScopeError(w http.ResponseWriter, err error, code apperrors.Code, msg string) {
+	var appErr *apperrors.AppError
+	if !errors.As(err, &appErr) {
+		appErr = apperrors.CacheError(code, msg, err)
+	}
+	WriteAppError(w, appErr)
+}
@@ -24,6 +24,8 @@ import (
 
 	httpcache "github.com/soulteary/httpcache-kit"
 	logger "github.com/soulteary/logger-kit"
+
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
 )
 
 // fakeCache is a lightweight in-memory ExtendedCache stub. It implements only
@@ -162,3 +164,125 @@ func TestCacheHandlerCleanup(t *testing.T) {
 		t.Errorf("expected one cleanup call, got %d", c.cleanupCalls)
 	}
 }
+
+// scopedCache is a fakeCache that also implements DistroScope.
+type scopedCache struct {
+	fakeCache
+	purged   []string
+	cleaned  []string
+	scopeErr error
+}
+
+func (c *scopedCache) PurgeDistros(ids []string) (httpcache.CleanupResult, error) {
+	c.purged = ids
+	return httpcache.CleanupResult{RemovedItems: 2, RemovedBytes: 512}, c.scopeErr
+}
+
+func (c *scopedCache) CleanupDistros(ids []string) (httpcache.CleanupResult, error) {
+	c.cleaned = ids
+	return httpcache.CleanupResult{RemovedItems: 1, RemovedBytes: 64}, c.scopeErr
+}
+
+func TestCacheHandlerPurgeDistros(t *testing.T) {
+	c := &scopedCache{fakeCache: fakeCache{stats: httpcache.CacheStats{ItemCount: 9}}}
+	h := NewCacheHandler(c, logger.New(logger.Config{Format: logger.FormatJSON, Level: logger.ErrorLevel}))
+
+	rec := httptest.NewRecorder()
+	h.HandleCachePurge(rec, httptest.NewRequest(http.MethodPost, "/api/cache/purge", strings.NewReader(`{"distros":["alpine"]}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body=%s", rec.Code, rec.Body.String())
+	}
+	var got CachePurgeResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.ItemsRemoved != 2 || got.BytesFreed != 512 || len(got.Distros) != 1 || got.Distros[0] != "alpine" {
+		t.Errorf("purge payload = %+v, want 2 items, 512 bytes for alpine", got)
+	}
+	if c.purgeCalls != 0 || len(c.purged) != 1 {
+		t.Errorf("Purge() calls = %d, PurgeDistros(%v); want only the scoped purge", c.purgeCalls, c.purged)
+	}
+
+	rec = httptest.NewRecorder()
+	h.HandleCacheCleanup(rec, httptest.NewRequest(http.MethodPost, "/api/cache/cleanup", strings.NewReader(`{"distros":["alpine"]}`)))
+	if rec.Code != http.StatusOK || c.cleanupCalls != 0 || len(c.cleaned) != 1 {
+		t.Errorf("scoped cleanup = %d, Cleanup() calls %d, CleanupDistros(%v); want only the scoped cleanup", rec.Code, c.cleanupCalls, c.cleaned)
+	}
+
+	// An empty distros list is the whole cache, as without a body.
+	rec = httptest.NewRecorder()
+	h.HandleCachePurge(rec, httptest.NewRequest(http.MethodPost, "/api/cache/purge", strings.NewReader(`{"distros":[]}`)))
+	if rec.Code != http.StatusOK || c.purgeCalls != 1 {
+		t.Errorf("purge with no distros = %d, Purge() calls %d; want the whole cache purged", rec.Code, c.purgeCalls)
+	}
+}
+
+func TestCacheHandlerPurgeDistrosErrors(t *testing.T) {
+	log := logger.New(logger.Config{Format: logger.FormatJSON, Level: logger.ErrorLevel})
+	tests := []struct {
+		name  string
+		cache httpcache.ExtendedCache
+		body  string
+		want  int
+	}{
+		{"bad body", &scopedCache{}, `{"distros":"alpine"}`, http.StatusBadRequest},
+		{"not scopeable", &fakeCache{}, `{"distros":["alpine"]}`, http.StatusNotImplemented},
+		{"unknown distro", &scopedCache{scopeErr: apperrors.New(apperrors.ErrResourceNotFound, "unknown distribution: plan9")}, `{"distros":["plan9"]}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewCacheHandler(tt.cache, log)
+			for _, path := range []string{"/api/cache/purge", "/api/cache/cleanup"} {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(tt.body))
+				if path == "/api/cache/purge" {
+					h.HandleCachePurge(rec, req)
+				} else {
+					h.HandleCacheCleanup(rec, req)
+				}
+				if rec.Code != tt.want {
+					t.Errorf("%s status = %d, want %d; body=%s", path, rec.Code, tt.want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+type pooledCache struct {
+	fakeCache
+	pools []CachePool
+}
+
+func (c *pooledCache) Pools() []CachePool { return c.pools }
+
+func TestCacheHandlerStatsReportsPools(t *testing.T) {
+	c := &pooledCache{
+		fakeCache: fakeCache{stats: httpcache.CacheStats{TotalSize: 3072, ItemCount: 3}},
+		pools: []CachePool{
+			{Name: "index", MaxSize: 2048, Stats: httpcache.CacheStats{TotalSize: 1024, ItemCount: 2, HitCount: 3, MissCount: 1}},
+			{Name: "package", MaxSize: 4096, Stats: httpcache.CacheStats{TotalSize: 2048, ItemCount: 1}},
+		},
+	}
+	h := NewCacheHandler(c, logger.New(logger.Config{Format: logger.FormatJSON, Level: logger.ErrorLevel}))
+
+	rec := httptest.NewRecorder()
+	h.HandleCacheStats(rec, httptest.NewRequest(http.MethodGet, "/api/cache/stats", nil))
+	var got CacheStatsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got.Pools) != 2 {
+		t.Fatalf("pools = %+v, want 2", got.Pools)
+	}
+	index := got.Pools[0]
+	if index.Name != "index" || index.MaxSizeBytes != 2048 || index.TotalSizeHuman != "1.00 KB" || index.ItemCount != 2 || index.HitRate != 0.75 {
+		t.Errorf("index pool = %+v", index)
+	}
+
+	c.pools = nil
+	rec = httptest.NewRecorder()
+	h.HandleCacheStats(rec, httptest.NewRequest(http.MethodGet, "/api/cache/stats", nil))
+	if strings.Contains(rec.Body.String(), `"pools"`) {
+		t.Errorf("unsplit cache reports pools: %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+)
+
+// CacheTotals are the counters kept by CacheHistory, as stored in the
+// cache.stats_file and reported by /api/cache/stats.
+type CacheTotals struct {
+	HitCount    int64     `json:"hit_count"`
+	MissCount   int64     `json:"miss_count"`
+	BytesServed int64     `json:"bytes_served"`
+	Since       time.Time `json:"since"`
+}
+
+// CacheHistory carries the cache hit, miss and bytes-served counters
+// across restarts: the totals saved by the previous process are loaded
+// from path and added to this process's counters, and Save writes the sum
+// back on shutdown. With an empty path nothing is loaded or saved and the
+// totals cover this process only.
+type CacheHistory struct {
+	path      string
+	previous  CacheTotals
+	startedAt time.Time
+
+	bytesServed atomic.Int64
+}
+
+// LoadCacheHistory returns a CacheHistory continuing the totals saved at
+// path. A missing file starts a new history; an unreadable one is reported
+// together with a new history, so the caller can log it and carry on.
+func LoadCacheHistory(path string) (*CacheHistory, error) {
+	h := &CacheHistory{path: path, startedAt: time.Now().UTC()}
+	h.previous.Since = h.startedAt
+	if path == "" {
+		return h, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return h, fmt.Errorf("read cache stats file: %w", err)
+	}
+	var saved CacheTotals
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return h, fmt.Errorf("parse cache stats file %s: %w", path, err)
+	}
+	if saved.Since.IsZero() {
+		saved.Since = h.startedAt
+	}
+	h.previous = saved
+	return h, nil
+}
+
+// Totals returns the counters since the history began and, as uptime,
+// those of this process alone. stats are the live cache statistics,
+// which count from the process start.
+func (h *CacheHistory) Totals(stats httpcache.CacheStats) (cumulative, uptime CacheTotals) {
+	uptime = CacheTotals{
+		HitCount:    stats.HitCount,
+		MissCount:   stats.MissCount,
+		BytesServed: h.bytesServed.Load(),
+		Since:       h.startedAt,
+	}
+	cumulative = CacheTotals{
+		HitCount:    h.previous.HitCount + uptime.HitCount,
+		MissCount:   h.previous.MissCount + uptime.MissCount,
+		BytesServed: h.previous.BytesServed + uptime.BytesServed,
+		Since:       h.previous.Since,
+	}
+	return cumulative, uptime
+}
+
+// Save writes the cumulative totals to the history's path, replacing the
+// file atomically. It does nothing without a path.
+func (h *CacheHistory) Save(stats httpcache.CacheStats) error {
+	if h.path == "" {
+		return nil
+	}
+	cumulative, _ := h.Totals(stats)
+	data, err := json.Marshal(cumulative)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), filepath.Base(h.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("write cache stats file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write cache stats file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write cache stats file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), h.path); err != nil {
+		return fmt.Errorf("write cache stats file: %w", err)
+	}
+	return nil
+}
+
+// Wrap counts the response body bytes next writes as bytes served.
+func (h *CacheHistory) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&countingWriter{ResponseWriter: w, n: &h.bytesServed}, r)
+	})
+}
+
+// countingWriter is an http.ResponseWriter that adds the body bytes
+// written through it to n.
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+// Flush forwards to the underlying writer when it supports flushing.
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
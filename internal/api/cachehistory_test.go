@@ -0,0 +1,132 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+)
+
+// serve sends a response with body through h's byte counter.
+func serve(h *CacheHistory, body string) {
+	h.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, body)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestCacheHistoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+
+	first, err := LoadCacheHistory(path)
+	if err != nil {
+		t.Fatalf("LoadCacheHistory() on a missing file error = %v", err)
+	}
+	serve(first, "0123456789")
+	if err := first.Save(httpcache.CacheStats{HitCount: 30, MissCount: 10}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	second, err := LoadCacheHistory(path)
+	if err != nil {
+		t.Fatalf("LoadCacheHistory() error = %v", err)
+	}
+	serve(second, "abcde")
+	cumulative, uptime := second.Totals(httpcache.CacheStats{HitCount: 3, MissCount: 1})
+	if cumulative.HitCount != 33 || cumulative.MissCount != 11 || cumulative.BytesServed != 15 {
+		t.Errorf("cumulative = %+v, want 33 hits, 11 misses, 15 bytes", cumulative)
+	}
+	if uptime.HitCount != 3 || uptime.MissCount != 1 || uptime.BytesServed != 5 {
+		t.Errorf("uptime = %+v, want 3 hits, 1 miss, 5 bytes", uptime)
+	}
+	if !cumulative.Since.Equal(first.startedAt) || !uptime.Since.Equal(second.startedAt) {
+		t.Errorf("since = %s / %s, want the first and the second start", cumulative.Since, uptime.Since)
+	}
+
+	if err := second.Save(httpcache.CacheStats{HitCount: 3, MissCount: 1}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	third, _ := LoadCacheHistory(path)
+	if got, _ := third.Totals(httpcache.CacheStats{}); got.HitCount != 33 || got.BytesServed != 15 {
+		t.Errorf("after second restart = %+v, want the totals carried over again", got)
+	}
+	if matches, _ := filepath.Glob(path + ".tmp-*"); len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestCacheHistoryWithoutFile(t *testing.T) {
+	h, err := LoadCacheHistory("")
+	if err != nil {
+		t.Fatalf("LoadCacheHistory(\"\") error = %v", err)
+	}
+	if err := h.Save(httpcache.CacheStats{HitCount: 1}); err != nil {
+		t.Errorf("Save() without a path error = %v", err)
+	}
+	cumulative, uptime := h.Totals(httpcache.CacheStats{HitCount: 2})
+	if cumulative != uptime {
+		t.Errorf("cumulative %+v != uptime %+v without a stats file", cumulative, uptime)
+	}
+}
+
+func TestCacheHistoryUnreadableFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := LoadCacheHistory(path)
+	if err == nil {
+		t.Fatal("LoadCacheHistory() of a corrupt file returned no error")
+	}
+	if got, _ := h.Totals(httpcache.CacheStats{HitCount: 4}); got.HitCount != 4 {
+		t.Errorf("cumulative hits = %d, want a new history counting 4", got.HitCount)
+	}
+}
+
+func TestCacheHandlerStatsWithHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	if err := os.WriteFile(path, []byte(`{"hit_count":70,"miss_count":10,"bytes_served":4096,"since":"2026-01-01T00:00:00Z"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	history, err := LoadCacheHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeCache{stats: httpcache.CacheStats{HitCount: 10, MissCount: 10}}
+	h := NewCacheHandlerWithHistory(c, history, logger.New(logger.Config{Format: logger.FormatJSON, Level: logger.ErrorLevel}))
+
+	rec := httptest.NewRecorder()
+	h.HandleCacheStats(rec, httptest.NewRequest(http.MethodGet, "/api/cache/stats", nil))
+	var got CacheStatsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.HitCount != 80 || got.MissCount != 20 || got.BytesServed != 4096 || got.HitRate != 0.8 {
+		t.Errorf("cumulative = %d hits, %d misses, %d bytes, rate %v; want 80, 20, 4096, 0.8", got.HitCount, got.MissCount, got.BytesServed, got.HitRate)
+	}
+	if got.Since.Format("2006-01-02") != "2026-01-01" {
+		t.Errorf("since = %s, want the saved start", got.Since)
+	}
+	if got.Uptime.HitCount != 10 || got.Uptime.MissCount != 10 || got.Uptime.HitRate != 0.5 {
+		t.Errorf("uptime = %+v, want 10 hits, 10 misses, rate 0.5", got.Uptime)
+	}
+}
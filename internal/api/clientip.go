@@ -22,9 +22,11 @@ import (
 )
 
 // ClientIPExtractor returns the "real" client IP for an incoming request,
-// honouring X-Forwarded-For only when the immediate peer is a trusted proxy.
+// honouring Forwarded / X-Forwarded-For only when the immediate peer is a
+// trusted proxy.
 //
-// This is shared between the auth and rate-limit middlewares so they cannot
+// This is shared between the auth and rate-limit middlewares (and the
+// access log) so they cannot
 // drift: if rate-limiting honours XFF for trusted proxies but auth logging
 // records r.RemoteAddr, operators get inconsistent forensic trails.
 //
@@ -64,31 +66,72 @@ func (e *ClientIPExtractor) AddTrustedProxy(n *net.IPNet) {
 }
 
 // ClientIP returns the request's client IP. When the immediate peer
-// (r.RemoteAddr) is in trustedProxies, the left-most syntactically valid
-// entry of X-Forwarded-For is preferred; otherwise the peer's host part is
-// used. Whitespace inside an XFF entry is rejected so attackers cannot
-// smuggle a fake left-most identifier (e.g. "1.2.3.4 attacker").
+// (r.RemoteAddr) is in trustedProxies, the forwarding chain in Forwarded
+// (RFC 7239 for= parameters) or, without it, X-Forwarded-For is walked
+// from the right, skipping the addresses of trusted proxies: the rightmost
+// untrusted entry is the client, as every entry left of it may have been
+// made up by the client itself. Otherwise the peer's host part is used.
 func (e *ClientIPExtractor) ClientIP(r *http.Request) string {
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	return e.ClientIPFromPeer(r.RemoteAddr, r.Header.Get("X-Forwarded-For"), r.Header.Get("Forwarded"))
+}
+
+// ClientIPFromPeer is ClientIP for a request from peer (host:port) with
+// the given X-Forwarded-For and Forwarded header values, for callers that
+// do not hold an *http.Request, such as Fiber middlewares. When every
+// forwarding hop is trusted the left-most entry is returned. An entry that
+// is not an IP address, such as an obfuscated identifier or one with
+// embedded whitespace ("1.2.3.4 attacker"), ends the walk: the peer's host
+// is returned rather than guessing past it.
+func (e *ClientIPExtractor) ClientIPFromPeer(peer, xForwardedFor, forwarded string) string {
+	host, _, err := net.SplitHostPort(peer)
 	if err != nil {
-		host = r.RemoteAddr
+		host = peer
 	}
 	if !e.isTrustedProxy(host) {
 		return host
 	}
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff == "" {
-		return host
+	var chain []string
+	if forwarded != "" {
+		chain = forwardedFor(forwarded)
+	} else if xForwardedFor != "" {
+		chain = strings.Split(xForwardedFor, ",")
 	}
-	first := xff
-	if i := strings.IndexByte(xff, ','); i >= 0 {
-		first = xff[:i]
+	for i := len(chain) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(chain[i])
+		if net.ParseIP(entry) == nil {
+			return host
+		}
+		if i == 0 || !e.isTrustedProxy(entry) {
+			return entry
+		}
 	}
-	first = strings.TrimSpace(first)
-	if first == "" || strings.ContainsAny(first, " \t") || net.ParseIP(first) == nil {
-		return host
+	return host
+}
+
+// forwardedFor returns the for= addresses of a Forwarded header value,
+// one per forwarding element, without quotes, IPv6 brackets or ports.
+// An element without for= yields "", which ClientIPFromPeer rejects.
+func forwardedFor(value string) []string {
+	var chain []string
+	for _, element := range strings.Split(value, ",") {
+		addr := ""
+		for _, pair := range strings.Split(element, ";") {
+			name, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(name, "for") {
+				continue
+			}
+			addr = strings.Trim(v, `"`)
+			if strings.HasPrefix(addr, "[") {
+				if end := strings.IndexByte(addr, ']'); end > 0 {
+					addr = addr[1:end]
+				}
+			} else if h, _, err := net.SplitHostPort(addr); err == nil {
+				addr = h
+			}
+		}
+		chain = append(chain, addr)
 	}
-	return first
+	return chain
 }
 
 func (e *ClientIPExtractor) isTrustedProxy(host string) bool {
@@ -64,3 +64,26 @@ func TestClientIPExtractor_IgnoresInvalidCIDR(t *testing.T) {
 		t.Fatalf("trusted proxy CIDR should still apply, got %q", got)
 	}
 }
+
+func TestClientIPExtractor_ForwardedChain(t *testing.T) {
+	e := NewClientIPExtractor([]string{"10.0.0.0/8", "192.168.0.0/16"})
+	tests := []struct {
+		name, peer, xff, forwarded, want string
+	}{
+		{"spoofed left entries", "10.1.2.3:443", "6.6.6.6, 198.51.100.42, 192.168.1.1", "", "198.51.100.42"},
+		{"every hop trusted", "10.1.2.3:443", "192.168.1.9, 10.0.0.1", "", "192.168.1.9"},
+		{"untrusted peer", "203.0.113.7:443", "198.51.100.42", "", "203.0.113.7"},
+		{"untrusted peer with forwarded", "203.0.113.7:443", "", "for=198.51.100.42", "203.0.113.7"},
+		{"forwarded", "10.1.2.3:443", "", `for=6.6.6.6, for=198.51.100.42;proto=https, for="10.0.0.1:8080"`, "198.51.100.42"},
+		{"forwarded ipv6", "10.1.2.3:443", "", `for="[2001:db8:cafe::17]:4711"`, "2001:db8:cafe::17"},
+		{"forwarded wins over xff", "10.1.2.3:443", "6.6.6.6", "For=198.51.100.42", "198.51.100.42"},
+		{"obfuscated hop", "10.1.2.3:443", "", "for=198.51.100.42, for=_hidden", "10.1.2.3"},
+		{"element without for", "10.1.2.3:443", "", "by=10.0.0.1;proto=http", "10.1.2.3"},
+		{"no chain", "10.1.2.3:443", "", "", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		if got := e.ClientIPFromPeer(tt.peer, tt.xff, tt.forwarded); got != tt.want {
+			t.Errorf("%s: ClientIPFromPeer() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+)
+
+// DistrosHandler exposes the per-Server distribution registry so operators
+// can confirm which distributions (built-in and distributions.yaml) are
+// actually loaded.
+//
+// reloadFunc re-reads distributions.yaml into the registry and rebuilds the
+// proxy's host patterns and rewriters, returning the number of registered
+// distributions. Like MirrorsHandler, there is no package-global fallback.
+type DistrosHandler struct {
+	registry   *distro.Registry
+	log        *logger.Logger
+	reloadFunc func() (int, error)
+}
+
+// NewDistrosHandler creates a new DistrosHandler backed by registry.
+// reloadFunc may be nil, in which case HandleDistrosReload returns 500.
+func NewDistrosHandler(registry *distro.Registry, log *logger.Logger, reloadFunc func() (int, error)) *DistrosHandler {
+	return &DistrosHandler{
+		registry:   registry,
+		log:        log,
+		reloadFunc: reloadFunc,
+	}
+}
+
+// HandleDistros returns every registered distribution, ordered by type and ID.
+func (h *DistrosHandler) HandleDistros(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		WriteAppError(w, apperrors.New(apperrors.ErrMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	if h.registry == nil {
+		WriteAppError(w, apperrors.New(apperrors.ErrInternal, "distribution registry not configured"))
+		return
+	}
+
+	all := h.registry.GetAll()
+	infos := make([]DistroInfo, 0, len(all))
+	for _, d := range all {
+		info := DistroInfo{
+			ID:             d.ID,
+			Name:           d.Name,
+			Type:           d.Type,
+			BenchmarkURL:   d.BenchmarkURL,
+			MirrorCount:    len(d.Mirrors),
+			CacheRuleCount: len(d.CacheRules),
+		}
+		if d.URLPattern != nil {
+			info.URLPattern = d.URLPattern.String()
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Type != infos[j].Type {
+			return infos[i].Type < infos[j].Type
+		}
+		return infos[i].ID < infos[j].ID
+	})
+
+	resp := DistrosResponse{
+		Count:         len(infos),
+		Distributions: infos,
+	}
+	if err := WriteJSON(w, http.StatusOK, resp); err != nil {
+		h.log.Error().Err(err).Msg("failed to write distros response")
+	}
+}
+
+// HandleDistrosReload reloads the distributions config without a SIGHUP.
+// A config that fails to load, or has an entry that does not register, is
+// reported as 400 and leaves the previous registry in place.
+func (h *DistrosHandler) HandleDistrosReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteAppError(w, apperrors.New(apperrors.ErrMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	if h.reloadFunc == nil {
+		h.log.Error().Msg("distros handler has no reload function configured")
+		WriteAppError(w, apperrors.New(apperrors.ErrInternal,
+			"distros handler not wired to a server (missing reloadFunc)"))
+		return
+	}
+
+	start := time.Now()
+	count, err := h.reloadFunc()
+	duration := time.Since(start)
+	if err != nil {
+		h.log.Warn().Err(err).Msg("distributions reload failed")
+		WriteAppError(w, apperrors.Wrap(apperrors.ErrConfigInvalid, "failed to reload distributions config", err))
+		return
+	}
+
+	h.log.Info().
+		Int("count", count).
+		Dur("duration", duration).
+		Msg("distributions reload completed")
+
+	resp := DistrosReloadResponse{
+		Success:    true,
+		Message:    "Distributions config reloaded",
+		Count:      count,
+		DurationMs: duration.Milliseconds(),
+	}
+	if err := WriteJSON(w, http.StatusOK, resp); err != nil {
+		h.log.Error().Err(err).Msg("failed to write distros reload response")
+	}
+}
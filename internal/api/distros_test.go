@@ -0,0 +1,106 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+func TestDistrosHandlerListsBuiltins(t *testing.T) {
+	h := NewDistrosHandler(distro.NewBuiltinRegistry(), newTestLogger(), nil)
+
+	rec := httptest.NewRecorder()
+	h.HandleDistros(rec, httptest.NewRequest(http.MethodGet, "/api/distros", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body=%s", rec.Code, rec.Body.String())
+	}
+
+	var got DistrosResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	byID := make(map[string]DistroInfo, len(got.Distributions))
+	for _, d := range got.Distributions {
+		byID[d.ID] = d
+	}
+	for _, id := range []string{distro.DistroUbuntu, distro.DistroUbuntuPorts, distro.DistroDebian, distro.DistroCentOS, distro.DistroAlpine} {
+		d, ok := byID[id]
+		if !ok {
+			t.Errorf("built-in distro %q missing from response", id)
+			continue
+		}
+		if d.URLPattern == "" || d.BenchmarkURL == "" || d.MirrorCount == 0 || d.CacheRuleCount == 0 {
+			t.Errorf("distro %q has incomplete info: %+v", id, d)
+		}
+	}
+	if got.Count != len(got.Distributions) {
+		t.Errorf("count = %d, want %d", got.Count, len(got.Distributions))
+	}
+	if got.Distributions[0].Type != distro.TypeUbuntu {
+		t.Errorf("first entry type = %d, want ubuntu (sorted by type)", got.Distributions[0].Type)
+	}
+}
+
+func TestDistrosHandlerRejectsPost(t *testing.T) {
+	h := NewDistrosHandler(distro.NewBuiltinRegistry(), newTestLogger(), nil)
+	rec := httptest.NewRecorder()
+	h.HandleDistros(rec, httptest.NewRequest(http.MethodPost, "/api/distros", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want 405", rec.Code)
+	}
+}
+
+func TestDistrosHandlerReload(t *testing.T) {
+	h := NewDistrosHandler(distro.NewBuiltinRegistry(), newTestLogger(), func() (int, error) { return 6, nil })
+	rec := httptest.NewRecorder()
+	h.HandleDistrosReload(rec, httptest.NewRequest(http.MethodPost, "/api/distros/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body=%s", rec.Code, rec.Body.String())
+	}
+	var got DistrosReloadResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !got.Success || got.Count != 6 {
+		t.Errorf("unexpected response: %+v", got)
+	}
+}
+
+func TestDistrosHandlerReloadParseError(t *testing.T) {
+	h := NewDistrosHandler(distro.NewBuiltinRegistry(), newTestLogger(), func() (int, error) {
+		return 0, errors.New("yaml: line 3: mapping values are not allowed")
+	})
+	rec := httptest.NewRecorder()
+	h.HandleDistrosReload(rec, httptest.NewRequest(http.MethodPost, "/api/distros/reload", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400; body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDistrosHandlerReloadRejectsGet(t *testing.T) {
+	h := NewDistrosHandler(distro.NewBuiltinRegistry(), newTestLogger(), func() (int, error) { return 0, nil })
+	rec := httptest.NewRecorder()
+	h.HandleDistrosReload(rec, httptest.NewRequest(http.MethodGet, "/api/distros/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want 405", rec.Code)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	health "github.com/soulteary/health-kit"
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+)
+
+// HealthHandler serves /api/health, a JSON superset of /healthz for
+// dashboards. It never probes mirrors itself: mirror reachability and
+// latency come from the last benchmark, supplied by mirrorsFunc, and the
+// proxy mode from modeFunc.
+type HealthHandler struct {
+	log         *logger.Logger
+	aggregator  *health.Aggregator
+	cache       httpcache.ExtendedCache
+	maxSize     int64
+	startedAt   time.Time
+	mirrorsFunc func() []MirrorHealth
+	modeFunc    func() ModeHealth
+}
+
+// NewHealthHandler creates a HealthHandler. maxSize is the configured
+// cache size limit in bytes (0 = unlimited); mirrorsFunc and modeFunc may
+// be nil.
+func NewHealthHandler(log *logger.Logger, aggregator *health.Aggregator, cache httpcache.ExtendedCache, maxSize int64, startedAt time.Time, mirrorsFunc func() []MirrorHealth, modeFunc func() ModeHealth) *HealthHandler {
+	return &HealthHandler{
+		log:         log,
+		aggregator:  aggregator,
+		cache:       cache,
+		maxSize:     maxSize,
+		startedAt:   startedAt,
+		mirrorsFunc: mirrorsFunc,
+		modeFunc:    modeFunc,
+	}
+}
+
+// HandleHealth reports the health checks, cache utilization, uptime and
+// per-distribution mirror state and proxy mode. Like /healthz it answers 503 when a
+// critical check fails, and 200 with status "degraded" when only others do.
+func (h *HealthHandler) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		WriteAppError(w, apperrors.New(apperrors.ErrMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	// The aggregator applies its own timeout; see fiberHealthHandler for
+	// why the request context is not passed down.
+	result := h.aggregator.Check(context.Background())
+
+	stats := h.cache.Stats()
+	cache := CacheHealth{
+		TotalSizeBytes: stats.TotalSize,
+		MaxSizeBytes:   h.maxSize,
+		ItemCount:      stats.ItemCount,
+		HitRate:        CalculateHitRate(stats.HitCount, stats.MissCount),
+	}
+	if h.maxSize > 0 {
+		cache.Utilization = float64(stats.TotalSize) / float64(h.maxSize)
+	}
+
+	var mirrors []MirrorHealth
+	if h.mirrorsFunc != nil {
+		mirrors = h.mirrorsFunc()
+	}
+	if mirrors == nil {
+		mirrors = []MirrorHealth{}
+	}
+
+	resp := HealthResponse{
+		Status:        result.Status.String(),
+		StartedAt:     h.startedAt,
+		UptimeSeconds: int64(time.Since(h.startedAt).Seconds()),
+		Checks:        result.Checks,
+		Cache:         cache,
+		Mirrors:       mirrors,
+	}
+	if h.modeFunc != nil {
+		mode := h.modeFunc()
+		if mode.ActiveDistros == nil {
+			mode.ActiveDistros = []string{}
+		}
+		resp.Mode = &mode
+	}
+	if err := WriteJSON(w, health.HTTPStatusCode(result.Status), resp); err != nil {
+		h.log.Error().Err(err).Msg("failed to write health response")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	health "github.com/soulteary/health-kit"
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+)
+
+func newTestHealthHandler(checkErr error, mirrors []MirrorHealth) *HealthHandler {
+	agg := health.NewAggregator(health.DefaultConfig().WithServiceName("apt-proxy"))
+	agg.AddChecker(health.NewCustomChecker("cache", func(context.Context) error { return checkErr }))
+	c := &fakeCache{stats: httpcache.CacheStats{TotalSize: 256, ItemCount: 2, HitCount: 3, MissCount: 1}}
+	log := logger.New(logger.Config{Format: logger.FormatJSON, Level: logger.ErrorLevel})
+	return NewHealthHandler(log, agg, c, 1024, time.Now().Add(-90*time.Second), func() []MirrorHealth { return mirrors }, nil)
+}
+
+func TestHealthHandlerReportsMirrorsCacheAndUptime(t *testing.T) {
+	reachable, latency, at := true, int64(42), time.Now()
+	h := newTestHealthHandler(nil, []MirrorHealth{
+		{Distro: "ubuntu", Mirror: "http://mirrors.example.com/ubuntu/", Reachable: &reachable, LatencyMs: &latency, BenchmarkedAt: &at},
+		{Distro: "debian", Mirror: "http://deb.example.com/debian/"},
+	})
+
+	rec := httptest.NewRecorder()
+	h.HandleHealth(rec, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body=%s", rec.Code, rec.Body.String())
+	}
+
+	var raw struct {
+		Status        string                     `json:"status"`
+		UptimeSeconds int64                      `json:"uptime_seconds"`
+		Checks        map[string]json.RawMessage `json:"checks"`
+		Cache         CacheHealth                `json:"cache"`
+		Mirrors       []map[string]any           `json:"mirrors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if raw.Status != "ok" || raw.UptimeSeconds < 90 {
+		t.Errorf("status=%q uptime=%d, want ok and >= 90", raw.Status, raw.UptimeSeconds)
+	}
+	if _, ok := raw.Checks["cache"]; !ok {
+		t.Errorf("checks = %v, want the cache check", raw.Checks)
+	}
+	if raw.Cache.Utilization != 0.25 || raw.Cache.MaxSizeBytes != 1024 || raw.Cache.HitRate != 0.75 {
+		t.Errorf("cache = %+v, want utilization 0.25 of 1024 and hit rate 0.75", raw.Cache)
+	}
+	if len(raw.Mirrors) != 2 {
+		t.Fatalf("mirrors = %v, want 2 entries", raw.Mirrors)
+	}
+	for _, m := range raw.Mirrors {
+		if _, ok := m["latency_ms"]; !ok {
+			t.Errorf("mirror %v has no latency_ms field", m["distro"])
+		}
+	}
+	if raw.Mirrors[0]["latency_ms"] != float64(42) || raw.Mirrors[0]["reachable"] != true {
+		t.Errorf("ubuntu = %v, want latency_ms 42 and reachable", raw.Mirrors[0])
+	}
+	if raw.Mirrors[1]["latency_ms"] != nil || raw.Mirrors[1]["reachable"] != nil {
+		t.Errorf("debian = %v, want null latency/reachable for an unbenchmarked mirror", raw.Mirrors[1])
+	}
+}
+
+func TestHealthHandlerUnhealthy(t *testing.T) {
+	h := newTestHealthHandler(errors.New("cache dir gone"), nil)
+	rec := httptest.NewRecorder()
+	h.HandleHealth(rec, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+	var resp HealthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Mirrors == nil {
+		t.Error("mirrors should encode as [] rather than null")
+	}
+}
+
+func TestHealthHandlerMethodNotAllowed(t *testing.T) {
+	h := newTestHealthHandler(nil, nil)
+	rec := httptest.NewRecorder()
+	h.HandleHealth(rec, httptest.NewRequest(http.MethodPost, "/api/health", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want 405", rec.Code)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	logger "github.com/soulteary/logger-kit"
+
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+)
+
+// MaintenanceHandler reports and toggles the proxy's maintenance mode, in
+// which package requests are answered with 503 while health checks stay
+// green. status returns whether it is on and the Retry-After sent; set
+// switches it.
+type MaintenanceHandler struct {
+	log    *logger.Logger
+	status func() (bool, time.Duration)
+	set    func(bool)
+}
+
+// NewMaintenanceHandler creates a new MaintenanceHandler.
+func NewMaintenanceHandler(log *logger.Logger, status func() (bool, time.Duration), set func(bool)) *MaintenanceHandler {
+	return &MaintenanceHandler{log: log, status: status, set: set}
+}
+
+// HandleMaintenance returns the maintenance mode state on GET, and sets it
+// from a {"enabled": true} body on POST.
+func (h *MaintenanceHandler) HandleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req MaintenanceRequest
+		if r.Body == nil || json.NewDecoder(r.Body).Decode(&req) != nil || req.Enabled == nil {
+			WriteAppError(w, apperrors.New(apperrors.ErrRequestInvalid, "request body must be JSON like {\"enabled\": true}"))
+			return
+		}
+		h.set(*req.Enabled)
+		h.log.Info().Bool("enabled", *req.Enabled).Msg("maintenance mode set through the API")
+	default:
+		WriteAppError(w, apperrors.New(apperrors.ErrMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	enabled, retryAfter := h.status()
+	resp := MaintenanceResponse{Enabled: enabled, RetryAfterSec: int(retryAfter / time.Second)}
+	if err := WriteJSON(w, http.StatusOK, resp); err != nil {
+		h.log.Error().Err(err).Msg("failed to write maintenance response")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	logger "github.com/soulteary/logger-kit"
+)
+
+func TestMaintenanceHandler(t *testing.T) {
+	on := false
+	h := NewMaintenanceHandler(logger.New(logger.Config{Format: logger.FormatJSON, Level: logger.ErrorLevel}),
+		func() (bool, time.Duration) { return on, 2 * time.Minute },
+		func(v bool) { on = v })
+
+	send := func(method, body string) (int, MaintenanceResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.HandleMaintenance(rec, httptest.NewRequest(method, "/api/maintenance", strings.NewReader(body)))
+		var got MaintenanceResponse
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+		}
+		return rec.Code, got
+	}
+
+	if code, got := send(http.MethodGet, ""); code != http.StatusOK || got.Enabled || got.RetryAfterSec != 120 {
+		t.Errorf("GET = %d %+v, want 200, off, 120s", code, got)
+	}
+	if code, got := send(http.MethodPost, `{"enabled":true}`); code != http.StatusOK || !got.Enabled || !on {
+		t.Errorf("POST enabled = %d %+v, want 200 and maintenance on", code, got)
+	}
+	for _, body := range []string{"", "{}", "not json", `{"enabled":"yes"}`} {
+		if code, _ := send(http.MethodPost, body); code != http.StatusBadRequest {
+			t.Errorf("POST %q = %d, want 400", body, code)
+		}
+	}
+	if !on {
+		t.Error("a rejected POST turned maintenance mode off")
+	}
+	if code, _ := send(http.MethodPut, `{"enabled":false}`); code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT = %d, want 405", code)
+	}
+	if code, got := send(http.MethodPost, `{"enabled":false}`); code != http.StatusOK || got.Enabled || on {
+		t.Errorf("POST disabled = %d %+v, want 200 and maintenance off", code, got)
+	}
+}
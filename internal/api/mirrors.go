@@ -15,41 +15,104 @@
 package api
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	logger "github.com/soulteary/logger-kit"
 
 	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+	"github.com/soulteary/apt-proxy/internal/mirrors"
 )
 
+// GeoLookup is the part of a Server's geo mirror lookup the mirrors API
+// reports on and refreshes. *mirrors.GeoLookup implements it.
+type GeoLookup interface {
+	BreakerStatus() mirrors.BreakerStatus
+	Invalidate()
+}
+
 // MirrorsHandler handles mirror-related API endpoints.
 //
 // reloadFunc is required: it is the per-Server reload closure that owns
-// distribution-registry reload + mirror refresh. The handler intentionally
-// has no package-global fallback so that misconfigured callers fail loudly
-// rather than mutating an unrelated Server's state.
+// distribution-registry reload + mirror refresh. geo is the same Server's
+// geo lookup. The handler intentionally has no package-global fallback so
+// that misconfigured callers fail loudly rather than mutating an unrelated
+// Server's state.
+//
+// refreshDistroFunc serves ?distro=<id>: it re-benchmarks one distribution
+// and should return an *apperrors.AppError for unknown or inactive IDs.
 type MirrorsHandler struct {
-	log        *logger.Logger
-	reloadFunc func()
+	log               *logger.Logger
+	geo               GeoLookup
+	reloadFunc        func()
+	refreshDistroFunc func(id string) error
 }
 
 // NewMirrorsHandler creates a new MirrorsHandler. reloadFunc is required;
-// passing nil makes HandleMirrorsRefresh return 500.
-func NewMirrorsHandler(log *logger.Logger, reloadFunc func()) *MirrorsHandler {
+// passing nil makes HandleMirrorsRefresh return 500. A nil geo makes
+// HandleMirrors and ?refresh_geo=true requests return 500.
+// refreshDistroFunc may be nil, in which case ?distro= requests return 501.
+func NewMirrorsHandler(log *logger.Logger, geo GeoLookup, reloadFunc func(), refreshDistroFunc func(id string) error) *MirrorsHandler {
 	return &MirrorsHandler{
-		log:        log,
-		reloadFunc: reloadFunc,
+		log:               log,
+		geo:               geo,
+		reloadFunc:        reloadFunc,
+		refreshDistroFunc: refreshDistroFunc,
+	}
+}
+
+// HandleMirrors reports mirror-selection state, currently the geo mirror
+// API circuit breaker.
+func (h *MirrorsHandler) HandleMirrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		WriteAppError(w, apperrors.New(apperrors.ErrMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	if h.geo == nil {
+		h.writeNoGeo(w)
+		return
+	}
+	resp := MirrorsStatusResponse{GeoBreaker: h.geo.BreakerStatus()}
+	if err := WriteJSON(w, http.StatusOK, resp); err != nil {
+		h.log.Error().Err(err).Msg("failed to write mirrors status response")
 	}
 }
 
 // HandleMirrorsRefresh triggers distribution config reload and mirror refresh.
+// With ?distro=<id> only that distribution is re-benchmarked and its
+// rewriter rebuilt; the config is not reloaded. ?refresh_geo=true also
+// drops the cached geo mirror list first, so Ubuntu candidates are fetched
+// again even when mirrors.geo.cache_ttl_sec has not elapsed.
 func (h *MirrorsHandler) HandleMirrorsRefresh(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		WriteAppError(w, apperrors.New(apperrors.ErrMethodNotAllowed, "Method not allowed"))
 		return
 	}
 
+	refreshGeo := false
+	if v := r.URL.Query().Get("refresh_geo"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			WriteAppError(w, apperrors.New(apperrors.ErrRequestInvalid, "refresh_geo must be a boolean"))
+			return
+		}
+		refreshGeo = b
+	}
+	if refreshGeo && h.geo == nil {
+		h.writeNoGeo(w)
+		return
+	}
+
+	if id := r.URL.Query().Get("distro"); id != "" {
+		if refreshGeo && h.refreshDistroFunc != nil {
+			h.geo.Invalidate()
+		}
+		h.refreshDistro(w, id, refreshGeo)
+		return
+	}
+
 	if h.reloadFunc == nil {
 		h.log.Error().Msg("mirrors handler has no reload function configured")
 		WriteAppError(w, apperrors.New(apperrors.ErrInternal,
@@ -57,21 +120,70 @@ func (h *MirrorsHandler) HandleMirrorsRefresh(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	if refreshGeo {
+		h.geo.Invalidate()
+	}
 	start := time.Now()
 	h.reloadFunc()
 	duration := time.Since(start)
 
 	h.log.Info().
+		Bool("refresh_geo", refreshGeo).
 		Dur("duration", duration).
 		Msg("mirrors refresh completed")
 
 	resp := MirrorsRefreshResponse{
-		Success:    true,
-		Message:    "Mirror configurations refreshed",
-		DurationMs: duration.Milliseconds(),
+		Success:      true,
+		Message:      "Mirror configurations refreshed",
+		GeoRefreshed: refreshGeo,
+		DurationMs:   duration.Milliseconds(),
 	}
 
 	if err := WriteJSON(w, http.StatusOK, resp); err != nil {
 		h.log.Error().Err(err).Msg("failed to write mirrors refresh response")
 	}
 }
+
+// writeNoGeo answers a request that needs the geo lookup the handler was
+// built without.
+func (h *MirrorsHandler) writeNoGeo(w http.ResponseWriter) {
+	h.log.Error().Msg("mirrors handler has no geo lookup configured")
+	WriteAppError(w, apperrors.New(apperrors.ErrInternal,
+		"mirrors handler not wired to a server (missing geo lookup)"))
+}
+
+func (h *MirrorsHandler) refreshDistro(w http.ResponseWriter, id string, refreshGeo bool) {
+	if h.refreshDistroFunc == nil {
+		WriteAppError(w, apperrors.New(apperrors.ErrNotImplemented,
+			"per-distribution refresh is not supported by this server"))
+		return
+	}
+
+	start := time.Now()
+	if err := h.refreshDistroFunc(id); err != nil {
+		var appErr *apperrors.AppError
+		if !errors.As(err, &appErr) {
+			appErr = apperrors.Wrap(apperrors.ErrInternal, "failed to refresh distribution", err)
+		}
+		WriteAppError(w, appErr)
+		return
+	}
+	duration := time.Since(start)
+
+	h.log.Info().
+		Str("distro", id).
+		Bool("refresh_geo", refreshGeo).
+		Dur("duration", duration).
+		Msg("distribution mirror refresh completed")
+
+	resp := MirrorsRefreshResponse{
+		Success:      true,
+		Message:      "Mirror configuration refreshed for " + id,
+		Distro:       id,
+		GeoRefreshed: refreshGeo,
+		DurationMs:   duration.Milliseconds(),
+	}
+	if err := WriteJSON(w, http.StatusOK, resp); err != nil {
+		h.log.Error().Err(err).Msg("failed to write mirrors refresh response")
+	}
+}
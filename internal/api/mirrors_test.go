@@ -21,10 +21,26 @@ import (
 	"testing"
 
 	logger "github.com/soulteary/logger-kit"
+
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+	"github.com/soulteary/apt-proxy/internal/mirrors"
 )
 
+// fakeGeoLookup reports a fixed breaker status and counts invalidations.
+type fakeGeoLookup struct {
+	status      mirrors.BreakerStatus
+	invalidated int
+}
+
+func (f *fakeGeoLookup) BreakerStatus() mirrors.BreakerStatus { return f.status }
+func (f *fakeGeoLookup) Invalidate()                          { f.invalidated++ }
+
 func newTestMirrorsHandler(reload func()) *MirrorsHandler {
-	return NewMirrorsHandler(logger.New(logger.Config{Format: logger.FormatJSON, Level: logger.ErrorLevel}), reload)
+	return newTestMirrorsHandlerWithGeo(reload, &fakeGeoLookup{})
+}
+
+func newTestMirrorsHandlerWithGeo(reload func(), geo GeoLookup) *MirrorsHandler {
+	return NewMirrorsHandler(logger.New(logger.Config{Format: logger.FormatJSON, Level: logger.ErrorLevel}), geo, reload, nil)
 }
 
 func TestMirrorsHandlerRefreshCallsReloadFunc(t *testing.T) {
@@ -70,3 +86,107 @@ func TestMirrorsHandlerRefreshErrorsWithoutReloadFunc(t *testing.T) {
 		t.Fatalf("status = %d, want 500", rec.Code)
 	}
 }
+
+func TestMirrorsHandlerReportsGeoBreaker(t *testing.T) {
+	geo := &fakeGeoLookup{status: mirrors.BreakerStatus{State: mirrors.BreakerOpen, FailureThreshold: 4}}
+	h := newTestMirrorsHandlerWithGeo(nil, geo)
+	rec := httptest.NewRecorder()
+	h.HandleMirrors(rec, httptest.NewRequest(http.MethodGet, "/api/mirrors", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body=%s", rec.Code, rec.Body.String())
+	}
+	var got MirrorsStatusResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.GeoBreaker.State != mirrors.BreakerOpen || got.GeoBreaker.FailureThreshold != 4 {
+		t.Errorf("geo_breaker = %+v, want the injected lookup's status", got.GeoBreaker)
+	}
+
+	rec = httptest.NewRecorder()
+	h.HandleMirrors(rec, httptest.NewRequest(http.MethodPost, "/api/mirrors", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status = %d, want 405", rec.Code)
+	}
+}
+
+func TestMirrorsHandlerRefreshGeo(t *testing.T) {
+	reloads := 0
+	geo := &fakeGeoLookup{}
+	h := newTestMirrorsHandlerWithGeo(func() { reloads++ }, geo)
+
+	rec := httptest.NewRecorder()
+	h.HandleMirrorsRefresh(rec, httptest.NewRequest(http.MethodPost, "/api/mirrors/refresh?refresh_geo=true", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body=%s", rec.Code, rec.Body.String())
+	}
+	var got MirrorsRefreshResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !got.GeoRefreshed || reloads != 1 || geo.invalidated != 1 {
+		t.Errorf("resp=%+v reloads=%d invalidated=%d; want geo_refreshed, one reload and the injected lookup invalidated", got, reloads, geo.invalidated)
+	}
+
+	rec = httptest.NewRecorder()
+	h.HandleMirrorsRefresh(rec, httptest.NewRequest(http.MethodPost, "/api/mirrors/refresh?refresh_geo=maybe", nil))
+	if rec.Code != http.StatusBadRequest || reloads != 1 {
+		t.Errorf("invalid refresh_geo: status = %d, reloads = %d; want 400 without a reload", rec.Code, reloads)
+	}
+}
+
+func TestMirrorsHandlerRefreshSingleDistro(t *testing.T) {
+	var reloads int
+	var refreshed []string
+	h := NewMirrorsHandler(logger.New(logger.Config{Format: logger.FormatJSON, Level: logger.ErrorLevel}), &fakeGeoLookup{},
+		func() { reloads++ },
+		func(id string) error {
+			if id != "ubuntu" {
+				return apperrors.New(apperrors.ErrResourceNotFound, "unknown distribution: "+id)
+			}
+			refreshed = append(refreshed, id)
+			return nil
+		})
+
+	rec := httptest.NewRecorder()
+	h.HandleMirrorsRefresh(rec, httptest.NewRequest(http.MethodPost, "/api/mirrors/refresh?distro=ubuntu", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body=%s", rec.Code, rec.Body.String())
+	}
+	var got MirrorsRefreshResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Distro != "ubuntu" || len(refreshed) != 1 || reloads != 0 {
+		t.Errorf("resp=%+v refreshed=%v reloads=%d; want only ubuntu refreshed, no full reload", got, refreshed, reloads)
+	}
+
+	rec = httptest.NewRecorder()
+	h.HandleMirrorsRefresh(rec, httptest.NewRequest(http.MethodPost, "/api/mirrors/refresh?distro=nope", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown distro status = %d, want 404", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	newTestMirrorsHandler(func() {}).HandleMirrorsRefresh(rec, httptest.NewRequest(http.MethodPost, "/api/mirrors/refresh?distro=ubuntu", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("without refreshDistroFunc status = %d, want 501", rec.Code)
+	}
+}
+
+func TestMirrorsHandlerWithoutGeoLookup(t *testing.T) {
+	reloads := 0
+	h := newTestMirrorsHandlerWithGeo(func() { reloads++ }, nil)
+
+	rec := httptest.NewRecorder()
+	h.HandleMirrors(rec, httptest.NewRequest(http.MethodGet, "/api/mirrors", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500 without a geo lookup", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.HandleMirrorsRefresh(rec, httptest.NewRequest(http.MethodPost, "/api/mirrors/refresh?refresh_geo=true", nil))
+	if rec.Code != http.StatusInternalServerError || reloads != 0 {
+		t.Errorf("refresh_geo status = %d, reloads = %d; want 500 without a reload", rec.Code, reloads)
+	}
+}
@@ -158,6 +158,37 @@ func TestRateLimitXFFTrustedProxy(t *testing.T) {
 	}
 }
 
+// TestRateLimitForwardedChain verifies a client cannot escape its bucket by
+// prepending addresses to X-Forwarded-For: behind a trusted proxy the
+// rightmost untrusted hop is the key, and from an untrusted peer the chain
+// is ignored.
+func TestRateLimitForwardedChain(t *testing.T) {
+	m := NewRateLimitMiddleware(1, newTestLogger(), "10.0.0.0/8")
+	wrapped := m.Wrap(okHandler())
+
+	hit := func(peer, xff string) int {
+		req := httptest.NewRequest(http.MethodGet, "/x", nil)
+		req.RemoteAddr = peer
+		req.Header.Set("X-Forwarded-For", xff)
+		rr := httptest.NewRecorder()
+		wrapped.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if c := hit("10.1.2.3:443", "198.51.100.1, 203.0.113.1, 10.0.0.9"); c != http.StatusOK {
+		t.Fatalf("trusted 1: %d", c)
+	}
+	if c := hit("10.1.2.3:443", "198.51.100.2, 203.0.113.1, 10.0.0.9"); c != http.StatusTooManyRequests {
+		t.Fatalf("trusted 2, spoofed first hop: %d", c)
+	}
+	if c := hit("203.0.113.50:443", "198.51.100.3, 10.0.0.9"); c != http.StatusOK {
+		t.Fatalf("untrusted 1: %d", c)
+	}
+	if c := hit("203.0.113.50:443", "198.51.100.4, 10.0.0.9"); c != http.StatusTooManyRequests {
+		t.Fatalf("untrusted 2, different chain: %d", c)
+	}
+}
+
 // TestRateLimitInvalidTrustedCIDR ensures invalid CIDR entries are skipped
 // without panicking.
 func TestRateLimitInvalidTrustedCIDR(t *testing.T) {
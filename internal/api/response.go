@@ -18,8 +18,12 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+	"time"
+
+	health "github.com/soulteary/health-kit"
 
 	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+	"github.com/soulteary/apt-proxy/internal/mirrors"
 	"github.com/soulteary/apt-proxy/internal/system"
 )
 
@@ -34,6 +38,38 @@ type CacheStatsResponse struct {
 	HitCount       int64   `json:"hit_count"`
 	MissCount      int64   `json:"miss_count"`
 	HitRate        float64 `json:"hit_rate"`
+	// Hits, misses and bytes served count from Since, which
+	// cache.stats_file carries across restarts; Uptime counts from this
+	// process's start.
+	BytesServed int64            `json:"bytes_served"`
+	Since       time.Time        `json:"since"`
+	Uptime      CacheUptimeStats `json:"uptime"`
+	// Pools breaks the totals down by pool when the cache is split into
+	// an index and a package pool (cache.index_max_size_mb). Their hit
+	// and miss counts are this process's.
+	Pools []CachePoolStats `json:"pools,omitempty"`
+}
+
+// CachePoolStats holds the statistics of one cache pool
+type CachePoolStats struct {
+	Name           string  `json:"name"`
+	MaxSizeBytes   int64   `json:"max_size_bytes"`
+	TotalSizeBytes int64   `json:"total_size_bytes"`
+	TotalSizeHuman string  `json:"total_size_human"`
+	ItemCount      int     `json:"item_count"`
+	StaleCount     int     `json:"stale_count"`
+	HitCount       int64   `json:"hit_count"`
+	MissCount      int64   `json:"miss_count"`
+	HitRate        float64 `json:"hit_rate"`
+}
+
+// CacheUptimeStats holds the cache counters of the running process
+type CacheUptimeStats struct {
+	HitCount    int64     `json:"hit_count"`
+	MissCount   int64     `json:"miss_count"`
+	HitRate     float64   `json:"hit_rate"`
+	BytesServed int64     `json:"bytes_served"`
+	Since       time.Time `json:"since"`
 }
 
 // CachePurgeResponse holds the result of a cache purge operation
@@ -41,6 +77,8 @@ type CachePurgeResponse struct {
 	Success      bool  `json:"success"`
 	ItemsRemoved int   `json:"items_removed"`
 	BytesFreed   int64 `json:"bytes_freed"`
+	// Distros lists the distributions purged; empty for the whole cache.
+	Distros []string `json:"distros,omitempty"`
 }
 
 // CacheCleanupResponse holds the result of a cache cleanup operation
@@ -50,15 +88,111 @@ type CacheCleanupResponse struct {
 	BytesFreed          int64 `json:"bytes_freed"`
 	StaleEntriesRemoved int   `json:"stale_entries_removed"`
 	DurationMs          int64 `json:"duration_ms"`
+	// Distros lists the distributions cleaned up; empty for the whole cache.
+	Distros []string `json:"distros,omitempty"`
 }
 
 // MirrorsRefreshResponse holds the result of a mirrors refresh operation
 type MirrorsRefreshResponse struct {
+	Success      bool   `json:"success"`
+	Message      string `json:"message"`
+	Distro       string `json:"distro,omitempty"`
+	GeoRefreshed bool   `json:"geo_refreshed,omitempty"`
+	DurationMs   int64  `json:"duration_ms"`
+}
+
+// MirrorsStatusResponse reports mirror-selection state. GeoBreaker is the
+// circuit breaker guarding the Ubuntu geo mirror API.
+type MirrorsStatusResponse struct {
+	GeoBreaker mirrors.BreakerStatus `json:"geo_breaker"`
+}
+
+// HealthResponse is the /api/health report: the /healthz checks plus the
+// state a monitoring dashboard wants alongside them.
+type HealthResponse struct {
+	Status        string                        `json:"status"`
+	StartedAt     time.Time                     `json:"started_at"`
+	UptimeSeconds int64                         `json:"uptime_seconds"`
+	Checks        map[string]health.CheckResult `json:"checks,omitempty"`
+	Cache         CacheHealth                   `json:"cache"`
+	Mirrors       []MirrorHealth                `json:"mirrors"`
+	Mode          *ModeHealth                   `json:"mode,omitempty"`
+}
+
+// CacheHealth reports cache utilization. Utilization is TotalSizeBytes
+// over MaxSizeBytes, 0 when the size is unlimited.
+type CacheHealth struct {
+	TotalSizeBytes int64   `json:"total_size_bytes"`
+	MaxSizeBytes   int64   `json:"max_size_bytes"`
+	Utilization    float64 `json:"utilization"`
+	ItemCount      int     `json:"item_count"`
+	HitRate        float64 `json:"hit_rate"`
+}
+
+// MirrorHealth reports one distribution's selected mirror and its last
+// benchmark. Reachable and LatencyMs are null when the mirror has not
+// been benchmarked (explicitly configured, or not yet requested).
+type MirrorHealth struct {
+	Distro        string     `json:"distro"`
+	Mirror        string     `json:"mirror"`
+	Reachable     *bool      `json:"reachable"`
+	LatencyMs     *int64     `json:"latency_ms"`
+	BenchmarkedAt *time.Time `json:"benchmarked_at,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	// RedirectedTo is where Mirror redirects to under another scheme,
+	// when seen and not adopted (mirrors.adopt_redirects).
+	RedirectedTo string `json:"redirected_to,omitempty"`
+}
+
+// ModeHealth reports the proxy mode as configured and as resolved.
+// Configured is empty when no mode was given; Fallback is true when a
+// configured mode did not resolve to itself, e.g. a mistyped -mode that
+// fell back to "all". ActiveDistros lists the distributions with a
+// mirror rewriter in place.
+type ModeHealth struct {
+	Configured    string   `json:"configured"`
+	Resolved      string   `json:"resolved"`
+	ResolvedType  int      `json:"resolved_type"`
+	Fallback      bool     `json:"fallback"`
+	ActiveDistros []string `json:"active_distros"`
+}
+
+// DistroInfo describes one registered distribution
+type DistroInfo struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Type           int    `json:"type"`
+	URLPattern     string `json:"url_pattern"`
+	BenchmarkURL   string `json:"benchmark_url"`
+	MirrorCount    int    `json:"mirror_count"`
+	CacheRuleCount int    `json:"cache_rule_count"`
+}
+
+// DistrosResponse lists the distributions currently in the registry
+type DistrosResponse struct {
+	Count         int          `json:"count"`
+	Distributions []DistroInfo `json:"distributions"`
+}
+
+// DistrosReloadResponse holds the result of a distributions config reload
+type DistrosReloadResponse struct {
 	Success    bool   `json:"success"`
 	Message    string `json:"message"`
+	Count      int    `json:"count"`
 	DurationMs int64  `json:"duration_ms"`
 }
 
+// MaintenanceRequest is the body of POST /api/maintenance
+type MaintenanceRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// MaintenanceResponse holds the maintenance mode state
+type MaintenanceResponse struct {
+	Enabled       bool `json:"enabled"`
+	RetryAfterSec int  `json:"retry_after_sec"`
+}
+
 // WriteJSON writes a JSON response with proper encoding
 func WriteJSON(w http.ResponseWriter, statusCode int, data interface{}) error {
 	w.Header().Set("Content-Type", "application/json")
@@ -17,15 +17,21 @@ package benchmarks
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	logger "github.com/soulteary/logger-kit"
 	"golang.org/x/sync/singleflight"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
 )
 
 // BenchmarkCache stores cached benchmark results to avoid repeated testing.
@@ -69,12 +75,17 @@ func (bc *BenchmarkCache) GetCachedResult(distType int) (string, bool) {
 
 // SetCachedResult stores a benchmark result in the cache.
 func (bc *BenchmarkCache) SetCachedResult(distType int, fastestMirror string, ttl time.Duration) {
+	bc.setCachedResultAt(distType, fastestMirror, time.Now(), ttl)
+}
+
+// setCachedResultAt stores a benchmark result obtained at at.
+func (bc *BenchmarkCache) setCachedResultAt(distType int, fastestMirror string, at time.Time, ttl time.Duration) {
 	bc.mu.Lock()
 	defer bc.mu.Unlock()
 
 	bc.results[distType] = CachedResult{
 		FastestMirror: fastestMirror,
-		CachedAt:      time.Now(),
+		CachedAt:      at,
 		TTL:           ttl,
 	}
 }
@@ -86,6 +97,13 @@ func (bc *BenchmarkCache) ClearCache() {
 	bc.results = make(map[int]CachedResult)
 }
 
+// Invalidate drops the cached result for one distribution type.
+func (bc *BenchmarkCache) Invalidate(distType int) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	delete(bc.results, distType)
+}
+
 // AsyncBenchmarkResult represents the result of an async benchmark operation.
 type AsyncBenchmarkResult struct {
 	DistType      int
@@ -101,6 +119,23 @@ const (
 	BenchmarkMaxTimeout    = 150 * time.Second // detect resource timeout
 	BenchmarkMaxTries      = 3                 // maximum number of attempts
 	BenchmarkDetectTimeout = 30 * time.Second  // for select fast mirror
+	BenchmarkDialTimeout   = 10 * time.Second  // default TCP connect timeout per probe
+)
+
+// Probe is the kind of request a benchmark try sends to a mirror.
+type Probe string
+
+// Probes accepted by Engine.WithProbe. Each measures the time to the
+// response headers plus at most the first 8 KiB of body.
+const (
+	// ProbeHead sends HEAD, transferring no body.
+	ProbeHead Probe = "head"
+	// ProbeRange sends GET with "Range: bytes=0-0", transferring one
+	// byte from mirrors that honour Range.
+	ProbeRange Probe = "range"
+	// ProbeGet sends a plain GET, for mirrors or CDNs whose HEAD answers
+	// do not reflect how fast they serve files.
+	ProbeGet Probe = "get"
 )
 
 // MaxBenchmarkConcurrency caps how many mirror benchmarks run in parallel.
@@ -112,10 +147,16 @@ const MaxBenchmarkConcurrency = 8
 // settings (connection pool, timeouts) are kept on a fresh client per Engine
 // so two engines do not share TCP connection state or mutate each other's
 // transport.
-func newBenchmarkClient() *http.Client {
+func newBenchmarkClient(dialTimeout time.Duration) *http.Client {
+	if dialTimeout <= 0 {
+		dialTimeout = BenchmarkDialTimeout
+	}
 	return &http.Client{
 		Timeout: BenchmarkMaxTimeout,
 		Transport: &http.Transport{
+			// Bound the connect so unreachable mirrors drop out of the
+			// race quickly instead of waiting for the OS TCP timeout.
+			DialContext:         (&net.Dialer{Timeout: dialTimeout}).DialContext,
 			MaxIdleConns:        100,
 			MaxIdleConnsPerHost: 10,
 			IdleConnTimeout:     90 * time.Second,
@@ -139,14 +180,163 @@ type Engine struct {
 	cache  *BenchmarkCache
 	group  singleflight.Group
 	client *http.Client
+
+	runsMu sync.RWMutex
+	runs   map[int]Run
+
+	// distros bounds how many distributions are benchmarked at once; nil
+	// means no limit. See WithDistroConcurrency.
+	distros chan struct{}
+
+	// success tracks real requests to mirrors; with minSuccess set,
+	// mirrors below that rate are only benchmarked when no other
+	// candidate answers. minSuccess holds the float64 bits of the rate,
+	// see SetMinSuccessRate.
+	success    *SuccessTracker
+	minSuccess atomic.Uint64
+
+	// probe is the request each benchmark try sends. See WithProbe.
+	probe Probe
+
+	// resultTTL is how long a benchmark result is cached; 0 selects
+	// DefaultCacheTTL. See WithResultTTL.
+	resultTTL time.Duration
+
+	// resultsFile keeps successful runs across restarts; persisted holds
+	// the runs loaded from it not yet used. See WithResultsFile.
+	resultsFile string
+	persisted   map[int]Run
+}
+
+// Run is the outcome of the most recent benchmark of one distribution
+// type. Unlike the result cache it also records failures and survives
+// ClearCache, so it can be reported while a refresh is in progress.
+type Run struct {
+	Mirror   string        // fastest mirror; empty when the run failed
+	Latency  time.Duration // mean response time of Mirror
+	RunnerUp string        // second-fastest mirror; empty when only one answered
+	Ranked   []string      // mirrors that answered, fastest first (at most three)
+	At       time.Time
+	Err      error
 }
 
 // NewEngine returns a fresh, independent Engine. Use one per Server.
 func NewEngine() *Engine {
+	return NewEngineWithDialTimeout(0)
+}
+
+// NewEngineWithDialTimeout is NewEngine with a custom per-probe connect
+// timeout; a non-positive value selects BenchmarkDialTimeout.
+func NewEngineWithDialTimeout(dialTimeout time.Duration) *Engine {
 	return &Engine{
-		cache:  NewBenchmarkCache(),
-		client: newBenchmarkClient(),
+		cache:     NewBenchmarkCache(),
+		client:    newBenchmarkClient(dialTimeout),
+		runs:      make(map[int]Run),
+		persisted: make(map[int]Run),
+		success:   NewSuccessTracker(),
+	}
+}
+
+// WithDistroConcurrency limits the engine to benchmarking n distributions
+// at a time; further distributions wait for a slot. Each benchmark still
+// probes up to MaxBenchmarkConcurrency mirrors in parallel, so this bounds
+// startup sockets to about n*MaxBenchmarkConcurrency in "all" mode. A
+// non-positive n leaves the engine unlimited. Call it before the engine
+// is first used.
+func (e *Engine) WithDistroConcurrency(n int) *Engine {
+	if n > 0 {
+		e.distros = make(chan struct{}, n)
+	} else {
+		e.distros = nil
+	}
+	return e
+}
+
+// WithRoundTripper wraps the transport benchmark probes are sent over
+// with wrap, e.g. to rewrite their URLs. Call it before the engine is
+// first used.
+func (e *Engine) WithRoundTripper(wrap func(http.RoundTripper) http.RoundTripper) *Engine {
+	e.client.Transport = wrap(e.client.Transport)
+	return e
+}
+
+// WithMinSuccessRate makes selection pass over mirrors whose recent
+// success rate on real requests (see Success) is below rate: they are
+// benchmarked only when none of the other candidates answer, and a cached
+// result naming one is ignored. A non-positive rate disables the check.
+func (e *Engine) WithMinSuccessRate(rate float64) *Engine {
+	e.SetMinSuccessRate(rate)
+	return e
+}
+
+// SetMinSuccessRate changes the rate set by WithMinSuccessRate. Unlike
+// the other options it may be called while the engine is in use, for a
+// config reload; it applies from the next selection on.
+func (e *Engine) SetMinSuccessRate(rate float64) {
+	e.minSuccess.Store(math.Float64bits(rate))
+}
+
+// minSuccessRate returns the rate set by SetMinSuccessRate.
+func (e *Engine) minSuccessRate() float64 {
+	return math.Float64frombits(e.minSuccess.Load())
+}
+
+// WithProbe selects the request each benchmark try sends: ProbeHead (the
+// default), ProbeRange or ProbeGet. A mirror rejecting HEAD or Range is
+// probed with a GET instead. Call it before the engine is first used.
+func (e *Engine) WithProbe(probe Probe) *Engine {
+	e.probe = probe
+	return e
+}
+
+// WithResultTTL makes the engine cache each benchmark result for ttl
+// instead of DefaultCacheTTL, so a distribution is benchmarked again once
+// ttl has passed. A non-positive ttl selects DefaultCacheTTL. Call it
+// before the engine is first used.
+func (e *Engine) WithResultTTL(ttl time.Duration) *Engine {
+	e.resultTTL = max(ttl, 0)
+	return e
+}
+
+// ResultTTL returns how long the engine caches a benchmark result.
+func (e *Engine) ResultTTL() time.Duration {
+	if e.resultTTL > 0 {
+		return e.resultTTL
+	}
+	return DefaultCacheTTL
+}
+
+// Success returns the tracker that proxied requests report their
+// outcomes to.
+func (e *Engine) Success() *SuccessTracker {
+	return e.success
+}
+
+// CachedMirror returns distType's cached fastest mirror, unless it has
+// since fallen below the minimum success rate.
+func (e *Engine) CachedMirror(distType int) (string, bool) {
+	cached, ok := e.cache.GetCachedResult(distType)
+	if !ok || e.success.Flaky(cached, e.minSuccessRate()) {
+		return "", false
 	}
+	return cached, true
+}
+
+// splitBySuccess separates the mirrors below the minimum success rate
+// from the rest, keeping their order.
+func (e *Engine) splitBySuccess(mirrors []string) (healthy, flaky []string) {
+	rate := e.minSuccessRate()
+	if rate <= 0 {
+		return mirrors, nil
+	}
+	for _, m := range mirrors {
+		if e.success.Flaky(m, rate) {
+			flaky = append(flaky, m)
+		} else {
+			healthy = append(healthy, m)
+		}
+	}
+	return healthy, flaky
 }
 
 // Cache exposes the engine's result cache for advanced callers / tests.
@@ -157,6 +347,79 @@ func (e *Engine) Cache() *BenchmarkCache {
 // ClearCache drops all cached benchmark results held by this engine.
 func (e *Engine) ClearCache() {
 	e.cache.ClearCache()
+	e.runsMu.Lock()
+	clear(e.persisted)
+	e.runsMu.Unlock()
+}
+
+// InvalidateMode drops this engine's cached result for one distribution
+// type, leaving the others in place.
+func (e *Engine) InvalidateMode(distType int) {
+	e.cache.Invalidate(distType)
+	e.runsMu.Lock()
+	delete(e.persisted, distType)
+	e.runsMu.Unlock()
+}
+
+// LastRun returns the most recent benchmark recorded for distType.
+func (e *Engine) LastRun(distType int) (Run, bool) {
+	e.runsMu.RLock()
+	defer e.runsMu.RUnlock()
+	run, ok := e.runs[distType]
+	return run, ok
+}
+
+// benchmarkMode finds distType's fastest mirror, records the run and
+// caches a successful result.
+func (e *Engine) benchmarkMode(distType int, mirrors []string, testURL string) (string, error) {
+	if e.distros != nil {
+		e.distros <- struct{}{}
+		defer func() { <-e.distros }()
+	}
+	log := logger.Default().WithField("distro", distro.DistributionName(distType))
+	healthy, flaky := e.splitBySuccess(mirrors)
+	var ranked Results
+	err := errors.New("no mirrors to benchmark")
+	if len(healthy) > 0 {
+		ranked, err = e.fastest(log, healthy, testURL)
+	}
+	if err != nil && len(flaky) > 0 {
+		log.Warn().Strs("mirrors", flaky).Float64("min_success_rate", e.minSuccessRate()).Msg("no reliable mirror answered, benchmarking mirrors below the minimum success rate")
+		ranked, err = e.fastest(log, flaky, testURL)
+	} else if len(flaky) > 0 {
+		log.Info().Strs("mirrors", flaky).Float64("min_success_rate", e.minSuccessRate()).Msg("passed over mirrors below the minimum success rate")
+	}
+	run := Run{At: time.Now(), Err: err}
+	if len(ranked) > 0 {
+		run.Mirror, run.Latency = ranked[0].URL, ranked[0].Duration
+	}
+	if len(ranked) > 1 {
+		run.RunnerUp = ranked[1].URL
+	}
+	for _, r := range ranked {
+		run.Ranked = append(run.Ranked, r.URL)
+	}
+	e.runsMu.Lock()
+	e.runs[distType] = run
+	e.runsMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	e.cache.SetCachedResult(distType, run.Mirror, e.ResultTTL())
+	e.saveResults()
+	return run.Mirror, nil
+}
+
+// cachedOrBenchmark returns distType's cached or persisted result, or
+// benchmarks mirrors. Callers hold the distribution's singleflight slot.
+func (e *Engine) cachedOrBenchmark(distType int, mirrors []string, testURL string) (string, error) {
+	if cached, ok := e.CachedMirror(distType); ok {
+		return cached, nil
+	}
+	if persisted, ok := e.persistedMirror(distType, mirrors); ok {
+		return persisted, nil
+	}
+	return e.benchmarkMode(distType, mirrors, testURL)
 }
 
 // defaultEngine is the process-wide engine used by the package-level helper
@@ -172,6 +435,7 @@ func Default() *Engine {
 type Result struct {
 	URL      string
 	Duration time.Duration
+	Err      error // set by RankMirrors when the mirror did not answer
 }
 
 // Results implements sort.Interface for []Result based on Duration
@@ -181,8 +445,9 @@ func (r Results) Len() int           { return len(r) }
 func (r Results) Less(i, j int) bool { return r[i].Duration < r[j].Duration }
 func (r Results) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
 
-// Benchmark performs HTTP GET requests against base+query using the engine's
-// shared HTTP client and reports the average response time.
+// Benchmark probes base+query times over the engine's shared HTTP client,
+// with the requests selected by WithProbe, and reports the average
+// response time.
 func (e *Engine) Benchmark(ctx context.Context, base, query string, times int) (time.Duration, error) {
 	var totalDuration time.Duration
 	for i := 0; i < times; i++ {
@@ -190,7 +455,7 @@ func (e *Engine) Benchmark(ctx context.Context, base, query string, times int) (
 		case <-ctx.Done():
 			return 0, ctx.Err()
 		default:
-			duration, err := singleBenchmark(ctx, e.client, base+query)
+			duration, err := singleBenchmark(ctx, e.client, base+query, e.probe)
 			if err != nil {
 				return 0, err
 			}
@@ -206,58 +471,81 @@ func Benchmark(ctx context.Context, base, query string, times int) (time.Duratio
 	return defaultEngine.Benchmark(ctx, base, query, times)
 }
 
-func singleBenchmark(ctx context.Context, client *http.Client, url string) (time.Duration, error) {
-	// Use HEAD when the upstream supports it: we only care about latency,
-	// not the response payload. Falling back to GET (with a tiny CopyN
-	// drain) is necessary for mirrors that don't implement HEAD correctly,
-	// since some return 405 / empty bodies that would otherwise mark the
-	// mirror as unhealthy.
-	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
-	if err != nil {
-		return 0, err
-	}
-
+func singleBenchmark(ctx context.Context, client *http.Client, url string, probe Probe) (time.Duration, error) {
 	start := time.Now()
-	resp, err := client.Do(req)
+	resp, err := sendProbe(ctx, client, url, probe)
 	if err != nil {
 		return 0, err
 	}
-	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+	// Mirrors that don't implement HEAD or Range correctly answer 405 /
+	// 501 (or 416 to a Range); retry those with a plain GET rather than
+	// marking the mirror unhealthy.
+	if probe != ProbeGet && rejectsProbe(resp.StatusCode, probe) {
 		_ = resp.Body.Close()
-		// Retry as GET, draining only the first 8 KiB to keep network cost low.
-		getReq, gerr := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-		if gerr != nil {
-			return 0, gerr
-		}
 		start = time.Now()
-		resp, err = client.Do(getReq)
-		if err != nil {
-			return 0, err
-		}
-		defer func() { _ = resp.Body.Close() }()
-		if _, err := io.CopyN(io.Discard, resp.Body, 8*1024); err != nil && !errors.Is(err, io.EOF) {
+		if resp, err = sendProbe(ctx, client, url, ProbeGet); err != nil {
 			return 0, err
 		}
-	} else {
-		defer func() { _ = resp.Body.Close() }()
-		// HEAD response: drain a small amount in case the server still sends
-		// a tiny body (some mirrors do, against spec).
-		_, _ = io.CopyN(io.Discard, resp.Body, 1024)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	// Drain only the first 8 KiB to keep network cost low; a HEAD answer
+	// may still carry a tiny body (some mirrors send one, against spec).
+	if _, err := io.CopyN(io.Discard, resp.Body, 8*1024); err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
 		return 0, errors.New("non-200 status code received")
 	}
 
 	return time.Since(start), nil
 }
 
+// sendProbe sends one probe request of the given kind to url.
+func sendProbe(ctx context.Context, client *http.Client, url string, probe Probe) (*http.Response, error) {
+	method := http.MethodGet
+	if probe == ProbeHead || probe == "" {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if probe == ProbeRange {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	return client.Do(req)
+}
+
+// rejectsProbe reports whether status means the mirror does not support
+// the HEAD or Range request of probe.
+func rejectsProbe(status int, probe Probe) bool {
+	switch status {
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return true
+	case http.StatusRequestedRangeNotSatisfiable:
+		return probe == ProbeRange
+	}
+	return false
+}
+
 // GetTheFastestMirror finds the fastest responding mirror from the provided
 // list. Concurrency is capped at MaxBenchmarkConcurrency. Once `maxResults`
 // valid results are collected, the parent context is cancelled so in-flight
 // benchmarks abort promptly instead of running to completion.
 func (e *Engine) GetTheFastestMirror(mirrors []string, testURL string) (string, error) {
-	log := logger.Default()
+	ranked, err := e.fastest(logger.Default(), mirrors, testURL)
+	if err != nil {
+		return "", err
+	}
+	return ranked[0].URL, nil
+}
+
+// fastest is GetTheFastestMirror returning every collected Result, fastest
+// first. On success the slice is never empty. Progress is logged to log,
+// which names the distribution when there is one: in "all" mode several
+// benchmarks start together and would otherwise look like one run repeated.
+func (e *Engine) fastest(log *logger.Logger, mirrors []string, testURL string) (Results, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), BenchmarkDetectTimeout)
 	defer cancel()
 
@@ -330,15 +618,91 @@ func (e *Engine) GetTheFastestMirror(mirrors []string, testURL string) (string,
 			errMsgs = append(errMsgs, err)
 		}
 		if len(errMsgs) > 0 {
-			return "", errors.Join(errMsgs...)
+			return nil, errors.Join(errMsgs...)
 		}
-		return "", errors.New("no valid results found")
+		return nil, errors.New("no valid results found")
 	}
 
 	sort.Sort(collectedResults)
 	log.Info().Int("valid_results", len(collectedResults)).Msg("completed benchmark")
 
-	return collectedResults[0].URL, nil
+	return collectedResults, nil
+}
+
+// FirstServing returns the first of mirrors seen serving testURL, probing
+// them at once (up to MaxBenchmarkConcurrency) with one request each and
+// stopping at the first answer. Unlike a benchmark it does not rank them:
+// it only tells which mirrors carry the distribution at all, e.g. which
+// Ubuntu mirrors have the ports tree, to pick a usable mirror quickly.
+func (e *Engine) FirstServing(mirrors []string, testURL string) (string, error) {
+	if len(mirrors) == 0 {
+		return "", errors.New("no mirrors to probe")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), BenchmarkDetectTimeout)
+	defer cancel()
+
+	serving := make(chan string, len(mirrors))
+	errs := make(chan error, len(mirrors))
+	sem := make(chan struct{}, MaxBenchmarkConcurrency)
+	for _, u := range mirrors {
+		go func(u string) {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+			if _, err := singleBenchmark(ctx, e.client, u+testURL, e.probe); err != nil {
+				errs <- fmt.Errorf("%s: %w", u, err)
+				return
+			}
+			serving <- u
+		}(u)
+	}
+
+	var failed []error
+	for range mirrors {
+		select {
+		case u := <-serving:
+			return u, nil
+		case err := <-errs:
+			failed = append(failed, err)
+		}
+	}
+	return "", errors.Join(failed...)
+}
+
+// RankMirrors benchmarks every mirror, unlike GetTheFastestMirror, which
+// stops after the first few answers, and returns one Result per mirror:
+// responding mirrors fastest first, then the failed ones (Err set) in
+// input order. Concurrency is capped at MaxBenchmarkConcurrency.
+func (e *Engine) RankMirrors(mirrors []string, testURL string) Results {
+	ctx, cancel := context.WithTimeout(context.Background(), BenchmarkDetectTimeout)
+	defer cancel()
+
+	results := make(Results, len(mirrors))
+	sem := make(chan struct{}, MaxBenchmarkConcurrency)
+	var wg sync.WaitGroup
+	for i, u := range mirrors {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			d, err := e.Benchmark(ctx, u, testURL, BenchmarkMaxTries)
+			results[i] = Result{URL: u, Duration: d, Err: err}
+		}(i, u)
+	}
+	wg.Wait()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if (results[i].Err == nil) != (results[j].Err == nil) {
+			return results[i].Err == nil
+		}
+		return results[i].Err == nil && results[i].Duration < results[j].Duration
+	})
+	return results
 }
 
 // GetTheFastestMirror is the package-level shim that delegates to the default engine.
@@ -351,7 +715,7 @@ func GetTheFastestMirror(mirrors []string, testURL string) (string, error) {
 // repeated benchmarking. Concurrent cache-miss callers for the same distType
 // are collapsed into a single execution via the engine's singleflight group.
 func (e *Engine) GetTheFastestMirrorWithCache(distType int, mirrors []string, testURL string) (string, error) {
-	if cached, ok := e.cache.GetCachedResult(distType); ok {
+	if cached, ok := e.CachedMirror(distType); ok {
 		log := logger.Default()
 		log.Debug().Int("dist_type", distType).Str("mirror", cached).Msg("using cached benchmark result")
 		return cached, nil
@@ -361,15 +725,7 @@ func (e *Engine) GetTheFastestMirrorWithCache(distType int, mirrors []string, te
 	v, err, _ := e.group.Do(key, func() (interface{}, error) {
 		// Re-check after acquiring the singleflight slot in case another
 		// goroutine just populated the cache.
-		if cached, ok := e.cache.GetCachedResult(distType); ok {
-			return cached, nil
-		}
-		fastest, ferr := e.GetTheFastestMirror(mirrors, testURL)
-		if ferr != nil {
-			return "", ferr
-		}
-		e.cache.SetCachedResult(distType, fastest, DefaultCacheTTL)
-		return fastest, nil
+		return e.cachedOrBenchmark(distType, mirrors, testURL)
 	})
 	if err != nil {
 		return "", err
@@ -401,7 +757,7 @@ func (e *Engine) GetTheFastestMirrorAsync(distType int, mirrors []string, testUR
 	log := logger.Default()
 
 	go func() {
-		if cached, ok := e.cache.GetCachedResult(distType); ok {
+		if cached, ok := e.CachedMirror(distType); ok {
 			log.Debug().Int("dist_type", distType).Str("mirror", cached).Msg("async: using cached benchmark result")
 			callback(AsyncBenchmarkResult{
 				DistType:      distType,
@@ -417,15 +773,7 @@ func (e *Engine) GetTheFastestMirrorAsync(distType int, mirrors []string, testUR
 		v, err, shared := e.group.Do(key, func() (interface{}, error) {
 			// Re-check after acquiring the singleflight slot in case
 			// another goroutine just populated the cache.
-			if cached, ok := e.cache.GetCachedResult(distType); ok {
-				return cached, nil
-			}
-			fastest, ferr := e.GetTheFastestMirror(mirrors, testURL)
-			if ferr != nil {
-				return "", ferr
-			}
-			e.cache.SetCachedResult(distType, fastest, DefaultCacheTTL)
-			return fastest, nil
+			return e.cachedOrBenchmark(distType, mirrors, testURL)
 		})
 		if err != nil {
 			log.Error().Err(err).Int("dist_type", distType).Bool("shared", shared).Msg("async: benchmark failed")
@@ -18,6 +18,9 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -94,6 +97,109 @@ func TestBenchmarkMultipleTries(t *testing.T) {
 	}
 }
 
+// probeRecorder is a mirror recording the method and Range header of each
+// request it answers with handle.
+type probeRecorder struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (p *probeRecorder) serve(handle func(w http.ResponseWriter, r *http.Request)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.requests = append(p.requests, strings.TrimSpace(r.Method+" "+r.Header.Get("Range")))
+		p.mu.Unlock()
+		handle(w, r)
+	}))
+}
+
+func (p *probeRecorder) seen() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requests...)
+}
+
+func TestEngineBenchmarkProbes(t *testing.T) {
+	tests := []struct {
+		name   string
+		probe  Probe
+		handle func(w http.ResponseWriter, r *http.Request)
+		want   []string
+	}{
+		{
+			name:   "default is HEAD",
+			handle: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) },
+			want:   []string{"HEAD"},
+		},
+		{
+			name:  "range asks for one byte",
+			probe: ProbeRange,
+			handle: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write([]byte("x"))
+			},
+			want: []string{"GET bytes=0-0"},
+		},
+		{
+			name:   "get downloads",
+			probe:  ProbeGet,
+			handle: func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("OK")) },
+			want:   []string{"GET"},
+		},
+		{
+			name:  "rejected HEAD falls back to GET",
+			probe: ProbeHead,
+			handle: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				_, _ = w.Write([]byte("OK"))
+			},
+			want: []string{"HEAD", "GET"},
+		},
+		{
+			name:  "rejected Range falls back to GET",
+			probe: ProbeRange,
+			handle: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "" {
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					return
+				}
+				_, _ = w.Write([]byte("OK"))
+			},
+			want: []string{"GET bytes=0-0", "GET"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &probeRecorder{}
+			server := rec.serve(tt.handle)
+			defer server.Close()
+
+			if _, err := NewEngine().WithProbe(tt.probe).Benchmark(context.Background(), server.URL, "/test", 1); err != nil {
+				t.Fatalf("Benchmark() error = %v", err)
+			}
+			if got := rec.seen(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mirror saw %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineBenchmarkProbeKeepsOtherFailures(t *testing.T) {
+	rec := &probeRecorder{}
+	server := rec.serve(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) })
+	defer server.Close()
+
+	if _, err := NewEngine().WithProbe(ProbeRange).Benchmark(context.Background(), server.URL, "/test", 1); err == nil {
+		t.Fatal("Benchmark() of a missing probe file returned no error")
+	}
+	if got := rec.seen(); len(got) != 1 {
+		t.Errorf("mirror saw %q, want no GET fallback for a 404", got)
+	}
+}
+
 func TestGetTheFastestMirror(t *testing.T) {
 	// Create multiple test servers with different response times
 	fastServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -146,6 +252,34 @@ func TestGetTheFastestMirrorEmptyList(t *testing.T) {
 	}
 }
 
+// TestFirstServing probes an Ubuntu mirror without the ports tree
+// alongside one with it, and checks only the latter is reported.
+func TestFirstServing(t *testing.T) {
+	const release = "/ubuntu-ports/dists/noble/main/binary-arm64/Release"
+	noPorts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ubuntu-ports/") {
+			http.NotFound(w, r)
+		}
+	}))
+	defer noPorts.Close()
+	ports := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer ports.Close()
+
+	e := NewEngine()
+	got, err := e.FirstServing([]string{noPorts.URL, ports.URL}, release)
+	if err != nil || got != ports.URL {
+		t.Errorf("FirstServing() = %q, %v; want %q", got, err, ports.URL)
+	}
+	if got, err := e.FirstServing([]string{noPorts.URL}, release); err == nil {
+		t.Errorf("FirstServing() of a mirror without the tree = %q, want an error", got)
+	}
+	if _, err := e.FirstServing(nil, release); err == nil {
+		t.Error("FirstServing() of no mirrors returned no error")
+	}
+}
+
 func TestResultsSorting(t *testing.T) {
 	results := Results{
 		{URL: "slow", Duration: 300 * time.Millisecond},
@@ -401,6 +535,194 @@ func TestCachedResultIsExpired(t *testing.T) {
 	}
 }
 
+func TestEngineLastRunRecordsLatencyAndFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	e := NewEngine()
+	if _, ok := e.LastRun(1); ok {
+		t.Fatal("LastRun() on a fresh engine should report no run")
+	}
+	if _, err := e.GetTheFastestMirrorWithCache(1, []string{server.URL}, "/test"); err != nil {
+		t.Fatalf("GetTheFastestMirrorWithCache() error = %v", err)
+	}
+	run, ok := e.LastRun(1)
+	if !ok || run.Err != nil || run.Mirror != server.URL {
+		t.Fatalf("LastRun(1) = %+v, %v; want a successful run on %s", run, ok, server.URL)
+	}
+	if run.Latency < 5*time.Millisecond || run.At.IsZero() {
+		t.Errorf("LastRun(1) latency=%s at=%s, want >= 5ms and a timestamp", run.Latency, run.At)
+	}
+
+	// ClearCache forgets the selection but not the run history.
+	e.ClearCache()
+	if _, ok := e.LastRun(1); !ok {
+		t.Error("ClearCache() dropped the recorded run")
+	}
+
+	if _, err := e.GetTheFastestMirrorWithCache(2, []string{"http://127.0.0.1:1"}, "/test"); err == nil {
+		t.Fatal("benchmark against a closed port should fail")
+	}
+	if run, ok := e.LastRun(2); !ok || run.Err == nil || run.Mirror != "" {
+		t.Errorf("LastRun(2) = %+v, %v; want a recorded failure", run, ok)
+	}
+}
+
+func TestEngineResultTTL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		ttl, want time.Duration
+	}{
+		{0, DefaultCacheTTL},
+		{-time.Minute, DefaultCacheTTL},
+		{90 * time.Minute, 90 * time.Minute},
+	} {
+		e := NewEngine().WithResultTTL(tt.ttl)
+		if got := e.ResultTTL(); got != tt.want {
+			t.Errorf("WithResultTTL(%s).ResultTTL() = %s, want %s", tt.ttl, got, tt.want)
+		}
+		if _, err := e.GetTheFastestMirrorWithCache(1, []string{server.URL}, "/test"); err != nil {
+			t.Fatalf("GetTheFastestMirrorWithCache() error = %v", err)
+		}
+		if got := e.Cache().results[1].TTL; got != tt.want {
+			t.Errorf("WithResultTTL(%s): cached result TTL = %s, want %s", tt.ttl, got, tt.want)
+		}
+	}
+
+	// A short TTL sends the next lookup back to the mirrors.
+	var probes atomic.Int32
+	counted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer counted.Close()
+	e := NewEngine().WithResultTTL(20 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if _, err := e.GetTheFastestMirrorWithCache(1, []string{counted.URL}, "/test"); err != nil {
+			t.Fatalf("GetTheFastestMirrorWithCache() error = %v", err)
+		}
+	}
+	first := probes.Load()
+	if _, ok := e.CachedMirror(1); !ok {
+		t.Fatal("CachedMirror() lost the result before its TTL")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := e.CachedMirror(1); ok {
+		t.Fatal("CachedMirror() still reports the result after its TTL")
+	}
+	if _, err := e.GetTheFastestMirrorWithCache(1, []string{counted.URL}, "/test"); err != nil {
+		t.Fatalf("GetTheFastestMirrorWithCache() error = %v", err)
+	}
+	if probes.Load() <= first {
+		t.Error("expired result was served without benchmarking again")
+	}
+}
+
+func TestEngineLastRunRecordsRunnerUp(t *testing.T) {
+	delays := []time.Duration{0, 20 * time.Millisecond, 60 * time.Millisecond}
+	var urls []string
+	for _, d := range delays {
+		d := d
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(d)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+		urls = append(urls, server.URL)
+	}
+
+	e := NewEngine()
+	// Slowest first, so the ranking does not follow the input order.
+	if _, err := e.GetTheFastestMirrorWithCache(1, []string{urls[2], urls[1], urls[0]}, "/test"); err != nil {
+		t.Fatalf("GetTheFastestMirrorWithCache() error = %v", err)
+	}
+	run, _ := e.LastRun(1)
+	if run.Mirror != urls[0] || run.RunnerUp != urls[1] {
+		t.Errorf("LastRun(1) mirror=%q runner-up=%q, want %q and %q", run.Mirror, run.RunnerUp, urls[0], urls[1])
+	}
+	if !reflect.DeepEqual(run.Ranked, urls) {
+		t.Errorf("LastRun(1) ranked = %q, want %q", run.Ranked, urls)
+	}
+
+	if _, err := e.GetTheFastestMirrorWithCache(2, urls[:1], "/test"); err != nil {
+		t.Fatalf("GetTheFastestMirrorWithCache() error = %v", err)
+	}
+	if run, _ := e.LastRun(2); run.RunnerUp != "" {
+		t.Errorf("LastRun(2) runner-up = %q with a single candidate, want none", run.RunnerUp)
+	}
+}
+
+func TestEngineRankMirrors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fast.Close()
+	dead := "http://127.0.0.1:1"
+
+	ranked := NewEngine().RankMirrors([]string{dead, slow.URL, fast.URL}, "/test")
+	if len(ranked) != 3 {
+		t.Fatalf("RankMirrors() returned %d results, want one per mirror", len(ranked))
+	}
+	if ranked[0].URL != fast.URL || ranked[1].URL != slow.URL || ranked[2].URL != dead {
+		t.Errorf("ranking = %s, %s, %s; want fast, slow, dead", ranked[0].URL, ranked[1].URL, ranked[2].URL)
+	}
+	if ranked[0].Err != nil || ranked[1].Err != nil || ranked[2].Err == nil {
+		t.Errorf("errors = %v, %v, %v; want only the dead mirror to fail", ranked[0].Err, ranked[1].Err, ranked[2].Err)
+	}
+}
+
+// TestEngineDistroConcurrencyBounded benchmarks five distributions at once
+// on an engine limited to two and checks no more than two were ever
+// probing mirrors at the same time.
+func TestEngineDistroConcurrencyBounded(t *testing.T) {
+	var inflight, peak atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	e := NewEngine().WithDistroConcurrency(2)
+	done := make(chan AsyncBenchmarkResult, 5)
+	for distType := 1; distType <= 5; distType++ {
+		// One mirror per distro, so concurrent requests = concurrent distros.
+		e.GetTheFastestMirrorAsync(distType, []string{server.URL}, "/test", func(r AsyncBenchmarkResult) { done <- r })
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case r := <-done:
+			if r.Error != nil {
+				t.Errorf("distro %d benchmark failed: %v", r.DistType, r.Error)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("benchmarks did not finish")
+		}
+	}
+	if got := peak.Load(); got > 2 {
+		t.Errorf("peak concurrent distro benchmarks = %d, want <= 2", got)
+	}
+}
+
 // TestEngineIsolation pins the post-refactor invariant: two Engine
 // instances must not share their cache. ClearCache on one engine is
 // invisible to the other. This is what enables per-Server cache
@@ -531,3 +853,16 @@ func TestEngineAsyncSingleflight(t *testing.T) {
 		t.Errorf("upstream was probed %d times for %d async callers; expected at most %d (singleflight dedup broken)", got, callers, BenchmarkMaxTries)
 	}
 }
+
+func TestEngineDialTimeoutFailsFastOnBlackHole(t *testing.T) {
+	e := NewEngineWithDialTimeout(200 * time.Millisecond)
+	start := time.Now()
+	// 10.255.255.1 is non-routable: without a dial timeout the probe would
+	// wait for the OS connect timeout.
+	if _, err := e.Benchmark(context.Background(), "http://10.255.255.1", "/", 1); err == nil {
+		t.Skip("black-hole address is reachable in this environment")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("benchmark took %s, want it bounded by the 200ms dial timeout", elapsed)
+	}
+}
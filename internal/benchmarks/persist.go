@@ -0,0 +1,166 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package benchmarks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	logger "github.com/soulteary/logger-kit"
+)
+
+// persistedRun is a successful Run as stored in the results file.
+type persistedRun struct {
+	Mirror   string        `json:"mirror"`
+	Latency  time.Duration `json:"latency_ns"`
+	RunnerUp string        `json:"runner_up,omitempty"`
+	Ranked   []string      `json:"ranked,omitempty"`
+	At       time.Time     `json:"at"`
+}
+
+// WithResultsFile keeps the engine's successful benchmark results in the
+// JSON file at path (benchmark.results_file), so a restart reuses them
+// instead of benchmarking every distribution again. The results saved by
+// the previous process are loaded here; one is used the first time its
+// distribution is benchmarked, if its mirror is still a candidate and it
+// is younger than the result TTL. With maxStale positive
+// (benchmark.max_stale_on_start_min), results older than that are
+// dropped on load and benchmarked afresh, however long the TTL. Call it
+// after WithResultTTL and before the engine is first used. A missing or
+// unreadable file starts empty.
+func (e *Engine) WithResultsFile(path string, maxStale time.Duration) *Engine {
+	e.resultsFile = path
+	if path == "" {
+		return e
+	}
+	runs, err := loadResults(path)
+	if err != nil {
+		logger.Default().Warn().Err(err).Str("path", path).Msg("ignoring the benchmark results file")
+		return e
+	}
+	e.runsMu.Lock()
+	defer e.runsMu.Unlock()
+	for distType, run := range runs {
+		age := time.Since(run.At)
+		if maxStale > 0 && age > maxStale {
+			logger.Default().Info().
+				Int("dist_type", distType).
+				Dur("age", age).
+				Dur("max_stale_on_start", maxStale).
+				Msg("persisted benchmark result is too old, benchmarking again")
+			continue
+		}
+		e.persisted[distType] = run
+	}
+	return e
+}
+
+// loadResults reads the results file at path; a missing file holds none.
+func loadResults(path string) (map[int]Run, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved map[string]persistedRun
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parse benchmark results file %s: %w", path, err)
+	}
+	runs := make(map[int]Run, len(saved))
+	for key, p := range saved {
+		distType, err := strconv.Atoi(key)
+		if err != nil || p.Mirror == "" || p.At.IsZero() {
+			continue
+		}
+		runs[distType] = Run{Mirror: p.Mirror, Latency: p.Latency, RunnerUp: p.RunnerUp, Ranked: p.Ranked, At: p.At}
+	}
+	return runs, nil
+}
+
+// persistedMirror returns distType's persisted result when its mirror is
+// one of mirrors and it has not outlived the result TTL, and installs it
+// as the distribution's last run and cached result.
+func (e *Engine) persistedMirror(distType int, mirrors []string) (string, bool) {
+	e.runsMu.Lock()
+	run, ok := e.persisted[distType]
+	if ok && time.Since(run.At) > e.ResultTTL() {
+		delete(e.persisted, distType)
+		ok = false
+	}
+	if !ok || !slices.Contains(mirrors, run.Mirror) || e.success.Flaky(run.Mirror, e.minSuccessRate()) {
+		e.runsMu.Unlock()
+		return "", false
+	}
+	delete(e.persisted, distType)
+	e.runs[distType] = run
+	e.runsMu.Unlock()
+
+	e.cache.setCachedResultAt(distType, run.Mirror, run.At, e.ResultTTL())
+	logger.Default().Info().
+		Int("dist_type", distType).
+		Str("mirror", run.Mirror).
+		Time("benchmarked_at", run.At).
+		Msg("using the persisted benchmark result")
+	return run.Mirror, true
+}
+
+// saveResults writes the successful runs to the results file, replacing
+// it atomically. It does nothing without one.
+func (e *Engine) saveResults() {
+	if e.resultsFile == "" {
+		return
+	}
+	e.runsMu.RLock()
+	saved := make(map[string]persistedRun, len(e.runs))
+	for distType, run := range e.runs {
+		if run.Err == nil && run.Mirror != "" {
+			saved[strconv.Itoa(distType)] = persistedRun{Mirror: run.Mirror, Latency: run.Latency, RunnerUp: run.RunnerUp, Ranked: run.Ranked, At: run.At}
+		}
+	}
+	e.runsMu.RUnlock()
+
+	if err := writeResults(e.resultsFile, saved); err != nil {
+		logger.Default().Warn().Err(err).Str("path", e.resultsFile).Msg("failed to save benchmark results")
+	}
+}
+
+func writeResults(path string, saved map[string]persistedRun) error {
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package benchmarks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingMirror returns a mirror answering every probe, and the number of
+// probes it has received.
+func countingMirror(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	var probes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, &probes
+}
+
+// writeResultsFile saves mirror as distType's result benchmarked age ago.
+func writeResultsFile(t *testing.T, path string, distType int, mirror string, age time.Duration) {
+	t.Helper()
+	run := Run{Mirror: mirror, Latency: time.Millisecond, At: time.Now().Add(-age)}
+	engine := NewEngine().WithResultsFile(path, 0)
+	engine.runs[distType] = run
+	engine.saveResults()
+}
+
+func TestEngineResultsFileSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "benchmarks.json")
+	mirror, probes := countingMirror(t)
+
+	first := NewEngine().WithResultsFile(path, 0)
+	if got, err := first.GetTheFastestMirrorWithCache(1, []string{mirror}, "/test"); err != nil || got != mirror {
+		t.Fatalf("first GetTheFastestMirrorWithCache() = %q, %v; want %q", got, err, mirror)
+	}
+	benchmarked := probes.Load()
+	if benchmarked == 0 {
+		t.Fatal("first engine did not benchmark the mirror")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("results file not written: %v", err)
+	}
+
+	second := NewEngine().WithResultsFile(path, time.Hour)
+	if got, err := second.GetTheFastestMirrorWithCache(1, []string{mirror}, "/test"); err != nil || got != mirror {
+		t.Fatalf("second GetTheFastestMirrorWithCache() = %q, %v; want %q", got, err, mirror)
+	}
+	if n := probes.Load(); n != benchmarked {
+		t.Errorf("restarted engine sent %d probes, want the persisted result reused", n-benchmarked)
+	}
+	run, ok := second.LastRun(1)
+	if !ok || run.Mirror != mirror || run.Latency <= 0 {
+		t.Errorf("LastRun() = %+v, %v; want the persisted run", run, ok)
+	}
+	if matches, _ := filepath.Glob(path + ".tmp-*"); len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestEngineStalePersistedResultIsBenchmarked(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		age       time.Duration
+		maxStale  time.Duration
+		ttl       time.Duration
+		wantProbe bool
+	}{
+		{"fresh", 10 * time.Minute, time.Hour, 0, false},
+		{"older than max_stale_on_start", 2 * time.Hour, time.Hour, 0, true},
+		{"no max_stale_on_start", 2 * time.Hour, 0, 0, false},
+		{"older than the result TTL", 2 * time.Hour, 0, time.Hour, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "benchmarks.json")
+			mirror, probes := countingMirror(t)
+			writeResultsFile(t, path, 1, mirror, tt.age)
+
+			engine := NewEngine().WithResultTTL(tt.ttl).WithResultsFile(path, tt.maxStale)
+			if got, err := engine.GetTheFastestMirrorWithCache(1, []string{mirror}, "/test"); err != nil || got != mirror {
+				t.Fatalf("GetTheFastestMirrorWithCache() = %q, %v; want %q", got, err, mirror)
+			}
+			if got := probes.Load() > 0; got != tt.wantProbe {
+				t.Errorf("benchmarked = %v, want %v", got, tt.wantProbe)
+			}
+			if run, _ := engine.LastRun(1); tt.wantProbe && time.Since(run.At) > time.Minute {
+				t.Errorf("LastRun().At = %s, want a fresh benchmark", run.At)
+			}
+		})
+	}
+}
+
+func TestEnginePersistedMirrorNoLongerCandidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "benchmarks.json")
+	writeResultsFile(t, path, 1, "http://gone.example.com/ubuntu/", time.Minute)
+	mirror, probes := countingMirror(t)
+
+	engine := NewEngine().WithResultsFile(path, 0)
+	if got, err := engine.GetTheFastestMirrorWithCache(1, []string{mirror}, "/test"); err != nil || got != mirror {
+		t.Fatalf("GetTheFastestMirrorWithCache() = %q, %v; want %q", got, err, mirror)
+	}
+	if probes.Load() == 0 {
+		t.Error("mirror not benchmarked though the persisted one is no longer configured")
+	}
+}
+
+func TestEngineUnreadableResultsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "benchmarks.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mirror, probes := countingMirror(t)
+
+	engine := NewEngine().WithResultsFile(path, 0)
+	if got, err := engine.GetTheFastestMirrorWithCache(1, []string{mirror}, "/test"); err != nil || got != mirror {
+		t.Fatalf("GetTheFastestMirrorWithCache() = %q, %v; want %q", got, err, mirror)
+	}
+	if probes.Load() == 0 {
+		t.Error("mirror not benchmarked with a corrupt results file")
+	}
+	if runs, err := loadResults(path); err != nil || runs[1].Mirror != mirror {
+		t.Errorf("results file after benchmark = %v, %v; want it rewritten", runs, err)
+	}
+}
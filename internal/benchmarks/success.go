@@ -0,0 +1,119 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package benchmarks
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SuccessWindow is how many recent outcomes are kept per mirror.
+	SuccessWindow = 100
+	// SuccessMinSamples is how many recent outcomes a mirror needs before
+	// its success rate is trusted; below it the mirror counts as healthy.
+	SuccessMinSamples = 10
+	// SuccessMaxAge is how long an outcome counts as recent, so a mirror
+	// that stopped getting traffic after being passed over is given
+	// another chance.
+	SuccessMaxAge = time.Hour
+)
+
+// outcome is one proxied request to a mirror.
+type outcome struct {
+	at time.Time
+	ok bool
+}
+
+// SuccessTracker keeps the outcomes of the latest real requests to each
+// mirror, in memory, so selection can steer away from mirrors that win
+// benchmarks but fail actual fetches.
+type SuccessTracker struct {
+	mu      sync.Mutex
+	mirrors map[string]*outcomeRing
+	now     func() time.Time
+}
+
+// outcomeRing holds the last SuccessWindow outcomes of one mirror.
+type outcomeRing struct {
+	outcomes [SuccessWindow]outcome
+	next     int
+	count    int
+}
+
+// NewSuccessTracker returns an empty tracker.
+func NewSuccessTracker() *SuccessTracker {
+	return &SuccessTracker{mirrors: make(map[string]*outcomeRing), now: time.Now}
+}
+
+// successKey identifies mirror regardless of a trailing slash.
+func successKey(mirror string) string {
+	return strings.TrimRight(mirror, "/")
+}
+
+// Record adds the outcome of a request to mirror.
+func (t *SuccessTracker) Record(mirror string, ok bool) {
+	key := successKey(mirror)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ring := t.mirrors[key]
+	if ring == nil {
+		ring = &outcomeRing{}
+		t.mirrors[key] = ring
+	}
+	ring.outcomes[ring.next] = outcome{at: t.now(), ok: ok}
+	ring.next = (ring.next + 1) % SuccessWindow
+	if ring.count < SuccessWindow {
+		ring.count++
+	}
+}
+
+// Rate returns mirror's success rate over its recent outcomes and how
+// many there were. With no recent outcomes the rate is 1.
+func (t *SuccessTracker) Rate(mirror string) (rate float64, samples int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ring := t.mirrors[successKey(mirror)]
+	if ring == nil {
+		return 1, 0
+	}
+	cutoff := t.now().Add(-SuccessMaxAge)
+	ok := 0
+	for _, o := range ring.outcomes[:ring.count] {
+		if o.at.Before(cutoff) {
+			continue
+		}
+		samples++
+		if o.ok {
+			ok++
+		}
+	}
+	if samples == 0 {
+		return 1, 0
+	}
+	return float64(ok) / float64(samples), samples
+}
+
+// Flaky reports whether mirror has at least SuccessMinSamples recent
+// outcomes and a success rate below min. It is always false when min is
+// not positive.
+func (t *SuccessTracker) Flaky(mirror string, min float64) bool {
+	if min <= 0 {
+		return false
+	}
+	rate, samples := t.Rate(mirror)
+	return samples >= SuccessMinSamples && rate < min
+}
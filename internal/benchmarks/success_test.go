@@ -0,0 +1,98 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package benchmarks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSuccessTrackerRate(t *testing.T) {
+	tr := NewSuccessTracker()
+	if rate, n := tr.Rate("http://a/"); rate != 1 || n != 0 {
+		t.Errorf("Rate() of an unknown mirror = %v, %d; want 1, 0", rate, n)
+	}
+	for i := 0; i < 8; i++ {
+		tr.Record("http://a/", i < 6)
+	}
+	if rate, n := tr.Rate("http://a"); rate != 0.75 || n != 8 {
+		t.Errorf("Rate() = %v, %d; want 0.75 over 8 (trailing slash ignored)", rate, n)
+	}
+	if tr.Flaky("http://a/", 0.9) {
+		t.Error("Flaky() with fewer than SuccessMinSamples outcomes")
+	}
+	tr.Record("http://a/", false)
+	tr.Record("http://a/", false)
+	if !tr.Flaky("http://a/", 0.9) || tr.Flaky("http://a/", 0) {
+		t.Error("Flaky() = false at 60% with min 0.9, or true with the check off")
+	}
+
+	// Only the last SuccessWindow outcomes count.
+	for i := 0; i < SuccessWindow; i++ {
+		tr.Record("http://a/", true)
+	}
+	if rate, n := tr.Rate("http://a/"); rate != 1 || n != SuccessWindow {
+		t.Errorf("Rate() after a full window of successes = %v, %d; want 1, %d", rate, n, SuccessWindow)
+	}
+}
+
+func TestSuccessTrackerForgetsOldOutcomes(t *testing.T) {
+	tr := NewSuccessTracker()
+	now := time.Now()
+	tr.now = func() time.Time { return now }
+	for i := 0; i < 20; i++ {
+		tr.Record("http://a/", false)
+	}
+	if !tr.Flaky("http://a/", 0.5) {
+		t.Fatal("mirror failing every request is not flaky")
+	}
+	now = now.Add(SuccessMaxAge + time.Minute)
+	if tr.Flaky("http://a/", 0.5) {
+		t.Error("mirror still flaky once its failures are older than SuccessMaxAge")
+	}
+}
+
+func TestEngineDeprioritisesFlakyMirrors(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer slow.Close()
+	mirrors := []string{fast.URL + "/", slow.URL + "/"}
+
+	e := NewEngine().WithMinSuccessRate(0.9)
+	if got, err := e.GetTheFastestMirrorWithCache(1, mirrors, "probe"); err != nil || got != fast.URL+"/" {
+		t.Fatalf("first selection = %q, %v; want the fast mirror", got, err)
+	}
+	for i := 0; i < 20; i++ {
+		e.Success().Record(fast.URL+"/", i%2 == 0)
+	}
+	if _, ok := e.CachedMirror(1); ok {
+		t.Error("CachedMirror() still returns the flaky mirror")
+	}
+	if got, err := e.GetTheFastestMirrorWithCache(1, mirrors, "probe"); err != nil || got != slow.URL+"/" {
+		t.Errorf("selection after failures = %q, %v; want the reliable slow mirror", got, err)
+	}
+
+	// With nothing else answering, a flaky mirror still beats none.
+	slow.Close()
+	e.InvalidateMode(1)
+	if got, err := e.GetTheFastestMirrorWithCache(1, mirrors, "probe"); err != nil || got != fast.URL+"/" {
+		t.Errorf("selection with only the flaky mirror up = %q, %v; want it", got, err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// loggedPaths returns the paths of the JSON request log lines in data.
+func loggedPaths(t *testing.T, data string) []string {
+	t.Helper()
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		var entry struct {
+			Path string `json:"path"`
+		}
+		if line == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("decode log line %q: %v", line, err)
+		}
+		if entry.Path != "" {
+			paths = append(paths, entry.Path)
+		}
+	}
+	return paths
+}
+
+// TestAccessFile sends a request with log.access_file set and checks
+// its line lands in the file, not the application log, then moves the
+// file aside as log rotation does and checks a reload starts a new one.
+func TestAccessFile(t *testing.T) {
+	for _, rate := range []int{0, 10} {
+		t.Run("sample rate "+strconv.Itoa(rate), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			srv, err := NewServer(withTestMirrors(&config.Config{
+				CacheDir: t.TempDir(),
+				Mode:     distro.TypeDebian,
+				Listen:   "127.0.0.1:0",
+				Log:      config.LogConfig{SampleRate: rate, AccessFile: path},
+			}))
+			if err != nil {
+				t.Fatalf("NewServer() error = %v", err)
+			}
+			t.Cleanup(func() { _ = srv.accessLog.Close() })
+			var appLog bytes.Buffer
+			srv.logConfig.Output = &appLog
+			srv.logConfig.Format = logger.FormatJSON
+			srv.log = logger.New(srv.logConfig)
+			srv.app = srv.createFiberApp()
+
+			get := func(target string) {
+				t.Helper()
+				resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, target, nil), 10000)
+				if err != nil {
+					t.Fatalf("app.Test(%s) error: %v", target, err)
+				}
+				resp.Body.Close()
+			}
+			read := func(name string) []string {
+				t.Helper()
+				data, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatalf("read %s: %v", name, err)
+				}
+				return loggedPaths(t, string(data))
+			}
+
+			get("/version")
+			if got := read(path); len(got) != 1 || got[0] != "/version" {
+				t.Errorf("access file paths = %v, want [/version]", got)
+			}
+			if got := loggedPaths(t, appLog.String()); len(got) != 0 {
+				t.Errorf("application log has request lines %v, want none", got)
+			}
+
+			if err := os.Rename(path, path+".1"); err != nil {
+				t.Fatal(err)
+			}
+			srv.reload()
+			get("/")
+			if got := read(path); len(got) != 1 || got[0] != "/" {
+				t.Errorf("reopened access file paths = %v, want [/]", got)
+			}
+			if got := read(path + ".1"); len(got) != 1 {
+				t.Errorf("rotated access file paths = %v, want the first request only", got)
+			}
+		})
+	}
+}
+
+func TestAccessFileUnwritable(t *testing.T) {
+	_, err := NewServer(withTestMirrors(&config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeDebian,
+		Listen:   "127.0.0.1:0",
+		Log:      config.LogConfig{AccessFile: filepath.Join(t.TempDir(), "missing", "access.log")},
+	}))
+	if err == nil || !strings.Contains(err.Error(), "log.access_file") {
+		t.Errorf("NewServer() error = %v, want a log.access_file error", err)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+	logger "github.com/soulteary/logger-kit"
+)
+
+// sampledAccessLog runs logger-kit's request logging middleware but keeps
+// only one in rate of the lines for successful cache hits (log.sample_rate).
+// Misses, errors and every other request are always logged.
+//
+// Whether a line is kept is known only once the handler has run, after
+// the middleware has written it, so each request logs into a buffer of
+// its own, taken from slots, and the buffer is copied to out if kept.
+type sampledAccessLog struct {
+	rate  uint64
+	hits  atomic.Uint64
+	slots sync.Pool
+
+	mu  sync.Mutex // serializes writes to out
+	out io.Writer
+}
+
+// accessLogSlot is a request logging middleware writing to buf, for
+// Fiber (next) and for net/http (std).
+type accessLogSlot struct {
+	buf  bytes.Buffer
+	next fiber.Handler
+	std  func(http.Handler) http.Handler
+}
+
+// newSampledAccessLog returns a request logging middleware configured by
+// mw that writes the kept lines, formatted as by log, to log.Output.
+func newSampledAccessLog(mw logger.MiddlewareConfig, log logger.Config, rate int) fiber.Handler {
+	return newAccessLogSampler(mw, log, rate).handle
+}
+
+// newSampledAccessLogStd is newSampledAccessLog for the net/http front
+// end. It reads the response status and X-Cache from the request's
+// accessRecorder (see withAccessRecorder).
+func newSampledAccessLogStd(mw logger.MiddlewareConfig, log logger.Config, rate int) func(http.Handler) http.Handler {
+	return newAccessLogSampler(mw, log, rate).wrap
+}
+
+func newAccessLogSampler(mw logger.MiddlewareConfig, log logger.Config, rate int) *sampledAccessLog {
+	l := &sampledAccessLog{rate: uint64(rate), out: log.Output}
+	l.slots.New = func() any {
+		slot := &accessLogSlot{}
+		slotLog := log
+		slotLog.Output = &slot.buf
+		slotMW := mw
+		slotMW.Logger = logger.New(slotLog)
+		slot.next = logger.FiberMiddleware(slotMW)
+		slot.std = logger.Middleware(slotMW)
+		return slot
+	}
+	return l
+}
+
+func (l *sampledAccessLog) handle(c *fiber.Ctx) error {
+	slot := l.slots.Get().(*accessLogSlot)
+	defer l.slots.Put(slot)
+	slot.buf.Reset()
+
+	err := slot.next(c)
+	failed := err != nil || c.Response().StatusCode() >= http.StatusBadRequest
+	if slot.buf.Len() > 0 && l.keep(failed, string(c.Response().Header.Peek("X-Cache"))) {
+		l.write(slot.buf.Bytes())
+	}
+	return err
+}
+
+func (l *sampledAccessLog) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slot := l.slots.Get().(*accessLogSlot)
+		defer l.slots.Put(slot)
+		slot.buf.Reset()
+
+		slot.std(next).ServeHTTP(w, r)
+		rec := accessRecorderFrom(r.Context())
+		if slot.buf.Len() > 0 && (rec == nil || l.keep(rec.status >= http.StatusBadRequest, rec.cache)) {
+			l.write(slot.buf.Bytes())
+		}
+	})
+}
+
+func (l *sampledAccessLog) write(line []byte) {
+	l.mu.Lock()
+	_, _ = l.out.Write(line)
+	l.mu.Unlock()
+}
+
+// keep reports whether the request's line is written: always unless it
+// was a successful cache hit (by its X-Cache header), and for those every
+// rate-th one, starting with the first.
+func (l *sampledAccessLog) keep(failed bool, xCache string) bool {
+	if failed || cacheLabelFromHeader(xCache) != "HIT" {
+		return true
+	}
+	return (l.hits.Add(1)-1)%l.rate == 0
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	logger "github.com/soulteary/logger-kit"
+)
+
+// accessLogLines sends hits cache hits, misses cache misses and failures
+// 502s through an app logging with sample rate rate, and returns the
+// logged lines' paths.
+func accessLogLines(t *testing.T, rate, hits, misses, failures int) []string {
+	t.Helper()
+	var out bytes.Buffer
+	app := fiber.New()
+	app.Use(newSampledAccessLog(logger.DefaultMiddlewareConfig(), logger.Config{Level: logger.InfoLevel, Output: &out, Format: logger.FormatJSON}, rate))
+	app.Get("/hit", func(c *fiber.Ctx) error {
+		c.Set("X-Cache", "HIT")
+		return c.SendString("cached")
+	})
+	app.Get("/miss", func(c *fiber.Ctx) error {
+		c.Set("X-Cache", "MISS")
+		return c.SendString("fetched")
+	})
+	app.Get("/error", func(c *fiber.Ctx) error {
+		c.Set("X-Cache", "HIT")
+		return c.SendStatus(http.StatusBadGateway)
+	})
+
+	send := func(path string, n int) {
+		for i := 0; i < n; i++ {
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+			if err != nil {
+				t.Fatalf("app.Test(%s) error: %v", path, err)
+			}
+			resp.Body.Close()
+		}
+	}
+	send("/hit", hits)
+	send("/miss", misses)
+	send("/error", failures)
+
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry struct {
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("decode log line %q: %v", line, err)
+		}
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
+
+func countPath(paths []string, path string) int {
+	n := 0
+	for _, p := range paths {
+		if p == path {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSampledAccessLogDropsHitsOnly(t *testing.T) {
+	paths := accessLogLines(t, 10, 25, 4, 3)
+	if n := countPath(paths, "/hit"); n != 3 {
+		t.Errorf("logged %d of 25 hits, want 3 with log.sample_rate 10", n)
+	}
+	if n := countPath(paths, "/miss"); n != 4 {
+		t.Errorf("logged %d of 4 misses, want all of them", n)
+	}
+	if n := countPath(paths, "/error"); n != 3 {
+		t.Errorf("logged %d of 3 errors, want all of them", n)
+	}
+}
+
+func TestSampledAccessLogRateOneLogsEverything(t *testing.T) {
+	paths := accessLogLines(t, 1, 5, 2, 1)
+	if len(paths) != 8 {
+		t.Errorf("logged %d lines, want all 8 requests", len(paths))
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+	"github.com/soulteary/apt-proxy/internal/distro"
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+)
+
+// CheckConfigCommand is the subcommand name for CheckConfig.
+const CheckConfigCommand = "--check-config"
+
+// PrintDefaultConfigCommand is the subcommand name for PrintDefaultConfig.
+const PrintDefaultConfigCommand = "--print-default-config"
+
+// PrintDefaultConfig backs "apt-proxy --print-default-config": it writes
+// a commented starter apt-proxy.yaml, listing every option with its
+// default, to w.
+func PrintDefaultConfig(w io.Writer) error {
+	if _, err := io.WriteString(w, config.DefaultConfigTemplate()); err != nil {
+		return apperrors.Wrap(apperrors.ErrInternal, "failed to write the default config", err)
+	}
+	return nil
+}
+
+// CheckConfig backs "apt-proxy --check-config": it validates cfg and the
+// distributions config it points at, writes one line per problem to w and
+// returns without starting the server. Every problem of the distributions
+// config is listed with its entry and field, including conflicts with the
+// built-in distributions. It fails when any problem was found.
+func CheckConfig(cfg *config.Config, w io.Writer) error {
+	if cfg == nil {
+		return apperrors.New(apperrors.ErrConfigInvalid, "config cannot be nil")
+	}
+	problems := 0
+	if err := config.ValidateConfig(cfg); err != nil {
+		fmt.Fprintf(w, "config: %v\n", err)
+		problems++
+	}
+
+	if path := cfg.DistributionsConfigPath; path == "" {
+		fmt.Fprintln(w, "distributions: no distributions_config set, using the built-in distributions")
+	} else {
+		dists, err := distro.NewLoader(path).Parse()
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "%s: %v\n", path, err)
+			problems++
+		case dists != nil:
+			for _, e := range distro.NewBuiltinRegistry().ValidateConfig(dists) {
+				fmt.Fprintf(w, "%s: %v\n", path, e)
+				problems++
+			}
+		}
+	}
+
+	if problems > 0 {
+		return apperrors.New(apperrors.ErrConfigInvalid, fmt.Sprintf("%d configuration problem(s) found", problems))
+	}
+	fmt.Fprintln(w, "configuration OK")
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+	"github.com/soulteary/apt-proxy/internal/distro"
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+)
+
+func TestCheckConfig(t *testing.T) {
+	cfg := &config.Config{
+		CacheDir:                t.TempDir(),
+		Mode:                    distro.TypeAllDistros,
+		Listen:                  "127.0.0.1:0",
+		DistributionsConfigPath: "../../config/distributions.yaml",
+	}
+	var out strings.Builder
+	if err := CheckConfig(cfg, &out); err != nil {
+		t.Fatalf("CheckConfig() error = %v, output:\n%s", err, out.String())
+	}
+	if strings.TrimSpace(out.String()) != "configuration OK" {
+		t.Errorf("output = %q, want %q", out.String(), "configuration OK\n")
+	}
+}
+
+func TestCheckConfigListsDistributionProblems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "distributions.yaml")
+	if err := os.WriteFile(path, []byte(`distributions:
+  - id: foo
+    name: Foo
+    url_pattern: "/foo/(.+)$"
+    benchmark_url: "dists/stable/Release"
+    cache_rules:
+      - pattern: "deb$"
+        cache_control: "max-age=1d"
+  - id: debian-lts
+    name: Debian LTS
+    type: 42
+    url_pattern: "/debian/lts/(.+)$"
+    benchmark_url: "dists/stable/Release"
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		CacheDir:                t.TempDir(),
+		Mode:                    distro.TypeAllDistros,
+		Listen:                  "127.0.0.1:0",
+		DistributionsConfigPath: path,
+	}
+	var out strings.Builder
+	err := CheckConfig(cfg, &out)
+	if !apperrors.Is(err, apperrors.ErrConfigInvalid) {
+		t.Fatalf("CheckConfig() error = %v, want ErrConfigInvalid", err)
+	}
+	want := []string{
+		path + ": distributions[0] (foo): type: distribution type is required (a positive number)",
+		path + `: distributions[0] (foo): cache_rules[0].cache_control: invalid cache-control "max-age=1d": max-age needs a number of seconds, got "1d"`,
+		path + `: distributions[1] (debian-lts): url_pattern: overlaps with distribution "debian": both match "/debian/lts/x"`,
+	}
+	if got := strings.TrimSpace(out.String()); got != strings.Join(want, "\n") {
+		t.Errorf("output =\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+	if !strings.Contains(err.Error(), "3 configuration problem(s)") {
+		t.Errorf("error = %v, want the problem count", err)
+	}
+}
+
+func TestCheckConfigUnparsableDistributions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "distributions.yaml")
+	if err := os.WriteFile(path, []byte("distributions: [\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	err := CheckConfig(&config.Config{CacheDir: t.TempDir(), Listen: "127.0.0.1:0", DistributionsConfigPath: path}, &out)
+	if err == nil || !strings.Contains(out.String(), "failed to parse distribution config") {
+		t.Errorf("CheckConfig() = %v, output %q; want a parse error", err, out.String())
+	}
+}
+
+func TestPrintDefaultConfig(t *testing.T) {
+	var out strings.Builder
+	if err := PrintDefaultConfig(&out); err != nil {
+		t.Fatalf("PrintDefaultConfig() error = %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "apt-proxy.yaml")
+	if err := os.WriteFile(path, []byte(out.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("LoadConfigFile() of the printed config error = %v", err)
+	}
+	if cfg.Listen != "0.0.0.0:3142" {
+		t.Errorf("listen = %q, want the default 0.0.0.0:3142", cfg.Listen)
+	}
+}
@@ -49,10 +49,21 @@ const (
 	EnvDebian      = config.EnvDebian
 	EnvCentOS      = config.EnvCentOS
 	EnvAlpine      = config.EnvAlpine
+	EnvGentoo      = config.EnvGentoo
+	EnvArch        = config.EnvArch
+	EnvMirrors     = config.EnvMirrors
+
+	EnvMirrorRegion       = config.EnvMirrorRegion
+	EnvLazyBenchmark      = config.EnvLazyBenchmark
+	EnvMirrorRequireHTTPS = config.EnvMirrorRequireHTTPS
+	EnvReadyTimeout       = config.EnvReadyTimeout
+	EnvH2C                = config.EnvH2C
+	EnvDialTimeout        = config.EnvDialTimeout
 
 	EnvCacheMaxSize         = config.EnvCacheMaxSize
 	EnvCacheTTL             = config.EnvCacheTTL
 	EnvCacheCleanupInterval = config.EnvCacheCleanupInterval
+	EnvCacheFollowRedirects = config.EnvCacheFollowRedirects
 
 	EnvTLSEnabled  = config.EnvTLSEnabled
 	EnvTLSCertFile = config.EnvTLSCertFile
@@ -69,6 +80,7 @@ const (
 
 	// Configuration files
 	EnvConfigFile          = config.EnvConfigFile
+	EnvConfigDir           = config.EnvConfigDir
 	EnvDistributionsConfig = config.EnvDistributionsConfig
 
 	// Logging (no CLI equivalent; canonical + legacy aliases).
@@ -90,8 +102,9 @@ const (
 	EnvS3InlineMaxMB  = config.EnvS3InlineMaxMB
 	EnvS3TempDir      = config.EnvS3TempDir
 
-	StorageBackendDisk = config.StorageBackendDisk
-	StorageBackendS3   = config.StorageBackendS3
+	StorageBackendDisk   = config.StorageBackendDisk
+	StorageBackendS3     = config.StorageBackendS3
+	StorageBackendMemory = config.StorageBackendMemory
 
 	DefaultHost     = config.DefaultHost
 	DefaultPort     = config.DefaultPort
@@ -184,6 +184,9 @@ func TestParseFlagsInvalidModeFallback(t *testing.T) {
 	if config.Mode != distro.TypeAllDistros {
 		t.Errorf("Mode = %d, want %d (should fallback to default 'all')", config.Mode, distro.TypeAllDistros)
 	}
+	if config.ModeName != "invalid-mode" {
+		t.Errorf("ModeName = %q, want the mode as given", config.ModeName)
+	}
 }
 
 func TestParseFlagsInvalidModeEnvFallback(t *testing.T) {
@@ -492,6 +495,8 @@ func TestAllowedModes(t *testing.T) {
 		distro.DistroDebian,
 		distro.DistroCentOS,
 		distro.DistroAlpine,
+		distro.DistroGentoo,
+		distro.DistroArch,
 	}
 
 	if len(allowedModes) != len(expectedModes) {
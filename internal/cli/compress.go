@@ -0,0 +1,168 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"compress/gzip"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressibleIndex matches repository index files served uncompressed:
+// Release / InRelease, pdiff Index files, repomd.xml, and plain Packages,
+// Sources, Translation and Contents files where a distributions.yaml rule
+// proxies them.
+var compressibleIndex = regexp.MustCompile(`/(Packages|Sources|Release|InRelease|Index|Translation-[\w@-]+|Contents-[\w-]+|repomd\.xml)$`)
+
+// gzipIndexes compresses uncompressed index responses for clients that
+// accept gzip (cache.compress_level). It sits in front of the cache, so
+// stored objects stay byte-for-byte what the mirror sent. Every index
+// response, compressed or not, carries Vary: Accept-Encoding so shared
+// caches downstream keep the two representations apart.
+type gzipIndexes struct {
+	next    http.Handler
+	writers sync.Pool
+}
+
+func newGzipIndexes(next http.Handler, level int) *gzipIndexes {
+	g := &gzipIndexes{next: next}
+	g.writers.New = func() any {
+		// level is validated by config.ValidateConfig.
+		w, _ := gzip.NewWriterLevel(nil, level)
+		return w
+	}
+	return g
+}
+
+func (g *gzipIndexes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !compressibleIndex.MatchString(r.URL.Path) {
+		g.next.ServeHTTP(w, r)
+		return
+	}
+	gw := &gzipIndexWriter{
+		ResponseWriter: w,
+		indexes:        g,
+		compress:       r.Header.Get("Range") == "" && acceptsGzip(r.Header.Get("Accept-Encoding")),
+		head:           r.Method == http.MethodHead,
+	}
+	defer gw.close()
+	g.next.ServeHTTP(gw, r)
+}
+
+// gzipIndexWriter decides at WriteHeader whether the response is
+// transcoded: only a 200 with a known Content-Type and no encoding of its
+// own is.
+type gzipIndexWriter struct {
+	http.ResponseWriter
+	indexes     *gzipIndexes
+	compress    bool
+	head        bool
+	wroteHeader bool
+	gz          *gzip.Writer
+}
+
+func (w *gzipIndexWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if !hasToken(h.Values("Vary"), "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if w.compress && status == http.StatusOK && h.Get("Content-Encoding") == "" && h.Get("Content-Type") != "" {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		// The compressed bytes differ from the stored ones, so a strong
+		// validator no longer applies.
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", "W/"+etag)
+		}
+		if !w.head {
+			w.gz = w.indexes.writers.Get().(*gzip.Writer)
+			w.gz.Reset(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipIndexWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush pushes buffered compressed bytes to the client, so streamed
+// responses are not held back until the end.
+func (w *gzipIndexWriter) Flush() {
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *gzipIndexWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipIndexWriter) close() {
+	if w.gz == nil {
+		return
+	}
+	_ = w.gz.Close()
+	w.gz.Reset(nil)
+	w.indexes.writers.Put(w.gz)
+	w.gz = nil
+}
+
+// acceptsGzip reports whether an Accept-Encoding value allows gzip, i.e.
+// lists it (or *) without q=0.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.TrimSpace(coding)
+		if !strings.EqualFold(coding, "gzip") && coding != "*" {
+			continue
+		}
+		if name, value, ok := strings.Cut(params, "="); ok && strings.TrimSpace(name) == "q" {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// hasToken reports whether the comma-separated header values contain
+// token, case-insensitively.
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+)
+
+var testIndex = strings.Repeat("Package: apt-proxy\nVersion: 1.0\n\n", 200)
+
+func indexBackend() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"idx"`)
+		_, _ = io.WriteString(w, testIndex)
+	})
+}
+
+func serveIndex(h http.Handler, path, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGzipIndexesTranscodesForGzipClients(t *testing.T) {
+	h := newGzipIndexes(indexBackend(), gzip.BestSpeed)
+	rec := serveIndex(h, "/ubuntu/dists/jammy/main/binary-amd64/Packages", "gzip, deflate")
+
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+	if got := rec.Header().Get("ETag"); got != `W/"idx"` {
+		t.Errorf("ETag = %q, want the weakened validator", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil || string(body) != testIndex {
+		t.Errorf("decompressed body differs from the index (err=%v, %d bytes)", err, len(body))
+	}
+}
+
+func TestGzipIndexesVaryOnIdentityResponses(t *testing.T) {
+	h := newGzipIndexes(indexBackend(), gzip.BestSpeed)
+	for _, ae := range []string{"", "identity", "gzip;q=0"} {
+		rec := serveIndex(h, "/debian/dists/bookworm/InRelease", ae)
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q, want none", ae, got)
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: Vary = %q, want Accept-Encoding", ae, got)
+		}
+		if rec.Body.String() != testIndex {
+			t.Errorf("Accept-Encoding %q: body was modified", ae)
+		}
+	}
+}
+
+func TestGzipIndexesLeavesPackagesAlone(t *testing.T) {
+	h := newGzipIndexes(indexBackend(), gzip.BestSpeed)
+	rec := serveIndex(h, "/ubuntu/pool/main/a/a_1.0.deb", "gzip")
+	if rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Vary") != "" {
+		t.Errorf("package response headers = %v, want no Content-Encoding or Vary", rec.Header())
+	}
+}
+
+// TestCompressLevelServesGzipIndex checks the wiring in NewServer: with
+// cache.compress_level an index fetched through the proxy is transcoded.
+// The built-in Debian-family rules proxy Release files but not plain
+// Packages, hence InRelease.
+func TestCompressLevelServesGzipIndex(t *testing.T) {
+	srv := newUpstreamTestServer(t, indexBackend(), func(cfg *config.Config) { cfg.Cache.CompressLevel = gzip.BestCompression })
+
+	req := httptest.NewRequest(http.MethodGet, "/ubuntu/dists/jammy/InRelease", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := srv.app.Test(req, 5000)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("status = %d, Content-Encoding = %q, Vary = %q; want gzip with Vary: Accept-Encoding",
+			resp.StatusCode, resp.Header.Get("Content-Encoding"), resp.Header.Get("Vary"))
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	if body, _ := io.ReadAll(zr); string(body) != testIndex {
+		t.Errorf("decompressed body differs from the upstream index (%d bytes)", len(body))
+	}
+	// Let the cache finish storing the index before TempDir cleanup.
+	httpcache.Writes.Wait()
+}
@@ -18,15 +18,21 @@ import (
 	"context"
 	stderrors "errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
 	health "github.com/soulteary/health-kit"
 	logger "github.com/soulteary/logger-kit"
 	metrics "github.com/soulteary/metrics-kit"
@@ -35,9 +41,11 @@ import (
 	version "github.com/soulteary/version-kit"
 
 	"github.com/soulteary/apt-proxy/internal/api"
+	"github.com/soulteary/apt-proxy/internal/benchmarks"
 	"github.com/soulteary/apt-proxy/internal/config"
 	"github.com/soulteary/apt-proxy/internal/distro"
 	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+	"github.com/soulteary/apt-proxy/internal/mirrors"
 	"github.com/soulteary/apt-proxy/internal/proxy"
 	"github.com/soulteary/apt-proxy/internal/state"
 	"github.com/soulteary/apt-proxy/internal/storage/s3vfs"
@@ -51,18 +59,39 @@ type Server struct {
 	config              *config.Config           // Application configuration
 	cache               httpcache.ExtendedCache  // HTTP cache implementation with management capabilities
 	s3fs                *s3vfs.S3VFS             // Active S3 backend (only set when storage backend == "s3")
+	memfs               vfs.VFS                  // In-memory store (only set when storage backend == "memory")
+	clientIP            *api.ClientIPExtractor   // Client IPs behind security.trusted_proxies, for logs, limits and sticky mirrors
 	state               *state.AppState          // Per-server runtime state (proxy mode, mirror URLs)
 	registry            *distro.Registry         // Per-server distribution registry
 	proxy               *proxy.PackageStruct     // Main proxy router (Handler is cache-wrapped)
 	app                 *fiber.App               // Fiber application
+	adminApp            *fiber.App               // Management endpoints on admin.listen; nil when they are served by app
+	httpServer          *http.Server             // net/http front end for HTTP/2 (TLS or h2c); nil when Fiber listens itself
 	log                 *logger.Logger           // Structured logger
+	logConfig           logger.Config            // Settings s.log was created with
+	accessLog           *accessLogFile           // log.access_file, reopened on SIGHUP; nil when access lines go to s.log
 	healthAggregator    *health.Aggregator       // Health check aggregator
+	readyAggregator     *health.Aggregator       // Readiness checks: health checks plus mirror warm-up
 	metricsRegistry     *metrics.Registry        // Prometheus metrics registry
+	cacheCorruption     prometheus.Counter       // Cached objects found truncated, see integrityCheck
+	inflightUpstream    prometheus.Gauge         // Requests outstanding at the mirrors, see proxy.Options
+	mirrorSources       *mirrors.Sources         // Per-server candidate mirror sources (geo lookup with its breaker and cache)
+	writeSlots          chan struct{}            // Cache writes in progress (cache.max_concurrent_writes), nil for no limit
+	readOnlyGuards      []*readOnlyGuard         // Disk stores that pass through uncached while their directory is read-only
+	diskGuards          []*diskGuard             // Disk stores that stop caching while their filesystem is low on space
 	versionInfo         *version.Info            // Version information
 	cacheHandler        *api.CacheHandler        // Cache API handler
+	cacheHistory        *api.CacheHistory        // Cache stats carried across restarts (cache.stats_file)
 	mirrorsHandler      *api.MirrorsHandler      // Mirrors API handler
+	distrosHandler      *api.DistrosHandler      // Distributions API handler
+	maintenanceHandler  *api.MaintenanceHandler  // Maintenance mode API handler
+	healthHandler       *api.HealthHandler       // Detailed health report API handler
 	authMiddleware      *api.AuthMiddleware      // API authentication middleware
 	rateLimitMiddleware *api.RateLimitMiddleware // API rate limit (per IP)
+	bandwidthLimiter    *api.BandwidthLimiter    // Per-client download throttle for proxied responses
+	startedAt           time.Time                // Construction time; bounds the readiness wait
+	idle                idleTracker              // Request activity, for server.idle_timeout_exit_sec
+	reloadMu            sync.Mutex               // Serializes reloads and mirror refreshes, which update config.Mirrors
 }
 
 // NewServer creates and initializes a new Server instance with the provided
@@ -74,7 +103,8 @@ func NewServer(cfg *config.Config) (*Server, error) {
 	}
 
 	s := &Server{
-		config: cfg,
+		config:    cfg,
+		startedAt: time.Now(),
 	}
 
 	// Initialize structured logger first
@@ -113,12 +143,13 @@ func (s *Server) initLogger() {
 	format := logger.ParseFormat(formatStr)
 
 	// Create logger with configuration
-	s.log = logger.New(logger.Config{
+	s.logConfig = logger.Config{
 		Level:       level,
 		Output:      os.Stdout,
 		Format:      format,
 		ServiceName: "apt-proxy",
-	})
+	}
+	s.log = logger.New(s.logConfig)
 
 	// Set as default logger
 	logger.SetDefault(s.log)
@@ -168,25 +199,63 @@ func (s *Server) initialize() error {
 		s.versionInfo = version.Default()
 	}
 
+	s.clientIP = api.NewClientIPExtractor(s.config.Security.TrustedProxies)
+
+	// Initialize metrics registry
+	s.metricsRegistry = metrics.NewRegistry("apt_proxy")
+
+	// Initialize cache metrics
+	httpcache.NewCacheMetrics(s.metricsRegistry)
+	s.cacheCorruption = s.metricsRegistry.WithSubsystem("cache").Counter("corruption_total").
+		Help("Total number of cached objects whose body did not match their Content-Length").
+		Build()
+	s.inflightUpstream = s.metricsRegistry.Gauge("inflight_upstream_requests").
+		Help("Number of requests outstanding at the mirrors").
+		Build()
+
 	// Initialize cache with configuration. Storage backend is selected by
 	// config.Storage.Backend; "disk" (default) keeps the historical
-	// behaviour, "s3" plugs an S3-compatible bucket in via the s3vfs VFS.
+	// behaviour, "s3" plugs an S3-compatible bucket in via the s3vfs VFS
+	// and "memory" keeps it in RAM.
 	cacheConfig := s.buildCacheConfig()
 	cache, err := s.initCache(cacheConfig)
 	if err != nil {
 		return wrapErr(apperrors.ErrCacheInit, "failed to initialize cache", err)
 	}
-	s.cache = cache
-
-	// Initialize metrics registry
-	s.metricsRegistry = metrics.NewRegistry("apt_proxy")
-
-	// Initialize cache metrics
-	httpcache.NewCacheMetrics(s.metricsRegistry)
+	shared := s.withIntegrityCheck(s.withWriteLimit(cache))
+	if s.s3fs == nil && s.memfs == nil {
+		shared = s.withDiskGuard(s.withReadOnlyGuard(shared, s.config.CacheDir), s.config.CacheDir)
+	}
+	s.cache = shared
+	stores, err := s.initDistroCaches()
+	if err != nil {
+		_ = s.cache.Close()
+		return wrapErr(apperrors.ErrCacheInit, "failed to initialize cache.dirs", err)
+	}
+	index, err := s.initIndexPool()
+	if err != nil {
+		_ = s.cache.Close()
+		for _, store := range stores {
+			_ = store.Close()
+		}
+		return wrapErr(apperrors.ErrCacheInit, "failed to initialize the cache's index pool", err)
+	}
+	caches := &distroCaches{ExtendedCache: shared, maxSize: s.config.Cache.MaxSize, index: index, indexMaxSize: s.config.Cache.IndexMaxSize, stores: stores}
+	s.cache = caches
+	if err := s.requireWritableCache(); err != nil {
+		_ = caches.Close()
+		return err
+	}
 
 	// Initialize health check aggregator
 	s.initHealthChecks()
 
+	sources, err := newMirrorSources(s.config)
+	if err != nil {
+		return wrapErr(apperrors.ErrConfigInvalid, "failed to load mirrors.list_file", err)
+	}
+	s.mirrorSources = sources
+
 	// Build the per-Server distribution registry. RegisterBuiltins seeds
 	// the compile-time defaults; Reload overlays user-supplied YAML when
 	// DistributionsConfigPath is set.
@@ -208,7 +277,36 @@ func (s *Server) initialize() error {
 
 	// Initialize proxy with async benchmark for faster startup.
 	// This uses default mirrors immediately and updates to the fastest mirror
-	// in the background after benchmarking completes.
+	// in the background after benchmarking completes. benchmark.mode "sync"
+	// instead blocks here until every mirror is chosen, so the server never
+	// swaps mirrors under a running apt session.
+	maxRedirects := 0
+	if s.config.Cache.FollowRedirects {
+		maxRedirects = proxy.DefaultMaxRedirects
+	}
+	bypass := make([]*regexp.Regexp, 0, len(s.config.Cache.BypassPatterns))
+	for _, pattern := range s.config.Cache.BypassPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return wrapErr(apperrors.ErrConfigInvalid, "invalid cache.bypass_patterns entry", err)
+		}
+		bypass = append(bypass, re)
+	}
+	queryKeys := make([]*regexp.Regexp, 0, len(s.config.Cache.QueryKeyPatterns))
+	for _, pattern := range s.config.Cache.QueryKeyPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return wrapErr(apperrors.ErrConfigInvalid, "invalid cache.query_key_patterns entry", err)
+		}
+		queryKeys = append(queryKeys, re)
+	}
+	via := s.config.Proxy.Via
+	if via == "" {
+		via = config.DefaultVia
+	}
+	if s.config.Proxy.OmitVia {
+		via = ""
+	}
 	ps, err := proxy.NewPackageStruct(proxy.Options{
 		State:           s.state,
 		Registry:        s.registry,
@@ -216,37 +314,117 @@ func (s *Server) initialize() error {
 		Logger:          s.log,
 		Mode:            s.state.GetProxyMode(),
 		EnableKeepAlive: s.config.UpstreamKeepAlive,
-		Async:           true,
+		DNS: proxy.DNSOptions{
+			Overrides: s.config.DNS.Overrides,
+			Server:    s.config.DNS.Server,
+			CacheTTL:  s.config.DNS.CacheTTL,
+		},
+		DialTimeout:               s.config.Transport.DialTimeout,
+		DistroConcurrency:         s.config.Benchmark.DistroConcurrency,
+		MaxRedirects:              maxRedirects,
+		CacheBypass:               bypass,
+		CacheQueryKeys:            queryKeys,
+		ForwardQuery:              s.config.Cache.ForwardQuery,
+		DisableRewrite:            s.config.Proxy.DisableRewrite,
+		TTLByExtension:            s.config.Cache.TTLByExtension,
+		SanityCheck:               s.config.Cache.SanityCheck,
+		Treat403As404:             s.config.Transport.Treat403As404,
+		ResponseHeaderTimeouts:    responseHeaderTimeouts(s.config.Transport.ResponseHeaderTimeouts),
+		SanityFailover:            s.config.Cache.SanityFailover,
+		StripHeaders:              s.config.Proxy.StripHeaders,
+		AddHeaders:                s.config.Proxy.AddHeaders,
+		Via:                       via,
+		LazyBenchmark:             s.config.Mirrors.LazyBenchmark,
+		MinSuccessRate:            s.config.Mirrors.MinSuccessRate,
+		AdoptRedirects:            s.config.Mirrors.AdoptRedirects,
+		SameOperatorFailover:      s.config.Mirrors.SameOperatorFailover,
+		BadGatewayRetryAfter:      s.config.Mirrors.BadGatewayRetryAfter,
+		BadGatewayRefreshInterval: s.config.Mirrors.BadGatewayRefreshInterval,
+		MirrorPathPrefixes:        s.config.Mirrors.PathPrefixes,
+		BenchmarkProbe:            benchmarks.Probe(s.config.Benchmark.Probe),
+		BenchmarkResultTTL:        s.config.Benchmark.ResultTTL,
+		BenchmarkResultsFile:      s.config.Benchmark.ResultsFile,
+		BenchmarkMaxStale:         s.config.Benchmark.MaxStaleOnStart,
+		Async:                     s.config.Benchmark.Mode != config.BenchmarkModeSync,
+		MirrorTLS:                 mirrorTLSOptions(s.config.Transport.MirrorTLS),
+		ClientIP:                  s.clientIP.ClientIP,
+		InflightUpstream:          s.inflightUpstream,
+		MirrorSources:             s.mirrorSources,
+
+		Maintenance:           s.config.Maintenance,
+		MaintenanceRetryAfter: s.config.MaintenanceRetryAfter,
 	})
 	if err != nil {
 		return wrapErr(apperrors.ErrServerInit, "failed to initialize proxy", err)
 	}
 	s.proxy = ps
 
-	// Wrap proxy with cache (request logging is done by logger-kit FiberMiddleware)
-	cachedHandler := httpcache.NewHandlerWithOptions(s.cache, s.proxy.Handler, &httpcache.HandlerOptions{Logger: s.log})
-	s.proxy.Handler = cachedHandler
+	// Wrap proxy with cache (request logging is done by logger-kit
+	// FiberMiddleware). Each distribution gets the same chain over its
+	// cache.dirs store or, tagging what it stores so it can be purged on
+	// its own, over the default cache; with an index pool, index files of
+	// the latter get a chain over the pool.
+	if err := s.initDistroTags(caches); err != nil {
+		_ = s.cache.Close()
+		return wrapErr(apperrors.ErrCacheInit, "failed to open the cache's distribution index", err)
+	}
+	upstream := s.proxy.Handler
+	s.proxy.Handler = s.cacheChain(s.cache, upstream)
+	dists := s.registry.GetAll()
+	s.proxy.DistroHandlers = make(map[int]http.Handler, len(dists))
+	if index != nil {
+		s.proxy.IndexHandlers = make(map[int]http.Handler, len(dists))
+	}
+	for _, dist := range dists {
+		store, ok := stores[dist.Type]
+		if !ok {
+			store = &taggingStore{ExtendedCache: shared, id: dist.ID, tags: caches.tags, log: s.log}
+			if index != nil {
+				indexStore := &taggingStore{ExtendedCache: index, id: dist.ID, tags: caches.tags, log: s.log}
+				s.proxy.IndexHandlers[dist.Type] = s.cacheChain(indexStore, upstream)
+			}
+		}
+		s.proxy.DistroHandlers[dist.Type] = s.cacheChain(store, upstream)
+	}
+
+	if mode := s.modeHealth(); mode.Fallback {
+		s.log.Warn().Str("configured", mode.Configured).Str("resolved", mode.Resolved).Msg("unrecognized mode, serving all distributions")
+	}
 
 	if s.config.Debug {
 		s.log.Debug().Msg("debug mode enabled")
 		httpcache.SetDebugLogging(true)
+		if s.proxy.MirrorsReady() {
+			s.proxy.LogMirrorPlan()
+		} else {
+			go s.logMirrorPlan()
+		}
 	}
 
 	// Initialize API handlers (mirrors refresh also reloads distributions config when path set)
-	s.cacheHandler = api.NewCacheHandler(s.cache, s.log)
-	s.mirrorsHandler = api.NewMirrorsHandler(s.log, s.refreshMirrors)
-
-	// Both middlewares need to agree on what counts as the "real" client
-	// IP. Construct the extractor once and share it; otherwise auth logs
-	// could attribute a request to r.RemoteAddr (the proxy) while
-	// rate-limit logs attributed it to the XFF left-most IP, making it
-	// impossible to correlate forensic events.
-	clientIP := api.NewClientIPExtractor(s.config.Security.TrustedProxies)
-
+	history, err := api.LoadCacheHistory(s.config.Cache.StatsFile)
+	if err != nil {
+		s.log.Warn().Err(err).Str("path", s.config.Cache.StatsFile).Msg("cannot restore cache stats, starting a new history")
+	}
+	s.cacheHistory = history
+	s.cacheHandler = api.NewCacheHandlerWithHistory(s.cache, s.cacheHistory, s.log)
+	s.mirrorsHandler = api.NewMirrorsHandler(s.log, s.mirrorSources.Geo(), s.refreshMirrors, s.refreshDistro)
+	s.distrosHandler = api.NewDistrosHandler(s.registry, s.log, s.reloadDistributions)
+	s.maintenanceHandler = api.NewMaintenanceHandler(s.log, s.maintenanceStatus, s.proxy.SetMaintenance)
+	// cache.max_size applies to each store, so the aggregate limit grows
+	// with cache.dirs.
+	maxSize := s.config.Cache.MaxSize * int64(1+len(stores))
+	s.healthHandler = api.NewHealthHandler(s.log, s.healthAggregator, s.cache, maxSize, s.startedAt, s.mirrorHealth, s.modeHealth)
+
+	// The middlewares need to agree on what counts as the "real" client
+	// IP, so they share s.clientIP; otherwise auth logs could attribute a
+	// request to r.RemoteAddr (the proxy) while rate-limit logs attributed
+	// it to a forwarded IP, making it impossible to correlate forensic
+	// events.
 	s.authMiddleware = api.NewAuthMiddleware(api.AuthConfig{
 		APIKey:   s.config.Security.APIKey,
 		Logger:   s.log,
-		ClientIP: clientIP,
+		ClientIP: s.clientIP,
 	})
 
 	s.rateLimitMiddleware = api.NewRateLimitMiddleware(
@@ -255,9 +433,23 @@ func (s *Server) initialize() error {
 		s.config.Security.TrustedProxies...,
 	)
 
+	s.bandwidthLimiter = api.NewBandwidthLimiter(s.config.RateLimit.BytesPerSecond, s.clientIP)
+
+	if path := s.config.Log.AccessFile; path != "" {
+		f, err := openAccessLogFile(path)
+		if err != nil {
+			return wrapErr(apperrors.ErrConfigInvalid, "failed to open log.access_file", err)
+		}
+		s.accessLog = f
+	}
+
 	// Create Fiber app with all routes
 	s.app = s.createFiberApp()
+	if s.config.Admin.Listen != "" {
+		s.adminApp = s.createAdminApp()
+	}
 
+	s.startCacheGuards()
 	return nil
 }
 
@@ -265,31 +457,120 @@ func (s *Server) initialize() error {
 func (s *Server) initHealthChecks() {
 	cfg := health.DefaultConfig().
 		WithServiceName("apt-proxy").
-		WithTimeout(2 * time.Second)
+		WithTimeout(2 * time.Second).
+		WithCriticalChecks([]string{"cache", "storage", "mirrors"})
 
 	s.healthAggregator = health.NewAggregator(cfg)
+	s.readyAggregator = health.NewAggregator(cfg)
 
 	// Register a storage-specific health check. For the local-disk backend
 	// we keep the cheap os.Stat probe; for S3 we delegate to a HeadBucket
 	// round-trip so we surface bucket-not-found / IAM regressions promptly.
+	var storage health.Checker
 	if s.s3fs != nil {
 		fs := s.s3fs
-		s.healthAggregator.AddChecker(health.NewCustomChecker("storage", func(ctx context.Context) error {
+		storage = health.NewCustomChecker("storage", func(ctx context.Context) error {
 			return fs.HealthCheck(ctx)
-		}).WithTimeout(2 * time.Second))
-		return
+		}).WithTimeout(2 * time.Second)
+	} else {
+		// Fallback: local-disk cache directory check.
+		storage = health.NewCustomChecker("cache", func(ctx context.Context) error {
+			if _, err := os.Stat(s.config.CacheDir); err != nil {
+				return err
+			}
+			for _, dir := range s.config.Cache.Dirs {
+				if _, err := os.Stat(dir); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).WithTimeout(1 * time.Second)
 	}
+	s.healthAggregator.AddChecker(storage)
+	// A read-only cache directory degrades the service without failing it:
+	// cache_writable is left out of the critical checks above.
+	writable := health.NewCheckerFunc("cache_writable", s.checkCacheWritable)
+	s.healthAggregator.AddChecker(writable)
+
+	// /readyz additionally waits for the startup mirror benchmarks, so
+	// orchestrators don't route traffic while we still point at defaults.
+	s.readyAggregator.AddChecker(storage)
+	s.readyAggregator.AddChecker(writable)
+	s.readyAggregator.AddChecker(health.NewCustomChecker("mirrors", s.checkMirrorsReady).WithTimeout(1 * time.Second))
+}
 
-	// Fallback: local-disk cache directory check.
-	s.healthAggregator.AddChecker(health.NewCustomChecker("cache", func(ctx context.Context) error {
-		_, err := os.Stat(s.config.CacheDir)
-		return err
-	}).WithTimeout(1 * time.Second))
+// checkMirrorsReady fails while async mirror benchmarks are pending, until
+// config.ReadyTimeout has elapsed since the server was created.
+func (s *Server) checkMirrorsReady(ctx context.Context) error {
+	if s.proxy == nil || s.proxy.MirrorsReady() {
+		return nil
+	}
+	if s.config.ReadyTimeout <= 0 || time.Since(s.startedAt) >= s.config.ReadyTimeout {
+		return nil
+	}
+	return stderrors.New("mirror benchmarks still running")
+}
+
+// mirrorPlanWait bounds how long the debug mirror plan waits for the
+// startup benchmarks before logging whatever has been selected so far.
+const mirrorPlanWait = 30 * time.Second
+
+// logMirrorPlan logs the resolved mirror plan once the startup benchmarks
+// have finished (or mirrorPlanWait has passed).
+func (s *Server) logMirrorPlan() {
+	timer := time.NewTimer(mirrorPlanWait)
+	defer timer.Stop()
+	select {
+	case <-s.proxy.MirrorsIdle():
+	case <-timer.C:
+	}
+	s.proxy.LogMirrorPlan()
+}
+
+// mirrorHealth converts the proxy's per-distribution mirror state for
+// /api/health.
+func (s *Server) mirrorHealth() []api.MirrorHealth {
+	statuses := s.proxy.MirrorStatuses()
+	out := make([]api.MirrorHealth, 0, len(statuses))
+	for _, st := range statuses {
+		mh := api.MirrorHealth{Distro: st.Distro, Mirror: st.Mirror, RedirectedTo: st.RedirectedTo}
+		if st.Benchmarked {
+			run := st.Benchmark
+			reachable := run.Err == nil
+			mh.Reachable = &reachable
+			mh.BenchmarkedAt = &run.At
+			if reachable {
+				latency := run.Latency.Milliseconds()
+				mh.LatencyMs = &latency
+			} else {
+				mh.Error = run.Err.Error()
+			}
+		}
+		out = append(out, mh)
+	}
+	return out
+}
+
+// modeHealth reports the configured and resolved proxy mode for
+// /api/health.
+func (s *Server) modeHealth() api.ModeHealth {
+	resolved := distro.DistributionName(s.config.Mode)
+	if s.config.Mode == distro.TypeAllDistros {
+		resolved = distro.DistroAll
+	}
+	return api.ModeHealth{
+		Configured:    s.config.ModeName,
+		Resolved:      resolved,
+		ResolvedType:  s.config.Mode,
+		Fallback:      s.config.ModeName != "" && s.config.ModeName != resolved,
+		ActiveDistros: s.proxy.ActiveDistros(),
+	}
 }
 
 // initCache constructs a cache backend selected by config.Storage.Backend.
 // Empty backend and "disk" preserve the historical local-disk implementation;
-// "s3" wires httpcache-kit through the s3vfs VFS.
+// "s3" wires httpcache-kit through the s3vfs VFS; "memory" through an
+// in-memory VFS, with the same size limit and eviction as on disk.
 //
 // On the s3 path we also stash the *S3VFS in the Server so the health check
 // (and any future maintenance hooks) can reach it without re-creating a
@@ -327,11 +608,200 @@ func (s *Server) initCache(cacheConfig *httpcache.CacheConfig) (httpcache.Extend
 			Str("prefix", s3cfg.Prefix).
 			Msg("storage backend: s3")
 		return httpcache.NewVFSCacheWithConfig(fs, cacheConfig), nil
+	case config.StorageBackendMemory:
+		s.memfs = vfs.Memory()
+		s.log.Info().
+			Int64("max_size_bytes", s.config.Cache.MaxSize).
+			Msg("storage backend: memory")
+		return httpcache.NewVFSCacheWithConfig(s.memfs, cacheConfig), nil
 	default:
 		return nil, fmt.Errorf("unknown storage backend %q", s.config.Storage.Backend)
 	}
 }
 
+// withIntegrityCheck wraps a store so that objects with a truncated body
+// are fetched again instead of served, see integrityCheck.
+func (s *Server) withIntegrityCheck(cache httpcache.ExtendedCache) httpcache.ExtendedCache {
+	return newIntegrityCheck(cache, s.cacheCorruption, s.log)
+}
+
+// withWriteLimit wraps a store so that it shares the limit on concurrent
+// cache writes when cache.max_concurrent_writes is set.
+func (s *Server) withWriteLimit(cache httpcache.ExtendedCache) httpcache.ExtendedCache {
+	if s.config.Cache.MaxConcurrentWrites <= 0 {
+		return cache
+	}
+	if s.writeSlots == nil {
+		s.writeSlots = make(chan struct{}, s.config.Cache.MaxConcurrentWrites)
+	}
+	return newWriteLimit(cache, s.writeSlots)
+}
+
+// withDiskGuard wraps a disk store in a diskGuard for dir when
+// cache.min_free_bytes is set. Only disk stores may be wrapped: the guard
+// purges the store when dir's filesystem runs low.
+func (s *Server) withDiskGuard(cache httpcache.ExtendedCache, dir string) httpcache.ExtendedCache {
+	if s.config.Cache.MinFreeBytes <= 0 {
+		return cache
+	}
+	guard := newDiskGuard(cache, dir, s.config.Cache.MinFreeBytes, s.log)
+	guard.check()
+	s.diskGuards = append(s.diskGuards, guard)
+	return guard
+}
+
+// withReadOnlyGuard wraps a disk store in a readOnlyGuard for dir, which
+// the cache_writable health check reports on.
+func (s *Server) withReadOnlyGuard(cache httpcache.ExtendedCache, dir string) httpcache.ExtendedCache {
+	guard := newReadOnlyGuard(cache, dir, s.log)
+	if s.config.Cache.AllowReadOnly {
+		guard.check()
+	}
+	s.readOnlyGuards = append(s.readOnlyGuards, guard)
+	return guard
+}
+
+// startCacheGuards starts the periodic checks of the disk stores' guards.
+// initialize calls it once nothing else can fail, so a Server that failed
+// to start has no checks left running.
+func (s *Server) startCacheGuards() {
+	for _, guard := range s.readOnlyGuards {
+		go guard.run(readOnlyProbeInterval)
+	}
+	for _, guard := range s.diskGuards {
+		go guard.run(diskGuardInterval)
+	}
+}
+
+// requireWritableCache fails with ErrCacheDirAccess when a disk cache
+// directory cannot be written to, so that a misconfigured cache.dir stops
+// the server at startup instead of leaving it proxying without caching.
+// cache.allow_read_only lets it start in pass-through mode instead.
+func (s *Server) requireWritableCache() error {
+	if s.config.Cache.AllowReadOnly {
+		return nil
+	}
+	for _, guard := range s.readOnlyGuards {
+		if err := guard.probe(guard.dir); err != nil {
+			return wrapErr(apperrors.ErrCacheDirAccess, "cache directory "+guard.dir+" is not writable (set cache.allow_read_only to start without caching)", err)
+		}
+	}
+	return nil
+}
+
+// checkCacheWritable reports the health check degraded while a cache
+// directory is read-only and its store passes requests through uncached.
+func (s *Server) checkCacheWritable(ctx context.Context) health.CheckResult {
+	result := health.CheckResult{Name: "cache_writable", Status: health.StatusHealthy, Timestamp: time.Now()}
+	var dirs []string
+	for _, guard := range s.readOnlyGuards {
+		if guard.readOnly.Load() {
+			dirs = append(dirs, guard.dir)
+		}
+	}
+	if len(dirs) > 0 {
+		result.Status = health.StatusDegraded
+		result.Error = "cache directory is read-only, proxying without caching"
+		result.Metadata = map[string]any{"read_only_dirs": dirs}
+	}
+	return result
+}
+
+// initDistroTags opens the index of which distribution stored each object
+// of the default cache, and the storage those objects live in, so that
+// caches can purge single distributions.
+func (s *Server) initDistroTags(caches *distroCaches) error {
+	var files vfs.VFS = s.s3fs
+	if s.memfs != nil {
+		files = s.memfs
+	} else if s.s3fs == nil {
+		var err error
+		if files, err = diskCacheFiles(s.config.CacheDir); err != nil {
+			return err
+		}
+	}
+	caches.files = []vfs.VFS{files}
+	if caches.index != nil {
+		indexFiles, err := diskCacheFiles(filepath.Join(s.config.CacheDir, indexPoolDir))
+		if err != nil {
+			return err
+		}
+		caches.files = append(caches.files, indexFiles)
+	}
+	tags, err := openDistroTags(filepath.Join(s.config.CacheDir, distroTagsFile))
+	if err != nil {
+		return err
+	}
+	caches.tags, caches.registry = tags, s.registry
+	return nil
+}
+
+// diskCacheFiles returns dir as the VFS httpcache.NewDiskCacheWithConfig
+// stores its objects in.
+func diskCacheFiles(dir string) (vfs.VFS, error) {
+	fs, err := vfs.FS(dir)
+	if err != nil {
+		return nil, err
+	}
+	return vfs.Chroot("/", fs)
+}
+
+// initIndexPool opens the index pool under cache.dir when
+// cache.index_max_size_mb is set, limited to that size; it returns nil
+// otherwise.
+func (s *Server) initIndexPool() (httpcache.ExtendedCache, error) {
+	if s.config.Cache.IndexMaxSize <= 0 {
+		return nil, nil
+	}
+	dir := filepath.Join(s.config.CacheDir, indexPoolDir)
+	cache, err := httpcache.NewDiskCacheWithConfig(dir, s.buildCacheConfig().WithMaxSize(s.config.Cache.IndexMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info().Str("dir", dir).Int64("max_size_bytes", s.config.Cache.IndexMaxSize).Msg("keeping index files in a pool of their own")
+	return s.withDiskGuard(s.withReadOnlyGuard(s.withIntegrityCheck(s.withWriteLimit(cache)), dir), dir), nil
+}
+
+// initDistroCaches opens a disk store for each cache.dirs entry, keyed by
+// distro type. On error the stores opened so far are closed.
+func (s *Server) initDistroCaches() (map[int]httpcache.ExtendedCache, error) {
+	if len(s.config.Cache.Dirs) == 0 {
+		return nil, nil
+	}
+	stores := make(map[int]httpcache.ExtendedCache, len(s.config.Cache.Dirs))
+	for name, dir := range s.config.Cache.Dirs {
+		cache, err := httpcache.NewDiskCacheWithConfig(dir, s.buildCacheConfig())
+		if err != nil {
+			for _, store := range stores {
+				_ = store.Close()
+			}
+			return nil, fmt.Errorf("cache.dirs.%s: %w", name, err)
+		}
+		stores[config.ModeToInt(name)] = s.withDiskGuard(s.withReadOnlyGuard(s.withIntegrityCheck(s.withWriteLimit(cache)), dir), dir)
+		s.log.Info().Str("distro", name).Str("dir", dir).Msg("using a separate cache directory")
+	}
+	return stores, nil
+}
+
+// cacheChain serves next through cache: the caching handler (which must
+// not take an upstream failure for a successful revalidation), stale copies
+// when upstream fails with cache.serve_stale_on_error, HEAD answers from
+// cached headers and, with cache.compress_level, gzip for indexes. Release
+// files past their Valid-Until are revalidated, see validUntilCheck.
+func (s *Server) cacheChain(cache httpcache.ExtendedCache, next http.Handler) http.Handler {
+	cache = newValidUntilCheck(cache, s.log)
+	var h http.Handler = httpcache.NewHandlerWithOptions(cache, abortRecovered{failedRevalidation{next}}, &httpcache.HandlerOptions{Logger: s.log})
+	h = hideRevalidationMarker{h}
+	if s.config.Cache.ServeStaleOnError {
+		h = newStaleOnError(cache, h, s.config.Cache.MaxStale, s.log)
+	}
+	h = newHeadFromCache(cache, h)
+	if level := s.config.Cache.CompressLevel; level > 0 {
+		h = newGzipIndexes(h, level)
+	}
+	return h
+}
+
 // buildCacheConfig creates a cache configuration from the application config
 func (s *Server) buildCacheConfig() *httpcache.CacheConfig {
 	cacheConfig := httpcache.DefaultCacheConfig()
@@ -356,8 +826,50 @@ const (
 	defaultWriteTimeout = 100 * time.Second
 	defaultIdleTimeout  = 120 * time.Second
 	defaultReadBufSize  = 4096 * 4 // 16KB, align with former ReadHeaderTimeout behavior
+	defaultMaxURLLength = 8 << 10  // apt paths are a few hundred bytes at most
+	defaultAPIPrefix    = "/api"
 )
 
+// apiPrefix is the path the management API is mounted under: the
+// configured server.api_prefix, or defaultAPIPrefix.
+func (s *Server) apiPrefix() string {
+	if s.config.APIPrefix != "" {
+		return s.config.APIPrefix
+	}
+	return defaultAPIPrefix
+}
+
+// maxHeaderBytes is the limit on the request line plus headers: the
+// configured server.max_header_bytes, or defaultReadBufSize.
+func (s *Server) maxHeaderBytes() int {
+	if s.config.MaxHeaderBytes > 0 {
+		return s.config.MaxHeaderBytes
+	}
+	return defaultReadBufSize
+}
+
+// maxURLLength is the longest request target accepted: the configured
+// server.max_url_length, or defaultMaxURLLength.
+func (s *Server) maxURLLength() int {
+	if s.config.MaxURLLength > 0 {
+		return s.config.MaxURLLength
+	}
+	return defaultMaxURLLength
+}
+
+// rejectLongURLs answers 414 for request targets longer than
+// server.max_url_length (default defaultMaxURLLength) before they reach
+// any route.
+func (s *Server) rejectLongURLs() fiber.Handler {
+	limit := s.maxURLLength()
+	return func(c *fiber.Ctx) error {
+		if len(c.Request().RequestURI()) > limit {
+			return c.Status(fiber.StatusRequestURITooLong).SendString("Request-URI Too Long")
+		}
+		return c.Next()
+	}
+}
+
 // cacheLabelFromHeader normalizes X-Cache header to HIT/MISS/SKIP for logging.
 func cacheLabelFromHeader(h string) string {
 	h = strings.TrimSpace(h)
@@ -374,42 +886,132 @@ func cacheLabelFromHeader(h string) string {
 }
 
 // createFiberApp creates the Fiber application with all routes and middleware.
+// With admin.listen set the management endpoints are left to
+// createAdminApp, and the API prefix answers 404 here.
 func (s *Server) createFiberApp() *fiber.App {
+	app := s.newFiberApp()
+	if s.config.Admin.Listen == "" {
+		s.addAdminRoutes(app)
+	} else {
+		notFound := func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusNotFound) }
+		app.All(s.apiPrefix(), notFound)
+		app.All(s.apiPrefix()+"/*", notFound)
+	}
+
+	// Ping (/_/ping and /_/ping/ and /_/ping/...)
+	pingHandler := func(c *fiber.Ctx) error {
+		c.Set("Content-Type", "text/plain; charset=utf-8")
+		return c.SendString("pong")
+	}
+	app.All("/_/ping", pingHandler)
+	app.All("/_/ping/*", pingHandler)
+
+	// Root "/" -> home page (Fiber native), with the selected mirrors
+	app.Get("/", func(c *fiber.Ctx) error {
+		c.Set("Content-Type", "text/html; charset=utf-8")
+		return c.SendString(proxy.RenderHomePage(s.config.CacheDir, s.proxy.HomeMirrors()))
+	})
+	// Static assets (must be registered before the catch-all proxy below).
+	app.Get("/static/apt-proxy-logo.png", adaptor.HTTPHandler(http.HandlerFunc(proxy.ServeStaticLogo)))
+	app.All(proxy.InternalPageFavicon, adaptor.HTTPHandler(http.HandlerFunc(proxy.ServeFavicon)))
+	app.All(proxy.InternalPageRobots, adaptor.HTTPHandler(http.HandlerFunc(proxy.ServeRobots)))
+	// All other paths -> proxy (rewrite) -> cache -> upstream.
+	app.All("/*", proxyHandler(s.proxyChain()))
+
+	return app
+}
+
+// proxyChain is the net/http handler every proxied request runs through.
+// The bandwidth limiter sits outside the cache so hits and misses are
+// throttled alike.
+func (s *Server) proxyChain() http.Handler {
+	return s.cacheHistory.Wrap(s.bandwidthLimiter.Wrap(s.proxy))
+}
+
+// createAdminApp creates the Fiber application served on admin.listen:
+// the management endpoints and nothing else.
+func (s *Server) createAdminApp() *fiber.App {
+	app := s.newFiberApp()
+	s.addAdminRoutes(app)
+	return app
+}
+
+// newFiberApp creates a Fiber application with the middleware every
+// listener shares.
+func (s *Server) newFiberApp() *fiber.App {
 	app := fiber.New(fiber.Config{
 		DisableStartupMessage: true,
 		ReadTimeout:           defaultReadTimeout,
 		WriteTimeout:          defaultWriteTimeout,
 		IdleTimeout:           defaultIdleTimeout,
-		ReadBufferSize:        defaultReadBufSize,
+		// fasthttp answers 431 when the request line and headers do not
+		// fit in the read buffer, so its size is the header limit.
+		ReadBufferSize: s.maxHeaderBytes(),
 	})
 
 	// Version headers for all responses
 	app.Use(version.FiberMiddleware(s.versionInfo, "X-"))
 	// Security headers
 	app.Use(middleware.SecurityHeaders(middleware.DefaultSecurityHeadersConfig()))
+	if s.config.IdleTimeoutExit > 0 {
+		app.Use(s.idle.middleware(healthProbePaths(s.config.HealthPrefix)))
+	}
+
+	// Request logging: logger-kit FiberMiddleware, unified with request_id and cache/size for proxy.
+	logCfg, accessCfg := s.accessLogConfig()
+	logCfg.CustomFieldsFiber = func(c *fiber.Ctx) map[string]interface{} {
+		// Use Content-Length header when available so we don't pull the
+		// body into memory just to record its size. A streamed body is
+		// not read at all: that would buffer it, throttled or not, before
+		// any of it is sent, so without a Content-Length its size is not
+		// logged.
+		fields := map[string]interface{}{
+			"cache":     cacheLabelFromHeader(string(c.Response().Header.Peek("X-Cache"))),
+			"client_ip": s.clientIP.ClientIPFromPeer(c.Context().RemoteAddr().String(), c.Get("X-Forwarded-For"), c.Get("Forwarded")),
+		}
+		if size := c.Response().Header.ContentLength(); size > 0 {
+			fields["size"] = size
+		} else if !c.Response().IsBodyStream() {
+			fields["size"] = len(c.Response().Body())
+		}
+		if ip, ok := s.takeUpstreamIP(c); ok {
+			fields["upstream_ip"] = ip
+		}
+		return fields
+	}
+	if rate := s.config.Log.SampleRate; rate > 1 {
+		app.Use(newSampledAccessLog(logCfg, accessCfg, rate))
+	} else {
+		app.Use(logger.FiberMiddleware(logCfg))
+	}
+	app.Use(s.rejectLongURLs())
+
+	return app
+}
 
-	// Request logging: logger-kit FiberMiddleware, unified with request_id and cache/size for proxy
+// accessLogConfig returns the request logging middleware settings shared
+// by the Fiber and net/http front ends, and the logger config the lines
+// are formatted with. With log.access_file the lines go to that file, in
+// the app log's format.
+func (s *Server) accessLogConfig() (logger.MiddlewareConfig, logger.Config) {
+	accessCfg := s.logConfig
 	logCfg := logger.DefaultMiddlewareConfig()
 	logCfg.Logger = s.log
-	logCfg.SkipPaths = []string{"/healthz", "/livez", "/readyz"} // skip health noise
+	if s.accessLog != nil {
+		accessCfg.Output = s.accessLog
+		logCfg.Logger = logger.New(accessCfg)
+	}
+	logCfg.SkipPaths = healthProbePaths(s.config.HealthPrefix) // skip health noise
 	if s.config.Debug {
 		logCfg.IncludeHeaders = true
 		logCfg.IncludeBody = true
 	}
-	logCfg.CustomFieldsFiber = func(c *fiber.Ctx) map[string]interface{} {
-		// Use Content-Length header when available so we don't pull the
-		// (potentially streamed) body into memory just to record its size.
-		size := c.Response().Header.ContentLength()
-		if size <= 0 {
-			size = len(c.Response().Body())
-		}
-		return map[string]interface{}{
-			"cache": cacheLabelFromHeader(string(c.Response().Header.Peek("X-Cache"))),
-			"size":  size,
-		}
-	}
-	app.Use(logger.FiberMiddleware(logCfg))
+	return logCfg, accessCfg
+}
 
+// addAdminRoutes registers the health probes, /version, /metrics and the
+// management API on app.
+func (s *Server) addAdminRoutes(app *fiber.App) {
 	// Health check endpoints (Fiber native)
 	// We deliberately use a local handler instead of health.FiberHandler /
 	// health.FiberReadinessHandler: the upstream helpers feed the fasthttp
@@ -417,9 +1019,11 @@ func (s *Server) createFiberApp() *fiber.App {
 	// goroutine that races with fiber/fasthttp's ShutdownWithContext during
 	// graceful shutdown (see internal/cli/health.go). Liveness has no
 	// aggregator and is safe to use as-is.
-	app.Get("/healthz", fiberHealthHandler(s.healthAggregator))
-	app.Get("/livez", health.FiberLivenessHandler("apt-proxy"))
-	app.Get("/readyz", fiberHealthHandler(s.healthAggregator))
+	// They are served under server.health_prefix, the root by default.
+	probes := s.config.HealthPrefix
+	app.Get(probes+"/healthz", fiberHealthHandler(s.healthAggregator))
+	app.Get(probes+"/livez", health.FiberLivenessHandler("apt-proxy"))
+	app.Get(probes+"/readyz", fiberHealthHandler(s.readyAggregator))
 
 	// Version endpoint (Fiber native)
 	app.Get("/version", version.FiberHandler(version.HandlerConfig{
@@ -430,39 +1034,25 @@ func (s *Server) createFiberApp() *fiber.App {
 	// Metrics (wrap net/http handler via adaptor)
 	app.Get("/metrics", adaptor.HTTPHandler(metrics.HandlerFor(s.metricsRegistry)))
 
-	// Cache & mirrors API (rate limit then auth)
+	// Cache & mirrors API (rate limit then auth), under server.api_prefix.
+	// A path freed by moving either prefix falls through to the proxy.
 	apiHandler := func(h http.HandlerFunc) http.Handler {
 		return s.rateLimitMiddleware.Wrap(s.authMiddleware.WrapFunc(h))
 	}
-	app.All("/api/cache/stats", adaptor.HTTPHandler(apiHandler(s.cacheHandler.HandleCacheStats)))
-	app.All("/api/cache/purge", adaptor.HTTPHandler(apiHandler(s.cacheHandler.HandleCachePurge)))
-	app.All("/api/cache/cleanup", adaptor.HTTPHandler(apiHandler(s.cacheHandler.HandleCacheCleanup)))
-	app.All("/api/mirrors/refresh", adaptor.HTTPHandler(apiHandler(s.mirrorsHandler.HandleMirrorsRefresh)))
-
-	// Ping (/_/ping and /_/ping/ and /_/ping/...)
-	pingHandler := func(c *fiber.Ctx) error {
-		c.Set("Content-Type", "text/plain; charset=utf-8")
-		return c.SendString("pong")
-	}
-	app.All("/_/ping", pingHandler)
-	app.All("/_/ping/*", pingHandler)
-
-	// Root "/" -> home page (Fiber native)
-	app.Get("/", func(c *fiber.Ctx) error {
-		tpl, status := proxy.RenderInternalUrls("/", s.config.CacheDir)
-		c.Set("Content-Type", "text/html; charset=utf-8")
-		c.Status(status)
-		return c.SendString(tpl)
-	})
-	// Static assets (must be registered before the catch-all proxy below).
-	app.Get("/static/apt-proxy-logo.png", adaptor.HTTPHandler(http.HandlerFunc(proxy.ServeStaticLogo)))
-	// All other paths -> proxy + cache
-	app.All("/*", adaptor.HTTPHandler(s.proxy.Handler))
-
-	return app
+	api := s.apiPrefix()
+	app.All(api+"/cache/stats", adaptor.HTTPHandler(apiHandler(s.cacheHandler.HandleCacheStats)))
+	app.All(api+"/cache/purge", adaptor.HTTPHandler(apiHandler(s.cacheHandler.HandleCachePurge)))
+	app.All(api+"/cache/cleanup", adaptor.HTTPHandler(apiHandler(s.cacheHandler.HandleCacheCleanup)))
+	app.All(api+"/mirrors", adaptor.HTTPHandler(apiHandler(s.mirrorsHandler.HandleMirrors)))
+	app.All(api+"/mirrors/refresh", adaptor.HTTPHandler(apiHandler(s.mirrorsHandler.HandleMirrorsRefresh)))
+	app.All(api+"/distros", adaptor.HTTPHandler(apiHandler(s.distrosHandler.HandleDistros)))
+	app.All(api+"/distros/reload", adaptor.HTTPHandler(apiHandler(s.distrosHandler.HandleDistrosReload)))
+	app.All(api+"/maintenance", adaptor.HTTPHandler(apiHandler(s.maintenanceHandler.HandleMaintenance)))
+	app.All(api+"/health", adaptor.HTTPHandler(apiHandler(s.healthHandler.HandleHealth)))
 }
 
-// Start begins serving HTTP requests and handles graceful shutdown on SIGINT or SIGTERM.
+// Start begins serving HTTP requests and handles graceful shutdown on SIGINT or SIGTERM,
+// or once server.idle_timeout_exit_sec passes without a request.
 // It also handles SIGHUP for configuration hot reload.
 // The server runs in a goroutine while the main goroutine waits for shutdown signals.
 // Returns an error if the server fails to start or encounters a fatal error.
@@ -470,6 +1060,8 @@ func (s *Server) Start() error {
 	protocol := "http"
 	if s.config.TLS.Enabled {
 		protocol = "https"
+	} else if s.config.H2C {
+		protocol = "h2c"
 	}
 	s.log.Info().
 		Str("version", s.versionInfo.String()).
@@ -486,23 +1078,25 @@ func (s *Server) Start() error {
 	signal.Notify(sighupChan, syscall.SIGHUP)
 	defer signal.Stop(sighupChan)
 
-	// Start Fiber in goroutine
-	serverErr := make(chan error, 1)
+	if s.usesHTTP2() {
+		s.httpServer = s.newHTTPServer()
+	}
+
+	// Start the listeners in goroutines
+	serverErr := make(chan error, 2)
 	go func() {
-		var err error
-		if s.config.TLS.Enabled {
-			s.log.Info().
-				Str("cert", s.config.TLS.CertFile).
-				Str("key", s.config.TLS.KeyFile).
-				Msg("starting HTTPS server with TLS")
-			err = s.app.ListenTLS(s.config.Listen, s.config.TLS.CertFile, s.config.TLS.KeyFile)
-		} else {
-			err = s.app.Listen(s.config.Listen)
-		}
-		if err != nil {
+		if err := s.serve(); err != nil && !stderrors.Is(err, http.ErrServerClosed) {
 			serverErr <- err
 		}
 	}()
+	if s.adminApp != nil {
+		s.log.Info().Str("listen", s.config.Admin.Listen).Msg("serving the management endpoints on admin.listen")
+		go func() {
+			if err := s.adminApp.Listen(s.config.Admin.Listen); err != nil {
+				serverErr <- fmt.Errorf("admin.listen: %w", err)
+			}
+		}()
+	}
 
 	s.log.Info().Msg("server started successfully")
 	s.log.Info().Msg("send SIGHUP to reload mirror configurations")
@@ -534,11 +1128,30 @@ func (s *Server) Start() error {
 		})
 	}
 
-	// Wait for shutdown signal, reload signal, or server error
+	// Measure the cache for the home page in the background, so it never
+	// waits on a walk of a large cache.
+	sizeTimeout := s.config.Cache.SizeScanTimeout
+	if sizeTimeout <= 0 {
+		sizeTimeout = proxy.DefaultCacheSizeTimeout
+	}
+	go proxy.RunCacheSizeRefresh(ctx, s.config.CacheDir, proxy.CacheSizeInterval, sizeTimeout)
+
+	// Re-benchmark distributions once their result is older than
+	// benchmark.result_ttl_min, checking at least once a minute.
+	if ttl := s.config.Benchmark.ResultTTL; ttl > 0 && s.proxy != nil {
+		go s.proxy.RunMirrorExpiry(ctx, min(ttl, time.Minute))
+	}
+
+	idle := s.idle.expired(ctx, s.config.IdleTimeoutExit)
+
+	// Wait for shutdown signal, reload signal, idle timeout, or server error
 	for {
 		select {
 		case err := <-serverErr:
 			return wrapErr(apperrors.ErrInternal, "server error", err)
+		case <-idle:
+			s.log.Info().Dur("idle_timeout", s.config.IdleTimeoutExit).Msg("no requests within server.idle_timeout_exit_sec, shutting down")
+			return s.shutdown()
 		case <-sighupChan:
 			scheduleReload()
 		case <-reloadDone:
@@ -553,16 +1166,107 @@ func (s *Server) Start() error {
 	}
 }
 
-// refreshMirrors reloads distributions config (when configured) and
-// refreshes mirror selection on this Server's proxy. Used as the reload
-// closure for the mirrors API handler and for SIGHUP-triggered reloads.
+// serve runs the configured front end on config.Listen until it is shut
+// down. With server.proxy_protocol the socket is opened here and wrapped
+// so the PROXY header is decoded before either front end sees a request.
+func (s *Server) serve() error {
+	var ln net.Listener
+	if s.config.ProxyProtocol {
+		raw, err := net.Listen("tcp", s.config.Listen)
+		if err != nil {
+			return err
+		}
+		ln = newProxyProtoListener(raw, proxyHeaderTimeout)
+		s.log.Info().Msg("expecting a PROXY protocol header on every connection")
+	}
+
+	switch {
+	case s.config.TLS.Enabled:
+		s.log.Info().
+			Str("cert", s.config.TLS.CertFile).
+			Str("key", s.config.TLS.KeyFile).
+			Msg("starting HTTPS server with TLS (HTTP/2 and HTTP/1.1)")
+		if ln != nil {
+			return s.httpServer.ServeTLS(ln, s.config.TLS.CertFile, s.config.TLS.KeyFile)
+		}
+		return s.httpServer.ListenAndServeTLS(s.config.TLS.CertFile, s.config.TLS.KeyFile)
+	case s.config.H2C:
+		s.log.Info().Msg("starting HTTP server with cleartext HTTP/2 (h2c) enabled")
+		if ln != nil {
+			return s.httpServer.Serve(ln)
+		}
+		return s.httpServer.ListenAndServe()
+	case ln != nil:
+		return s.app.Listener(ln)
+	default:
+		return s.app.Listen(s.config.Listen)
+	}
+}
+
+// refreshMirrors reloads the mirror configuration and re-runs mirror
+// selection for every distribution, discarding the cached benchmark
+// results. Backs POST /api/mirrors/refresh.
 func (s *Server) refreshMirrors() {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.reloadMirrorConfig()
+	if s.proxy != nil {
+		s.proxy.RefreshMirrors()
+	}
+}
+
+// applyMirrorSettings takes the mirror selection settings of cfg, a
+// reloaded config, and reports whether they changed: the mirror URLs,
+// region, list_file and list_mode, require_https, sticky_clients and
+// min_success_rate. The other mirrors settings are wired into the proxy
+// when it is built and keep their value until a restart. A setting
+// ApplyToState rejects keeps the previous ones.
+func (s *Server) applyMirrorSettings(cfg *config.Config) bool {
+	if cfg == nil {
+		return false
+	}
+	next := s.config.Mirrors
+	m := cfg.Mirrors
+	next.Ubuntu, next.UbuntuPorts, next.Debian, next.CentOS = m.Ubuntu, m.UbuntuPorts, m.Debian, m.CentOS
+	next.Alpine, next.Gentoo, next.Arch = m.Alpine, m.Gentoo, m.Arch
+	next.Region, next.ListFile, next.ListMode = m.Region, m.ListFile, m.ListMode
+	next.RequireHTTPS, next.StickyClients, next.MinSuccessRate = m.RequireHTTPS, m.StickyClients, m.MinSuccessRate
+	if !reflect.DeepEqual(next, m) {
+		s.log.Warn().Msg("mirrors settings other than the mirrors, region, list file, require_https, sticky_clients and min_success_rate changed, restart to apply them")
+	}
+	if reflect.DeepEqual(next, s.config.Mirrors) {
+		return false
+	}
+	if s.state != nil {
+		trial := *s.config
+		trial.Mirrors = next
+		if err := config.ApplyToState(&trial, s.state, s.registry); err != nil {
+			s.log.Warn().Err(err).Msg("invalid mirrors settings in the reloaded config, keeping the previous ones")
+			return false
+		}
+	}
+	s.config.Mirrors = next
+	s.proxy.SetMinSuccessRate(next.MinSuccessRate)
+	s.log.Info().Msg("mirrors settings changed, re-benchmarking mirrors")
+	return true
+}
+
+// reloadMirrorConfig re-reads mirrors.list_file and the distributions
+// config (when configured) and re-applies the mirror settings to state.
+// Failures are logged and leave the previous settings in place.
+func (s *Server) reloadMirrorConfig() {
+	if err := loadMirrorList(s.mirrorSources, s.config); err != nil {
+		s.log.Warn().
+			Err(err).
+			Str("path", s.config.Mirrors.ListFile).
+			Msg("failed to reload mirrors list file, keeping the previous list")
+	}
 	if s.registry != nil && s.config.DistributionsConfigPath != "" {
 		if err := s.registry.Reload(s.config.DistributionsConfigPath); err != nil {
 			s.log.Warn().
 				Err(err).
 				Str("path", s.config.DistributionsConfigPath).
-				Msg("failed to reload distributions config")
+				Msg("failed to reload distributions config, keeping the previous distributions")
 		}
 	}
 	if s.state != nil {
@@ -570,19 +1274,183 @@ func (s *Server) refreshMirrors() {
 			s.log.Warn().Err(err).Msg("failed to re-apply config to state during reload")
 		}
 	}
+}
+
+// mirrorTLSOptions converts transport.mirror_tls to the proxy's options;
+// nil when none are configured.
+func mirrorTLSOptions(hosts map[string]config.MirrorTLSConfig) map[string]proxy.MirrorTLSOptions {
+	if len(hosts) == 0 {
+		return nil
+	}
+	out := make(map[string]proxy.MirrorTLSOptions, len(hosts))
+	for host, t := range hosts {
+		out[host] = proxy.MirrorTLSOptions{
+			InsecureSkipVerify: t.InsecureSkipVerify,
+			CAFile:             t.CAFile,
+			PinnedSHA256:       t.PinnedSHA256,
+		}
+	}
+	return out
+}
+
+// responseHeaderTimeouts keys transport.response_header_timeout_sec by
+// distro type; nil when none are configured.
+func responseHeaderTimeouts(timeouts map[string]time.Duration) map[int]time.Duration {
+	if len(timeouts) == 0 {
+		return nil
+	}
+	out := make(map[int]time.Duration, len(timeouts))
+	for name, d := range timeouts {
+		out[config.ModeToInt(name)] = d
+	}
+	return out
+}
+
+// newGeoLookup returns a geo mirror lookup tuned by cfg's mirrors.geo
+// settings.
+func newGeoLookup(cfg *config.Config) *mirrors.GeoLookup {
+	return mirrors.NewGeoLookup(mirrors.GeoLookupOptions{
+		Timeout:          cfg.Mirrors.Geo.Timeout,
+		FailureThreshold: cfg.Mirrors.Geo.FailureThreshold,
+		Cooldown:         cfg.Mirrors.Geo.Cooldown,
+		CacheTTL:         cfg.Mirrors.Geo.CacheTTL,
+	})
+}
+
+// newMirrorSources returns the candidate mirror sources for cfg: the geo
+// lookup tuned by mirrors.geo and the mirrors.list_file list.
+func newMirrorSources(cfg *config.Config) (*mirrors.Sources, error) {
+	src := mirrors.NewSources(newGeoLookup(cfg))
+	if err := loadMirrorList(src, cfg); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// loadMirrorList (re)reads cfg's mirrors.list_file and installs it on src.
+// On error the previously installed list stays in place.
+func loadMirrorList(src *mirrors.Sources, cfg *config.Config) error {
+	if cfg.Mirrors.ListFile == "" {
+		src.SetMirrorList(nil)
+		return nil
+	}
+	list, err := mirrors.LoadMirrorListFile(cfg.Mirrors.ListFile, cfg.Mirrors.ListMode == config.MirrorListReplace)
+	if err != nil {
+		return err
+	}
+	src.SetMirrorList(list)
+	return nil
+}
+
+// refreshDistro re-benchmarks the distribution with the given registry ID
+// (e.g. "ubuntu") without touching the others. Backs
+// POST /api/mirrors/refresh?distro=<id>.
+func (s *Server) refreshDistro(id string) error {
+	if s.registry == nil || s.proxy == nil {
+		return apperrors.New(apperrors.ErrInternal, "proxy not initialized")
+	}
+	d, ok := s.registry.GetByID(id)
+	if !ok {
+		return apperrors.New(apperrors.ErrResourceNotFound, "unknown distribution: "+id)
+	}
+	if err := s.proxy.RefreshDistro(d.Type); err != nil {
+		return apperrors.Wrap(apperrors.ErrRequestInvalid, "cannot refresh distribution "+id, err)
+	}
+	return nil
+}
+
+// reloadDistributions re-reads distributions.yaml into the registry and
+// rebuilds host patterns and the rewriters of distributions whose mirrors
+// changed. Unlike refreshMirrors it reports load errors to the caller; a
+// config that fails to parse, or has an entry that does not register,
+// leaves the previous registry (and therefore the live routing) untouched.
+func (s *Server) reloadDistributions() (int, error) {
+	if s.registry == nil {
+		return 0, fmt.Errorf("distribution registry not initialized")
+	}
+	if err := s.registry.Reload(s.config.DistributionsConfigPath); err != nil {
+		return 0, err
+	}
+	if s.state != nil {
+		if err := config.ApplyToState(s.config, s.state, s.registry); err != nil {
+			return 0, err
+		}
+	}
 	if s.proxy != nil {
-		s.proxy.RefreshMirrors()
+		s.proxy.ReloadMirrors()
 	}
+	count := len(s.registry.GetAll())
+	s.log.Info().
+		Int("count", count).
+		Str("path", s.config.DistributionsConfigPath).
+		Msg("distributions config reloaded")
+	return count, nil
 }
 
 // reload handles configuration hot reload triggered by SIGHUP signal.
-// It reloads distributions config (if path set) and refreshes mirror configurations.
+// It re-reads the config files and the mirror configuration. A change to
+// the mirrors settings re-benchmarks every distribution; otherwise only
+// the distributions whose candidates changed (mirror list file,
+// distributions config) are re-benchmarked and the rest keep their cached
+// benchmark result.
 func (s *Server) reload() {
 	s.log.Info().Msg("received SIGHUP, reloading configuration...")
-	s.refreshMirrors()
+	s.reopenAccessLog()
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	cfg := s.reloadConfigFiles()
+	s.reloadMaintenance(cfg)
+	changed := s.applyMirrorSettings(cfg)
+	s.reloadMirrorConfig()
+	if changed {
+		s.proxy.RefreshMirrors()
+	} else {
+		s.proxy.ReloadMirrors()
+	}
 	s.log.Info().Msg("configuration reload complete")
 }
 
+// reopenAccessLog reopens log.access_file, which log rotation may have
+// moved aside. On failure access lines keep going to the old file.
+func (s *Server) reopenAccessLog() {
+	if s.accessLog == nil {
+		return
+	}
+	if err := s.accessLog.Reopen(); err != nil {
+		s.log.Error().Err(err).Str("path", s.accessLog.path).Msg("failed to reopen log.access_file")
+	}
+}
+
+// maintenanceStatus reports whether maintenance mode is on and the
+// Retry-After sent meanwhile. Backs GET /api/maintenance.
+func (s *Server) maintenanceStatus() (bool, time.Duration) {
+	return s.proxy.InMaintenance(), s.proxy.MaintenanceRetryAfter()
+}
+
+// reloadConfigFiles re-reads the config file and drop-ins the server was
+// started with, see config.ReloadConfigFiles. It returns nil without a
+// config file or when the files no longer load, which keeps the current
+// settings.
+func (s *Server) reloadConfigFiles() *config.Config {
+	cfg, err := config.ReloadConfigFiles(s.config)
+	if err != nil {
+		s.log.Warn().Err(err).Str("path", s.config.ConfigFile).Msg("failed to re-read the config file, keeping the current settings")
+		return nil
+	}
+	return cfg
+}
+
+// reloadMaintenance applies server.maintenance from cfg, the reloaded
+// config, so maintenance mode can be switched by editing the file and
+// sending SIGHUP. It overrides a switch made through /api/maintenance. A
+// nil cfg keeps the current state.
+func (s *Server) reloadMaintenance(cfg *config.Config) {
+	if cfg == nil {
+		return
+	}
+	s.proxy.SetMaintenance(cfg.Maintenance)
+}
+
 // shutdown performs a graceful server shutdown with a 5-second timeout.
 // It allows in-flight requests to complete before closing the proxy.
 // All cleanup steps run unconditionally so a Fiber-shutdown failure does
@@ -592,7 +1460,7 @@ func (s *Server) shutdown() error {
 
 	var errs []error
 
-	if err := s.app.ShutdownWithTimeout(5 * time.Second); err != nil {
+	if err := s.shutdownListener(5 * time.Second); err != nil {
 		s.log.Warn().Err(err).Msg("failed to shutdown server gracefully")
 		errs = append(errs, wrapErr(apperrors.ErrInternal, "failed to shutdown server gracefully", err))
 	}
@@ -600,6 +1468,14 @@ func (s *Server) shutdown() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// Save the stats before closing the cache they are read from.
+	if s.cacheHistory != nil && s.cache != nil {
+		if err := s.cacheHistory.Save(s.cache.Stats()); err != nil {
+			s.log.Warn().Err(err).Msg("failed to save cache stats")
+			errs = append(errs, wrapErr(apperrors.ErrInternal, "failed to save cache stats", err))
+		}
+	}
+
 	// Close cache to stop cleanup goroutines and release file locks.
 	if s.cache != nil {
 		if err := s.cache.Close(); err != nil {
@@ -608,6 +1484,12 @@ func (s *Server) shutdown() error {
 		}
 	}
 
+	if s.accessLog != nil {
+		if err := s.accessLog.Close(); err != nil {
+			errs = append(errs, wrapErr(apperrors.ErrInternal, "failed to close log.access_file", err))
+		}
+	}
+
 	// Shutdown tracing (flush spans). Always attempt even on prior errors.
 	if err := tracing.Shutdown(ctx); err != nil {
 		s.log.Warn().Err(err).Msg("failed to shutdown tracing")
@@ -622,6 +1504,22 @@ func (s *Server) shutdown() error {
 	return nil
 }
 
+// shutdownListener gracefully stops the listeners Start brought up.
+func (s *Server) shutdownListener(timeout time.Duration) error {
+	var err error
+	if s.httpServer == nil {
+		err = s.app.ShutdownWithTimeout(timeout)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err = s.httpServer.Shutdown(ctx)
+	}
+	if s.adminApp != nil {
+		err = stderrors.Join(err, s.adminApp.ShutdownWithTimeout(timeout))
+	}
+	return err
+}
+
 // Daemon is the main entry point for starting the application daemon.
 // It validates the configuration, creates and starts the server, and handles
 // any startup errors. This function blocks until the server shuts down.
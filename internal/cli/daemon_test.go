@@ -15,16 +15,32 @@
 package cli
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gofiber/fiber/v2"
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+
 	"github.com/soulteary/apt-proxy/internal/api"
 	"github.com/soulteary/apt-proxy/internal/config"
 	"github.com/soulteary/apt-proxy/internal/distro"
+	"github.com/soulteary/apt-proxy/internal/proxy"
 )
 
 // withTestMirrors returns a copy of cfg with mock mirror URLs filled in
@@ -35,18 +51,65 @@ func withTestMirrors(cfg *config.Config) *config.Config {
 		return nil
 	}
 	out := *cfg
-	if out.Mirrors == (config.MirrorConfig{}) {
+	if reflect.DeepEqual(out.Mirrors, config.MirrorConfig{}) {
 		out.Mirrors = config.MirrorConfig{
 			Ubuntu:      "http://mirrors.example.com/ubuntu/",
 			UbuntuPorts: "http://mirrors.example.com/ubuntu-ports/",
 			Debian:      "http://mirrors.example.com/debian/",
 			CentOS:      "http://mirrors.example.com/centos/",
 			Alpine:      "http://mirrors.example.com/alpine/",
+			Gentoo:      "http://mirrors.example.com/gentoo/",
+			Arch:        "http://mirrors.example.com/archlinux/",
 		}
 	}
 	return &out
 }
 
+// newUpstreamTestServer starts upstream as a mock mirror and builds a
+// Server in ubuntu mode with a temporary cache dir. Every distribution's
+// mirror is the mock's tree of the same name (/ubuntu/, /debian/, ...), so
+// a mutate that switches the mode keeps the proxy on the mock. Each mutate
+// adjusts the config before NewServer; the mock is closed when the test
+// ends.
+func newUpstreamTestServer(t *testing.T, upstream http.Handler, mutate ...func(*config.Config)) *Server {
+	t.Helper()
+	mock := httptest.NewServer(upstream)
+	t.Cleanup(mock.Close)
+	cfg := &config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeUbuntu,
+		Listen:   "127.0.0.1:0",
+		Mirrors: config.MirrorConfig{
+			Ubuntu:      mock.URL + "/ubuntu/",
+			UbuntuPorts: mock.URL + "/ubuntu-ports/",
+			Debian:      mock.URL + "/debian/",
+			CentOS:      mock.URL + "/centos/",
+			Alpine:      mock.URL + "/alpine/",
+			Gentoo:      mock.URL + "/gentoo/",
+			Arch:        mock.URL + "/archlinux/",
+		},
+	}
+	for _, m := range mutate {
+		m(cfg)
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	return srv
+}
+
+// waitMirrorsReady waits up to five seconds for srv's mirror benchmarks
+// to finish. Tests that benchmark also call it from t.Cleanup, so no
+// benchmark outlives its test and races with the next test's NewServer.
+func waitMirrorsReady(t *testing.T, srv *Server) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !srv.proxy.MirrorsReady() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestNewServer(t *testing.T) {
 	// Create a temporary cache directory
 	tmpDir, err := os.MkdirTemp("", "apt-proxy-test-*")
@@ -328,6 +391,8 @@ func TestMirrorConfig(t *testing.T) {
 			Debian:      "https://mirrors.example.com/debian/",
 			CentOS:      "https://mirrors.example.com/centos/",
 			Alpine:      "https://mirrors.example.com/alpine/",
+			Gentoo:      "https://mirrors.example.com/gentoo/",
+			Arch:        "https://mirrors.example.com/archlinux/",
 		},
 	}
 
@@ -373,6 +438,213 @@ func TestServerReload(t *testing.T) {
 	}
 }
 
+// TestServerReloadRereadsMirrorListFile swaps the file behind
+// mirrors.list_file and checks that SIGHUP reload makes the new mirror the
+// only benchmark candidate and the one requests are sent to.
+func TestServerReloadRereadsMirrorListFile(t *testing.T) {
+	var hitsA, hitsB atomic.Int64
+	upstreamA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hitsA.Add(1)
+		_, _ = io.WriteString(w, "a")
+	}))
+	defer upstreamA.Close()
+	upstreamB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hitsB.Add(1)
+		_, _ = io.WriteString(w, "b")
+	}))
+	defer upstreamB.Close()
+
+	listFile := filepath.Join(t.TempDir(), "mirrors.list")
+	writeList := func(url string) {
+		if err := os.WriteFile(listFile, []byte("[alpine]\n"+url+"/alpine/\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeList(upstreamA.URL)
+
+	cfg := &config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeAlpine,
+		Listen:   "127.0.0.1:0",
+		Mirrors: config.MirrorConfig{
+			ListFile: listFile,
+			ListMode: config.MirrorListReplace,
+		},
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	t.Cleanup(func() { waitMirrorsReady(t, srv) })
+	if got := srv.mirrorSources.MirrorUrlsByMode(srv.registry, distro.TypeAlpine); len(got) != 1 || got[0] != upstreamA.URL+"/alpine/" {
+		t.Fatalf("candidates = %v, want only %s/alpine/", got, upstreamA.URL)
+	}
+
+	// Let the startup benchmark settle so it cannot land after the reload.
+	waitMirrorsReady(t, srv)
+
+	writeList(upstreamB.URL)
+	srv.reload()
+	if got := srv.mirrorSources.MirrorUrlsByMode(srv.registry, distro.TypeAlpine); len(got) != 1 || got[0] != upstreamB.URL+"/alpine/" {
+		t.Fatalf("candidates after reload = %v, want only %s/alpine/", got, upstreamB.URL)
+	}
+
+	waitMirrorsReady(t, srv)
+	before := hitsA.Load()
+	req := httptest.NewRequest(http.MethodGet, "/alpine/v3.20/main/x86_64/APKINDEX.tar.gz", nil)
+	resp, err := srv.app.Test(req, 10000)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "b" {
+		t.Errorf("body = %q, want %q from the reloaded mirror", body, "b")
+	}
+	if hitsA.Load() != before {
+		t.Error("request went to the mirror removed from the list file")
+	}
+}
+
+// TestServerReloadKeepsBenchmarkCache checks that a SIGHUP reload that
+// changes no mirror setting does not re-benchmark, while the mirrors API
+// refresh still does.
+func TestServerReloadKeepsBenchmarkCache(t *testing.T) {
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	listFile := filepath.Join(t.TempDir(), "mirrors.list")
+	if err := os.WriteFile(listFile, []byte("[alpine]\n"+upstream.URL+"/alpine/\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(&config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeAlpine,
+		Listen:   "127.0.0.1:0",
+		Mirrors: config.MirrorConfig{
+			ListFile: listFile,
+			ListMode: config.MirrorListReplace,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	t.Cleanup(func() { waitMirrorsReady(t, srv) })
+	waitMirrorsReady(t, srv)
+	before := hits.Load()
+	if before == 0 {
+		t.Fatal("startup benchmark never reached the mirror")
+	}
+
+	srv.reload()
+	if got := hits.Load(); got != before {
+		t.Errorf("reload with unchanged mirrors hit the mirror %d more times, want 0", got-before)
+	}
+
+	srv.refreshMirrors()
+	if hits.Load() == before {
+		t.Error("mirrors refresh did not re-benchmark")
+	}
+}
+
+// TestServerReloadAppliesMirrorSettings reloads an edited config file:
+// a change outside the mirrors section keeps the benchmark cache, a
+// changed mirrors setting takes effect and re-benchmarks.
+func TestServerReloadAppliesMirrorSettings(t *testing.T) {
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	listFile := filepath.Join(dir, "mirrors.list")
+	if err := os.WriteFile(listFile, []byte("[alpine]\n"+upstream.URL+"/alpine/\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "apt-proxy.yaml")
+	writeConfig := func(extra string) {
+		t.Helper()
+		yaml := "mirrors:\n  list_file: " + listFile + "\n  list_mode: replace\n" + extra
+		if err := os.WriteFile(configFile, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("")
+
+	cfg, err := config.ReloadConfigFiles(&config.Config{ConfigFile: configFile})
+	if err != nil || cfg == nil {
+		t.Fatalf("ReloadConfigFiles() = %v, %v", cfg, err)
+	}
+	cfg.CacheDir, cfg.Mode, cfg.Listen = t.TempDir(), distro.TypeAlpine, "127.0.0.1:0"
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	t.Cleanup(func() { waitMirrorsReady(t, srv) })
+	waitMirrorsReady(t, srv)
+	before := hits.Load()
+
+	writeConfig("log:\n  sample_rate: 10\n")
+	srv.reload()
+	if got := hits.Load(); got != before {
+		t.Errorf("reload without mirrors changes hit the mirror %d more times, want 0", got-before)
+	}
+
+	writeConfig("  sticky_clients: 2\n  min_success_rate: 0.5\n")
+	srv.reload()
+	if hits.Load() == before {
+		t.Error("reload with changed mirrors settings did not re-benchmark")
+	}
+	if got := srv.state.StickyClients(); got != 2 {
+		t.Errorf("sticky clients after reload = %d, want 2", got)
+	}
+	if got := srv.config.Mirrors.MinSuccessRate; got != 0.5 {
+		t.Errorf("mirrors.min_success_rate after reload = %v, want 0.5", got)
+	}
+}
+
+// TestProxyCatchAllRewritesToMirror sends a package request by path, as a
+// client using the proxy as its origin does, through the Fiber catch-all
+// and checks it reaches the configured mirror under the mirror's path.
+func TestProxyCatchAllRewritesToMirror(t *testing.T) {
+	var gotPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_, _ = io.WriteString(w, "package")
+	}))
+	defer upstream.Close()
+
+	srv, err := NewServer(&config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeUbuntu,
+		Listen:   "127.0.0.1:0",
+		Mirrors:  config.MirrorConfig{Ubuntu: upstream.URL + "/mirror/ubuntu/"},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/ubuntu/pool/main/a/a_1.0.deb", nil), 10000)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(got) != "package" {
+		t.Fatalf("status = %d, body = %q; want 200 from the mirror", resp.StatusCode, got)
+	}
+	if gotPath != "/mirror/ubuntu/pool/main/a/a_1.0.deb" {
+		t.Errorf("upstream path = %q, want the request rewritten onto the mirror", gotPath)
+	}
+}
+
 // Admin API Tests
 
 func TestCacheStatsAPI(t *testing.T) {
@@ -713,6 +985,335 @@ func TestMirrorsRefreshAPI(t *testing.T) {
 	}
 }
 
+// TestDistrosAPIRequiresKey checks that /api/distros sits behind the API key
+// and lists the built-in distributions once authenticated.
+func TestDistrosAPIRequiresKey(t *testing.T) {
+	cfg := &config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeAllDistros,
+		Listen:   "127.0.0.1:0",
+		Security: config.SecurityConfig{APIKey: "secret", EnableAPIAuth: true},
+	}
+	srv, err := NewServer(withTestMirrors(cfg))
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/distros", nil)
+	resp, err := srv.app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated status = %d, want 401", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/distros", nil)
+	req.Header.Set("X-API-Key", "secret")
+	resp, err = srv.app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body=%s", resp.StatusCode, body)
+	}
+	for _, id := range []string{`"ubuntu"`, `"debian"`, `"alpine"`} {
+		if !strings.Contains(string(body), id) {
+			t.Errorf("response missing %s: %s", id, body)
+		}
+	}
+}
+
+// TestAPIPrefix checks that server.api_prefix moves the management API,
+// the probes stay at the root, and the proxy catch-all still serves
+// package paths and the freed /api path.
+func TestAPIPrefix(t *testing.T) {
+	var upstreamHits atomic.Int64
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		_, _ = io.WriteString(w, "release")
+	}), func(cfg *config.Config) { cfg.APIPrefix = "/apt-proxy/api" })
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, path, nil), 10000)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, path := range []string{"/apt-proxy/api/cache/stats", "/apt-proxy/api/mirrors", "/apt-proxy/api/distros"} {
+		if status, body := get(path); status != http.StatusOK || !strings.HasPrefix(body, "{") {
+			t.Errorf("GET %s = %d %q, want a 200 JSON response", path, status, body)
+		}
+	}
+	if status, _ := get("/healthz"); status != http.StatusOK {
+		t.Errorf("GET /healthz = %d, want 200 at the root", status)
+	}
+	if status, _ := get("/api/cache/stats"); status != http.StatusNotFound {
+		t.Errorf("GET /api/cache/stats = %d, want 404 from the proxy once the API moved", status)
+	}
+	if status, body := get("/ubuntu/dists/noble/InRelease"); status != http.StatusOK || body != "release" {
+		t.Errorf("GET /ubuntu/dists/noble/InRelease = %d %q, want the mirror's 200", status, body)
+	}
+	httpcache.Writes.Wait()
+	if n := upstreamHits.Load(); n != 1 {
+		t.Errorf("upstream hit %d times, want 1 (only the package path)", n)
+	}
+}
+
+// TestHealthPrefix checks that server.health_prefix moves the probes and
+// that the access log skips them at their new paths.
+func TestHealthPrefix(t *testing.T) {
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}), func(cfg *config.Config) { cfg.HealthPrefix = "/apt-proxy" })
+
+	for path, want := range map[string]int{
+		"/apt-proxy/healthz": http.StatusOK,
+		"/apt-proxy/livez":   http.StatusOK,
+		"/healthz":           http.StatusNotFound,
+	} {
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, path, nil), 10000)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+
+	logCfg, _ := srv.accessLogConfig()
+	if want := []string{"/apt-proxy/healthz", "/apt-proxy/livez", "/apt-proxy/readyz"}; !slices.Equal(logCfg.SkipPaths, want) {
+		t.Errorf("access log SkipPaths = %v, want %v", logCfg.SkipPaths, want)
+	}
+}
+
+// TestAdminListen checks that with admin.listen the management endpoints
+// are served only by the admin app, the main app answers the API prefix
+// with 404, and package requests stay on the main app.
+func TestAdminListen(t *testing.T) {
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "release")
+	}), func(cfg *config.Config) { cfg.Admin.Listen = "127.0.0.1:0" })
+	if srv.adminApp == nil {
+		t.Fatal("no admin app with admin.listen set")
+	}
+	get := func(app *fiber.App, path string) int {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil), 10000)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, path := range []string{"/api/cache/stats", "/api/mirrors", "/api/health", "/metrics", "/healthz", "/livez", "/version"} {
+		if status := get(srv.adminApp, path); status != http.StatusOK {
+			t.Errorf("admin GET %s = %d, want 200", path, status)
+		}
+		if status := get(srv.app, path); status != http.StatusNotFound {
+			t.Errorf("main GET %s = %d, want 404", path, status)
+		}
+	}
+	if status := get(srv.app, "/api"); status != http.StatusNotFound {
+		t.Errorf("main GET /api = %d, want 404", status)
+	}
+	if status := get(srv.app, "/ubuntu/dists/noble/InRelease"); status != http.StatusOK {
+		t.Errorf("main GET of a package path = %d, want 200", status)
+	}
+	httpcache.Writes.Wait()
+	if status := get(srv.adminApp, "/ubuntu/dists/noble/InRelease"); status != http.StatusNotFound {
+		t.Errorf("admin GET of a package path = %d, want 404", status)
+	}
+}
+
+// TestHealthAPIReportsMirrorLatency checks /api/health sits behind the API
+// key and reports the benchmarked mirror's latency per distribution.
+func TestHealthAPIReportsMirrorLatency(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	listFile := filepath.Join(t.TempDir(), "mirrors.list")
+	if err := os.WriteFile(listFile, []byte("[alpine]\n"+upstream.URL+"/alpine/\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeAlpine,
+		Listen:   "127.0.0.1:0",
+		Mirrors:  config.MirrorConfig{ListFile: listFile, ListMode: config.MirrorListReplace},
+		Security: config.SecurityConfig{APIKey: "secret", EnableAPIAuth: true},
+	}
+	cfg.Cache.MaxSize = 1 << 30
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	t.Cleanup(func() { waitMirrorsReady(t, srv) })
+	waitMirrorsReady(t, srv)
+
+	resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated status = %d, want 401", resp.StatusCode)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/health", nil)
+	req.Header.Set("X-API-Key", "secret")
+	resp, err = srv.app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body=%s", resp.StatusCode, body)
+	}
+	var health api.HealthResponse
+	if err := json.Unmarshal(body, &health); err != nil {
+		t.Fatalf("decode: %v; body=%s", err, body)
+	}
+	if len(health.Mirrors) != 1 {
+		t.Fatalf("mirrors = %+v, want one entry", health.Mirrors)
+	}
+	m := health.Mirrors[0]
+	if m.Distro != distro.DistroAlpine || m.Mirror != upstream.URL+"/alpine/" {
+		t.Errorf("mirror = %s %s, want alpine on %s/alpine/", m.Distro, m.Mirror, upstream.URL)
+	}
+	if m.Reachable == nil || !*m.Reachable || m.LatencyMs == nil || m.BenchmarkedAt == nil {
+		t.Errorf("mirror = %+v, want a reachable benchmark with latency", m)
+	}
+	if health.Cache.MaxSizeBytes != 1<<30 || health.Checks["cache"].Status == "" {
+		t.Errorf("cache = %+v checks = %v, want max size and the cache check", health.Cache, health.Checks)
+	}
+}
+
+// TestSyncBenchmarkModeChoosesMirrorBeforeServing lists a slow mirror
+// first, the one async mode would serve while benchmarking, and checks
+// that with benchmark.mode "sync" the fast mirror is already in place when
+// NewServer returns and stays in place for the rest of the session.
+func TestSyncBenchmarkModeChoosesMirrorBeforeServing(t *testing.T) {
+	var slowHits, fastHits atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowHits.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		_, _ = io.WriteString(w, "slow")
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastHits.Add(1)
+		_, _ = io.WriteString(w, "fast")
+	}))
+	defer fast.Close()
+	listFile := filepath.Join(t.TempDir(), "mirrors.list")
+	if err := os.WriteFile(listFile, []byte("[alpine]\n"+slow.URL+"/alpine/\n"+fast.URL+"/alpine/\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(&config.Config{
+		CacheDir:  t.TempDir(),
+		Mode:      distro.TypeAlpine,
+		Listen:    "127.0.0.1:0",
+		Mirrors:   config.MirrorConfig{ListFile: listFile, ListMode: config.MirrorListReplace},
+		Benchmark: config.BenchmarkConfig{Mode: config.BenchmarkModeSync},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if !srv.proxy.MirrorsReady() {
+		t.Fatal("mirrors not ready when NewServer returned in sync mode")
+	}
+	before := srv.proxy.MirrorStatuses()
+	if len(before) != 1 || before[0].Mirror != fast.URL+"/alpine/" || before[0].Source != proxy.MirrorSourceBenchmarked {
+		t.Fatalf("mirror statuses = %+v, want the benchmarked %s/alpine/", before, fast.URL)
+	}
+
+	slowHits.Store(0)
+	fastHits.Store(0)
+	for i := 0; i < 3; i++ {
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/alpine/v3.19/main/x86_64/APKINDEX.tar.gz", nil), -1)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		resp.Body.Close()
+		time.Sleep(20 * time.Millisecond)
+	}
+	if slowHits.Load() != 0 || fastHits.Load() == 0 {
+		t.Errorf("requests reached slow=%d fast=%d, want only the fast mirror", slowHits.Load(), fastHits.Load())
+	}
+	if after := srv.proxy.MirrorStatuses(); after[0].Mirror != before[0].Mirror {
+		t.Errorf("mirror changed mid-session from %s to %s", before[0].Mirror, after[0].Mirror)
+	}
+}
+
+// TestProxyCatchAllThrottled drives a package request through the Fiber
+// listener and checks that it is rewritten to the configured mirror and
+// paced by rate_limit.bytes_per_second: the first bytes reach the client
+// at once and the rest follow at the configured rate, rather than the
+// whole body being buffered for the duration of the throttle.
+func TestProxyCatchAllThrottled(t *testing.T) {
+	body := strings.Repeat("d", 32*1024)
+	var gotPath string
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_, _ = io.WriteString(w, body)
+	}), func(cfg *config.Config) { cfg.RateLimit.BytesPerSecond = 64 * 1024 })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.app.Listener(ln) }()
+	t.Cleanup(func() { _ = srv.app.Shutdown() })
+
+	start := time.Now()
+	resp, err := http.Get("http://" + ln.Addr().String() + "/ubuntu/pool/main/a/a_1.0.deb")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatalf("reading the first byte: %v", err)
+	}
+	firstByte := time.Since(start)
+	rest, _ := io.ReadAll(resp.Body)
+	elapsed := time.Since(start)
+
+	if resp.StatusCode != http.StatusOK || string(first)+string(rest) != body {
+		t.Fatalf("status = %d, body length = %d; want 200 with %d bytes", resp.StatusCode, len(rest)+1, len(body))
+	}
+	if gotPath != "/ubuntu/pool/main/a/a_1.0.deb" {
+		t.Errorf("upstream path = %q, want rewritten package path", gotPath)
+	}
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("throttled response took %v, want ~500ms", elapsed)
+	}
+	if firstByte > elapsed/2 {
+		t.Errorf("first byte after %v of %v, want the body streamed while throttled", firstByte, elapsed)
+	}
+	// The cache finishes storing the package after the response has been
+	// sent; wait for it so TempDir cleanup does not race the write.
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.cache.Stats().ItemCount == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // Helper function to check if a JSON field exists in a response
 func containsField(body, field string) bool {
 	return len(body) > 0 && (len(field) == 0 || (len(body) > len(field) && containsString(body, "\""+field+"\"")))
@@ -775,3 +1376,1195 @@ func TestCalculateHitRate(t *testing.T) {
 		})
 	}
 }
+
+// TestProxyRejectsPostOnPackagePath checks the method guard through the
+// Fiber catch-all while the POST-only admin API keeps working.
+func TestProxyRejectsPostOnPackagePath(t *testing.T) {
+	cfg := &config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeAllDistros,
+		Listen:   "127.0.0.1:0",
+	}
+	srv, err := NewServer(withTestMirrors(cfg))
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/ubuntu/dists/jammy/main/binary-amd64/Packages.gz", strings.NewReader("x"))
+	resp, err := srv.app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST package path status = %d, want 405", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/cache/purge", nil)
+	resp, err = srv.app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /api/cache/purge status = %d, want 200", resp.StatusCode)
+	}
+}
+
+// TestFaviconAndRobotsServedLocally checks that browser and crawler noise
+// is answered by the server itself instead of flowing to the proxy, which
+// would log a 404 for each.
+func TestFaviconAndRobotsServedLocally(t *testing.T) {
+	cfg := &config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeAllDistros,
+		Listen:   "127.0.0.1:0",
+	}
+	srv, err := NewServer(withTestMirrors(cfg))
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("GET /favicon.ico status = %d, want 204", resp.StatusCode)
+	}
+	if got := resp.Header.Get(httpcache.CacheHeader); got != "" {
+		t.Errorf("GET /favicon.ico went through the cache (%s: %q)", httpcache.CacheHeader, got)
+	}
+
+	resp, err = srv.app.Test(httptest.NewRequest(http.MethodGet, "/robots.txt", nil))
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "Disallow: /") {
+		t.Errorf("GET /robots.txt = %d %q, want 200 with a disallow-all policy", resp.StatusCode, body)
+	}
+
+	resp, err = srv.app.Test(httptest.NewRequest(http.MethodPost, "/favicon.ico", nil))
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /favicon.ico status = %d, want 405", resp.StatusCode)
+	}
+}
+
+// TestRequestSizeLimits checks that server.max_header_bytes and
+// server.max_url_length are enforced before a request reaches any route.
+// It goes over a real listener: fasthttp only writes its 431 to a
+// connection, app.Test surfaces the read error instead.
+func TestRequestSizeLimits(t *testing.T) {
+	cfg := &config.Config{
+		CacheDir:       t.TempDir(),
+		Mode:           distro.TypeAllDistros,
+		Listen:         "127.0.0.1:0",
+		MaxHeaderBytes: 4096,
+		MaxURLLength:   512,
+	}
+	srv, err := NewServer(withTestMirrors(cfg))
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.app.Listener(ln) }()
+	t.Cleanup(func() { _ = srv.app.Shutdown() })
+	base := "http://" + ln.Addr().String()
+
+	status := func(path string, padding int) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, base+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Padding", strings.Repeat("a", padding))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := status("/_/ping", 1024); got != http.StatusOK {
+		t.Errorf("request within limits: status = %d, want 200", got)
+	}
+	if got := status("/_/ping", 8192); got != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("oversized header: status = %d, want 431", got)
+	}
+	if got := status("/ubuntu/"+strings.Repeat("a", 1024), 1); got != http.StatusRequestURITooLong {
+		t.Errorf("overlong URL: status = %d, want 414", got)
+	}
+}
+
+// TestProxyFollowsRedirectAndCachesFinalBody points the Ubuntu mirror at
+// an upstream that 302s to a CDN path and checks that the CDN body, not
+// the redirect, is what ends up cached.
+func TestProxyFollowsRedirectAndCachesFinalBody(t *testing.T) {
+	var cdnHits atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ubuntu/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/cdn"+r.URL.Path, http.StatusFound)
+	})
+	mux.HandleFunc("/cdn/", func(w http.ResponseWriter, r *http.Request) {
+		cdnHits.Add(1)
+		_, _ = io.WriteString(w, "package-bytes")
+	})
+	srv := newUpstreamTestServer(t, mux, func(cfg *config.Config) { cfg.Cache.FollowRedirects = true })
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/ubuntu/pool/main/a/a_1.0.deb", nil)
+		resp, err := srv.app.Test(req, 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(got) != "package-bytes" {
+			t.Fatalf("request %d: status = %d body = %q; want 200 with the CDN body", i, resp.StatusCode, got)
+		}
+		httpcache.Writes.Wait()
+	}
+	if n := cdnHits.Load(); n != 1 {
+		t.Errorf("CDN hit %d times, want 1 (second request should be a cache hit)", n)
+	}
+}
+
+// TestProxyCachesContentsIndex checks that a Contents-<arch>.gz fetch is
+// matched by a cache rule and served from the cache on the second request.
+func TestProxyCachesContentsIndex(t *testing.T) {
+	var hits atomic.Int64
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.WriteString(w, "contents")
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/ubuntu/dists/noble/main/Contents-amd64.gz", nil)
+		resp, err := srv.app.Test(req, 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Cache-Control"); got != "max-age=21600" {
+			t.Errorf("request %d: Cache-Control = %q, want max-age=21600", i, got)
+		}
+		httpcache.Writes.Wait()
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("upstream hit %d times, want 1", n)
+	}
+}
+
+// TestProxyCachesCommandNotFound checks that command-not-found's
+// cnf/Commands-<arch>.xz is cached with the index max-age.
+func TestProxyCachesCommandNotFound(t *testing.T) {
+	var hits atomic.Int64
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.WriteString(w, "commands")
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/ubuntu/dists/noble/main/cnf/Commands-amd64.xz", nil)
+		resp, err := srv.app.Test(req, 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Cache-Control"); got != "max-age=3600" {
+			t.Errorf("request %d: Cache-Control = %q, want max-age=3600", i, got)
+		}
+		httpcache.Writes.Wait()
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("upstream hit %d times, want 1", n)
+	}
+}
+
+// TestProxyCachesModernCompressedIndexes checks that Packages indexes in
+// the xz and zstd formats newer apt prefers are cached as indexes.
+func TestProxyCachesModernCompressedIndexes(t *testing.T) {
+	hits := make(map[string]int)
+	var mu sync.Mutex
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		_, _ = io.WriteString(w, "index")
+	}))
+
+	paths := []string{
+		"/ubuntu/dists/noble/main/binary-amd64/Packages.xz",
+		"/ubuntu/dists/noble/main/binary-amd64/Packages.zst",
+		"/ubuntu/dists/noble/main/source/Sources.zst",
+	}
+	for _, path := range paths {
+		for i := 0; i < 2; i++ {
+			resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, path, nil), 10000)
+			if err != nil {
+				t.Fatalf("app.Test error: %v", err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s request %d: status = %d, want 200", path, i, resp.StatusCode)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != "max-age=3600" {
+				t.Errorf("%s request %d: Cache-Control = %q, want max-age=3600", path, i, got)
+			}
+			httpcache.Writes.Wait()
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range paths {
+		if n := hits[path]; n != 1 {
+			t.Errorf("upstream hit %d times for %s, want 1", n, path)
+		}
+	}
+}
+
+// TestProxyStripHeaders checks that proxy.strip_headers keeps a mirror's
+// Set-Cookie and Server away from clients, on the miss and on the cached
+// hit, and that proxy.add_headers is applied to both.
+func TestProxyStripHeaders(t *testing.T) {
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "cdn_session=abc")
+		w.Header().Set("Server", "cdn-edge/1.2")
+		_, _ = io.WriteString(w, "package")
+	}), func(cfg *config.Config) {
+		cfg.Proxy.StripHeaders = []string{"Set-Cookie", "server"}
+		cfg.Proxy.AddHeaders = map[string]string{"X-Served-By": "apt-proxy"}
+	})
+
+	for _, want := range []string{"MISS", "HIT"} {
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb", nil), 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+		if got := resp.Header.Get("X-Cache"); got != want {
+			t.Errorf("X-Cache = %q, want %s", got, want)
+		}
+		if got := resp.Header.Get("Set-Cookie"); got != "" {
+			t.Errorf("%s: Set-Cookie = %q reached the client", want, got)
+		}
+		if got := resp.Header.Get("Server"); strings.Contains(got, "cdn-edge") {
+			t.Errorf("%s: mirror Server header %q reached the client", want, got)
+		}
+		if got := resp.Header.Get("X-Served-By"); got != "apt-proxy" {
+			t.Errorf("%s: X-Served-By = %q, want apt-proxy", want, got)
+		}
+	}
+}
+
+// TestProxyAddsVia checks the Via entry on the request to the mirror and
+// on the miss and the hit, where it is added once, and that
+// proxy.omit_via leaves Via alone.
+func TestProxyAddsVia(t *testing.T) {
+	for _, omit := range []bool{false, true} {
+		var upstreamVia atomic.Value
+		srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamVia.Store(r.Header.Get("Via"))
+			_, _ = io.WriteString(w, "package")
+		}), func(cfg *config.Config) { cfg.Proxy.OmitVia = omit })
+
+		want := "1.1 " + config.DefaultVia
+		if omit {
+			want = ""
+		}
+		for _, cache := range []string{"MISS", "HIT"} {
+			resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb", nil), 10000)
+			if err != nil {
+				t.Fatalf("app.Test error: %v", err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			httpcache.Writes.Wait()
+			if got := strings.Join(resp.Header.Values("Via"), ", "); got != want {
+				t.Errorf("omit_via %v, %s: Via = %q, want %q", omit, cache, got, want)
+			}
+		}
+		if got, _ := upstreamVia.Load().(string); got != want {
+			t.Errorf("omit_via %v: mirror saw Via %q, want %q", omit, got, want)
+		}
+	}
+}
+
+// TestProxyHitKeepsUpstreamLastModified checks that cache hits, GET and
+// HEAD, replay the validators of the original miss, and that Date stays
+// consistent with them: the proxy's clock, with the time spent in the
+// cache in Age.
+func TestProxyHitKeepsUpstreamLastModified(t *testing.T) {
+	const lastModified = "Mon, 01 Jan 2024 00:00:00 GMT"
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", lastModified)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, "package")
+	}))
+
+	var missDate time.Time
+	for _, step := range []struct{ method, cache string }{
+		{http.MethodGet, "MISS"},
+		{http.MethodGet, "HIT"},
+		{http.MethodHead, "HIT"},
+	} {
+		resp, err := srv.app.Test(httptest.NewRequest(step.method, "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb", nil), 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+
+		name := step.method + " " + step.cache
+		if got := resp.Header.Get("X-Cache"); got != step.cache {
+			t.Fatalf("%s: X-Cache = %q", name, got)
+		}
+		if got := resp.Header.Get("Last-Modified"); got != lastModified {
+			t.Errorf("%s: Last-Modified = %q, want the upstream %q", name, got, lastModified)
+		}
+		if got := resp.Header.Get("ETag"); got != `"v1"` {
+			t.Errorf("%s: ETag = %q, want the upstream one", name, got)
+		}
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			t.Fatalf("%s: Date %q: %v", name, resp.Header.Get("Date"), err)
+		}
+		if step.cache == "MISS" {
+			missDate = date
+			continue
+		}
+		if date.Before(missDate) {
+			t.Errorf("%s: Date %v is before the miss's %v", name, date, missDate)
+		}
+		if resp.Header.Get("Age") == "" {
+			t.Errorf("%s: no Age header on a cache hit", name)
+		}
+	}
+}
+
+// TestProxyCacheBypassPattern checks that a path matching
+// cache.bypass_patterns reaches the upstream on every request and is never
+// stored, while a path outside the patterns is still cached. The bypassed
+// .diff/Index has no distro cache rule at all.
+func TestProxyCacheBypassPattern(t *testing.T) {
+	hits := make(map[string]int)
+	var mu sync.Mutex
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		if cc := r.Header.Get("Cache-Control"); cc != "" {
+			t.Errorf("upstream saw Cache-Control %q, want none", cc)
+		}
+		_, _ = io.WriteString(w, "body")
+	}), func(cfg *config.Config) {
+		cfg.Cache.BypassPatterns = []string{
+			`\.diff/Index$`,
+			`/noble-proposed/.*InRelease$`,
+		}
+	})
+
+	paths := map[string]int{
+		"/ubuntu/dists/noble/main/binary-amd64/Packages.diff/Index": 2,
+		"/ubuntu/dists/noble-proposed/InRelease":                    2,
+		"/ubuntu/dists/noble/InRelease":                             1,
+	}
+	for path, want := range paths {
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			resp, err := srv.app.Test(req, 10000)
+			if err != nil {
+				t.Fatalf("app.Test error: %v", err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s request %d: status = %d, want 200", path, i, resp.StatusCode)
+			}
+			if want == 2 {
+				if got := resp.Header.Get(httpcache.CacheHeader); got != "SKIP" {
+					t.Errorf("%s request %d: %s = %q, want SKIP", path, i, httpcache.CacheHeader, got)
+				}
+				if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+					t.Errorf("%s request %d: Cache-Control = %q, want no-store", path, i, got)
+				}
+			}
+			httpcache.Writes.Wait()
+		}
+		mu.Lock()
+		got := hits[path]
+		mu.Unlock()
+		if got != want {
+			t.Errorf("%s: upstream hit %d times, want %d", path, got, want)
+		}
+	}
+}
+
+// TestProxyOriginStyleRequests covers sources that name the proxy as the
+// origin (deb http://apt-proxy:3142/ubuntu ...) next to the usual
+// HTTP-proxy form with an absolute URL: both are routed by path to the
+// selected mirror and share one cache entry.
+func TestProxyOriginStyleRequests(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Host+r.URL.Path)
+		mu.Unlock()
+		_, _ = io.WriteString(w, "index")
+	}))
+	mirror, err := url.Parse(srv.config.Mirrors.Ubuntu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirrorHost := mirror.Host
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.app.Listener(ln) }()
+	defer func() { _ = srv.app.Shutdown() }()
+	proxyURL := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	viaProxy := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, step := range []struct {
+		name   string
+		client *http.Client
+		url    string
+		status int
+		cache  string
+	}{
+		{"origin style", http.DefaultClient, proxyURL.String() + "/ubuntu/dists/noble/InRelease", http.StatusOK, "MISS"},
+		{"proxy style", viaProxy, "http://archive.ubuntu.com/ubuntu/dists/noble/InRelease", http.StatusOK, "HIT"},
+		{"origin style, unknown path", http.DefaultClient, proxyURL.String() + "/nothing/here", http.StatusNotFound, ""},
+	} {
+		resp, err := step.client.Get(step.url)
+		if err != nil {
+			t.Fatalf("%s: GET error: %v", step.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+
+		if resp.StatusCode != step.status {
+			t.Errorf("%s: status = %d, want %d", step.name, resp.StatusCode, step.status)
+		}
+		if step.cache != "" && (resp.Header.Get("X-Cache") != step.cache || string(body) != "index") {
+			t.Errorf("%s: X-Cache = %q, body %q; want %s with the mirror's body", step.name, resp.Header.Get("X-Cache"), body, step.cache)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := mirrorHost + "/ubuntu/dists/noble/InRelease"; len(seen) != 1 || seen[0] != want {
+		t.Errorf("mirror saw %q, want one request for %q", seen, want)
+	}
+}
+
+// TestProxyCacheQueryKeyPattern checks that two URLs differing only in
+// their query string are cached separately when the path matches
+// cache.query_key_patterns, and share one path-only entry otherwise.
+func TestProxyCacheQueryKeyPattern(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.RequestURI()]++
+		mu.Unlock()
+		_, _ = io.WriteString(w, r.URL.RawQuery)
+	}), func(cfg *config.Config) { cfg.Cache.QueryKeyPatterns = []string{`/noble-updates/`} })
+
+	get := func(target string) string {
+		t.Helper()
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, target, nil), 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+		return string(body)
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := get("/ubuntu/dists/noble-updates/InRelease?arch=amd64"); got != "arch=amd64" {
+			t.Errorf("amd64 request %d: body = %q, want arch=amd64", i, got)
+		}
+		if got := get("/ubuntu/dists/noble-updates/InRelease?arch=arm64"); got != "arch=arm64" {
+			t.Errorf("arm64 request %d: body = %q, want arch=arm64", i, got)
+		}
+	}
+	for _, target := range []string{
+		"/ubuntu/dists/noble/InRelease?arch=amd64",
+		"/ubuntu/dists/noble/InRelease?arch=arm64",
+	} {
+		if got := get(target); got != "" {
+			t.Errorf("%s: body = %q, want the path-only response", target, got)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]int{
+		"/ubuntu/dists/noble-updates/InRelease?arch=amd64": 1,
+		"/ubuntu/dists/noble-updates/InRelease?arch=arm64": 1,
+		"/ubuntu/dists/noble/InRelease":                    1,
+	}
+	for uri, n := range want {
+		if hits[uri] != n {
+			t.Errorf("upstream hits for %s = %d, want %d (all hits: %v)", uri, hits[uri], n, hits)
+		}
+	}
+	if len(hits) != len(want) {
+		t.Errorf("upstream saw %v, want only %v", hits, want)
+	}
+}
+
+// TestProxyForwardQuery checks that with cache.forward_query a signed
+// package URL reaches the mirror with its query string, while the cache
+// still keys it by path: the same package under another signature is
+// served from the cache.
+func TestProxyForwardQuery(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.URL.RequestURI())
+		mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = io.WriteString(w, "deb-body")
+	}), func(cfg *config.Config) {
+		cfg.Mode = distro.TypeDebian
+		cfg.Cache.ForwardQuery = true
+	})
+	for _, target := range []string{
+		"/debian/pool/main/h/hello/hello_2.10-3_amd64.deb?_gda_=1700000000_abc",
+		"/debian/pool/main/h/hello/hello_2.10-3_amd64.deb?_gda_=1700003600_def",
+	} {
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, target, nil), 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+		if string(body) != "deb-body" {
+			t.Errorf("%s: body = %q, want the package", target, body)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"/debian/pool/main/h/hello/hello_2.10-3_amd64.deb?_gda_=1700000000_abc"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("upstream saw %v, want %v", seen, want)
+	}
+}
+
+// TestProxySanityCheckDoesNotCacheHTMLPackage points Debian at a mirror
+// that answers .deb requests with a 200 HTML page and checks the page is
+// refused with 502 and never written to the cache.
+func TestProxySanityCheckDoesNotCacheHTMLPackage(t *testing.T) {
+	var hits atomic.Int64
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.WriteString(w, "<!DOCTYPE html><html><body>404 - Not Found</body></html>")
+	}), func(cfg *config.Config) {
+		cfg.Mode = distro.TypeDebian
+		cfg.Cache.SanityCheck = true
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb", nil)
+		resp, err := srv.app.Test(req, 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("request %d: status = %d, want 502", i, resp.StatusCode)
+		}
+		httpcache.Writes.Wait()
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("upstream hit %d times, want 2 (the HTML page must not be cached)", n)
+	}
+}
+
+// TestReadyzWaitsForMirrorBenchmark holds the only Alpine mirror's
+// benchmark response and checks that /readyz stays not-ready until the
+// async benchmark callback has fired.
+func TestReadyzWaitsForMirrorBenchmark(t *testing.T) {
+	gate := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-gate:
+		case <-r.Context().Done():
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			close(gate)
+		}
+	}
+	defer release()
+
+	distros := filepath.Join(t.TempDir(), "distributions.yaml")
+	yaml := `distributions:
+  - id: alpine
+    name: Alpine Linux
+    type: 5
+    url_pattern: "/alpine/(.+)$"
+    benchmark_url: "MIRRORS.txt"
+    cache_rules:
+      - pattern: ".*"
+        cache_control: "max-age=100000"
+        rewrite: true
+    mirrors:
+      official:
+        - "` + upstream.URL + `/alpine/"
+`
+	if err := os.WriteFile(distros, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		CacheDir:                t.TempDir(),
+		Mode:                    distro.TypeAlpine,
+		Listen:                  "127.0.0.1:0",
+		DistributionsConfigPath: distros,
+		ReadyTimeout:            30 * time.Second,
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	t.Cleanup(func() { waitMirrorsReady(t, srv) })
+
+	readyz := func() int {
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/readyz", nil), 5000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz before benchmark = %d, want 503", code)
+	}
+	if resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/healthz", nil), 5000); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("/healthz should not wait for benchmarks: resp=%v err=%v", resp, err)
+	}
+
+	release()
+	deadline := time.Now().Add(10 * time.Second)
+	for readyz() != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("/readyz did not become ready after the benchmark completed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestCacheStatsSurviveRestart checks that cache.stats_file carries the
+// hit, miss and bytes-served totals from one Server to the next, and that
+// the uptime block restarts from zero.
+func TestCacheStatsSurviveRestart(t *testing.T) {
+	const pkg = "package"
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, pkg)
+	})
+	cacheDir, statsFile := t.TempDir(), filepath.Join(t.TempDir(), "stats.json")
+	sameFiles := func(cfg *config.Config) {
+		cfg.CacheDir = cacheDir
+		cfg.Cache.StatsFile = statsFile
+	}
+	stats := func(srv *Server) api.CacheStatsResponse {
+		t.Helper()
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/api/cache/stats", nil), 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		defer resp.Body.Close()
+		var got api.CacheStatsResponse
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return got
+	}
+
+	first := newUpstreamTestServer(t, upstream, sameFiles)
+	for range 2 {
+		resp, err := first.app.Test(httptest.NewRequest(http.MethodGet, "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb", nil), 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+	}
+	before := stats(first)
+	if before.HitCount == 0 || before.BytesServed != 2*int64(len(pkg)) {
+		t.Fatalf("first server stats = %+v, want hits and %d bytes served", before, 2*len(pkg))
+	}
+	if err := first.shutdown(); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	second := newUpstreamTestServer(t, upstream, sameFiles)
+	defer func() { _ = second.shutdown() }()
+	after := stats(second)
+	if after.HitCount != before.HitCount || after.MissCount != before.MissCount || after.BytesServed != before.BytesServed {
+		t.Errorf("after restart = %d/%d/%d, want the saved %d/%d/%d", after.HitCount, after.MissCount, after.BytesServed, before.HitCount, before.MissCount, before.BytesServed)
+	}
+	if !after.Since.Equal(before.Since) {
+		t.Errorf("since = %s, want the first start %s", after.Since, before.Since)
+	}
+	if after.Uptime.HitCount != 0 || after.Uptime.BytesServed != 0 || !after.Uptime.Since.After(before.Since) {
+		t.Errorf("uptime = %+v, want counters of the new process only", after.Uptime)
+	}
+}
+
+// TestHealthAPIReportsMode checks /api/health reports the configured and
+// resolved mode and the distributions with an active rewriter, so a
+// mistyped mode that fell back to "all" shows up.
+func TestHealthAPIReportsMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		modeName string
+		mode     int
+		want     api.ModeHealth
+	}{
+		{
+			name:     "valid mode",
+			modeName: "ubuntu",
+			mode:     distro.TypeUbuntu,
+			want:     api.ModeHealth{Configured: "ubuntu", Resolved: "ubuntu", ResolvedType: distro.TypeUbuntu, ActiveDistros: []string{"ubuntu"}},
+		},
+		{
+			name:     "mistyped mode fell back to all",
+			modeName: "debain",
+			mode:     distro.TypeAllDistros,
+			want: api.ModeHealth{
+				Configured: "debain", Resolved: "all", ResolvedType: distro.TypeAllDistros, Fallback: true,
+				ActiveDistros: []string{"ubuntu", "ubuntu-ports", "debian", "centos", "alpine", "gentoo", "arch"},
+			},
+		},
+		{
+			name: "no mode given",
+			mode: distro.TypeAllDistros,
+			want: api.ModeHealth{
+				Resolved: "all", ResolvedType: distro.TypeAllDistros,
+				ActiveDistros: []string{"ubuntu", "ubuntu-ports", "debian", "centos", "alpine", "gentoo", "arch"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := NewServer(withTestMirrors(&config.Config{
+				CacheDir: t.TempDir(),
+				Mode:     tt.mode,
+				ModeName: tt.modeName,
+				Listen:   "127.0.0.1:0",
+			}))
+			if err != nil {
+				t.Fatalf("NewServer() error = %v", err)
+			}
+			resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/api/health", nil))
+			if err != nil {
+				t.Fatalf("app.Test error: %v", err)
+			}
+			defer resp.Body.Close()
+			var health api.HealthResponse
+			if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if health.Mode == nil {
+				t.Fatal("health response has no mode")
+			}
+			if !reflect.DeepEqual(*health.Mode, tt.want) {
+				t.Errorf("mode = %+v, want %+v", *health.Mode, tt.want)
+			}
+		})
+	}
+}
+
+// TestMaintenanceMode checks that package requests get 503 with a
+// Retry-After in maintenance mode while /healthz stays green, and that
+// both the API and a config reload switch the mode.
+func TestMaintenanceMode(t *testing.T) {
+	var upstreamHits atomic.Int64
+	configFile := filepath.Join(t.TempDir(), "apt-proxy.yaml")
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		_, _ = io.WriteString(w, "release")
+	}), func(cfg *config.Config) {
+		cfg.Maintenance = true
+		cfg.MaintenanceRetryAfter = 90 * time.Second
+		cfg.ConfigFile = configFile
+	})
+	send := func(method, path, body string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := srv.app.Test(req, 10000)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+		return resp
+	}
+	const pkg = "/ubuntu/dists/noble/InRelease"
+
+	if resp := send(http.MethodGet, pkg, ""); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "90" {
+		t.Errorf("GET %s in maintenance = %d, Retry-After %q; want 503, 90", pkg, resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp := send(http.MethodGet, "/healthz", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz in maintenance = %d, want 200", resp.StatusCode)
+	}
+	if n := upstreamHits.Load(); n != 0 {
+		t.Errorf("mirror asked %d times in maintenance mode, want 0", n)
+	}
+
+	if resp := send(http.MethodPost, "/api/maintenance", `{"enabled":false}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /api/maintenance = %d, want 200", resp.StatusCode)
+	}
+	if resp := send(http.MethodGet, pkg, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET %s after maintenance = %d, want the mirror's 200", pkg, resp.StatusCode)
+	}
+
+	if err := os.WriteFile(configFile, []byte("server:\n  maintenance: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv.reloadMaintenance(srv.reloadConfigFiles())
+	if !srv.proxy.InMaintenance() {
+		t.Error("reload of a config with server.maintenance did not turn maintenance mode on")
+	}
+	if resp := send(http.MethodGet, pkg, ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET %s after reload = %d, want 503", pkg, resp.StatusCode)
+	}
+}
+
+// TestStorageBackendsServeFromCache runs the same requests against the
+// disk and the memory backend: a miss is stored and then served from the
+// cache, and cache.max_size evicts the least recently used package. Only
+// the disk backend writes the packages under cache.dir.
+func TestStorageBackendsServeFromCache(t *testing.T) {
+	body := strings.Repeat("p", 1000)
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = io.WriteString(w, body)
+	})
+
+	for _, backend := range []string{config.StorageBackendDisk, config.StorageBackendMemory} {
+		t.Run(backend, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			srv := newUpstreamTestServer(t, upstream, func(cfg *config.Config) {
+				cfg.CacheDir = cacheDir
+				cfg.Storage.Backend = backend
+				cfg.Cache.MaxSize = 4096
+			})
+			defer srv.cache.Close()
+			send := func(method string, n int, want string) {
+				t.Helper()
+				path := fmt.Sprintf("/ubuntu/pool/main/h/hello/hello_2.%d_amd64.deb", n)
+				resp, err := srv.app.Test(httptest.NewRequest(method, path, nil), 10000)
+				if err != nil {
+					t.Fatalf("%s %s: %v", method, path, err)
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				httpcache.Writes.Wait()
+				if got := resp.Header.Get("X-Cache"); resp.StatusCode != http.StatusOK || got != want {
+					t.Errorf("%s %s = %d, X-Cache %q; want 200, %s", method, path, resp.StatusCode, got, want)
+				}
+			}
+
+			send(http.MethodGet, 1, "MISS")
+			send(http.MethodGet, 1, "HIT")
+			send(http.MethodHead, 1, "HIT")
+			for n := 2; n <= 4; n++ {
+				send(http.MethodGet, n, "MISS")
+			}
+			if stats := srv.cache.Stats(); stats.TotalSize > 4096 {
+				t.Errorf("cache holds %d bytes, over cache.max_size 4096", stats.TotalSize)
+			}
+			send(http.MethodGet, 4, "HIT")
+			send(http.MethodGet, 1, "MISS")
+
+			onDisk := false
+			_ = filepath.WalkDir(cacheDir, func(path string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					if data, _ := os.ReadFile(path); string(data) == body {
+						onDisk = true
+					}
+				}
+				return nil
+			})
+			if want := backend == config.StorageBackendDisk; onDisk != want {
+				t.Errorf("package stored under cache.dir = %v, want %v", onDisk, want)
+			}
+		})
+	}
+}
+
+// TestAccessLogClientIP checks the access log's client_ip is the
+// rightmost untrusted X-Forwarded-For hop when the request comes from a
+// trusted proxy, and the peer itself otherwise. app.Test connects from
+// 0.0.0.0.
+func TestAccessLogClientIP(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		trusted []string
+		want    string
+	}{
+		{"trusted proxy", []string{"0.0.0.0/32", "10.0.0.0/8"}, "198.51.100.7"},
+		{"untrusted peer", nil, "0.0.0.0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := NewServer(withTestMirrors(&config.Config{
+				CacheDir: t.TempDir(),
+				Mode:     distro.TypeDebian,
+				Listen:   "127.0.0.1:0",
+				Security: config.SecurityConfig{TrustedProxies: tt.trusted},
+			}))
+			if err != nil {
+				t.Fatalf("NewServer() error = %v", err)
+			}
+			var out bytes.Buffer
+			srv.logConfig.Output = &out
+			srv.logConfig.Format = logger.FormatJSON
+			srv.log = logger.New(srv.logConfig)
+			srv.app = srv.createFiberApp()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Forwarded-For", "203.0.113.66, 198.51.100.7, 10.0.0.2")
+			resp, err := srv.app.Test(req, 10000)
+			if err != nil {
+				t.Fatalf("app.Test error: %v", err)
+			}
+			resp.Body.Close()
+
+			var entry struct {
+				ClientIP string `json:"client_ip"`
+			}
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				if err := json.Unmarshal([]byte(line), &entry); err == nil && entry.ClientIP != "" {
+					break
+				}
+			}
+			if entry.ClientIP != tt.want {
+				t.Errorf("client_ip = %q, want %q; log:\n%s", entry.ClientIP, tt.want, out.String())
+			}
+		})
+	}
+}
+
+// TestHomePageListsMirrors checks that the home page lists the mirror
+// selected for the served distribution.
+func TestHomePageListsMirrors(t *testing.T) {
+	srv, err := NewServer(withTestMirrors(&config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeDebian,
+		Listen:   "127.0.0.1:0",
+	}))
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/", nil), 10000)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "Selected mirrors") || !strings.Contains(string(body), "http://mirrors.example.com/debian/") {
+		t.Errorf("home page = %d without the Debian mirror:\n%s", resp.StatusCode, body)
+	}
+}
+
+// TestConditionalGetOnNonCacheableRule checks a path matched by a cache
+// rule without cache_control is never answered from the cache: the
+// client's If-None-Match reaches the mirror and the mirror's 304 is
+// passed back as sent, while a cacheable path is still cached.
+func TestConditionalGetOnNonCacheableRule(t *testing.T) {
+	var fetches, conditional atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			w.Header().Set("X-Mirror", "not-modified")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = io.WriteString(w, "body of "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	distros := filepath.Join(t.TempDir(), "distributions.yaml")
+	yaml := `distributions:
+  - id: alpine
+    name: Alpine Linux
+    type: 5
+    url_pattern: "/alpine/(.+)$"
+    benchmark_url: "MIRRORS.txt"
+    cache_rules:
+      - pattern: "status\\.json$"
+        rewrite: true
+      - pattern: ".*"
+        cache_control: "max-age=100000"
+        rewrite: true
+    mirrors:
+      official:
+        - "` + upstream.URL + `/alpine/"
+`
+	if err := os.WriteFile(distros, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(&config.Config{
+		CacheDir:                t.TempDir(),
+		Mode:                    distro.TypeAlpine,
+		Listen:                  "127.0.0.1:0",
+		DistributionsConfigPath: distros,
+		Mirrors:                 config.MirrorConfig{Alpine: upstream.URL + "/alpine/"},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	get := func(path, etag string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := srv.app.Test(req, 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+		return resp
+	}
+
+	const status = "/alpine/v3.20/status.json"
+	if resp := get(status, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first GET status = %d, want 200", resp.StatusCode)
+	}
+	before := fetches.Load()
+	resp := get(status, `"v1"`)
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get("X-Mirror") != "not-modified" || resp.Header.Get("ETag") != `"v1"` {
+		t.Errorf("conditional GET = %d X-Mirror=%q ETag=%q, want the mirror's 304", resp.StatusCode, resp.Header.Get("X-Mirror"), resp.Header.Get("ETag"))
+	}
+	if fetches.Load() != before+1 || conditional.Load() != 1 {
+		t.Errorf("mirror got %d requests, %d conditional; want the If-None-Match forwarded once", fetches.Load()-before, conditional.Load())
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "max-age=3600" {
+		t.Errorf("Cache-Control = %q, want the mirror's", got)
+	}
+
+	const pkg = "/alpine/v3.20/main/x86_64/hello-1.0-r0.apk"
+	get(pkg, "")
+	before = fetches.Load()
+	if resp := get(pkg, ""); resp.Header.Get("X-Cache") != "HIT" || fetches.Load() != before {
+		t.Errorf("cacheable path: X-Cache = %q after %d fetches, want a HIT", resp.Header.Get("X-Cache"), fetches.Load()-before)
+	}
+}
+
+// TestCacheSurvivesMirrorSwitch caches a package fetched from one mirror,
+// switches Debian to another mirror and checks the package is a cache hit
+// that never reaches the new mirror, while an uncached file is fetched
+// from it.
+func TestCacheSurvivesMirrorSwitch(t *testing.T) {
+	var hitsA, hitsB atomic.Int32
+	mirrorA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hitsA.Add(1)
+		_, _ = io.WriteString(w, "package from A")
+	}))
+	defer mirrorA.Close()
+	mirrorB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hitsB.Add(1)
+		_, _ = io.WriteString(w, "package from B")
+	}))
+	defer mirrorB.Close()
+
+	srv, err := NewServer(&config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeDebian,
+		Listen:   "127.0.0.1:0",
+		Mirrors:  config.MirrorConfig{Debian: mirrorA.URL + "/debian/"},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	get := func(path string) (string, string) {
+		t.Helper()
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, path, nil), 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+		return string(body), resp.Header.Get("X-Cache")
+	}
+
+	const pkg = "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"
+	if body, _ := get(pkg); body != "package from A" {
+		t.Fatalf("first GET body = %q, want it from mirror A", body)
+	}
+
+	srv.state.SetMirror(distro.TypeDebian, mirrorB.URL+"/debian/")
+	srv.proxy.RefreshMirrors()
+	if statuses := srv.proxy.MirrorStatuses(); len(statuses) != 1 || statuses[0].Mirror != mirrorB.URL+"/debian/" {
+		t.Fatalf("mirror after the switch = %+v, want %s", statuses, mirrorB.URL)
+	}
+
+	body, cache := get(pkg)
+	if body != "package from A" || cache != "HIT" {
+		t.Errorf("after the switch: body %q, X-Cache %q; want the copy cached from mirror A", body, cache)
+	}
+	if n := hitsB.Load(); n != 0 {
+		t.Errorf("mirror B asked %d times for a cached package", n)
+	}
+	if body, _ := get("/debian/pool/main/h/hello/hello_2.10-3_arm64.deb"); body != "package from B" || hitsB.Load() != 1 {
+		t.Errorf("uncached package body = %q after %d requests to B, want it from mirror B", body, hitsB.Load())
+	}
+	if n := hitsA.Load(); n != 1 {
+		t.Errorf("mirror A asked %d times, want once", n)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/apt-proxy/internal/system"
+)
+
+// diskGuardInterval is how often the cache filesystem's free space is
+// checked against cache.min_free_bytes.
+const diskGuardInterval = 30 * time.Second
+
+// diskGuard wraps the cache so that, while the cache filesystem is below
+// minFree bytes of free space, new objects are not stored: responses are
+// still proxied, just not written to disk. Crossing the threshold also
+// triggers eviction: a regular cleanup first and, if that does not free
+// enough, a purge, since a full disk hurts the host more than a cold cache.
+type diskGuard struct {
+	httpcache.ExtendedCache
+
+	dir       string
+	minFree   uint64
+	freeBytes func(dir string) (uint64, error)
+	log       *logger.Logger
+
+	paused    atomic.Bool
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newDiskGuard(cache httpcache.ExtendedCache, dir string, minFree int64, log *logger.Logger) *diskGuard {
+	return &diskGuard{
+		ExtendedCache: cache,
+		dir:           dir,
+		minFree:       uint64(minFree),
+		freeBytes:     func(dir string) (uint64, error) { return system.DiskAvailable(dir) },
+		log:           log,
+		stop:          make(chan struct{}),
+	}
+}
+
+// Store drops the write while caching is paused.
+func (g *diskGuard) Store(res *httpcache.Resource, keys ...string) error {
+	if g.paused.Load() {
+		return nil
+	}
+	return g.ExtendedCache.Store(res, keys...)
+}
+
+// Close stops the periodic check and closes the wrapped cache.
+func (g *diskGuard) Close() error {
+	g.closeOnce.Do(func() { close(g.stop) })
+	return g.ExtendedCache.Close()
+}
+
+// run checks free space every interval until Close.
+func (g *diskGuard) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.check()
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// check pauses or resumes caching according to the current free space.
+func (g *diskGuard) check() {
+	free, err := g.freeBytes(g.dir)
+	if err != nil {
+		g.log.Warn().Err(err).Str("dir", g.dir).Msg("cannot read free disk space for cache.min_free_bytes")
+		return
+	}
+	if free >= g.minFree {
+		if g.paused.CompareAndSwap(true, false) {
+			g.log.Info().Uint64("free_bytes", free).Uint64("min_free_bytes", g.minFree).Msg("free disk space recovered, caching resumed")
+		}
+		return
+	}
+	if !g.paused.CompareAndSwap(false, true) {
+		return
+	}
+	g.log.Warn().Uint64("free_bytes", free).Uint64("min_free_bytes", g.minFree).Msg("cache filesystem low on free space, caching paused")
+
+	result := g.Cleanup()
+	if free, err = g.freeBytes(g.dir); err == nil && free >= g.minFree {
+		g.log.Info().Int("removed_items", result.RemovedItems).Int64("removed_bytes", result.RemovedBytes).Msg("cache cleanup freed enough disk space")
+		return
+	}
+	if err := g.Purge(); err != nil {
+		g.log.Error().Err(err).Msg("failed to purge cache after low free disk space")
+		return
+	}
+	g.log.Warn().Msg("cache purged to recover free disk space")
+}
@@ -0,0 +1,146 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+func storeTestResource(t *testing.T, c httpcache.Cache, key string) {
+	t.Helper()
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("deb-body"), http.Header{"Content-Length": {"8"}})
+	if err := c.Store(res, key); err != nil {
+		t.Fatalf("Store(%q) error = %v", key, err)
+	}
+}
+
+func cached(c httpcache.Cache, key string) bool {
+	_, err := c.Header(key)
+	return err == nil
+}
+
+func TestDiskGuardPausesCachingBelowMinFree(t *testing.T) {
+	free := uint64(10 << 20)
+	g := newDiskGuard(httpcache.NewMemoryCacheWithConfig(nil), "/var/cache/apt-proxy", 1<<20, logger.Default())
+	g.freeBytes = func(string) (uint64, error) { return free, nil }
+	defer func() { _ = g.Close() }()
+
+	g.check()
+	storeTestResource(t, g, "GET /ubuntu/pool/a.deb")
+	if !cached(g, "GET /ubuntu/pool/a.deb") {
+		t.Fatal("object not stored while free space is above the minimum")
+	}
+
+	// The disk fills up: caching pauses and existing objects are evicted.
+	free = 512 << 10
+	g.check()
+	if cached(g, "GET /ubuntu/pool/a.deb") {
+		t.Error("existing object survived low-disk eviction")
+	}
+	storeTestResource(t, g, "GET /ubuntu/pool/b.deb")
+	if cached(g, "GET /ubuntu/pool/b.deb") {
+		t.Error("object stored while caching is paused")
+	}
+
+	free = 10 << 20
+	g.check()
+	storeTestResource(t, g, "GET /ubuntu/pool/c.deb")
+	if !cached(g, "GET /ubuntu/pool/c.deb") {
+		t.Error("object not stored after free space recovered")
+	}
+}
+
+func TestDiskGuardKeepsStateWhenStatFails(t *testing.T) {
+	g := newDiskGuard(httpcache.NewMemoryCacheWithConfig(nil), "/var/cache/apt-proxy", 1<<20, logger.Default())
+	g.freeBytes = func(string) (uint64, error) { return 0, errors.New("statfs unsupported") }
+	defer func() { _ = g.Close() }()
+
+	g.check()
+	storeTestResource(t, g, "GET /ubuntu/pool/a.deb")
+	if !cached(g, "GET /ubuntu/pool/a.deb") {
+		t.Error("a failed free-space check should not pause caching")
+	}
+}
+
+// runningCacheGuards counts the goroutines running a cache guard's
+// periodic check.
+func runningCacheGuards() int {
+	buf := make([]byte, 1<<20)
+	stacks := string(buf[:runtime.Stack(buf, true)])
+	return strings.Count(stacks, "(*diskGuard).run") + strings.Count(stacks, "(*readOnlyGuard).run")
+}
+
+// TestFailedInitializeLeavesNoCacheGuardRunning checks that a Server
+// failing to initialize after its stores were opened does not leave their
+// guards' checks running.
+func TestFailedInitializeLeavesNoCacheGuardRunning(t *testing.T) {
+	before := runningCacheGuards()
+	cfg := withTestMirrors(&config.Config{CacheDir: t.TempDir(), Mode: distro.TypeUbuntu, Listen: "127.0.0.1:0"})
+	cfg.Cache.MinFreeBytes = 1
+	cfg.Cache.BypassPatterns = []string{"("}
+	if _, err := NewServer(cfg); err == nil {
+		t.Fatal("NewServer() with an invalid cache.bypass_patterns entry: error = nil")
+	}
+	// A goroutine just started may not show up in the dump at once.
+	for deadline := time.Now().Add(100 * time.Millisecond); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if after := runningCacheGuards(); after > before {
+			t.Fatalf("%d cache guard checks left running after a failed initialize", after-before)
+		}
+	}
+}
+
+// TestMemoryBackendIgnoresMinFreeBytes sets a cache.min_free_bytes no
+// disk can meet on a memory-backed Server: local disk space says nothing
+// about the RAM cache, which must keep caching and never be purged.
+func TestMemoryBackendIgnoresMinFreeBytes(t *testing.T) {
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = io.WriteString(w, "deb-body")
+	}), func(cfg *config.Config) {
+		cfg.Storage.Backend = config.StorageBackendMemory
+		cfg.Cache.MinFreeBytes = math.MaxInt64
+	})
+	defer srv.cache.Close()
+	if len(srv.diskGuards) != 0 {
+		t.Fatalf("memory backend wrapped in %d disk guards", len(srv.diskGuards))
+	}
+
+	for _, want := range []string{"MISS", "HIT"} {
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb", nil), 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+		if got := resp.Header.Get("X-Cache"); got != want {
+			t.Errorf("X-Cache = %q, want %q", got, want)
+		}
+	}
+}
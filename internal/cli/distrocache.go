@@ -0,0 +1,270 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+	vfs "github.com/soulteary/vfs-kit"
+
+	"github.com/soulteary/apt-proxy/internal/api"
+	"github.com/soulteary/apt-proxy/internal/distro"
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+)
+
+// indexPoolDir is the directory under cache.dir holding the index pool
+// (cache.index_max_size_mb).
+const indexPoolDir = "index"
+
+// distroCaches presents the default cache, the index pool and the
+// per-distribution stores of cache.dirs as one cache to the management
+// API and health checks: stats and cleanup results are summed, and purge
+// and close reach every store. Lookups by key go to the default cache
+// only; proxied requests reach the index pool or a distribution's store
+// through their own handler chains (see proxy.PackageStruct.IndexHandlers
+// and DistroHandlers).
+//
+// It also implements api.DistroScope. A distribution with its own store is
+// purged by purging that store; objects a distribution left in the default
+// cache or the index pool are found through tags and their files removed
+// from files. Those stores keep counting removed objects in their
+// statistics until they evict them or the server restarts.
+//
+// With an index pool it implements api.CachePools, reporting the index
+// pool and the default cache, which then holds the package files.
+type distroCaches struct {
+	httpcache.ExtendedCache
+
+	maxSize      int64                   // default cache's size limit
+	index        httpcache.ExtendedCache // index pool, nil when not split
+	indexMaxSize int64                   // index pool's size limit
+	stores       map[int]httpcache.ExtendedCache
+	files        []vfs.VFS   // storage of the default cache and index pool, nil without tags
+	tags         *distroTags // distribution of each key in files
+	registry     *distro.Registry
+}
+
+// all returns the default cache and the index pool followed by the
+// per-distribution stores in distro.Type* order.
+func (c *distroCaches) all() []httpcache.ExtendedCache {
+	modes := make([]int, 0, len(c.stores))
+	for m := range c.stores {
+		modes = append(modes, m)
+	}
+	sort.Ints(modes)
+	out := []httpcache.ExtendedCache{c.ExtendedCache}
+	if c.index != nil {
+		out = append(out, c.index)
+	}
+	for _, m := range modes {
+		out = append(out, c.stores[m])
+	}
+	return out
+}
+
+// Stats sums the statistics of every store.
+func (c *distroCaches) Stats() httpcache.CacheStats {
+	var total httpcache.CacheStats
+	for _, store := range c.all() {
+		s := store.Stats()
+		total.TotalSize += s.TotalSize
+		total.ItemCount += s.ItemCount
+		total.StaleCount += s.StaleCount
+		total.HitCount += s.HitCount
+		total.MissCount += s.MissCount
+	}
+	return total
+}
+
+// Pools reports the index pool and the package pool (the default cache),
+// or nil when the cache is not split.
+func (c *distroCaches) Pools() []api.CachePool {
+	if c.index == nil {
+		return nil
+	}
+	return []api.CachePool{
+		{Name: "index", MaxSize: c.indexMaxSize, Stats: c.index.Stats()},
+		{Name: "package", MaxSize: c.maxSize, Stats: c.ExtendedCache.Stats()},
+	}
+}
+
+// Cleanup runs a cleanup cycle on every store and sums the results.
+func (c *distroCaches) Cleanup() httpcache.CleanupResult {
+	var total httpcache.CleanupResult
+	for _, store := range c.all() {
+		r := store.Cleanup()
+		total.RemovedItems += r.RemovedItems
+		total.RemovedBytes += r.RemovedBytes
+		total.RemovedStaleEntries += r.RemovedStaleEntries
+		total.Duration += r.Duration
+	}
+	return total
+}
+
+// Purge empties every store, continuing past failures.
+func (c *distroCaches) Purge() error {
+	var errs []error
+	for _, store := range c.all() {
+		if err := store.Purge(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.tags != nil {
+		if err := c.tags.clear(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lookup resolves distribution IDs, rejecting unknown ones.
+func (c *distroCaches) lookup(ids []string) ([]*distro.RegisteredDistribution, error) {
+	dists := make([]*distro.RegisteredDistribution, 0, len(ids))
+	for _, id := range ids {
+		var dist *distro.RegisteredDistribution
+		ok := false
+		if c.registry != nil {
+			dist, ok = c.registry.GetByID(id)
+		}
+		if !ok {
+			return nil, apperrors.New(apperrors.ErrResourceNotFound, fmt.Sprintf("unknown distribution: %s", id))
+		}
+		dists = append(dists, dist)
+	}
+	return dists, nil
+}
+
+// PurgeDistros removes the cached objects of the given distributions only,
+// emptying their cache.dirs stores and deleting the objects they stored in
+// the default cache and the index pool.
+func (c *distroCaches) PurgeDistros(ids []string) (httpcache.CleanupResult, error) {
+	start := time.Now()
+	var result httpcache.CleanupResult
+	dists, err := c.lookup(ids)
+	if err != nil {
+		return result, err
+	}
+
+	var errs []error
+	tagged := make(map[string]bool, len(dists))
+	for _, dist := range dists {
+		tagged[dist.ID] = true
+		store, ok := c.stores[dist.Type]
+		if !ok {
+			continue
+		}
+		stats := store.Stats()
+		if err := store.Purge(); err != nil {
+			errs = append(errs, fmt.Errorf("purge %s store: %w", dist.ID, err))
+			continue
+		}
+		result.RemovedItems += stats.ItemCount
+		result.RemovedBytes += stats.TotalSize
+	}
+
+	if c.tags != nil && len(c.files) > 0 {
+		keys, err := c.tags.take(tagged)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, key := range keys {
+			for _, files := range c.files {
+				removed, size, err := removeCacheObject(files, key)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				if removed {
+					result.RemovedItems++
+					result.RemovedBytes += size
+				}
+			}
+		}
+	}
+
+	result.Duration = time.Since(start)
+	return result, errors.Join(errs...)
+}
+
+// CleanupDistros runs a cleanup cycle over the cache.dirs stores of the
+// given distributions. Distributions sharing the default cache have no
+// cleanup of their own, so naming one is an error.
+func (c *distroCaches) CleanupDistros(ids []string) (httpcache.CleanupResult, error) {
+	var total httpcache.CleanupResult
+	dists, err := c.lookup(ids)
+	if err != nil {
+		return total, err
+	}
+	stores := make([]httpcache.ExtendedCache, 0, len(dists))
+	for _, dist := range dists {
+		store, ok := c.stores[dist.Type]
+		if !ok {
+			return total, apperrors.New(apperrors.ErrRequestInvalid,
+				fmt.Sprintf("distribution %s shares the default cache, which is only cleaned up as a whole; set cache.dirs.%s or omit distros", dist.ID, dist.ID))
+		}
+		stores = append(stores, store)
+	}
+	for _, store := range stores {
+		r := store.Cleanup()
+		total.RemovedItems += r.RemovedItems
+		total.RemovedBytes += r.RemovedBytes
+		total.RemovedStaleEntries += r.RemovedStaleEntries
+		total.Duration += r.Duration
+	}
+	return total, nil
+}
+
+// removeCacheObject deletes the body and header files of key from files,
+// reporting whether the object existed and its size on storage.
+func removeCacheObject(files vfs.VFS, key string) (bool, int64, error) {
+	body, header := cacheObjectPaths(key)
+	removed := false
+	var size int64
+	for _, path := range []string{body, header} {
+		info, err := files.Stat(path)
+		if vfs.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return removed, size, err
+		}
+		if err := files.Remove(path); err != nil && !vfs.IsNotExist(err) {
+			return removed, size, err
+		}
+		removed = true
+		size += info.Size()
+	}
+	return removed, size, nil
+}
+
+// Close closes every store and the tags, continuing past failures.
+func (c *distroCaches) Close() error {
+	var errs []error
+	for _, store := range c.all() {
+		if err := store.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.tags != nil {
+		if err := c.tags.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
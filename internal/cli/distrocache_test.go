@@ -0,0 +1,292 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+
+	"github.com/soulteary/apt-proxy/internal/api"
+	"github.com/soulteary/apt-proxy/internal/config"
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+func TestDistroCachesAggregate(t *testing.T) {
+	def := httpcache.NewMemoryCacheWithConfig(nil)
+	alpine := httpcache.NewMemoryCacheWithConfig(nil)
+	c := &distroCaches{ExtendedCache: def, stores: map[int]httpcache.ExtendedCache{distro.TypeAlpine: alpine}}
+	defer func() { _ = c.Close() }()
+
+	storeTestResource(t, def, "GET /debian/pool/a.deb")
+	storeTestResource(t, alpine, "GET /alpine/v3.20/main/x86_64/b.apk")
+	if got := c.Stats(); got.ItemCount != 2 || got.TotalSize != def.Stats().TotalSize+alpine.Stats().TotalSize {
+		t.Errorf("Stats() = %+v, want the sum of both stores", got)
+	}
+
+	if err := c.Purge(); err != nil {
+		t.Fatalf("Purge() error = %v", err)
+	}
+	if n := c.Stats().ItemCount; n != 0 {
+		t.Errorf("ItemCount after Purge() = %d, want 0", n)
+	}
+}
+
+// countFiles returns the number of regular files below dir.
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// TestCacheDirsSeparatesDistroStores serves an Ubuntu and a Debian package
+// with cache.dirs.ubuntu set: the Ubuntu object lands in the Ubuntu store,
+// the Debian one in cache.dir, and stats cover both.
+func TestCacheDirsSeparatesDistroStores(t *testing.T) {
+	ubuntuDir := t.TempDir()
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "package")
+	}), func(cfg *config.Config) {
+		cfg.Mode = distro.TypeAllDistros
+		cfg.Cache.Dirs = map[string]string{distro.DistroUbuntu: ubuntuDir}
+	})
+	defer func() { _ = srv.cache.Close() }()
+
+	for _, path := range []string{"/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb", "/debian/pool/main/h/hello/hello_2.10_amd64.deb"} {
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, path, nil), 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", path, resp.StatusCode)
+		}
+	}
+	httpcache.Writes.Wait()
+
+	caches, ok := srv.cache.(*distroCaches)
+	if !ok {
+		t.Fatalf("srv.cache is %T, want *distroCaches", srv.cache)
+	}
+	if n := caches.stores[distro.TypeUbuntu].Stats().ItemCount; n != 1 {
+		t.Errorf("ubuntu store holds %d objects, want 1", n)
+	}
+	if n := caches.ExtendedCache.Stats().ItemCount; n != 1 {
+		t.Errorf("default store holds %d objects, want 1 (debian)", n)
+	}
+	if n := srv.cache.Stats().ItemCount; n != 2 {
+		t.Errorf("aggregated ItemCount = %d, want 2", n)
+	}
+	if countFiles(t, ubuntuDir) == 0 {
+		t.Error("no files written under cache.dirs.ubuntu")
+	}
+}
+
+const (
+	scopeTestUbuntu = "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb"
+	scopeTestAlpine = "/alpine/v3.20/main/x86_64/hello-2.10-r0.apk"
+)
+
+// newScopeTestServer serves every distribution from one upstream, with
+// the given cache.dirs.
+func newScopeTestServer(t *testing.T, dirs map[string]string) *Server {
+	t.Helper()
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "package "+r.URL.Path)
+	}), func(cfg *config.Config) {
+		cfg.Mode = distro.TypeAllDistros
+		cfg.Cache.Dirs = dirs
+	})
+	t.Cleanup(func() { _ = srv.cache.Close() })
+	return srv
+}
+
+// fetchXCache GETs path and returns its X-Cache header.
+func fetchXCache(t *testing.T, srv *Server, path string) string {
+	t.Helper()
+	resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, path, nil), 10000)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	httpcache.Writes.Wait()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s status = %d, want 200", path, resp.StatusCode)
+	}
+	return resp.Header.Get("X-Cache")
+}
+
+// postScoped POSTs body to an admin cache endpoint and decodes the reply.
+func postScoped(t *testing.T, srv *Server, path, body string) (int, map[string]any) {
+	t.Helper()
+	resp, err := srv.app.Test(httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)), 10000)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+func TestPurgeDistrosKeepsOtherDistros(t *testing.T) {
+	srv := newScopeTestServer(t, nil)
+	for _, path := range []string{scopeTestUbuntu, scopeTestAlpine} {
+		if got := fetchXCache(t, srv, path); got != "MISS" {
+			t.Fatalf("first GET %s X-Cache = %q, want MISS", path, got)
+		}
+	}
+
+	status, out := postScoped(t, srv, "/api/cache/purge", `{"distros":["alpine"]}`)
+	if status != http.StatusOK {
+		t.Fatalf("scoped purge status = %d (%v), want 200", status, out)
+	}
+	if out["items_removed"] != float64(1) {
+		t.Errorf("items_removed = %v, want 1", out["items_removed"])
+	}
+
+	if got := fetchXCache(t, srv, scopeTestUbuntu); got != "HIT" {
+		t.Errorf("ubuntu after purging alpine: X-Cache = %q, want HIT", got)
+	}
+	if got := fetchXCache(t, srv, scopeTestAlpine); got != "MISS" {
+		t.Errorf("alpine after purging alpine: X-Cache = %q, want MISS", got)
+	}
+	if got := fetchXCache(t, srv, scopeTestAlpine); got != "HIT" {
+		t.Errorf("alpine after re-fetch: X-Cache = %q, want HIT", got)
+	}
+}
+
+func TestPurgeDistrosWithOwnStore(t *testing.T) {
+	srv := newScopeTestServer(t, map[string]string{distro.DistroAlpine: t.TempDir()})
+	fetchXCache(t, srv, scopeTestUbuntu)
+	fetchXCache(t, srv, scopeTestAlpine)
+
+	if status, out := postScoped(t, srv, "/api/cache/purge", `{"distros":["alpine"]}`); status != http.StatusOK || out["items_removed"] != float64(1) {
+		t.Fatalf("scoped purge = %d %v, want 200 removing 1 item", status, out)
+	}
+	if got := fetchXCache(t, srv, scopeTestUbuntu); got != "HIT" {
+		t.Errorf("ubuntu after purging alpine: X-Cache = %q, want HIT", got)
+	}
+	if got := fetchXCache(t, srv, scopeTestAlpine); got != "MISS" {
+		t.Errorf("alpine after purging alpine: X-Cache = %q, want MISS", got)
+	}
+
+	if status, out := postScoped(t, srv, "/api/cache/cleanup", `{"distros":["alpine"]}`); status != http.StatusOK {
+		t.Errorf("scoped cleanup of a cache.dirs store = %d %v, want 200", status, out)
+	}
+	if status, _ := postScoped(t, srv, "/api/cache/cleanup", `{"distros":["ubuntu"]}`); status != http.StatusBadRequest {
+		t.Errorf("scoped cleanup of the shared cache status = %d, want 400", status)
+	}
+}
+
+func TestPurgeDistrosRejectsUnknownDistro(t *testing.T) {
+	srv := newScopeTestServer(t, nil)
+	fetchXCache(t, srv, scopeTestUbuntu)
+
+	if status, _ := postScoped(t, srv, "/api/cache/purge", `{"distros":["plan9"]}`); status != http.StatusNotFound {
+		t.Errorf("purge of an unknown distro status = %d, want 404", status)
+	}
+	if got := fetchXCache(t, srv, scopeTestUbuntu); got != "HIT" {
+		t.Errorf("ubuntu after a rejected purge: X-Cache = %q, want HIT", got)
+	}
+}
+
+const poolTestIndex = "/ubuntu/dists/noble/InRelease"
+
+// newPoolTestServer serves Ubuntu from an upstream answering every path
+// with 1000 bytes.
+func newPoolTestServer(t *testing.T, cache config.CacheConfig) *Server {
+	t.Helper()
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("x", 1000))
+	}), func(cfg *config.Config) { cfg.Cache = cache })
+	t.Cleanup(func() { _ = srv.cache.Close() })
+	return srv
+}
+
+// fillWithPackages fetches enough packages to exceed a 4000-byte pool.
+func fillWithPackages(t *testing.T, srv *Server) {
+	t.Helper()
+	for i := 0; i < 8; i++ {
+		fetchXCache(t, srv, fmt.Sprintf("/ubuntu/pool/main/h/hello/hello_2.%d_amd64.deb", i))
+	}
+}
+
+func TestIndexPoolKeepsIndexesWhenPackagesFill(t *testing.T) {
+	srv := newPoolTestServer(t, config.CacheConfig{MaxSize: 4000, IndexMaxSize: 1 << 20})
+	if got := fetchXCache(t, srv, poolTestIndex); got != "MISS" {
+		t.Fatalf("first GET X-Cache = %q, want MISS", got)
+	}
+	fillWithPackages(t, srv)
+	if got := fetchXCache(t, srv, poolTestIndex); got != "HIT" {
+		t.Errorf("index after filling the package pool: X-Cache = %q, want HIT", got)
+	}
+
+	resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/api/cache/stats", nil))
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	defer resp.Body.Close()
+	var stats api.CacheStatsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(stats.Pools) != 2 {
+		t.Fatalf("pools = %+v, want index and package", stats.Pools)
+	}
+	index, pkg := stats.Pools[0], stats.Pools[1]
+	if index.Name != "index" || index.ItemCount != 1 || index.MaxSizeBytes != 1<<20 || index.HitCount != 1 {
+		t.Errorf("index pool = %+v, want 1 item, 1 hit and a 1 MiB limit", index)
+	}
+	if pkg.Name != "package" || pkg.MaxSizeBytes != 4000 || pkg.TotalSizeBytes > 4000 || pkg.ItemCount == 0 {
+		t.Errorf("package pool = %+v, want packages within a 4000-byte limit", pkg)
+	}
+
+	status, out := postScoped(t, srv, "/api/cache/purge", `{"distros":["ubuntu"]}`)
+	if status != http.StatusOK {
+		t.Fatalf("scoped purge status = %d (%v), want 200", status, out)
+	}
+	if got := fetchXCache(t, srv, poolTestIndex); got != "MISS" {
+		t.Errorf("index after purging ubuntu: X-Cache = %q, want MISS", got)
+	}
+}
+
+func TestSharedPoolEvictsIndexesWhenPackagesFill(t *testing.T) {
+	srv := newPoolTestServer(t, config.CacheConfig{MaxSize: 4000})
+	fetchXCache(t, srv, poolTestIndex)
+	fillWithPackages(t, srv)
+	if got := fetchXCache(t, srv, poolTestIndex); got != "MISS" {
+		t.Errorf("index after filling a shared cache: X-Cache = %q, want MISS (evicted)", got)
+	}
+}
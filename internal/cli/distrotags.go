@@ -0,0 +1,197 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+)
+
+// distroTagsFile is the name of the distroTags index inside cache.dir.
+const distroTagsFile = "distro-tags"
+
+// distroTags records which distribution stored each key of the shared
+// cache, so that a purge can be limited to some distributions. The index
+// is kept in memory and appended to a file of "id\tkey" lines, the last
+// line for a key winning; it is compacted when opened and whenever keys
+// are taken out of it.
+type distroTags struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	keys map[string]string // cache key -> distribution ID
+}
+
+// openDistroTags loads the index at path, creating it if needed.
+func openDistroTags(path string) (*distroTags, error) {
+	t := &distroTags{path: path, keys: make(map[string]string)}
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		for scanner.Scan() {
+			if id, key, ok := strings.Cut(scanner.Text(), "\t"); ok && id != "" && key != "" {
+				t.keys[key] = id
+			}
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	if err := t.rewrite(); err != nil {
+		// A read-only cache directory (cache.allow_read_only) stores
+		// nothing new to tag: keep the index as read, without a file.
+		if !isReadOnlyErr(err) {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// rewrite replaces the file with one line per key and reopens it for
+// appending. t.mu must be held (or t not yet shared).
+func (t *distroTags) rewrite() error {
+	if t.file != nil {
+		_ = t.file.Close()
+		t.file = nil
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), filepath.Base(t.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	w := bufio.NewWriter(tmp)
+	for key, id := range t.keys {
+		_, _ = fmt.Fprintf(w, "%s\t%s\n", id, key)
+	}
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), t.path); err != nil {
+		return err
+	}
+	t.file, err = os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// add tags keys as stored by distribution id.
+func (t *distroTags) add(id string, keys ...string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var lines strings.Builder
+	for _, key := range keys {
+		if t.keys[key] == id || strings.Contains(key, "\n") {
+			continue
+		}
+		t.keys[key] = id
+		fmt.Fprintf(&lines, "%s\t%s\n", id, key)
+	}
+	if lines.Len() == 0 || t.file == nil {
+		return nil
+	}
+	_, err := t.file.WriteString(lines.String())
+	return err
+}
+
+// take removes the keys of the given distribution IDs from the index and
+// returns them.
+func (t *distroTags) take(ids map[string]bool) ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var keys []string
+	for key, id := range t.keys {
+		if ids[id] {
+			keys = append(keys, key)
+			delete(t.keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return keys, t.rewrite()
+}
+
+// clear empties the index, after the whole cache was purged.
+func (t *distroTags) clear() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys = make(map[string]string)
+	return t.rewrite()
+}
+
+// Close closes the index file.
+func (t *distroTags) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// taggingStore is the shared cache as seen by one distribution's handler
+// chain: every key it stores is tagged with the distribution's ID.
+type taggingStore struct {
+	httpcache.ExtendedCache
+
+	id   string
+	tags *distroTags
+	log  *logger.Logger
+}
+
+// Store stores res and tags keys. A failure to record the tag is only
+// logged: the object is cached, it just cannot be purged by distribution.
+// On a read-only cache directory nothing was stored and readOnlyGuard has
+// already warned, so that failure is dropped silently.
+func (c *taggingStore) Store(res *httpcache.Resource, keys ...string) error {
+	if err := c.ExtendedCache.Store(res, keys...); err != nil {
+		return err
+	}
+	if err := c.tags.add(c.id, keys...); err != nil && !isReadOnlyErr(err) {
+		c.log.Warn().Err(err).Str("distro", c.id).Msg("failed to record the distribution of a cached object")
+	}
+	return nil
+}
+
+// cacheObjectPaths returns the paths of the body and header files the
+// httpcache-kit VFS store keeps for key.
+func cacheObjectPaths(key string) (body, header string) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	hashed := fmt.Sprintf("%x", h.Sum(nil))
+	return "body/v1/" + hashed, "header/v1/" + hashed
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+)
+
+func TestDistroTagsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), distroTagsFile)
+	tags, err := openDistroTags(path)
+	if err != nil {
+		t.Fatalf("openDistroTags() error = %v", err)
+	}
+	for _, err := range []error{
+		tags.add("ubuntu", "GET http://mirror/ubuntu/a.deb"),
+		tags.add("alpine", "GET http://mirror/alpine/b.apk", "GET http://mirror/alpine/c.apk"),
+		tags.add("ubuntu", "GET http://mirror/alpine/c.apk"), // re-stored: last one wins
+	} {
+		if err != nil {
+			t.Fatalf("add() error = %v", err)
+		}
+	}
+	if err := tags.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	tags, err = openDistroTags(path)
+	if err != nil {
+		t.Fatalf("reopen error = %v", err)
+	}
+	keys, err := tags.take(map[string]bool{"alpine": true})
+	if err != nil {
+		t.Fatalf("take() error = %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "GET http://mirror/alpine/b.apk" {
+		t.Errorf("take(alpine) = %v, want only b.apk", keys)
+	}
+	_ = tags.Close()
+
+	tags, err = openDistroTags(path)
+	if err != nil {
+		t.Fatalf("reopen error = %v", err)
+	}
+	defer func() { _ = tags.Close() }()
+	if keys, _ := tags.take(map[string]bool{"alpine": true}); len(keys) != 0 {
+		t.Errorf("alpine keys after take() and reopen = %v, want none", keys)
+	}
+	keys, _ = tags.take(map[string]bool{"ubuntu": true})
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "GET http://mirror/alpine/c.apk" {
+		t.Errorf("ubuntu keys = %v, want a.deb and c.apk", keys)
+	}
+}
+
+func TestTaggingStoreRemovesOnlyTaggedObjects(t *testing.T) {
+	dir := t.TempDir()
+	shared, err := httpcache.NewDiskCacheWithConfig(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := openDistroTags(filepath.Join(dir, distroTagsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alpine := &taggingStore{ExtendedCache: shared, id: "alpine", tags: tags, log: logger.Default()}
+	ubuntu := &taggingStore{ExtendedCache: shared, id: "ubuntu", tags: tags, log: logger.Default()}
+	storeTestResource(t, alpine, "GET /alpine/b.apk")
+	storeTestResource(t, ubuntu, "GET /ubuntu/a.deb")
+	defer func() { _ = shared.Close() }()
+
+	defer func() { _ = tags.Close() }()
+	files, err := diskCacheFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := tags.take(map[string]bool{"alpine": true})
+	for _, key := range keys {
+		removed, size, err := removeCacheObject(files, key)
+		if err != nil || !removed || size == 0 {
+			t.Errorf("removeCacheObject(%q) = %v, %d, %v; want the object removed", key, removed, size, err)
+		}
+	}
+	if cached(shared, "GET /alpine/b.apk") {
+		t.Error("alpine object still cached")
+	}
+	if !cached(shared, "GET /ubuntu/a.deb") {
+		t.Error("ubuntu object removed too")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+)
+
+// headFromCache answers HEAD requests for objects whose GET response is
+// cached and fresh from the stored headers alone. apt issues HEAD to check
+// sizes before downloading; the cache handler would only serve those from
+// entries with an explicit expiry, and otherwise asks the mirror. Anything
+// it cannot answer this way (conditional or range requests, stale, Vary or
+// unsized entries) is passed to next.
+type headFromCache struct {
+	cache httpcache.Cache
+	next  http.Handler
+}
+
+func newHeadFromCache(cache httpcache.Cache, next http.Handler) *headFromCache {
+	return &headFromCache{cache: cache, next: next}
+}
+
+func (h *headFromCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodHead || !plainHead(r) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	// Retrieve only opens the body; it is closed unread.
+	res, err := h.cache.Retrieve(httpcache.NewRequestKey(r).ForMethod(http.MethodGet).String())
+	if err != nil {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	defer func() { _ = res.Close() }()
+	age, fresh := cachedFreshness(res)
+	if !fresh || res.Status() != http.StatusOK || res.Header().Get("Vary") != "" || res.Header().Get("Content-Length") == "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	for key, values := range res.Header() {
+		for _, v := range values {
+			w.Header().Add(key, v)
+		}
+	}
+	w.Header().Set("Age", strconv.FormatFloat(math.Floor(age.Seconds()), 'f', 0, 64))
+	w.Header().Set("Via", res.Via())
+	w.Header().Set(httpcache.CacheHeader, "HIT")
+	httpcache.GetDefaultMetrics().RecordCacheHit(r.Method)
+	w.WriteHeader(http.StatusOK)
+}
+
+// plainHead reports whether r carries none of the headers that make the
+// answer depend on more than the stored metadata.
+func plainHead(r *http.Request) bool {
+	for _, name := range []string{"Cache-Control", "Pragma", "Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"} {
+		if r.Header.Get(name) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// cachedFreshness returns the age of res and whether it is still fresh,
+// with the cache handler's rules: the explicit max-age or Expires, else
+// the Last-Modified heuristic.
+func cachedFreshness(res *httpcache.Resource) (time.Duration, bool) {
+	if res.IsStale() || res.MustValidate(false) {
+		return 0, false
+	}
+	age, err := res.Age()
+	if err != nil {
+		return 0, false
+	}
+	maxAge, err := res.MaxAge(false)
+	if err != nil {
+		return 0, false
+	}
+	if heuristic := res.HeuristicFreshness(); heuristic > maxAge {
+		maxAge = heuristic
+	}
+	return age, age < maxAge
+}
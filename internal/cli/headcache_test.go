@@ -0,0 +1,133 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+)
+
+// countingBackend serves a fixed body with validators but no explicit
+// expiry, so cached copies are only fresh by the Last-Modified heuristic.
+func countingBackend() (http.Handler, *atomic.Int32) {
+	var hits atomic.Int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Last-Modified", time.Now().Add(-240*time.Hour).UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", "12")
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			_, _ = io.WriteString(w, "package-body")
+		}
+	}), &hits
+}
+
+func TestHeadFromCacheAnswersFromMetadata(t *testing.T) {
+	backend, hits := countingBackend()
+	cache := httpcache.NewMemoryCacheWithConfig(nil)
+	h := newHeadFromCache(cache, httpcache.NewHandler(cache, backend))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://mirror.test/pool/a.deb", nil))
+	httpcache.Writes.Wait()
+	if rec.Code != http.StatusOK || hits.Load() != 1 {
+		t.Fatalf("GET status = %d, upstream hits = %d; want 200 from 1 fetch", rec.Code, hits.Load())
+	}
+	before := cache.Stats().HitCount
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "http://mirror.test/pool/a.deb", nil))
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("HEAD for a cached object reached the backend (%d upstream hits)", n)
+	}
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("HEAD status = %d, body = %q; want 200 with no body", rec.Code, rec.Body.String())
+	}
+	for name, want := range map[string]string{"Content-Length": "12", "ETag": `"v1"`, httpcache.CacheHeader: "HIT"} {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if rec.Header().Get("Last-Modified") == "" {
+		t.Error("Last-Modified missing from HEAD answered from cache")
+	}
+	if got := cache.Stats().HitCount; got != before+1 {
+		t.Errorf("cache hits = %d, want %d", got, before+1)
+	}
+}
+
+func TestHeadFromCachePassesThroughWhenNotServable(t *testing.T) {
+	backend, hits := countingBackend()
+	cache := httpcache.NewMemoryCacheWithConfig(nil)
+	h := newHeadFromCache(cache, httpcache.NewHandler(cache, backend))
+
+	// Not cached yet.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodHead, "http://mirror.test/pool/b.deb", nil))
+	httpcache.Writes.Wait()
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("uncached HEAD upstream hits = %d, want 1", n)
+	}
+
+	// Cached but expired.
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(http.TimeFormat)
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("package-body"), http.Header{
+		"Content-Length": {"12"}, "Cache-Control": {"max-age=60"}, "Date": {old},
+	})
+	key := httpcache.NewRequestKey(httptest.NewRequest(http.MethodGet, "http://mirror.test/pool/c.deb", nil))
+	if err := cache.Store(res, key.String()); err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodHead, "http://mirror.test/pool/c.deb", nil))
+	httpcache.Writes.Wait()
+	if n := hits.Load(); n == 1 {
+		t.Error("HEAD for a stale entry was answered without asking the backend")
+	}
+}
+
+// TestHeadAfterGetServedFromCache checks the wiring in NewServer: once a
+// package has been downloaded, apt's HEAD for it never reaches the mirror.
+func TestHeadAfterGetServedFromCache(t *testing.T) {
+	backend, hits := countingBackend()
+	srv := newUpstreamTestServer(t, backend)
+
+	const path = "/ubuntu/pool/main/a/a_1.0.deb"
+	resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, path, nil), 5000)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	httpcache.Writes.Wait()
+
+	resp, err = srv.app.Test(httptest.NewRequest(http.MethodHead, path, nil), 5000)
+	if err != nil {
+		t.Fatalf("HEAD: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(httpcache.CacheHeader) != "HIT" || resp.Header.Get("Content-Length") != "12" {
+		t.Errorf("HEAD status = %d, X-Cache = %q, Content-Length = %q; want 200 HIT 12",
+			resp.StatusCode, resp.Header.Get(httpcache.CacheHeader), resp.Header.Get("Content-Length"))
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("upstream hits = %d, want only the GET", n)
+	}
+}
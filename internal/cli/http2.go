@@ -0,0 +1,274 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	logger "github.com/soulteary/logger-kit"
+	middleware "github.com/soulteary/middleware-kit"
+	version "github.com/soulteary/version-kit"
+
+	"github.com/soulteary/apt-proxy/internal/proxy"
+)
+
+// usesHTTP2 reports whether the listener should be served by net/http
+// instead of Fiber directly. Fiber v2 runs on fasthttp, which only speaks
+// HTTP/1.1 (its TLS listener does not even advertise h2 via ALPN), so any
+// HTTP/2 support has to come from the standard library server.
+func (s *Server) usesHTTP2() bool {
+	return s.config.TLS.Enabled || s.config.H2C
+}
+
+// newHTTPServer builds the net/http front end used when TLS or h2c is
+// enabled, serving http2Handler with HTTP/1.1 always on and HTTP/2
+// negotiated via ALPN over TLS, or accepted in cleartext when H2C is set.
+func (s *Server) newHTTPServer() *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	if s.config.TLS.Enabled {
+		protocols.SetHTTP2(true)
+	} else if s.config.H2C {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return &http.Server{
+		Addr:         s.config.Listen,
+		Handler:      s.http2Handler(),
+		ReadTimeout:  defaultReadTimeout,
+		WriteTimeout: defaultWriteTimeout,
+		IdleTimeout:  defaultIdleTimeout,
+		// Same limit as Fiber's read buffer on the plain listener.
+		MaxHeaderBytes: s.maxHeaderBytes(),
+		// Same floor as Fiber's ListenTLS.
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+		Protocols: protocols,
+	}
+}
+
+// http2Handler routes the net/http front end. Proxied requests run the
+// net/http proxy chain directly, so package bodies reach the socket (and
+// the bandwidth limiter) as they are written. Only the routes the Fiber
+// app registers besides its catch-all go through the adaptor, which holds
+// a whole response in memory before sending it.
+func (s *Server) http2Handler() http.Handler {
+	fiberRoutes := adaptor.FiberApp(s.app)
+	owned := fiberOwnedPaths(s.app)
+	direct := s.withStdMiddleware(headerSnapshot(s.proxyChain()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if owned.match(r.URL.Path) {
+			fiberRoutes(w, r)
+			return
+		}
+		direct.ServeHTTP(w, r)
+	})
+}
+
+// headerSnapshot hands next a writer whose Header returns the header map
+// the net/http response had when the request arrived. The cache handler
+// writes the response from a goroutine of its own while its own
+// goroutine keeps setting X-Cache, and net/http's Header is not safe to
+// call from two goroutines once the status has been written: it records
+// a snapshot of the map on first use after WriteHeader. Headers set after
+// WriteHeader are not sent either way.
+func headerSnapshot(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&snapshotHeaderWriter{ResponseWriter: w, header: w.Header()}, r)
+	})
+}
+
+// snapshotHeaderWriter is an http.ResponseWriter with a fixed Header map,
+// see headerSnapshot.
+type snapshotHeaderWriter struct {
+	http.ResponseWriter
+	header http.Header
+}
+
+func (w *snapshotHeaderWriter) Header() http.Header {
+	return w.header
+}
+
+// Flush forwards to the underlying writer when it supports flushing.
+func (w *snapshotHeaderWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *snapshotHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withStdMiddleware wraps next in the net/http equivalents of the
+// middleware newFiberApp installs, in the same order.
+func (s *Server) withStdMiddleware(next http.Handler) http.Handler {
+	h := s.rejectLongURLsStd(next)
+	h = s.accessLogStd(h)
+	if s.config.IdleTimeoutExit > 0 {
+		h = s.idle.wrap(h, healthProbePaths(s.config.HealthPrefix))
+	}
+	h = middleware.SecurityHeadersStd(middleware.DefaultSecurityHeadersConfig())(h)
+	return version.Middleware(s.versionInfo, "X-")(h)
+}
+
+// rejectLongURLsStd is rejectLongURLs for the net/http front end.
+func (s *Server) rejectLongURLsStd(next http.Handler) http.Handler {
+	limit := s.maxURLLength()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > limit {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusRequestURITooLong)
+			_, _ = io.WriteString(w, "Request-URI Too Long")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessLogStd is newFiberApp's request logging for the net/http front
+// end, with the same extra fields. logger-kit logs the body size itself.
+func (s *Server) accessLogStd(next http.Handler) http.Handler {
+	logCfg, accessCfg := s.accessLogConfig()
+	logCfg.CustomFields = func(r *http.Request) map[string]interface{} {
+		fields := map[string]interface{}{
+			"client_ip": s.clientIP.ClientIP(r),
+		}
+		if rec := accessRecorderFrom(r.Context()); rec != nil {
+			fields["cache"] = cacheLabelFromHeader(rec.cache)
+			if rec.upstreamIP != "" {
+				fields["upstream_ip"] = rec.upstreamIP
+			}
+		}
+		return fields
+	}
+	var logged http.Handler
+	if rate := s.config.Log.SampleRate; rate > 1 {
+		logged = newSampledAccessLogStd(logCfg, accessCfg, rate)(next)
+	} else {
+		logged = logger.Middleware(logCfg)(next)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &accessRecorder{ResponseWriter: w, keepUpstreamIP: s.config.Proxy.UpstreamIPHeader}
+		logged.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessRecorderKey{}, rec)))
+	})
+}
+
+type accessRecorderKey struct{}
+
+// accessRecorder notes what the access log needs from a response as its
+// header goes out: once written, net/http's header can no longer be read
+// back or changed the way takeUpstreamIP does on the Fiber side.
+type accessRecorder struct {
+	http.ResponseWriter
+	keepUpstreamIP bool
+
+	wroteHeader bool
+	status      int
+	cache       string
+	upstreamIP  string
+}
+
+// accessRecorderFrom returns the request's accessRecorder, or nil.
+func accessRecorderFrom(ctx context.Context) *accessRecorder {
+	rec, _ := ctx.Value(accessRecorderKey{}).(*accessRecorder)
+	return rec
+}
+
+func (w *accessRecorder) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = code
+		h := w.Header()
+		w.cache = h.Get("X-Cache")
+		w.upstreamIP = h.Get(proxy.UpstreamIPHeader)
+		if !w.keepUpstreamIP {
+			h.Del(proxy.UpstreamIPHeader)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessRecorder) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush forwards to the underlying writer when it supports flushing.
+func (w *accessRecorder) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *accessRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// fiberPaths is the set of paths a Fiber app answers itself, matched the
+// way Fiber does by default: case-insensitively, ignoring a trailing
+// slash, with a trailing "/*" matching the path and everything below it.
+type fiberPaths struct {
+	exact    map[string]struct{}
+	prefixes []string
+}
+
+// fiberOwnedPaths collects the paths of app's routes other than its "/*"
+// catch-all. Routes with parameters are not supported.
+func fiberOwnedPaths(app *fiber.App) fiberPaths {
+	owned := fiberPaths{exact: make(map[string]struct{})}
+	for _, route := range app.GetRoutes(true) {
+		if route.Path == "/*" {
+			continue
+		}
+		if base, ok := strings.CutSuffix(route.Path, "/*"); ok {
+			owned.prefixes = append(owned.prefixes, strings.ToLower(base)+"/")
+			owned.exact[strings.ToLower(base)] = struct{}{}
+			continue
+		}
+		owned.exact[normalizeFiberPath(route.Path)] = struct{}{}
+	}
+	return owned
+}
+
+func (f fiberPaths) match(path string) bool {
+	path = normalizeFiberPath(path)
+	if _, ok := f.exact[path]; ok {
+		return true
+	}
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeFiberPath(path string) string {
+	path = strings.ToLower(path)
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return path
+}
@@ -0,0 +1,181 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+	"github.com/soulteary/apt-proxy/internal/proxy"
+)
+
+// debBodyUpstream is a mirror serving a fixed package body.
+var debBodyUpstream = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.WriteString(w, "deb-body")
+})
+
+// newHTTP2TestServer builds a Server on upstream with mutate applied and
+// returns it along with a loopback listener for its net/http front end.
+func newHTTP2TestServer(t *testing.T, upstream http.Handler, mutate func(*config.Config)) (*Server, net.Listener) {
+	t.Helper()
+	srv := newUpstreamTestServer(t, upstream, mutate)
+	if !srv.usesHTTP2() {
+		t.Fatal("usesHTTP2() = false, want true")
+	}
+	srv.httpServer = srv.newHTTPServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.httpServer.Close() })
+	return srv, ln
+}
+
+func fetchPackage(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+	resp, err := client.Get(url + "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb")
+	if err != nil {
+		t.Fatalf("GET through proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 {
+		t.Errorf("response proto = %s, want HTTP/2", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "deb-body" {
+		t.Errorf("status=%d body=%q, want 200 %q", resp.StatusCode, body, "deb-body")
+	}
+}
+
+func TestHTTP2CleartextClientFetchesThroughProxy(t *testing.T) {
+	srv, ln := newHTTP2TestServer(t, debBodyUpstream, func(cfg *config.Config) { cfg.H2C = true })
+	go func() { _ = srv.httpServer.Serve(ln) }()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	fetchPackage(t, client, "http://"+ln.Addr().String())
+}
+
+func TestHTTP2OverTLSClientFetchesThroughProxy(t *testing.T) {
+	// Borrow httptest's self-signed certificate instead of shipping one.
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := certSrv.TLS.Certificates[0]
+	certSrv.Close()
+
+	srv, ln := newHTTP2TestServer(t, debBodyUpstream, func(cfg *config.Config) { cfg.TLS.Enabled = true })
+	srv.httpServer.TLSConfig.Certificates = []tls.Certificate{cert}
+	go func() { _ = srv.httpServer.ServeTLS(ln, "", "") }()
+
+	client := &http.Client{Transport: &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // self-signed test cert
+	}}
+	fetchPackage(t, client, "https://"+ln.Addr().String())
+}
+
+func TestUsesHTTP2DefaultsToFiber(t *testing.T) {
+	srv := &Server{config: &config.Config{}}
+	if srv.usesHTTP2() {
+		t.Error("plain HTTP without h2c should keep Fiber's own listener")
+	}
+}
+
+// TestHTTP2StreamsProxiedBody checks that a package body reaches an h2c
+// client while the upstream is still sending it, instead of being
+// buffered whole by the Fiber adaptor first.
+func TestHTTP2StreamsProxiedBody(t *testing.T) {
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("a", 64*1024))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		_, _ = io.WriteString(w, "end")
+	})
+
+	srv, ln := newHTTP2TestServer(t, upstream, func(cfg *config.Config) { cfg.H2C = true })
+	go func() { _ = srv.httpServer.Serve(ln) }()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	first, done := make(chan error, 1), make(chan error, 1)
+	go func() {
+		resp, err := client.Get("http://" + ln.Addr().String() + "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb")
+		if err != nil {
+			first <- err
+			return
+		}
+		defer resp.Body.Close()
+		if resp.Header.Get("X-Content-Type-Options") == "" {
+			t.Error("proxied response lost the security headers")
+		}
+		if ip := resp.Header.Get(proxy.UpstreamIPHeader); ip != "" {
+			t.Errorf("%s = %q leaked without proxy.upstream_ip_header", proxy.UpstreamIPHeader, ip)
+		}
+		_, err = io.ReadFull(resp.Body, make([]byte, 1024))
+		first <- err
+		_, err = io.Copy(io.Discard, resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-first:
+		if err != nil {
+			t.Fatalf("read first bytes: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no body bytes before the upstream finished; the response was buffered")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("read rest of body: %v", err)
+	}
+}
+
+func TestFiberOwnedPaths(t *testing.T) {
+	app := fiber.New()
+	handler := func(c *fiber.Ctx) error { return nil }
+	app.Get("/", handler)
+	app.Get("/healthz", handler)
+	app.All("/_/ping/*", handler)
+	app.All("/*", handler)
+	owned := fiberOwnedPaths(app)
+
+	for path, want := range map[string]bool{
+		"/":                             true,
+		"/healthz":                      true,
+		"/HealthZ/":                     true,
+		"/_/ping":                       true,
+		"/_/ping/deep/path":             true,
+		"/healthzx":                     false,
+		"/ubuntu/dists/jammy/InRelease": false,
+	} {
+		if got := owned.match(path); got != want {
+			t.Errorf("match(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
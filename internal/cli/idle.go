@@ -0,0 +1,113 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// healthProbes are the orchestrator probes, served under
+// server.health_prefix.
+var healthProbes = []string{"/healthz", "/livez", "/readyz"}
+
+// healthProbePaths returns the health probe paths under prefix, which are
+// left out of the access log and of idle tracking.
+func healthProbePaths(prefix string) []string {
+	paths := make([]string, len(healthProbes))
+	for i, p := range healthProbes {
+		paths[i] = prefix + p
+	}
+	return paths
+}
+
+// idleTracker records when the server last finished a request and how many
+// are in flight, for server.idle_timeout_exit_sec. A long download counts
+// as activity until it completes.
+type idleTracker struct {
+	active atomic.Int32
+	last   atomic.Int64 // UnixNano of the last completed request
+}
+
+// middleware counts every request except the health probes at probes,
+// which an orchestrator keeps sending to an otherwise idle server.
+func (t *idleTracker) middleware(probes []string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if slices.Contains(probes, c.Path()) {
+			return c.Next()
+		}
+		defer t.track()()
+		return c.Next()
+	}
+}
+
+// wrap is middleware for the net/http front end.
+func (t *idleTracker) wrap(next http.Handler, probes []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(probes, r.URL.Path) {
+			defer t.track()()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// track counts a request as in flight until the returned func is called.
+func (t *idleTracker) track() func() {
+	t.active.Add(1)
+	return func() {
+		t.last.Store(time.Now().UnixNano())
+		t.active.Add(-1)
+	}
+}
+
+// idleFor reports how long no request has been in flight as of now.
+func (t *idleTracker) idleFor(now time.Time) time.Duration {
+	if t.active.Load() > 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, t.last.Load()))
+}
+
+// expired returns a channel that is closed once the server has been idle
+// for timeout, counted from this call, or nil (never ready) when timeout
+// is not positive. The watcher stops with ctx.
+func (t *idleTracker) expired(ctx context.Context, timeout time.Duration) <-chan struct{} {
+	if timeout <= 0 {
+		return nil
+	}
+	t.last.Store(time.Now().UnixNano())
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(min(timeout/4, time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if t.idleFor(now) >= timeout {
+					close(done)
+					return
+				}
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+)
+
+func TestIdleTrackerCountsRequests(t *testing.T) {
+	var tr idleTracker
+	tr.last.Store(time.Now().Add(-time.Hour).UnixNano())
+	app := fiber.New()
+	app.Use(tr.middleware(healthProbePaths("")))
+	var during time.Duration
+	app.Get("/ubuntu/dists/noble/InRelease", func(c *fiber.Ctx) error {
+		during = tr.idleFor(time.Now())
+		return c.SendString("ok")
+	})
+	app.Get("/healthz", func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	if _, err := app.Test(httptest.NewRequest(http.MethodGet, "/healthz", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.idleFor(time.Now()); got < time.Hour {
+		t.Errorf("idle for %s after a health probe, want the probe ignored", got)
+	}
+
+	if _, err := app.Test(httptest.NewRequest(http.MethodGet, "/ubuntu/dists/noble/InRelease", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if during != 0 {
+		t.Errorf("idle for %s while a request was in flight, want 0", during)
+	}
+	if got := tr.idleFor(time.Now()); got > time.Minute {
+		t.Errorf("idle for %s right after a request, want the clock reset", got)
+	}
+}
+
+// TestServerExitsWhenIdle starts a server that never receives a request
+// and checks Start returns cleanly once server.idle_timeout_exit_sec passes.
+func TestServerExitsWhenIdle(t *testing.T) {
+	srv, err := NewServer(withTestMirrors(&config.Config{
+		CacheDir:        t.TempDir(),
+		Listen:          "127.0.0.1:0",
+		IdleTimeoutExit: 200 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Start() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Start() = %v, want a clean idle shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still running 5s after a 200ms idle timeout")
+	}
+}
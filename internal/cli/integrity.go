@@ -0,0 +1,72 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+)
+
+// integrityCheck wraps a cache store so that an object whose stored body
+// is shorter or longer than its stored Content-Length, as disk corruption
+// or an interrupted write can leave it, is never served: Retrieve reports
+// it as not cached, so the cache handler fetches it again and overwrites
+// it. Each such object is counted in corrupt and logged.
+type integrityCheck struct {
+	httpcache.ExtendedCache
+
+	corrupt prometheus.Counter
+	log     *logger.Logger
+}
+
+func newIntegrityCheck(cache httpcache.ExtendedCache, corrupt prometheus.Counter, log *logger.Logger) *integrityCheck {
+	return &integrityCheck{ExtendedCache: cache, corrupt: corrupt, log: log}
+}
+
+// Retrieve returns httpcache.ErrNotFoundInCache for a stored object whose
+// body length does not match its Content-Length. Objects stored without a
+// Content-Length (chunked upstream responses) are not checked.
+func (c *integrityCheck) Retrieve(key string) (*httpcache.Resource, error) {
+	res, err := c.ExtendedCache.Retrieve(key)
+	if err != nil {
+		return res, err
+	}
+	want, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64)
+	if err != nil {
+		return res, nil
+	}
+	size, err := res.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = res.Seek(0, io.SeekStart)
+	}
+	if err == nil && size == want {
+		return res, nil
+	}
+	_ = res.Close()
+
+	c.corrupt.Inc()
+	event := c.log.Warn().Str("key", key).Int64("content_length", want)
+	if err != nil {
+		event = event.Err(err)
+	} else {
+		event = event.Int64("body_bytes", size)
+	}
+	event.Msg("cached body does not match its Content-Length, fetching it again")
+	return nil, httpcache.ErrNotFoundInCache
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+)
+
+func TestTruncatedCacheBodyIsFetchedAgain(t *testing.T) {
+	const pkg = "package contents, long enough to be cut short"
+	var fetches atomic.Int32
+	cacheDir := t.TempDir()
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		_, _ = io.WriteString(w, pkg)
+	}), func(cfg *config.Config) { cfg.CacheDir = cacheDir })
+	get := func() (*http.Response, string) {
+		t.Helper()
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb", nil), 10000)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		httpcache.Writes.Wait()
+		return resp, string(body)
+	}
+
+	get()
+	var bodies []string
+	_ = filepath.WalkDir(filepath.Join(cacheDir, "body"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			bodies = append(bodies, path)
+		}
+		return nil
+	})
+	if len(bodies) != 1 {
+		t.Fatalf("found %d cached bodies, want 1", len(bodies))
+	}
+	if err := os.Truncate(bodies[0], 10); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := get()
+	if body != pkg || resp.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("after truncation: X-Cache %q, body %q; want a MISS with the full body", resp.Header.Get("X-Cache"), body)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("upstream fetched %d times, want 2", n)
+	}
+	if resp, body := get(); body != pkg || resp.Header.Get("X-Cache") != "HIT" {
+		t.Errorf("after re-fetch: X-Cache %q, body %q; want a HIT with the full body", resp.Header.Get("X-Cache"), body)
+	}
+
+	resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/metrics", nil), 10000)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	metrics, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(metrics), "apt_proxy_cache_corruption_total 1\n") {
+		t.Errorf("/metrics does not report one corrupted object:\n%s", metrics)
+	}
+	if !strings.Contains(string(metrics), "apt_proxy_inflight_upstream_requests 0\n") {
+		t.Errorf("/metrics does not report no upstream requests in flight once served:\n%s", metrics)
+	}
+}
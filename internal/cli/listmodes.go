@@ -0,0 +1,102 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"sort"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+	"github.com/soulteary/apt-proxy/internal/distro"
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+)
+
+// ListModesCommand is the subcommand name for ListModes.
+const ListModesCommand = "--list-modes"
+
+// ModeInfo describes one entry of the --list-modes output.
+type ModeInfo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	MirrorCount int    `json:"mirror_count"`
+	// Builtin is true for the values --mode accepts. Distributions from
+	// the distributions config are served only in mode "all".
+	Builtin bool `json:"builtin"`
+}
+
+// ListModes backs "apt-proxy --list-modes": it writes the modes --mode
+// accepts, then the distributions registered by the distributions config
+// cfg points at, to w as a JSON array and returns without starting the
+// server. MirrorCount is the number of built-in or configured candidate
+// mirrors; "all" counts those of every distribution.
+func ListModes(cfg *config.Config, w io.Writer) error {
+	if cfg == nil {
+		return apperrors.New(apperrors.ErrConfigInvalid, "config cannot be nil")
+	}
+	reg := distro.NewBuiltinRegistry()
+	if cfg.DistributionsConfigPath != "" {
+		if err := reg.Reload(cfg.DistributionsConfigPath); err != nil {
+			return wrapErr(apperrors.ErrConfigInvalid, "failed to load distributions config", err)
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(listModes(reg)); err != nil {
+		return apperrors.Wrap(apperrors.ErrInternal, "failed to write the mode list", err)
+	}
+	return nil
+}
+
+// listModes returns the allowed modes in their usual order, followed by
+// the other distributions of reg ordered by type and ID.
+func listModes(reg *distro.Registry) []ModeInfo {
+	all := reg.GetAll()
+	total := 0
+	for _, d := range all {
+		total += len(d.Mirrors)
+	}
+	allowed := config.GetAllowedModes()
+	modes := make([]ModeInfo, 0, len(allowed)+len(all))
+	for _, id := range allowed {
+		if id == distro.DistroAll {
+			modes = append(modes, ModeInfo{ID: id, Name: "All distributions", MirrorCount: total, Builtin: true})
+			continue
+		}
+		info := ModeInfo{ID: id, Name: id, Builtin: true}
+		if d, ok := all[id]; ok {
+			info.Name, info.MirrorCount = d.Name, len(d.Mirrors)
+		}
+		modes = append(modes, info)
+	}
+
+	var extra []*distro.RegisteredDistribution
+	for id, d := range all {
+		if !slices.Contains(allowed, id) {
+			extra = append(extra, d)
+		}
+	}
+	sort.Slice(extra, func(i, j int) bool {
+		if extra[i].Type != extra[j].Type {
+			return extra[i].Type < extra[j].Type
+		}
+		return extra[i].ID < extra[j].ID
+	})
+	for _, d := range extra {
+		modes = append(modes, ModeInfo{ID: d.ID, Name: d.Name, MirrorCount: len(d.Mirrors)})
+	}
+	return modes
+}
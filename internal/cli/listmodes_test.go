@@ -0,0 +1,80 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+)
+
+func listModesOutput(t *testing.T, cfg *config.Config) []ModeInfo {
+	t.Helper()
+	var out strings.Builder
+	if err := ListModes(cfg, &out); err != nil {
+		t.Fatalf("ListModes() error = %v", err)
+	}
+	var modes []ModeInfo
+	if err := json.Unmarshal([]byte(out.String()), &modes); err != nil {
+		t.Fatalf("output is not a JSON array of modes: %v\n%s", err, out.String())
+	}
+	return modes
+}
+
+func TestListModesIncludesBuiltinModes(t *testing.T) {
+	modes := listModesOutput(t, &config.Config{})
+	allowed := config.GetAllowedModes()
+	if len(modes) != len(allowed) {
+		t.Fatalf("got %d modes, want the %d allowed modes: %+v", len(modes), len(allowed), modes)
+	}
+	for i, id := range allowed {
+		m := modes[i]
+		if m.ID != id || !m.Builtin || m.Name == "" || m.MirrorCount == 0 {
+			t.Errorf("modes[%d] = %+v, want built-in mode %q with a name and mirrors", i, m, id)
+		}
+	}
+	if modes[0].MirrorCount < modes[1].MirrorCount+modes[3].MirrorCount {
+		t.Errorf("all counts %d mirrors, want those of every distribution", modes[0].MirrorCount)
+	}
+}
+
+func TestListModesIncludesConfiguredDistributions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "distributions.yaml")
+	if err := os.WriteFile(path, []byte(`distributions:
+  - id: fedora
+    name: Fedora
+    type: 100
+    url_pattern: "/fedora/(.+)$"
+    benchmark_url: "releases/README"
+    mirrors:
+      official:
+        - "https://mirror.example.com/fedora/"
+        - "https://mirror.example.org/fedora/"
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modes := listModesOutput(t, &config.Config{DistributionsConfigPath: path})
+	last := modes[len(modes)-1]
+	if last.ID != "fedora" || last.Name != "Fedora" || last.MirrorCount != 2 || last.Builtin {
+		t.Errorf("last entry = %+v, want the configured fedora distribution with 2 mirrors", last)
+	}
+	if len(modes) != len(config.GetAllowedModes())+1 {
+		t.Errorf("got %d entries, want the allowed modes and fedora", len(modes))
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/apt-proxy/internal/benchmarks"
+	"github.com/soulteary/apt-proxy/internal/config"
+	"github.com/soulteary/apt-proxy/internal/distro"
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+	"github.com/soulteary/apt-proxy/internal/mirrors"
+	"github.com/soulteary/apt-proxy/internal/proxy"
+)
+
+// MirrorsTestCommand is the subcommand name for MirrorsTest.
+const MirrorsTestCommand = "mirrors-test"
+
+// MirrorsTest backs "apt-proxy mirrors-test": it benchmarks every candidate
+// mirror of each distribution cfg.Mode serves, the way the server would
+// choose among them, prints a ranked table to w and returns without
+// starting the server. The distributions config, mirrors.list_file,
+// mirrors.region, mirrors.require_https and dial timeout are honored. It
+// fails when some distribution has no responding mirror.
+func MirrorsTest(cfg *config.Config, w io.Writer) error {
+	if cfg == nil {
+		return apperrors.New(apperrors.ErrConfigInvalid, "config cannot be nil")
+	}
+	// Benchmark progress goes to stderr so stdout holds only the table.
+	level := logger.WarnLevel
+	if cfg.Debug {
+		level = logger.DebugLevel
+	}
+	logger.SetDefault(logger.New(logger.Config{Level: level, Output: os.Stderr, ServiceName: "apt-proxy"}))
+
+	reg := distro.NewBuiltinRegistry()
+	if cfg.DistributionsConfigPath != "" {
+		if err := reg.Reload(cfg.DistributionsConfigPath); err != nil {
+			logger.Default().Warn().
+				Err(err).
+				Str("path", cfg.DistributionsConfigPath).
+				Msg("failed to load distributions config; using built-in defaults")
+		}
+	}
+	src, err := newMirrorSources(cfg)
+	if err != nil {
+		return wrapErr(apperrors.ErrConfigInvalid, "failed to load mirrors.list_file", err)
+	}
+
+	engine := benchmarks.NewEngineWithDialTimeout(cfg.Transport.DialTimeout).WithProbe(benchmarks.Probe(cfg.Benchmark.Probe))
+	if opts := mirrorTLSOptions(cfg.Transport.MirrorTLS); opts != nil {
+		wrap, err := proxy.NewMirrorTLSTransport(opts)
+		if err != nil {
+			return wrapErr(apperrors.ErrConfigInvalid, "invalid transport.mirror_tls", err)
+		}
+		engine.WithRoundTripper(wrap)
+	}
+	if prefixes := cfg.Mirrors.PathPrefixes; len(prefixes) > 0 {
+		engine.WithRoundTripper(func(next http.RoundTripper) http.RoundTripper {
+			return proxy.NewMirrorPathTransport(next, prefixes)
+		})
+	}
+	return writeMirrorRanking(w, reg, src, proxy.ServedModes(cfg.Mode), cfg.Mirrors.Region, cfg.Mirrors.RequireHTTPS, engine)
+}
+
+// writeMirrorRanking benchmarks the candidates src lists for each mode and
+// writes one row per mirror: responding mirrors ranked by latency, then
+// failures. With requireHTTPS, http candidates are left out.
+func writeMirrorRanking(w io.Writer, reg *distro.Registry, src *mirrors.Sources, modes []int, region string, requireHTTPS bool, engine *benchmarks.Engine) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DISTRO\tRANK\tMIRROR\tLATENCY\tSTATUS")
+	var unreachable []string
+	for _, m := range modes {
+		name := distro.DistributionName(m)
+		benchmarkURL, _ := mirrors.GetPredefinedConfiguration(reg, m)
+		candidates := src.MirrorUrlsByMode(reg, m)
+		if requireHTTPS {
+			candidates = mirrors.HTTPSOnly(candidates)
+			if len(candidates) == 0 {
+				fmt.Fprintf(tw, "%s\t-\t-\t-\terror: no https mirror (mirrors.require_https)\n", name)
+			}
+		}
+		preferred, rest := mirrors.SplitByRegion(candidates, region)
+		answered := 0
+		for i, r := range engine.RankMirrors(append(preferred, rest...), benchmarkURL) {
+			if r.Err != nil {
+				fmt.Fprintf(tw, "%s\t-\t%s\t-\terror: %v\n", name, r.URL, r.Err)
+				continue
+			}
+			answered++
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%.1fms\tok\n", name, i+1, r.URL, float64(r.Duration.Microseconds())/1000)
+		}
+		if answered == 0 {
+			unreachable = append(unreachable, name)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(unreachable) > 0 {
+		return apperrors.New(apperrors.ErrMirrorUnreachable, "no mirror responded for "+strings.Join(unreachable, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/benchmarks"
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// debianMirrorRegistry returns the built-in registry with Debian's
+// candidates replaced by the given base URLs.
+func debianMirrorRegistry(t *testing.T, candidates ...string) *distro.Registry {
+	t.Helper()
+	reg := distro.NewBuiltinRegistry()
+	deb, _ := reg.GetByID("debian")
+	local := *deb
+	local.Mirrors = nil
+	for _, c := range candidates {
+		local.Mirrors = append(local.Mirrors, distro.URLWithAlias{URL: c, Scheme: "http"})
+	}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func newDelayedMirror(t *testing.T, delay time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		_, _ = w.Write([]byte("Release"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWriteMirrorRanking(t *testing.T) {
+	fast := newDelayedMirror(t, 0)
+	slow := newDelayedMirror(t, 50*time.Millisecond)
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	reg := debianMirrorRegistry(t, dead.URL+"/debian/", slow.URL+"/debian/", fast.URL+"/debian/")
+	var out bytes.Buffer
+	err := writeMirrorRanking(&out, reg, nil, []int{distro.TypeDebian}, "", false, benchmarks.NewEngineWithDialTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("writeMirrorRanking() error = %v\n%s", err, out.String())
+	}
+
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want header + 3 mirrors:\n%s", len(lines), out.String())
+	}
+	if got := strings.Fields(lines[0]); strings.Join(got, " ") != "DISTRO RANK MIRROR LATENCY STATUS" {
+		t.Errorf("header = %q", lines[0])
+	}
+	want := []struct{ rank, mirror, status string }{
+		{"1", fast.URL + "/debian/", "ok"},
+		{"2", slow.URL + "/debian/", "ok"},
+		{"-", dead.URL + "/debian/", "error:"},
+	}
+	for i, w := range want {
+		f := strings.Fields(lines[i+1])
+		if len(f) < 5 || f[0] != "debian" || f[1] != w.rank || f[2] != w.mirror || f[4] != w.status {
+			t.Errorf("row %d = %q, want debian %s %s ... %s", i+1, lines[i+1], w.rank, w.mirror, w.status)
+			continue
+		}
+		if w.status == "ok" && !strings.HasSuffix(f[3], "ms") {
+			t.Errorf("row %d latency = %q, want milliseconds", i+1, f[3])
+		}
+		if w.status != "ok" && f[3] != "-" {
+			t.Errorf("row %d latency = %q, want - for a failed mirror", i+1, f[3])
+		}
+	}
+}
+
+func TestWriteMirrorRankingFailsWhenNoMirrorResponds(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	reg := debianMirrorRegistry(t, dead.URL+"/debian/")
+	var out bytes.Buffer
+	err := writeMirrorRanking(&out, reg, nil, []int{distro.TypeDebian}, "", false, benchmarks.NewEngineWithDialTimeout(time.Second))
+	if err == nil || !strings.Contains(err.Error(), "debian") {
+		t.Fatalf("writeMirrorRanking() error = %v, want one naming debian", err)
+	}
+	if !strings.Contains(out.String(), dead.URL+"/debian/") {
+		t.Errorf("failed mirror missing from output:\n%s", out.String())
+	}
+}
+
+func TestWriteMirrorRankingRequireHTTPS(t *testing.T) {
+	fast := newDelayedMirror(t, 0)
+
+	reg := debianMirrorRegistry(t, fast.URL+"/debian/")
+	var out bytes.Buffer
+	err := writeMirrorRanking(&out, reg, nil, []int{distro.TypeDebian}, "", true, benchmarks.NewEngineWithDialTimeout(time.Second))
+	if err == nil || !strings.Contains(err.Error(), "debian") {
+		t.Fatalf("writeMirrorRanking() error = %v, want one naming debian", err)
+	}
+	if strings.Contains(out.String(), fast.URL) || !strings.Contains(out.String(), "no https mirror") {
+		t.Errorf("http mirror ranked despite require_https:\n%s", out.String())
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+)
+
+// pipelineRequests is what one apt update plus install sends on a single
+// connection: index files, a HEAD, a miss for a package that does not
+// exist, and repeats that are served from the cache.
+var pipelineRequests = []struct {
+	method, path string
+	status       int
+	body         string
+}{
+	{http.MethodGet, "/ubuntu/dists/noble/InRelease", http.StatusOK, "index:/ubuntu/dists/noble/InRelease"},
+	{http.MethodHead, "/ubuntu/dists/noble/InRelease", http.StatusOK, ""},
+	{http.MethodGet, "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb", http.StatusOK, "package:/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb"},
+	{http.MethodGet, "/ubuntu/pool/main/m/missing/missing_1.0_amd64.deb", http.StatusNotFound, ""},
+	{http.MethodGet, "/ubuntu/dists/noble/InRelease", http.StatusOK, "index:/ubuntu/dists/noble/InRelease"},
+	{http.MethodGet, "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb", http.StatusOK, "package:/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb"},
+}
+
+// startPipelineServer serves an Ubuntu mirror through the Server on a
+// loopback listener, using the Fiber front end or, with h2c, the net/http
+// one, and returns the listener address.
+func startPipelineServer(t *testing.T, h2c bool) string {
+	t.Helper()
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/missing/"):
+			http.NotFound(w, r)
+		case strings.Contains(r.URL.Path, "/pool/"):
+			_, _ = io.WriteString(w, "package:"+r.URL.Path)
+		default:
+			_, _ = io.WriteString(w, "index:"+r.URL.Path)
+		}
+	}), func(cfg *config.Config) { cfg.H2C = h2c })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2c {
+		srv.httpServer = srv.newHTTPServer()
+		go func() { _ = srv.httpServer.Serve(ln) }()
+		t.Cleanup(func() { _ = srv.httpServer.Close() })
+	} else {
+		go func() { _ = srv.app.Listener(ln) }()
+		t.Cleanup(func() { _ = srv.app.Shutdown() })
+	}
+	return ln.Addr().String()
+}
+
+// readPipelineResponse reads the response to the i-th pipelineRequests
+// entry from br and checks it.
+func readPipelineResponse(t *testing.T, br *bufio.Reader, i int) {
+	t.Helper()
+	want := pipelineRequests[i]
+	req, _ := http.NewRequest(want.method, want.path, nil)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("request %d (%s %s): reading response: %v", i, want.method, want.path, err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("request %d (%s %s): reading body: %v", i, want.method, want.path, err)
+	}
+	if resp.StatusCode != want.status {
+		t.Errorf("request %d (%s %s): status = %d, want %d", i, want.method, want.path, resp.StatusCode, want.status)
+	}
+	if want.status == http.StatusOK && string(body) != want.body {
+		t.Errorf("request %d (%s %s): body = %q, want %q", i, want.method, want.path, body, want.body)
+	}
+}
+
+// writePipelineRequest writes the i-th pipelineRequests entry to buf; the
+// last one asks the server to close the connection, as apt does when it
+// runs out of work.
+func writePipelineRequest(buf *bytes.Buffer, i int) {
+	r := pipelineRequests[i]
+	buf.WriteString(r.method + " " + r.path + " HTTP/1.1\r\nHost: archive.ubuntu.com\r\nUser-Agent: Debian APT-HTTP/1.3 (2.7.14)\r\n")
+	if i == len(pipelineRequests)-1 {
+		buf.WriteString("Connection: close\r\n")
+	}
+	buf.WriteString("\r\n")
+}
+
+// TestPipelineDepth replays one connection's worth of apt traffic with
+// Acquire::http::Pipeline-Depth 0 (one request at a time over a kept-alive
+// connection) and with a deep pipeline (every request written before any
+// response is read). Both must get every response, in order, with intact
+// framing, whichever front end serves the connection.
+func TestPipelineDepth(t *testing.T) {
+	for _, front := range []struct {
+		name string
+		h2c  bool
+	}{{"fiber", false}, {"net/http", true}} {
+		t.Run(front.name, func(t *testing.T) {
+			t.Run("depth 0", func(t *testing.T) {
+				conn, err := net.DialTimeout("tcp", startPipelineServer(t, front.h2c), time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+				br := bufio.NewReader(conn)
+				for i := range pipelineRequests {
+					var buf bytes.Buffer
+					writePipelineRequest(&buf, i)
+					if _, err := conn.Write(buf.Bytes()); err != nil {
+						t.Fatalf("request %d: write: %v", i, err)
+					}
+					readPipelineResponse(t, br, i)
+				}
+			})
+			t.Run("pipelined", func(t *testing.T) {
+				conn, err := net.DialTimeout("tcp", startPipelineServer(t, front.h2c), time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+				var buf bytes.Buffer
+				for i := range pipelineRequests {
+					writePipelineRequest(&buf, i)
+				}
+				if _, err := conn.Write(buf.Bytes()); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				br := bufio.NewReader(conn)
+				for i := range pipelineRequests {
+					readPipelineResponse(t, br, i)
+				}
+				if n, _ := br.Read(make([]byte, 1)); n != 0 {
+					t.Error("data after the last response on a Connection: close request")
+				}
+			})
+		})
+	}
+}
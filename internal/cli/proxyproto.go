@@ -0,0 +1,182 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a new connection may take to send
+// its PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature opens every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLen is the longest v1 header the spec allows, CRLF included.
+const proxyV1MaxLen = 107
+
+// proxyProtoListener decodes the PROXY protocol (v1 text or v2 binary)
+// header an L4 load balancer sends at the start of each connection, so
+// RemoteAddr reports the real client instead of the balancer. Every
+// connection must carry a header; one without it fails on first use.
+type proxyProtoListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func newProxyProtoListener(ln net.Listener, timeout time.Duration) net.Listener {
+	return &proxyProtoListener{Listener: ln, timeout: timeout}
+}
+
+// Accept returns the connection at once; the header is read on the first
+// Read or RemoteAddr call, in the connection's own goroutine, so a slow
+// client cannot stall the accept loop.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: c, r: bufio.NewReader(c), timeout: l.timeout}, nil
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr // client address from the header; nil keeps Conn's
+	err    error
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) readHeader() {
+	if c.timeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer func() { _ = c.Conn.SetReadDeadline(time.Time{}) }()
+	}
+	c.remote, c.err = readProxyHeader(c.r)
+	if c.err != nil {
+		c.err = fmt.Errorf("proxy protocol from %s: %w", c.Conn.RemoteAddr(), c.err)
+	}
+}
+
+// readProxyHeader consumes a v1 or v2 header from r and returns the source
+// address it carries, or nil for headers that carry none (v1 UNKNOWN, v2
+// LOCAL health checks, non-IP families).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long or not CRLF-terminated")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL: sent by the balancer itself, keep the real peer
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", hdr[12]&0x0f)
+	}
+	// Address family in the high nibble; any transport is accepted.
+	switch hdr[13] >> 4 {
+	case 0x1: // AF_INET: src, dst, src port, dst port
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// proxyV2Header builds a v2 header for cmd (0 LOCAL, 1 PROXY) carrying an
+// IPv4 TCP source and destination.
+func proxyV2Header(cmd byte, src, dst string, sport, dport uint16) []byte {
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, 0x20|cmd, 0x11, 0, 12)
+	h = append(h, net.ParseIP(src).To4()...)
+	h = append(h, net.ParseIP(dst).To4()...)
+	h = binary.BigEndian.AppendUint16(h, sport)
+	return binary.BigEndian.AppendUint16(h, dport)
+}
+
+// acceptWith dials a proxy-protocol listener, writes payload and returns
+// the server side of the connection.
+func acceptWith(t *testing.T, payload []byte) net.Conn {
+	t.Helper()
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newProxyProtoListener(raw, time.Second)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	client, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	if _, err := client.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestProxyProtoListenerRecoversClientAddr(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   string // empty: the balancer's own address is kept
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 3142\r\n"), "203.0.113.7:56324"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 40000 3142\r\n"), "[2001:db8::7]:40000"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 proxy", proxyV2Header(1, "198.51.100.9", "10.0.0.1", 41000, 3142), "198.51.100.9:41000"},
+		{"v2 local", proxyV2Header(0, "0.0.0.0", "0.0.0.0", 0, 0), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := acceptWith(t, append(tt.header, "GET / HTTP/1.1\r\n"...))
+			want := tt.want
+			if want == "" {
+				want = conn.(*proxyProtoConn).Conn.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != want {
+				t.Errorf("RemoteAddr() = %s, want %s", got, want)
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || line != "GET / HTTP/1.1\r\n" {
+				t.Errorf("payload after header = %q, %v; want the request line", line, err)
+			}
+		})
+	}
+}
+
+func TestProxyProtoListenerRejectsMissingHeader(t *testing.T) {
+	for _, payload := range []string{
+		"GET / HTTP/1.1\r\nHost: apt-proxy\r\n\r\n",
+		"PROXY TCP4 not-an-ip 10.0.0.1 1 2\r\nGET / HTTP/1.1\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 56324 3142" + strings.Repeat(" ", 80) + "\r\n",
+	} {
+		conn := acceptWith(t, []byte(payload))
+		if _, err := conn.Read(make([]byte, 16)); err == nil {
+			t.Errorf("Read() after %q succeeded, want a PROXY protocol error", payload)
+		}
+	}
+}
+
+// TestProxyProtocolSetsRequestRemoteAddr serves a Fiber app over the
+// listener, as Start does with server.proxy_protocol, and checks net/http
+// handlers behind the adaptor see the client from the PROXY header.
+func TestProxyProtocolSetsRequestRemoteAddr(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/", adaptor.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.RemoteAddr)
+	})))
+	go func() { _ = app.Listener(newProxyProtoListener(raw, time.Second)) }()
+	defer func() { _ = app.Shutdown() }()
+
+	conn, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 56324 3142\r\nGET / HTTP/1.1\r\nHost: apt-proxy\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("ReadResponse: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "203.0.113.7:56324" {
+		t.Errorf("r.RemoteAddr = %q, want 203.0.113.7:56324", body)
+	}
+}
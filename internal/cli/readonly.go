@@ -0,0 +1,140 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+)
+
+// readOnlyProbeInterval is how often a cache directory found read-only
+// is probed to see whether it can be written to again.
+const readOnlyProbeInterval = time.Minute
+
+// readOnlyGuard wraps a disk store so that a cache directory that cannot
+// be written to, typically a filesystem remounted read-only after a disk
+// error, puts the store in pass-through mode instead of failing and
+// logging every store: responses are still proxied, and objects already
+// cached still served, but nothing new is written. The store switches on
+// the first write failing with EROFS or a permission error, or at startup
+// with cache.allow_read_only (startup fails otherwise, see
+// Server.requireWritableCache). While read-only it is probed every
+// readOnlyProbeInterval, and caching resumes once a write succeeds.
+type readOnlyGuard struct {
+	httpcache.ExtendedCache
+
+	dir   string
+	probe func(dir string) error
+	log   *logger.Logger
+
+	readOnly  atomic.Bool
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newReadOnlyGuard(cache httpcache.ExtendedCache, dir string, log *logger.Logger) *readOnlyGuard {
+	return &readOnlyGuard{
+		ExtendedCache: cache,
+		dir:           dir,
+		probe:         probeWritable,
+		log:           log,
+		stop:          make(chan struct{}),
+	}
+}
+
+// Store drops the write while the directory is read-only, and switches
+// to pass-through when a write fails because it has become so.
+func (g *readOnlyGuard) Store(res *httpcache.Resource, keys ...string) error {
+	if g.readOnly.Load() {
+		return nil
+	}
+	err := g.ExtendedCache.Store(res, keys...)
+	if err != nil && isReadOnlyErr(err) {
+		g.enter(err)
+		return nil
+	}
+	return err
+}
+
+// Close stops the periodic probe and closes the wrapped cache.
+func (g *readOnlyGuard) Close() error {
+	g.closeOnce.Do(func() { close(g.stop) })
+	return g.ExtendedCache.Close()
+}
+
+// run probes the directory every interval until Close.
+func (g *readOnlyGuard) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if g.readOnly.Load() {
+				g.check()
+			}
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// check enters or leaves pass-through mode according to whether a file
+// can be created in the directory.
+func (g *readOnlyGuard) check() {
+	err := g.probe(g.dir)
+	if err == nil {
+		if g.readOnly.CompareAndSwap(true, false) {
+			g.log.Info().Str("dir", g.dir).Msg("cache directory is writable again, caching resumed")
+		}
+		return
+	}
+	if isReadOnlyErr(err) {
+		g.enter(err)
+		return
+	}
+	g.log.Warn().Err(err).Str("dir", g.dir).Msg("cannot probe whether the cache directory is writable")
+}
+
+// enter switches to pass-through mode, logging the switch once.
+func (g *readOnlyGuard) enter(err error) {
+	if g.readOnly.CompareAndSwap(false, true) {
+		g.log.Warn().Err(err).Str("dir", g.dir).Msg("cache directory is read-only, proxying without caching")
+	}
+}
+
+// isReadOnlyErr reports whether err means the cache cannot be written to
+// at all, rather than that one write failed.
+func isReadOnlyErr(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, fs.ErrPermission)
+}
+
+// probeWritable creates and removes a file in dir.
+func probeWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".write-probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_ = f.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,255 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/apt-proxy/internal/api"
+	"github.com/soulteary/apt-proxy/internal/config"
+	"github.com/soulteary/apt-proxy/internal/distro"
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+)
+
+// readOnlyStore fails every store the way the disk cache does on a
+// filesystem remounted read-only, while failing is set.
+type readOnlyStore struct {
+	httpcache.ExtendedCache
+	failing atomic.Bool
+	stores  atomic.Int32
+}
+
+func (c *readOnlyStore) Store(res *httpcache.Resource, keys ...string) error {
+	c.stores.Add(1)
+	if c.failing.Load() {
+		return fmt.Errorf("failed to store body for key %q: %w", keys[0], &fs.PathError{Op: "open", Path: "/var/cache/apt-proxy/body/x", Err: syscall.EROFS})
+	}
+	return c.ExtendedCache.Store(res, keys...)
+}
+
+// warnings counts the warning lines in a JSON log.
+func warnings(log *bytes.Buffer) int {
+	return strings.Count(log.String(), `"level":"warn"`)
+}
+
+func TestReadOnlyGuardPassesThroughOnWriteFailure(t *testing.T) {
+	var out bytes.Buffer
+	store := &readOnlyStore{ExtendedCache: httpcache.NewMemoryCacheWithConfig(nil)}
+	g := newReadOnlyGuard(store, "/var/cache/apt-proxy", logger.New(logger.Config{Level: logger.InfoLevel, Output: &out, Format: logger.FormatJSON}))
+	g.probe = func(string) error { return nil }
+	defer func() { _ = g.Close() }()
+
+	store.failing.Store(true)
+	for _, key := range []string{"GET /debian/pool/a.deb", "GET /debian/pool/b.deb", "GET /debian/pool/c.deb"} {
+		storeTestResource(t, g, key)
+	}
+	if !g.readOnly.Load() {
+		t.Fatal("guard not read-only after a store failed with EROFS")
+	}
+	if n := store.stores.Load(); n != 1 {
+		t.Errorf("%d stores reached the disk, want only the first", n)
+	}
+	if n := warnings(&out); n != 1 {
+		t.Errorf("%d warnings logged, want a single one; log:\n%s", n, out.String())
+	}
+
+	// The filesystem is remounted read-write: the next probe resumes caching.
+	store.failing.Store(false)
+	g.check()
+	storeTestResource(t, g, "GET /debian/pool/d.deb")
+	if !cached(g, "GET /debian/pool/d.deb") {
+		t.Error("object not stored after the directory became writable again")
+	}
+}
+
+func TestReadOnlyGuardKeepsOtherStoreErrors(t *testing.T) {
+	g := newReadOnlyGuard(failingStore{httpcache.NewMemoryCacheWithConfig(nil)}, "/var/cache/apt-proxy", logger.Default())
+	defer func() { _ = g.Close() }()
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("deb-body"), http.Header{"Content-Length": {"8"}})
+	if err := g.Store(res, "GET /debian/pool/a.deb"); err == nil {
+		t.Error("Store() hid an error unrelated to a read-only directory")
+	}
+	if g.readOnly.Load() {
+		t.Error("guard read-only after an unrelated store error")
+	}
+}
+
+// failingStore fails every store with an error unrelated to permissions.
+type failingStore struct{ httpcache.ExtendedCache }
+
+func (failingStore) Store(*httpcache.Resource, ...string) error { return io.ErrUnexpectedEOF }
+
+func TestReadOnlyGuardDetectsReadOnlyDirAtStartup(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to a read-only directory")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chmod(dir, 0o755) }()
+
+	g := newReadOnlyGuard(httpcache.NewMemoryCacheWithConfig(nil), dir, logger.Default())
+	defer func() { _ = g.Close() }()
+	g.check()
+	if !g.readOnly.Load() {
+		t.Fatal("read-only cache directory not detected")
+	}
+	storeTestResource(t, g, "GET /debian/pool/a.deb")
+	if cached(g, "GET /debian/pool/a.deb") {
+		t.Error("object stored while the directory is read-only")
+	}
+}
+
+// TestReadOnlyCacheDirProxiesAndReportsDegraded starts a server whose
+// cache directory probes read-only, and checks that packages are still
+// proxied, that the warning is logged once, and that /readyz and
+// /api/health report the degraded state until the directory recovers.
+func TestReadOnlyCacheDirProxiesAndReportsDegraded(t *testing.T) {
+	var fetches atomic.Int32
+	srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = io.WriteString(w, "deb-body")
+	}), func(cfg *config.Config) { cfg.Mode = distro.TypeDebian })
+	var out bytes.Buffer
+	srv.logConfig.Output = &out
+	srv.logConfig.Format = logger.FormatJSON
+	srv.log = logger.New(srv.logConfig)
+	guard := srv.readOnlyGuards[0]
+	guard.log = srv.log
+	guard.probe = func(dir string) error { return &fs.PathError{Op: "open", Path: dir, Err: syscall.EROFS} }
+	guard.check()
+
+	get := func(path string) (int, []byte) {
+		t.Helper()
+		resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, path, nil), 10000)
+		if err != nil {
+			t.Fatalf("app.Test(%s) error: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		httpcache.Writes.Wait()
+		return resp.StatusCode, body
+	}
+	for i := 0; i < 2; i++ {
+		if code, body := get("/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"); code != http.StatusOK || string(body) != "deb-body" {
+			t.Fatalf("request %d = %d %q, want the package", i+1, code, body)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("mirror asked %d times, want 2 with caching off", n)
+	}
+	if n := warnings(&out); n != 1 {
+		t.Errorf("%d warnings logged, want a single one; log:\n%s", n, out.String())
+	}
+
+	code, body := get("/readyz")
+	if code != http.StatusOK || !strings.Contains(string(body), `"degraded"`) || !strings.Contains(string(body), "cache_writable") {
+		t.Errorf("/readyz = %d %s, want 200 degraded with cache_writable", code, body)
+	}
+	code, body = get("/api/health")
+	var health api.HealthResponse
+	if err := json.Unmarshal(body, &health); err != nil {
+		t.Fatalf("decode /api/health: %v; body=%s", err, body)
+	}
+	if code != http.StatusOK || health.Status != "degraded" {
+		t.Errorf("/api/health = %d %s, want 200 degraded", code, health.Status)
+	}
+
+	guard.probe = func(string) error { return nil }
+	guard.check()
+	if _, body := get("/readyz"); !strings.Contains(string(body), `"status":"ok"`) {
+		t.Errorf("/readyz after recovery = %s, want ok", body)
+	}
+}
+
+func TestStartupFailsOnUnwritableCacheDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to a read-only directory")
+	}
+	for _, allow := range []bool{false, true} {
+		dir := t.TempDir()
+		if err := os.Chmod(dir, 0o555); err != nil {
+			t.Fatal(err)
+		}
+		srv, err := NewServer(withTestMirrors(&config.Config{
+			CacheDir: dir,
+			Mode:     distro.TypeDebian,
+			Listen:   "127.0.0.1:0",
+			Cache:    config.CacheConfig{AllowReadOnly: allow},
+		}))
+		_ = os.Chmod(dir, 0o755)
+		if !allow {
+			if !apperrors.Is(err, apperrors.ErrCacheDirAccess) {
+				t.Errorf("NewServer() error = %v, want %s", err, apperrors.ErrCacheDirAccess)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("NewServer() with cache.allow_read_only error = %v", err)
+		}
+		if !srv.readOnlyGuards[0].readOnly.Load() {
+			t.Error("cache.allow_read_only server not in pass-through mode")
+		}
+		_ = srv.cache.Close()
+	}
+}
+
+// TestRequireWritableCache runs the startup check against a cache
+// directory probing read-only, whoever the tests run as.
+func TestRequireWritableCache(t *testing.T) {
+	srv, err := NewServer(withTestMirrors(&config.Config{
+		CacheDir: t.TempDir(),
+		Mode:     distro.TypeDebian,
+		Listen:   "127.0.0.1:0",
+	}))
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	defer func() { _ = srv.cache.Close() }()
+	if err := srv.requireWritableCache(); err != nil {
+		t.Fatalf("requireWritableCache() on a writable directory = %v", err)
+	}
+
+	srv.readOnlyGuards[0].probe = func(dir string) error { return &fs.PathError{Op: "open", Path: dir, Err: syscall.EACCES} }
+	err = srv.requireWritableCache()
+	if !apperrors.Is(err, apperrors.ErrCacheDirAccess) {
+		t.Errorf("requireWritableCache() = %v, want %s", err, apperrors.ErrCacheDirAccess)
+	}
+	if err == nil || !strings.Contains(err.Error(), srv.config.CacheDir) {
+		t.Errorf("error %v does not name the directory", err)
+	}
+
+	srv.config.Cache.AllowReadOnly = true
+	if err := srv.requireWritableCache(); err != nil {
+		t.Errorf("requireWritableCache() with cache.allow_read_only = %v, want nil", err)
+	}
+}
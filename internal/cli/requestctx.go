@@ -0,0 +1,189 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// streamLengthHeader carries a proxied response's Content-Length past the
+// fiber adaptor, see proxyHandler. It never reaches the client.
+const streamLengthHeader = "X-Apt-Proxy-Stream-Length"
+
+// proxyHandler serves next, the proxy chain, on the Fiber app. Once next
+// flushes (the bandwidth limiter does before every pause) the fasthttp
+// adaptor streams the body instead of buffering it, and drops the
+// Content-Length, which would leave clients with a chunked body of
+// unknown size and the access log without a size. The length is
+// carried to the Fiber side in streamLengthHeader and restored there.
+func proxyHandler(next http.Handler) fiber.Handler {
+	h := adaptor.HTTPHandler(detachRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&streamLengthWriter{ResponseWriter: w}, r)
+	})))
+	return func(c *fiber.Ctx) error {
+		err := h(c)
+		header := &c.Response().Header
+		if v := header.Peek(streamLengthHeader); len(v) > 0 {
+			n, perr := strconv.Atoi(string(v))
+			header.Del(streamLengthHeader)
+			if perr == nil && n >= 0 && c.Response().IsBodyStream() {
+				header.SetContentLength(n)
+				// Send the headers at once: a fixed-length stream is
+				// otherwise held in the write buffer behind them.
+				c.Response().ImmediateHeaderFlush = true
+			}
+		}
+		return err
+	}
+}
+
+// streamLengthWriter copies the response's Content-Length to
+// streamLengthHeader when the header is written.
+type streamLengthWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *streamLengthWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if cl := w.Header().Get("Content-Length"); cl != "" {
+			w.Header().Set(streamLengthHeader, cl)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamLengthWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush forwards to the underlying writer when it supports flushing.
+func (w *streamLengthWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *streamLengthWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// detachRequest hands next a copy of the request sharing no memory with
+// the fasthttp *RequestCtx the fiber adaptor builds it from, which
+// fasthttp reuses for the next request on the connection once the
+// handler has returned. Work on behalf of the request can outlive the
+// handler: the cache handler stores responses in the background, keyed
+// by the request URL, and net/http's Transport cancels the context of an
+// upstream request from its read loop, walking the parent contexts'
+// values as it does. The adaptor's strings point into fasthttp's buffers
+// and its context is the *RequestCtx itself, so the copy gets its own
+// strings, and a context carrying only the server's shutdown signal.
+func detachRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := r.Clone(shutdownContext{done: r.Context().Done()})
+		d.Method = strings.Clone(r.Method)
+		d.Proto = strings.Clone(r.Proto)
+		d.Host = strings.Clone(r.Host)
+		d.RequestURI = strings.Clone(r.RequestURI)
+		d.URL = cloneURL(r.URL)
+		d.Header = make(http.Header, len(r.Header))
+		for name, values := range r.Header {
+			copied := make([]string, len(values))
+			for i, v := range values {
+				copied[i] = strings.Clone(v)
+			}
+			d.Header[strings.Clone(name)] = copied
+		}
+		next.ServeHTTP(w, d)
+	})
+}
+
+// cloneURL returns a copy of u with its own strings.
+func cloneURL(u *url.URL) *url.URL {
+	c := *u
+	c.Scheme = strings.Clone(u.Scheme)
+	c.Opaque = strings.Clone(u.Opaque)
+	c.Host = strings.Clone(u.Host)
+	c.Path = strings.Clone(u.Path)
+	c.RawPath = strings.Clone(u.RawPath)
+	c.RawQuery = strings.Clone(u.RawQuery)
+	c.Fragment = strings.Clone(u.Fragment)
+	c.RawFragment = strings.Clone(u.RawFragment)
+	if u.User != nil {
+		password, ok := u.User.Password()
+		if ok {
+			c.User = url.UserPassword(strings.Clone(u.User.Username()), strings.Clone(password))
+		} else {
+			c.User = url.User(strings.Clone(u.User.Username()))
+		}
+	}
+	return &c
+}
+
+// shutdownContext is a context canceled when done is closed, with no
+// deadline and no values.
+type shutdownContext struct {
+	done <-chan struct{}
+}
+
+func (shutdownContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (c shutdownContext) Done() <-chan struct{} { return c.done }
+
+func (c shutdownContext) Err() error {
+	select {
+	case <-c.done:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
+
+func (shutdownContext) Value(any) any { return nil }
+
+// abortRecovered runs the cache handler's upstream, which httpcache-kit
+// calls on a goroutine of its own. net/http's ReverseProxy gives up on a
+// response it cannot finish copying (the client went away) by panicking
+// with http.ErrAbortHandler, which only the server's goroutine recovers;
+// on the cache's goroutine it would take the process down, so it is
+// recovered here and the response is left cut short.
+type abortRecovered struct {
+	next http.Handler
+}
+
+func (h abortRecovered) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if v := recover(); v != nil && v != http.ErrAbortHandler { //nolint:errorlint // recover value, compared as net/http does
+			panic(v)
+		}
+	}()
+	h.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type testContextKey struct{}
+
+func TestDetachRequest(t *testing.T) {
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), testContextKey{}, "fasthttp"))
+	r := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/dists/bookworm/InRelease?x=1", nil).WithContext(parent)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	var got *http.Request
+	detachRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	})).ServeHTTP(httptest.NewRecorder(), r)
+
+	shared := func(a, b string) bool { return unsafe.StringData(a) == unsafe.StringData(b) }
+	for name, pair := range map[string][2]string{
+		"method":      {got.Method, r.Method},
+		"host":        {got.Host, r.Host},
+		"request uri": {got.RequestURI, r.RequestURI},
+		"url host":    {got.URL.Host, r.URL.Host},
+		"url path":    {got.URL.Path, r.URL.Path},
+		"url query":   {got.URL.RawQuery, r.URL.RawQuery},
+		"header":      {got.Header.Get("Accept-Encoding"), r.Header.Get("Accept-Encoding")},
+	} {
+		if pair[0] != pair[1] {
+			t.Errorf("%s = %q, want %q", name, pair[0], pair[1])
+		} else if shared(pair[0], pair[1]) {
+			t.Errorf("%s shares memory with the adaptor's request", name)
+		}
+	}
+	if got.URL == r.URL {
+		t.Error("URL is the adaptor's")
+	}
+
+	ctx := got.Context()
+	if v := ctx.Value(testContextKey{}); v != nil {
+		t.Errorf("context value = %v, want none of the parent's", v)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("context canceled early: %v", ctx.Err())
+	}
+	cancel()
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal("context not done once the parent is")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Errorf("Err() = %v, want context.Canceled", ctx.Err())
+	}
+}
+
+// TestProxyHandlerKeepsStreamedContentLength flushes a response with a
+// Content-Length half way, which makes the fiber adaptor stream it, and
+// checks that the client still gets the length, and the first half before
+// the handler has finished.
+func TestProxyHandlerKeepsStreamedContentLength(t *testing.T) {
+	const half = "package"
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.All("/*", proxyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(2*len(half)))
+		_, _ = io.WriteString(w, half)
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		_, _ = io.WriteString(w, half)
+	})))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = app.Listener(ln) }()
+	t.Cleanup(func() { _ = app.Shutdown() })
+
+	start := time.Now()
+	resp, err := http.Get("http://" + ln.Addr().String() + "/debian/pool/a.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, len(half))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != half {
+		t.Fatalf("first half = %q, %v; want %q", first, err, half)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Errorf("first half after %v, want it before the handler finished", d)
+	}
+	if resp.ContentLength != int64(2*len(half)) {
+		t.Errorf("Content-Length = %d, want %d", resp.ContentLength, 2*len(half))
+	}
+	if v := resp.Header.Get(streamLengthHeader); v != "" {
+		t.Errorf("%s = %q leaked to the client", streamLengthHeader, v)
+	}
+	if rest, _ := io.ReadAll(resp.Body); string(rest) != half {
+		t.Errorf("second half = %q, want %q", rest, half)
+	}
+}
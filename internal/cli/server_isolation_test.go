@@ -28,6 +28,9 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 
@@ -54,6 +57,8 @@ func makeIsolationServer(t *testing.T, name, apiKey, mirrorPrefix string) *Serve
 			Debian:      mirrorPrefix + "/debian/",
 			CentOS:      mirrorPrefix + "/centos/",
 			Alpine:      mirrorPrefix + "/alpine/",
+			Gentoo:      mirrorPrefix + "/gentoo/",
+			Arch:        mirrorPrefix + "/archlinux/",
 		},
 		Security: config.SecurityConfig{
 			EnableAPIAuth: apiKey != "",
@@ -119,6 +124,71 @@ func TestTwoServersStateIsolation(t *testing.T) {
 	}
 }
 
+// TestTwoServersGeoLookupIsolation builds two Servers with different
+// mirrors.geo settings and checks each keeps its own geo lookup: the
+// breaker of one must not carry the other's limits.
+func TestTwoServersGeoLookupIsolation(t *testing.T) {
+	newServer := func(threshold int) *Server {
+		cfg := withTestMirrors(&config.Config{CacheDir: t.TempDir(), Mode: distro.TypeDebian, Listen: "127.0.0.1:0"})
+		cfg.Mirrors.Geo.FailureThreshold = threshold
+		srv, err := NewServer(cfg)
+		if err != nil {
+			t.Fatalf("NewServer: %v", err)
+		}
+		t.Cleanup(func() { _ = srv.shutdown() })
+		return srv
+	}
+	srvA, srvB := newServer(2), newServer(7)
+
+	if srvA.mirrorSources.Geo() == srvB.mirrorSources.Geo() {
+		t.Fatal("expected per-Server geo lookups to differ")
+	}
+	if got := srvA.mirrorSources.Geo().BreakerStatus().FailureThreshold; got != 2 {
+		t.Errorf("server A breaker threshold = %d, want its own 2", got)
+	}
+	if got := srvB.mirrorSources.Geo().BreakerStatus().FailureThreshold; got != 7 {
+		t.Errorf("server B breaker threshold = %d, want its own 7", got)
+	}
+}
+
+// TestTwoServersMirrorListIsolation builds two Servers with different
+// mirrors.list_file contents and checks neither replaces the other's list.
+func TestTwoServersMirrorListIsolation(t *testing.T) {
+	newServer := func() (*Server, string) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		t.Cleanup(upstream.Close)
+		mirror := upstream.URL + "/alpine/"
+		listFile := filepath.Join(t.TempDir(), "mirrors.list")
+		if err := os.WriteFile(listFile, []byte("[alpine]\n"+mirror+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		srv, err := NewServer(&config.Config{
+			CacheDir: t.TempDir(),
+			Mode:     distro.TypeAlpine,
+			Listen:   "127.0.0.1:0",
+			Mirrors:  config.MirrorConfig{ListFile: listFile, ListMode: config.MirrorListReplace},
+		})
+		if err != nil {
+			t.Fatalf("NewServer: %v", err)
+		}
+		t.Cleanup(func() { waitMirrorsReady(t, srv) })
+		return srv, mirror
+	}
+	srvA, mirrorA := newServer()
+	waitMirrorsReady(t, srvA)
+	srvB, mirrorB := newServer()
+
+	for name, c := range map[string]struct {
+		srv  *Server
+		want string
+	}{"A": {srvA, mirrorA}, "B": {srvB, mirrorB}} {
+		got := c.srv.mirrorSources.MirrorUrlsByMode(c.srv.registry, distro.TypeAlpine)
+		if len(got) != 1 || got[0] != c.want {
+			t.Errorf("server %s candidates = %v, want only its own %s", name, got, c.want)
+		}
+	}
+}
+
 // TestTwoServersAPIKeyIsolation verifies that a key valid against one
 // server is rejected by the other. A regression here would mean the
 // auth middleware accidentally consulted some shared global key.
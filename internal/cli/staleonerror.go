@@ -0,0 +1,230 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+)
+
+// staleWarning is the RFC 7234 warning attached to stale copies.
+const staleWarning = `110 - "Response is Stale"`
+
+// maxErrorBody bounds how much of an upstream error body is held back
+// while deciding whether to answer with a stale copy instead.
+const maxErrorBody = 64 << 10
+
+// staleOnError implements cache.serve_stale_on_error: when next answers a
+// GET or HEAD with a 5xx, which is what the cache handler passes on when
+// no mirror can be reached, the stored copy is served instead, marked
+// with a Warning header and X-Cache: STALE, provided it is at most
+// maxStale past its expiry (0: any age). Without a usable copy the error
+// goes out unchanged.
+type staleOnError struct {
+	cache    httpcache.Cache
+	next     http.Handler
+	maxStale time.Duration
+	log      *logger.Logger
+}
+
+func newStaleOnError(cache httpcache.Cache, next http.Handler, maxStale time.Duration, log *logger.Logger) *staleOnError {
+	return &staleOnError{cache: cache, next: next, maxStale: maxStale, log: log}
+}
+
+func (h *staleOnError) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Range") != "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	// The cache handler may rewrite r, so the key is taken first.
+	key := httpcache.NewRequestKey(r).ForMethod(http.MethodGet).String()
+	sw := &staleWriter{ResponseWriter: w}
+	h.next.ServeHTTP(sw, r)
+	if !sw.failed {
+		return
+	}
+	if h.serveStale(w, r, key, sw.status) {
+		return
+	}
+	w.WriteHeader(sw.status)
+	_, _ = w.Write(sw.body.Bytes())
+}
+
+// serveStale writes the stored copy under key to w in place of a failed
+// response, reporting whether there was one young enough.
+func (h *staleOnError) serveStale(w http.ResponseWriter, r *http.Request, key string, status int) bool {
+	res, err := h.cache.Retrieve(key)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = res.Close() }()
+	if res.Status() != http.StatusOK {
+		return false
+	}
+	age, err := res.Age()
+	if err != nil {
+		return false
+	}
+	if h.maxStale > 0 {
+		lifetime, err := res.MaxAge(false)
+		if err != nil {
+			return false
+		}
+		if heuristic := res.HeuristicFreshness(); heuristic > lifetime {
+			lifetime = heuristic
+		}
+		if age-lifetime > h.maxStale {
+			return false
+		}
+	}
+
+	header := w.Header()
+	for k := range header {
+		delete(header, k)
+	}
+	for k, values := range res.Header() {
+		header[k] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.FormatFloat(math.Floor(age.Seconds()), 'f', 0, 64))
+	header.Set("Via", res.Via())
+	header.Add("Warning", staleWarning)
+	header.Set(httpcache.CacheHeader, "STALE")
+	h.log.Warn().
+		Str("url", r.URL.String()).
+		Int("upstream_status", status).
+		Dur("age", age).
+		Msg("upstream failed, serving stale cached copy")
+
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = io.Copy(w, res)
+	}
+	return true
+}
+
+// revalidationMarker is the Content-MD5 value failedRevalidation puts on
+// upstream 5xx answers.
+const revalidationMarker = "upstream-error"
+
+// failedRevalidation wraps the upstream of the cache handler so that a 5xx
+// answer never counts as "not modified". httpcache-kit revalidates a stale
+// copy by comparing only the validators the upstream response carries
+// (ETag, Last-Modified, Content-Length, Content-MD5), so an error page
+// without any of them would otherwise refresh the copy and have it served
+// as fresh while every mirror is down. The obsolete Content-MD5 header is
+// set to a value no stored copy has, so the cache goes on to fetch the
+// object and passes the error on; hideRevalidationMarker removes it again
+// before the client sees it.
+type failedRevalidation struct {
+	next http.Handler
+}
+
+func (h failedRevalidation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.next.ServeHTTP(&markerWriter{ResponseWriter: w, mark: true}, r)
+}
+
+// hideRevalidationMarker wraps the cache handler and drops the header
+// failedRevalidation added.
+type hideRevalidationMarker struct {
+	next http.Handler
+}
+
+func (h hideRevalidationMarker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.next.ServeHTTP(&markerWriter{ResponseWriter: w}, r)
+}
+
+// markerWriter sets (mark) or removes the revalidation marker on 5xx
+// responses as their header is written.
+type markerWriter struct {
+	http.ResponseWriter
+	mark bool
+}
+
+func (w *markerWriter) WriteHeader(status int) {
+	if status >= http.StatusInternalServerError {
+		if w.mark {
+			w.Header().Set("Content-MD5", revalidationMarker)
+		} else if w.Header().Get("Content-MD5") == revalidationMarker {
+			w.Header().Del("Content-MD5")
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *markerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// staleWriter holds back a 5xx response, and its body up to maxErrorBody,
+// so staleOnError can still answer with something else. Other responses
+// pass straight through.
+type staleWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	failed      bool
+	status      int
+	body        bytes.Buffer
+}
+
+func (w *staleWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status >= http.StatusInternalServerError {
+		w.failed = true
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *staleWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.failed {
+		if room := maxErrorBody - w.body.Len(); room > 0 {
+			if len(p) < room {
+				room = len(p)
+			}
+			w.body.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush passes through once a response other than a held-back failure
+// has started.
+func (w *staleWriter) Flush() {
+	if !w.wroteHeader || w.failed {
+		return
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *staleWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
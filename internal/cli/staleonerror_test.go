@@ -0,0 +1,132 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+)
+
+const staleTestPath = "/ubuntu/dists/noble/InRelease" // cached for an hour
+
+// newStaleTestServer serves Ubuntu from an upstream that down makes
+// unreachable, and lets the test move the cache's clock forward.
+func newStaleTestServer(t *testing.T, cache config.CacheConfig) (srv *Server, down func(), advance func(time.Duration)) {
+	t.Helper()
+	var unreachable atomic.Bool
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unreachable.Load() {
+			// Drop the connection without a response, like a dead mirror.
+			if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+				_ = conn.Close()
+			}
+			return
+		}
+		_, _ = io.WriteString(w, "index")
+	})
+
+	var offset atomic.Int64
+	clock := httpcache.Clock
+	httpcache.Clock = func() time.Time { return time.Now().UTC().Add(time.Duration(offset.Load())) }
+	t.Cleanup(func() { httpcache.Clock = clock })
+
+	srv = newUpstreamTestServer(t, upstream, func(cfg *config.Config) { cfg.Cache = cache })
+	return srv, func() { unreachable.Store(true) }, func(d time.Duration) { offset.Add(int64(d)) }
+}
+
+func fetchStale(t *testing.T, srv *Server, method string) (*http.Response, string) {
+	t.Helper()
+	resp, err := srv.app.Test(httptest.NewRequest(method, staleTestPath, nil), 30000)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	httpcache.Writes.Wait()
+	return resp, string(body)
+}
+
+func TestServeStaleOnErrorWhenMirrorsDown(t *testing.T) {
+	srv, down, advance := newStaleTestServer(t, config.CacheConfig{ServeStaleOnError: true, MaxStale: 24 * time.Hour})
+	if resp, _ := fetchStale(t, srv, http.MethodGet); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("first request X-Cache = %q, want MISS", resp.Header.Get("X-Cache"))
+	}
+	advance(3 * time.Hour)
+	down()
+
+	resp, body := fetchStale(t, srv, http.MethodGet)
+	if resp.StatusCode != http.StatusOK || body != "index" {
+		t.Fatalf("GET with mirrors down = %d %q, want the stale copy", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Warning"); got != staleWarning {
+		t.Errorf("Warning = %q, want %q", got, staleWarning)
+	}
+	if got := resp.Header.Get("X-Cache"); got != "STALE" {
+		t.Errorf("X-Cache = %q, want STALE", got)
+	}
+	if resp.Header.Get("Age") == "" {
+		t.Error("stale copy has no Age header")
+	}
+
+	resp, body = fetchStale(t, srv, http.MethodHead)
+	if resp.StatusCode != http.StatusOK || body != "" || resp.Header.Get("Warning") != staleWarning {
+		t.Errorf("HEAD with mirrors down = %d %q Warning %q, want 200 with the warning and no body", resp.StatusCode, body, resp.Header.Get("Warning"))
+	}
+}
+
+func TestServeStaleOnErrorRespectsMaxStale(t *testing.T) {
+	srv, down, advance := newStaleTestServer(t, config.CacheConfig{ServeStaleOnError: true, MaxStale: time.Hour})
+	fetchStale(t, srv, http.MethodGet)
+	// Expired after one hour, so three hours in it is two hours stale.
+	advance(3 * time.Hour)
+	down()
+
+	if resp, _ := fetchStale(t, srv, http.MethodGet); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502 for a copy staler than cache.max_stale_hours", resp.StatusCode)
+	}
+}
+
+func TestServeStaleOnErrorDisabled(t *testing.T) {
+	srv, down, advance := newStaleTestServer(t, config.CacheConfig{})
+	fetchStale(t, srv, http.MethodGet)
+	advance(3 * time.Hour)
+	down()
+
+	resp, _ := fetchStale(t, srv, http.MethodGet)
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("Warning") != "" {
+		t.Errorf("status = %d, Warning = %q; want a plain 502 without serve_stale_on_error", resp.StatusCode, resp.Header.Get("Warning"))
+	}
+	if got := resp.Header.Get("Content-MD5"); got != "" {
+		t.Errorf("Content-MD5 = %q, want the revalidation marker removed", got)
+	}
+}
+
+func TestServeStaleOnErrorWithoutCachedCopy(t *testing.T) {
+	srv, down, _ := newStaleTestServer(t, config.CacheConfig{ServeStaleOnError: true})
+	down()
+
+	resp, _ := fetchStale(t, srv, http.MethodGet)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want the upstream error when nothing is cached", resp.StatusCode)
+	}
+}
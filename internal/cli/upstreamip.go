@@ -0,0 +1,39 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/soulteary/apt-proxy/internal/proxy"
+)
+
+// takeUpstreamIP returns the proxy's X-Upstream-IP header for the access
+// log's upstream_ip, dropping it from the response unless
+// proxy.upstream_ip_header is set. It is called by the request logging
+// middleware once the handler has returned; it must not write to the
+// fiber.Ctx locals, which net/http may still be reading through the
+// upstream request's context.
+func (s *Server) takeUpstreamIP(c *fiber.Ctx) (string, bool) {
+	ip := c.Response().Header.Peek(proxy.UpstreamIPHeader)
+	if len(ip) == 0 {
+		return "", false
+	}
+	value := string(ip)
+	if !s.config.Proxy.UpstreamIPHeader {
+		c.Response().Header.Del(proxy.UpstreamIPHeader)
+	}
+	return value, true
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+	"github.com/soulteary/apt-proxy/internal/distro"
+	"github.com/soulteary/apt-proxy/internal/proxy"
+)
+
+// TestAccessLogUpstreamIP checks the access log records the address the
+// mirror was reached at, which clients see only with
+// proxy.upstream_ip_header, and that a cache hit records none.
+func TestAccessLogUpstreamIP(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = io.WriteString(w, "deb")
+	})
+
+	for _, expose := range []bool{false, true} {
+		srv := newUpstreamTestServer(t, upstream, func(cfg *config.Config) {
+			cfg.Mode = distro.TypeDebian
+			cfg.Proxy.UpstreamIPHeader = expose
+		})
+		var out bytes.Buffer
+		srv.logConfig.Output = &out
+		srv.logConfig.Format = logger.FormatJSON
+		srv.log = logger.New(srv.logConfig)
+		srv.app = srv.createFiberApp()
+
+		var headers []string
+		for i := 0; i < 2; i++ {
+			resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/debian/pool/main/h/hello/hello_2.10_amd64.deb", nil), 10000)
+			if err != nil {
+				t.Fatalf("app.Test error: %v", err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			httpcache.Writes.Wait()
+			headers = append(headers, resp.Header.Get(proxy.UpstreamIPHeader))
+		}
+
+		var logged []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var entry struct {
+				Path       string `json:"path"`
+				Cache      string `json:"cache"`
+				UpstreamIP string `json:"upstream_ip"`
+			}
+			if err := json.Unmarshal([]byte(line), &entry); err == nil && entry.Path != "" {
+				logged = append(logged, entry.Cache+" "+entry.UpstreamIP)
+			}
+		}
+		if want := []string{"MISS 127.0.0.1", "HIT "}; strings.Join(logged, ",") != strings.Join(want, ",") {
+			t.Errorf("upstream_ip_header %v: logged %q, want %q; log:\n%s", expose, logged, want, out.String())
+		}
+		wantHeader := ""
+		if expose {
+			wantHeader = "127.0.0.1"
+		}
+		if headers[0] != wantHeader || headers[1] != "" {
+			t.Errorf("upstream_ip_header %v: %s = %q, want %q on the miss and none on the hit", expose, proxy.UpstreamIPHeader, headers, wantHeader)
+		}
+	}
+}
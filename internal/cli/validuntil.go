@@ -0,0 +1,103 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+	logger "github.com/soulteary/logger-kit"
+)
+
+// releaseHeaderLimit bounds how much of a cached Release file is read
+// looking for Valid-Until, which sits in the first, short paragraph.
+const releaseHeaderLimit = 64 << 10
+
+// validUntilCheck wraps a cache store so that a cached Release or
+// InRelease file whose Valid-Until has passed is never served as fresh:
+// Retrieve marks it stale, so the cache handler revalidates it with the
+// mirror whatever its max-age. apt refuses such a file, so serving it
+// from the cache would break apt update until it expired on its own.
+type validUntilCheck struct {
+	httpcache.ExtendedCache
+
+	now func() time.Time
+	log *logger.Logger
+}
+
+func newValidUntilCheck(cache httpcache.ExtendedCache, log *logger.Logger) *validUntilCheck {
+	return &validUntilCheck{ExtendedCache: cache, now: time.Now, log: log}
+}
+
+// Retrieve marks a Release or InRelease file stale once its Valid-Until
+// has passed. Files without the field are left to their max-age.
+func (c *validUntilCheck) Retrieve(key string) (*httpcache.Resource, error) {
+	res, err := c.ExtendedCache.Retrieve(key)
+	if err != nil || !isReleaseKey(key) {
+		return res, err
+	}
+	until, ok := releaseValidUntil(res)
+	if _, err := res.Seek(0, io.SeekStart); err != nil {
+		_ = res.Close()
+		return nil, httpcache.ErrNotFoundInCache
+	}
+	if ok && !c.now().Before(until) {
+		res.MarkStale()
+		c.log.Debug().Str("key", key).Time("valid_until", until).Msg("cached release file has expired, revalidating it")
+	}
+	return res, nil
+}
+
+// isReleaseKey reports whether the cache key is that of a Release or
+// InRelease file. Keys hold the lowercased URL, after the method.
+func isReleaseKey(key string) bool {
+	key, _, _ = strings.Cut(key, "::")
+	key, _, _ = strings.Cut(key, "?")
+	return strings.HasSuffix(key, "/release") || strings.HasSuffix(key, "/inrelease")
+}
+
+// releaseValidUntil returns the Valid-Until field of the Release file r,
+// signed (InRelease) or not. It stops at the checksum lists, which follow
+// the fields apt-proxy looks at.
+func releaseValidUntil(r io.Reader) (time.Time, bool) {
+	scanner := bufio.NewScanner(io.LimitReader(r, releaseHeaderLimit))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || name == "" || name[0] == ' ' || name[0] == '\t' {
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "valid-until":
+			return parseReleaseDate(strings.TrimSpace(value))
+		case "md5sum", "sha1", "sha256", "sha512":
+			return time.Time{}, false
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseReleaseDate parses a Release file date, such as
+// "Sat, 26 Oct 2024 20:19:44 UTC".
+func parseReleaseDate(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC1123, time.RFC1123Z, "Mon, 2 Jan 2006 15:04:05 MST", "Mon, 2 Jan 2006 15:04:05 -0700"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// releaseFile returns a Debian Release file valid until until.
+func releaseFile(until time.Time) string {
+	return "Origin: Debian\n" +
+		"Suite: stable\n" +
+		"Date: " + until.Add(-7*24*time.Hour).UTC().Format(time.RFC1123) + "\n" +
+		"Valid-Until: " + until.UTC().Format(time.RFC1123) + "\n" +
+		"SHA256:\n" +
+		" 0123456789abcdef 1234 main/binary-amd64/Packages\n"
+}
+
+func TestReleaseValidUntil(t *testing.T) {
+	until := time.Date(2024, 10, 26, 20, 19, 44, 0, time.UTC)
+	tests := []struct {
+		name   string
+		body   string
+		want   time.Time
+		wantOK bool
+	}{
+		{"release", releaseFile(until), until, true},
+		{"inrelease", "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA512\n\n" + releaseFile(until) + "-----BEGIN PGP SIGNATURE-----\n", until, true},
+		{"numeric zone", "Valid-Until: Sat, 26 Oct 2024 22:19:44 +0200\n", until, true},
+		{"lower-case field", "valid-until: Sat, 26 Oct 2024 20:19:44 UTC\n", until, true},
+		{"no field", "Origin: Ubuntu\nSuite: noble\nSHA256:\n abc 1 Valid-Until: x\n", time.Time{}, false},
+		{"after checksums", "Origin: Debian\nMD5Sum:\n abc 1 main/Packages\nValid-Until: Sat, 26 Oct 2024 20:19:44 UTC\n", time.Time{}, false},
+		{"bad date", "Valid-Until: next week\n", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := releaseValidUntil(strings.NewReader(tt.body))
+		if ok != tt.wantOK || !got.Equal(tt.want) {
+			t.Errorf("%s: releaseValidUntil() = %s, %v; want %s, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestIsReleaseKey(t *testing.T) {
+	for key, want := range map[string]bool{
+		"GET:http://deb.debian.org/debian/dists/bookworm/inrelease":                  true,
+		"GET:http://deb.debian.org/debian/dists/bookworm/release":                    true,
+		"GET:http://deb.debian.org/debian/dists/bookworm/release::accept-encoding=:": true,
+		"GET:http://deb.debian.org/debian/dists/bookworm/release.gpg":                false,
+		"GET:http://deb.debian.org/debian/pool/main/h/hello/hello_2.10_amd64.deb":    false,
+	} {
+		if got := isReleaseKey(key); got != want {
+			t.Errorf("isReleaseKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+// TestExpiredReleaseIsRevalidated caches a Release file the mirror says
+// is fresh for an hour, and checks that it is revalidated with the mirror
+// on the next request once Valid-Until has passed, and served from the
+// cache while it has not.
+func TestExpiredReleaseIsRevalidated(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		until     time.Time
+		wantFetch int32
+	}{
+		{"expired", time.Now().Add(-time.Hour), 2},
+		{"valid", time.Now().Add(24 * time.Hour), 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := releaseFile(tt.until)
+			var fetches, revalidations atomic.Int32
+			srv := newUpstreamTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				if r.Header.Get("If-None-Match") != "" {
+					revalidations.Add(1)
+				}
+				w.Header().Set("Cache-Control", "max-age=3600")
+				w.Header().Set("ETag", `"release-1"`)
+				_, _ = io.WriteString(w, body)
+			}), func(cfg *config.Config) { cfg.Mode = distro.TypeDebian })
+			for i := 0; i < 2; i++ {
+				resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/debian/dists/bookworm/Release", nil), 10000)
+				if err != nil {
+					t.Fatalf("app.Test error: %v", err)
+				}
+				got, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				httpcache.Writes.Wait()
+				if string(got) != body {
+					t.Fatalf("request %d: body %q, want the Release file", i+1, got)
+				}
+			}
+			if n := fetches.Load(); n != tt.wantFetch {
+				t.Errorf("mirror asked %d times, want %d", n, tt.wantFetch)
+			}
+			if n := revalidations.Load(); n != tt.wantFetch-1 {
+				t.Errorf("%d conditional requests, want %d", n, tt.wantFetch-1)
+			}
+		})
+	}
+}
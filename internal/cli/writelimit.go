@@ -0,0 +1,41 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	httpcache "github.com/soulteary/httpcache-kit"
+)
+
+// writeLimit wraps a cache store so that at most cap(slots) objects are
+// written at once (cache.max_concurrent_writes). The cache handler stores
+// objects in goroutines of their own once the response is on its way, so
+// a write waiting for a slot only delays caching, never the client. Stores
+// sharing slots share the limit.
+type writeLimit struct {
+	httpcache.ExtendedCache
+
+	slots chan struct{}
+}
+
+func newWriteLimit(cache httpcache.ExtendedCache, slots chan struct{}) *writeLimit {
+	return &writeLimit{ExtendedCache: cache, slots: slots}
+}
+
+// Store waits for a free slot, then writes the object.
+func (l *writeLimit) Store(res *httpcache.Resource, keys ...string) error {
+	l.slots <- struct{}{}
+	defer func() { <-l.slots }()
+	return l.ExtendedCache.Store(res, keys...)
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	httpcache "github.com/soulteary/httpcache-kit"
+
+	"github.com/soulteary/apt-proxy/internal/config"
+)
+
+// writeGauge records how many writes run at once and the most seen.
+type writeGauge struct {
+	running atomic.Int32
+	peak    atomic.Int32
+}
+
+// slowStore is a store whose writes take delay, counted in gauge.
+type slowStore struct {
+	httpcache.ExtendedCache
+
+	delay time.Duration
+	gauge *writeGauge
+}
+
+func (s *slowStore) Store(res *httpcache.Resource, keys ...string) error {
+	n := s.gauge.running.Add(1)
+	defer s.gauge.running.Add(-1)
+	for {
+		peak := s.gauge.peak.Load()
+		if n <= peak || s.gauge.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(s.delay)
+	return s.ExtendedCache.Store(res, keys...)
+}
+
+func TestWriteLimitCapsConcurrentStores(t *testing.T) {
+	gauge := &writeGauge{}
+	slots := make(chan struct{}, 3)
+	stores := []httpcache.ExtendedCache{
+		newWriteLimit(&slowStore{ExtendedCache: httpcache.NewMemoryCacheWithConfig(nil), delay: 10 * time.Millisecond, gauge: gauge}, slots),
+		newWriteLimit(&slowStore{ExtendedCache: httpcache.NewMemoryCacheWithConfig(nil), delay: 10 * time.Millisecond, gauge: gauge}, slots),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := httpcache.NewResourceBytes(http.StatusOK, []byte("deb-body"), http.Header{"Content-Length": {"8"}})
+			if err := stores[i%2].Store(res, fmt.Sprintf("GET /ubuntu/pool/%d.deb", i)); err != nil {
+				t.Errorf("Store() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if peak := gauge.peak.Load(); peak > 3 {
+		t.Errorf("up to %d writes at once across both stores, want at most 3", peak)
+	} else if peak < 2 {
+		t.Errorf("at most %d write at once, want writes to run in parallel up to the limit", peak)
+	}
+	for i := 0; i < 20; i++ {
+		if !cached(stores[i%2], fmt.Sprintf("GET /ubuntu/pool/%d.deb", i)) {
+			t.Errorf("object %d was not stored", i)
+		}
+	}
+}
+
+func TestWithWriteLimitSharesSlots(t *testing.T) {
+	s := &Server{config: &config.Config{Cache: config.CacheConfig{MaxConcurrentWrites: 2}}}
+	a, ok := s.withWriteLimit(httpcache.NewMemoryCacheWithConfig(nil)).(*writeLimit)
+	if !ok {
+		t.Fatal("withWriteLimit() did not wrap the store with cache.max_concurrent_writes set")
+	}
+	b := s.withWriteLimit(httpcache.NewMemoryCacheWithConfig(nil)).(*writeLimit)
+	if a.slots != b.slots || cap(a.slots) != 2 {
+		t.Errorf("stores do not share 2 write slots")
+	}
+
+	s = &Server{config: &config.Config{}}
+	if _, ok := s.withWriteLimit(httpcache.NewMemoryCacheWithConfig(nil)).(*writeLimit); ok {
+		t.Error("withWriteLimit() wrapped the store without cache.max_concurrent_writes")
+	}
+}
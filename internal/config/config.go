@@ -19,30 +19,122 @@ import "time"
 
 // Storage backend identifiers used by StorageConfig.Backend.
 const (
-	StorageBackendDisk = "disk"
-	StorageBackendS3   = "s3"
+	StorageBackendDisk   = "disk"
+	StorageBackendS3     = "s3"
+	StorageBackendMemory = "memory"
+)
+
+// Mirror list modes used by MirrorConfig.ListMode.
+const (
+	MirrorListMerge   = "merge"
+	MirrorListReplace = "replace"
+)
+
+// Benchmark modes used by BenchmarkConfig.Mode.
+const (
+	BenchmarkModeAsync = "async"
+	BenchmarkModeSync  = "sync"
+)
+
+// Benchmark probes used by BenchmarkConfig.Probe.
+const (
+	BenchmarkProbeHead  = "head"
+	BenchmarkProbeRange = "range"
+	BenchmarkProbeGet   = "get"
 )
 
 // Config holds all application configuration
 type Config struct {
-	Debug                   bool           `yaml:"debug"`
-	CacheDir                string         `yaml:"cache_dir"`
-	Mode                    int            `yaml:"mode"`
-	Listen                  string         `yaml:"listen"`
-	Mirrors                 MirrorConfig   `yaml:"mirrors"`
-	Cache                   CacheConfig    `yaml:"cache"`
-	Storage                 StorageConfig  `yaml:"storage"`
-	TLS                     TLSConfig      `yaml:"tls"`
-	Security                SecurityConfig `yaml:"security"`
-	DistributionsConfigPath string         `yaml:"distributions_config"`
+	Debug                   bool            `yaml:"debug"`
+	CacheDir                string          `yaml:"cache_dir"`
+	Mode                    int             `yaml:"mode"`
+	Listen                  string          `yaml:"listen"`
+	Mirrors                 MirrorConfig    `yaml:"mirrors"`
+	Cache                   CacheConfig     `yaml:"cache"`
+	Storage                 StorageConfig   `yaml:"storage"`
+	TLS                     TLSConfig       `yaml:"tls"`
+	Security                SecurityConfig  `yaml:"security"`
+	RateLimit               RateLimitConfig `yaml:"rate_limit"`
+	DNS                     DNSConfig       `yaml:"dns"`
+	Log                     LogConfig       `yaml:"log"`
+	Transport               TransportConfig `yaml:"transport"`
+	Proxy                   ProxyConfig     `yaml:"proxy"`
+	Benchmark               BenchmarkConfig `yaml:"benchmark"`
+	Admin                   AdminConfig     `yaml:"admin"`
+	DistributionsConfigPath string          `yaml:"distributions_config"`
 	// UpstreamKeepAlive enables HTTP keep-alive to upstream mirrors (default true).
 	UpstreamKeepAlive bool `yaml:"upstream_keep_alive"`
+	// ModeName is the mode as given by -mode, APT_PROXY_MODE or the
+	// config file, before it was resolved to Mode; empty when none was
+	// given. /api/health reports it so a mistyped mode that fell back to
+	// "all" is visible.
+	ModeName string `yaml:"-"`
+	// ReadyTimeout is the longest /readyz reports not-ready while the
+	// startup mirror benchmarks run (default 30s). 0 reports ready at once.
+	// Read from YAML as server.ready_timeout_sec.
+	ReadyTimeout time.Duration `yaml:"-"`
+	// H2C serves cleartext HTTP/2 (prior knowledge or Upgrade) alongside
+	// HTTP/1.1 when TLS is off. Intended for trusted internal networks.
+	// Read from YAML as server.h2c.
+	H2C bool `yaml:"-"`
+	// MaxHeaderBytes caps the request line plus headers; larger requests
+	// are answered 431. MaxURLLength caps the request target alone (414).
+	// 0 keeps the built-in limits (16 KiB and 8 KiB). Read from YAML as
+	// server.max_header_bytes / server.max_url_length.
+	MaxHeaderBytes int `yaml:"-"`
+	MaxURLLength   int `yaml:"-"`
+	// IdleTimeoutExit shuts the server down gracefully once no request
+	// has been served for this long, for one-shot CI use. 0 (default)
+	// keeps it running. Read from YAML as server.idle_timeout_exit_sec.
+	IdleTimeoutExit time.Duration `yaml:"-"`
+	// ProxyProtocol expects a PROXY protocol (v1 or v2) header on every
+	// connection and takes the client address from it, for deployments
+	// behind an L4 load balancer. Read from YAML as server.proxy_protocol.
+	ProxyProtocol bool `yaml:"-"`
+	// APIPrefix is the path the management API is served under, e.g.
+	// "/apt-proxy/api" for /apt-proxy/api/cache/stats. Empty means "/api".
+	// Read from YAML as server.api_prefix.
+	APIPrefix string `yaml:"-"`
+	// HealthPrefix is the path the /healthz, /livez and /readyz probes are
+	// served under, e.g. "/apt-proxy" for /apt-proxy/healthz. Empty keeps
+	// them at the root. Read from YAML as server.health_prefix.
+	HealthPrefix string `yaml:"-"`
+	// Maintenance answers every package request with 503 and a
+	// Retry-After of MaintenanceRetryAfter (0: 5 minutes), while health
+	// checks, the home page and the API keep working. It is re-read from
+	// the config file on SIGHUP and can be toggled with POST
+	// /api/maintenance. Read from YAML as server.maintenance and
+	// server.maintenance_retry_after_sec.
+	Maintenance           bool          `yaml:"-"`
+	MaintenanceRetryAfter time.Duration `yaml:"-"`
+	// ConfigFile and ConfigDir are the config file and drop-in directory
+	// the configuration is read from, empty when there are none; SIGHUP
+	// re-reads them for the settings that can change at runtime.
+	ConfigFile string `yaml:"-"`
+	ConfigDir  string `yaml:"-"`
+
+	// explicit records the settings given on the command line or in the
+	// environment, which keep their value when ReloadConfigFiles re-reads
+	// the files. nil when the config was not built by the flag parser.
+	explicit *cliExplicit
+}
+
+// AdminConfig moves the management endpoints off the package proxy's
+// listener.
+type AdminConfig struct {
+	// Listen, when set, serves the API (under server.api_prefix),
+	// /metrics, /version and the health probes on this address, e.g.
+	// "127.0.0.1:3143", instead of on Listen; Listen then answers them
+	// with 404. Plain HTTP; changing it needs a restart.
+	Listen string `yaml:"listen"`
 }
 
 // StorageConfig selects and configures the cache storage backend.
 // "disk" (default) keeps the cache on the local filesystem under CacheDir;
 // "s3" puts every cached body/header into an S3-compatible bucket so that
-// many apt-proxy instances can share a single cache pool.
+// many apt-proxy instances can share a single cache pool; "memory" keeps
+// the cache in RAM, bounded by cache.max_size_gb, for ephemeral hosts such
+// as CI runners. It is empty again after every restart.
 type StorageConfig struct {
 	// Backend selects which storage implementation to use.
 	// Empty defaults to "disk" for backward compatibility.
@@ -92,11 +184,45 @@ type SecurityConfig struct {
 	// APIRateLimitPerMinute limits API requests per IP per minute (0 = disabled). Default 60.
 	APIRateLimitPerMinute int `yaml:"api_rate_limit_per_minute"`
 	// TrustedProxies is the list of CIDR networks (e.g. "10.0.0.0/8") whose
-	// X-Forwarded-For header is honored for the API rate-limit / IP-based
-	// audit fields. Leave empty to ignore XFF entirely (default secure).
+	// Forwarded / X-Forwarded-For headers are honored: the client IP used
+	// for rate limits, audit fields and the access log is then the
+	// rightmost hop outside these networks. Leave empty to ignore the
+	// headers entirely (default secure).
 	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
+// RateLimitConfig holds per-client limits applied to proxied downloads.
+type RateLimitConfig struct {
+	// BytesPerSecond caps the download rate of each client IP across all
+	// of its concurrent requests, cache hits and misses alike. 0 = unlimited.
+	BytesPerSecond int64 `yaml:"bytes_per_second"`
+}
+
+// DNSConfig controls how upstream mirror hostnames are resolved.
+type DNSConfig struct {
+	// Overrides pins mirror hostnames to fixed IPs (host -> IP), consulted
+	// before any DNS lookup.
+	Overrides map[string]string `yaml:"overrides"`
+	// Server is an optional "host[:port]" DNS server used instead of the
+	// system resolver (port 53 when omitted).
+	Server string `yaml:"server"`
+	// CacheTTL keeps resolved mirror addresses for this long so repeated
+	// upstream dials skip the lookup. 0 disables the cache.
+	CacheTTL time.Duration `yaml:"-"`
+}
+
+// LogConfig controls request logging.
+type LogConfig struct {
+	// SampleRate logs one in SampleRate successful cache hits; misses,
+	// errors and all other requests are always logged. 0 or 1 logs every
+	// request.
+	SampleRate int `yaml:"sample_rate"`
+	// AccessFile, when set, receives the request log lines instead of
+	// the application log, in the same format. It is reopened on SIGHUP
+	// for log rotation.
+	AccessFile string `yaml:"access_file"`
+}
+
 // TLSConfig holds TLS/HTTPS configuration
 type TLSConfig struct {
 	// Enabled indicates whether TLS is enabled
@@ -114,6 +240,180 @@ type MirrorConfig struct {
 	Debian      string `yaml:"debian"`
 	CentOS      string `yaml:"centos"`
 	Alpine      string `yaml:"alpine"`
+	Gentoo      string `yaml:"gentoo"`
+	Arch        string `yaml:"arch"`
+	// Region is an optional hint (e.g. "cn", "us", "eu"). When set,
+	// mirrors whose hostname matches the region are benchmarked first and
+	// the rest are only tried if none of them respond.
+	Region string `yaml:"region"`
+	// Geo tunes the Ubuntu geo mirror API lookup and its circuit breaker.
+	Geo GeoConfig `yaml:"geo"`
+	// ListFile points at a file of extra mirror URLs, one per line,
+	// optionally grouped under [<distro>] sections. Re-read on SIGHUP.
+	ListFile string `yaml:"list_file"`
+	// ListMode is "merge" (default: listed mirrors are benchmarked before
+	// the usual candidates) or "replace" (only listed mirrors are used for
+	// the distributions the file covers).
+	ListMode string `yaml:"list_mode"`
+	// LazyBenchmark defers choosing a distribution's mirror until the
+	// first request for it, so distros nobody uses in "all" mode are never
+	// benchmarked.
+	LazyBenchmark bool `yaml:"lazy_benchmark"`
+	// RequireHTTPS drops http:// candidates from benchmarking and
+	// selection, and makes an http:// mirror set above a config error.
+	RequireHTTPS bool `yaml:"require_https"`
+	// MinSuccessRate (0-1) passes over mirrors whose recent proxied
+	// requests succeeded less often than this when selecting a mirror;
+	// they are only used when no other candidate answers. 0 disables it.
+	MinSuccessRate float64 `yaml:"min_success_rate"`
+	// AdoptRedirects replaces a selected mirror that redirects to
+	// another scheme on the same host (http:// to https://) by the
+	// redirect target once seen, so later requests skip the redirect.
+	// Needs cache.follow_redirects.
+	AdoptRedirects bool `yaml:"adopt_redirects"`
+	// SameOperatorFailover makes a distribution whose mirror fails switch
+	// to its mirror on a host another distribution is being served from
+	// (Ubuntu and Debian are often mirrored by the same operator), before
+	// the warm fallback. Mirrors are grouped by host from the registry or
+	// built-in lists and mirrors.list_file.
+	SameOperatorFailover bool `yaml:"same_operator_failover"`
+	// StickyClients spreads clients over this many of a distribution's
+	// fastest benchmarked mirrors, each client IP always sent to the same
+	// one, so apt does not switch mirrors mid-session. The benchmark ranks
+	// at most three mirrors. The mirrors share one cache, keyed by
+	// repository path. 0 or 1 sends every client to the fastest mirror.
+	StickyClients int `yaml:"sticky_clients"`
+	// BadGatewayRetryAfter, when positive, answers a request that would
+	// get a 502 with 503 and this Retry-After, and refreshes the
+	// distribution's mirror in the background, so apt retries against
+	// the new one instead of giving up. A distribution is refreshed this
+	// way at most once per BadGatewayRefreshInterval (0: 5 minutes).
+	BadGatewayRetryAfter      time.Duration `yaml:"-"`
+	BadGatewayRefreshInterval time.Duration `yaml:"-"`
+	// PathPrefixes maps the layout of mirrors that serve a distribution
+	// under another tree: for each mirror host (with a port to match
+	// only that port), repository path prefixes and their replacements
+	// on that mirror, e.g. "/ubuntu/": "/ubuntu-archive/". The longest
+	// matching prefix applies, to proxied requests and benchmarks alike;
+	// cache keys keep the canonical paths.
+	PathPrefixes map[string]map[string]string `yaml:"path_prefixes"`
+}
+
+// ProxyConfig edits the headers of proxied responses before they reach
+// clients. Hop-by-hop headers (Connection and the headers it names,
+// Keep-Alive, Proxy-Connection, TE, Transfer-Encoding, Upgrade) are
+// always removed.
+type ProxyConfig struct {
+	// StripHeaders are removed from every proxied response, e.g.
+	// Set-Cookie or Server. Names are case-insensitive.
+	StripHeaders []string `yaml:"strip_headers"`
+	// AddHeaders are set on every proxied response (name -> value),
+	// replacing any value from the mirror. Applied after StripHeaders.
+	AddHeaders map[string]string `yaml:"add_headers"`
+	// Via is the name apt-proxy adds to the Via header of upstream
+	// requests and proxied responses, as in "1.1 apt-proxy" (RFC 9110
+	// section 7.6.3). Empty means DefaultVia.
+	Via string `yaml:"via"`
+	// OmitVia leaves the Via header alone.
+	OmitVia bool `yaml:"omit_via"`
+	// UpstreamIPHeader sends clients the X-Upstream-IP header naming the
+	// IP address the mirror's host name resolved to and was connected to
+	// for the request. The address is logged as upstream_ip either way.
+	UpstreamIPHeader bool `yaml:"upstream_ip_header"`
+	// DisableRewrite (proxy.rewrite: false) proxies requests that name
+	// their repository host, as clients using apt-proxy as their HTTP
+	// proxy send them, to that host instead of the selected mirror, and
+	// caches them under it. Only the distribution's own hosts and known
+	// mirrors are kept; other hosts, and requests addressed to apt-proxy
+	// itself, still go to the mirror.
+	DisableRewrite bool `yaml:"-"`
+}
+
+// TransportConfig tunes connections to upstream mirrors.
+type TransportConfig struct {
+	// DialTimeout bounds establishing a TCP connection to a mirror, for
+	// proxied requests and mirror benchmarks alike (default 10s).
+	// Read from YAML as transport.dial_timeout_sec.
+	DialTimeout time.Duration `yaml:"-"`
+	// MirrorTLS overrides certificate verification per HTTPS mirror
+	// hostname, e.g. for internal mirrors with self-signed certificates.
+	// Hosts not listed are fully verified. Read from YAML as
+	// transport.mirror_tls.
+	MirrorTLS map[string]MirrorTLSConfig `yaml:"-"`
+	// Treat403As404 passes a mirror's 403 for a package file (.deb,
+	// .rpm, .apk, ...) on as 404, for mirrors that forbid files they do
+	// not have: apt expects a 404 there and reports a 403 as an error.
+	// Read from YAML as transport.treat_403_as_404.
+	Treat403As404 bool `yaml:"-"`
+	// ResponseHeaderTimeouts sets, per distribution name (as in
+	// cache.dirs), how long its mirrors may take to send the response
+	// headers of a proxied request. Distributions not listed wait 45s.
+	// Read from YAML as transport.response_header_timeout_sec.
+	ResponseHeaderTimeouts map[string]time.Duration `yaml:"-"`
+}
+
+// MirrorTLSConfig is the certificate policy for one mirror host.
+type MirrorTLSConfig struct {
+	// InsecureSkipVerify accepts any certificate. Dangerous; logged at
+	// startup.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+	// CAFile is a PEM bundle trusted instead of the system roots.
+	CAFile string `yaml:"ca_file"`
+	// PinnedSHA256 lists the hex SHA-256 fingerprints of accepted leaf
+	// certificates. Without CAFile a matching pin is enough; with it the
+	// chain must verify too.
+	PinnedSHA256 []string `yaml:"pinned_sha256"`
+}
+
+// BenchmarkConfig tunes mirror benchmarking.
+type BenchmarkConfig struct {
+	// DistroConcurrency is how many distributions are benchmarked at the
+	// same time; the rest wait. 0 (default) benchmarks them all at once.
+	// Read from YAML as benchmark.distro_concurrency.
+	DistroConcurrency int `yaml:"-"`
+
+	// Mode is "async" (default: serve the first candidate while mirrors
+	// are benchmarked in the background) or "sync" (benchmark before the
+	// server accepts traffic, so the mirror never changes mid-session).
+	// Read from YAML as benchmark.mode.
+	Mode string `yaml:"-"`
+
+	// Probe is the request each benchmark try sends: "head" (default),
+	// "range" (GET of the first byte, for metered or slow links where a
+	// mirror's HEAD is unreliable) or "get". Mirrors rejecting HEAD or
+	// Range are probed with a GET instead; no probe reads more than 8 KiB.
+	// Read from YAML as benchmark.probe.
+	Probe string `yaml:"-"`
+
+	// ResultTTL is how long a distribution's benchmark result is kept
+	// before its mirrors are benchmarked again. 0 (default) keeps it for
+	// 24 hours. Read from YAML as benchmark.result_ttl_min.
+	ResultTTL time.Duration `yaml:"-"`
+
+	// ResultsFile, when set, keeps the benchmark results across restarts:
+	// a distribution whose saved mirror is still a candidate starts on it
+	// without being benchmarked, until its result outlives ResultTTL.
+	// Read from YAML as benchmark.results_file.
+	ResultsFile string `yaml:"-"`
+
+	// MaxStaleOnStart makes a saved result older than it at startup be
+	// benchmarked afresh instead of trusted, however long ResultTTL is.
+	// 0 (default) applies ResultTTL only. Read from YAML as
+	// benchmark.max_stale_on_start_min.
+	MaxStaleOnStart time.Duration `yaml:"-"`
+}
+
+// GeoConfig bounds the Ubuntu geo mirror API lookup (mirrors.txt). After
+// FailureThreshold consecutive failures the lookup is skipped for Cooldown
+// and the built-in mirror list is used instead. Zero values select the
+// defaults (5s, 3, 5m). A fetched list is reused for CacheTTL before the
+// API is asked again (0, the default, fetches it on every mirror refresh).
+// Read from YAML as mirrors.geo.*.
+type GeoConfig struct {
+	Timeout          time.Duration `yaml:"-"`
+	FailureThreshold int           `yaml:"-"`
+	Cooldown         time.Duration `yaml:"-"`
+	CacheTTL         time.Duration `yaml:"-"`
 }
 
 // CacheConfig holds cache-specific configuration.
@@ -145,4 +445,85 @@ type CacheConfig struct {
 	// Not read from the top-level Config YAML; YAMLConfig.Cache.CleanupIntervalMin
 	// is the user-facing knob.
 	CleanupIntervalMin int `yaml:"-"`
+	// FollowRedirects makes the proxy follow upstream 3xx responses and
+	// cache the final response instead of the redirect (default: true).
+	FollowRedirects bool `yaml:"-"`
+	// FollowRedirectsSet records that FollowRedirects came from the config
+	// file or the command line rather than the default, so MergeConfigs
+	// can let an explicit false override a true base.
+	FollowRedirectsSet bool `yaml:"-"`
+	// BypassPatterns are regular expressions matched against the request
+	// path; matching requests are always proxied and never stored,
+	// whatever the distribution's cache rules say. YAML-only.
+	BypassPatterns []string `yaml:"-"`
+	// QueryKeyPatterns are regular expressions matched against the request
+	// path; matching requests keep their query string, which then becomes
+	// part of the cache key. Other requests are fetched and cached by path
+	// alone. YAML-only.
+	QueryKeyPatterns []string `yaml:"-"`
+	// ForwardQuery sends the query string dropped from other requests'
+	// cache keys to the mirror all the same, for repositories behind
+	// signed URLs ("?_gda_=..."). The cache still keys them by path.
+	// YAML-only.
+	ForwardQuery bool `yaml:"-"`
+	// AllowReadOnly starts the server with a disk cache directory that
+	// cannot be written to, proxying without caching until it can,
+	// instead of failing at startup. YAML-only.
+	AllowReadOnly bool `yaml:"-"`
+	// SanityCheck refuses to serve or cache a package file (.deb, .rpm,
+	// .apk) that turns out to be an HTML page, answering 502 instead.
+	// SanityFailover then retries it once on the next fastest mirror of
+	// the benchmark; a configured mirror has none to retry on.
+	// YAML-only: cache.sanity_check / cache.sanity_failover.
+	SanityCheck    bool `yaml:"-"`
+	SanityFailover bool `yaml:"-"`
+	// ServeStaleOnError answers with the cached copy of an object, marked
+	// with "Warning: 110", when fetching or revalidating it fails with a
+	// 5xx (every mirror down) instead of passing the error on. MaxStale
+	// bounds how long past its expiry such a copy may be; 0 means no
+	// bound. YAML-only: cache.serve_stale_on_error / cache.max_stale_hours.
+	ServeStaleOnError bool          `yaml:"-"`
+	MaxStale          time.Duration `yaml:"-"`
+	// StatsFile is where the cache hit, miss and bytes-served totals are
+	// saved on shutdown and restored from on startup, so /api/cache/stats
+	// reports them across restarts. Empty keeps them per process.
+	// YAML-only: cache.stats_file.
+	StatsFile string `yaml:"-"`
+	// MinFreeBytes pauses storing new objects while the cache filesystem
+	// has less free space than this, and evicts to get back above it.
+	// 0 disables the guard. Disk backend only; YAML-only.
+	MinFreeBytes int64 `yaml:"-"`
+	// CompressLevel gzip-compresses uncompressed index files (Packages,
+	// Sources, Release, ...) for clients that accept it, at this level
+	// from 1 (fastest) to 9 (smallest). The cache keeps the original
+	// bytes. 0 (default) serves indexes as stored. YAML-only.
+	CompressLevel int `yaml:"-"`
+	// Dirs stores the objects of some distributions outside Dir, keyed by
+	// distribution name (ubuntu, ubuntu-ports, debian, ...). Each entry is
+	// a separate store with its own size limit and cleanup; the others
+	// stay in Dir. Disk backend only; YAML-only.
+	Dirs map[string]string `yaml:"-"`
+	// IndexMaxSize splits the cache into two pools when positive: index
+	// files (rules caching for less than distro.IndexMaxAge) are kept in
+	// an index pool of this many bytes under Dir/index, and package files
+	// stay in the rest of Dir limited by MaxSize, so large packages never
+	// evict hot indexes. Disk backend only; read from YAML as
+	// cache.index_max_size_mb.
+	IndexMaxSize int64 `yaml:"-"`
+	// MaxConcurrentWrites caps how many objects are written to the cache
+	// at once, across all stores; further writes wait for a free slot.
+	// Requests are proxied meanwhile, only storing is delayed. 0 (default)
+	// means no limit. YAML-only.
+	MaxConcurrentWrites int `yaml:"-"`
+	// SizeScanTimeout bounds each measurement of the cache directory for
+	// the home page, which runs in the background every minute. A scan
+	// that times out keeps the last-known size. 0 uses the default (10s).
+	// YAML-only: cache.size_scan_timeout_sec.
+	SizeScanTimeout time.Duration `yaml:"-"`
+	// TTLByExtension replaces the max-age of the matched distribution
+	// rule for files ending in one of these extensions, keyed lower-case
+	// with the leading dot (".deb", ".tar.gz"); the longest listed
+	// extension of a file wins. Paths the rules never cache stay so.
+	// Read from YAML as cache.ttl_by_extension_hours.
+	TTLByExtension map[string]time.Duration `yaml:"-"`
 }
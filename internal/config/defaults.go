@@ -26,11 +26,33 @@ const (
 	EnvDebian      = "APT_PROXY_DEBIAN"
 	EnvCentOS      = "APT_PROXY_CENTOS"
 	EnvAlpine      = "APT_PROXY_ALPINE"
+	EnvGentoo      = "APT_PROXY_GENTOO"
+	EnvArch        = "APT_PROXY_ARCH"
+
+	// EnvMirrors sets the mirrors of several distributions at once, as JSON
+	// ({"ubuntu":"cn:tsinghua"}) or CSV (ubuntu=cn:tsinghua,debian=...).
+	EnvMirrors = "APT_PROXY_MIRRORS"
+
+	// EnvReadyTimeout caps how long /readyz waits for mirror benchmarks.
+	EnvReadyTimeout = "APT_PROXY_READY_TIMEOUT"
+
+	// EnvH2C enables cleartext HTTP/2 on the plain-HTTP listener.
+	EnvH2C = "APT_PROXY_H2C"
+
+	// EnvMirrorRegion biases geo/benchmark mirror selection towards a region.
+	EnvMirrorRegion = "APT_PROXY_MIRROR_REGION"
+
+	// EnvLazyBenchmark defers mirror benchmarks to each distro's first request.
+	EnvLazyBenchmark = "APT_PROXY_LAZY_BENCHMARK"
+
+	// EnvMirrorRequireHTTPS restricts upstream mirrors to https.
+	EnvMirrorRequireHTTPS = "APT_PROXY_MIRROR_REQUIRE_HTTPS"
 
 	// Cache configuration environment variables
 	EnvCacheMaxSize         = "APT_PROXY_CACHE_MAX_SIZE"
 	EnvCacheTTL             = "APT_PROXY_CACHE_TTL"
 	EnvCacheCleanupInterval = "APT_PROXY_CACHE_CLEANUP_INTERVAL"
+	EnvCacheFollowRedirects = "APT_PROXY_CACHE_FOLLOW_REDIRECTS"
 
 	// TLS configuration environment variables
 	EnvTLSEnabled  = "APT_PROXY_TLS_ENABLED"
@@ -45,14 +67,17 @@ const (
 
 	// Configuration file environment variable
 	EnvConfigFile = "APT_PROXY_CONFIG_FILE"
+	// Configuration drop-in directory environment variable
+	EnvConfigDir = "APT_PROXY_CONFIG_DIR"
 
 	// Upstream transport
 	EnvUpstreamKeepAlive = "APT_PROXY_UPSTREAM_KEEP_ALIVE"
+	EnvDialTimeout       = "APT_PROXY_DIAL_TIMEOUT"
 
 	// Distributions configuration (distributions.yaml) path
 	EnvDistributionsConfig = "APT_PROXY_DISTRIBUTIONS_CONFIG"
 
-	// Storage backend selection: "disk" (default) or "s3"
+	// Storage backend selection: "disk" (default), "s3" or "memory"
 	EnvStorageBackend = "APT_PROXY_STORAGE_BACKEND"
 
 	// S3 storage backend environment variables. Credentials default to the
@@ -84,6 +109,19 @@ const (
 
 	// Default configuration file paths (searched in order)
 	DefaultConfigFileName = "apt-proxy.yaml"
+	// Drop-in directory merged over the config file, looked up beside it
+	// (e.g. /etc/apt-proxy/conf.d) unless set with --config-dir.
+	DefaultConfigDirName = "conf.d"
+
+	// Default name in the Via header added to proxied messages.
+	DefaultVia = "apt-proxy"
+
+	// Default upper bound, in seconds, on how long /readyz reports
+	// not-ready while async mirror benchmarks are still running.
+	DefaultReadyTimeoutSec = 30
+
+	// Default upstream connect (dial) timeout in seconds.
+	DefaultDialTimeoutSec = 10
 
 	// Default async benchmark setting
 	DefaultAsyncBenchmark = true // Enable async mirror benchmark by default for faster startup
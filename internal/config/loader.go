@@ -22,6 +22,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/soulteary/apt-proxy/internal/distro"
 	"github.com/soulteary/apt-proxy/internal/mirrors"
@@ -49,7 +50,10 @@ func ParseFlags() (*Config, error) {
 	}
 
 	// Build CLI configuration with defaults
-	config, ex := buildCLIConfig(flags, DefaultHost, DefaultPort, DefaultCacheDir, DefaultCacheMaxSizeGB, DefaultCacheTTLHours, DefaultCacheCleanupIntervalMin)
+	config, ex, err := buildCLIConfig(flags, DefaultHost, DefaultPort, DefaultCacheDir, DefaultCacheMaxSizeGB, DefaultCacheTTLHours, DefaultCacheCleanupIntervalMin)
+	if err != nil {
+		return nil, err
+	}
 
 	// Set mode (buildCLIConfig may have set it, but we ensure it's set here with validated value)
 	config.Mode = ModeToInt(modeName)
@@ -77,7 +81,8 @@ func ParseFlags() (*Config, error) {
 }
 
 // ParseFlagsWithConfigFile parses command-line flags and optionally loads
-// configuration from a YAML file. Priority: CLI > ENV > Config File > Default.
+// configuration from a YAML file and its conf.d drop-in directory.
+// Priority: CLI > ENV > Config File (drop-ins over the file) > Default.
 func ParseFlagsWithConfigFile() (*Config, error) {
 	flags := flag.NewFlagSet("apt-proxy", flag.ContinueOnError)
 	defineFlags(flags)
@@ -93,16 +98,23 @@ func ParseFlagsWithConfigFile() (*Config, error) {
 	if configPath == "" {
 		configPath = FindConfigFile()
 	}
-	if configPath != "" {
+	configDir := configutil.ResolveString(flags, "config-dir", EnvConfigDir, "", true)
+	if configDir == "" && configPath != "" {
+		configDir = filepath.Join(filepath.Dir(configPath), DefaultConfigDirName)
+	}
+	if configPath != "" || configDir != "" {
 		var err error
-		fileConfig, err = LoadConfigFile(configPath)
+		fileConfig, err = LoadConfigFiles(configPath, configDir)
 		if err != nil {
 			return nil, fmt.Errorf("loading config file %s: %w", configPath, err)
 		}
 	}
 
 	// Build CLI/ENV configuration
-	cliConfig, ex := buildCLIConfig(flags, "", "", "", 0, 0, 0)
+	cliConfig, ex, err := buildCLIConfig(flags, "", "", "", 0, 0, 0)
+	if err != nil {
+		return nil, err
+	}
 
 	// Merge configurations: file config as base, CLI/ENV as override (honoring
 	// the explicit-set mask so users can override file/defaults with false/0).
@@ -111,7 +123,31 @@ func ParseFlagsWithConfigFile() (*Config, error) {
 	// Apply defaults for any remaining unset values, but respect explicit
 	// CLI/ENV zeroes (e.g. --cache-max-size=0 must really disable the limit).
 	config = applyDefaultsWithExplicit(config, ex)
+	config.ConfigFile, config.ConfigDir = configPath, configDir
+	config.explicit = ex
+
+	return config, nil
+}
 
+// ReloadConfigFiles re-reads the config file and drop-in directory cur was
+// loaded from and merges them the way ParseFlagsWithConfigFile did:
+// settings given on the command line or in the environment keep their
+// value from cur. It returns nil when cur has no config files or none of
+// them exists any more.
+func ReloadConfigFiles(cur *Config) (*Config, error) {
+	if cur == nil || (cur.ConfigFile == "" && cur.ConfigDir == "") {
+		return nil, nil
+	}
+	fileConfig, err := LoadConfigFiles(cur.ConfigFile, cur.ConfigDir)
+	if err != nil || fileConfig == nil {
+		return nil, err
+	}
+	ex := cur.explicit
+	if ex == nil {
+		ex = &cliExplicit{}
+	}
+	config := applyDefaultsWithExplicit(MergeConfigsWithExplicit(fileConfig, cur, ex), ex)
+	config.ConfigFile, config.ConfigDir, config.explicit = cur.ConfigFile, cur.ConfigDir, cur.explicit
 	return config, nil
 }
 
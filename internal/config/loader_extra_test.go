@@ -16,6 +16,7 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -47,13 +48,13 @@ func clearConfigEnv(t *testing.T) {
 		EnvHost, EnvPort, EnvCacheDir, EnvMode,
 		EnvCacheMaxSize, EnvCacheTTL, EnvCacheCleanupInterval,
 		EnvDebug, EnvUbuntu, EnvUbuntuPorts, EnvDebian,
-		EnvCentOS, EnvAlpine,
+		EnvCentOS, EnvAlpine, EnvGentoo, EnvArch, EnvMirrors,
 		EnvAPIKey, EnvAPIRateLimitPerMinute, EnvEnableAPIAuth, EnvTrustedProxies,
 		EnvUpstreamKeepAlive, EnvDistributionsConfig,
 		EnvStorageBackend, EnvS3Endpoint, EnvS3Region, EnvS3Bucket, EnvS3Prefix,
 		EnvS3AccessKey, EnvS3SecretKey, EnvS3SessionToken, EnvS3UseSSL,
 		EnvS3UsePathStyle, EnvS3InlineMaxMB, EnvS3TempDir,
-		EnvConfigFile,
+		EnvConfigFile, EnvConfigDir,
 	} {
 		t.Setenv(v, "")
 		_ = os.Unsetenv(v)
@@ -157,6 +158,157 @@ cache:
 	})
 }
 
+// TestParseFlagsWithConfigFileDropIns loads the conf.d directory beside
+// the config file when --config-dir is not given.
+func TestParseFlagsWithConfigFileDropIns(t *testing.T) {
+	clearConfigEnv(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "apt-proxy.yaml")
+	if err := os.WriteFile(path, []byte("server:\n  port: \"6789\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, DefaultConfigDirName), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, DefaultConfigDirName, "10-port.yaml"), []byte("server:\n  port: \"7000\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	withArgs(t, []string{"apt-proxy", "--config=" + path}, func() {
+		cfg, err := ParseFlagsWithConfigFile()
+		if err != nil {
+			t.Fatalf("ParseFlagsWithConfigFile: %v", err)
+		}
+		if !strings.HasSuffix(cfg.Listen, ":7000") {
+			t.Errorf("Listen = %q, want the drop-in's port 7000", cfg.Listen)
+		}
+	})
+}
+
+// TestReloadConfigFiles re-reads the config file after it changed: the
+// file's new values apply, except where the command line set the value.
+func TestReloadConfigFiles(t *testing.T) {
+	clearConfigEnv(t)
+	path := filepath.Join(t.TempDir(), "apt-proxy.yaml")
+	write := func(yaml string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("mirrors:\n  debian: https://deb.example.org/debian/\n  require_https: true\n")
+
+	withArgs(t, []string{"apt-proxy", "--config=" + path, "--ubuntu=https://cli.example.org/ubuntu/"}, func() {
+		cfg, err := ParseFlagsWithConfigFile()
+		if err != nil {
+			t.Fatalf("ParseFlagsWithConfigFile: %v", err)
+		}
+		write("mirrors:\n  ubuntu: https://file.example.org/ubuntu/\n  debian: https://deb2.example.org/debian/\n  sticky_clients: 2\n")
+
+		reloaded, err := ReloadConfigFiles(cfg)
+		if err != nil {
+			t.Fatalf("ReloadConfigFiles: %v", err)
+		}
+		if reloaded.Mirrors.Ubuntu != "https://cli.example.org/ubuntu/" {
+			t.Errorf("Mirrors.Ubuntu = %q, want the command line's mirror", reloaded.Mirrors.Ubuntu)
+		}
+		if reloaded.Mirrors.Debian != "https://deb2.example.org/debian/" {
+			t.Errorf("Mirrors.Debian = %q, want the file's new mirror", reloaded.Mirrors.Debian)
+		}
+		if reloaded.Mirrors.RequireHTTPS {
+			t.Error("Mirrors.RequireHTTPS still set after it was removed from the file")
+		}
+		if reloaded.Mirrors.StickyClients != 2 {
+			t.Errorf("Mirrors.StickyClients = %d, want 2", reloaded.Mirrors.StickyClients)
+		}
+		if reloaded.ConfigFile != path {
+			t.Errorf("ConfigFile = %q, want %q", reloaded.ConfigFile, path)
+		}
+	})
+
+	if cfg, err := ReloadConfigFiles(&Config{}); cfg != nil || err != nil {
+		t.Errorf("ReloadConfigFiles without config files = %v, %v; want nil, nil", cfg, err)
+	}
+}
+
+func TestParseMirrorsEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "  ", nil, false},
+		{"json", `{"ubuntu": "cn:tsinghua", "Debian": "https://deb.example.com/debian/", "ubuntu_ports": "cn:ustc"}`,
+			map[string]string{"ubuntu": "cn:tsinghua", "debian": "https://deb.example.com/debian/", "ubuntu-ports": "cn:ustc"}, false},
+		{"csv", "ubuntu=cn:tsinghua, alpine = https://dl.example.com/alpine/ ,ubuntu-ports=cn:ustc,",
+			map[string]string{"ubuntu": "cn:tsinghua", "alpine": "https://dl.example.com/alpine/", "ubuntu-ports": "cn:ustc"}, false},
+		{"csv mirror with query", "centos=https://c.example.com/centos/?a=b",
+			map[string]string{"centos": "https://c.example.com/centos/?a=b"}, false},
+		{"bad json", `{"ubuntu": 1}`, nil, true},
+		{"unknown distro", "fedora=https://f.example.com/", nil, true},
+		{"missing mirror", "ubuntu=", nil, true},
+		{"not a pair", "cn:tsinghua", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMirrorsEnv(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseMirrorsEnv(%q) error = %v, wantErr %v", tt.name, tt.value, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: parseMirrorsEnv(%q) = %v, want %v", tt.name, tt.value, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("%s: parseMirrorsEnv(%q)[%s] = %q, want %q", tt.name, tt.value, k, got[k], v)
+			}
+		}
+	}
+}
+
+// TestParseFlagsMirrorsEnv checks that APT_PROXY_MIRRORS sets mirrors,
+// that a distribution's own variable or flag wins over it, and that it
+// overrides the config file.
+func TestParseFlagsMirrorsEnv(t *testing.T) {
+	clearConfigEnv(t)
+	path := filepath.Join(t.TempDir(), "apt-proxy.yaml")
+	if err := os.WriteFile(path, []byte("mirrors:\n  centos: https://file.example.com/centos/\n  gentoo: https://file.example.com/gentoo/\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvMirrors, `{"ubuntu":"https://all.example.com/ubuntu/","debian":"https://all.example.com/debian/","centos":"https://all.example.com/centos/","alpine":"https://all.example.com/alpine/"}`)
+	t.Setenv(EnvDebian, "https://own.example.com/debian/")
+
+	withArgs(t, []string{"apt-proxy", "--config=" + path, "--alpine=https://flag.example.com/alpine/"}, func() {
+		cfg, err := ParseFlagsWithConfigFile()
+		if err != nil {
+			t.Fatalf("ParseFlagsWithConfigFile: %v", err)
+		}
+		for name, tt := range map[string]struct{ got, want string }{
+			"ubuntu": {cfg.Mirrors.Ubuntu, "https://all.example.com/ubuntu/"},
+			"debian": {cfg.Mirrors.Debian, "https://own.example.com/debian/"},
+			"centos": {cfg.Mirrors.CentOS, "https://all.example.com/centos/"},
+			"alpine": {cfg.Mirrors.Alpine, "https://flag.example.com/alpine/"},
+			"gentoo": {cfg.Mirrors.Gentoo, "https://file.example.com/gentoo/"},
+		} {
+			if tt.got != tt.want {
+				t.Errorf("%s mirror = %q, want %q", name, tt.got, tt.want)
+			}
+		}
+	})
+}
+
+func TestParseFlagsInvalidMirrorsEnv(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv(EnvMirrors, "fedora=https://f.example.com/")
+	withArgs(t, []string{"apt-proxy"}, func() {
+		if _, err := ParseFlags(); err == nil || !strings.Contains(err.Error(), EnvMirrors) {
+			t.Errorf("ParseFlags() error = %v, want one naming %s", err, EnvMirrors)
+		}
+	})
+}
+
 // TestMergeConfigsWithExplicitNilMask falls through to MergeConfigs
 // when ex is nil.
 func TestMergeConfigsWithExplicitNilMask(t *testing.T) {
@@ -211,6 +363,8 @@ func TestApplyToStatePopulatesMirrors(t *testing.T) {
 			Debian:      "http://example.com/debian/",
 			CentOS:      "http://example.com/centos/",
 			Alpine:      "http://example.com/alpine/",
+			Gentoo:      "http://example.com/gentoo/",
+			Arch:        "http://example.com/archlinux/",
 		},
 	}
 	if err := ApplyToState(cfg, st, nil); err != nil {
@@ -225,6 +379,40 @@ func TestApplyToStatePopulatesMirrors(t *testing.T) {
 	}
 }
 
+func TestApplyToStateRequireHTTPS(t *testing.T) {
+	st := state.NewAppState()
+	cfg := &Config{Mirrors: MirrorConfig{
+		Ubuntu:       "https://example.com/ubuntu/",
+		Debian:       "http://example.com/debian/",
+		RequireHTTPS: true,
+	}}
+	err := ApplyToState(cfg, st, nil)
+	if err == nil || !strings.Contains(err.Error(), "mirrors.debian") {
+		t.Fatalf("ApplyToState() error = %v, want one naming mirrors.debian", err)
+	}
+	if st.GetMirror(distro.TypeUbuntu) != nil || st.RequireHTTPS() {
+		t.Error("a rejected config was partially applied")
+	}
+
+	cfg.Mirrors.Debian = "https://example.com/debian/"
+	if err := ApplyToState(cfg, st, nil); err != nil {
+		t.Fatalf("ApplyToState() with https mirrors: %v", err)
+	}
+	if !st.RequireHTTPS() {
+		t.Error("RequireHTTPS() = false after applying mirrors.require_https")
+	}
+}
+
+func TestApplyToStateStickyClients(t *testing.T) {
+	st := state.NewAppState()
+	if err := ApplyToState(&Config{Mirrors: MirrorConfig{StickyClients: 3}}, st, nil); err != nil {
+		t.Fatalf("ApplyToState() error = %v", err)
+	}
+	if n := st.StickyClients(); n != 3 {
+		t.Errorf("StickyClients() = %d, want 3", n)
+	}
+}
+
 func TestApplyToStateNilArguments(t *testing.T) {
 	if err := ApplyToState(nil, state.NewAppState(), nil); err == nil {
 		t.Error("expected error for nil Config, got nil")
@@ -246,6 +434,8 @@ func TestGetAllowedModes(t *testing.T) {
 		distro.DistroDebian,
 		distro.DistroCentOS,
 		distro.DistroAlpine,
+		distro.DistroGentoo,
+		distro.DistroArch,
 	}
 	if len(got) != len(want) {
 		t.Fatalf("len = %d, want %d (got=%v)", len(got), len(want), got)
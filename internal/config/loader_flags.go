@@ -16,6 +16,7 @@
 package config
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -37,6 +38,8 @@ var (
 		distro.DistroDebian,
 		distro.DistroCentOS,
 		distro.DistroAlpine,
+		distro.DistroGentoo,
+		distro.DistroArch,
 	}
 )
 
@@ -59,6 +62,10 @@ func ModeToInt(mode string) int {
 		return distro.TypeCentOS
 	case distro.DistroAlpine:
 		return distro.TypeAlpine
+	case distro.DistroGentoo:
+		return distro.TypeGentoo
+	case distro.DistroArch:
+		return distro.TypeArch
 	default:
 		return distro.TypeAllDistros
 	}
@@ -70,7 +77,7 @@ func defineFlags(flags *flag.FlagSet) {
 	flags.String("host", DefaultHost, "the host to bind to")
 	flags.String("port", DefaultPort, "the port to bind to")
 	flags.String("mode", distro.DistroAll,
-		"select the mode of system to cache: all / ubuntu / ubuntu-ports / debian / centos / alpine")
+		"select the mode of system to cache: all / ubuntu / ubuntu-ports / debian / centos / alpine / gentoo / arch")
 	flags.Bool("debug", false, "whether to output debugging logging")
 	flags.String("cachedir", DefaultCacheDir, "the dir to store cache data in")
 	flags.String("ubuntu", "", "the ubuntu mirror for fetching packages")
@@ -78,7 +85,15 @@ func defineFlags(flags *flag.FlagSet) {
 	flags.String("debian", "", "the debian mirror for fetching packages")
 	flags.String("centos", "", "the centos mirror for fetching packages")
 	flags.String("alpine", "", "the alpine mirror for fetching packages")
+	flags.String("gentoo", "", "the gentoo mirror for fetching distfiles")
+	flags.String("arch", "", "the arch linux mirror for fetching packages")
+	flags.String("mirror-region", "", "prefer mirrors in this region (e.g. cn, us, eu) before benchmarking the rest")
+	flags.Bool("lazy-benchmark", false, "pick each distro's mirror on its first request instead of at startup")
+	flags.Bool("mirror-require-https", false, "only benchmark and use https upstream mirrors")
 	flags.String("distributions-config", "", "path to distributions YAML (distributions.yaml)")
+	flags.Int("ready-timeout", DefaultReadyTimeoutSec,
+		"seconds /readyz waits for startup mirror benchmarks before reporting ready (0 = do not wait)")
+	flags.Bool("h2c", false, "serve cleartext HTTP/2 (h2c) when TLS is disabled; for trusted networks")
 
 	// Cache configuration flags
 	flags.Int64("cache-max-size", DefaultCacheMaxSizeGB,
@@ -87,6 +102,8 @@ func defineFlags(flags *flag.FlagSet) {
 		"cache TTL in hours (0 to disable TTL-based eviction)")
 	flags.Int("cache-cleanup-interval", DefaultCacheCleanupIntervalMin,
 		"cache cleanup interval in minutes (0 to disable automatic cleanup)")
+	flags.Bool("cache-follow-redirects", true,
+		"follow upstream redirects and cache the final response instead of the redirect")
 
 	// TLS configuration flags
 	flags.Bool("tls", false, "enable TLS/HTTPS")
@@ -102,15 +119,18 @@ func defineFlags(flags *flag.FlagSet) {
 	// Security: API key for protected endpoints (also auto-enables auth)
 	flags.String("api-key", "", "API key for protected endpoints")
 	// Security: trusted proxies for honoring X-Forwarded-For (comma-separated CIDRs)
-	flags.String("trusted-proxies", "", "comma-separated CIDRs whose X-Forwarded-For is trusted by the API rate-limiter")
+	flags.String("trusted-proxies", "", "comma-separated CIDRs whose X-Forwarded-For is trusted for client IPs")
 	// Configuration file (only honored by ParseFlagsWithConfigFile)
 	flags.String("config", "", "path to YAML configuration file")
+	flags.String("config-dir", "", "directory of YAML drop-in files merged over the config file in lexical order (default: conf.d beside the config file)")
 
 	// Upstream: keep-alive to mirrors (default true)
 	flags.Bool("upstream-keep-alive", true, "enable HTTP keep-alive to upstream mirrors")
+	flags.Int("dial-timeout", DefaultDialTimeoutSec,
+		"seconds to wait for a TCP connection to an upstream mirror (proxying and benchmarks)")
 
 	// Storage backend selection (disk | s3). Empty/disk = local filesystem.
-	flags.String("storage-backend", DefaultStorageBackend, "cache storage backend: disk | s3")
+	flags.String("storage-backend", DefaultStorageBackend, "cache storage backend: disk | s3 | memory")
 
 	// S3 storage backend flags (only honored when storage-backend=s3).
 	flags.String("s3-endpoint", "", "S3 endpoint host[:port], e.g. s3.amazonaws.com or minio.local:9000")
@@ -135,15 +155,15 @@ var flagGroups = []struct {
 }{
 	{
 		title: "Server / Mode",
-		flags: []string{"host", "port", "mode", "debug", "config", "distributions-config"},
+		flags: []string{"host", "port", "mode", "debug", "config", "config-dir", "distributions-config", "ready-timeout", "h2c"},
 	},
 	{
 		title: "Cache (used when storage backend is \"disk\")",
-		flags: []string{"cachedir", "cache-max-size", "cache-ttl", "cache-cleanup-interval"},
+		flags: []string{"cachedir", "cache-max-size", "cache-ttl", "cache-cleanup-interval", "cache-follow-redirects"},
 	},
 	{
 		title: "Mirrors",
-		flags: []string{"ubuntu", "ubuntu-ports", "debian", "centos", "alpine"},
+		flags: []string{"ubuntu", "ubuntu-ports", "debian", "centos", "alpine", "gentoo", "arch", "mirror-region", "lazy-benchmark", "mirror-require-https"},
 	},
 	{
 		title: "TLS",
@@ -155,7 +175,7 @@ var flagGroups = []struct {
 	},
 	{
 		title: "Upstream",
-		flags: []string{"upstream-keep-alive"},
+		flags: []string{"upstream-keep-alive", "dial-timeout"},
 	},
 	{
 		title: "Storage backend (disk | s3)",
@@ -252,9 +272,15 @@ type cliExplicit struct {
 	DebianMirror          bool
 	CentOSMirror          bool
 	AlpineMirror          bool
+	GentooMirror          bool
+	ArchMirror            bool
+	MirrorRegion          bool
+	LazyBenchmark         bool
+	MirrorRequireHTTPS    bool
 	CacheMaxSize          bool
 	CacheTTL              bool
 	CacheCleanupInterval  bool
+	CacheFollowRedirects  bool
 	TLSEnabled            bool
 	TLSCertFile           bool
 	TLSKeyFile            bool
@@ -264,6 +290,9 @@ type cliExplicit struct {
 	TrustedProxies        bool
 	UpstreamKeepAlive     bool
 	DistributionsConfig   bool
+	ReadyTimeout          bool
+	H2C                   bool
+	DialTimeout           bool
 
 	StorageBackend bool
 	S3Endpoint     bool
@@ -303,11 +332,74 @@ func flagOrEnvSet(flags *flag.FlagSet, name, env string) bool {
 	return false
 }
 
+// mirrorsEnvNames maps the distribution names APT_PROXY_MIRRORS accepts to
+// the flag setting that distribution's mirror.
+var mirrorsEnvNames = map[string]string{
+	"ubuntu":       "ubuntu",
+	"ubuntu-ports": "ubuntu-ports",
+	"ubuntu_ports": "ubuntu-ports",
+	"debian":       "debian",
+	"centos":       "centos",
+	"alpine":       "alpine",
+	"gentoo":       "gentoo",
+	"arch":         "arch",
+}
+
+// parseMirrorsEnv parses APT_PROXY_MIRRORS, a JSON object or a comma
+// separated list of distro=mirror pairs, into mirrors keyed by flag name.
+// Distribution names are case-insensitive; unknown names and empty
+// mirrors are errors.
+func parseMirrorsEnv(value string) (map[string]string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	pairs := map[string]string{}
+	if strings.HasPrefix(value, "{") {
+		if err := json.Unmarshal([]byte(value), &pairs); err != nil {
+			return nil, fmt.Errorf("not a JSON object of distro to mirror: %w", err)
+		}
+	} else {
+		for _, item := range strings.Split(value, ",") {
+			if strings.TrimSpace(item) == "" {
+				continue
+			}
+			name, mirror, ok := strings.Cut(item, "=")
+			if !ok {
+				return nil, fmt.Errorf("%q is not distro=mirror", strings.TrimSpace(item))
+			}
+			pairs[name] = mirror
+		}
+	}
+
+	result := make(map[string]string, len(pairs))
+	for name, mirror := range pairs {
+		name = strings.ToLower(strings.TrimSpace(name))
+		flagName, ok := mirrorsEnvNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown distribution %q", name)
+		}
+		if mirror = strings.TrimSpace(mirror); mirror == "" {
+			return nil, fmt.Errorf("empty mirror for %s", name)
+		}
+		result[flagName] = mirror
+	}
+	return result, nil
+}
+
 // buildCLIConfig builds a Config from CLI flags and environment variables.
 // Default values are used when flags/env vars are not set.
 // The returned cliExplicit mask records which fields were explicitly set
 // (CLI flag or ENV) so MergeConfigsWithExplicit can honor false/0 overrides.
-func buildCLIConfig(flags *flag.FlagSet, defaultHost, defaultPort, defaultCacheDir string, defaultCacheMaxSizeGB int64, defaultCacheTTLHours, defaultCacheCleanupIntervalMin int) (*Config, *cliExplicit) {
+// A distribution's mirror flag or its own variable (APT_PROXY_UBUNTU, ...)
+// wins over its entry in APT_PROXY_MIRRORS; an invalid APT_PROXY_MIRRORS
+// is an error.
+func buildCLIConfig(flags *flag.FlagSet, defaultHost, defaultPort, defaultCacheDir string, defaultCacheMaxSizeGB int64, defaultCacheTTLHours, defaultCacheCleanupIntervalMin int) (*Config, *cliExplicit, error) {
+	mirrorsEnv, err := parseMirrorsEnv(os.Getenv(EnvMirrors))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %w", EnvMirrors, err)
+	}
+
 	ex := &cliExplicit{
 		Debug:                 flagOrEnvSet(flags, "debug", EnvDebug),
 		CacheDir:              flagOrEnvSet(flags, "cachedir", EnvCacheDir),
@@ -317,9 +409,15 @@ func buildCLIConfig(flags *flag.FlagSet, defaultHost, defaultPort, defaultCacheD
 		DebianMirror:          flagOrEnvSet(flags, "debian", EnvDebian),
 		CentOSMirror:          flagOrEnvSet(flags, "centos", EnvCentOS),
 		AlpineMirror:          flagOrEnvSet(flags, "alpine", EnvAlpine),
+		GentooMirror:          flagOrEnvSet(flags, "gentoo", EnvGentoo),
+		ArchMirror:            flagOrEnvSet(flags, "arch", EnvArch),
+		MirrorRegion:          flagOrEnvSet(flags, "mirror-region", EnvMirrorRegion),
+		LazyBenchmark:         flagOrEnvSet(flags, "lazy-benchmark", EnvLazyBenchmark),
+		MirrorRequireHTTPS:    flagOrEnvSet(flags, "mirror-require-https", EnvMirrorRequireHTTPS),
 		CacheMaxSize:          flagOrEnvSet(flags, "cache-max-size", EnvCacheMaxSize),
 		CacheTTL:              flagOrEnvSet(flags, "cache-ttl", EnvCacheTTL),
 		CacheCleanupInterval:  flagOrEnvSet(flags, "cache-cleanup-interval", EnvCacheCleanupInterval),
+		CacheFollowRedirects:  flagOrEnvSet(flags, "cache-follow-redirects", EnvCacheFollowRedirects),
 		TLSEnabled:            flagOrEnvSet(flags, "tls", EnvTLSEnabled),
 		TLSCertFile:           flagOrEnvSet(flags, "tls-cert", EnvTLSCertFile),
 		TLSKeyFile:            flagOrEnvSet(flags, "tls-key", EnvTLSKeyFile),
@@ -329,6 +427,9 @@ func buildCLIConfig(flags *flag.FlagSet, defaultHost, defaultPort, defaultCacheD
 		TrustedProxies:        flagOrEnvSet(flags, "trusted-proxies", EnvTrustedProxies),
 		UpstreamKeepAlive:     flagOrEnvSet(flags, "upstream-keep-alive", EnvUpstreamKeepAlive),
 		DistributionsConfig:   flagOrEnvSet(flags, "distributions-config", EnvDistributionsConfig),
+		ReadyTimeout:          flagOrEnvSet(flags, "ready-timeout", EnvReadyTimeout),
+		H2C:                   flagOrEnvSet(flags, "h2c", EnvH2C),
+		DialTimeout:           flagOrEnvSet(flags, "dial-timeout", EnvDialTimeout),
 
 		StorageBackend: flagOrEnvSet(flags, "storage-backend", EnvStorageBackend),
 		S3Endpoint:     flagOrEnvSet(flags, "s3-endpoint", EnvS3Endpoint),
@@ -357,18 +458,33 @@ func buildCLIConfig(flags *flag.FlagSet, defaultHost, defaultPort, defaultCacheD
 
 	// Resolve distributions config path
 	distributionsConfig := configutil.ResolveString(flags, "distributions-config", EnvDistributionsConfig, "", true)
-
-	// Resolve mirror configurations
-	ubuntu := configutil.ResolveString(flags, "ubuntu", EnvUbuntu, "", true)
-	ubuntuPorts := configutil.ResolveString(flags, "ubuntu-ports", EnvUbuntuPorts, "", true)
-	debian := configutil.ResolveString(flags, "debian", EnvDebian, "", true)
-	centos := configutil.ResolveString(flags, "centos", EnvCentOS, "", true)
-	alpine := configutil.ResolveString(flags, "alpine", EnvAlpine, "", true)
+	readyTimeoutSec := configutil.ResolveInt(flags, "ready-timeout", EnvReadyTimeout, DefaultReadyTimeoutSec, true)
+	h2c := configutil.ResolveBool(flags, "h2c", EnvH2C, false)
+
+	// Resolve mirror configurations, falling back to APT_PROXY_MIRRORS
+	mirror := func(name, env string, explicit *bool) string {
+		if m, ok := mirrorsEnv[name]; ok && !*explicit {
+			*explicit = true
+			return m
+		}
+		return configutil.ResolveString(flags, name, env, "", true)
+	}
+	ubuntu := mirror("ubuntu", EnvUbuntu, &ex.UbuntuMirror)
+	ubuntuPorts := mirror("ubuntu-ports", EnvUbuntuPorts, &ex.UbuntuPortsMirror)
+	debian := mirror("debian", EnvDebian, &ex.DebianMirror)
+	centos := mirror("centos", EnvCentOS, &ex.CentOSMirror)
+	alpine := mirror("alpine", EnvAlpine, &ex.AlpineMirror)
+	gentoo := mirror("gentoo", EnvGentoo, &ex.GentooMirror)
+	arch := mirror("arch", EnvArch, &ex.ArchMirror)
+	mirrorRegion := configutil.ResolveString(flags, "mirror-region", EnvMirrorRegion, "", true)
+	lazyBenchmark := configutil.ResolveBool(flags, "lazy-benchmark", EnvLazyBenchmark, false)
+	mirrorRequireHTTPS := configutil.ResolveBool(flags, "mirror-require-https", EnvMirrorRequireHTTPS, false)
 
 	// Resolve cache configurations
 	cacheMaxSizeGB := configutil.ResolveInt64(flags, "cache-max-size", EnvCacheMaxSize, defaultCacheMaxSizeGB, true)
 	cacheTTLHours := configutil.ResolveInt(flags, "cache-ttl", EnvCacheTTL, defaultCacheTTLHours, true)
 	cacheCleanupIntervalMin := configutil.ResolveInt(flags, "cache-cleanup-interval", EnvCacheCleanupInterval, defaultCacheCleanupIntervalMin, true)
+	cacheFollowRedirects := configutil.ResolveBool(flags, "cache-follow-redirects", EnvCacheFollowRedirects, true)
 
 	// Resolve TLS configurations
 	tlsEnabled := configutil.ResolveBool(flags, "tls", EnvTLSEnabled, false)
@@ -389,6 +505,7 @@ func buildCLIConfig(flags *flag.FlagSet, defaultHost, defaultPort, defaultCacheD
 	}
 	apiRateLimitPerMinute := configutil.ResolveInt(flags, "api-rate-limit", EnvAPIRateLimitPerMinute, DefaultAPIRateLimitPerMinute, true)
 	upstreamKeepAlive := configutil.ResolveBool(flags, "upstream-keep-alive", EnvUpstreamKeepAlive, true)
+	dialTimeoutSec := configutil.ResolveInt(flags, "dial-timeout", EnvDialTimeout, DefaultDialTimeoutSec, true)
 	trustedProxiesRaw := configutil.ResolveString(flags, "trusted-proxies", EnvTrustedProxies, "", true)
 	var trustedProxies []string
 	if trustedProxiesRaw != "" {
@@ -418,16 +535,23 @@ func buildCLIConfig(flags *flag.FlagSet, defaultHost, defaultPort, defaultCacheD
 		CacheDir:          cacheDir,
 		UpstreamKeepAlive: upstreamKeepAlive,
 		Mirrors: MirrorConfig{
-			Ubuntu:      ubuntu,
-			UbuntuPorts: ubuntuPorts,
-			Debian:      debian,
-			CentOS:      centos,
-			Alpine:      alpine,
+			Ubuntu:        ubuntu,
+			UbuntuPorts:   ubuntuPorts,
+			Debian:        debian,
+			CentOS:        centos,
+			Alpine:        alpine,
+			Gentoo:        gentoo,
+			Arch:          arch,
+			Region:        mirrorRegion,
+			LazyBenchmark: lazyBenchmark,
+			RequireHTTPS:  mirrorRequireHTTPS,
 		},
 		Cache: CacheConfig{
-			MaxSize:         cacheMaxSizeGB * 1024 * 1024 * 1024,
-			TTL:             time.Duration(cacheTTLHours) * time.Hour,
-			CleanupInterval: time.Duration(cacheCleanupIntervalMin) * time.Minute,
+			MaxSize:            cacheMaxSizeGB * 1024 * 1024 * 1024,
+			TTL:                time.Duration(cacheTTLHours) * time.Hour,
+			CleanupInterval:    time.Duration(cacheCleanupIntervalMin) * time.Minute,
+			FollowRedirects:    cacheFollowRedirects,
+			FollowRedirectsSet: ex.CacheFollowRedirects,
 		},
 		TLS: TLSConfig{
 			Enabled:  tlsEnabled,
@@ -457,9 +581,15 @@ func buildCLIConfig(flags *flag.FlagSet, defaultHost, defaultPort, defaultCacheD
 			},
 		},
 		DistributionsConfigPath: distributionsConfig,
+		ReadyTimeout:            time.Duration(readyTimeoutSec) * time.Second,
+		H2C:                     h2c,
+		Transport: TransportConfig{
+			DialTimeout: time.Duration(dialTimeoutSec) * time.Second,
+		},
 	}
 
 	// Set mode if specified
+	config.ModeName = configutil.ResolveString(flags, "mode", EnvMode, "", true)
 	if modeName != "" {
 		config.Mode = ModeToInt(modeName)
 	}
@@ -475,5 +605,5 @@ func buildCLIConfig(flags *flag.FlagSet, defaultHost, defaultPort, defaultCacheD
 		config.Listen = mirrors.BuildListenAddress(host, port)
 	}
 
-	return config, ex
+	return config, ex, nil
 }
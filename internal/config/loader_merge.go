@@ -15,6 +15,80 @@
 // Package config configuration merging logic between file/CLI/ENV sources.
 package config
 
+import (
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mergeYAMLConfig merges the config file src over dst. The parsed document
+// set is the explicit mask: only the keys it contains are copied, so a file
+// can set a value back to false or zero while leaving every key it does not
+// mention untouched. Maps are merged key by key and lists are replaced.
+func mergeYAMLConfig(dst, src *YAMLConfig, set *yaml.Node) {
+	if set.Kind == yaml.DocumentNode && len(set.Content) > 0 {
+		set = set.Content[0]
+	}
+	mergeYAMLValue(reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem(), set)
+}
+
+// mergeYAMLValue copies the fields of the struct src named by the mapping
+// node set into dst, descending into nested sections.
+func mergeYAMLValue(dst, src reflect.Value, set *yaml.Node) {
+	if set.Kind == yaml.AliasNode {
+		set = set.Alias
+	}
+	if set.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(set.Content); i += 2 {
+		key, val := set.Content[i].Value, set.Content[i+1]
+		if key == "<<" {
+			// A merge key pulls in the keys of the aliased mapping(s).
+			if val.Kind == yaml.SequenceNode {
+				for _, m := range val.Content {
+					mergeYAMLValue(dst, src, m)
+				}
+			} else {
+				mergeYAMLValue(dst, src, val)
+			}
+			continue
+		}
+		field := yamlField(dst.Type(), key)
+		if field < 0 {
+			continue
+		}
+		d, s := dst.Field(field), src.Field(field)
+		switch d.Kind() {
+		case reflect.Struct:
+			mergeYAMLValue(d, s, val)
+		case reflect.Map:
+			if d.IsNil() || s.IsNil() {
+				d.Set(s)
+				continue
+			}
+			iter := s.MapRange()
+			for iter.Next() {
+				d.SetMapIndex(iter.Key(), iter.Value())
+			}
+		default:
+			d.Set(s)
+		}
+	}
+}
+
+// yamlField returns the index of the field of the struct type t whose yaml
+// tag is key, or -1.
+func yamlField(t reflect.Type, key string) int {
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ","); name == key {
+			return i
+		}
+	}
+	return -1
+}
+
 // MergeConfigsWithExplicit is like MergeConfigs but uses the explicit mask to
 // decide whether a zero/empty value in `override` should overwrite `base`.
 // Pass nil to fall back to MergeConfigs' permissive zero-value handling.
@@ -39,6 +113,7 @@ func MergeConfigsWithExplicit(base, override *Config, ex *cliExplicit) *Config {
 	}
 	if ex.Mode {
 		result.Mode = override.Mode
+		result.ModeName = override.ModeName
 	}
 	if ex.Listen && override.Listen != "" {
 		result.Listen = override.Listen
@@ -59,6 +134,21 @@ func MergeConfigsWithExplicit(base, override *Config, ex *cliExplicit) *Config {
 	if ex.AlpineMirror {
 		result.Mirrors.Alpine = override.Mirrors.Alpine
 	}
+	if ex.GentooMirror {
+		result.Mirrors.Gentoo = override.Mirrors.Gentoo
+	}
+	if ex.ArchMirror {
+		result.Mirrors.Arch = override.Mirrors.Arch
+	}
+	if ex.MirrorRegion {
+		result.Mirrors.Region = override.Mirrors.Region
+	}
+	if ex.LazyBenchmark {
+		result.Mirrors.LazyBenchmark = override.Mirrors.LazyBenchmark
+	}
+	if ex.MirrorRequireHTTPS {
+		result.Mirrors.RequireHTTPS = override.Mirrors.RequireHTTPS
+	}
 
 	if ex.CacheMaxSize {
 		result.Cache.MaxSize = override.Cache.MaxSize
@@ -69,6 +159,10 @@ func MergeConfigsWithExplicit(base, override *Config, ex *cliExplicit) *Config {
 	if ex.CacheCleanupInterval {
 		result.Cache.CleanupInterval = override.Cache.CleanupInterval
 	}
+	if ex.CacheFollowRedirects {
+		result.Cache.FollowRedirects = override.Cache.FollowRedirects
+		result.Cache.FollowRedirectsSet = true
+	}
 
 	if ex.TLSEnabled {
 		result.TLS.Enabled = override.TLS.Enabled
@@ -99,6 +193,15 @@ func MergeConfigsWithExplicit(base, override *Config, ex *cliExplicit) *Config {
 	if ex.DistributionsConfig && override.DistributionsConfigPath != "" {
 		result.DistributionsConfigPath = override.DistributionsConfigPath
 	}
+	if ex.ReadyTimeout {
+		result.ReadyTimeout = override.ReadyTimeout
+	}
+	if ex.H2C {
+		result.H2C = override.H2C
+	}
+	if ex.DialTimeout {
+		result.Transport.DialTimeout = override.Transport.DialTimeout
+	}
 
 	if ex.StorageBackend && override.Storage.Backend != "" {
 		result.Storage.Backend = override.Storage.Backend
@@ -141,137 +244,67 @@ func MergeConfigsWithExplicit(base, override *Config, ex *cliExplicit) *Config {
 }
 
 // MergeConfigs merges two configurations, with values from 'override' taking precedence.
-// Zero values in 'override' do not override values in 'base'.
+// Zero values in 'override' do not override values in 'base'. It is
+// MergeConfigsWithExplicit with a mask of the fields override sets to a
+// non-zero value, plus Cache.FollowRedirects when FollowRedirectsSet.
 //
 // Deprecated: prefer MergeConfigsWithExplicit, which can distinguish "user
 // wrote false/0" from "field defaulted". UpstreamKeepAlive in particular is
 // a bool whose zero value (false) cannot be safely overridden here without
 // the explicit-set mask.
 func MergeConfigs(base, override *Config) *Config {
-	if base == nil {
-		return override
-	}
 	if override == nil {
-		return base
-	}
-
-	result := *base
-
-	// Override non-zero values
-	if override.Debug {
-		result.Debug = override.Debug
-	}
-	if override.CacheDir != "" {
-		result.CacheDir = override.CacheDir
-	}
-	if override.Mode != 0 {
-		result.Mode = override.Mode
-	}
-	if override.Listen != "" {
-		result.Listen = override.Listen
-	}
-
-	// Merge MirrorConfig
-	if override.Mirrors.Ubuntu != "" {
-		result.Mirrors.Ubuntu = override.Mirrors.Ubuntu
-	}
-	if override.Mirrors.UbuntuPorts != "" {
-		result.Mirrors.UbuntuPorts = override.Mirrors.UbuntuPorts
-	}
-	if override.Mirrors.Debian != "" {
-		result.Mirrors.Debian = override.Mirrors.Debian
-	}
-	if override.Mirrors.CentOS != "" {
-		result.Mirrors.CentOS = override.Mirrors.CentOS
-	}
-	if override.Mirrors.Alpine != "" {
-		result.Mirrors.Alpine = override.Mirrors.Alpine
-	}
-
-	// Merge CacheConfig
-	if override.Cache.MaxSize > 0 {
-		result.Cache.MaxSize = override.Cache.MaxSize
-	}
-	if override.Cache.TTL > 0 {
-		result.Cache.TTL = override.Cache.TTL
-	}
-	if override.Cache.CleanupInterval > 0 {
-		result.Cache.CleanupInterval = override.Cache.CleanupInterval
-	}
-
-	// Merge TLSConfig
-	if override.TLS.Enabled {
-		result.TLS.Enabled = override.TLS.Enabled
-	}
-	if override.TLS.CertFile != "" {
-		result.TLS.CertFile = override.TLS.CertFile
-	}
-	if override.TLS.KeyFile != "" {
-		result.TLS.KeyFile = override.TLS.KeyFile
+		return MergeConfigsWithExplicit(base, override, &cliExplicit{})
 	}
+	return MergeConfigsWithExplicit(base, override, nonZeroMask(override))
+}
 
-	// Merge SecurityConfig
-	if override.Security.APIKey != "" {
-		result.Security.APIKey = override.Security.APIKey
-	}
-	if override.Security.EnableAPIAuth {
-		result.Security.EnableAPIAuth = override.Security.EnableAPIAuth
-	}
-	if override.Security.APIRateLimitPerMinute > 0 {
-		result.Security.APIRateLimitPerMinute = override.Security.APIRateLimitPerMinute
-	}
-	if len(override.Security.TrustedProxies) > 0 {
-		result.Security.TrustedProxies = append([]string(nil), override.Security.TrustedProxies...)
-	}
-	if override.DistributionsConfigPath != "" {
-		result.DistributionsConfigPath = override.DistributionsConfigPath
-	}
-	// UpstreamKeepAlive: override only when override is true (its non-zero
-	// value). The legacy non-explicit merge cannot tell "user wrote false"
-	// from "default false", so the safe behaviour is to never silently drop
-	// a true value from base.
-	if override.UpstreamKeepAlive {
-		result.UpstreamKeepAlive = override.UpstreamKeepAlive
-	}
+// nonZeroMask marks the CLI-settable fields of c that hold a non-zero value.
+func nonZeroMask(c *Config) *cliExplicit {
+	s3 := c.Storage.S3
+	return &cliExplicit{
+		Debug:                 c.Debug,
+		CacheDir:              c.CacheDir != "",
+		Mode:                  c.Mode != 0 || c.ModeName != "",
+		Listen:                c.Listen != "",
+		UbuntuMirror:          c.Mirrors.Ubuntu != "",
+		UbuntuPortsMirror:     c.Mirrors.UbuntuPorts != "",
+		DebianMirror:          c.Mirrors.Debian != "",
+		CentOSMirror:          c.Mirrors.CentOS != "",
+		AlpineMirror:          c.Mirrors.Alpine != "",
+		GentooMirror:          c.Mirrors.Gentoo != "",
+		ArchMirror:            c.Mirrors.Arch != "",
+		MirrorRegion:          c.Mirrors.Region != "",
+		LazyBenchmark:         c.Mirrors.LazyBenchmark,
+		MirrorRequireHTTPS:    c.Mirrors.RequireHTTPS,
+		CacheMaxSize:          c.Cache.MaxSize > 0,
+		CacheTTL:              c.Cache.TTL > 0,
+		CacheCleanupInterval:  c.Cache.CleanupInterval > 0,
+		CacheFollowRedirects:  c.Cache.FollowRedirectsSet || c.Cache.FollowRedirects,
+		TLSEnabled:            c.TLS.Enabled,
+		TLSCertFile:           c.TLS.CertFile != "",
+		TLSKeyFile:            c.TLS.KeyFile != "",
+		APIKey:                c.Security.APIKey != "",
+		EnableAPIAuth:         c.Security.EnableAPIAuth,
+		APIRateLimitPerMinute: c.Security.APIRateLimitPerMinute > 0,
+		TrustedProxies:        len(c.Security.TrustedProxies) > 0,
+		UpstreamKeepAlive:     c.UpstreamKeepAlive,
+		DistributionsConfig:   c.DistributionsConfigPath != "",
+		ReadyTimeout:          c.ReadyTimeout > 0,
+		H2C:                   c.H2C,
+		DialTimeout:           c.Transport.DialTimeout > 0,
 
-	// Storage backend: override only when non-empty/non-zero values are
-	// supplied. Same rationale as UpstreamKeepAlive applies to UseSSL et al.
-	if override.Storage.Backend != "" {
-		result.Storage.Backend = override.Storage.Backend
+		StorageBackend: c.Storage.Backend != "",
+		S3Endpoint:     s3.Endpoint != "",
+		S3Region:       s3.Region != "",
+		S3Bucket:       s3.Bucket != "",
+		S3Prefix:       s3.Prefix != "",
+		S3AccessKey:    s3.AccessKey != "",
+		S3SecretKey:    s3.SecretKey != "",
+		S3SessionToken: s3.SessionToken != "",
+		S3UseSSL:       s3.UseSSL,
+		S3UsePathStyle: s3.UsePathStyle,
+		S3InlineMaxMB:  s3.InlineMaxMB > 0,
+		S3TempDir:      s3.TempDir != "",
 	}
-	if override.Storage.S3.Endpoint != "" {
-		result.Storage.S3.Endpoint = override.Storage.S3.Endpoint
-	}
-	if override.Storage.S3.Region != "" {
-		result.Storage.S3.Region = override.Storage.S3.Region
-	}
-	if override.Storage.S3.Bucket != "" {
-		result.Storage.S3.Bucket = override.Storage.S3.Bucket
-	}
-	if override.Storage.S3.Prefix != "" {
-		result.Storage.S3.Prefix = override.Storage.S3.Prefix
-	}
-	if override.Storage.S3.AccessKey != "" {
-		result.Storage.S3.AccessKey = override.Storage.S3.AccessKey
-	}
-	if override.Storage.S3.SecretKey != "" {
-		result.Storage.S3.SecretKey = override.Storage.S3.SecretKey
-	}
-	if override.Storage.S3.SessionToken != "" {
-		result.Storage.S3.SessionToken = override.Storage.S3.SessionToken
-	}
-	if override.Storage.S3.UseSSL {
-		result.Storage.S3.UseSSL = override.Storage.S3.UseSSL
-	}
-	if override.Storage.S3.UsePathStyle {
-		result.Storage.S3.UsePathStyle = override.Storage.S3.UsePathStyle
-	}
-	if override.Storage.S3.InlineMaxMB > 0 {
-		result.Storage.S3.InlineMaxMB = override.Storage.S3.InlineMaxMB
-	}
-	if override.Storage.S3.TempDir != "" {
-		result.Storage.S3.TempDir = override.Storage.S3.TempDir
-	}
-
-	return &result
 }
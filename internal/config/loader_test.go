@@ -17,8 +17,12 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
 )
 
 func TestLoadConfigFile(t *testing.T) {
@@ -371,6 +375,17 @@ func TestYamlConfigToConfig_HostPort(t *testing.T) {
 	}
 }
 
+func TestYamlConfigToConfig_ModeName(t *testing.T) {
+	yamlCfg := &YAMLConfig{}
+	yamlCfg.Mode = "debain"
+
+	cfg := yamlConfigToConfig(yamlCfg)
+
+	if cfg.ModeName != "debain" || cfg.Mode != distro.TypeAllDistros {
+		t.Errorf("ModeName = %q, Mode = %d; want the mode as written and the fallback to all", cfg.ModeName, cfg.Mode)
+	}
+}
+
 func TestValidateConfig(t *testing.T) {
 	t.Run("nil config", func(t *testing.T) {
 		if err := ValidateConfig(nil); err == nil {
@@ -405,14 +420,451 @@ func TestValidateConfig(t *testing.T) {
 			t.Error("ValidateConfig with CacheDir as file should return error")
 		}
 	})
-	t.Run("valid config", func(t *testing.T) {
+	t.Run("dns override with non-IP value", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			DNS: DNSConfig{Overrides: map[string]string{"mirrors.example.com": "not-an-ip"}}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with non-IP dns override should return error")
+		}
+	})
+	t.Run("negative dns cache ttl", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			DNS: DNSConfig{CacheTTL: -time.Second}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative dns.cache_ttl_sec should return error")
+		}
+	})
+	t.Run("h2c combined with TLS", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), H2C: true,
+			TLS: TLSConfig{Enabled: true, CertFile: "/dev/null", KeyFile: "/dev/null"}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with h2c and TLS should return error")
+		}
+	})
+	t.Run("negative benchmark distro concurrency", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Benchmark: BenchmarkConfig{DistroConcurrency: -1}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative benchmark.distro_concurrency should return error")
+		}
+	})
+	t.Run("negative benchmark result ttl", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Benchmark: BenchmarkConfig{ResultTTL: -time.Minute}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative benchmark.result_ttl_min should return error")
+		}
+	})
+	t.Run("invalid mirror path prefixes", func(t *testing.T) {
+		for _, prefixes := range []map[string]map[string]string{
+			{"": {"/ubuntu/": "/ubuntu-archive/"}},
+			{"http://mirror.example.com": {"/ubuntu/": "/ubuntu-archive/"}},
+			{"mirror.example.com": {"ubuntu/": "/ubuntu-archive/"}},
+			{"mirror.example.com": {"/ubuntu/": "/ubuntu-archive"}},
+		} {
+			cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), Mirrors: MirrorConfig{PathPrefixes: prefixes}}
+			if err := ValidateConfig(cfg); err == nil {
+				t.Errorf("ValidateConfig with mirrors.path_prefixes %v should return error", prefixes)
+			}
+		}
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), Mirrors: MirrorConfig{PathPrefixes: map[string]map[string]string{
+			"mirror.example.com:8080": {"/ubuntu/": "/ubuntu-archive/", "/ubuntu/pool": "/pool"},
+		}}}
+		if err := ValidateConfig(cfg); err != nil {
+			t.Errorf("ValidateConfig with valid mirrors.path_prefixes error = %v", err)
+		}
+	})
+	t.Run("invalid ttl by extension", func(t *testing.T) {
+		for _, ttls := range []map[string]time.Duration{
+			{".deb": 0},
+			{".rpm": -time.Hour},
+			{".": time.Hour},
+			{"./deb": time.Hour},
+		} {
+			cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), Cache: CacheConfig{TTLByExtension: ttls}}
+			if err := ValidateConfig(cfg); err == nil {
+				t.Errorf("ValidateConfig with cache.ttl_by_extension_hours %v should return error", ttls)
+			}
+		}
+	})
+	t.Run("invalid response header timeouts", func(t *testing.T) {
+		for _, timeouts := range []map[string]time.Duration{
+			{"centos": 0},
+			{"ubuntu": -time.Second},
+			{"rocky": time.Minute},
+		} {
+			cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), Transport: TransportConfig{ResponseHeaderTimeouts: timeouts}}
+			if err := ValidateConfig(cfg); err == nil {
+				t.Errorf("ValidateConfig with transport.response_header_timeout_sec %v should return error", timeouts)
+			}
+		}
+	})
+	t.Run("negative benchmark max stale on start", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Benchmark: BenchmarkConfig{MaxStaleOnStart: -time.Minute}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative benchmark.max_stale_on_start_min should return error")
+		}
+	})
+	t.Run("invalid admin listen", func(t *testing.T) {
+		for _, addr := range []string{"localhost", "0.0.0.0:3142"} {
+			cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), Admin: AdminConfig{Listen: addr}}
+			if err := ValidateConfig(cfg); err == nil {
+				t.Errorf("ValidateConfig with admin.listen %q should return error", addr)
+			}
+		}
+	})
+	t.Run("negative bad gateway retry after", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Mirrors: MirrorConfig{BadGatewayRetryAfter: -time.Second}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative mirrors.bad_gateway_retry_after_sec should return error")
+		}
+	})
+	t.Run("unknown benchmark mode", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Benchmark: BenchmarkConfig{Mode: "lazy"}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with unknown benchmark.mode should return error")
+		}
+	})
+	t.Run("unknown benchmark probe", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Benchmark: BenchmarkConfig{Probe: "options"}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with unknown benchmark.probe should return error")
+		}
+	})
+	t.Run("negative idle timeout exit", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), IdleTimeoutExit: -time.Second}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative server.idle_timeout_exit_sec should return error")
+		}
+	})
+	t.Run("negative geo cache ttl", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir()}
+		cfg.Mirrors.Geo.CacheTTL = -time.Second
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative mirrors.geo.cache_ttl_sec should return error")
+		}
+	})
+	t.Run("min success rate above one", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir()}
+		cfg.Mirrors.MinSuccessRate = 1.5
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with mirrors.min_success_rate above 1 should return error")
+		}
+	})
+	t.Run("negative log sample rate", func(t *testing.T) {
 		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir()}
+		cfg.Log.SampleRate = -1
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative log.sample_rate should return error")
+		}
+	})
+	t.Run("negative max header bytes", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), MaxHeaderBytes: -1}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative server.max_header_bytes should return error")
+		}
+	})
+	t.Run("max url length above max header bytes", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), MaxHeaderBytes: 4096, MaxURLLength: 8192}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with server.max_url_length above server.max_header_bytes should return error")
+		}
+	})
+	t.Run("sanity failover without sanity check", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Cache: CacheConfig{SanityFailover: true}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with sanity_failover but no sanity_check should return error")
+		}
+	})
+	t.Run("max stale without serve stale on error", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Cache: CacheConfig{MaxStale: time.Hour}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with max_stale_hours but no serve_stale_on_error should return error")
+		}
+	})
+	t.Run("negative max stale", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Cache: CacheConfig{ServeStaleOnError: true, MaxStale: -time.Hour}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative cache.max_stale_hours should return error")
+		}
+	})
+	t.Run("negative min free bytes", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Cache: CacheConfig{MinFreeBytes: -1}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative cache.min_free_bytes should return error")
+		}
+	})
+	t.Run("min free bytes with s3 backend", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", Cache: CacheConfig{MinFreeBytes: 1 << 30},
+			Storage: StorageConfig{Backend: StorageBackendS3, S3: S3Config{Endpoint: "s3.example.com", Bucket: "apt"}}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with cache.min_free_bytes on the s3 backend should return error")
+		}
+	})
+	t.Run("negative max concurrent writes", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Cache: CacheConfig{MaxConcurrentWrites: -1}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative cache.max_concurrent_writes should return error")
+		}
+	})
+	t.Run("negative size scan timeout", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Cache: CacheConfig{SizeScanTimeout: -time.Second}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative cache.size_scan_timeout_sec should return error")
+		}
+	})
+	t.Run("negative sticky clients", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), Mirrors: MirrorConfig{StickyClients: -1}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative mirrors.sticky_clients should return error")
+		}
+	})
+	t.Run("negative maintenance retry after", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), MaintenanceRetryAfter: -time.Second}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative server.maintenance_retry_after_sec should return error")
+		}
+	})
+	t.Run("negative index pool size", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Cache: CacheConfig{IndexMaxSize: -1 << 20}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with negative cache.index_max_size_mb should return error")
+		}
+	})
+	t.Run("index pool with s3 backend", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", Cache: CacheConfig{IndexMaxSize: 512 << 20},
+			Storage: StorageConfig{Backend: StorageBackendS3, S3: S3Config{Endpoint: "s3.example.com", Bucket: "apt"}}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with cache.index_max_size_mb on the s3 backend should return error")
+		}
+	})
+	t.Run("cache dirs with s3 backend", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", Cache: CacheConfig{Dirs: map[string]string{"ubuntu": t.TempDir()}},
+			Storage: StorageConfig{Backend: StorageBackendS3, S3: S3Config{Endpoint: "s3.example.com", Bucket: "apt"}}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with cache.dirs on the s3 backend should return error")
+		}
+	})
+	t.Run("compress level out of range", func(t *testing.T) {
+		for _, level := range []int{-1, 10} {
+			cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+				Cache: CacheConfig{CompressLevel: level}}
+			if err := ValidateConfig(cfg); err == nil {
+				t.Errorf("ValidateConfig with cache.compress_level %d should return error", level)
+			}
+		}
+	})
+	t.Run("invalid cache bypass pattern", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Cache: CacheConfig{BypassPatterns: []string{`\.diff/Index$`, `(unclosed`}}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with an invalid bypass regexp should return error")
+		}
+	})
+	t.Run("invalid cache query key pattern", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Cache: CacheConfig{QueryKeyPatterns: []string{`[unclosed`}}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with an invalid query key regexp should return error")
+		}
+	})
+	t.Run("cache dirs", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		for name, dirs := range map[string]map[string]string{
+			"unknown distribution": {"fedora": t.TempDir()},
+			"empty directory":      {"ubuntu": " "},
+			"same as cache.dir":    {"ubuntu": cacheDir + "/"},
+			"shared directory":     {"ubuntu": cacheDir + "/shared", "alpine": cacheDir + "/shared"},
+		} {
+			cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: cacheDir, Cache: CacheConfig{Dirs: dirs}}
+			if err := ValidateConfig(cfg); err == nil || !strings.Contains(err.Error(), "cache.dirs.") {
+				t.Errorf("%s: ValidateConfig() error = %v, want a cache.dirs error", name, err)
+			}
+		}
+
+		ubuntuDir := filepath.Join(t.TempDir(), "ubuntu")
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: cacheDir,
+			Cache: CacheConfig{Dirs: map[string]string{"ubuntu": ubuntuDir, "ubuntu-ports": cacheDir + "/ports"}}}
+		if err := ValidateConfig(cfg); err != nil {
+			t.Fatalf("ValidateConfig() with valid cache.dirs: %v", err)
+		}
+		if _, err := os.Stat(ubuntuDir); err != nil {
+			t.Errorf("cache.dirs.ubuntu not created: %v", err)
+		}
+	})
+	t.Run("proxy headers", func(t *testing.T) {
+		for name, p := range map[string]ProxyConfig{
+			"strip name with space": {StripHeaders: []string{"Set Cookie"}},
+			"empty strip name":      {StripHeaders: []string{""}},
+			"add name with colon":   {AddHeaders: map[string]string{"X-Served-By:": "apt-proxy"}},
+			"add value with CRLF":   {AddHeaders: map[string]string{"X-Served-By": "apt-proxy\r\nSet-Cookie: x=1"}},
+			"via with space":        {Via: "apt proxy"},
+			"via with comma":        {Via: "apt-proxy,cdn"},
+		} {
+			cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), Proxy: p}
+			if err := ValidateConfig(cfg); err == nil {
+				t.Errorf("%s: ValidateConfig() should return error", name)
+			}
+		}
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), Proxy: ProxyConfig{
+			StripHeaders: []string{"Set-Cookie", "Server", "X-Cache"},
+			AddHeaders:   map[string]string{"X-Served-By": "apt-proxy eu-1"},
+			Via:          "cache01.example.com",
+		}}
+		if err := ValidateConfig(cfg); err != nil {
+			t.Errorf("ValidateConfig() with valid proxy headers: %v", err)
+		}
+	})
+	t.Run("unknown mirrors list mode", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Mirrors: MirrorConfig{ListMode: "append"}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with mirrors.list_mode=append should return error")
+		}
+	})
+	t.Run("missing mirrors list file", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Mirrors: MirrorConfig{ListFile: filepath.Join(t.TempDir(), "missing.list")}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with a missing mirrors.list_file should return error")
+		}
+	})
+	t.Run("mirror tls insecure with ca file", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Transport: TransportConfig{MirrorTLS: map[string]MirrorTLSConfig{
+				"mirror.internal": {InsecureSkipVerify: true, CAFile: "/etc/ssl/mirror-ca.pem"}}}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with insecure_skip_verify and ca_file should return error")
+		}
+	})
+	t.Run("mirror tls missing ca file", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Transport: TransportConfig{MirrorTLS: map[string]MirrorTLSConfig{
+				"mirror.internal": {CAFile: filepath.Join(t.TempDir(), "missing.pem")}}}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with a missing mirror ca_file should return error")
+		}
+	})
+	t.Run("mirror tls invalid pin", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Transport: TransportConfig{MirrorTLS: map[string]MirrorTLSConfig{
+				"mirror.internal": {PinnedSHA256: []string{"AB:CD"}}}}}
+		if err := ValidateConfig(cfg); err == nil {
+			t.Error("ValidateConfig with a short pinned_sha256 should return error")
+		}
+	})
+	t.Run("mirror tls valid pin", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			Transport: TransportConfig{MirrorTLS: map[string]MirrorTLSConfig{
+				"mirror.internal": {PinnedSHA256: []string{strings.Repeat("ab:", 31) + "ab"}}}}}
+		if err := ValidateConfig(cfg); err != nil {
+			t.Errorf("ValidateConfig with a colon-separated pin should succeed: %v", err)
+		}
+	})
+	t.Run("api prefix", func(t *testing.T) {
+		for prefix, valid := range map[string]bool{
+			"/apt-proxy/api": true,
+			"/_admin":        true,
+			"api":            false,
+			"/":              false,
+			"/api/":          false,
+			"/:name":         false,
+		} {
+			cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), APIPrefix: prefix}
+			if err := ValidateConfig(cfg); (err == nil) != valid {
+				t.Errorf("ValidateConfig with server.api_prefix %q: error = %v, want valid %v", prefix, err, valid)
+			}
+		}
+	})
+	t.Run("health prefix", func(t *testing.T) {
+		for prefix, valid := range map[string]bool{
+			"/apt-proxy": true,
+			"health":     false,
+			"/probes/":   false,
+		} {
+			cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), HealthPrefix: prefix}
+			if err := ValidateConfig(cfg); (err == nil) != valid {
+				t.Errorf("ValidateConfig with server.health_prefix %q: error = %v, want valid %v", prefix, err, valid)
+			}
+		}
+	})
+	t.Run("valid config", func(t *testing.T) {
+		cfg := &Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(),
+			DNS: DNSConfig{Overrides: map[string]string{"mirrors.example.com": "10.0.0.5"}}}
 		if err := ValidateConfig(cfg); err != nil {
 			t.Errorf("ValidateConfig with valid config should succeed: %v", err)
 		}
 	})
 }
 
+func TestYamlConfigToConfig_FollowRedirectsDefault(t *testing.T) {
+	if cfg := yamlConfigToConfig(&YAMLConfig{}); !cfg.Cache.FollowRedirects {
+		t.Error("cache.follow_redirects should default to true when omitted")
+	}
+
+	off := false
+	yamlCfg := &YAMLConfig{}
+	yamlCfg.Cache.FollowRedirects = &off
+	if cfg := yamlConfigToConfig(yamlCfg); cfg.Cache.FollowRedirects {
+		t.Error("explicit cache.follow_redirects: false should be honoured")
+	}
+}
+
+func TestYamlConfigToConfig_CacheBypassPatterns(t *testing.T) {
+	yamlCfg := &YAMLConfig{}
+	yamlCfg.Cache.BypassPatterns = []string{`\.diff/Index$`}
+	got := yamlConfigToConfig(yamlCfg).Cache.BypassPatterns
+	if len(got) != 1 || got[0] != `\.diff/Index$` {
+		t.Errorf("Cache.BypassPatterns = %q, want [\\.diff/Index$]", got)
+	}
+}
+
+func TestYamlConfigToConfig_CacheQueryKeyPatterns(t *testing.T) {
+	yamlCfg := &YAMLConfig{}
+	yamlCfg.Cache.QueryKeyPatterns = []string{`/mirrorlist$`}
+	got := yamlConfigToConfig(yamlCfg).Cache.QueryKeyPatterns
+	if len(got) != 1 || got[0] != `/mirrorlist$` {
+		t.Errorf("Cache.QueryKeyPatterns = %q, want [/mirrorlist$]", got)
+	}
+}
+
+func TestYamlConfigToConfig_CacheSanityCheck(t *testing.T) {
+	yamlCfg := &YAMLConfig{}
+	yamlCfg.Cache.SanityCheck = true
+	yamlCfg.Cache.SanityFailover = true
+	if c := yamlConfigToConfig(yamlCfg).Cache; !c.SanityCheck || !c.SanityFailover {
+		t.Errorf("Cache sanity = %v / %v, want true / true", c.SanityCheck, c.SanityFailover)
+	}
+}
+
+func TestYamlConfigToConfig_CacheServeStaleOnError(t *testing.T) {
+	yamlCfg := &YAMLConfig{}
+	yamlCfg.Cache.ServeStaleOnError = true
+	yamlCfg.Cache.MaxStaleHours = 48
+	if c := yamlConfigToConfig(yamlCfg).Cache; !c.ServeStaleOnError || c.MaxStale != 48*time.Hour {
+		t.Errorf("Cache stale = %v / %s, want true / 48h", c.ServeStaleOnError, c.MaxStale)
+	}
+}
+
+func TestYamlConfigToConfig_CacheStatsFile(t *testing.T) {
+	yamlCfg := &YAMLConfig{}
+	yamlCfg.Cache.StatsFile = "/var/lib/apt-proxy/stats.json"
+	if got := yamlConfigToConfig(yamlCfg).Cache.StatsFile; got != "/var/lib/apt-proxy/stats.json" {
+		t.Errorf("Cache.StatsFile = %q, want /var/lib/apt-proxy/stats.json", got)
+	}
+}
+
 func TestYamlConfigToConfig_PartialHostPort(t *testing.T) {
 	// Only host specified
 	yamlCfg := &YAMLConfig{}
@@ -523,6 +975,25 @@ func TestValidateConfig_S3Backend(t *testing.T) {
 	})
 }
 
+func TestValidateConfig_MemoryBackend(t *testing.T) {
+	memory := func(cache CacheConfig) *Config {
+		return &Config{Listen: "0.0.0.0:3142", Storage: StorageConfig{Backend: StorageBackendMemory}, Cache: cache}
+	}
+	if err := ValidateConfig(memory(CacheConfig{MaxSize: 1 << 30})); err != nil {
+		t.Errorf("memory backend with cache.max_size_gb should pass validation: %v", err)
+	}
+	for name, cfg := range map[string]*Config{
+		"no max size":    memory(CacheConfig{}),
+		"min free bytes": memory(CacheConfig{MaxSize: 1 << 30, MinFreeBytes: 1 << 30}),
+		"index pool":     memory(CacheConfig{MaxSize: 1 << 30, IndexMaxSize: 512 << 20}),
+		"cache dirs":     memory(CacheConfig{MaxSize: 1 << 30, Dirs: map[string]string{"ubuntu": "/srv/ubuntu"}}),
+	} {
+		if err := ValidateConfig(cfg); err == nil {
+			t.Errorf("%s: memory backend should fail validation", name)
+		}
+	}
+}
+
 func TestMergeConfigs_StorageFields(t *testing.T) {
 	base := &Config{
 		Storage: StorageConfig{
@@ -618,3 +1089,381 @@ func TestApplyDefaults_S3Backend(t *testing.T) {
 		t.Errorf("inline_max_mb default not applied: %d", got.Storage.S3.InlineMaxMB)
 	}
 }
+
+func TestYamlConfigToConfig_ReadyTimeout(t *testing.T) {
+	cfg := yamlConfigToConfig(&YAMLConfig{})
+	if cfg.ReadyTimeout != DefaultReadyTimeoutSec*time.Second {
+		t.Errorf("ReadyTimeout default = %s, want %ds", cfg.ReadyTimeout, DefaultReadyTimeoutSec)
+	}
+	zero := 0
+	yc := &YAMLConfig{}
+	yc.Server.ReadyTimeoutSec = &zero
+	if cfg := yamlConfigToConfig(yc); cfg.ReadyTimeout != 0 {
+		t.Errorf("explicit ready_timeout_sec: 0 = %s, want 0", cfg.ReadyTimeout)
+	}
+}
+
+func TestYamlConfigToConfig_RequestLimits(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Server.MaxHeaderBytes = 32768
+	yc.Server.MaxURLLength = 2048
+	cfg := yamlConfigToConfig(yc)
+	if cfg.MaxHeaderBytes != 32768 || cfg.MaxURLLength != 2048 {
+		t.Errorf("MaxHeaderBytes, MaxURLLength = %d, %d, want 32768, 2048", cfg.MaxHeaderBytes, cfg.MaxURLLength)
+	}
+}
+
+func TestYamlConfigToConfig_ProxyProtocol(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Server.ProxyProtocol = true
+	if !yamlConfigToConfig(yc).ProxyProtocol {
+		t.Error("ProxyProtocol = false, want true from server.proxy_protocol")
+	}
+}
+
+func TestYamlConfigToConfig_APIPrefix(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Server.APIPrefix = "/apt-proxy/api"
+	yc.Server.HealthPrefix = "/apt-proxy"
+	cfg := yamlConfigToConfig(yc)
+	if cfg.APIPrefix != "/apt-proxy/api" {
+		t.Errorf("APIPrefix = %q, want /apt-proxy/api", cfg.APIPrefix)
+	}
+	if cfg.HealthPrefix != "/apt-proxy" {
+		t.Errorf("HealthPrefix = %q, want /apt-proxy", cfg.HealthPrefix)
+	}
+}
+
+func TestYamlConfigToConfig_IdleTimeoutExit(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Server.IdleTimeoutExitSec = 90
+	if got := yamlConfigToConfig(yc).IdleTimeoutExit; got != 90*time.Second {
+		t.Errorf("IdleTimeoutExit = %s, want 1m30s", got)
+	}
+}
+
+func TestYamlConfigToConfig_BenchmarkDistroConcurrency(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Benchmark.DistroConcurrency = 1
+	if got := yamlConfigToConfig(yc).Benchmark.DistroConcurrency; got != 1 {
+		t.Errorf("Benchmark.DistroConcurrency = %d, want 1", got)
+	}
+}
+
+func TestYamlConfigToConfig_BenchmarkProbe(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Benchmark.Probe = BenchmarkProbeRange
+	if got := yamlConfigToConfig(yc).Benchmark.Probe; got != BenchmarkProbeRange {
+		t.Errorf("Benchmark.Probe = %q, want %q", got, BenchmarkProbeRange)
+	}
+}
+
+func TestYamlConfigToConfig_BenchmarkResultTTL(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Benchmark.ResultTTLMin = 180
+	if got := yamlConfigToConfig(yc).Benchmark.ResultTTL; got != 3*time.Hour {
+		t.Errorf("Benchmark.ResultTTL = %s, want 3h", got)
+	}
+}
+
+func TestYamlConfigToConfig_TTLByExtension(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Cache.TTLByExtensionHours = map[string]int{".deb": 8760, "RPM": 720}
+	got := yamlConfigToConfig(yc).Cache.TTLByExtension
+	want := map[string]time.Duration{".deb": 365 * 24 * time.Hour, ".rpm": 30 * 24 * time.Hour}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.TTLByExtension = %v, want %v", got, want)
+	}
+	if err := ValidateConfig(&Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), Cache: CacheConfig{TTLByExtension: got}}); err != nil {
+		t.Errorf("ValidateConfig() error = %v", err)
+	}
+}
+
+func TestYamlConfigToConfig_ResponseHeaderTimeouts(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Transport.ResponseHeaderTimeoutSec = map[string]int{"centos": 120, "ubuntu": 20}
+	got := yamlConfigToConfig(yc).Transport.ResponseHeaderTimeouts
+	want := map[string]time.Duration{"centos": 2 * time.Minute, "ubuntu": 20 * time.Second}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Transport.ResponseHeaderTimeouts = %v, want %v", got, want)
+	}
+	if err := ValidateConfig(&Config{Listen: "0.0.0.0:3142", CacheDir: t.TempDir(), Transport: TransportConfig{ResponseHeaderTimeouts: got}}); err != nil {
+		t.Errorf("ValidateConfig() error = %v", err)
+	}
+}
+
+func TestYamlConfigToConfig_BenchmarkResultsFile(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Benchmark.ResultsFile = "/var/lib/apt-proxy/benchmarks.json"
+	yc.Benchmark.MaxStaleOnStartMin = 720
+	got := yamlConfigToConfig(yc).Benchmark
+	if got.ResultsFile != "/var/lib/apt-proxy/benchmarks.json" || got.MaxStaleOnStart != 12*time.Hour {
+		t.Errorf("Benchmark = %q, %s; want the results file and 12h", got.ResultsFile, got.MaxStaleOnStart)
+	}
+}
+
+func TestYamlConfigToConfig_BenchmarkMode(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Benchmark.Mode = BenchmarkModeSync
+	if got := yamlConfigToConfig(yc).Benchmark.Mode; got != BenchmarkModeSync {
+		t.Errorf("Benchmark.Mode = %q, want %q", got, BenchmarkModeSync)
+	}
+}
+
+func TestYamlConfigToConfig_MirrorsGeo(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Mirrors.Geo.TimeoutSec = 2
+	yc.Mirrors.Geo.FailureThreshold = 4
+	yc.Mirrors.Geo.CooldownSec = 60
+	yc.Mirrors.Geo.CacheTTLSec = 3600
+	geo := yamlConfigToConfig(yc).Mirrors.Geo
+	if geo.Timeout != 2*time.Second || geo.FailureThreshold != 4 || geo.Cooldown != time.Minute || geo.CacheTTL != time.Hour {
+		t.Errorf("Mirrors.Geo = %+v, want 2s / 4 / 1m / 1h", geo)
+	}
+}
+
+func TestYamlConfigToConfig_MirrorsListFile(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Mirrors.ListFile = "/etc/apt-proxy/mirrors.list"
+	yc.Mirrors.ListMode = MirrorListReplace
+	m := yamlConfigToConfig(yc).Mirrors
+	if m.ListFile != "/etc/apt-proxy/mirrors.list" || m.ListMode != MirrorListReplace {
+		t.Errorf("Mirrors list = %q / %q, want /etc/apt-proxy/mirrors.list / replace", m.ListFile, m.ListMode)
+	}
+}
+
+func TestYamlConfigToConfig_MirrorsRequireHTTPS(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Mirrors.RequireHTTPS = true
+	if !yamlConfigToConfig(yc).Mirrors.RequireHTTPS {
+		t.Error("Mirrors.RequireHTTPS = false, want true")
+	}
+}
+
+func TestYamlConfigToConfig_MirrorsMinSuccessRate(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Mirrors.MinSuccessRate = 0.95
+	if got := yamlConfigToConfig(yc).Mirrors.MinSuccessRate; got != 0.95 {
+		t.Errorf("Mirrors.MinSuccessRate = %v, want 0.95", got)
+	}
+}
+
+func TestYamlConfigToConfig_MirrorsSameOperatorFailover(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Mirrors.SameOperator = true
+	if !yamlConfigToConfig(yc).Mirrors.SameOperatorFailover {
+		t.Error("Mirrors.SameOperatorFailover = false, want true")
+	}
+}
+
+func TestLoadConfigFile_MirrorPathPrefixes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apt-proxy.yaml")
+	yaml := `mirrors:
+  path_prefixes:
+    mirror.example.com:
+      /ubuntu/: /ubuntu-archive/
+`
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("LoadConfigFile() error = %v", err)
+	}
+	want := map[string]map[string]string{"mirror.example.com": {"/ubuntu/": "/ubuntu-archive/"}}
+	if !reflect.DeepEqual(cfg.Mirrors.PathPrefixes, want) {
+		t.Errorf("Mirrors.PathPrefixes = %v, want %v", cfg.Mirrors.PathPrefixes, want)
+	}
+}
+
+func TestYamlConfigToConfig_TransportTreat403As404(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Transport.Treat403As404 = true
+	if !yamlConfigToConfig(yc).Transport.Treat403As404 {
+		t.Error("Transport.Treat403As404 = false, want true")
+	}
+}
+
+func TestYamlConfigToConfig_CacheForwardQuery(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Cache.ForwardQuery = true
+	if !yamlConfigToConfig(yc).Cache.ForwardQuery {
+		t.Error("Cache.ForwardQuery = false, want true")
+	}
+}
+
+func TestYamlConfigToConfig_CacheAllowReadOnly(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Cache.AllowReadOnly = true
+	if !yamlConfigToConfig(yc).Cache.AllowReadOnly {
+		t.Error("Cache.AllowReadOnly = false, want true")
+	}
+}
+
+func TestYamlConfigToConfig_ProxyRewrite(t *testing.T) {
+	off, on := false, true
+	for _, tt := range []struct {
+		name    string
+		rewrite *bool
+		want    bool
+	}{
+		{"unset", nil, false},
+		{"true", &on, false},
+		{"false", &off, true},
+	} {
+		yc := &YAMLConfig{}
+		yc.Proxy.Rewrite = tt.rewrite
+		if got := yamlConfigToConfig(yc).Proxy.DisableRewrite; got != tt.want {
+			t.Errorf("proxy.rewrite %s: DisableRewrite = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestYamlConfigToConfig_AdminListen(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Admin.Listen = "127.0.0.1:3143"
+	if got := yamlConfigToConfig(yc).Admin.Listen; got != "127.0.0.1:3143" {
+		t.Errorf("Admin.Listen = %q, want 127.0.0.1:3143", got)
+	}
+}
+
+func TestYamlConfigToConfig_MirrorsBadGateway(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Mirrors.BadGatewayRetryAfterSec = 5
+	yc.Mirrors.BadGatewayRefreshIntervalSec = 600
+	m := yamlConfigToConfig(yc).Mirrors
+	if m.BadGatewayRetryAfter != 5*time.Second || m.BadGatewayRefreshInterval != 10*time.Minute {
+		t.Errorf("BadGatewayRetryAfter = %s, BadGatewayRefreshInterval = %s; want 5s, 10m", m.BadGatewayRetryAfter, m.BadGatewayRefreshInterval)
+	}
+}
+
+func TestYamlConfigToConfig_MirrorsAdoptRedirects(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Mirrors.AdoptRedirects = true
+	if !yamlConfigToConfig(yc).Mirrors.AdoptRedirects {
+		t.Error("Mirrors.AdoptRedirects = false, want true")
+	}
+}
+
+func TestYamlConfigToConfig_LogSampleRate(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Log.SampleRate = 100
+	if got := yamlConfigToConfig(yc).Log.SampleRate; got != 100 {
+		t.Errorf("Log.SampleRate = %d, want 100", got)
+	}
+}
+
+func TestYamlConfigToConfig_LogAccessFile(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Log.AccessFile = "/var/log/apt-proxy/access.log"
+	if got := yamlConfigToConfig(yc).Log.AccessFile; got != "/var/log/apt-proxy/access.log" {
+		t.Errorf("Log.AccessFile = %q, want /var/log/apt-proxy/access.log", got)
+	}
+}
+
+func TestYamlConfigToConfig_CacheMinFreeBytes(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Cache.MinFreeBytes = 5 << 30
+	if got := yamlConfigToConfig(yc).Cache.MinFreeBytes; got != 5<<30 {
+		t.Errorf("Cache.MinFreeBytes = %d, want %d", got, int64(5<<30))
+	}
+}
+
+func TestYamlConfigToConfig_CacheMaxConcurrentWrites(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Cache.MaxConcurrentWrites = 2
+	if got := yamlConfigToConfig(yc).Cache.MaxConcurrentWrites; got != 2 {
+		t.Errorf("Cache.MaxConcurrentWrites = %d, want 2", got)
+	}
+}
+
+func TestYamlConfigToConfig_CacheSizeScanTimeout(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Cache.SizeScanTimeoutSec = 30
+	if got := yamlConfigToConfig(yc).Cache.SizeScanTimeout; got != 30*time.Second {
+		t.Errorf("Cache.SizeScanTimeout = %s, want 30s", got)
+	}
+}
+
+func TestYamlConfigToConfig_MirrorsStickyClients(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Mirrors.StickyClients = 3
+	if got := yamlConfigToConfig(yc).Mirrors.StickyClients; got != 3 {
+		t.Errorf("Mirrors.StickyClients = %d, want 3", got)
+	}
+}
+
+func TestYamlConfigToConfig_Maintenance(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Server.Maintenance = true
+	yc.Server.MaintenanceRetryAfterSec = 120
+	cfg := yamlConfigToConfig(yc)
+	if !cfg.Maintenance || cfg.MaintenanceRetryAfter != 2*time.Minute {
+		t.Errorf("Maintenance = %v, MaintenanceRetryAfter = %s; want true, 2m", cfg.Maintenance, cfg.MaintenanceRetryAfter)
+	}
+}
+
+func TestYamlConfigToConfig_CacheIndexMaxSize(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Cache.IndexMaxSizeMB = 512
+	if got := yamlConfigToConfig(yc).Cache.IndexMaxSize; got != 512<<20 {
+		t.Errorf("Cache.IndexMaxSize = %d, want %d", got, int64(512<<20))
+	}
+}
+
+func TestYamlConfigToConfig_CacheDirs(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Cache.Dirs = map[string]string{"ubuntu": "/srv/hdd/apt-proxy", "alpine": "/srv/ssd/apt-proxy"}
+	got := yamlConfigToConfig(yc).Cache.Dirs
+	if len(got) != 2 || got["ubuntu"] != "/srv/hdd/apt-proxy" || got["alpine"] != "/srv/ssd/apt-proxy" {
+		t.Errorf("Cache.Dirs = %v, want ubuntu and alpine directories", got)
+	}
+}
+
+func TestYamlConfigToConfig_ProxyHeaders(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Proxy.StripHeaders = []string{"Set-Cookie"}
+	yc.Proxy.AddHeaders = map[string]string{"X-Served-By": "apt-proxy"}
+	got := yamlConfigToConfig(yc).Proxy
+	if len(got.StripHeaders) != 1 || got.StripHeaders[0] != "Set-Cookie" || got.AddHeaders["X-Served-By"] != "apt-proxy" {
+		t.Errorf("Proxy = %+v, want Set-Cookie stripped and X-Served-By added", got)
+	}
+}
+
+func TestYamlConfigToConfig_CacheCompressLevel(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Cache.CompressLevel = 6
+	if got := yamlConfigToConfig(yc).Cache.CompressLevel; got != 6 {
+		t.Errorf("Cache.CompressLevel = %d, want 6", got)
+	}
+}
+
+func TestYamlConfigToConfig_DNSCacheTTL(t *testing.T) {
+	yc := &YAMLConfig{}
+	if got := yamlConfigToConfig(yc).DNS.CacheTTL; got != 0 {
+		t.Errorf("DNS.CacheTTL default = %s, want 0 (disabled)", got)
+	}
+	yc.DNS.CacheTTLSec = 30
+	if got := yamlConfigToConfig(yc).DNS.CacheTTL; got != 30*time.Second {
+		t.Errorf("DNS.CacheTTL = %s, want 30s", got)
+	}
+}
+
+func TestYamlConfigToConfig_TransportDialTimeout(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Transport.DialTimeoutSec = 3
+	if got := yamlConfigToConfig(yc).Transport.DialTimeout; got != 3*time.Second {
+		t.Errorf("Transport.DialTimeout = %s, want 3s", got)
+	}
+}
+
+func TestYamlConfigToConfig_TransportMirrorTLS(t *testing.T) {
+	yc := &YAMLConfig{}
+	yc.Transport.MirrorTLS = map[string]MirrorTLSConfig{
+		"mirror.internal": {CAFile: "/etc/apt-proxy/mirror-ca.pem"},
+	}
+	got := yamlConfigToConfig(yc).Transport.MirrorTLS
+	if got["mirror.internal"].CAFile != "/etc/apt-proxy/mirror-ca.pem" {
+		t.Errorf("Transport.MirrorTLS = %+v, want mirror.internal ca_file", got)
+	}
+}
@@ -16,10 +16,16 @@
 package config
 
 import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/soulteary/apt-proxy/internal/distro"
 	"github.com/soulteary/apt-proxy/internal/state"
@@ -27,7 +33,8 @@ import (
 
 // ApplyToState writes the proxy mode and per-distro mirror URLs from
 // config into the supplied AppState. Aliases are resolved against reg
-// when reg is non-nil.
+// when reg is non-nil. With mirrors.require_https set, a mirror that does
+// not resolve to an https URL is an error and st is left unchanged.
 //
 // This replaces the previous package-global UpdateGlobalState helper:
 // callers must now own (and supply) the AppState explicitly so that
@@ -41,12 +48,39 @@ func ApplyToState(config *Config, st *state.AppState, reg *distro.Registry) erro
 		return fmt.Errorf("config: ApplyToState called with nil AppState")
 	}
 
+	specified := []struct {
+		distType int
+		key      string
+		value    string
+	}{
+		{distro.TypeUbuntu, "ubuntu", config.Mirrors.Ubuntu},
+		{distro.TypeUbuntuPorts, "ubuntu_ports", config.Mirrors.UbuntuPorts},
+		{distro.TypeDebian, "debian", config.Mirrors.Debian},
+		{distro.TypeCentOS, "centos", config.Mirrors.CentOS},
+		{distro.TypeAlpine, "alpine", config.Mirrors.Alpine},
+		{distro.TypeGentoo, "gentoo", config.Mirrors.Gentoo},
+		{distro.TypeArch, "arch", config.Mirrors.Arch},
+	}
+
+	// Check before touching st so a failed reload keeps the previous
+	// mirrors. Aliases are resolved first: they may name http mirrors.
+	if config.Mirrors.RequireHTTPS {
+		for _, m := range specified {
+			ms := state.NewMirrorState(m.distType)
+			ms.SetWithRegistry(m.value, reg)
+			if u := ms.Get(); u != nil && !strings.EqualFold(u.Scheme, "https") {
+				return fmt.Errorf("mirrors.%s %q is not an https mirror, but mirrors.require_https is enabled", m.key, u.Redacted())
+			}
+		}
+	}
+
 	st.SetProxyMode(config.Mode)
-	st.SetMirrorWithRegistry(distro.TypeUbuntu, config.Mirrors.Ubuntu, reg)
-	st.SetMirrorWithRegistry(distro.TypeUbuntuPorts, config.Mirrors.UbuntuPorts, reg)
-	st.SetMirrorWithRegistry(distro.TypeDebian, config.Mirrors.Debian, reg)
-	st.SetMirrorWithRegistry(distro.TypeCentOS, config.Mirrors.CentOS, reg)
-	st.SetMirrorWithRegistry(distro.TypeAlpine, config.Mirrors.Alpine, reg)
+	st.SetRegion(config.Mirrors.Region)
+	st.SetRequireHTTPS(config.Mirrors.RequireHTTPS)
+	st.SetStickyClients(config.Mirrors.StickyClients)
+	for _, m := range specified {
+		st.SetMirrorWithRegistry(m.distType, m.value, reg)
+	}
 	return nil
 }
 
@@ -65,6 +99,14 @@ func ValidateConfig(config *Config) error {
 	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
 		return fmt.Errorf("invalid listen address %q: %w", config.Listen, err)
 	}
+	if a := config.Admin.Listen; a != "" {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return fmt.Errorf("invalid admin.listen address %q: %w", a, err)
+		}
+		if a == config.Listen {
+			return fmt.Errorf("admin.listen must differ from the listen address %q", a)
+		}
+	}
 
 	// Validate storage backend selection and corresponding fields. The
 	// CacheDir checks below only apply to the local-disk backend; S3 uses
@@ -74,16 +116,12 @@ func ValidateConfig(config *Config) error {
 		if config.CacheDir == "" {
 			return fmt.Errorf("cache directory must be specified")
 		}
-		// Ensure cache directory exists and is writable
-		if err := os.MkdirAll(config.CacheDir, 0750); err != nil {
-			return fmt.Errorf("cache directory %q cannot be created: %w", config.CacheDir, err)
+		if err := checkCacheDir(config.CacheDir); err != nil {
+			return err
 		}
-		// Check writable by creating a temp file
-		testFile := filepath.Join(config.CacheDir, ".apt-proxy-write-test")
-		if err := os.WriteFile(testFile, nil, 0600); err != nil {
-			return fmt.Errorf("cache directory %q is not writable: %w", config.CacheDir, err)
+		if err := validateCacheDirs(config.CacheDir, config.Cache.Dirs); err != nil {
+			return err
 		}
-		_ = os.Remove(testFile)
 	case StorageBackendS3:
 		if config.Storage.S3.Endpoint == "" {
 			return fmt.Errorf("S3 endpoint must be specified when storage backend is %q", StorageBackendS3)
@@ -101,14 +139,26 @@ func ValidateConfig(config *Config) error {
 		// silently dropped the value; emit a one-line stderr warning when the
 		// operator supplied a non-default cache directory so the special case
 		// is observable instead of buried in README.
+		if len(config.Cache.Dirs) > 0 {
+			return fmt.Errorf("cache.dirs only applies to the %q storage backend", StorageBackendDisk)
+		}
 		if config.CacheDir != "" && config.CacheDir != DefaultCacheDir {
 			fmt.Fprintf(os.Stderr,
 				"warning: storage backend is %q; ignoring cache.dir=%q (cache.dir/--cachedir/APT_PROXY_CACHEDIR only apply when backend is %q)\n",
 				StorageBackendS3, config.CacheDir, StorageBackendDisk)
 		}
+	case StorageBackendMemory:
+		// Without a size limit the cache would grow until the process
+		// runs out of memory.
+		if config.Cache.MaxSize <= 0 {
+			return fmt.Errorf("storage backend %q needs cache.max_size_gb to bound its memory", StorageBackendMemory)
+		}
+		if len(config.Cache.Dirs) > 0 {
+			return fmt.Errorf("cache.dirs only applies to the %q storage backend", StorageBackendDisk)
+		}
 	default:
-		return fmt.Errorf("unknown storage backend %q (expected %q or %q)",
-			config.Storage.Backend, StorageBackendDisk, StorageBackendS3)
+		return fmt.Errorf("unknown storage backend %q (expected %q, %q or %q)",
+			config.Storage.Backend, StorageBackendDisk, StorageBackendS3, StorageBackendMemory)
 	}
 
 	// Validate TLS configuration
@@ -129,5 +179,317 @@ func ValidateConfig(config *Config) error {
 		}
 	}
 
+	if config.RateLimit.BytesPerSecond < 0 {
+		return fmt.Errorf("rate_limit.bytes_per_second must not be negative, got %d", config.RateLimit.BytesPerSecond)
+	}
+
+	if g := config.Mirrors.Geo; g.Timeout < 0 || g.FailureThreshold < 0 || g.Cooldown < 0 || g.CacheTTL < 0 {
+		return fmt.Errorf("mirrors.geo values must not be negative")
+	}
+
+	if r := config.Mirrors.MinSuccessRate; r < 0 || r > 1 {
+		return fmt.Errorf("mirrors.min_success_rate must be between 0 and 1, got %v", r)
+	}
+
+	if config.Mirrors.BadGatewayRetryAfter < 0 || config.Mirrors.BadGatewayRefreshInterval < 0 {
+		return fmt.Errorf("mirrors.bad_gateway_retry_after_sec and mirrors.bad_gateway_refresh_interval_sec must not be negative")
+	}
+
+	if err := validatePathPrefixes(config.Mirrors.PathPrefixes); err != nil {
+		return err
+	}
+
+	if config.Mirrors.StickyClients < 0 {
+		return fmt.Errorf("mirrors.sticky_clients must not be negative, got %d", config.Mirrors.StickyClients)
+	}
+
+	switch config.Mirrors.ListMode {
+	case "", MirrorListMerge, MirrorListReplace:
+	default:
+		return fmt.Errorf("mirrors.list_mode must be %q or %q, got %q",
+			MirrorListMerge, MirrorListReplace, config.Mirrors.ListMode)
+	}
+	if config.Mirrors.ListFile != "" {
+		if _, err := os.Stat(config.Mirrors.ListFile); err != nil {
+			return fmt.Errorf("mirrors.list_file: %w", err)
+		}
+	}
+
+	if config.Transport.DialTimeout < 0 {
+		return fmt.Errorf("transport.dial_timeout_sec must not be negative, got %s", config.Transport.DialTimeout)
+	}
+	for name, timeout := range config.Transport.ResponseHeaderTimeouts {
+		key := "transport.response_header_timeout_sec." + name
+		if ModeToInt(name) == distro.TypeAllDistros {
+			return fmt.Errorf("%s: unknown distribution %q", key, name)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", key, timeout)
+		}
+	}
+
+	if config.Benchmark.DistroConcurrency < 0 {
+		return fmt.Errorf("benchmark.distro_concurrency must not be negative, got %d", config.Benchmark.DistroConcurrency)
+	}
+	if config.Benchmark.ResultTTL < 0 {
+		return fmt.Errorf("benchmark.result_ttl_min must not be negative, got %s", config.Benchmark.ResultTTL)
+	}
+	if config.Benchmark.MaxStaleOnStart < 0 {
+		return fmt.Errorf("benchmark.max_stale_on_start_min must not be negative, got %s", config.Benchmark.MaxStaleOnStart)
+	}
+	switch config.Benchmark.Mode {
+	case "", BenchmarkModeAsync, BenchmarkModeSync:
+	default:
+		return fmt.Errorf("benchmark.mode must be %q or %q, got %q",
+			BenchmarkModeAsync, BenchmarkModeSync, config.Benchmark.Mode)
+	}
+	switch config.Benchmark.Probe {
+	case "", BenchmarkProbeHead, BenchmarkProbeRange, BenchmarkProbeGet:
+	default:
+		return fmt.Errorf("benchmark.probe must be %q, %q or %q, got %q",
+			BenchmarkProbeHead, BenchmarkProbeRange, BenchmarkProbeGet, config.Benchmark.Probe)
+	}
+
+	if config.H2C && config.TLS.Enabled {
+		return fmt.Errorf("server.h2c cannot be combined with tls.enabled; TLS already negotiates HTTP/2")
+	}
+
+	if config.ReadyTimeout < 0 {
+		return fmt.Errorf("server.ready_timeout_sec must not be negative, got %s", config.ReadyTimeout)
+	}
+
+	if config.IdleTimeoutExit < 0 {
+		return fmt.Errorf("server.idle_timeout_exit_sec must not be negative, got %s", config.IdleTimeoutExit)
+	}
+
+	if config.MaintenanceRetryAfter < 0 {
+		return fmt.Errorf("server.maintenance_retry_after_sec must not be negative, got %s", config.MaintenanceRetryAfter)
+	}
+
+	if config.MaxHeaderBytes < 0 {
+		return fmt.Errorf("server.max_header_bytes must not be negative, got %d", config.MaxHeaderBytes)
+	}
+	if config.MaxURLLength < 0 {
+		return fmt.Errorf("server.max_url_length must not be negative, got %d", config.MaxURLLength)
+	}
+	if config.MaxHeaderBytes > 0 && config.MaxURLLength > config.MaxHeaderBytes {
+		return fmt.Errorf("server.max_url_length (%d) cannot exceed server.max_header_bytes (%d)", config.MaxURLLength, config.MaxHeaderBytes)
+	}
+
+	if err := validateRoutePrefix("server.api_prefix", config.APIPrefix); err != nil {
+		return err
+	}
+	if err := validateRoutePrefix("server.health_prefix", config.HealthPrefix); err != nil {
+		return err
+	}
+
+	if config.Cache.SanityFailover && !config.Cache.SanityCheck {
+		return fmt.Errorf("cache.sanity_failover requires cache.sanity_check")
+	}
+
+	if config.Cache.MaxStale < 0 {
+		return fmt.Errorf("cache.max_stale_hours must not be negative, got %s", config.Cache.MaxStale)
+	}
+	if config.Cache.MaxStale > 0 && !config.Cache.ServeStaleOnError {
+		return fmt.Errorf("cache.max_stale_hours requires cache.serve_stale_on_error")
+	}
+
+	if config.Cache.MinFreeBytes < 0 {
+		return fmt.Errorf("cache.min_free_bytes must not be negative, got %d", config.Cache.MinFreeBytes)
+	}
+	if config.Cache.MinFreeBytes > 0 && !diskBackend(config) {
+		return fmt.Errorf("cache.min_free_bytes only applies to the %q storage backend", StorageBackendDisk)
+	}
+
+	if config.Cache.MaxConcurrentWrites < 0 {
+		return fmt.Errorf("cache.max_concurrent_writes must not be negative, got %d", config.Cache.MaxConcurrentWrites)
+	}
+
+	if config.Cache.SizeScanTimeout < 0 {
+		return fmt.Errorf("cache.size_scan_timeout_sec must not be negative, got %s", config.Cache.SizeScanTimeout)
+	}
+
+	for ext, ttl := range config.Cache.TTLByExtension {
+		if ext == "." || strings.ContainsAny(ext, "/ ") {
+			return fmt.Errorf("cache.ttl_by_extension_hours: %q is not a file extension", ext)
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("cache.ttl_by_extension_hours[%q] must be positive, got %s", ext, ttl)
+		}
+	}
+
+	if config.Cache.IndexMaxSize < 0 {
+		return fmt.Errorf("cache.index_max_size_mb must not be negative, got %d", config.Cache.IndexMaxSize/(1024*1024))
+	}
+	if config.Cache.IndexMaxSize > 0 && !diskBackend(config) {
+		return fmt.Errorf("cache.index_max_size_mb only applies to the %q storage backend", StorageBackendDisk)
+	}
+
+	if config.Cache.CompressLevel < 0 || config.Cache.CompressLevel > gzip.BestCompression {
+		return fmt.Errorf("cache.compress_level must be between 0 and %d, got %d", gzip.BestCompression, config.Cache.CompressLevel)
+	}
+
+	for _, pattern := range config.Cache.BypassPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("cache.bypass_patterns: invalid pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range config.Cache.QueryKeyPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("cache.query_key_patterns: invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	for host, t := range config.Transport.MirrorTLS {
+		if strings.TrimSpace(host) == "" {
+			return fmt.Errorf("transport.mirror_tls contains an empty hostname")
+		}
+		if t.InsecureSkipVerify && (t.CAFile != "" || len(t.PinnedSHA256) > 0) {
+			return fmt.Errorf("transport.mirror_tls[%q]: insecure_skip_verify cannot be combined with ca_file or pinned_sha256", host)
+		}
+		if t.CAFile != "" {
+			if _, err := os.Stat(t.CAFile); err != nil {
+				return fmt.Errorf("transport.mirror_tls[%q]: ca_file: %w", host, err)
+			}
+		}
+		for _, pin := range t.PinnedSHA256 {
+			if b, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(pin), ":", "")); err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("transport.mirror_tls[%q]: pinned_sha256 %q is not a hex SHA-256 fingerprint", host, pin)
+			}
+		}
+	}
+
+	for _, name := range config.Proxy.StripHeaders {
+		if !validHeaderName(name) {
+			return fmt.Errorf("proxy.strip_headers: %q is not a valid header name", name)
+		}
+	}
+	for name, value := range config.Proxy.AddHeaders {
+		if !validHeaderName(name) {
+			return fmt.Errorf("proxy.add_headers: %q is not a valid header name", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return fmt.Errorf("proxy.add_headers[%q]: value must not contain CR, LF or NUL", name)
+		}
+	}
+	if strings.ContainsAny(config.Proxy.Via, " \t,\r\n\x00") {
+		return fmt.Errorf("proxy.via: %q must be a single name without spaces or commas", config.Proxy.Via)
+	}
+
+	for host, ip := range config.DNS.Overrides {
+		if strings.TrimSpace(host) == "" {
+			return fmt.Errorf("dns.overrides contains an empty hostname")
+		}
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("dns.overrides[%q]: %q is not an IP address", host, ip)
+		}
+	}
+	if config.DNS.CacheTTL < 0 {
+		return fmt.Errorf("dns.cache_ttl_sec must not be negative, got %s", config.DNS.CacheTTL)
+	}
+	if config.Log.SampleRate < 0 {
+		return fmt.Errorf("log.sample_rate must not be negative, got %d", config.Log.SampleRate)
+	}
+
+	return nil
+}
+
+// validHeaderName reports whether name is an RFC 9110 field name token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// diskBackend reports whether config keeps the cache on the local disk.
+func diskBackend(config *Config) bool {
+	return config.Storage.Backend == "" || config.Storage.Backend == StorageBackendDisk
+}
+
+// checkCacheDir ensures a cache directory exists and is writable.
+func checkCacheDir(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("cache directory %q cannot be created: %w", dir, err)
+	}
+	// Check writable by creating a temp file
+	testFile := filepath.Join(dir, ".apt-proxy-write-test")
+	if err := os.WriteFile(testFile, nil, 0600); err != nil {
+		return fmt.Errorf("cache directory %q is not writable: %w", dir, err)
+	}
+	_ = os.Remove(testFile)
+	return nil
+}
+
+// validateCacheDirs checks cache.dirs: keys must name a distribution and
+// every store needs a writable directory of its own.
+func validateCacheDirs(defaultDir string, dirs map[string]string) error {
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	owner := map[string]string{filepath.Clean(defaultDir): "cache.dir"}
+	for _, name := range names {
+		key := "cache.dirs." + name
+		if ModeToInt(name) == distro.TypeAllDistros {
+			return fmt.Errorf("%s: unknown distribution %q", key, name)
+		}
+		dir := strings.TrimSpace(dirs[name])
+		if dir == "" {
+			return fmt.Errorf("%s must not be empty", key)
+		}
+		if other, ok := owner[filepath.Clean(dir)]; ok {
+			return fmt.Errorf("%s %q is already used by %s", key, dir, other)
+		}
+		owner[filepath.Clean(dir)] = key
+		if err := checkCacheDir(dir); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// validatePathPrefixes checks mirrors.path_prefixes: keys are bare host
+// names, optionally with a port, and each prefix and its replacement
+// are absolute paths that end in "/" together or not at all.
+func validatePathPrefixes(prefixes map[string]map[string]string) error {
+	for host, table := range prefixes {
+		if host == "" || strings.ContainsAny(host, "/ ") {
+			return fmt.Errorf("mirrors.path_prefixes: %q is not a mirror host name", host)
+		}
+		for from, to := range table {
+			if !strings.HasPrefix(from, "/") || !strings.HasPrefix(to, "/") {
+				return fmt.Errorf("mirrors.path_prefixes[%q]: %q -> %q must map an absolute path onto another", host, from, to)
+			}
+			if strings.HasSuffix(from, "/") != strings.HasSuffix(to, "/") {
+				return fmt.Errorf("mirrors.path_prefixes[%q]: %q -> %q must both end in / or neither", host, from, to)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRoutePrefix checks the route prefix p set by the YAML key name:
+// empty, or a path starting but not ending with / that fiber can mount.
+func validateRoutePrefix(name, p string) error {
+	if p == "" {
+		return nil
+	}
+	if !strings.HasPrefix(p, "/") || p == "/" || strings.HasSuffix(p, "/") {
+		return fmt.Errorf("%s must start with / and not end with one, got %q", name, p)
+	}
+	if strings.ContainsAny(p, ":*?# ") {
+		return fmt.Errorf("%s contains a character not allowed in a route prefix: %q", name, p)
+	}
 	return nil
 }
@@ -20,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -29,16 +30,47 @@ import (
 // It uses a more user-friendly structure that maps to the internal Config.
 type YAMLConfig struct {
 	Server struct {
-		Host  string `yaml:"host"`
-		Port  string `yaml:"port"`
-		Debug bool   `yaml:"debug"`
+		Host                     string `yaml:"host"`
+		Port                     string `yaml:"port"`
+		Debug                    bool   `yaml:"debug"`
+		ReadyTimeoutSec          *int   `yaml:"ready_timeout_sec"`
+		H2C                      bool   `yaml:"h2c"`
+		MaxHeaderBytes           int    `yaml:"max_header_bytes"`
+		MaxURLLength             int    `yaml:"max_url_length"`
+		IdleTimeoutExitSec       int    `yaml:"idle_timeout_exit_sec"`
+		ProxyProtocol            bool   `yaml:"proxy_protocol"`
+		APIPrefix                string `yaml:"api_prefix"`
+		HealthPrefix             string `yaml:"health_prefix"`
+		Maintenance              bool   `yaml:"maintenance"`
+		MaintenanceRetryAfterSec int    `yaml:"maintenance_retry_after_sec"`
 	} `yaml:"server"`
 
+	Admin struct {
+		Listen string `yaml:"listen"`
+	} `yaml:"admin"`
+
 	Cache struct {
-		Dir                string `yaml:"dir"`
-		MaxSizeGB          int64  `yaml:"max_size_gb"`
-		TTLHours           int    `yaml:"ttl_hours"`
-		CleanupIntervalMin int    `yaml:"cleanup_interval_min"`
+		Dir                 string            `yaml:"dir"`
+		MaxSizeGB           int64             `yaml:"max_size_gb"`
+		TTLHours            int               `yaml:"ttl_hours"`
+		CleanupIntervalMin  int               `yaml:"cleanup_interval_min"`
+		FollowRedirects     *bool             `yaml:"follow_redirects"`
+		BypassPatterns      []string          `yaml:"bypass_patterns"`
+		QueryKeyPatterns    []string          `yaml:"query_key_patterns"`
+		ForwardQuery        bool              `yaml:"forward_query"`
+		AllowReadOnly       bool              `yaml:"allow_read_only"`
+		SanityCheck         bool              `yaml:"sanity_check"`
+		SanityFailover      bool              `yaml:"sanity_failover"`
+		ServeStaleOnError   bool              `yaml:"serve_stale_on_error"`
+		MaxStaleHours       int               `yaml:"max_stale_hours"`
+		StatsFile           string            `yaml:"stats_file"`
+		MinFreeBytes        int64             `yaml:"min_free_bytes"`
+		CompressLevel       int               `yaml:"compress_level"`
+		Dirs                map[string]string `yaml:"dirs"`
+		IndexMaxSizeMB      int64             `yaml:"index_max_size_mb"`
+		MaxConcurrentWrites int               `yaml:"max_concurrent_writes"`
+		SizeScanTimeoutSec  int               `yaml:"size_scan_timeout_sec"`
+		TTLByExtensionHours map[string]int    `yaml:"ttl_by_extension_hours"`
 	} `yaml:"cache"`
 
 	Mirrors struct {
@@ -47,6 +79,28 @@ type YAMLConfig struct {
 		Debian      string `yaml:"debian"`
 		CentOS      string `yaml:"centos"`
 		Alpine      string `yaml:"alpine"`
+		Gentoo      string `yaml:"gentoo"`
+		Arch        string `yaml:"arch"`
+		Region      string `yaml:"region"`
+		Geo         struct {
+			TimeoutSec       int `yaml:"timeout_sec"`
+			FailureThreshold int `yaml:"failure_threshold"`
+			CooldownSec      int `yaml:"cooldown_sec"`
+			CacheTTLSec      int `yaml:"cache_ttl_sec"`
+		} `yaml:"geo"`
+		ListFile       string  `yaml:"list_file"`
+		ListMode       string  `yaml:"list_mode"`
+		LazyBenchmark  bool    `yaml:"lazy_benchmark"`
+		RequireHTTPS   bool    `yaml:"require_https"`
+		MinSuccessRate float64 `yaml:"min_success_rate"`
+		AdoptRedirects bool    `yaml:"adopt_redirects"`
+		SameOperator   bool    `yaml:"same_operator_failover"`
+		StickyClients  int     `yaml:"sticky_clients"`
+
+		BadGatewayRetryAfterSec      int `yaml:"bad_gateway_retry_after_sec"`
+		BadGatewayRefreshIntervalSec int `yaml:"bad_gateway_refresh_interval_sec"`
+
+		PathPrefixes map[string]map[string]string `yaml:"path_prefixes"`
 	} `yaml:"mirrors"`
 
 	TLS struct {
@@ -62,6 +116,21 @@ type YAMLConfig struct {
 		TrustedProxies        []string `yaml:"trusted_proxies"`
 	} `yaml:"security"`
 
+	RateLimit struct {
+		BytesPerSecond int64 `yaml:"bytes_per_second"`
+	} `yaml:"rate_limit"`
+
+	DNS struct {
+		Overrides   map[string]string `yaml:"overrides"`
+		Server      string            `yaml:"server"`
+		CacheTTLSec int               `yaml:"cache_ttl_sec"`
+	} `yaml:"dns"`
+
+	Log struct {
+		SampleRate int    `yaml:"sample_rate"`
+		AccessFile string `yaml:"access_file"`
+	} `yaml:"log"`
+
 	Storage struct {
 		Backend string `yaml:"backend"`
 		S3      struct {
@@ -86,6 +155,31 @@ type YAMLConfig struct {
 	// Pointer to distinguish "user did not set" (nil → leave to defaults
 	// or CLI/ENV) from "user explicitly set false" (disable keep-alive).
 	UpstreamKeepAlive *bool `yaml:"upstream_keep_alive"`
+
+	Transport struct {
+		DialTimeoutSec           int                        `yaml:"dial_timeout_sec"`
+		MirrorTLS                map[string]MirrorTLSConfig `yaml:"mirror_tls"`
+		Treat403As404            bool                       `yaml:"treat_403_as_404"`
+		ResponseHeaderTimeoutSec map[string]int             `yaml:"response_header_timeout_sec"`
+	} `yaml:"transport"`
+
+	Proxy struct {
+		StripHeaders     []string          `yaml:"strip_headers"`
+		AddHeaders       map[string]string `yaml:"add_headers"`
+		Via              string            `yaml:"via"`
+		OmitVia          bool              `yaml:"omit_via"`
+		UpstreamIPHeader bool              `yaml:"upstream_ip_header"`
+		Rewrite          *bool             `yaml:"rewrite"`
+	} `yaml:"proxy"`
+
+	Benchmark struct {
+		DistroConcurrency  int    `yaml:"distro_concurrency"`
+		Mode               string `yaml:"mode"`
+		Probe              string `yaml:"probe"`
+		ResultTTLMin       int    `yaml:"result_ttl_min"`
+		ResultsFile        string `yaml:"results_file"`
+		MaxStaleOnStartMin int    `yaml:"max_stale_on_start_min"`
+	} `yaml:"benchmark"`
 }
 
 // LoadConfigFile loads configuration from a YAML file.
@@ -96,13 +190,60 @@ type YAMLConfig struct {
 // search list. Cleaning the path before reading mirrors what FindConfigFile
 // already does and keeps gosec G304 narrow to this single, audited site.
 func LoadConfigFile(path string) (*Config, error) {
+	return LoadConfigFiles(path, "")
+}
+
+// LoadConfigFiles loads the YAML file at path and then every *.yaml and
+// *.yml file in the drop-in directory dropInDir, in lexical order. Each file
+// is decoded on its own and merged over the ones before it with
+// mergeYAMLConfig, using the keys it sets as the explicit mask: a later file
+// wins for every key it sets, even to false or zero, maps (such as
+// cache.dirs) are merged key by key and lists are replaced.
+// Either may be empty or missing; it returns nil when no file was found.
+func LoadConfigFiles(path, dropInDir string) (*Config, error) {
+	var yamlCfg YAMLConfig
+	found := false
+	if path != "" {
+		fileCfg, set, err := decodeConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if fileCfg != nil {
+			mergeYAMLConfig(&yamlCfg, fileCfg, set)
+			found = true
+		}
+	}
+	dropIns, err := dropInFiles(dropInDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dropIn := range dropIns {
+		fileCfg, set, err := decodeConfigFile(dropIn)
+		if err != nil {
+			return nil, fmt.Errorf("drop-in %s: %w", dropIn, err)
+		}
+		if fileCfg != nil {
+			mergeYAMLConfig(&yamlCfg, fileCfg, set)
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return yamlConfigToConfig(&yamlCfg), nil
+}
+
+// decodeConfigFile decodes the YAML file at path into a YAMLConfig of its
+// own and also returns the parsed document, which records the keys the file
+// sets. It returns a nil config if the file does not exist.
+func decodeConfigFile(path string) (*YAMLConfig, *yaml.Node, error) {
 	cleaned := filepath.Clean(path)
 	data, err := os.ReadFile(cleaned) // #nosec G304 -- operator-controlled config path
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, nil // File doesn't exist, not an error
+			return nil, nil, nil // File doesn't exist, not an error
 		}
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
 	// Expand environment variables in the YAML content. We use the
@@ -112,12 +253,43 @@ func LoadConfigFile(path string) (*Config, error) {
 	// instead of seeing a mysterious empty string.
 	expandedData := expandConfigEnv(string(data))
 
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(expandedData), &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
 	var yamlCfg YAMLConfig
-	if err := yaml.Unmarshal([]byte(expandedData), &yamlCfg); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	if err := doc.Decode(&yamlCfg); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	return &yamlCfg, &doc, nil
+}
 
-	return yamlConfigToConfig(&yamlCfg), nil
+// dropInFiles lists the *.yaml and *.yml files in dir, sorted by name.
+// Hidden files, such as editor swap files, are skipped. A missing dir
+// has no drop-ins.
+func dropInFiles(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read config drop-in directory: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if ext := filepath.Ext(name); ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files, nil
 }
 
 // envRefPattern matches ${NAME} or ${NAME:-default} where NAME is a typical
@@ -153,7 +325,39 @@ func expandConfigEnv(src string) string {
 // yamlConfigToConfig converts a YAMLConfig to the internal Config structure.
 func yamlConfigToConfig(yamlCfg *YAMLConfig) *Config {
 	cfg := &Config{
-		Debug:    yamlCfg.Server.Debug,
+		Debug:                 yamlCfg.Server.Debug,
+		H2C:                   yamlCfg.Server.H2C,
+		MaxHeaderBytes:        yamlCfg.Server.MaxHeaderBytes,
+		MaxURLLength:          yamlCfg.Server.MaxURLLength,
+		IdleTimeoutExit:       time.Duration(yamlCfg.Server.IdleTimeoutExitSec) * time.Second,
+		ProxyProtocol:         yamlCfg.Server.ProxyProtocol,
+		APIPrefix:             yamlCfg.Server.APIPrefix,
+		HealthPrefix:          yamlCfg.Server.HealthPrefix,
+		Maintenance:           yamlCfg.Server.Maintenance,
+		MaintenanceRetryAfter: time.Duration(yamlCfg.Server.MaintenanceRetryAfterSec) * time.Second,
+		Transport: TransportConfig{
+			DialTimeout:            time.Duration(yamlCfg.Transport.DialTimeoutSec) * time.Second,
+			MirrorTLS:              yamlCfg.Transport.MirrorTLS,
+			Treat403As404:          yamlCfg.Transport.Treat403As404,
+			ResponseHeaderTimeouts: headerTimeouts(yamlCfg.Transport.ResponseHeaderTimeoutSec),
+		},
+		Proxy: ProxyConfig{
+			StripHeaders:     append([]string(nil), yamlCfg.Proxy.StripHeaders...),
+			AddHeaders:       yamlCfg.Proxy.AddHeaders,
+			Via:              yamlCfg.Proxy.Via,
+			OmitVia:          yamlCfg.Proxy.OmitVia,
+			UpstreamIPHeader: yamlCfg.Proxy.UpstreamIPHeader,
+			DisableRewrite:   yamlCfg.Proxy.Rewrite != nil && !*yamlCfg.Proxy.Rewrite,
+		},
+		Benchmark: BenchmarkConfig{
+			DistroConcurrency: yamlCfg.Benchmark.DistroConcurrency,
+			Mode:              yamlCfg.Benchmark.Mode,
+			Probe:             yamlCfg.Benchmark.Probe,
+			ResultTTL:         time.Duration(yamlCfg.Benchmark.ResultTTLMin) * time.Minute,
+			ResultsFile:       yamlCfg.Benchmark.ResultsFile,
+			MaxStaleOnStart:   time.Duration(yamlCfg.Benchmark.MaxStaleOnStartMin) * time.Minute,
+		},
+		Admin:    AdminConfig{Listen: yamlCfg.Admin.Listen},
 		CacheDir: yamlCfg.Cache.Dir,
 		Mirrors: MirrorConfig{
 			Ubuntu:      yamlCfg.Mirrors.Ubuntu,
@@ -161,11 +365,47 @@ func yamlConfigToConfig(yamlCfg *YAMLConfig) *Config {
 			Debian:      yamlCfg.Mirrors.Debian,
 			CentOS:      yamlCfg.Mirrors.CentOS,
 			Alpine:      yamlCfg.Mirrors.Alpine,
+			Gentoo:      yamlCfg.Mirrors.Gentoo,
+			Arch:        yamlCfg.Mirrors.Arch,
+			Region:      yamlCfg.Mirrors.Region,
+			Geo: GeoConfig{
+				Timeout:          time.Duration(yamlCfg.Mirrors.Geo.TimeoutSec) * time.Second,
+				FailureThreshold: yamlCfg.Mirrors.Geo.FailureThreshold,
+				Cooldown:         time.Duration(yamlCfg.Mirrors.Geo.CooldownSec) * time.Second,
+				CacheTTL:         time.Duration(yamlCfg.Mirrors.Geo.CacheTTLSec) * time.Second,
+			},
+			ListFile:                  yamlCfg.Mirrors.ListFile,
+			ListMode:                  yamlCfg.Mirrors.ListMode,
+			LazyBenchmark:             yamlCfg.Mirrors.LazyBenchmark,
+			RequireHTTPS:              yamlCfg.Mirrors.RequireHTTPS,
+			MinSuccessRate:            yamlCfg.Mirrors.MinSuccessRate,
+			StickyClients:             yamlCfg.Mirrors.StickyClients,
+			AdoptRedirects:            yamlCfg.Mirrors.AdoptRedirects,
+			SameOperatorFailover:      yamlCfg.Mirrors.SameOperator,
+			BadGatewayRetryAfter:      time.Duration(yamlCfg.Mirrors.BadGatewayRetryAfterSec) * time.Second,
+			BadGatewayRefreshInterval: time.Duration(yamlCfg.Mirrors.BadGatewayRefreshIntervalSec) * time.Second,
+			PathPrefixes:              yamlCfg.Mirrors.PathPrefixes,
 		},
 		Cache: CacheConfig{
-			MaxSizeGB:          yamlCfg.Cache.MaxSizeGB,
-			TTLHours:           yamlCfg.Cache.TTLHours,
-			CleanupIntervalMin: yamlCfg.Cache.CleanupIntervalMin,
+			MaxSizeGB:           yamlCfg.Cache.MaxSizeGB,
+			TTLHours:            yamlCfg.Cache.TTLHours,
+			CleanupIntervalMin:  yamlCfg.Cache.CleanupIntervalMin,
+			BypassPatterns:      append([]string(nil), yamlCfg.Cache.BypassPatterns...),
+			QueryKeyPatterns:    append([]string(nil), yamlCfg.Cache.QueryKeyPatterns...),
+			ForwardQuery:        yamlCfg.Cache.ForwardQuery,
+			AllowReadOnly:       yamlCfg.Cache.AllowReadOnly,
+			SanityCheck:         yamlCfg.Cache.SanityCheck,
+			SanityFailover:      yamlCfg.Cache.SanityFailover,
+			ServeStaleOnError:   yamlCfg.Cache.ServeStaleOnError,
+			MaxStale:            time.Duration(yamlCfg.Cache.MaxStaleHours) * time.Hour,
+			StatsFile:           yamlCfg.Cache.StatsFile,
+			MinFreeBytes:        yamlCfg.Cache.MinFreeBytes,
+			CompressLevel:       yamlCfg.Cache.CompressLevel,
+			Dirs:                yamlCfg.Cache.Dirs,
+			IndexMaxSize:        yamlCfg.Cache.IndexMaxSizeMB * 1024 * 1024,
+			MaxConcurrentWrites: yamlCfg.Cache.MaxConcurrentWrites,
+			SizeScanTimeout:     time.Duration(yamlCfg.Cache.SizeScanTimeoutSec) * time.Second,
+			TTLByExtension:      extensionTTLs(yamlCfg.Cache.TTLByExtensionHours),
 		},
 		TLS: TLSConfig{
 			Enabled:  yamlCfg.TLS.Enabled,
@@ -178,6 +418,18 @@ func yamlConfigToConfig(yamlCfg *YAMLConfig) *Config {
 			APIRateLimitPerMinute: yamlCfg.Security.APIRateLimitPerMinute,
 			TrustedProxies:        append([]string(nil), yamlCfg.Security.TrustedProxies...),
 		},
+		RateLimit: RateLimitConfig{
+			BytesPerSecond: yamlCfg.RateLimit.BytesPerSecond,
+		},
+		DNS: DNSConfig{
+			Overrides: yamlCfg.DNS.Overrides,
+			Server:    yamlCfg.DNS.Server,
+			CacheTTL:  time.Duration(yamlCfg.DNS.CacheTTLSec) * time.Second,
+		},
+		Log: LogConfig{
+			SampleRate: yamlCfg.Log.SampleRate,
+			AccessFile: yamlCfg.Log.AccessFile,
+		},
 		Storage: StorageConfig{
 			Backend: yamlCfg.Storage.Backend,
 			S3: S3Config{
@@ -205,9 +457,24 @@ func yamlConfigToConfig(yamlCfg *YAMLConfig) *Config {
 	} else {
 		cfg.UpstreamKeepAlive = true
 	}
+	// server.ready_timeout_sec: nil means "not set" so an explicit 0 can
+	// disable the readiness wait.
+	if yamlCfg.Server.ReadyTimeoutSec != nil {
+		cfg.ReadyTimeout = time.Duration(*yamlCfg.Server.ReadyTimeoutSec) * time.Second
+	} else {
+		cfg.ReadyTimeout = DefaultReadyTimeoutSec * time.Second
+	}
+	// Same default-true treatment for cache.follow_redirects.
+	if yamlCfg.Cache.FollowRedirects != nil {
+		cfg.Cache.FollowRedirects = *yamlCfg.Cache.FollowRedirects
+		cfg.Cache.FollowRedirectsSet = true
+	} else {
+		cfg.Cache.FollowRedirects = true
+	}
 
 	// Convert mode string to int
 	if yamlCfg.Mode != "" {
+		cfg.ModeName = yamlCfg.Mode
 		cfg.Mode = ModeToInt(yamlCfg.Mode)
 	}
 
@@ -241,3 +508,28 @@ func yamlConfigToConfig(yamlCfg *YAMLConfig) *Config {
 
 	return cfg
 }
+
+// headerTimeouts converts transport.response_header_timeout_sec.
+func headerTimeouts(secs map[string]int) map[string]time.Duration {
+	if len(secs) == 0 {
+		return nil
+	}
+	timeouts := make(map[string]time.Duration, len(secs))
+	for name, sec := range secs {
+		timeouts[name] = time.Duration(sec) * time.Second
+	}
+	return timeouts
+}
+
+// extensionTTLs converts cache.ttl_by_extension_hours, keying it by the
+// lower-cased extension with its leading dot.
+func extensionTTLs(hours map[string]int) map[string]time.Duration {
+	if len(hours) == 0 {
+		return nil
+	}
+	ttls := make(map[string]time.Duration, len(hours))
+	for ext, h := range hours {
+		ttls["."+strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")] = time.Duration(h) * time.Hour
+	}
+	return ttls
+}
@@ -15,9 +15,175 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+// writeConfigFile writes content to name in dir.
+func writeConfigFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigFilesDropInsLaterWins(t *testing.T) {
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeConfigFile(t, dir, "apt-proxy.yaml", `
+mode: debian
+cache:
+  max_size_gb: 4
+  dirs:
+    ubuntu: /srv/ubuntu
+log:
+  sample_rate: 5
+`)
+	// Written out of order: files are applied by name, not creation time.
+	writeConfigFile(t, confDir, "20-operator.yml", `
+cache:
+  max_size_gb: 8
+  dirs:
+    debian: /srv/debian-fast
+server:
+  debug: false
+`)
+	writeConfigFile(t, confDir, "10-package.yaml", `
+cache:
+  max_size_gb: 6
+  dirs:
+    debian: /srv/debian
+server:
+  debug: true
+`)
+	writeConfigFile(t, confDir, "30-ignored.conf", "mode: ubuntu\n")
+	writeConfigFile(t, confDir, ".40-swap.yaml", "mode: ubuntu\n")
+
+	cfg, err := LoadConfigFiles(filepath.Join(dir, "apt-proxy.yaml"), confDir)
+	if err != nil {
+		t.Fatalf("LoadConfigFiles() error = %v", err)
+	}
+	if cfg.ModeName != "debian" {
+		t.Errorf("mode = %q, want debian from the base file", cfg.ModeName)
+	}
+	if want := int64(8) * 1024 * 1024 * 1024; cfg.Cache.MaxSize != want {
+		t.Errorf("Cache.MaxSize = %d, want %d from the last drop-in", cfg.Cache.MaxSize, want)
+	}
+	if cfg.Debug {
+		t.Error("Debug = true, want false set by the later drop-in")
+	}
+	if cfg.Log.SampleRate != 5 {
+		t.Errorf("Log.SampleRate = %d, want 5 from the base file", cfg.Log.SampleRate)
+	}
+	if cfg.Cache.Dirs["ubuntu"] != "/srv/ubuntu" || cfg.Cache.Dirs["debian"] != "/srv/debian-fast" {
+		t.Errorf("Cache.Dirs = %v, want ubuntu from the base file and debian from the last drop-in", cfg.Cache.Dirs)
+	}
+}
+
+func TestLoadConfigFilesDropInResetsValues(t *testing.T) {
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeConfigFile(t, dir, "apt-proxy.yaml", `
+mirrors:
+  require_https: true
+  sticky_clients: 3
+  region: eu
+cache:
+  bypass_patterns: ["a", "b"]
+`)
+	writeConfigFile(t, confDir, "10-reset.yaml", `
+mirrors:
+  require_https: false
+  sticky_clients: 0
+cache:
+  bypass_patterns: ["c"]
+`)
+	writeConfigFile(t, confDir, "20-empty.yaml", "")
+
+	cfg, err := LoadConfigFiles(filepath.Join(dir, "apt-proxy.yaml"), confDir)
+	if err != nil {
+		t.Fatalf("LoadConfigFiles() error = %v", err)
+	}
+	if cfg.Mirrors.RequireHTTPS {
+		t.Error("Mirrors.RequireHTTPS = true, want false set by the drop-in")
+	}
+	if cfg.Mirrors.StickyClients != 0 {
+		t.Errorf("Mirrors.StickyClients = %d, want 0 set by the drop-in", cfg.Mirrors.StickyClients)
+	}
+	if cfg.Mirrors.Region != "eu" {
+		t.Errorf("Mirrors.Region = %q, want eu from the base file", cfg.Mirrors.Region)
+	}
+	if got := strings.Join(cfg.Cache.BypassPatterns, ","); got != "c" {
+		t.Errorf("Cache.BypassPatterns = %q, want the drop-in's list to replace the base's", got)
+	}
+}
+
+func TestLoadConfigFilesDropInDisablesFollowRedirects(t *testing.T) {
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeConfigFile(t, dir, "apt-proxy.yaml", "cache:\n  follow_redirects: true\n")
+	writeConfigFile(t, confDir, "10-no-redirects.yaml", "cache:\n  follow_redirects: false\n")
+
+	cfg, err := LoadConfigFiles(filepath.Join(dir, "apt-proxy.yaml"), confDir)
+	if err != nil {
+		t.Fatalf("LoadConfigFiles() error = %v", err)
+	}
+	if cfg.Cache.FollowRedirects {
+		t.Error("Cache.FollowRedirects = true, want false set by the drop-in")
+	}
+
+	// The same false must survive MergeConfigs when it arrives as its own
+	// override rather than being decoded over the base.
+	base, err := LoadConfigFile(filepath.Join(dir, "apt-proxy.yaml"))
+	if err != nil {
+		t.Fatalf("LoadConfigFile() base error = %v", err)
+	}
+	override, err := LoadConfigFile(filepath.Join(confDir, "10-no-redirects.yaml"))
+	if err != nil {
+		t.Fatalf("LoadConfigFile() override error = %v", err)
+	}
+	if MergeConfigs(base, override).Cache.FollowRedirects {
+		t.Error("MergeConfigs() FollowRedirects = true, want the explicit false override")
+	}
+	if !MergeConfigs(base, &Config{}).Cache.FollowRedirects {
+		t.Error("MergeConfigs() with an unset override dropped the base's true")
+	}
+}
+
+func TestLoadConfigFilesWithoutFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := LoadConfigFiles(filepath.Join(dir, "apt-proxy.yaml"), filepath.Join(dir, "conf.d"))
+	if err != nil || cfg != nil {
+		t.Errorf("LoadConfigFiles() of missing files = %v, %v; want nil, nil", cfg, err)
+	}
+
+	writeConfigFile(t, dir, "50-only.yaml", "mode: ubuntu\n")
+	cfg, err = LoadConfigFiles("", dir)
+	if err != nil || cfg == nil || cfg.ModeName != "ubuntu" {
+		t.Errorf("LoadConfigFiles() of a drop-in alone = %+v, %v; want mode ubuntu", cfg, err)
+	}
+}
+
+func TestLoadConfigFilesNamesBadDropIn(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFile(t, dir, "10-bad.yaml", "cache: [\n")
+	_, err := LoadConfigFiles("", dir)
+	if err == nil || !strings.Contains(err.Error(), "10-bad.yaml") {
+		t.Errorf("LoadConfigFiles() error = %v, want one naming 10-bad.yaml", err)
+	}
+}
+
 func TestExpandConfigEnv_StrictBraceForm(t *testing.T) {
 	t.Setenv("APT_PROXY_TEST_USER", "alice")
 
@@ -0,0 +1,31 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config starter configuration template.
+package config
+
+import _ "embed"
+
+// defaultConfigTemplate is the commented starter apt-proxy.yaml. The copy
+// in examples/config-template must stay identical, and every YAMLConfig
+// key must appear in it; template_test.go checks both.
+//
+//go:embed default-config.yaml
+var defaultConfigTemplate string
+
+// DefaultConfigTemplate returns a fully commented apt-proxy.yaml listing
+// every supported key with its default value and a short description.
+func DefaultConfigTemplate() string {
+	return defaultConfigTemplate
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// yamlKeys returns the dotted path of every key of a struct of type t,
+// as named by its yaml tags.
+func yamlKeys(t reflect.Type, prefix string, keys map[string]bool) {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		keys[prefix+name] = true
+		yamlKeys(t.Field(i).Type, prefix+name+".", keys)
+	}
+}
+
+// templateKeyLine matches a key in the template, set or commented out:
+// "  key: value" or "  # key: value", with nested keys indented further.
+var templateKeyLine = regexp.MustCompile(`^( *)(?:# ?( *))?(?:- )?([a-z0-9_]+):(?: |$)`)
+
+// templateKeys returns the dotted path of every key in the template.
+func templateKeys(template string) map[string]bool {
+	keys := map[string]bool{}
+	type level struct {
+		indent int
+		name   string
+	}
+	var stack []level
+	for _, line := range strings.Split(template, "\n") {
+		m := templateKeyLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		indent := len(m[1]) + len(m[2])
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		path := m[3]
+		if len(stack) > 0 {
+			path = stack[len(stack)-1].name + "." + m[3]
+		}
+		keys[path] = true
+		stack = append(stack, level{indent, path})
+	}
+	return keys
+}
+
+func TestDefaultConfigTemplateLoads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apt-proxy.yaml")
+	if err := os.WriteFile(path, []byte(DefaultConfigTemplate()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("LoadConfigFile() of the default template error = %v", err)
+	}
+	if cfg == nil {
+		t.Fatal("LoadConfigFile() of the default template returned no config")
+	}
+}
+
+func TestDefaultConfigTemplateListsEveryKey(t *testing.T) {
+	want := map[string]bool{}
+	yamlKeys(reflect.TypeOf(YAMLConfig{}), "", want)
+	got := templateKeys(DefaultConfigTemplate())
+	for key := range want {
+		if !got[key] {
+			t.Errorf("the default config template does not mention %s", key)
+		}
+	}
+}
+
+func TestDefaultConfigTemplateMatchesExample(t *testing.T) {
+	example, err := os.ReadFile(filepath.Join("..", "..", "examples", "config-template", "apt-proxy.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(example) != DefaultConfigTemplate() {
+		t.Error("examples/config-template/apt-proxy.yaml differs from internal/config/default-config.yaml; keep them identical")
+	}
+}
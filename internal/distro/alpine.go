@@ -34,9 +34,14 @@ var AlpineCustomMirrors = []string{}
 
 var BuiltinAlpineMirrors = GenerateBuildInList(AlpineOfficialMirrors, AlpineCustomMirrors)
 
+// AlpineDefaultCacheRules are evaluated in order (first match wins). The
+// edge branch (including edge/testing) republishes its APKINDEX many times
+// a day, so it gets a much shorter TTL than release indexes. Package files
+// carry their version in the name and never change once published.
 var AlpineDefaultCacheRules = []Rule{
-	{Pattern: regexp.MustCompile(`APKINDEX.tar.gz$`), CacheControl: `max-age=3600`, Rewrite: true, OS: TypeAlpine},
-	{Pattern: regexp.MustCompile(`tar.gz$`), CacheControl: `max-age=3600`, Rewrite: true, OS: TypeAlpine},
-	{Pattern: regexp.MustCompile(`apk$`), CacheControl: `max-age=3600`, Rewrite: true, OS: TypeAlpine},
+	{Pattern: regexp.MustCompile(`/edge/.+/APKINDEX\.tar\.gz$`), CacheControl: `max-age=300`, Rewrite: true, OS: TypeAlpine},
+	{Pattern: regexp.MustCompile(`APKINDEX\.tar\.gz$`), CacheControl: `max-age=3600`, Rewrite: true, OS: TypeAlpine},
+	{Pattern: regexp.MustCompile(`\.apk$`), CacheControl: `max-age=100000`, Rewrite: true, OS: TypeAlpine},
+	{Pattern: regexp.MustCompile(`tar\.gz$`), CacheControl: `max-age=3600`, Rewrite: true, OS: TypeAlpine},
 	{Pattern: regexp.MustCompile(`.*`), CacheControl: `max-age=100000`, Rewrite: true, OS: TypeAlpine},
 }
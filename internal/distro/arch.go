@@ -0,0 +1,49 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distro
+
+import "regexp"
+
+// ArchHostPattern matches pacman's $repo/os/$arch layout under the
+// /archlinux/ prefix every Arch mirror uses.
+var ArchHostPattern = regexp.MustCompile(`/archlinux/(.+)$`)
+
+// ArchBenchmarkURL is the sync timestamp at the root of every mirror.
+const ArchBenchmarkURL = "lastupdate"
+
+// https://archlinux.org/mirrorlist/ 2024.06.01
+var ArchOfficialMirrors = []string{
+	"mirrors.tuna.tsinghua.edu.cn/archlinux/",
+	"mirrors.ustc.edu.cn/archlinux/",
+	"mirrors.bfsu.edu.cn/archlinux/",
+	"mirrors.aliyun.com/archlinux/",
+	"mirrors.kernel.org/archlinux/",
+}
+
+var ArchCustomMirrors = []string{}
+
+var BuiltinArchMirrors = GenerateBuildInList(ArchOfficialMirrors, ArchCustomMirrors)
+
+// ArchDefaultCacheRules are evaluated in order (first match wins). Package
+// files carry their version in the name and never change once published,
+// while the repo databases (core.db, extra.files, ...) are rewritten on
+// every repo update, so they only get a few minutes: a stale database
+// points pacman at package versions the mirror has already removed.
+var ArchDefaultCacheRules = []Rule{
+	{Pattern: regexp.MustCompile(`\.pkg\.tar\.(zst|xz)(\.sig)?$`), CacheControl: `max-age=100000`, Rewrite: true, OS: TypeArch},
+	{Pattern: regexp.MustCompile(`\.(db|files)(\.tar\.(gz|xz|zst))?(\.sig)?$`), CacheControl: `max-age=300`, Rewrite: true, OS: TypeArch},
+	{Pattern: regexp.MustCompile(`last(update|sync)$`), CacheControl: `max-age=60`, Rewrite: true, OS: TypeArch},
+	{Pattern: regexp.MustCompile(`.*`), CacheControl: `max-age=3600`, Rewrite: true, OS: TypeArch},
+}
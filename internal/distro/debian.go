@@ -22,6 +22,14 @@ const (
 
 var DebianHostPattern = regexp.MustCompile(`/debian(-security)?/(.+)$`)
 
+// DebianSecurityHosts serve the security archive at their root as well as
+// under /debian-security/, so "deb http://security.debian.org/
+// bookworm-security main" asks for /dists/... with no segment for
+// DebianHostPattern to match. Other Debian hosts, such as deb.debian.org,
+// its CDN front-ends (cdn-fastly.deb.debian.org) and the debian.net
+// redirectors, name the archive in the path and need no such help.
+var DebianSecurityHosts = []string{"security.debian.org", "security-cdn.debian.org"}
+
 // https://www.debian.org/mirror/list 2022.11.19
 // Sites that contain protocol headers, restrict access to resources using that protocol
 var DebianOfficialMirrors = []string{
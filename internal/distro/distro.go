@@ -14,13 +14,16 @@
 
 // Package distro provides distribution-specific definitions and caching rules
 // for apt-proxy. This package contains constants, types, and configurations
-// for supported Linux distributions (Ubuntu, Debian, CentOS, Alpine).
+// for supported Linux distributions (Ubuntu, Debian, CentOS, Alpine, Gentoo, Arch Linux).
 package distro
 
 import (
 	"fmt"
+	neturl "net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Distribution name constants
@@ -31,6 +34,8 @@ const (
 	DistroDebian      string = "debian"
 	DistroCentOS      string = "centos"
 	DistroAlpine      string = "alpine"
+	DistroGentoo      string = "gentoo"
+	DistroArch        string = "arch"
 )
 
 // Distribution type constants
@@ -41,6 +46,8 @@ const (
 	TypeDebian      int = 3
 	TypeCentOS      int = 4
 	TypeAlpine      int = 5
+	TypeGentoo      int = 6
+	TypeArch        int = 7
 )
 
 // DistributionName returns the distribution ID string for the given type.
@@ -57,11 +64,49 @@ func DistributionName(distType int) string {
 		return DistroCentOS
 	case TypeAlpine:
 		return DistroAlpine
+	case TypeGentoo:
+		return DistroGentoo
+	case TypeArch:
+		return DistroArch
 	default:
 		return ""
 	}
 }
 
+// OfficialDomains returns the domains the distribution's own archives are
+// served from, such as ubuntu.com for archive.ubuntu.com and
+// security.ubuntu.com. Returns nil for unknown types.
+func OfficialDomains(distType int) []string {
+	switch distType {
+	case TypeUbuntu, TypeUbuntuPorts:
+		return []string{"ubuntu.com"}
+	case TypeDebian:
+		return []string{"debian.org"}
+	case TypeCentOS:
+		return []string{"centos.org"}
+	case TypeAlpine:
+		return []string{"alpinelinux.org"}
+	case TypeGentoo:
+		return []string{"gentoo.org"}
+	case TypeArch:
+		return []string{"archlinux.org"}
+	default:
+		return nil
+	}
+}
+
+// IsOfficialHost reports whether host, a bare hostname without a port, is
+// one of the distribution's OfficialDomains or a subdomain of one.
+func IsOfficialHost(distType int, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range OfficialDomains(distType) {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
 // Rule defines a caching rule for package files
 type Rule struct {
 	OS           int
@@ -75,12 +120,45 @@ func (r *Rule) String() string {
 		r.Pattern.String(), r.CacheControl, r.Rewrite)
 }
 
+// IndexMaxAge separates index rules from package rules: a rule caching
+// for less than this (Release, Packages, APKINDEX, repomd.xml, ...)
+// matches index files, which change often and are revalidated, and any
+// other rule matches package files.
+const IndexMaxAge = 24 * time.Hour
+
+// MaxAge returns the max-age directive of the rule's CacheControl, and
+// false when it has none.
+func (r *Rule) MaxAge() (time.Duration, bool) {
+	for _, directive := range splitDirectives(r.CacheControl) {
+		name, arg, ok := strings.Cut(strings.TrimSpace(directive), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "max-age") {
+			continue
+		}
+		seconds, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(arg), `"`), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// IsIndex reports whether the rule matches index files: its max-age is
+// below IndexMaxAge.
+func (r *Rule) IsIndex() bool {
+	maxAge, ok := r.MaxAge()
+	return ok && maxAge < IndexMaxAge
+}
+
 // URLWithAlias represents a mirror URL with its alias and metadata.
 // Scheme is "http", "https", or "" (unknown / let downstream pick the default).
+// Region is the lower-case region hint derived from the hostname ("" when
+// the host carries no recognisable country/region marker).
 type URLWithAlias struct {
 	URL       string
 	Alias     string
 	Scheme    string
+	Region    string
 	Official  bool
 	Bandwidth int64
 }
@@ -96,18 +174,94 @@ func (u URLWithAlias) HTTPS() bool { return u.Scheme == "https" }
 
 // GenerateAliasFromURL generates an alias from a URL
 func GenerateAliasFromURL(url string) string {
+	alias, _ := GenerateAliasAndRegionFromURL(url)
+	return alias
+}
+
+// GenerateAliasAndRegionFromURL returns the alias GenerateAliasFromURL would
+// produce together with the region derived from the hostname. The alias keeps
+// its historical "cn:" namespace (the built-in lists are all CN mirrors and
+// operators reference them as e.g. "cn:tsinghua"); the region is reported
+// separately so region-aware selection does not depend on that prefix.
+func GenerateAliasAndRegionFromURL(url string) (alias, region string) {
 	pureHost := urlSchemeAndPathRegex.ReplaceAllString(url, "")
 	tldRemoved := tldRemovalRegex.ReplaceAllString(pureHost, "")
 	group := strings.Split(tldRemoved, ".")
-	alias := group[len(group)-1]
-	return "cn:" + alias
+	return "cn:" + group[len(group)-1], regionFromLabels(hostLabels(url))
+}
+
+// hostLabels returns the lower-cased dot-separated labels of the mirror
+// URL's hostname, without port or userinfo. A bare host is accepted too.
+func hostLabels(rawURL string) []string {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "//" + rawURL
+	}
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return nil
+	}
+	return strings.Split(host, ".")
+}
+
+// regionFromLabels derives a region hint from hostname labels: a two-letter
+// country-code TLD ("mirrors.ustc.edu.cn" -> "cn") wins, otherwise the first
+// two-letter subdomain label ("us.archive.ubuntu.com" -> "us",
+// "ftp.de.debian.org" -> "de"). Returns "" if neither is present.
+func regionFromLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	if tld := labels[len(labels)-1]; isRegionCode(tld) {
+		return tld
+	}
+	for _, label := range labels[:len(labels)-2] {
+		if isRegionCode(label) {
+			return label
+		}
+	}
+	return ""
+}
+
+func isRegionCode(s string) bool {
+	return len(s) == 2 && s[0] >= 'a' && s[0] <= 'z' && s[1] >= 'a' && s[1] <= 'z'
+}
+
+// MatchesRegion reports whether the mirror URL belongs to region: its
+// country-code TLD is the region, or a subdomain label is the region or
+// starts with it followed by a dash, so broader hints such as "eu" match
+// "mirror.eu.example.org" and "eu-west.example.net". Only whole labels
+// count: "de" does not match "deb.debian.org", nor does a region matching
+// the registered domain name itself ("eu.org"). An empty region never
+// matches.
+func MatchesRegion(url, region string) bool {
+	region = strings.ToLower(strings.TrimSpace(region))
+	if region == "" {
+		return false
+	}
+	labels := hostLabels(url)
+	if len(labels) < 2 {
+		return false
+	}
+	if labels[len(labels)-1] == region || regionFromLabels(labels) == region {
+		return true
+	}
+	for _, label := range labels[:len(labels)-2] {
+		if label == region || strings.HasPrefix(label, region+"-") {
+			return true
+		}
+	}
+	return false
 }
 
 // GenerateBuiltinMirrorItem creates a URLWithAlias from a URL.
 func GenerateBuiltinMirrorItem(url string, official bool) URLWithAlias {
 	var mirror URLWithAlias
 	mirror.Official = official
-	mirror.Alias = GenerateAliasFromURL(url)
+	mirror.Alias, mirror.Region = GenerateAliasAndRegionFromURL(url)
 
 	switch {
 	case strings.HasPrefix(url, "http://"):
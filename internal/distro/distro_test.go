@@ -19,6 +19,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/soulteary/apt-proxy/internal/distro"
 )
@@ -36,6 +37,51 @@ func TestRuleToString(t *testing.T) {
 	}
 }
 
+func TestRuleIsIndex(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		maxAge       time.Duration
+		index        bool
+	}{
+		{"max-age=3600", time.Hour, true},
+		{"public, max-age=21600", 6 * time.Hour, true},
+		{"max-age=100000", 100000 * time.Second, false},
+		{"no-cache", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		r := distro.Rule{Pattern: regexp.MustCompile(`.*`), CacheControl: tt.cacheControl}
+		if got, _ := r.MaxAge(); got != tt.maxAge {
+			t.Errorf("MaxAge(%q) = %s, want %s", tt.cacheControl, got, tt.maxAge)
+		}
+		if got := r.IsIndex(); got != tt.index {
+			t.Errorf("IsIndex(%q) = %v, want %v", tt.cacheControl, got, tt.index)
+		}
+	}
+}
+
+func TestIsOfficialHost(t *testing.T) {
+	for _, tt := range []struct {
+		distType int
+		host     string
+		want     bool
+	}{
+		{distro.TypeUbuntu, "archive.ubuntu.com", true},
+		{distro.TypeUbuntu, "DE.Archive.Ubuntu.com.", true},
+		{distro.TypeUbuntuPorts, "ports.ubuntu.com", true},
+		{distro.TypeDebian, "deb.debian.org", true},
+		{distro.TypeDebian, "archive.ubuntu.com", false},
+		{distro.TypeDebian, "notdebian.org", false},
+		{distro.TypeDebian, "debian.org.example.com", false},
+		{distro.TypeUbuntu, "169.254.169.254", false},
+		{distro.TypeAllDistros, "deb.debian.org", false},
+	} {
+		if got := distro.IsOfficialHost(tt.distType, tt.host); got != tt.want {
+			t.Errorf("IsOfficialHost(%d, %q) = %v, want %v", tt.distType, tt.host, got, tt.want)
+		}
+	}
+}
+
 func TestGenerateAliasFromURL(t *testing.T) {
 	if distro.GenerateAliasFromURL("http://mirrors.cn99.com/ubuntu/") != "cn:cn99" {
 		t.Fatal("generate alias from url failed")
@@ -50,6 +96,59 @@ func TestGenerateAliasFromURL(t *testing.T) {
 	}
 }
 
+func TestGenerateAliasAndRegionFromURL(t *testing.T) {
+	tests := []struct {
+		url        string
+		wantAlias  string
+		wantRegion string
+	}{
+		{"https://mirrors.tuna.tsinghua.edu.cn/ubuntu/", "cn:tsinghua", "cn"},
+		{"http://mirrors.cn99.com/ubuntu/", "cn:cn99", ""},
+		{"http://us.archive.ubuntu.com/ubuntu/", "cn:ubuntu", "us"},
+		{"https://ftp.de.debian.org/debian/", "cn:debian", "de"},
+		{"mirrors.cnnic.cn/ubuntu/", "cn:cnnic", "cn"},
+	}
+	for _, tt := range tests {
+		alias, region := distro.GenerateAliasAndRegionFromURL(tt.url)
+		if alias != tt.wantAlias || region != tt.wantRegion {
+			t.Errorf("GenerateAliasAndRegionFromURL(%q) = (%q, %q), want (%q, %q)",
+				tt.url, alias, region, tt.wantAlias, tt.wantRegion)
+		}
+	}
+}
+
+func TestMatchesRegion(t *testing.T) {
+	tests := []struct {
+		url    string
+		region string
+		want   bool
+	}{
+		{"https://mirrors.ustc.edu.cn/ubuntu/", "cn", true},
+		{"https://mirrors.ustc.edu.cn/ubuntu/", "CN", true},
+		{"http://us.archive.ubuntu.com/ubuntu/", "us", true},
+		{"https://mirror.eu.example.org/debian/", "eu", true},
+		{"https://eu-west.example.net/debian/", "eu", true},
+		{"https://mirrors.ustc.edu.cn/ubuntu/", "us", false},
+		{"https://mirrors.ustc.edu.cn/ubuntu/", "", false},
+		{"https://user@ftp.de.debian.org:8443/debian/", "de", true},
+		{"https://eu-west-1.example.net/debian/", "eu", true},
+		// Only whole labels count, not substrings of them.
+		{"https://deb.debian.org/debian/", "de", false},
+		{"https://mirrors.europe.example.org/debian/", "eu", false},
+		{"https://mirror-us.example.com/ubuntu/", "us", false},
+		{"https://usmirror.example.com/ubuntu/", "us", false},
+		{"https://mirror.example.com/us/ubuntu/", "us", false},
+		// The registered domain name is not a region hint.
+		{"https://mirror.eu.org/debian/", "eu", false},
+		{"https://mirror.example.cn.com/ubuntu/", "cn", false},
+	}
+	for _, tt := range tests {
+		if got := distro.MatchesRegion(tt.url, tt.region); got != tt.want {
+			t.Errorf("MatchesRegion(%q, %q) = %v, want %v", tt.url, tt.region, got, tt.want)
+		}
+	}
+}
+
 func TestGenerateBuildInMirorItem(t *testing.T) {
 	mirror := distro.GenerateBuildInMirorItem("http://mirrors.tuna.tsinghua.edu.cn/ubuntu/", true)
 	if (mirror.HTTP() != true || mirror.HTTPS() != false) || mirror.Official != true {
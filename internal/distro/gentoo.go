@@ -0,0 +1,48 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distro
+
+import "regexp"
+
+var GentooHostPattern = regexp.MustCompile(`/gentoo/(.+)$`)
+
+// GentooBenchmarkURL is the distfiles layout description every mirror
+// publishes (GLEP 75), small and always present.
+const GentooBenchmarkURL = "distfiles/layout.conf"
+
+// https://www.gentoo.org/downloads/mirrors/ 2024.06.01
+var GentooOfficialMirrors = []string{
+	"mirrors.tuna.tsinghua.edu.cn/gentoo/",
+	"mirrors.ustc.edu.cn/gentoo/",
+	"mirrors.bfsu.edu.cn/gentoo/",
+	"mirrors.aliyun.com/gentoo/",
+	"distfiles.gentoo.org/",
+}
+
+var GentooCustomMirrors = []string{}
+
+var BuiltinGentooMirrors = GenerateBuildInList(GentooOfficialMirrors, GentooCustomMirrors)
+
+// GentooDefaultCacheRules are evaluated in order (first match wins).
+// Distfiles are stored under their name, never replaced, and checked by
+// Portage against the Manifest digests, so source archives are cached for a
+// year. The "latest" pointers (gentoo-latest.tar.xz snapshots, stage3
+// latest-*.txt) and layout.conf do change and keep a short TTL.
+var GentooDefaultCacheRules = []Rule{
+	{Pattern: regexp.MustCompile(`latest[^/]*$`), CacheControl: `max-age=3600`, Rewrite: true, OS: TypeGentoo},
+	{Pattern: regexp.MustCompile(`/distfiles/layout\.conf$`), CacheControl: `max-age=3600`, Rewrite: true, OS: TypeGentoo},
+	{Pattern: regexp.MustCompile(`/distfiles/.+\.tar\.[^/.]+$`), CacheControl: `max-age=31536000`, Rewrite: true, OS: TypeGentoo},
+	{Pattern: regexp.MustCompile(`.*`), CacheControl: `max-age=100000`, Rewrite: true, OS: TypeGentoo},
+}
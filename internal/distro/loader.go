@@ -19,7 +19,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"regexp"
 
 	"gopkg.in/yaml.v3"
 )
@@ -70,6 +69,22 @@ func NewLoader(configPath string) *Loader {
 
 // Load loads distribution configurations from the configured file
 func (l *Loader) Load() (*DistributionsConfig, error) {
+	config, err := l.Parse()
+	if err != nil || config == nil {
+		return nil, err
+	}
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid distribution config: %w", errs)
+	}
+
+	l.config = config
+	return config, nil
+}
+
+// Parse reads and parses the configured file like Load, without
+// validating the result, so callers can report every problem Validate
+// finds. It returns nil, nil when no file is configured or found.
+func (l *Loader) Parse() (*DistributionsConfig, error) {
 	if l.configPath == "" {
 		// Try default paths
 		defaultPaths := []string{
@@ -102,50 +117,13 @@ func (l *Loader) Load() (*DistributionsConfig, error) {
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse distribution config: %w", err)
 	}
-
-	// Validate and compile regex patterns
-	for i := range config.Distributions {
-		dist := &config.Distributions[i]
-		if err := l.validateDistribution(dist); err != nil {
-			return nil, fmt.Errorf("invalid distribution config for %s: %w", dist.ID, err)
-		}
-	}
-
-	l.config = &config
 	return &config, nil
 }
 
-// validateDistribution validates a distribution configuration
-func (l *Loader) validateDistribution(dist *DistributionConfig) error {
-	if dist.ID == "" {
-		return fmt.Errorf("distribution ID is required")
-	}
-	if dist.Name == "" {
-		return fmt.Errorf("distribution name is required")
-	}
-	if dist.URLPattern == "" {
-		return fmt.Errorf("URL pattern is required")
-	}
-	if dist.BenchmarkURL == "" {
-		return fmt.Errorf("benchmark URL is required")
-	}
-
-	// Validate URL pattern is a valid regex
-	if _, err := regexp.Compile(dist.URLPattern); err != nil {
-		return fmt.Errorf("invalid URL pattern regex: %w", err)
-	}
-
-	// Validate cache rule patterns
-	for i, rule := range dist.CacheRules {
-		if rule.Pattern == "" {
-			return fmt.Errorf("cache rule %d: pattern is required", i)
-		}
-		if _, err := regexp.Compile(rule.Pattern); err != nil {
-			return fmt.Errorf("cache rule %d: invalid pattern regex: %w", i, err)
-		}
-	}
-
-	return nil
+// Path returns the file the loader reads: the configured path, or the
+// one found on the default search paths once Load or Parse ran.
+func (l *Loader) Path() string {
+	return l.configPath
 }
 
 // GetConfig returns the loaded configuration
@@ -135,8 +135,8 @@ func TestLoaderLoadNoPath(t *testing.T) {
 }
 
 // TestLoaderValidateDistribution covers each individual error branch
-// of validateDistribution by feeding minimal-but-broken YAML through
-// Load (which calls validateDistribution per entry).
+// of the per-entry checks by feeding minimal-but-broken YAML through
+// Load (which runs DistributionsConfig.Validate).
 func TestLoaderValidateDistribution(t *testing.T) {
 	cases := []struct {
 		name    string
@@ -291,3 +291,43 @@ func TestRegistryReloadInvalidYAML(t *testing.T) {
 		t.Error("built-in Ubuntu missing after a failed Reload (state was clobbered)")
 	}
 }
+
+// TestRegistryReloadBadEntryKeepsRegistry asserts that one entry failing
+// to register leaves the whole previous set in place, good entries
+// included, so nothing built from the registry goes out of step with it.
+func TestRegistryReloadBadEntryKeepsRegistry(t *testing.T) {
+	good := `distributions:
+  - id: customdistro
+    name: Custom
+    type: 42
+    url_pattern: "/customdistro/(.+)$"
+    benchmark_url: "/customdistro/test"
+`
+	reg := NewBuiltinRegistry()
+	if err := reg.Reload(writeTempYAML(t, good)); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	bad := `distributions:
+  - id: other
+    name: Other
+    type: 43
+    url_pattern: "/other/(.+)$"
+    benchmark_url: "/other/test"
+  - id: clash
+    name: Clash
+    type: 1
+    url_pattern: "/clash/(.+)$"
+    benchmark_url: "/clash/test"
+`
+	err := reg.Reload(writeTempYAML(t, bad))
+	if err == nil || !strings.Contains(err.Error(), "clash") {
+		t.Fatalf("Reload error = %v, want the clash entry's", err)
+	}
+	if _, ok := reg.GetByType(42); !ok {
+		t.Error("previous custom distribution lost after a failed Reload")
+	}
+	if _, ok := reg.GetByType(43); ok {
+		t.Error("good entry of the failed Reload was applied")
+	}
+}
@@ -236,6 +236,24 @@ func RegisterBuiltins(reg *Registry) {
 			CacheRules:   AlpineDefaultCacheRules,
 			Mirrors:      BuiltinAlpineMirrors,
 		},
+		{
+			ID:           DistroGentoo,
+			Name:         "Gentoo",
+			Type:         TypeGentoo,
+			URLPattern:   GentooHostPattern,
+			BenchmarkURL: GentooBenchmarkURL,
+			CacheRules:   GentooDefaultCacheRules,
+			Mirrors:      BuiltinGentooMirrors,
+		},
+		{
+			ID:           DistroArch,
+			Name:         "Arch Linux",
+			Type:         TypeArch,
+			URLPattern:   ArchHostPattern,
+			BenchmarkURL: ArchBenchmarkURL,
+			CacheRules:   ArchDefaultCacheRules,
+			Mirrors:      BuiltinArchMirrors,
+		},
 	}
 	for _, d := range builtins {
 		if err := reg.Register(d); err != nil {
@@ -308,11 +326,11 @@ func (r *Registry) HostPatternMap() map[*regexp.Regexp][]Rule {
 // search paths inside Loader.Load are used.
 //
 // Errors loading or registering individual distributions are returned (joined)
-// so callers can surface them to operators. The registry is only mutated after
-// a successful YAML load: a parse/regex error preserves the previous registry
-// state. Per-entry Register failures are accumulated but do not roll back
-// previously-applied entries (which would require a deep clone of the
-// registry); built-in entries are always reapplied first.
+// so callers can surface them to operators. The new set is assembled in a
+// staging registry and only swapped in, under a single lock, when every
+// entry registered: on any error r keeps its previous distributions, so
+// routing built from them stays in step with the registry, and concurrent
+// readers never observe a half-cleared registry.
 //
 // Safe to call at startup and on SIGHUP/API reload.
 func (r *Registry) Reload(configPath string) error {
@@ -322,22 +340,25 @@ func (r *Registry) Reload(configPath string) error {
 		return fmt.Errorf("loading distributions config: %w", err)
 	}
 
-	r.Clear()
-	RegisterBuiltins(r)
-
-	if cfg == nil {
-		return nil
-	}
+	staging := NewBuiltinRegistry()
 
 	var errs []error
-	for i := range cfg.Distributions {
-		if loadErr := r.LoadFromConfig(&cfg.Distributions[i]); loadErr != nil {
-			errs = append(errs, fmt.Errorf("registering %s: %w",
-				cfg.Distributions[i].ID, loadErr))
+	if cfg != nil {
+		for i := range cfg.Distributions {
+			if loadErr := staging.LoadFromConfig(&cfg.Distributions[i]); loadErr != nil {
+				errs = append(errs, fmt.Errorf("registering %s: %w",
+					cfg.Distributions[i].ID, loadErr))
+			}
 		}
 	}
+
 	if len(errs) > 0 {
 		return errors.Join(errs...)
 	}
+
+	r.mu.Lock()
+	r.distributions = staging.distributions
+	r.types = staging.types
+	r.mu.Unlock()
 	return nil
 }
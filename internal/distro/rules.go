@@ -28,15 +28,37 @@ var debStyleCachePatterns = []struct {
 	{regexp.MustCompile(`udeb$`), `max-age=100000`},
 	{regexp.MustCompile(`InRelease$`), `max-age=3600`},
 	{regexp.MustCompile(`DiffIndex$`), `max-age=3600`},
+	// pdiffs: <index>.diff/Index lists the patches from older versions of
+	// an index to the one InRelease names, so it must not outlive the
+	// InRelease it goes with, or apt finds a hash mismatch and downloads
+	// the full index. The patches themselves are named after the versions
+	// they join and never change.
+	{regexp.MustCompile(`\.diff/Index$`), `max-age=300`},
+	{regexp.MustCompile(`\.diff/[^/]+\.gz$`), `max-age=100000`},
 	{regexp.MustCompile(`PackagesIndex$`), `max-age=3600`},
-	{regexp.MustCompile(`Packages\.(bz2|gz|lzma)$`), `max-age=3600`},
+	{regexp.MustCompile(`Packages\.(bz2|gz|lzma|xz|zst)$`), `max-age=3600`},
 	{regexp.MustCompile(`SourcesIndex$`), `max-age=3600`},
-	{regexp.MustCompile(`Sources\.(bz2|gz|lzma)$`), `max-age=3600`},
+	{regexp.MustCompile(`Sources\.(bz2|gz|lzma|xz|zst)$`), `max-age=3600`},
 	{regexp.MustCompile(`Release(\.gpg)?$`), `max-age=3600`},
-	{regexp.MustCompile(`Translation-(en|fr)\.(gz|bz2|bzip2|lzma)$`), `max-age=3600`},
+	// Translation-<lang>[_<REGION>] for every locale apt is set up for.
+	{regexp.MustCompile(`Translation-[a-z]{2}(_[A-Z]{2})?\.(gz|bz2|bzip2|xz|lzma|zst)$`), `max-age=3600`},
+	// Contents-<arch> (apt-file, command-not-found) are large and only
+	// change when the suite is republished, so cache them for longer.
+	{regexp.MustCompile(`Contents-.*\.(gz|xz)$`), `max-age=21600`},
 	{regexp.MustCompile(`\/by-hash\/`), `max-age=3600`},
 }
 
+// ubuntuCachePatterns are cached for Ubuntu and Ubuntu Ports on top of
+// debStyleCachePatterns: the command-not-found databases Ubuntu publishes
+// beside each component's indexes, dists/<suite>/<component>/cnf/
+// Commands-<arch>.xz, which apt fetches with them on apt update.
+var ubuntuCachePatterns = []struct {
+	pattern      *regexp.Regexp
+	cacheControl string
+}{
+	{regexp.MustCompile(`/cnf/Commands-[a-z0-9]+(\.(gz|xz))?$`), `max-age=3600`},
+}
+
 // newDebStyleRules returns a fresh set of cache rules for the given OS type.
 // Each call returns a new slice so callers can mutate freely without affecting
 // the canonical template.
@@ -52,3 +74,18 @@ func newDebStyleRules(osType int) []Rule {
 	}
 	return rules
 }
+
+// newUbuntuStyleRules returns newDebStyleRules(osType) followed by the
+// Ubuntu-only ubuntuCachePatterns.
+func newUbuntuStyleRules(osType int) []Rule {
+	rules := newDebStyleRules(osType)
+	for _, p := range ubuntuCachePatterns {
+		rules = append(rules, Rule{
+			OS:           osType,
+			Pattern:      p.pattern,
+			CacheControl: p.cacheControl,
+			Rewrite:      true,
+		})
+	}
+	return rules
+}
@@ -64,4 +64,4 @@ var UbuntuPortsCustomMirrors = []string{
 
 var BuiltinUbuntuPortsMirrors = GenerateBuildInList(UbuntuPortsOfficialMirrors, UbuntuPortsCustomMirrors)
 
-var UbuntuPortsDefaultCacheRules = newDebStyleRules(TypeUbuntuPorts)
+var UbuntuPortsDefaultCacheRules = newUbuntuStyleRules(TypeUbuntuPorts)
@@ -25,6 +25,16 @@ const (
 
 var UbuntuHostPattern = regexp.MustCompile(`/ubuntu/(.+)$`)
 
+// UbuntuDdebsHost serves Ubuntu's debug symbol packages (.ddeb). It is a
+// separate archive that regular Ubuntu mirrors do not carry. Its packages
+// are cached by the `deb$` rule, like .deb files.
+const UbuntuDdebsHost = "ddebs.ubuntu.com"
+
+// UbuntuDdebsPattern matches ddebs.ubuntu.com paths requested relative to
+// apt-proxy, e.g. /ddebs/dists/noble/Release from
+// "deb http://apt-proxy:3142/ddebs/ noble main".
+var UbuntuDdebsPattern = regexp.MustCompile(`^/ddebs(/.+)$`)
+
 // http://mirrors.ubuntu.com/mirrors.txt 2022.11.19
 // Sites that contain protocol headers, restrict access to resources using that protocol
 var UbuntuOfficialMirrors = []string{
@@ -60,4 +70,4 @@ var UbuntuCustomMirrors = []string{
 
 var BuiltinUbuntuMirrors = GenerateBuildInList(UbuntuOfficialMirrors, UbuntuCustomMirrors)
 
-var UbuntuDefaultCacheRules = newDebStyleRules(TypeUbuntu)
+var UbuntuDefaultCacheRules = newUbuntuStyleRules(TypeUbuntu)
@@ -0,0 +1,321 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distro
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// ValidationError is one problem found in a distributions config, tied to
+// the entry and field it concerns.
+type ValidationError struct {
+	Index   int    // position in the distributions list
+	ID      string // the entry's id, empty when it has none
+	Field   string // YAML field path within the entry, e.g. "cache_rules[1].cache_control"
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	where := fmt.Sprintf("distributions[%d]", e.Index)
+	if e.ID != "" {
+		where += " (" + e.ID + ")"
+	}
+	return where + ": " + e.Field + ": " + e.Message
+}
+
+// ValidationErrors lists every problem found in a distributions config,
+// in entry order.
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks every entry of c and returns all problems found rather
+// than stopping at the first: required fields, regex syntax, cache-control
+// syntax, and ids, types and URL patterns that clash between entries.
+// Conflicts with distributions outside c are checked by
+// Registry.ValidateConfig.
+func (c *DistributionsConfig) Validate() ValidationErrors {
+	var errs ValidationErrors
+	patterns := make([]*regexp.Regexp, len(c.Distributions))
+	for i := range c.Distributions {
+		dist := &c.Distributions[i]
+		report := func(field, format string, args ...any) {
+			errs = append(errs, ValidationError{Index: i, ID: dist.ID, Field: field, Message: fmt.Sprintf(format, args...)})
+		}
+
+		if dist.ID == "" {
+			report("id", "distribution ID is required")
+		}
+		if dist.Name == "" {
+			report("name", "distribution name is required")
+		}
+		switch {
+		case dist.Type == 0:
+			report("type", "distribution type is required (a positive number)")
+		case dist.Type < 0:
+			report("type", "distribution type must be a positive number, got %d", dist.Type)
+		}
+		if dist.URLPattern == "" {
+			report("url_pattern", "URL pattern is required")
+		} else if re, err := regexp.Compile(dist.URLPattern); err != nil {
+			report("url_pattern", "invalid URL pattern regex: %v", err)
+		} else {
+			patterns[i] = re
+		}
+		if dist.BenchmarkURL == "" {
+			report("benchmark_url", "benchmark URL is required")
+		}
+		for j, rule := range dist.CacheRules {
+			field := fmt.Sprintf("cache_rules[%d]", j)
+			if rule.Pattern == "" {
+				report(field+".pattern", "pattern is required")
+			} else if _, err := regexp.Compile(rule.Pattern); err != nil {
+				report(field+".pattern", "invalid pattern regex: %v", err)
+			}
+			if err := checkCacheControl(rule.CacheControl); err != nil {
+				report(field+".cache_control", "invalid cache-control %q: %v", rule.CacheControl, err)
+			}
+		}
+
+		for k := 0; k < i; k++ {
+			other := &c.Distributions[k]
+			if dist.ID != "" && other.ID == dist.ID {
+				report("id", "duplicate ID, already used by distributions[%d]", k)
+			}
+			if dist.Type > 0 && other.Type == dist.Type {
+				report("type", "type %d is already used by distributions[%d] (%s)", dist.Type, k, other.ID)
+			}
+			if path, ok := patternsOverlap(patterns[i], patterns[k]); ok {
+				report("url_pattern", "overlaps with distributions[%d] (%s): both match %q", k, other.ID, path)
+			}
+		}
+	}
+	return errs
+}
+
+// ValidateConfig returns c.Validate() plus the conflicts of c's entries
+// with the distributions in r they do not replace: the same type under
+// another ID, a registered ID with a different type, and overlapping URL
+// patterns. Checked against NewBuiltinRegistry() it reports what Reload
+// would reject or misroute. The result is in entry order.
+func (r *Registry) ValidateConfig(c *DistributionsConfig) ValidationErrors {
+	errs := c.Validate()
+	replaced := make(map[string]bool, len(c.Distributions))
+	for _, dist := range c.Distributions {
+		replaced[dist.ID] = true
+	}
+	all := r.GetAll()
+	ids := make([]string, 0, len(all))
+	for id := range all {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for i := range c.Distributions {
+		dist := &c.Distributions[i]
+		report := func(field, format string, args ...any) {
+			errs = append(errs, ValidationError{Index: i, ID: dist.ID, Field: field, Message: fmt.Sprintf(format, args...)})
+		}
+		if existing, ok := r.GetByType(dist.Type); ok && dist.Type > 0 && dist.ID != "" && existing.ID != dist.ID {
+			report("type", "type %d is already used by distribution %q", dist.Type, existing.ID)
+		}
+		if existing, ok := r.GetByID(dist.ID); ok && dist.Type > 0 && existing.Type != dist.Type {
+			report("type", "distribution %q is registered with type %d and cannot change it", dist.ID, existing.Type)
+		}
+		re, err := regexp.Compile(dist.URLPattern)
+		if dist.URLPattern == "" || err != nil {
+			continue
+		}
+		for _, id := range ids {
+			if replaced[id] {
+				continue
+			}
+			if path, ok := patternsOverlap(re, all[id].URLPattern); ok {
+				report("url_pattern", "overlaps with distribution %q: both match %q", id, path)
+			}
+		}
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Index < errs[j].Index })
+	return errs
+}
+
+// patternsOverlap reports whether a request path exists that both a and b
+// match, returning it. Deciding that in general is expensive, so it tries
+// the shortest path each pattern matches on the other one, which catches
+// the usual mistake of one pattern being a prefix of another ("/debian/"
+// and "/debian/security/").
+func patternsOverlap(a, b *regexp.Regexp) (string, bool) {
+	if a == nil || b == nil {
+		return "", false
+	}
+	for _, probe := range [][2]*regexp.Regexp{{a, b}, {b, a}} {
+		if path, ok := shortestMatch(probe[0]); ok && probe[1].MatchString(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// shortestMatch builds a short string re matches: optional parts left out,
+// the first branch of each alternation, and "x" (or the first printable
+// member of a class) for each character. ok is false when that string does
+// not match after all, e.g. because of word boundaries.
+func shortestMatch(re *regexp.Regexp) (string, bool) {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	var b strings.Builder
+	writeShortestMatch(&b, parsed.Simplify())
+	return b.String(), re.MatchString(b.String())
+}
+
+func writeShortestMatch(b *strings.Builder, re *syntax.Regexp) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		b.WriteString(string(re.Rune))
+	case syntax.OpCharClass:
+		b.WriteRune(classMember(re.Rune))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		b.WriteByte('x')
+	case syntax.OpCapture, syntax.OpPlus:
+		writeShortestMatch(b, re.Sub[0])
+	case syntax.OpRepeat:
+		for i := 0; i < re.Min; i++ {
+			writeShortestMatch(b, re.Sub[0])
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			writeShortestMatch(b, sub)
+		}
+	case syntax.OpAlternate:
+		writeShortestMatch(b, re.Sub[0])
+	}
+}
+
+// classMember picks a member of a character class given as rune ranges:
+// 'x' when it is one, otherwise the first printable ASCII member.
+func classMember(ranges []rune) rune {
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if ranges[i] <= 'x' && 'x' <= ranges[i+1] {
+			return 'x'
+		}
+	}
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if lo < '!' {
+			lo = '!'
+		}
+		if lo <= hi && lo <= '~' {
+			return lo
+		}
+	}
+	if len(ranges) > 0 {
+		return ranges[0]
+	}
+	return 'x'
+}
+
+// cacheControlSeconds are the directives whose argument is a number of
+// seconds; max-stale's argument is optional.
+var cacheControlSeconds = map[string]bool{
+	"max-age":                true,
+	"s-maxage":               true,
+	"min-fresh":              true,
+	"max-stale":              true,
+	"stale-while-revalidate": true,
+	"stale-if-error":         true,
+}
+
+// checkCacheControl checks v against the Cache-Control grammar of RFC 9111
+// section 5.2: comma-separated directives, each a token optionally followed
+// by "=" and a token or quoted string. An empty value is allowed.
+func checkCacheControl(v string) error {
+	if strings.TrimSpace(v) == "" {
+		return nil
+	}
+	for _, directive := range splitDirectives(v) {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			return fmt.Errorf("empty directive")
+		}
+		name, arg, hasArg := strings.Cut(directive, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		arg = strings.TrimSpace(arg)
+		if !isToken(name) {
+			return fmt.Errorf("directive %q is not a valid name", name)
+		}
+		if !hasArg {
+			if cacheControlSeconds[name] && name != "max-stale" {
+				return fmt.Errorf("%s needs a number of seconds", name)
+			}
+			continue
+		}
+		quoted := len(arg) >= 2 && arg[0] == '"' && arg[len(arg)-1] == '"'
+		if !quoted && !isToken(arg) {
+			return fmt.Errorf("%s has an invalid argument %q", name, arg)
+		}
+		if cacheControlSeconds[name] && strings.Trim(arg, "0123456789") != "" {
+			return fmt.Errorf("%s needs a number of seconds, got %q", name, arg)
+		}
+	}
+	return nil
+}
+
+// splitDirectives splits a Cache-Control value on the commas outside
+// quoted strings.
+func splitDirectives(v string) []string {
+	var parts []string
+	start, inQuote := 0, false
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '"':
+			inQuote = !inQuote
+		case ',':
+			if !inQuote {
+				parts = append(parts, v[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, v[start:])
+}
+
+// isToken reports whether s is an RFC 9110 token.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
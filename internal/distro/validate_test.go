@@ -0,0 +1,222 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distro
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func parseDistributions(t *testing.T, src string) *DistributionsConfig {
+	t.Helper()
+	var c DistributionsConfig
+	if err := yaml.Unmarshal([]byte(src), &c); err != nil {
+		t.Fatalf("yaml: %v", err)
+	}
+	return &c
+}
+
+const validEntry = `
+  - id: foo
+    name: Foo
+    type: 42
+    url_pattern: "/foo/(.+)$"
+    benchmark_url: "dists/stable/Release"
+`
+
+func TestValidateReportsFieldErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		yaml string
+		want []string // ValidationError.Error() of each expected error, in order
+	}{
+		{
+			"missing type",
+			`distributions:
+  - id: foo
+    name: Foo
+    url_pattern: "/foo/(.+)$"
+    benchmark_url: "dists/stable/Release"
+`,
+			[]string{"distributions[0] (foo): type: distribution type is required (a positive number)"},
+		},
+		{
+			"every missing field at once",
+			`distributions:
+  - type: 42
+`,
+			[]string{
+				"distributions[0]: id: distribution ID is required",
+				"distributions[0]: name: distribution name is required",
+				"distributions[0]: url_pattern: URL pattern is required",
+				"distributions[0]: benchmark_url: benchmark URL is required",
+			},
+		},
+		{
+			"duplicate type and id",
+			"distributions:" + validEntry + `  - id: foo
+    name: Foo again
+    type: 42
+    url_pattern: "/other/(.+)$"
+    benchmark_url: "dists/stable/Release"
+`,
+			[]string{
+				"distributions[1] (foo): id: duplicate ID, already used by distributions[0]",
+				"distributions[1] (foo): type: type 42 is already used by distributions[0] (foo)",
+			},
+		},
+		{
+			"overlapping url patterns",
+			"distributions:" + validEntry + `  - id: foo-security
+    name: Foo Security
+    type: 43
+    url_pattern: "/foo/security/(.+)$"
+    benchmark_url: "dists/stable/Release"
+`,
+			[]string{`distributions[1] (foo-security): url_pattern: overlaps with distributions[0] (foo): both match "/foo/security/x"`},
+		},
+		{
+			"invalid cache-control syntax",
+			`distributions:
+  - id: foo
+    name: Foo
+    type: 42
+    url_pattern: "/foo/(.+)$"
+    benchmark_url: "dists/stable/Release"
+    cache_rules:
+      - pattern: "deb$"
+        cache_control: "max-age=forever"
+      - pattern: "Release$"
+        cache_control: "max-age=3600,,public"
+      - pattern: "InRelease$"
+        cache_control: "max age=3600"
+      - pattern: "Packages$"
+        cache_control: "s-maxage"
+`,
+			[]string{
+				`distributions[0] (foo): cache_rules[0].cache_control: invalid cache-control "max-age=forever": max-age needs a number of seconds, got "forever"`,
+				`distributions[0] (foo): cache_rules[1].cache_control: invalid cache-control "max-age=3600,,public": empty directive`,
+				`distributions[0] (foo): cache_rules[2].cache_control: invalid cache-control "max age=3600": directive "max age" is not a valid name`,
+				`distributions[0] (foo): cache_rules[3].cache_control: invalid cache-control "s-maxage": s-maxage needs a number of seconds`,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errs := parseDistributions(t, c.yaml).Validate()
+			var got []string
+			for _, e := range errs {
+				got = append(got, e.Error())
+			}
+			if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("Validate() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(c.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestValidateAcceptsValidConfig(t *testing.T) {
+	c := parseDistributions(t, "distributions:"+validEntry+`    cache_rules:
+      - pattern: "deb$"
+        cache_control: "max-age=100000, public, no-cache=\"Set-Cookie, Vary\""
+      - pattern: "Release$"
+        cache_control: "max-stale, stale-while-revalidate=60"
+      - pattern: "Sources$"
+        cache_control: ""
+`)
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Errorf("Validate() = %v, want no errors", errs)
+	}
+}
+
+func TestValidateShippedDistributionsConfig(t *testing.T) {
+	loader := NewLoader("../../config/distributions.yaml")
+	c, err := loader.Parse()
+	if err != nil || c == nil {
+		t.Fatalf("Parse() = %v, %v", c, err)
+	}
+	if errs := NewBuiltinRegistry().ValidateConfig(c); len(errs) != 0 {
+		t.Errorf("shipped distributions.yaml: %v", errs)
+	}
+}
+
+func TestRegistryValidateConfigBuiltinConflicts(t *testing.T) {
+	c := parseDistributions(t, `distributions:
+  - id: debian-security
+    name: Debian Security
+    type: 3
+    url_pattern: "/debian/security/(.+)$"
+    benchmark_url: "dists/stable/Release"
+  - id: ubuntu
+    name: Ubuntu
+    type: 99
+    url_pattern: "/ubuntu/(.+)$"
+    benchmark_url: "dists/noble/Release"
+`)
+	var got []string
+	for _, e := range NewBuiltinRegistry().ValidateConfig(c) {
+		got = append(got, e.Error())
+	}
+	want := []string{
+		`distributions[0] (debian-security): type: type 3 is already used by distribution "debian"`,
+		`distributions[0] (debian-security): url_pattern: overlaps with distribution "debian": both match "/debian/security/x"`,
+		`distributions[1] (ubuntu): type: distribution "ubuntu" is registered with type 1 and cannot change it`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ValidateConfig() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLoaderLoadReportsAllErrors(t *testing.T) {
+	path := writeTempYAML(t, `distributions:
+  - id: foo
+    type: 42
+    url_pattern: "/foo/(.+)$"
+  - id: bar
+    name: Bar
+    type: 42
+    url_pattern: "/bar/(.+)$"
+    benchmark_url: "dists/stable/Release"
+`)
+	_, err := NewLoader(path).Load()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Load() error = %v, want ValidationErrors", err)
+	}
+	if len(errs) != 3 {
+		t.Fatalf("Load() reported %d errors, want 3: %v", len(errs), errs)
+	}
+	if errs[2].Index != 1 || errs[2].Field != "type" {
+		t.Errorf("third error = %+v, want the duplicate type of distributions[1]", errs[2])
+	}
+}
+
+func TestShortestMatch(t *testing.T) {
+	for pattern, want := range map[string]string{
+		`/ubuntu/(.+)$`:                 "/ubuntu/x",
+		`/debian(-security)?/(.+)$`:     "/debian/x",
+		`^/(alpine|edge)/v[0-9]+/.*`:    "/alpine/v0/",
+		`/pool/[^/]{2,}/(main|contrib)`: "/pool/xx/main",
+	} {
+		got, ok := shortestMatch(regexp.MustCompile(pattern))
+		if !ok || got != want {
+			t.Errorf("shortestMatch(%q) = %q, %v; want %q", pattern, got, ok, want)
+		}
+	}
+}
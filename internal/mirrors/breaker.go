@@ -0,0 +1,153 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mirrors
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Defaults for the geo mirror API circuit breaker.
+const (
+	DefaultGeoFailureThreshold = 3
+	DefaultGeoCooldown         = 5 * time.Minute
+)
+
+// Breaker states reported by GeoBreakerStatus.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// ErrGeoBreakerOpen is returned by GetUbuntuMirrorUrlsByGeo while the
+// breaker is open; callers fall back to registry/built-in mirrors.
+var ErrGeoBreakerOpen = errors.New("geo mirror API circuit breaker is open")
+
+// BreakerStatus is a point-in-time view of a circuit breaker.
+type BreakerStatus struct {
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	FailureThreshold    int       `json:"failure_threshold"`
+	CooldownSeconds     int64     `json:"cooldown_seconds"`
+	OpenUntil           time.Time `json:"open_until,omitzero"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// circuitBreaker short-circuits calls after threshold consecutive failures.
+// Once cooldown has passed a single probe is let through (half-open): a
+// success closes the breaker, a failure re-opens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	failures  int
+	openUntil time.Time
+	probing   bool
+	lastErr   string
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{now: time.Now}
+	b.configure(threshold, cooldown)
+	return b
+}
+
+// configure updates the limits; non-positive values select the defaults.
+func (b *circuitBreaker) configure(threshold int, cooldown time.Duration) {
+	if threshold <= 0 {
+		threshold = DefaultGeoFailureThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultGeoCooldown
+	}
+	b.mu.Lock()
+	b.threshold = threshold
+	b.cooldown = cooldown
+	b.mu.Unlock()
+}
+
+// allow reports whether a call may proceed. In the half-open state only
+// one caller gets through until it reports back via record.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record reports the outcome of a call admitted by allow.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.lastErr = ""
+		return
+	}
+	b.failures++
+	b.lastErr = err.Error()
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// abandon releases a half-open probe without counting it either way.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BreakerStatus{
+		State:               BreakerClosed,
+		ConsecutiveFailures: b.failures,
+		FailureThreshold:    b.threshold,
+		CooldownSeconds:     int64(b.cooldown / time.Second),
+		LastError:           b.lastErr,
+	}
+	if b.failures >= b.threshold {
+		st.OpenUntil = b.openUntil
+		if b.now().Before(b.openUntil) {
+			st.State = BreakerOpen
+		} else {
+			st.State = BreakerHalfOpen
+		}
+	}
+	return st
+}
+
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+	b.lastErr = ""
+}
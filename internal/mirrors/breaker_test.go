@@ -0,0 +1,106 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mirrors
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+	fail := errors.New("boom")
+
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("call %d rejected before threshold", i)
+		}
+		b.record(fail)
+	}
+	if b.allow() {
+		t.Fatal("breaker should be open after 2 failures")
+	}
+	if st := b.status(); st.State != BreakerOpen || st.ConsecutiveFailures != 2 || st.LastError != "boom" {
+		t.Fatalf("status = %+v, want open with 2 failures", st)
+	}
+
+	now = now.Add(time.Minute)
+	if st := b.status(); st.State != BreakerHalfOpen {
+		t.Fatalf("state after cooldown = %s, want half-open", st.State)
+	}
+	if !b.allow() {
+		t.Fatal("half-open breaker should admit one probe")
+	}
+	if b.allow() {
+		t.Fatal("half-open breaker should admit only one probe at a time")
+	}
+	b.record(fail)
+	if b.allow() {
+		t.Fatal("failed probe should re-open the breaker")
+	}
+
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("probe after second cooldown rejected")
+	}
+	b.record(nil)
+	if st := b.status(); st.State != BreakerClosed || st.ConsecutiveFailures != 0 {
+		t.Fatalf("status after success = %+v, want closed", st)
+	}
+}
+
+// TestGeoLookupBreakerShortCircuits points the geo lookup at a failing
+// server and checks that, once the breaker opens, further lookups no longer
+// reach it and mode resolution falls back to the built-in mirrors.
+func TestGeoLookupBreakerShortCircuits(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	geo := NewGeoLookup(GeoLookupOptions{Timeout: time.Second, FailureThreshold: 3, Cooldown: time.Hour})
+	geo.api = srv.URL
+
+	for i := 0; i < 3; i++ {
+		if _, err := geo.MirrorsCtx(context.Background()); err == nil || errors.Is(err, ErrGeoBreakerOpen) {
+			t.Fatalf("lookup %d: err = %v, want upstream failure", i, err)
+		}
+	}
+	if st := geo.BreakerStatus(); st.State != BreakerOpen {
+		t.Fatalf("breaker state = %s, want open", st.State)
+	}
+
+	if _, err := geo.Mirrors(); !errors.Is(err, ErrGeoBreakerOpen) {
+		t.Fatalf("err = %v, want ErrGeoBreakerOpen", err)
+	}
+	got := NewSources(geo).MirrorUrlsByMode(nil, distro.TypeUbuntu)
+	if want := builtinMirrorURLs(distro.BuiltinUbuntuMirrors); len(got) != len(want) || got[0] != want[0] {
+		t.Errorf("fallback mirrors = %v, want built-in list", got)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("geo API hit %d times, want 3 (open breaker must not call it)", n)
+	}
+}
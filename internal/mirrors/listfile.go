@@ -0,0 +1,150 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mirrors
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// MirrorList is a set of operator-supplied mirror URLs per distribution
+// type, loaded from mirrors.list_file.
+type MirrorList struct {
+	// Replace makes the listed mirrors the only candidates for the
+	// distributions they cover; otherwise they are tried alongside the
+	// geo/registry/built-in list.
+	Replace bool
+	byMode  map[int][]string
+}
+
+// Mirrors returns the listed URLs for a distribution type.
+func (l *MirrorList) Mirrors(mode int) []string {
+	if l == nil {
+		return nil
+	}
+	return l.byMode[mode]
+}
+
+// LoadMirrorListFile parses a mirror list file. Each non-blank line not
+// starting with '#' is a mirror base URL. Lines may be grouped under
+// "[<distro>]" headers (ubuntu, ubuntu-ports, debian, centos, alpine,
+// gentoo, arch); lines before the first header are assigned by the last
+// segment of the URL path, so "https://mirror.internal/debian/" lands under
+// debian (and ".../archlinux/" under arch).
+func LoadMirrorListFile(filename string, replace bool) (*MirrorList, error) {
+	f, err := os.Open(filename) // #nosec G304 -- path comes from operator config
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	list := &MirrorList{Replace: replace, byMode: make(map[int][]string)}
+	section := -1
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			mode, ok := modeByName(name)
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unknown distribution section %q", filename, lineNo, name)
+			}
+			section = mode
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s:%d: %q is not an http(s) mirror URL", filename, lineNo, line)
+		}
+		mode := section
+		if mode < 0 {
+			var ok bool
+			if mode, ok = modeByName(sectionForPathSegment(path.Base(u.Path))); !ok {
+				return nil, fmt.Errorf("%s:%d: cannot tell the distribution of %q; list it under a [<distro>] section", filename, lineNo, line)
+			}
+		}
+		if !strings.HasSuffix(line, "/") {
+			line += "/"
+		}
+		list.byMode[mode] = append(list.byMode[mode], line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// sectionForPathSegment maps a mirror's last path segment to the
+// distribution ID when they differ, as Arch's /archlinux/ does.
+func sectionForPathSegment(seg string) string {
+	if seg == "archlinux" {
+		return distro.DistroArch
+	}
+	return seg
+}
+
+// modeByName maps a built-in distribution ID to its type.
+func modeByName(name string) (int, bool) {
+	for mode := range builtinByMode {
+		if distro.DistributionName(mode) == name {
+			return mode, true
+		}
+	}
+	return 0, false
+}
+
+// SetMirrorList installs l as the custom mirror list s consults for
+// candidate selection. A nil list removes it.
+func (s *Sources) SetMirrorList(l *MirrorList) {
+	s.list.Store(l)
+}
+
+// customMirrorsFor returns the installed list's mirrors for mode and
+// whether they replace the usual candidates. A nil s has no list.
+func (s *Sources) customMirrorsFor(mode int) (mirrors []string, replace bool) {
+	if s == nil {
+		return nil, false
+	}
+	l := s.list.Load()
+	if l == nil {
+		return nil, false
+	}
+	return l.byMode[mode], l.Replace
+}
+
+// mergeMirrors puts custom first and appends the candidates not already
+// listed.
+func mergeMirrors(custom, candidates []string) []string {
+	out := append([]string(nil), custom...)
+	seen := make(map[string]struct{}, len(out))
+	for _, m := range out {
+		seen[m] = struct{}{}
+	}
+	for _, m := range candidates {
+		if _, dup := seen[m]; !dup {
+			out = append(out, m)
+		}
+	}
+	return out
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mirrors
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+func writeMirrorList(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mirrors.list")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mirrorListSources(t *testing.T, content string, replace bool) *Sources {
+	t.Helper()
+	list, err := LoadMirrorListFile(writeMirrorList(t, content), replace)
+	if err != nil {
+		t.Fatalf("LoadMirrorListFile() error = %v", err)
+	}
+	src := NewSources(nil)
+	src.SetMirrorList(list)
+	return src
+}
+
+const testMirrorList = `# internal mirrors
+https://mirror.internal/debian/
+
+[alpine]
+https://mirror.internal/alpine
+http://backup.internal/pub/alpine/
+`
+
+func TestMirrorListMergesWithBuiltins(t *testing.T) {
+	src := mirrorListSources(t, testMirrorList, false)
+
+	got := src.MirrorUrlsByMode(nil, distro.TypeDebian)
+	builtin := builtinMirrorURLs(distro.BuiltinDebianMirrors)
+	if len(got) != len(builtin)+1 || got[0] != "https://mirror.internal/debian/" {
+		t.Fatalf("Debian candidates = %v, want the listed mirror first, then %d built-ins", got, len(builtin))
+	}
+
+	got = src.MirrorUrlsByMode(nil, distro.TypeAlpine)
+	if got[0] != "https://mirror.internal/alpine/" || got[1] != "http://backup.internal/pub/alpine/" {
+		t.Errorf("Alpine candidates start with %v, want the listed mirrors in file order", got[:2])
+	}
+
+	// Distributions the file does not mention keep their usual list.
+	if got := src.MirrorUrlsByMode(nil, distro.TypeCentOS); len(got) != len(builtinMirrorURLs(distro.BuiltinCentosMirrors)) {
+		t.Errorf("CentOS candidates = %d, want the built-in list", len(got))
+	}
+}
+
+func TestMirrorListReplacesBuiltins(t *testing.T) {
+	src := mirrorListSources(t, testMirrorList, true)
+
+	got := src.MirrorUrlsByMode(nil, distro.TypeAlpine)
+	want := []string{"https://mirror.internal/alpine/", "http://backup.internal/pub/alpine/"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Alpine candidates = %v, want only %v", got, want)
+	}
+}
+
+func TestMirrorListClassifiesArchlinuxPath(t *testing.T) {
+	src := mirrorListSources(t, "https://mirror.internal/archlinux/\n", true)
+
+	got := src.MirrorUrlsByMode(nil, distro.TypeArch)
+	if strings.Join(got, " ") != "https://mirror.internal/archlinux/" {
+		t.Errorf("Arch candidates = %v, want the /archlinux/ mirror", got)
+	}
+}
+
+func TestLoadMirrorListFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown section":   "[fedora]\nhttps://mirror.internal/fedora/\n",
+		"not a URL":         "[debian]\nmirror.internal/debian\n",
+		"unclassified line": "https://mirror.internal/packages/\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadMirrorListFile(writeMirrorList(t, content), false); err == nil {
+				t.Error("LoadMirrorListFile() error = nil, want error")
+			}
+		})
+	}
+	if _, err := LoadMirrorListFile(filepath.Join(t.TempDir(), "missing"), false); err == nil {
+		t.Error("LoadMirrorListFile() on a missing file should fail")
+	}
+}
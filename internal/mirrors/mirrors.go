@@ -15,8 +15,10 @@
 package mirrors
 
 import (
+	"net/url"
 	"regexp"
 	"strings"
+	"sync/atomic"
 
 	"github.com/soulteary/apt-proxy/internal/distro"
 )
@@ -67,17 +69,71 @@ var builtinByMode = map[int]builtinDistro{
 		benchmarkURL: distro.AlpineBenchmarkURL,
 		hostPattern:  distro.AlpineHostPattern,
 	},
+	distro.TypeGentoo: {
+		mirrors:      distro.BuiltinGentooMirrors,
+		benchmarkURL: distro.GentooBenchmarkURL,
+		hostPattern:  distro.GentooHostPattern,
+	},
+	distro.TypeArch: {
+		mirrors:      distro.BuiltinArchMirrors,
+		benchmarkURL: distro.ArchBenchmarkURL,
+		hostPattern:  distro.ArchHostPattern,
+	},
+}
+
+// Sources is where one Server's candidate mirrors come from besides the
+// registry and built-in lists: its Ubuntu geo lookup and its
+// mirrors.list_file. A nil *Sources uses the package-level lookup and no
+// list.
+type Sources struct {
+	geo  *GeoLookup
+	list atomic.Pointer[MirrorList]
+}
+
+// NewSources returns Sources looking Ubuntu mirrors up with geo; a nil
+// geo selects the package-level lookup.
+func NewSources(geo *GeoLookup) *Sources {
+	return &Sources{geo: geo}
+}
+
+// Geo returns the geo lookup s consults.
+func (s *Sources) Geo() *GeoLookup {
+	if s == nil || s.geo == nil {
+		return defaultGeoLookup
+	}
+	return s.geo
 }
 
 // GetGeoMirrorUrlsByMode returns the candidate upstream mirror URLs
-// for the given proxy mode. When reg is non-nil, registry-loaded
-// mirrors are preferred over the compile-time built-ins.
-func GetGeoMirrorUrlsByMode(reg *distro.Registry, mode int) (mirrors []string) {
+// for the given proxy mode using the package-level geo lookup, see
+// Sources.MirrorUrlsByMode.
+func GetGeoMirrorUrlsByMode(reg *distro.Registry, mode int) []string {
+	return (*Sources)(nil).MirrorUrlsByMode(reg, mode)
+}
+
+// MirrorUrlsByMode returns the candidate upstream mirror URLs for the
+// given proxy mode. When reg is non-nil, registry-loaded mirrors are
+// preferred over the compile-time built-ins. Mirrors from an installed
+// MirrorList (mirrors.list_file, see SetMirrorList) come first, or
+// alone when the list replaces the defaults.
+func (s *Sources) MirrorUrlsByMode(reg *distro.Registry, mode int) []string {
+	custom, replace := s.customMirrorsFor(mode)
+	if len(custom) == 0 {
+		return s.defaultMirrorUrlsByMode(reg, mode)
+	}
+	if replace {
+		return append([]string(nil), custom...)
+	}
+	return mergeMirrors(custom, s.defaultMirrorUrlsByMode(reg, mode))
+}
+
+// defaultMirrorUrlsByMode is MirrorUrlsByMode without the custom list.
+func (s *Sources) defaultMirrorUrlsByMode(reg *distro.Registry, mode int) (mirrors []string) {
 	// Ubuntu/UbuntuPorts: prefer geo-derived mirrors (real point of the
 	// `mirrors.txt` lookup). Fall back to registry/built-in on failure so
 	// the proxy still has *some* upstream list when the geo API is down.
 	if mode == distro.TypeUbuntu || mode == distro.TypeUbuntuPorts {
-		online, err := GetUbuntuMirrorUrlsByGeo()
+		online, err := s.Geo().Mirrors()
 		if err == nil && len(online) > 0 {
 			if mode == distro.TypeUbuntu {
 				return online
@@ -91,28 +147,91 @@ func GetGeoMirrorUrlsByMode(reg *distro.Registry, mode int) (mirrors []string) {
 		// Geo failed: fall through to registry/built-in.
 	}
 
+	if mirrors := listedMirrorUrlsByMode(reg, mode); len(mirrors) > 0 {
+		return mirrors
+	}
+
+	// Fallback: aggregate all known built-in mirrors (used by ALL_DISTROS).
+	for _, b := range builtinByMode {
+		mirrors = append(mirrors, builtinMirrorURLs(b.mirrors)...)
+	}
+	return mirrors
+}
+
+// listedMirrorUrlsByMode returns mode's registry mirrors, or its built-in
+// list when the registry has none. Nothing is looked up online.
+func listedMirrorUrlsByMode(reg *distro.Registry, mode int) []string {
 	// Prefer registry (config-loaded) mirrors when present
 	if reg != nil {
 		if d, ok := reg.GetByType(mode); ok && len(d.Mirrors) > 0 {
-			for _, m := range d.Mirrors {
-				mirrors = append(mirrors, GetFullMirrorURL(m))
+			return builtinMirrorURLs(d.Mirrors)
+		}
+	}
+	if b, ok := builtinByMode[mode]; ok {
+		return builtinMirrorURLs(b.mirrors)
+	}
+	return nil
+}
+
+// GroupByHost groups the listed mirrors of modes (registry or built-in,
+// plus s's mirrors.list_file) by host, so distributions mirrored by the same
+// operator can be found from one another: the result maps a host (with
+// its port, if any, lowercased) to the mirror URL it serves for each mode. A host listing a mode twice keeps
+// the first URL.
+func (s *Sources) GroupByHost(reg *distro.Registry, modes []int) map[string]map[int]string {
+	groups := make(map[string]map[int]string)
+	for _, mode := range modes {
+		candidates := listedMirrorUrlsByMode(reg, mode)
+		if custom, replace := s.customMirrorsFor(mode); replace {
+			candidates = custom
+		} else if len(custom) > 0 {
+			candidates = mergeMirrors(custom, candidates)
+		}
+		for _, raw := range candidates {
+			u, err := url.Parse(raw)
+			if err != nil || u.Host == "" {
+				continue
 			}
-			if len(mirrors) > 0 {
-				return mirrors
+			host := strings.ToLower(u.Host)
+			if groups[host] == nil {
+				groups[host] = make(map[int]string)
+			}
+			if _, ok := groups[host][mode]; !ok {
+				groups[host][mode] = raw
 			}
 		}
 	}
+	return groups
+}
 
-	// Other single-distro modes: just return their built-in list.
-	if b, ok := builtinByMode[mode]; ok {
-		return builtinMirrorURLs(b.mirrors)
+// SplitByRegion partitions candidate mirror URLs into those matching the
+// region hint and the rest, preserving the original order inside each group.
+// With an empty region every candidate is "preferred" so callers fall back
+// to the unbiased behaviour.
+func SplitByRegion(candidates []string, region string) (preferred, rest []string) {
+	if strings.TrimSpace(region) == "" {
+		return candidates, nil
+	}
+	for _, u := range candidates {
+		if distro.MatchesRegion(u, region) {
+			preferred = append(preferred, u)
+		} else {
+			rest = append(rest, u)
+		}
 	}
+	return preferred, rest
+}
 
-	// Fallback: aggregate all known built-in mirrors (used by ALL_DISTROS).
-	for _, b := range builtinByMode {
-		mirrors = append(mirrors, builtinMirrorURLs(b.mirrors)...)
+// HTTPSOnly returns the candidates served over https, preserving their
+// order. It backs mirrors.require_https.
+func HTTPSOnly(candidates []string) []string {
+	var out []string
+	for _, u := range candidates {
+		if strings.HasPrefix(strings.ToLower(u), "https://") {
+			out = append(out, u)
+		}
 	}
-	return mirrors
+	return out
 }
 
 func GetFullMirrorURL(mirror distro.URLWithAlias) string {
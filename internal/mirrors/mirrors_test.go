@@ -57,6 +57,76 @@ func TestGetCentOSMirrorByAliases(t *testing.T) {
 	}
 }
 
+func TestSplitByRegionReordersCandidates(t *testing.T) {
+	candidates := []string{
+		"https://mirror.example.com/ubuntu/",
+		"http://us.archive.ubuntu.com/ubuntu/",
+		"https://mirrors.ustc.edu.cn/ubuntu/",
+		"https://mirror.us.leaseweb.net/ubuntu/",
+	}
+
+	preferred, rest := SplitByRegion(candidates, "us")
+	wantPreferred := []string{"http://us.archive.ubuntu.com/ubuntu/", "https://mirror.us.leaseweb.net/ubuntu/"}
+	wantRest := []string{"https://mirror.example.com/ubuntu/", "https://mirrors.ustc.edu.cn/ubuntu/"}
+	if strings.Join(preferred, ",") != strings.Join(wantPreferred, ",") {
+		t.Fatalf("preferred = %v, want %v", preferred, wantPreferred)
+	}
+	if strings.Join(rest, ",") != strings.Join(wantRest, ",") {
+		t.Fatalf("rest = %v, want %v", rest, wantRest)
+	}
+
+	preferred, rest = SplitByRegion(candidates, "")
+	if len(preferred) != len(candidates) || rest != nil {
+		t.Fatalf("empty region should keep every candidate preferred, got %v / %v", preferred, rest)
+	}
+
+	preferred, rest = SplitByRegion(candidates, "jp")
+	if len(preferred) != 0 || len(rest) != len(candidates) {
+		t.Fatalf("unmatched region should leave everything in rest, got %v / %v", preferred, rest)
+	}
+}
+
+func TestHTTPSOnly(t *testing.T) {
+	got := HTTPSOnly([]string{
+		"http://deb.debian.org/debian/",
+		"https://mirrors.ustc.edu.cn/debian/",
+		"HTTPS://mirror.example.com/debian/",
+		"http://mirrors.tuna.tsinghua.edu.cn/debian/",
+	})
+	want := []string{"https://mirrors.ustc.edu.cn/debian/", "HTTPS://mirror.example.com/debian/"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("HTTPSOnly() = %v, want %v", got, want)
+	}
+	if got := HTTPSOnly([]string{"http://deb.debian.org/debian/"}); len(got) != 0 {
+		t.Fatalf("HTTPSOnly() of http-only list = %v, want empty", got)
+	}
+}
+
+func TestGroupByHost(t *testing.T) {
+	groups := (*Sources)(nil).GroupByHost(nil, []int{distro.TypeUbuntu, distro.TypeDebian, distro.TypeAlpine})
+	tuna := groups["mirrors.tuna.tsinghua.edu.cn"]
+	for mode, path := range map[int]string{distro.TypeUbuntu: "/ubuntu/", distro.TypeDebian: "/debian/", distro.TypeAlpine: "/alpine/"} {
+		if got := tuna[mode]; !strings.HasSuffix(got, "mirrors.tuna.tsinghua.edu.cn"+path) {
+			t.Errorf("tuna mirror for type %d = %q, want its %s base", mode, got, path)
+		}
+	}
+	if _, ok := groups["deb.debian.org"][distro.TypeUbuntu]; ok {
+		t.Error("deb.debian.org grouped with an Ubuntu mirror")
+	}
+	if _, ok := tuna[distro.TypeCentOS]; ok {
+		t.Error("GroupByHost() included a mode it was not asked for")
+	}
+}
+
+func TestGroupByHostIncludesMirrorList(t *testing.T) {
+	src := NewSources(nil)
+	src.SetMirrorList(&MirrorList{byMode: map[int][]string{distro.TypeDebian: {"https://Mirror.Example.com:8443/debian/"}}})
+	groups := src.GroupByHost(nil, []int{distro.TypeDebian})
+	if got := groups["mirror.example.com:8443"][distro.TypeDebian]; got != "https://Mirror.Example.com:8443/debian/" {
+		t.Errorf("list_file mirror grouped as %q, want it under its lowercased host", got)
+	}
+}
+
 func TestGetMirrorUrlsByGeo(t *testing.T) {
 	mirrors := GetGeoMirrorUrlsByMode(nil, distro.TypeAllDistros)
 	if len(mirrors) == 0 {
@@ -17,7 +17,10 @@ package mirrors
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/soulteary/apt-proxy/internal/distro"
@@ -28,28 +31,155 @@ import (
 // benchmark/startup indefinitely when the API was unreachable.
 const ubuntuGeoLookupTimeout = 5 * time.Second
 
-// GetUbuntuMirrorUrlsByGeo fetches the geo-localized mirrors list using a
-// background context with a fixed timeout. Prefer GetUbuntuMirrorUrlsByGeoCtx
-// when a caller-provided context is available (e.g. inside benchmark flow).
+// GeoLookupOptions tunes the Ubuntu geo mirror lookup. Zero values select
+// the defaults (5s timeout, 3 failures, 5 minute cooldown, no caching).
+type GeoLookupOptions struct {
+	Timeout          time.Duration
+	FailureThreshold int
+	Cooldown         time.Duration
+	// CacheTTL is how long a fetched mirrors.txt is reused before the API
+	// is asked again. 0 fetches it on every lookup.
+	CacheTTL time.Duration
+}
+
+// GeoLookup fetches Ubuntu's geo-localized mirror list (mirrors.txt) for
+// one Server. Its timeout, circuit breaker and list cache belong to that
+// Server alone, like its benchmarks.Engine, so two Servers in one process
+// never trip or fill each other's.
+type GeoLookup struct {
+	// api is the lookup URL; a field so tests can point it at a local
+	// server.
+	api     string
+	timeout time.Duration
+	breaker *circuitBreaker
+	cache   *geoListCache
+}
+
+// NewGeoLookup returns a GeoLookup tuned by opts.
+func NewGeoLookup(opts GeoLookupOptions) *GeoLookup {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = ubuntuGeoLookupTimeout
+	}
+	return &GeoLookup{
+		api:     distro.UbuntuGeoMirrorAPI,
+		timeout: timeout,
+		breaker: newCircuitBreaker(opts.FailureThreshold, opts.Cooldown),
+		cache:   &geoListCache{ttl: opts.CacheTTL, now: time.Now},
+	}
+}
+
+// defaultGeoLookup backs the package-level helpers and a nil *Sources. No
+// Server configures it; each builds its own with NewGeoLookup.
+var defaultGeoLookup = NewGeoLookup(GeoLookupOptions{})
+
+// geoListCache holds the last mirrors.txt fetched from the geo API so
+// rewriter rebuilds within ttl do not ask the API again.
+type geoListCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	mirrors []string
+	fetched time.Time
+}
+
+// get returns a copy of the cached list while it is younger than ttl.
+func (c *geoListCache) get() ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 || c.mirrors == nil || c.now().Sub(c.fetched) >= c.ttl {
+		return nil, false
+	}
+	return append([]string(nil), c.mirrors...), true
+}
+
+func (c *geoListCache) put(mirrors []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mirrors = append([]string(nil), mirrors...)
+	c.fetched = c.now()
+}
+
+func (c *geoListCache) clear() {
+	c.mu.Lock()
+	c.mirrors = nil
+	c.fetched = time.Time{}
+	c.mu.Unlock()
+}
+
+// Invalidate drops the cached mirrors.txt so the next lookup asks the geo
+// API again, however young the cached list is.
+func (g *GeoLookup) Invalidate() {
+	g.cache.clear()
+}
+
+// BreakerStatus reports the state of the geo mirror API circuit breaker.
+func (g *GeoLookup) BreakerStatus() BreakerStatus {
+	return g.breaker.status()
+}
+
+// GetUbuntuMirrorUrlsByGeo fetches the geo-localized mirrors list with the
+// package-level lookup, see GeoLookup.Mirrors.
 func GetUbuntuMirrorUrlsByGeo() (mirrors []string, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), ubuntuGeoLookupTimeout)
-	defer cancel()
-	return GetUbuntuMirrorUrlsByGeoCtx(ctx)
+	return defaultGeoLookup.Mirrors()
 }
 
-// GetUbuntuMirrorUrlsByGeoCtx fetches Ubuntu's mirror list honoring the
-// caller-provided context for cancellation/deadline.
+// GetUbuntuMirrorUrlsByGeoCtx is GetUbuntuMirrorUrlsByGeo honoring ctx,
+// see GeoLookup.MirrorsCtx.
 func GetUbuntuMirrorUrlsByGeoCtx(ctx context.Context) (mirrors []string, err error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, distro.UbuntuGeoMirrorAPI, nil)
+	return defaultGeoLookup.MirrorsCtx(ctx)
+}
+
+// Mirrors fetches the geo-localized mirrors list using a background
+// context with the configured timeout. Prefer MirrorsCtx when a
+// caller-provided context is available (e.g. inside benchmark flow).
+func (g *GeoLookup) Mirrors() (mirrors []string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	return g.MirrorsCtx(ctx)
+}
+
+// MirrorsCtx fetches Ubuntu's mirror list honoring the caller-provided
+// context for cancellation/deadline. A list fetched within the configured
+// cache TTL is returned without touching the network; while the circuit
+// breaker is open it returns ErrGeoBreakerOpen.
+func (g *GeoLookup) MirrorsCtx(ctx context.Context) (mirrors []string, err error) {
+	if cached, ok := g.cache.get(); ok {
+		return cached, nil
+	}
+	if !g.breaker.allow() {
+		return nil, ErrGeoBreakerOpen
+	}
+	mirrors, err = g.fetch(ctx)
+	if err == nil && len(mirrors) == 0 {
+		err = errors.New("geo mirror API returned an empty list")
+	}
+	if err != nil && errors.Is(err, context.Canceled) {
+		// The caller gave up; that says nothing about the API's health.
+		g.breaker.abandon()
+		return mirrors, err
+	}
+	g.breaker.record(err)
+	if err == nil {
+		g.cache.put(mirrors)
+	}
+	return mirrors, err
+}
+
+func (g *GeoLookup) fetch(ctx context.Context) (mirrors []string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.api, nil)
 	if err != nil {
 		return mirrors, err
 	}
-	client := &http.Client{Timeout: ubuntuGeoLookupTimeout}
+	client := &http.Client{Timeout: g.timeout}
 	response, err := client.Do(req)
 	if err != nil {
 		return mirrors, err
 	}
 	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		return mirrors, fmt.Errorf("geo mirror API returned %s", response.Status)
+	}
 
 	scanner := bufio.NewScanner(response.Body)
 	for scanner.Scan() {
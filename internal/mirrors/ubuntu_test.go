@@ -16,6 +16,10 @@ package mirrors
 
 import (
 	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -34,3 +38,92 @@ func TestGetUbuntuMirrorUrlsByGeo(t *testing.T) {
 		t.Fatal("get ubuntu get mirrors failed")
 	}
 }
+
+// withGeoServer returns a geo lookup pointed at a local server listing
+// mirror, with the given cache TTL and a controllable clock. It also
+// returns the hit counter and a function that advances the clock.
+func withGeoServer(t *testing.T, mirror *atomic.Value, ttl time.Duration) (*GeoLookup, *atomic.Int32, func(time.Duration)) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.WriteString(w, mirror.Load().(string)+"\n")
+	}))
+	t.Cleanup(srv.Close)
+
+	now := time.Unix(1000, 0)
+	geo := NewGeoLookup(GeoLookupOptions{Timeout: time.Second, CacheTTL: ttl})
+	geo.api = srv.URL
+	geo.cache.now = func() time.Time { return now }
+	return geo, &hits, func(d time.Duration) { now = now.Add(d) }
+}
+
+func lookupGeo(t *testing.T, geo *GeoLookup) string {
+	t.Helper()
+	got, err := geo.Mirrors()
+	if err != nil || len(got) != 1 {
+		t.Fatalf("Mirrors() = %v, %v; want one mirror", got, err)
+	}
+	return got[0]
+}
+
+func TestGeoCacheReusesListUntilTTL(t *testing.T) {
+	var mirror atomic.Value
+	mirror.Store("http://old.example/ubuntu/")
+	geo, hits, advance := withGeoServer(t, &mirror, time.Hour)
+
+	lookupGeo(t, geo)
+	mirror.Store("http://new.example/ubuntu/")
+	advance(59 * time.Minute)
+	if got := lookupGeo(t, geo); got != "http://old.example/ubuntu/" || hits.Load() != 1 {
+		t.Fatalf("lookup within TTL = %s after %d fetches, want the cached list from 1 fetch", got, hits.Load())
+	}
+
+	advance(time.Minute)
+	if got := lookupGeo(t, geo); got != "http://new.example/ubuntu/" || hits.Load() != 2 {
+		t.Fatalf("lookup after TTL = %s after %d fetches, want a re-fetched list", got, hits.Load())
+	}
+}
+
+func TestGeoCacheDisabledWithoutTTL(t *testing.T) {
+	var mirror atomic.Value
+	mirror.Store("http://old.example/ubuntu/")
+	geo, hits, _ := withGeoServer(t, &mirror, 0)
+
+	lookupGeo(t, geo)
+	lookupGeo(t, geo)
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("geo API fetched %d times, want every lookup to fetch", n)
+	}
+}
+
+func TestInvalidateGeoCacheForcesRefetch(t *testing.T) {
+	var mirror atomic.Value
+	mirror.Store("http://old.example/ubuntu/")
+	geo, hits, _ := withGeoServer(t, &mirror, time.Hour)
+
+	lookupGeo(t, geo)
+	mirror.Store("http://new.example/ubuntu/")
+	geo.Invalidate()
+	if got := lookupGeo(t, geo); got != "http://new.example/ubuntu/" || hits.Load() != 2 {
+		t.Fatalf("lookup after invalidation = %s after %d fetches, want a re-fetched list", got, hits.Load())
+	}
+}
+
+// TestGeoLookupsAreIndependent fills one lookup's cache and checks a
+// second lookup, as another Server would own, still asks its own API.
+func TestGeoLookupsAreIndependent(t *testing.T) {
+	var first, second atomic.Value
+	first.Store("http://first.example/ubuntu/")
+	second.Store("http://second.example/ubuntu/")
+	a, _, _ := withGeoServer(t, &first, time.Hour)
+	b, hits, _ := withGeoServer(t, &second, time.Hour)
+
+	lookupGeo(t, a)
+	if got := lookupGeo(t, b); got != "http://second.example/ubuntu/" || hits.Load() != 1 {
+		t.Fatalf("second lookup = %s after %d fetches, want its own list", got, hits.Load())
+	}
+	if st := b.BreakerStatus(); st.State != BreakerClosed {
+		t.Errorf("second breaker state = %s, want closed", st.State)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// DefaultBadGatewayRefreshInterval is how often a distribution's mirror
+// may be refreshed after a 502 when Options.BadGatewayRefreshInterval is
+// not set.
+const DefaultBadGatewayRefreshInterval = 5 * time.Minute
+
+// badGatewayRefresh turns a 502 for a distribution into a background
+// refresh of its mirror and a 503 with a short Retry-After, so apt, which
+// gives up on a 502, retries once a new mirror has been selected
+// (Options.BadGatewayRetryAfter). A distribution is refreshed at most
+// once per interval; while its refresh runs further 502s are answered
+// with 503 too, afterwards, until the interval has passed, they reach
+// the client as they are.
+type badGatewayRefresh struct {
+	retryAfter time.Duration
+	interval   time.Duration
+
+	mu      sync.Mutex
+	last    map[int]time.Time
+	running map[int]bool
+}
+
+func newBadGatewayRefresh(retryAfter, interval time.Duration) *badGatewayRefresh {
+	if retryAfter <= 0 {
+		return nil
+	}
+	if interval <= 0 {
+		interval = DefaultBadGatewayRefreshInterval
+	}
+	return &badGatewayRefresh{
+		retryAfter: retryAfter,
+		interval:   interval,
+		last:       make(map[int]time.Time),
+		running:    make(map[int]bool),
+	}
+}
+
+// retryBadGateway is called by responseWriter when mode's request is
+// about to be answered with 502. It starts a refresh of mode's mirror
+// unless one ran within the interval, and returns the Retry-After of the
+// 503 to answer with instead, or false to let the 502 through.
+func (ap *PackageStruct) retryBadGateway(mode int) (time.Duration, bool) {
+	b := ap.badGateway
+	if b == nil {
+		return 0, false
+	}
+	b.mu.Lock()
+	if b.running[mode] {
+		b.mu.Unlock()
+		return b.retryAfter, true
+	}
+	if last, ok := b.last[mode]; ok && time.Since(last) < b.interval {
+		b.mu.Unlock()
+		return 0, false
+	}
+	b.last[mode] = time.Now()
+	b.running[mode] = true
+	b.mu.Unlock()
+
+	ap.log.Warn().
+		Str("distro", distro.DistributionName(mode)).
+		Dur("retry_after", b.retryAfter).
+		Msg("mirror answered 502, refreshing the mirror and asking the client to retry")
+	go func() {
+		defer func() {
+			b.mu.Lock()
+			b.running[mode] = false
+			b.mu.Unlock()
+		}()
+		if err := ap.RefreshDistro(mode); err != nil {
+			ap.log.Error().Err(err).Str("distro", distro.DistributionName(mode)).Msg("failed to refresh the mirror after a 502")
+		}
+	}()
+	return b.retryAfter, true
+}
+
+// serveRetryLater answers a request whose mirror failed with 503 and a
+// Retry-After of retryAfter, rounded up to a whole second.
+func serveRetryLater(rw http.ResponseWriter, retryAfter time.Duration) {
+	h := rw.Header()
+	for k := range h {
+		delete(h, k)
+	}
+	h.Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = io.WriteString(rw, "upstream mirror failed, selecting another one, retry shortly\n")
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+	"github.com/soulteary/apt-proxy/internal/state"
+)
+
+// newBrokenMirror returns a mirror that drops the connection without an
+// answer, which the reverse proxy reports as 502, while broken is set,
+// and otherwise answers every request with its path.
+func newBrokenMirror(t *testing.T, delay time.Duration, broken *atomic.Bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if broken.Load() {
+			panic(http.ErrAbortHandler)
+		}
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestBadGatewayRefreshesMirror breaks the selected mirror and its
+// fallback, and checks the client is asked to retry with 503 while the
+// mirror is refreshed, the retry is served by the newly selected mirror,
+// and a second failure within the interval is passed through as 502.
+func TestBadGatewayRefreshesMirror(t *testing.T) {
+	var brokenA, brokenB atomic.Bool
+	a := newBrokenMirror(t, 0, &brokenA)
+	b := newBrokenMirror(t, 30*time.Millisecond, &brokenB)
+
+	reg := newTestRegistry()
+	deb, _ := reg.GetByID("debian")
+	local := *deb
+	local.Mirrors = []distro.URLWithAlias{{URL: b.URL + "/debian/", Scheme: "http"}, {URL: a.URL + "/debian/", Scheme: "http"}}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+	ps, err := NewPackageStruct(Options{
+		State:                state.NewAppState(),
+		Registry:             reg,
+		Mode:                 distro.TypeDebian,
+		BadGatewayRetryAfter: 2 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	const pkg = "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"
+
+	// A fails once: the warm fallback B takes over, no 503 needed.
+	brokenA.Store(true)
+	if rec := serve(ps, pkg); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d with a working fallback, want 200", rec.Code)
+	}
+
+	// A is back, B fails and has no fallback left.
+	brokenA.Store(false)
+	brokenB.Store(true)
+	rec := serve(ps, pkg)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "2" {
+		t.Fatalf("status = %d, Retry-After %q; want 503 with Retry-After 2", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store on the retry response", cc)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statuses := ps.MirrorStatuses()
+		if len(statuses) == 1 && statuses[0].Mirror == a.URL+"/debian/" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mirror after the refresh = %+v, want %s", statuses, a.URL)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec := serve(ps, pkg); rec.Code != http.StatusOK || rec.Body.String() != pkg {
+		t.Errorf("retry: status = %d body %q, want 200 from the refreshed mirror", rec.Code, rec.Body.String())
+	}
+
+	brokenA.Store(true)
+	if rec := serve(ps, pkg); rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d for a failure right after a refresh, want the 502 passed through", rec.Code)
+	}
+}
+
+func TestBadGatewayPassedThroughByDefault(t *testing.T) {
+	var broken atomic.Bool
+	broken.Store(true)
+	mirror := newBrokenMirror(t, 0, &broken)
+	st := state.NewAppState()
+	st.SetMirror(distro.TypeDebian, mirror.URL+"/debian/")
+	ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	if rec := serve(ps, "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"); rec.Code != http.StatusBadGateway || rec.Header().Get("Retry-After") != "" {
+		t.Errorf("status = %d, Retry-After %q; want a plain 502", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Default dialer settings for upstream connections. The keep-alive
+// matches net/http's DefaultTransport; the dial timeout is shorter than
+// its 30s so an unreachable mirror IP fails fast.
+const (
+	DefaultDialTimeout   = 10 * time.Second
+	DefaultDialKeepAlive = 30 * time.Second
+)
+
+// DNSOptions controls how upstream mirror hostnames are resolved.
+type DNSOptions struct {
+	// Overrides pins hostnames to fixed IPs, like an /etc/hosts entry that
+	// only applies to apt-proxy. Keys are matched case-insensitively.
+	Overrides map[string]string
+	// Server is a "host[:port]" DNS server used instead of the system
+	// resolver. Port 53 is assumed when omitted.
+	Server string
+	// CacheTTL reuses resolved addresses for this long instead of looking
+	// the mirror up on every new connection. 0 disables the cache.
+	CacheTTL time.Duration
+}
+
+// dialFunc matches net.Dialer.DialContext / http.Transport.DialContext.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newUpstreamDialer returns the DialContext used by the upstream
+// transport. With zero DNSOptions it is a plain net.Dialer. A non-positive
+// timeout selects DefaultDialTimeout.
+func newUpstreamDialer(dns DNSOptions, timeout time.Duration) dialFunc {
+	dial, _ := upstreamDialer(dns, timeout)
+	return dial
+}
+
+// upstreamDialer is newUpstreamDialer that also returns its DNS cache
+// (nil when dns.CacheTTL is 0) so the owner can flush it.
+func upstreamDialer(dns DNSOptions, timeout time.Duration) (dialFunc, *dnsCache) {
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+	d := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: DefaultDialKeepAlive,
+	}
+	if server := dnsServerAddr(dns.Server); server != "" {
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var rd net.Dialer
+				return rd.DialContext(ctx, network, server)
+			},
+		}
+	}
+	cache := newDNSCache(dns.CacheTTL, d.Resolver)
+	return withDNSOverrides(dns.Overrides, cache.wrap(d.DialContext, timeout)), cache
+}
+
+// withDNSOverrides wraps dial so addresses whose host has an override are
+// dialled at the pinned IP (same port) instead of being resolved.
+func withDNSOverrides(overrides map[string]string, dial dialFunc) dialFunc {
+	if len(overrides) == 0 {
+		return dial
+	}
+	pinned := make(map[string]string, len(overrides))
+	for host, ip := range overrides {
+		pinned[strings.ToLower(strings.TrimSuffix(host, "."))] = ip
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+		if ip, ok := pinned[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// dnsServerAddr normalises a dns.server value to host:port.
+func dnsServerAddr(server string) string {
+	server = strings.TrimSpace(server)
+	if server == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "53")
+}
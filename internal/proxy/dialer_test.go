@@ -0,0 +1,142 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var errDialRecorded = errors.New("recorded")
+
+func TestWithDNSOverridesUsesPinnedIP(t *testing.T) {
+	var dialed []string
+	record := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, errDialRecorded
+	}
+	dial := withDNSOverrides(map[string]string{"Mirrors.Example.com": "10.1.2.3"}, record)
+
+	_, _ = dial(context.Background(), "tcp", "mirrors.example.com:80")
+	_, _ = dial(context.Background(), "tcp", "other.example.com:443")
+
+	want := []string{"10.1.2.3:80", "other.example.com:443"}
+	if len(dialed) != len(want) {
+		t.Fatalf("dialed = %v, want %v", dialed, want)
+	}
+	for i := range want {
+		if dialed[i] != want[i] {
+			t.Errorf("dial[%d] = %q, want %q", i, dialed[i], want[i])
+		}
+	}
+}
+
+func TestWithDNSOverridesNoopWhenEmpty(t *testing.T) {
+	called := false
+	base := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		called = true
+		return nil, errDialRecorded
+	}
+	dial := withDNSOverrides(nil, base)
+	_, _ = dial(context.Background(), "tcp", "mirrors.example.com:80")
+	if !called {
+		t.Error("base dialer not called")
+	}
+}
+
+func TestUpstreamTransportHonoursDNSOverride(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Host)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	tr := NewUpstreamTransportWithDialer(true, 0, DNSOptions{
+		Overrides: map[string]string{"mirror.apt-proxy.invalid": host},
+	})
+	tr.Proxy = nil // keep HTTP_PROXY in the environment out of the test
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	resp, err := client.Get("http://mirror.apt-proxy.invalid:" + port + "/ubuntu/")
+	if err != nil {
+		t.Fatalf("GET via override: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	// The Host header must still carry the original name.
+	if string(body) != "mirror.apt-proxy.invalid:"+port {
+		t.Errorf("upstream saw Host %q", body)
+	}
+}
+
+func TestDNSServerAddr(t *testing.T) {
+	tests := map[string]string{
+		"":             "",
+		"10.0.0.53":    "10.0.0.53:53",
+		"10.0.0.53:54": "10.0.0.53:54",
+		"::1":          "[::1]:53",
+		"[::1]:5353":   "[::1]:5353",
+		"dns.internal": "dns.internal:53",
+	}
+	for in, want := range tests {
+		if got := dnsServerAddr(in); got != want {
+			t.Errorf("dnsServerAddr(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestUpstreamDialerTimesOut points the dialer at a black-hole DNS server
+// (a UDP socket that swallows every query) so the dial can only end by
+// hitting the configured timeout, which covers resolution as well as the
+// TCP connect.
+func TestUpstreamDialerTimesOut(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, _, err := pc.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	dial := newUpstreamDialer(DNSOptions{Server: pc.LocalAddr().String()}, 200*time.Millisecond)
+	start := time.Now()
+	conn, err := dial(context.Background(), "tcp", "mirror.black-hole.test:80")
+	elapsed := time.Since(start)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial through a black-hole resolver should fail")
+	}
+	if elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("dial failed after %s, want about the 200ms dial timeout", elapsed)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// dnsCache remembers mirror hostname lookups for a fixed TTL so a burst of
+// package downloads does not resolve the same mirror on every new
+// connection. The system resolver does not expose record TTLs, so the
+// configured TTL is the upper bound an address is reused for; keep it
+// short. Entries are dropped early when every cached address fails to
+// connect, and all of them when the mirrors are refreshed.
+type dnsCache struct {
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+	now    func() time.Time
+
+	group   singleflight.Group
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// newDNSCache returns a cache resolving through resolver (nil means
+// net.DefaultResolver), or nil when ttl <= 0 disables caching.
+func newDNSCache(ttl time.Duration, resolver *net.Resolver) *dnsCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &dnsCache{
+		ttl:     ttl,
+		lookup:  resolver.LookupIPAddr,
+		now:     time.Now,
+		entries: make(map[string]dnsEntry),
+	}
+}
+
+// wrap returns a dialer that resolves hostnames through the cache and
+// tries the cached addresses in order. timeout bounds the whole attempt,
+// as net.Dialer does when it is given a hostname.
+func (c *dnsCache) wrap(dial dialFunc, timeout time.Duration) dialFunc {
+	if c == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		addrs, err := c.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, ip := range addrs {
+			if !ipMatchesNetwork(ip.IP, network) {
+				continue
+			}
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		// Nothing we remembered answers: look the name up again next time.
+		c.forget(host)
+		if firstErr == nil {
+			firstErr = &net.DNSError{Err: "no address for network " + network, Name: host, IsNotFound: true}
+		}
+		return nil, firstErr
+	}
+}
+
+// resolve returns the cached addresses for host, looking it up (once for
+// concurrent callers) when missing or expired.
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]net.IPAddr, error) {
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		// Callers share this lookup, so one of them going away must not
+		// fail it for the rest; the caller's deadline still bounds it.
+		lctx := context.WithoutCancel(ctx)
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			lctx, cancel = context.WithDeadline(lctx, deadline)
+			defer cancel()
+		}
+		addrs, err := c.lookup(lctx, host)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.entries[key] = dnsEntry{addrs: addrs, expires: c.now().Add(c.ttl)}
+		c.mu.Unlock()
+		return addrs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]net.IPAddr), nil
+}
+
+func (c *dnsCache) forget(host string) {
+	c.mu.Lock()
+	delete(c.entries, strings.ToLower(strings.TrimSuffix(host, ".")))
+	c.mu.Unlock()
+}
+
+// flush drops every entry. Called when the selected mirrors change.
+func (c *dnsCache) flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.entries = make(map[string]dnsEntry)
+	c.mu.Unlock()
+}
+
+// ipMatchesNetwork filters addresses for the "tcp4"/"tcp6" networks.
+func ipMatchesNetwork(ip net.IP, network string) bool {
+	switch network {
+	case "tcp4", "udp4":
+		return ip.To4() != nil
+	case "tcp6", "udp6":
+		return ip.To4() == nil
+	}
+	return true
+}
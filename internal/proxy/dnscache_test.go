@@ -0,0 +1,152 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDNSCache returns a cache whose lookups are counted and always answer
+// ip, with a clock the test can move.
+func fakeDNSCache(ttl time.Duration, ip string) (*dnsCache, *atomic.Int32, *time.Time) {
+	var lookups atomic.Int32
+	now := time.Unix(1700000000, 0)
+	c := newDNSCache(ttl, nil)
+	c.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups.Add(1)
+		return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+	}
+	c.now = func() time.Time { return now }
+	return c, &lookups, &now
+}
+
+func TestDNSCacheResolvesOnceWithinTTL(t *testing.T) {
+	c, lookups, _ := fakeDNSCache(time.Minute, "10.0.0.7")
+	var dialed []string
+	dial := c.wrap(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return &net.TCPConn{}, nil
+	}, time.Second)
+
+	for i := 0; i < 5; i++ {
+		if _, err := dial(context.Background(), "tcp", "Mirrors.Example.com:80"); err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+	}
+	if got := lookups.Load(); got != 1 {
+		t.Errorf("lookups = %d, want 1", got)
+	}
+	for _, addr := range dialed {
+		if addr != "10.0.0.7:80" {
+			t.Errorf("dialed %q, want the cached IP", addr)
+		}
+	}
+}
+
+func TestDNSCacheRefreshesAfterTTL(t *testing.T) {
+	c, lookups, now := fakeDNSCache(time.Minute, "10.0.0.7")
+	dial := c.wrap(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return &net.TCPConn{}, nil
+	}, time.Second)
+
+	_, _ = dial(context.Background(), "tcp", "mirrors.example.com:80")
+	*now = now.Add(59 * time.Second)
+	_, _ = dial(context.Background(), "tcp", "mirrors.example.com:80")
+	if got := lookups.Load(); got != 1 {
+		t.Fatalf("lookups before expiry = %d, want 1", got)
+	}
+	*now = now.Add(2 * time.Second)
+	_, _ = dial(context.Background(), "tcp", "mirrors.example.com:80")
+	if got := lookups.Load(); got != 2 {
+		t.Errorf("lookups after expiry = %d, want 2", got)
+	}
+}
+
+func TestDNSCacheFlushAndFailedDialForget(t *testing.T) {
+	c, lookups, _ := fakeDNSCache(time.Minute, "10.0.0.7")
+	fail := false
+	dial := c.wrap(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if fail {
+			return nil, errDialRecorded
+		}
+		return &net.TCPConn{}, nil
+	}, time.Second)
+
+	_, _ = dial(context.Background(), "tcp", "mirrors.example.com:80")
+	c.flush()
+	_, _ = dial(context.Background(), "tcp", "mirrors.example.com:80")
+	if got := lookups.Load(); got != 2 {
+		t.Fatalf("lookups after flush = %d, want 2", got)
+	}
+
+	fail = true
+	if _, err := dial(context.Background(), "tcp", "mirrors.example.com:80"); err != errDialRecorded {
+		t.Fatalf("dial error = %v, want %v", err, errDialRecorded)
+	}
+	fail = false
+	_, _ = dial(context.Background(), "tcp", "mirrors.example.com:80")
+	if got := lookups.Load(); got != 3 {
+		t.Errorf("lookups after failed dial = %d, want 3", got)
+	}
+}
+
+func TestDNSCacheSharesConcurrentLookups(t *testing.T) {
+	c, lookups, _ := fakeDNSCache(time.Minute, "10.0.0.7")
+	release := make(chan struct{})
+	inner := c.lookup
+	c.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		<-release
+		return inner(ctx, host)
+	}
+	dial := c.wrap(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return &net.TCPConn{}, nil
+	}, time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = dial(context.Background(), "tcp", "mirrors.example.com:80")
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if got := lookups.Load(); got != 1 {
+		t.Errorf("lookups = %d, want 1", got)
+	}
+}
+
+func TestDNSCacheSkipsIPLiteralsAndDisabled(t *testing.T) {
+	if newDNSCache(0, nil) != nil {
+		t.Error("newDNSCache(0) should disable the cache")
+	}
+	c, lookups, _ := fakeDNSCache(time.Minute, "10.0.0.7")
+	var dialed string
+	dial := c.wrap(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		return &net.TCPConn{}, nil
+	}, time.Second)
+	_, _ = dial(context.Background(), "tcp", "192.0.2.1:443")
+	if dialed != "192.0.2.1:443" || lookups.Load() != 0 {
+		t.Errorf("IP literal: dialed %q with %d lookups, want direct dial", dialed, lookups.Load())
+	}
+}
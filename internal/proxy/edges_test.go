@@ -180,6 +180,28 @@ func TestServeStaticLogo(t *testing.T) {
 	})
 }
 
+// TestServeFaviconAndRobots covers the handlers answering browser and
+// crawler requests.
+func TestServeFaviconAndRobots(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ServeFavicon(rec, httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Errorf("favicon: status = %d with %d body bytes, want an empty 204", rec.Code, rec.Body.Len())
+	}
+
+	rec = httptest.NewRecorder()
+	ServeRobots(rec, httptest.NewRequest(http.MethodGet, "/robots.txt", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != robotsTxt {
+		t.Errorf("robots: status = %d body = %q, want 200 %q", rec.Code, rec.Body.String(), robotsTxt)
+	}
+
+	rec = httptest.NewRecorder()
+	ServeRobots(rec, httptest.NewRequest(http.MethodHead, "/robots.txt", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("robots HEAD: status = %d with %d body bytes, want an empty 200", rec.Code, rec.Body.Len())
+	}
+}
+
 // TestGetErrorPage exercises the fallback HTML path used when the
 // home template fails to render. It's pure-string output so we just
 // assert on a couple of marker strings.
@@ -0,0 +1,66 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// extensionTTLs maps file extensions, lower-cased with their leading dot
+// (".deb", ".tar.gz"), to the Cache-Control that replaces the matched
+// rule's for files ending in them (cache.ttl_by_extension_hours).
+type extensionTTLs map[string]string
+
+// newExtensionTTLs builds the overrides, or returns nil for an empty map.
+func newExtensionTTLs(ttls map[string]time.Duration) extensionTTLs {
+	if len(ttls) == 0 {
+		return nil
+	}
+	m := make(extensionTTLs, len(ttls))
+	for ext, ttl := range ttls {
+		ext = "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+		m[ext] = "max-age=" + strconv.FormatInt(int64(ttl/time.Second), 10)
+	}
+	return m
+}
+
+// apply returns rule with the Cache-Control configured for the longest
+// extension p ends in, so ".tar.gz" wins over ".gz", or rule itself when
+// none matches. Rules that do not cache keep doing so.
+func (m extensionTTLs) apply(p string, rule *distro.Rule) *distro.Rule {
+	if len(m) == 0 || rule.CacheControl == "" {
+		return rule
+	}
+	rest := strings.ToLower(path.Base(p))
+	for {
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			break
+		}
+		rest = rest[i:]
+		if cc, ok := m[rest]; ok {
+			overridden := *rule
+			overridden.CacheControl = cc
+			return &overridden
+		}
+		rest = rest[1:]
+	}
+	return rule
+}
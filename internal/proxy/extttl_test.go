@@ -0,0 +1,95 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+func TestTTLByExtension(t *testing.T) {
+	ps, err := NewPackageStruct(Options{
+		State:       newTestState(),
+		Registry:    newTestRegistry(),
+		Mode:        distro.TypeAllDistros,
+		CacheBypass: []*regexp.Regexp{regexp.MustCompile(`/bypassed_`)},
+		TTLByExtension: map[string]time.Duration{
+			".deb":    365 * 24 * time.Hour,
+			".rpm":    30 * 24 * time.Hour,
+			".gz":     time.Hour,
+			".tar.gz": 2 * time.Hour,
+		},
+		LazyBenchmark: true,
+	})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/debian/pool/main/h/hello/hello_2.10-3_amd64.deb", "max-age=31536000"},
+		{"/centos/9-stream/BaseOS/x86_64/os/Packages/bash-5.1.8-6.el9.x86_64.rpm", "max-age=2592000"},
+		{"/alpine/v3.19/main/x86_64/APKINDEX.tar.gz", "max-age=7200"},
+		{"/debian/dists/bookworm/main/binary-amd64/Packages.gz", "max-age=3600"},
+		{"/debian/pool/main/h/hello/bypassed_2.10-3_amd64.deb", "no-store"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		rule := ps.handleExternalURLs(req)
+		if rule == nil {
+			t.Fatalf("%s matched no rule", tt.path)
+		}
+		if rule.CacheControl != tt.want {
+			t.Errorf("%s: Cache-Control = %q, want %q", tt.path, rule.CacheControl, tt.want)
+		}
+	}
+
+	// Without the map, the rules decide.
+	plain, err := NewPackageStruct(Options{State: newTestState(), Registry: newTestRegistry(), Mode: distro.TypeDebian})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb", nil)
+	want, _ := MatchingRule("/debian/pool/main/h/hello/hello_2.10-3_amd64.deb", GetRewriteRulesByMode(plain.registry, distro.TypeDebian))
+	if rule := plain.handleExternalURLs(req); rule.CacheControl != want.CacheControl {
+		t.Errorf("Cache-Control without ttl_by_extension = %q, want the rule's %q", rule.CacheControl, want.CacheControl)
+	}
+}
+
+// TestTTLByExtensionResponse checks the overriding max-age is what the
+// client is sent.
+func TestTTLByExtensionResponse(t *testing.T) {
+	ps, err := NewPackageStruct(Options{
+		State:          newTestState(),
+		Registry:       newTestRegistry(),
+		Mode:           distro.TypeDebian,
+		TTLByExtension: map[string]time.Duration{".deb": 365 * 24 * time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	ps.DistroHandlers = map[int]http.Handler{distro.TypeDebian: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+	rec := serve(ps, "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb")
+	if got := rec.Header().Get("Cache-Control"); got != "max-age=31536000" {
+		t.Errorf("Cache-Control = %q, want max-age=31536000", got)
+	}
+}
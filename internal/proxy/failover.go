@@ -0,0 +1,182 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// failoverTransport handles an upstream failure of a distribution's
+// selected mirror, after the retries below it are spent: it promotes that
+// distribution's warm fallback (see URLRewriter.fallback) to be the mirror
+// for every later request and sends this request there once. No benchmark
+// runs on this path.
+type failoverTransport struct {
+	next    http.RoundTripper
+	log     *logger.Logger
+	promote func(*url.URL) *url.URL
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if !upstreamFailed(resp, err) || req.Context().Err() != nil {
+		return resp, err
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return resp, err
+	}
+	alt := t.promote(req.URL)
+	if alt == nil {
+		return resp, err
+	}
+	if resp != nil {
+		drainAndClose(resp.Body)
+	}
+	retry := req.Clone(req.Context())
+	retry.URL = alt
+	retry.Host = ""
+	return t.next.RoundTrip(retry)
+}
+
+// upstreamFailed reports whether a round trip failed on the mirror's side:
+// no response at all, or a 5xx.
+func upstreamFailed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// promoteFallback makes the warm fallback of the distribution whose
+// selected mirror serves u that distribution's mirror, and returns u
+// mapped onto it. It returns nil when u is not on a selected mirror or the
+// distribution has no fallback. The fallback is used up: a second failure
+// waits for the next refresh to pick new mirrors.
+//
+// With Options.SameOperatorFailover, the distribution's mirror on a host
+// another distribution is being served from is preferred to the warm
+// fallback (see operatorFallback), which is then kept for a second
+// failure.
+//
+// A request that failed on one of the other mirrors clients stick to
+// (mirrors.sticky_clients) is sent to the selected mirror instead, and
+// nothing is promoted.
+func (ap *PackageStruct) promoteFallback(u *url.URL) *url.URL {
+	var groups map[string]map[int]string
+	if ap.sameOperator {
+		groups = ap.rewriters.sources.GroupByHost(ap.registry, modesToInit(ap.mode))
+	}
+	ap.rewriters.Mu.Lock()
+	mode, p := ap.rewriterForURL(u)
+	if p == nil {
+		rewriter, failed := ap.stickyMirrorForURL(u)
+		ap.rewriters.Mu.Unlock()
+		if rewriter == nil {
+			return nil
+		}
+		ap.log.Warn().
+			Str("failed", failed.Redacted()).
+			Str("mirror", rewriter.mirror.Redacted()).
+			Msg("sticky mirror failed, retrying on the selected mirror")
+		return onMirror(u, failed, rewriter.mirror)
+	}
+	old := *p
+	alt, next, msg := old.fallback, (*url.URL)(nil), "mirror failed, switched to warm fallback"
+	if shared := ap.operatorFallback(groups, mode, old.mirror); shared != nil {
+		alt, msg = shared, "mirror failed, switched to the operator serving another distribution"
+		if old.fallback != nil && old.fallback.String() != shared.String() {
+			next = old.fallback
+		}
+	}
+	if alt == nil {
+		ap.rewriters.Mu.Unlock()
+		return nil
+	}
+	*p = &URLRewriter{
+		mirror:     alt,
+		fallback:   next,
+		pattern:    old.pattern,
+		source:     MirrorSourceFailover,
+		candidates: old.candidates,
+		inputs:     old.inputs,
+	}
+	ap.rewriters.Mu.Unlock()
+
+	ap.log.Warn().
+		Str("distro", distro.DistributionName(mode)).
+		Str("failed", old.mirror.Redacted()).
+		Str("mirror", alt.Redacted()).
+		Msg(msg)
+	return onMirror(u, old.mirror, alt)
+}
+
+// operatorFallback returns mode's mirror on the host that another
+// distribution's selected mirror is on, looked up in groups (see
+// mirrors.Sources.GroupByHost), or nil. Ubuntu and Debian, say, are often
+// mirrored by the same operator, and one that is serving a distribution
+// is likely to be up for the other. The failed mirror's host is never
+// chosen, and with mirrors.require_https neither is an http:// mirror.
+// Callers hold ap.rewriters.Mu.
+func (ap *PackageStruct) operatorFallback(groups map[string]map[int]string, mode int, failed *url.URL) *url.URL {
+	if len(groups) == 0 {
+		return nil
+	}
+	for _, m := range distroModesOrder {
+		p := rewriterField(ap.rewriters, m)
+		if m == mode || p == nil || *p == nil || (*p).mirror == nil {
+			continue
+		}
+		host := strings.ToLower((*p).mirror.Host)
+		if host == strings.ToLower(failed.Host) {
+			continue
+		}
+		raw, ok := groups[host][mode]
+		if !ok || (ap.state.RequireHTTPS() && !strings.HasPrefix(strings.ToLower(raw), "https://")) {
+			continue
+		}
+		if shared, err := url.Parse(raw); err == nil {
+			return shared
+		}
+	}
+	return nil
+}
+
+// rewriterForURL finds the distribution whose selected mirror serves u.
+// Callers hold ap.rewriters.Mu; p is nil when there is none.
+func (ap *PackageStruct) rewriterForURL(u *url.URL) (mode int, p **URLRewriter) {
+	for _, m := range distroModesOrder {
+		p := rewriterField(ap.rewriters, m)
+		if p == nil || *p == nil || (*p).mirror == nil {
+			continue
+		}
+		if mirror := (*p).mirror; mirror.Host == u.Host && strings.HasPrefix(u.Path, mirror.Path) {
+			return m, p
+		}
+	}
+	return -1, nil
+}
+
+// onMirror maps u, a URL under mirror from, to the same resource under to.
+func onMirror(u, from, to *url.URL) *url.URL {
+	return &url.URL{
+		Scheme:   to.Scheme,
+		Host:     to.Host,
+		Path:     to.Path + strings.TrimPrefix(u.Path, from.Path),
+		RawQuery: u.RawQuery,
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+	"github.com/soulteary/apt-proxy/internal/state"
+)
+
+// pathRecorder is a mirror that answers every request with its path and
+// remembers the paths it was asked for.
+type pathRecorder struct {
+	*httptest.Server
+	down atomic.Bool
+
+	mu    sync.Mutex
+	paths []string
+}
+
+func newPathRecorder(t *testing.T, delay time.Duration) *pathRecorder {
+	t.Helper()
+	m := &pathRecorder{}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		m.paths = append(m.paths, r.URL.Path)
+		m.mu.Unlock()
+		time.Sleep(delay)
+		if m.down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+// takePaths returns the recorded paths and forgets them.
+func (m *pathRecorder) takePaths() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.paths
+	m.paths = nil
+	return p
+}
+
+// newDebianCandidatesStruct benchmarks the given Debian mirrors, and only
+// those, at construction.
+func newDebianCandidatesStruct(t *testing.T, candidates ...string) *PackageStruct {
+	t.Helper()
+	reg := newTestRegistry()
+	deb, _ := reg.GetByID("debian")
+	local := *deb
+	local.Mirrors = nil
+	for _, c := range candidates {
+		local.Mirrors = append(local.Mirrors, distro.URLWithAlias{URL: c, Scheme: "http"})
+	}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+	ps, err := NewPackageStruct(Options{State: state.NewAppState(), Registry: reg, Mode: distro.TypeDebian})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	return ps
+}
+
+// TestFailoverUsesWarmFallback takes the benchmarked primary down and
+// checks the runner-up of the startup benchmark serves the request, and
+// every later one, without any mirror being benchmarked again.
+func TestFailoverUsesWarmFallback(t *testing.T) {
+	primary := newPathRecorder(t, 0)
+	standby := newPathRecorder(t, 30*time.Millisecond)
+	ps := newDebianCandidatesStruct(t, standby.URL+"/debian/", primary.URL+"/debian/")
+
+	rw := ps.rewriters.Debian
+	if rw.mirror.Host != primary.Listener.Addr().String() {
+		t.Fatalf("selected mirror = %s, want the faster %s", rw.mirror, primary.URL)
+	}
+	if rw.fallback == nil || rw.fallback.Host != standby.Listener.Addr().String() {
+		t.Fatalf("fallback = %v, want the runner-up %s", rw.fallback, standby.URL)
+	}
+	run, _ := ps.BenchmarkEngine().LastRun(distro.TypeDebian)
+	primary.takePaths()
+	standby.takePaths()
+
+	primary.down.Store(true)
+	const pkg = "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"
+	if rec := serve(ps, pkg); rec.Code != http.StatusOK || rec.Body.String() != pkg {
+		t.Fatalf("status = %d body = %q, want 200 from the fallback", rec.Code, rec.Body.String())
+	}
+	if got := standby.takePaths(); len(got) != 1 || got[0] != pkg {
+		t.Errorf("fallback received %q, want only the package request", got)
+	}
+
+	rw = ps.rewriters.Debian
+	if rw.mirror.Host != standby.Listener.Addr().String() || rw.source != MirrorSourceFailover {
+		t.Errorf("rewriter mirror = %s source = %q, want the fallback marked %q", rw.mirror, rw.source, MirrorSourceFailover)
+	}
+	primary.takePaths()
+	const index = "/debian/dists/bookworm/InRelease"
+	if rec := serve(ps, index); rec.Code != http.StatusOK {
+		t.Errorf("follow-up request status = %d, want 200", rec.Code)
+	}
+	if got := primary.takePaths(); len(got) != 0 {
+		t.Errorf("failed mirror still received %q after failover", got)
+	}
+	if after, _ := ps.BenchmarkEngine().LastRun(distro.TypeDebian); !after.At.Equal(run.At) {
+		t.Error("failover ran a new benchmark")
+	}
+}
+
+// TestFailoverWithoutFallbackPassesFailureThrough checks a pinned mirror,
+// which has no runner-up, keeps serving its own errors.
+func TestFailoverWithoutFallbackPassesFailureThrough(t *testing.T) {
+	primary := newPathRecorder(t, 0)
+	primary.down.Store(true)
+	st := newTestState()
+	st.SetMirror(distro.TypeDebian, primary.URL+"/debian/")
+	ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+
+	before := ps.rewriters.Debian
+	if rec := serve(ps, "/debian/dists/bookworm/InRelease"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want the mirror's 503", rec.Code)
+	}
+	if ps.rewriters.Debian != before {
+		t.Error("rewriter replaced although there was no fallback")
+	}
+}
+
+// newSharedOperatorStruct serves every distribution, Ubuntu from the
+// pinned ubuntu base and Debian from the benchmarked candidates; the
+// others are pinned to mirrors.example.com.
+func newSharedOperatorStruct(t *testing.T, sameOperator bool, ubuntu string, candidates ...string) *PackageStruct {
+	t.Helper()
+	reg := newTestRegistry()
+	deb, _ := reg.GetByID("debian")
+	local := *deb
+	local.Mirrors = nil
+	for _, c := range candidates {
+		local.Mirrors = append(local.Mirrors, distro.URLWithAlias{URL: c, Scheme: "http"})
+	}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+	st := state.NewAppState()
+	st.SetMirror(distro.TypeUbuntu, ubuntu)
+	st.SetMirror(distro.TypeUbuntuPorts, "http://mirrors.example.com/ubuntu-ports/")
+	st.SetMirror(distro.TypeCentOS, "http://mirrors.example.com/centos/")
+	st.SetMirror(distro.TypeAlpine, "http://mirrors.example.com/alpine/")
+	st.SetMirror(distro.TypeGentoo, "http://mirrors.example.com/gentoo/")
+	st.SetMirror(distro.TypeArch, "http://mirrors.example.com/archlinux/")
+	ps, err := NewPackageStruct(Options{State: st, Registry: reg, Mode: distro.TypeAllDistros, SameOperatorFailover: sameOperator})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	return ps
+}
+
+// TestFailoverPrefersSameOperator takes Debian's benchmarked mirror down
+// while Ubuntu is served by an operator that also mirrors Debian, and
+// checks Debian fails over to that operator rather than to the warm
+// fallback, which is kept for a second failure; without
+// SameOperatorFailover the warm fallback is used.
+func TestFailoverPrefersSameOperator(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		sameOperator bool
+	}{
+		{"same operator", true},
+		{"warm fallback", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newPathRecorder(t, 0)
+			standby := newPathRecorder(t, 30*time.Millisecond)
+			shared := newPathRecorder(t, 60*time.Millisecond)
+			ps := newSharedOperatorStruct(t, tt.sameOperator, shared.URL+"/ubuntu/",
+				shared.URL+"/debian/", standby.URL+"/debian/", primary.URL+"/debian/")
+			if rw := ps.rewriters.Debian; rw.mirror.Host != primary.Listener.Addr().String() {
+				t.Fatalf("selected mirror = %s, want the fastest %s", rw.mirror, primary.URL)
+			}
+			primary.takePaths()
+			standby.takePaths()
+			shared.takePaths()
+
+			primary.down.Store(true)
+			const pkg = "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"
+			if rec := serve(ps, pkg); rec.Code != http.StatusOK || rec.Body.String() != pkg {
+				t.Fatalf("status = %d body = %q, want 200 after failover", rec.Code, rec.Body.String())
+			}
+			want, other := standby, shared
+			if tt.sameOperator {
+				want, other = shared, standby
+			}
+			if got := want.takePaths(); len(got) != 1 || got[0] != pkg {
+				t.Errorf("replacement received %q, want only the package request", got)
+			}
+			if got := other.takePaths(); len(got) != 0 {
+				t.Errorf("other mirror received %q", got)
+			}
+			rw := ps.rewriters.Debian
+			if rw.mirror.Host != want.Listener.Addr().String() || rw.source != MirrorSourceFailover {
+				t.Errorf("rewriter mirror = %s source = %q, want %s marked %q", rw.mirror, rw.source, want.URL, MirrorSourceFailover)
+			}
+			if tt.sameOperator && (rw.fallback == nil || rw.fallback.Host != standby.Listener.Addr().String()) {
+				t.Errorf("fallback after failover = %v, want the warm fallback %s kept", rw.fallback, standby.URL)
+			}
+			if !tt.sameOperator && rw.fallback != nil {
+				t.Errorf("fallback after failover = %s, want it used up", rw.fallback)
+			}
+		})
+	}
+}
+
+// TestFailoverSkipsFailedOperator checks the operator of the failed
+// mirror is not chosen, even when it serves another distribution.
+func TestFailoverSkipsFailedOperator(t *testing.T) {
+	primary := newPathRecorder(t, 0)
+	standby := newPathRecorder(t, 30*time.Millisecond)
+	ps := newSharedOperatorStruct(t, true, primary.URL+"/ubuntu/", standby.URL+"/debian/", primary.URL+"/debian/")
+	primary.down.Store(true)
+	if rec := serve(ps, "/debian/dists/bookworm/InRelease"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 from the warm fallback", rec.Code)
+	}
+	if rw := ps.rewriters.Debian; rw.mirror.Host != standby.Listener.Addr().String() {
+		t.Errorf("rewriter mirror = %s, want the warm fallback %s", rw.mirror, standby.URL)
+	}
+}
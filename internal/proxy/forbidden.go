@@ -0,0 +1,34 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import "net/http"
+
+// forbiddenTransport passes a mirror's 403 for a package file on as 404
+// (transport.treat_403_as_404). Some mirrors forbid files they do not
+// have, where apt expects a 404 and reports a 403 as an error. It sits
+// above the redirect transport, so a CDN's 403 after a redirect counts.
+type forbiddenTransport struct {
+	next http.RoundTripper
+}
+
+func (t *forbiddenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusForbidden && packageFilePattern.MatchString(req.URL.Path) {
+		resp.StatusCode = http.StatusNotFound
+		resp.Status = "404 Not Found"
+	}
+	return resp, err
+}
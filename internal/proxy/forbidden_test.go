@@ -0,0 +1,74 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// forbiddingMirror answers 403 for every file, as mirrors that forbid
+// missing files do, and counts the requests.
+func forbiddingMirror(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestTreat403As404(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		treat  bool
+		path   string
+		status int
+	}{
+		{"missing package", true, "/debian/pool/main/h/hello/hello_9.9-1_amd64.deb", http.StatusNotFound},
+		{"option off", false, "/debian/pool/main/h/hello/hello_9.9-1_amd64.deb", http.StatusForbidden},
+		{"index", true, "/debian/dists/bookworm/Release", http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mirror, requests := forbiddingMirror(t)
+			st := newTestState()
+			st.SetMirror(distro.TypeDebian, mirror.URL+"/debian/")
+			ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian, Treat403As404: tt.treat})
+			if err != nil {
+				t.Fatalf("NewPackageStruct: %v", err)
+			}
+
+			rec := serve(ps, tt.path)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if n := requests.Load(); n != 1 {
+				t.Errorf("mirror asked %d times, want once (no retry)", n)
+			}
+			if tt.status == http.StatusNotFound && rec.Header().Get("Cache-Control") == "" {
+				t.Error("404 without the rule's Cache-Control, want it handled like the mirror's own 404")
+			}
+			if rate, samples := ps.bench.Success().Rate(mirror.URL + "/debian/"); samples > 0 && rate < 1 {
+				t.Errorf("mirror success rate = %v, want the 403 not counted as a failure", rate)
+			}
+		})
+	}
+}
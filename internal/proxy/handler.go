@@ -15,20 +15,27 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"regexp"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	logger "github.com/soulteary/logger-kit"
 	tracing "github.com/soulteary/tracing-kit"
 
 	"github.com/soulteary/apt-proxy/internal/benchmarks"
 	"github.com/soulteary/apt-proxy/internal/distro"
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+	"github.com/soulteary/apt-proxy/internal/mirrors"
 	"github.com/soulteary/apt-proxy/internal/state"
 )
 
@@ -58,6 +65,8 @@ var defaultHostPatterns = []hostPatternEntry{
 	{pattern: distro.DebianHostPattern, rules: distro.DebianDefaultCacheRules},
 	{pattern: distro.CentosHostPattern, rules: distro.CentosDefaultCacheRules},
 	{pattern: distro.AlpineHostPattern, rules: distro.AlpineDefaultCacheRules},
+	{pattern: distro.GentooHostPattern, rules: distro.GentooDefaultCacheRules},
+	{pattern: distro.ArchHostPattern, rules: distro.ArchDefaultCacheRules},
 }
 
 // hostPatternsFromRegistry materialises the registry's pattern→rules map
@@ -97,14 +106,30 @@ func hostPatternsFromRegistry(reg *distro.Registry) []hostPatternEntry {
 // enableKeepAlive: true reuses connections to mirrors (recommended);
 // false disables keep-alives.
 func NewUpstreamTransport(enableKeepAlive bool) *http.Transport {
+	return NewUpstreamTransportWithDialer(enableKeepAlive, 0, DNSOptions{})
+}
+
+// NewUpstreamTransportWithDialer is NewUpstreamTransport with a custom
+// connect timeout (<= 0 means DefaultDialTimeout) and host overrides
+// and/or a custom DNS server applied to upstream dials.
+func NewUpstreamTransportWithDialer(enableKeepAlive bool, dialTimeout time.Duration, dns DNSOptions) *http.Transport {
+	tr, _ := newUpstreamTransport(enableKeepAlive, dialTimeout, dns)
+	return tr
+}
+
+// newUpstreamTransport builds NewUpstreamTransportWithDialer's transport
+// and returns the DNS cache behind its dialer, if any.
+func newUpstreamTransport(enableKeepAlive bool, dialTimeout time.Duration, dns DNSOptions) (*http.Transport, *dnsCache) {
+	dial, cache := upstreamDialer(dns, dialTimeout)
 	return &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
 		ResponseHeaderTimeout: DefaultResponseHeaderTimeout,
 		DisableKeepAlives:     !enableKeepAlive,
 		MaxIdleConns:          DefaultMaxIdleConns,
 		IdleConnTimeout:       DefaultIdleConnTimeout,
 		DisableCompression:    false,
-	}
+	}, cache
 }
 
 // PackageStruct is the main HTTP handler that routes requests to appropriate
@@ -117,6 +142,17 @@ type PackageStruct struct {
 	CacheDir string         // Cache directory path for statistics
 	log      *logger.Logger // Structured logger
 
+	// DistroHandlers optionally replaces Handler for requests whose
+	// matched rule belongs to a given distribution (keyed by distro.Type*),
+	// e.g. to keep that distribution's objects in a store of its own.
+	DistroHandlers map[int]http.Handler
+
+	// IndexHandlers optionally replaces DistroHandlers and Handler for
+	// requests whose matched rule is an index rule (distro.Rule.IsIndex),
+	// keyed by distro.Type*, e.g. to keep index files in a pool of their
+	// own.
+	IndexHandlers map[int]http.Handler
+
 	state    *state.AppState
 	registry *distro.Registry
 	mode     int
@@ -136,6 +172,11 @@ type PackageStruct struct {
 	// used by the underlying ReverseProxy.
 	transport http.RoundTripper
 
+	// dnsCache is the upstream dialer's lookup cache (nil when disabled
+	// or TransportOverride is set). Flushed whenever mirrors are
+	// re-selected.
+	dnsCache *dnsCache
+
 	// hostPatternCache caches the snapshot of registry-derived host
 	// patterns so we don't allocate/copy on every request. RefreshMirrors
 	// clears this pointer; readers fall back to defaultHostPatterns when
@@ -146,18 +187,126 @@ type PackageStruct struct {
 	// (SIGHUP debounced reload + /api/mirrors/refresh) don't race when
 	// rebuilding rewriters. Readers don't take this mutex.
 	refreshMu sync.Mutex
+
+	// bypass holds the compiled cache.bypass_patterns.
+	bypass []*regexp.Regexp
+
+	// queryKeys holds the compiled cache.query_key_patterns. Requests
+	// matching none of them have their query string dropped.
+	queryKeys []*regexp.Regexp
+
+	// disableRewrite sends requests that name a repository host to that
+	// host rather than the selected mirror (proxy.rewrite: false).
+	disableRewrite bool
+
+	// forwardQuery sends a query string dropped from the cache key to
+	// the mirror all the same (cache.forward_query), for signed URLs.
+	forwardQuery bool
+
+	// extensionTTLs overrides rules' Cache-Control by file extension.
+	extensionTTLs extensionTTLs
+
+	// headerTimeouts is Options.ResponseHeaderTimeouts.
+	headerTimeouts headerTimeouts
+
+	// headers edits every proxied response on its way to the client.
+	headers *responseHeaders
+
+	// lazy is non-nil when Options.LazyBenchmark is set: each served
+	// distro's rewriter is built on its first request, under its Once.
+	// The map itself is never modified after construction.
+	lazy  map[int]*sync.Once
+	async bool
+
+	// adoptRedirects is Options.AdoptRedirects, see noteRedirect.
+	adoptRedirects bool
+
+	// sameOperator is Options.SameOperatorFailover, see promoteFallback.
+	sameOperator bool
+
+	// clientIP is Options.ClientIP, keying mirrors.sticky_clients.
+	clientIP func(*http.Request) string
+
+	// maintenance answers every proxied request with 503, see
+	// SetMaintenance; maintenanceRetryAfter is its Retry-After.
+	maintenance           atomic.Bool
+	maintenanceRetryAfter time.Duration
+
+	// badGateway is Options.BadGatewayRetryAfter, nil when off.
+	badGateway *badGatewayRefresh
 }
 
 // Options configures NewPackageStruct.
 type Options struct {
-	State             *state.AppState
-	Registry          *distro.Registry
-	CacheDir          string
-	Logger            *logger.Logger
-	Mode              int
-	EnableKeepAlive   bool
-	Async             bool              // when true, use async (non-blocking) benchmarks during construction
-	TransportOverride http.RoundTripper // optional: caller-supplied transport (mainly for tests)
+	State                 *state.AppState
+	Registry              *distro.Registry
+	CacheDir              string
+	Logger                *logger.Logger
+	Mode                  int
+	EnableKeepAlive       bool
+	DNS                   DNSOptions               // optional: host overrides and custom resolver for upstream dials
+	DialTimeout           time.Duration            // optional: upstream and benchmark connect timeout (0 = DefaultDialTimeout)
+	DistroConcurrency     int                      // optional: distributions benchmarked at once (0 = unlimited)
+	MaxRedirects          int                      // upstream redirects to follow; 0 passes them through (marked no-store)
+	CacheBypass           []*regexp.Regexp         // optional: request paths that are always proxied and never cached
+	CacheQueryKeys        []*regexp.Regexp         // optional: request paths whose query string is kept, and so keys the cache
+	ForwardQuery          bool                     // when true, a query string dropped from the cache key is still sent to the mirror
+	DisableRewrite        bool                     // when true, requests naming their repository host go there instead of to the mirror
+	TTLByExtension        map[string]time.Duration // optional: max-age replacing the matched rule's for files with these extensions
+	SanityCheck           bool                     // when true, refuse HTML pages served as package files
+	Treat403As404         bool                     // when true, a mirror's 403 for a package file reaches the client as 404
+	SanityFailover        bool                     // with SanityCheck, retry a rejected package once on the next fastest benchmarked mirror
+	Async                 bool                     // when true, use async (non-blocking) benchmarks during construction
+	LazyBenchmark         bool                     // when true, pick each distro's mirror on its first request instead of at construction
+	MinSuccessRate        float64                  // optional: pass over mirrors whose recent share of successful proxied requests is lower (0 = off)
+	AdoptRedirects        bool                     // when true, a mirror redirecting to another scheme on its host is replaced by the target
+	SameOperatorFailover  bool                     // when true, a failed mirror is replaced by its distro's mirror on a host another distro is using
+	BenchmarkProbe        benchmarks.Probe         // optional: benchmark request, benchmarks.ProbeHead when empty
+	BenchmarkResultTTL    time.Duration            // optional: how long a benchmark result is kept (0 = benchmarks.DefaultCacheTTL)
+	BenchmarkResultsFile  string                   // optional: file keeping benchmark results across restarts ("" = none)
+	BenchmarkMaxStale     time.Duration            // optional: persisted results older than this are benchmarked again at start (0 = result TTL only)
+	TransportOverride     http.RoundTripper        // optional: caller-supplied transport (mainly for tests)
+	StripHeaders          []string                 // optional: response headers never sent to clients (hop-by-hop ones always are removed)
+	AddHeaders            map[string]string        // optional: response headers set on every proxied response
+	Via                   string                   // optional: name added to Via on upstream requests and proxied responses ("" = no Via)
+	Maintenance           bool                     // when true, start in maintenance mode, see PackageStruct.SetMaintenance
+	MaintenanceRetryAfter time.Duration            // optional: Retry-After of maintenance responses (0 = DefaultMaintenanceRetryAfter)
+
+	// BadGatewayRetryAfter, when positive, answers a 502 with 503 and this
+	// Retry-After while the distribution's mirror is refreshed in the
+	// background, at most once per BadGatewayRefreshInterval
+	// (0 = DefaultBadGatewayRefreshInterval).
+	BadGatewayRetryAfter      time.Duration
+	BadGatewayRefreshInterval time.Duration
+
+	// ClientIP returns the client a request is from, for client-sticky
+	// mirror selection (AppState.StickyClients). Defaults to the host of
+	// the request's RemoteAddr.
+	ClientIP func(*http.Request) string
+
+	// MirrorPathPrefixes maps, per mirror host, repository path prefixes
+	// onto that mirror's layout, e.g. "/ubuntu/" to "/ubuntu-archive/",
+	// for proxied requests and benchmarks alike. See mirrorPaths.
+	MirrorPathPrefixes map[string]map[string]string
+
+	// ResponseHeaderTimeouts bounds, per distribution (distro.Type*),
+	// how long a mirror may take to send the response headers of a
+	// proxied request. Distributions not listed wait
+	// DefaultResponseHeaderTimeout. Ignored with TransportOverride.
+	ResponseHeaderTimeouts map[int]time.Duration
+
+	// MirrorTLS sets certificate verification per HTTPS mirror host, for
+	// proxied requests and benchmarks alike. Hosts not listed get full
+	// verification against the system roots.
+	MirrorTLS map[string]MirrorTLSOptions
+
+	// InflightUpstream, when set, counts the requests outstanding at the
+	// mirrors, see inflightTransport. Benchmark probes are not counted.
+	InflightUpstream prometheus.Gauge
+
+	// MirrorSources is where candidate mirrors are looked up, including
+	// the Server's own geo lookup. nil uses the package-level lookup.
+	MirrorSources *mirrors.Sources
 }
 
 // NewPackageStruct constructs a fully wired PackageStruct using the
@@ -176,39 +325,154 @@ func NewPackageStruct(opts Options) (*PackageStruct, error) {
 		log = logger.Default()
 	}
 
+	var tlsConfigs map[string]*tls.Config
+	if len(opts.MirrorTLS) > 0 {
+		var err error
+		if tlsConfigs, err = mirrorTLSConfigs(opts.MirrorTLS); err != nil {
+			return nil, err
+		}
+		for host, o := range opts.MirrorTLS {
+			if o.InsecureSkipVerify {
+				log.Warn().Str("host", host).Msg("TLS certificate verification disabled for mirror (insecure_skip_verify)")
+			}
+		}
+	}
+
 	transport := opts.TransportOverride
+	var lookups *dnsCache
 	if transport == nil {
-		transport = NewRetryableTransport(NewUpstreamTransport(opts.EnableKeepAlive))
+		var upstream *http.Transport
+		upstream, lookups = newUpstreamTransport(opts.EnableKeepAlive, opts.DialTimeout, opts.DNS)
+		if len(opts.ResponseHeaderTimeouts) > 0 {
+			upstream.ResponseHeaderTimeout = headerTimeouts(opts.ResponseHeaderTimeouts).longest()
+		}
+		transport = upstream
+		if tlsConfigs != nil {
+			transport = newMirrorTLSTransport(upstream, tlsConfigs)
+		}
+		if len(opts.ResponseHeaderTimeouts) > 0 {
+			transport = &headerTimeoutTransport{next: transport}
+		}
+		transport = NewRetryableTransport(transport)
+	}
+	if opts.InflightUpstream != nil {
+		transport = &inflightTransport{next: transport, gauge: opts.InflightUpstream}
+	}
+	paths := newMirrorPaths(opts.MirrorPathPrefixes)
+	transport = newMirrorPathTransport(transport, paths)
+	redirect := newRedirectTransport(transport, opts.MaxRedirects)
+	transport = redirect
+	if opts.Treat403As404 {
+		transport = &forbiddenTransport{next: transport}
+	}
+	success := &successTransport{next: transport}
+	transport = success
+	failover := &failoverTransport{next: transport, log: log}
+	transport = failover
+	var sanity *sanityTransport
+	if opts.SanityCheck {
+		sanity = &sanityTransport{next: transport, log: log}
+		transport = sanity
 	}
 
 	mode := opts.Mode
-	bench := benchmarks.NewEngine()
-	rewriters := newRewriters(mode, opts.State, opts.Registry, opts.Async, bench)
+	bench := benchmarks.NewEngineWithDialTimeout(opts.DialTimeout).
+		WithDistroConcurrency(opts.DistroConcurrency).
+		WithMinSuccessRate(opts.MinSuccessRate).
+		WithProbe(opts.BenchmarkProbe).
+		WithResultTTL(opts.BenchmarkResultTTL).
+		WithResultsFile(opts.BenchmarkResultsFile, opts.BenchmarkMaxStale)
+	if tlsConfigs != nil {
+		// Probe HTTPS mirrors with the same certificate rules as proxied
+		// requests, or a self-signed internal mirror never wins.
+		bench.WithRoundTripper(func(next http.RoundTripper) http.RoundTripper {
+			if tr, ok := next.(*http.Transport); ok {
+				return newMirrorTLSTransport(tr, tlsConfigs)
+			}
+			return next
+		})
+	}
+	if paths != nil {
+		// Probe such mirrors where they serve the benchmark file.
+		bench.WithRoundTripper(func(next http.RoundTripper) http.RoundTripper {
+			return newMirrorPathTransport(next, paths)
+		})
+	}
+	var rewriters *URLRewriters
+	var lazy map[int]*sync.Once
+	if opts.LazyBenchmark {
+		rewriters = &URLRewriters{sources: opts.MirrorSources}
+		lazy = make(map[int]*sync.Once)
+		for _, m := range modesToInit(mode) {
+			lazy[m] = new(sync.Once)
+		}
+	} else {
+		rewriters = newRewriters(mode, opts.State, opts.Registry, opts.Async, bench, opts.MirrorSources)
+	}
+
+	clientIP := opts.ClientIP
+	if clientIP == nil {
+		clientIP = remoteIP
+	}
 
 	ps := &PackageStruct{
-		Rules:     GetRewriteRulesByMode(opts.Registry, mode),
-		CacheDir:  opts.CacheDir,
-		log:       log,
-		state:     opts.State,
-		registry:  opts.Registry,
-		mode:      mode,
-		rewriters: rewriters,
-		bench:     bench,
-		transport: transport,
+		Rules:                 GetRewriteRulesByMode(opts.Registry, mode),
+		CacheDir:              opts.CacheDir,
+		log:                   log,
+		state:                 opts.State,
+		registry:              opts.Registry,
+		mode:                  mode,
+		rewriters:             rewriters,
+		bench:                 bench,
+		transport:             transport,
+		dnsCache:              lookups,
+		bypass:                opts.CacheBypass,
+		queryKeys:             opts.CacheQueryKeys,
+		forwardQuery:          opts.ForwardQuery,
+		disableRewrite:        opts.DisableRewrite,
+		extensionTTLs:         newExtensionTTLs(opts.TTLByExtension),
+		headerTimeouts:        opts.ResponseHeaderTimeouts,
+		headers:               newResponseHeaders(opts.StripHeaders, opts.AddHeaders, viaEntry(1, 1, opts.Via)),
+		lazy:                  lazy,
+		async:                 opts.Async,
+		adoptRedirects:        opts.AdoptRedirects,
+		sameOperator:          opts.SameOperatorFailover,
+		clientIP:              clientIP,
+		maintenanceRetryAfter: opts.MaintenanceRetryAfter,
+		badGateway:            newBadGatewayRefresh(opts.BadGatewayRetryAfter, opts.BadGatewayRefreshInterval),
 		Handler: &httputil.ReverseProxy{
-			Director:  func(r *http.Request) {},
+			// Clients' Cache-Control is dropped in processMatchingRule;
+			// what remains is ours (see bypassCache) and is not meant
+			// for the upstream mirror.
+			Director: func(r *http.Request) {
+				if u, ok := upstreamURL(r); ok {
+					mirror := *u
+					r.URL, r.Host = &mirror, mirror.Host
+				}
+				r.Header.Del("Cache-Control")
+				if via := viaEntry(r.ProtoMajor, r.ProtoMinor, opts.Via); via != "" {
+					r.Header.Add("Via", via)
+				}
+			},
 			Transport: transport,
 		},
 	}
+	ps.maintenance.Store(opts.Maintenance)
+	failover.promote = ps.promoteFallback
+	redirect.redirected = ps.noteRedirect
+	success.record = ps.recordMirrorOutcome
+	if sanity != nil && opts.SanityFailover {
+		sanity.alternate = ps.alternateMirrorURL
+	}
 	return ps, nil
 }
 
 // newRewriters chooses the sync/async constructor based on opts.Async.
-func newRewriters(mode int, st *state.AppState, reg *distro.Registry, async bool, bench *benchmarks.Engine) *URLRewriters {
+func newRewriters(mode int, st *state.AppState, reg *distro.Registry, async bool, bench *benchmarks.Engine, src *mirrors.Sources) *URLRewriters {
 	if async {
-		return CreateNewRewritersAsyncWithEngine(mode, st, reg, bench)
+		return createNewRewritersAsync(mode, st, reg, bench, src)
 	}
-	return CreateNewRewritersWithEngine(mode, st, reg, bench)
+	return createNewRewriters(mode, st, reg, bench, src)
 }
 
 // HandleHomePage serves the home page with statistics
@@ -252,6 +516,10 @@ func (ap *PackageStruct) Registry() *distro.Registry {
 // matches them against caching rules, and routes them to the appropriate handler.
 // If a matching rule is found, the request is processed with cache control headers.
 func (ap *PackageStruct) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if ap.maintenance.Load() {
+		ap.serveMaintenance(rw)
+		return
+	}
 	ctx := r.Context()
 
 	spanCtx, span := tracing.StartSpan(ctx, "proxy.request")
@@ -267,7 +535,8 @@ func (ap *PackageStruct) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		"http.remote_addr": r.RemoteAddr,
 	})
 
-	r = r.WithContext(spanCtx)
+	upstream := &upstreamIP{}
+	r = r.WithContext(withUpstreamIP(withRepoPath(spanCtx), upstream))
 
 	rule := ap.handleExternalURLs(r)
 	if rule != nil {
@@ -277,8 +546,20 @@ func (ap *PackageStruct) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			})
 		}
 
-		if ap.Handler != nil {
-			ap.Handler.ServeHTTP(&responseWriter{rw, rule}, r)
+		// Mirrors only serve reads; refuse anything else here rather than
+		// letting a POST/PUT/DELETE reach the upstream. processMatchingRule
+		// has left such a request unrewritten, so no mirror was chosen.
+		if !readMethod(r.Method) {
+			tracing.SetSpanAttributes(span, map[string]string{
+				"http.status_code": "405",
+			})
+			rw.Header().Set("Allow", "GET, HEAD")
+			apperrors.WriteHTTPError(rw, apperrors.New(apperrors.ErrMethodNotAllowed, "Method not allowed"))
+			return
+		}
+
+		if h := ap.handlerFor(rule); h != nil {
+			h.ServeHTTP(&responseWriter{ResponseWriter: rw, rule: rule, headers: ap.headers, upstream: upstream, retry: ap.retryBadGateway}, ap.repoKeyed(ap.headerTimeouts.apply(r, rule.OS)))
 		} else {
 			tracing.RecordError(span, http.ErrAbortHandler)
 			http.Error(rw, "Internal Server Error: handler not initialized", http.StatusInternalServerError)
@@ -291,11 +572,56 @@ func (ap *PackageStruct) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handlerFor returns the handler serving requests matched by rule: for
+// an index rule the distribution's entry in IndexHandlers, else its entry
+// in DistroHandlers, or Handler.
+func (ap *PackageStruct) handlerFor(rule *distro.Rule) http.Handler {
+	if len(ap.IndexHandlers) > 0 && rule.IsIndex() {
+		if h, ok := ap.IndexHandlers[rule.OS]; ok {
+			return h
+		}
+	}
+	if h, ok := ap.DistroHandlers[rule.OS]; ok {
+		return h
+	}
+	return ap.Handler
+}
+
+// bypassCache reports whether path matches one of the configured
+// cache.bypass_patterns.
+func (ap *PackageStruct) bypassCache(path string) bool {
+	for _, re := range ap.bypass {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepQuery reports whether path matches one of the configured
+// cache.query_key_patterns.
+func (ap *PackageStruct) keepQuery(path string) bool {
+	for _, re := range ap.queryKeys {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
 // responseWriter wraps http.ResponseWriter to inject cache control headers
-// based on the matched caching rule.
+// based on the matched caching rule and apply the client header policy.
 type responseWriter struct {
 	http.ResponseWriter
-	rule *distro.Rule // The matched caching rule for this request
+	rule        *distro.Rule     // The matched caching rule for this request
+	headers     *responseHeaders // proxy.strip_headers / proxy.add_headers
+	upstream    *upstreamIP      // mirror address for UpstreamIPHeader
+	wroteHeader bool
+
+	// retry is asked whether a 502 is answered with 503 instead, see
+	// PackageStruct.retryBadGateway; retrying then discards the body.
+	retry    func(mode int) (time.Duration, bool)
+	retrying bool
 }
 
 // hostPatterns returns this PackageStruct's cached pattern→rules entries,
@@ -321,8 +647,15 @@ func (ap *PackageStruct) invalidateHostPatterns() {
 
 // handleExternalURLs processes requests for external package repositories.
 // It matches the request path against known distribution patterns and returns
-// the appropriate caching rule if a match is found.
+// the appropriate caching rule if a match is found. Ubuntu debug symbols
+// (ddebs.ubuntu.com) are served with the Ubuntu rules whenever Ubuntu is.
 func (ap *PackageStruct) handleExternalURLs(r *http.Request) *distro.Rule {
+	if ap.servesMode(distro.TypeUbuntu) && rewriteDdebsRequest(r) {
+		return ap.processMatchingRule(r, GetRewriteRulesByMode(ap.registry, distro.TypeUbuntu))
+	}
+	if ap.servesMode(distro.TypeDebian) && !ap.keepsHost(r, distro.TypeDebian) {
+		rootDebianSecurityRequest(r)
+	}
 	path := r.URL.Path
 	for _, entry := range ap.hostPatterns() {
 		if entry.pattern.MatchString(path) {
@@ -332,22 +665,155 @@ func (ap *PackageStruct) handleExternalURLs(r *http.Request) *distro.Rule {
 	return nil
 }
 
+// servesMode reports whether mode is one of the distributions this
+// PackageStruct proxies.
+func (ap *PackageStruct) servesMode(mode int) bool {
+	for _, m := range modesToInit(ap.mode) {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
 // processMatchingRule processes a request that matches a distribution pattern.
 // It finds the specific caching rule, removes client cache control headers,
-// and rewrites the URL if necessary.
+// and rewrites the URL if necessary. Paths matching cache.bypass_patterns
+// are proxied even without a caching rule, and marked no-store.
+//
+// A rule without CacheControl marks its paths non-cacheable: they skip
+// the cache layer as well, so a client's If-None-Match / If-Modified-Since
+// goes to the mirror and its 304 is passed back as is, rather than being
+// answered from a copy cached after the mirror's own headers. Cacheable
+// paths ending in an extension of cache.ttl_by_extension_hours get its
+// max-age instead of the rule's.
+//
+// The cache key is built from the request URL, so the query string is
+// dropped unless the path matches cache.query_key_patterns: repository
+// files are addressed by path alone, and a stray "?" from a client must
+// not create a second copy of the same package. Mirrorlists and metalinks
+// that select the resource by query opt in through the patterns. With
+// cache.forward_query the dropped query string still reaches the mirror,
+// see repoKeyed.
 func (ap *PackageStruct) processMatchingRule(r *http.Request, rules []distro.Rule) *distro.Rule {
 	rule, match := MatchingRule(r.URL.Path, rules)
+	bypass := ap.bypassCache(r.URL.Path)
 	if !match {
-		return nil
+		if !bypass || len(rules) == 0 {
+			return nil
+		}
+		rule = &distro.Rule{OS: rules[0].OS, Rewrite: rules[0].Rewrite}
 	}
 
+	if !ap.keepQuery(r.URL.Path) {
+		if ap.forwardQuery {
+			noteForwardQuery(r, r.URL.RawQuery)
+		}
+		r.URL.RawQuery = ""
+		r.URL.ForceQuery = false
+	}
 	r.Header.Del("Cache-Control")
-	if rule.Rewrite {
+	if bypass {
+		// Ask the cache layer to skip both lookup and store, and keep
+		// downstream caches from holding on to the response either.
+		r.Header.Set("Cache-Control", "no-store")
+		bypassed := *rule
+		bypassed.CacheControl = "no-store"
+		rule = &bypassed
+	} else if rule.CacheControl == "" {
+		r.Header.Set("Cache-Control", "no-store")
+	} else {
+		rule = ap.extensionTTLs.apply(r.URL.Path, rule)
+	}
+	// Only reads are proxied (ServeHTTP refuses the rest), so only they
+	// may choose, or benchmark, a mirror.
+	if rule.Rewrite && readMethod(r.Method) && !ap.keepsHost(r, rule.OS) {
 		ap.rewriteRequest(r, rule)
 	}
 	return rule
 }
 
+// readMethod reports whether method is one mirrors serve: GET or HEAD.
+func readMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// keepsHost reports whether r is proxied to the host it names, unchanged:
+// with proxy.rewrite off, a request sent to apt-proxy as an HTTP proxy,
+// whose absolute URL names a repository host of distribution mode (see
+// knownUpstreamHost). A request addressed to apt-proxy itself, or naming
+// any other host, is still sent to the mirror: a path that merely looks
+// like a repository must not turn apt-proxy into an open proxy.
+func (ap *PackageStruct) keepsHost(r *http.Request, mode int) bool {
+	return ap.disableRewrite && r.URL.Host != "" && ap.knownUpstreamHost(mode, r.URL)
+}
+
+// knownUpstreamHost reports whether u names one of the hosts distribution
+// mode is served from: its official domains on the default ports, a
+// mirror of its registry entry, or the mirror apt-proxy selected for it.
+func (ap *PackageStruct) knownUpstreamHost(mode int, u *url.URL) bool {
+	host := strings.ToLower(u.Host)
+	if port := u.Port(); (port == "" || port == "80" || port == "443") && distro.IsOfficialHost(mode, u.Hostname()) {
+		return true
+	}
+	if d, ok := ap.registry.GetByType(mode); ok {
+		for _, m := range d.Mirrors {
+			if mirrorHost(m.URL) == host {
+				return true
+			}
+		}
+	}
+	if m := ap.state.GetMirror(mode); m != nil && strings.ToLower(m.Host) == host {
+		return true
+	}
+	if ap.rewriters == nil {
+		return false
+	}
+	ap.rewriters.Mu.RLock()
+	defer ap.rewriters.Mu.RUnlock()
+	if p := rewriterField(ap.rewriters, mode); p != nil && *p != nil && (*p).mirror != nil {
+		return strings.ToLower((*p).mirror.Host) == host
+	}
+	return false
+}
+
+// mirrorHost returns the lower-case host[:port] of a mirror URL, which
+// the built-in lists often write without a scheme.
+func mirrorHost(raw string) string {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// ensureRewriter builds the rewriter for mode on the first request when
+// mirrors are benchmarked lazily. With Async the request goes to the
+// default mirror while the benchmark runs; otherwise it waits for it.
+func (ap *PackageStruct) ensureRewriter(mode int) {
+	once, ok := ap.lazy[mode]
+	if !ok {
+		return
+	}
+	once.Do(func() {
+		ap.log.Info().Str("distro", distro.DistributionName(mode)).Msg("first request for distribution, selecting mirror")
+		if ap.async {
+			installRewriterAsync(mode, ap.state, ap.registry, ap.rewriters, ap.bench)
+			return
+		}
+		r := createRewriter(mode, ap.state, ap.registry, ap.bench, ap.rewriters.sources)
+		ap.rewriters.Mu.Lock()
+		defer ap.rewriters.Mu.Unlock()
+		// A refresh may have installed one meanwhile; keep the newer.
+		if p := rewriterField(ap.rewriters, mode); p != nil && *p == nil {
+			*p = r
+		}
+	})
+}
+
 // rewriteRequest rewrites the request URL to point to the configured mirror
 // for the distribution. This enables transparent proxying to different mirrors
 // while maintaining the original request path structure.
@@ -356,8 +822,11 @@ func (ap *PackageStruct) rewriteRequest(r *http.Request, rule *distro.Rule) {
 		ap.log.Error().Msg("request URL is nil, cannot rewrite")
 		return
 	}
-	before := r.URL.String()
-	RewriteRequestByMode(r, ap.rewriters, rule.OS)
+	before, query := r.URL.String(), r.URL.RawQuery
+	ap.ensureRewriter(rule.OS)
+	if rel, ok := rewriteRequestForClient(r, ap.rewriters, rule.OS, ap.clientIP(r), ap.state.StickyClients()); ok {
+		noteRepoPath(r, rule.OS, rel, query)
+	}
 
 	if r.URL != nil {
 		r.Host = r.URL.Host
@@ -369,7 +838,8 @@ func (ap *PackageStruct) rewriteRequest(r *http.Request, rule *distro.Rule) {
 }
 
 // RefreshMirrors refreshes this PackageStruct's mirror configuration.
-// Triggered by SIGHUP and POST /api/mirrors/refresh. The mutex serializes
+// Triggered by POST /api/mirrors/refresh; SIGHUP goes through
+// ReloadMirrors, which keeps the benchmark cache. The mutex serializes
 // concurrent refreshes (the rewriter pointer swap inside RefreshRewriters
 // has its own finer-grained lock; this outer lock prevents two refresh
 // runs from racing to clear the benchmark cache and re-elect mirrors at
@@ -380,16 +850,194 @@ func (ap *PackageStruct) rewriteRequest(r *http.Request, rule *distro.Rule) {
 // any other Server's mirror selection. (Historically the engine was a
 // package-level singleton; that coupling was removed in favour of the
 // per-Server engine field above.)
+//
+// Like ReloadMirrors and RefreshDistro, it ends with the heal watchdog,
+// which undoes a rebuild that left a distribution without a mirror.
 func (ap *PackageStruct) RefreshMirrors() {
 	if ap == nil || ap.rewriters == nil {
 		return
 	}
 	ap.refreshMu.Lock()
 	defer ap.refreshMu.Unlock()
+	defer ap.heal(ap.snapshot())
 	ap.invalidateHostPatterns()
+	ap.dnsCache.flush()
+	if ap.lazy != nil {
+		// Only re-benchmark distros that have been requested; the rest
+		// stay untouched until their first request.
+		ap.bench.ClearCache()
+		for _, m := range modesToInit(ap.mode) {
+			if ap.hasRewriter(m) {
+				RefreshRewriterWithEngine(ap.rewriters, m, ap.state, ap.registry, ap.bench)
+			}
+		}
+		return
+	}
 	RefreshRewritersWithEngine(ap.rewriters, ap.mode, ap.state, ap.registry, ap.bench)
 }
 
+// ReloadMirrors applies a configuration reload (SIGHUP) to mirror
+// selection. Unlike RefreshMirrors it keeps the benchmark cache: only the
+// distributions whose mirror settings changed (mirrors.*, the mirror list
+// file, distributions.yaml) are re-benchmarked, the others keep their
+// mirror.
+func (ap *PackageStruct) ReloadMirrors() {
+	if ap == nil || ap.rewriters == nil {
+		return
+	}
+	ap.refreshMu.Lock()
+	defer ap.refreshMu.Unlock()
+	defer ap.heal(ap.snapshot())
+	ap.invalidateHostPatterns()
+	ap.dnsCache.flush()
+	ReloadRewritersWithEngine(ap.rewriters, ap.mode, ap.state, ap.registry, ap.bench)
+}
+
+// SetMinSuccessRate changes Options.MinSuccessRate, for a config reload.
+// It applies from the next mirror selection on.
+func (ap *PackageStruct) SetMinSuccessRate(rate float64) {
+	if ap == nil || ap.bench == nil {
+		return
+	}
+	ap.bench.SetMinSuccessRate(rate)
+}
+
+// hasRewriter reports whether mode's rewriter has been built.
+func (ap *PackageStruct) hasRewriter(mode int) bool {
+	ap.rewriters.Mu.RLock()
+	defer ap.rewriters.Mu.RUnlock()
+	p := rewriterField(ap.rewriters, mode)
+	return p != nil && *p != nil
+}
+
+// RefreshDistro re-benchmarks and rebuilds the rewriter of one distribution
+// (a distro.Type* value), leaving the others untouched. It fails when this
+// PackageStruct does not serve that distribution.
+func (ap *PackageStruct) RefreshDistro(mode int) error {
+	if ap == nil || ap.rewriters == nil {
+		return fmt.Errorf("proxy not initialized")
+	}
+	if _, ok := descriptorByMode[mode]; !ok {
+		return fmt.Errorf("unknown distribution type %d", mode)
+	}
+	if ap.mode != distro.TypeAllDistros && ap.mode != mode {
+		return fmt.Errorf("distribution type %d is not served in the current mode", mode)
+	}
+	ap.refreshMu.Lock()
+	defer ap.refreshMu.Unlock()
+	defer ap.heal(ap.snapshot())
+	ap.dnsCache.flush()
+	RefreshRewriterWithEngine(ap.rewriters, mode, ap.state, ap.registry, ap.bench)
+	return nil
+}
+
+// MirrorStatus describes the mirror selected for one served distribution.
+type MirrorStatus struct {
+	Distro string // distribution ID, e.g. "ubuntu"
+	// Mirror is the selected base URL; empty until the first request
+	// when Options.LazyBenchmark is set.
+	Mirror string
+	// Source is how Mirror was chosen (a MirrorSource value) and
+	// Candidates how many mirrors were considered; both zero until the
+	// mirror is chosen.
+	Source     string
+	Candidates int
+	// RedirectedTo is the base URL Mirror redirects to under another
+	// scheme, when seen and not adopted (Options.AdoptRedirects).
+	RedirectedTo string
+	// Benchmark is the distribution's most recent benchmark, valid when
+	// Benchmarked is true. Explicitly configured mirrors are never
+	// benchmarked.
+	Benchmark   benchmarks.Run
+	Benchmarked bool
+}
+
+// MirrorStatuses reports the selected mirror and last benchmark of every
+// distribution this PackageStruct serves, in distroModesOrder.
+func (ap *PackageStruct) MirrorStatuses() []MirrorStatus {
+	if ap == nil || ap.rewriters == nil {
+		return nil
+	}
+	modes := modesToInit(ap.mode)
+	out := make([]MirrorStatus, 0, len(modes))
+	for _, m := range modes {
+		st := MirrorStatus{Distro: distro.DistributionName(m)}
+		ap.rewriters.Mu.RLock()
+		if p := rewriterField(ap.rewriters, m); p != nil && *p != nil && (*p).mirror != nil {
+			st.Mirror = (*p).mirror.String()
+			st.Source = (*p).source
+			st.Candidates = (*p).candidates
+			if (*p).redirected != nil {
+				st.RedirectedTo = (*p).redirected.String()
+			}
+		}
+		ap.rewriters.Mu.RUnlock()
+		st.Benchmark, st.Benchmarked = ap.bench.LastRun(m)
+		out = append(out, st)
+	}
+	return out
+}
+
+// ActiveDistros returns the IDs of the served distributions whose
+// rewriter has been built, in distroModesOrder. With lazy benchmarking a
+// distribution appears once it has been requested.
+func (ap *PackageStruct) ActiveDistros() []string {
+	if ap == nil || ap.rewriters == nil {
+		return nil
+	}
+	var out []string
+	for _, m := range modesToInit(ap.mode) {
+		if ap.hasRewriter(m) {
+			out = append(out, distro.DistributionName(m))
+		}
+	}
+	return out
+}
+
+// LogMirrorPlan logs one entry per served distribution with the selected
+// mirror, how it was chosen, the candidate count and, for benchmarked
+// mirrors, the measured latency. Mirror URLs are logged with any
+// credentials redacted. Distros not selected yet (lazy benchmarking)
+// are logged with source "pending".
+func (ap *PackageStruct) LogMirrorPlan() {
+	for _, st := range ap.MirrorStatuses() {
+		source := st.Source
+		if source == "" {
+			source = "pending"
+		}
+		ev := ap.log.Info().
+			Str("distro", st.Distro).
+			Int("candidates", st.Candidates).
+			Str("source", source)
+		if u, err := url.Parse(st.Mirror); err == nil && st.Mirror != "" {
+			ev = ev.Str("mirror", u.Redacted())
+		}
+		if st.Source == MirrorSourceBenchmarked && st.Benchmarked && st.Benchmark.Err == nil {
+			ev = ev.Int64("latency_ms", st.Benchmark.Latency.Milliseconds())
+		}
+		ev.Msg("mirror plan")
+	}
+}
+
+// MirrorsReady reports whether every async mirror benchmark started at
+// construction has finished, i.e. rewriters no longer point at the
+// placeholder default mirrors.
+func (ap *PackageStruct) MirrorsReady() bool {
+	if ap == nil {
+		return true
+	}
+	return ap.rewriters.Pending() == 0
+}
+
+// MirrorsIdle returns a channel that is closed once MirrorsReady would
+// report true.
+func (ap *PackageStruct) MirrorsIdle() <-chan struct{} {
+	if ap == nil {
+		return (*URLRewriters)(nil).Idle()
+	}
+	return ap.rewriters.Idle()
+}
+
 // BenchmarkEngine exposes this PackageStruct's private benchmark engine.
 // Callers (tests, debug endpoints) should prefer this over
 // benchmarks.Default() so they observe the same cache the Server uses.
@@ -401,14 +1049,42 @@ func (ap *PackageStruct) BenchmarkEngine() *benchmarks.Engine {
 }
 
 // WriteHeader implements http.ResponseWriter interface. It injects cache control
-// headers based on the matched rule before writing the status code.
+// headers based on the matched rule, then applies the header policy, before
+// writing the status code.
 func (rw *responseWriter) WriteHeader(status int) {
-	if rw.shouldSetCacheControl(status) {
-		rw.Header().Set("Cache-Control", rw.rule.CacheControl)
+	if rw.retrying {
+		return
+	}
+	if !rw.wroteHeader && status == http.StatusBadGateway && rw.retry != nil && rw.rule != nil {
+		if retryAfter, ok := rw.retry(rw.rule.OS); ok {
+			rw.wroteHeader, rw.retrying = true, true
+			serveRetryLater(rw.ResponseWriter, retryAfter)
+			return
+		}
+	}
+	if !rw.wroteHeader && status >= http.StatusOK {
+		rw.wroteHeader = true
+		if rw.shouldSetCacheControl(status) {
+			rw.Header().Set("Cache-Control", rw.rule.CacheControl)
+		}
+		rw.upstream.setHeader(rw.Header())
+		rw.headers.apply(rw.Header())
 	}
 	rw.ResponseWriter.WriteHeader(status)
 }
 
+// Write implements http.ResponseWriter, routing an implicit 200 through
+// WriteHeader so it gets the same headers.
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.retrying {
+		return len(b), nil
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
 // shouldSetCacheControl determines whether cache control headers should be set
 // for the given HTTP status code. Only certain status codes are cacheable.
 func (rw *responseWriter) shouldSetCacheControl(status int) bool {
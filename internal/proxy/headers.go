@@ -0,0 +1,119 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// hopByHopHeaders are the connection-specific fields of RFC 9110 section
+// 7.6.1. httputil.ReverseProxy already drops them from mirror responses;
+// clearing them again on the client-facing response also covers headers
+// added further down the chain, and whatever Connection names.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// cacheVia is the Via entry httpcache-kit sets on cache hits. It stands
+// for apt-proxy itself, which adds its own entry per proxy.via instead.
+const cacheVia = "1.1 httpcache"
+
+// responseHeaders is the client-facing header policy: proxy.strip_headers,
+// proxy.add_headers and the Via entry of proxy.via. A nil
+// *responseHeaders only removes hop-by-hop headers.
+type responseHeaders struct {
+	strip []string
+	via   string
+	add   http.Header
+}
+
+// newResponseHeaders builds the policy, or returns nil when both lists
+// and via are empty. via is the whole Via entry, e.g. "1.1 apt-proxy".
+func newResponseHeaders(strip []string, add map[string]string, via string) *responseHeaders {
+	if len(strip) == 0 && len(add) == 0 && via == "" {
+		return nil
+	}
+	p := &responseHeaders{via: via, add: make(http.Header, len(add))}
+	for _, name := range strip {
+		p.strip = append(p.strip, textproto.CanonicalMIMEHeaderKey(name))
+	}
+	for name, value := range add {
+		p.add.Set(name, value)
+	}
+	return p
+}
+
+// apply edits h in place: configured removals, then the Via entry, then
+// additions, which can replace Via too, then the hop-by-hop headers,
+// which are never forwarded whatever the config says. httpcache-kit's
+// Via entry is always dropped.
+func (p *responseHeaders) apply(h http.Header) {
+	if via := h["Via"]; len(via) > 0 {
+		kept := via[:0]
+		for _, v := range via {
+			if v != cacheVia {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) == 0 {
+			h.Del("Via")
+		} else {
+			h["Via"] = kept
+		}
+	}
+	if p != nil {
+		for _, name := range p.strip {
+			h.Del(name)
+		}
+		if p.via != "" {
+			h.Add("Via", p.via)
+		}
+		for name, values := range p.add {
+			h[name] = append([]string(nil), values...)
+		}
+	}
+	for _, field := range h.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// viaEntry returns the Via entry apt-proxy adds for a message received
+// over HTTP major.minor, e.g. "1.1 apt-proxy" or "2 apt-proxy"; RFC 9110
+// section 7.6.3 leaves out the minor version of HTTP/2 and later. It
+// returns "" for an empty name.
+func viaEntry(major, minor int, name string) string {
+	if name == "" {
+		return ""
+	}
+	if major >= 2 && minor == 0 {
+		return strconv.Itoa(major) + " " + name
+	}
+	return strconv.Itoa(major) + "." + strconv.Itoa(minor) + " " + name
+}
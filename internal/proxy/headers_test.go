@@ -0,0 +1,156 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+func TestResponseHeadersApply(t *testing.T) {
+	h := http.Header{
+		"Set-Cookie":   {"session=1"},
+		"Server":       {"cdn-edge"},
+		"Connection":   {"keep-alive, X-Edge-Trace"},
+		"X-Edge-Trace": {"abc"},
+		"Keep-Alive":   {"timeout=5"},
+		"Upgrade":      {"h2c"},
+		"Via":          {"1.1 cdn"},
+		"Etag":         {`"v1"`},
+	}
+	p := newResponseHeaders([]string{"set-cookie", "SERVER"}, map[string]string{"via": "apt-proxy", "X-Served-By": "apt-proxy"}, "1.1 apt-proxy")
+	p.apply(h)
+
+	for _, name := range []string{"Set-Cookie", "Server", "Connection", "X-Edge-Trace", "Keep-Alive", "Upgrade"} {
+		if v, ok := h[name]; ok {
+			t.Errorf("%s = %q survived, want it removed", name, v)
+		}
+	}
+	if got := h.Values("Via"); len(got) != 1 || got[0] != "apt-proxy" {
+		t.Errorf("Via = %q, want the configured value only", got)
+	}
+	if got := h.Get("X-Served-By"); got != "apt-proxy" {
+		t.Errorf("X-Served-By = %q, want apt-proxy", got)
+	}
+	if got := h.Get("Etag"); got != `"v1"` {
+		t.Errorf("Etag = %q, want it untouched", got)
+	}
+}
+
+func TestResponseHeadersNilPolicyStripsHopByHop(t *testing.T) {
+	h := http.Header{"Connection": {"close"}, "Set-Cookie": {"session=1"}}
+	var p *responseHeaders
+	p.apply(h)
+	if _, ok := h["Connection"]; ok {
+		t.Error("Connection survived the default policy")
+	}
+	if h.Get("Set-Cookie") == "" {
+		t.Error("Set-Cookie removed without proxy.strip_headers")
+	}
+}
+
+// TestPackageStructStripsHeadersFromClientResponse checks the policy on
+// the response seen by the client, including an implicit 200 that never
+// calls WriteHeader.
+func TestPackageStructStripsHeadersFromClientResponse(t *testing.T) {
+	ps := newTestPackageStruct(t, t.TempDir(), distro.TypeAllDistros)
+	ps.headers = newResponseHeaders([]string{"Set-Cookie"}, map[string]string{"X-Served-By": "apt-proxy"}, "")
+	ps.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "tracker=1")
+		w.Header().Set("Content-Type", "application/vnd.debian.binary-package")
+		_, _ = w.Write([]byte("deb"))
+	})
+
+	rr := httptest.NewRecorder()
+	ps.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debian/pool/main/h/hello/hello_2.10_amd64.deb", nil))
+	if got := rr.Header().Get("Set-Cookie"); got != "" {
+		t.Errorf("Set-Cookie = %q reached the client", got)
+	}
+	if got := rr.Header().Get("X-Served-By"); got != "apt-proxy" {
+		t.Errorf("X-Served-By = %q, want apt-proxy", got)
+	}
+	if got := rr.Header().Get("Cache-Control"); got == "" {
+		t.Error("implicit 200 lost the rule's Cache-Control")
+	}
+}
+
+func TestViaEntry(t *testing.T) {
+	tests := []struct {
+		major, minor int
+		name, want   string
+	}{
+		{1, 1, "apt-proxy", "1.1 apt-proxy"},
+		{1, 0, "cache01", "1.0 cache01"},
+		{2, 0, "apt-proxy", "2 apt-proxy"},
+		{1, 1, "", ""},
+	}
+	for _, tt := range tests {
+		if got := viaEntry(tt.major, tt.minor, tt.name); got != tt.want {
+			t.Errorf("viaEntry(%d, %d, %q) = %q, want %q", tt.major, tt.minor, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResponseHeadersReplaceCacheVia(t *testing.T) {
+	h := http.Header{"Via": {"1.1 cdn-edge", cacheVia}}
+	newResponseHeaders(nil, nil, "1.1 apt-proxy").apply(h)
+	if got := h.Values("Via"); !reflect.DeepEqual(got, []string{"1.1 cdn-edge", "1.1 apt-proxy"}) {
+		t.Errorf("Via = %q, want the cache's entry replaced by apt-proxy's", got)
+	}
+
+	h = http.Header{"Via": {cacheVia}}
+	var p *responseHeaders
+	p.apply(h)
+	if _, ok := h["Via"]; ok {
+		t.Errorf("Via = %q survived with proxy.omit_via", h.Values("Via"))
+	}
+}
+
+// TestPackageStructAddsVia checks proxy.via is appended to the Via of
+// both the request sent to the mirror and the response sent back.
+func TestPackageStructAddsVia(t *testing.T) {
+	for _, via := range []string{"apt-proxy", ""} {
+		var upstreamVia atomic.Value
+		mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamVia.Store(r.Header.Values("Via"))
+			w.Header().Set("Via", "1.1 cdn-edge")
+			_, _ = w.Write([]byte("deb"))
+		}))
+		defer mirror.Close()
+		st := newTestState()
+		st.SetMirror(distro.TypeDebian, mirror.URL+"/debian/")
+		ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian, Via: via})
+		if err != nil {
+			t.Fatalf("NewPackageStruct: %v", err)
+		}
+
+		rec := serve(ps, "/debian/pool/main/h/hello/hello_2.10_amd64.deb")
+		wantUpstream, wantClient := []string{"1.1 apt-proxy"}, []string{"1.1 cdn-edge", "1.1 apt-proxy"}
+		if via == "" {
+			wantUpstream, wantClient = nil, []string{"1.1 cdn-edge"}
+		}
+		if got, _ := upstreamVia.Load().([]string); !reflect.DeepEqual(got, wantUpstream) {
+			t.Errorf("via %q: mirror saw Via %q, want %q", via, got, wantUpstream)
+		}
+		if got := rec.Header().Values("Via"); !reflect.DeepEqual(got, wantClient) {
+			t.Errorf("via %q: client got Via %q, want %q", via, got, wantClient)
+		}
+	}
+}
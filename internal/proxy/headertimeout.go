@@ -0,0 +1,97 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// headerTimeouts holds the response header timeouts of distributions
+// whose mirrors answer at a pace of their own, keyed by distro.Type*
+// (transport.response_header_timeout_sec). Distributions not listed
+// wait DefaultResponseHeaderTimeout.
+type headerTimeouts map[int]time.Duration
+
+type headerTimeoutKey struct{}
+
+// longest returns the longest timeout a request may be given: the
+// upstream transport's own ResponseHeaderTimeout must not cut it short.
+func (t headerTimeouts) longest() time.Duration {
+	longest := DefaultResponseHeaderTimeout
+	for _, d := range t {
+		longest = max(longest, d)
+	}
+	return longest
+}
+
+// apply returns r carrying the header timeout of distribution mode for
+// headerTimeoutTransport, or r itself when no timeouts are configured.
+func (t headerTimeouts) apply(r *http.Request, mode int) *http.Request {
+	if len(t) == 0 {
+		return r
+	}
+	d, ok := t[mode]
+	if !ok {
+		d = DefaultResponseHeaderTimeout
+	}
+	return r.WithContext(context.WithValue(r.Context(), headerTimeoutKey{}, d))
+}
+
+// headerTimeoutTransport fails a request whose mirror has not sent the
+// response headers within the request's header timeout (see
+// headerTimeouts.apply). Once they arrive the body may take as long as
+// it needs. Requests without a timeout are left to next's own.
+type headerTimeoutTransport struct {
+	next http.RoundTripper
+}
+
+func (t *headerTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	d, ok := req.Context().Value(headerTimeoutKey{}).(time.Duration)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(d, cancel)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("proxy: timeout awaiting response headers from %s after %s", req.URL.Host, d)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a request's context once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// TestResponseHeaderTimeoutPerDistro sends requests to an Ubuntu and a
+// CentOS mirror that both take 150ms to answer: Ubuntu's 50ms header
+// timeout fails its request, CentOS's 2s one lets it through.
+func TestResponseHeaderTimeoutPerDistro(t *testing.T) {
+	ubuntu := newPathRecorder(t, 150*time.Millisecond)
+	centos := newPathRecorder(t, 150*time.Millisecond)
+	st := newTestState()
+	st.SetMirror(distro.TypeUbuntu, ubuntu.URL+"/ubuntu/")
+	st.SetMirror(distro.TypeCentOS, centos.URL+"/centos/")
+	ps, err := NewPackageStruct(Options{
+		State:         st,
+		Registry:      newTestRegistry(),
+		Mode:          distro.TypeAllDistros,
+		LazyBenchmark: true,
+		ResponseHeaderTimeouts: map[int]time.Duration{
+			distro.TypeUbuntu: 50 * time.Millisecond,
+			distro.TypeCentOS: 2 * time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const rpm = "/centos/9-stream/BaseOS/x86_64/os/Packages/bash-5.1.8-9.el9.x86_64.rpm"
+	if rec := serve(ps, rpm); rec.Code != http.StatusOK || rec.Body.String() != rpm {
+		t.Errorf("centos: status = %d body = %q, want 200 within its 2s timeout", rec.Code, rec.Body.String())
+	}
+	if rec := serve(ps, "/ubuntu/pool/main/h/hello/hello_2.10-3_amd64.deb"); rec.Code != http.StatusBadGateway {
+		t.Errorf("ubuntu: status = %d, want 502 after its 50ms timeout", rec.Code)
+	}
+}
+
+func TestHeaderTimeoutsLongest(t *testing.T) {
+	for _, tt := range []struct {
+		timeouts headerTimeouts
+		want     time.Duration
+	}{
+		{nil, DefaultResponseHeaderTimeout},
+		{headerTimeouts{distro.TypeUbuntu: 10 * time.Second}, DefaultResponseHeaderTimeout},
+		{headerTimeouts{distro.TypeUbuntu: 10 * time.Second, distro.TypeCentOS: 2 * time.Minute}, 2 * time.Minute},
+	} {
+		if got := tt.timeouts.longest(); got != tt.want {
+			t.Errorf("%v.longest() = %s, want %s", tt.timeouts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// inflightTransport counts the requests outstanding at the mirrors in a
+// gauge (apt_proxy_inflight_upstream_requests): from the time one is sent
+// until its response body is closed, as a download is in flight until
+// the cache handler has read it. Retries of a request count once.
+type inflightTransport struct {
+	next  http.RoundTripper
+	gauge prometheus.Gauge
+}
+
+func (t *inflightTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.gauge.Inc()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.gauge.Dec()
+		return nil, err
+	}
+	resp.Body = &decOnClose{ReadCloser: resp.Body, gauge: t.gauge}
+	return resp, nil
+}
+
+// decOnClose takes its request off the gauge once the body is closed.
+type decOnClose struct {
+	io.ReadCloser
+	gauge prometheus.Gauge
+	once  sync.Once
+}
+
+func (b *decOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.gauge.Dec)
+	return err
+}
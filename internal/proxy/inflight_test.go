@@ -0,0 +1,79 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// countingGauge is a prometheus.Gauge keeping count of Inc and Dec.
+type countingGauge struct {
+	prometheus.Gauge
+	n atomic.Int64
+}
+
+func (g *countingGauge) Inc() { g.n.Add(1) }
+func (g *countingGauge) Dec() { g.n.Add(-1) }
+
+// TestInflightUpstreamGauge holds a mirror response and checks the gauge
+// counts the request while it is outstanding and drops back once it is
+// served, and that a failed request does not stay counted.
+func TestInflightUpstreamGauge(t *testing.T) {
+	release := make(chan struct{})
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = w.Write([]byte("deb"))
+	}))
+	defer mirror.Close()
+
+	gauge := &countingGauge{}
+	st := newTestState()
+	st.SetMirror(distro.TypeDebian, mirror.URL+"/debian/")
+	ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian, InflightUpstream: gauge})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(ps, "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb") }()
+	deadline := time.Now().Add(5 * time.Second)
+	for gauge.n.Load() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := gauge.n.Load(); got != 1 {
+		t.Fatalf("gauge while the mirror holds the response = %v, want 1", got)
+	}
+	close(release)
+	if rec := <-done; rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if got := gauge.n.Load(); got != 0 {
+		t.Errorf("gauge once served = %v, want 0", got)
+	}
+
+	mirror.Close()
+	serve(ps, "/debian/pool/main/h/hello/hello_2.10-4_amd64.deb")
+	if got := gauge.n.Load(); got != 0 {
+		t.Errorf("gauge after a failed request = %v, want 0", got)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultMaintenanceRetryAfter is the Retry-After of maintenance
+// responses when Options.MaintenanceRetryAfter is not set.
+const DefaultMaintenanceRetryAfter = 5 * time.Minute
+
+// SetMaintenance turns maintenance mode on or off. In maintenance mode
+// every proxied request, cached or not, is answered with 503 and a
+// Retry-After so apt backs off; the home page, health and management
+// endpoints are served as usual, as they do not go through ServeHTTP.
+func (ap *PackageStruct) SetMaintenance(on bool) {
+	if ap == nil || ap.maintenance.Swap(on) == on {
+		return
+	}
+	if on {
+		ap.log.Warn().Dur("retry_after", ap.MaintenanceRetryAfter()).Msg("maintenance mode on, answering package requests with 503")
+	} else {
+		ap.log.Info().Msg("maintenance mode off, proxying package requests again")
+	}
+}
+
+// InMaintenance reports whether maintenance mode is on.
+func (ap *PackageStruct) InMaintenance() bool {
+	return ap != nil && ap.maintenance.Load()
+}
+
+// MaintenanceRetryAfter returns the Retry-After of maintenance responses.
+func (ap *PackageStruct) MaintenanceRetryAfter() time.Duration {
+	if ap == nil || ap.maintenanceRetryAfter <= 0 {
+		return DefaultMaintenanceRetryAfter
+	}
+	return ap.maintenanceRetryAfter
+}
+
+// serveMaintenance answers a request in maintenance mode.
+func (ap *PackageStruct) serveMaintenance(rw http.ResponseWriter) {
+	rw.Header().Set("Retry-After", strconv.Itoa(int(ap.MaintenanceRetryAfter()/time.Second)))
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = io.WriteString(rw, "apt-proxy is down for maintenance, retry later\n")
+}
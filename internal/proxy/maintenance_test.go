@@ -0,0 +1,77 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	logger "github.com/soulteary/logger-kit"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	st := newTestState()
+	ps, err := NewPackageStruct(Options{
+		State:                 st,
+		Registry:              newTestRegistry(),
+		CacheDir:              t.TempDir(),
+		Logger:                logger.Default(),
+		Mode:                  st.GetProxyMode(),
+		Maintenance:           true,
+		MaintenanceRetryAfter: 2 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	var upstream atomic.Int32
+	ps.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.Add(1)
+		_, _ = w.Write([]byte("deb"))
+	})
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		ps.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debian/pool/main/h/hello/hello_2.10_amd64.deb", nil))
+		return rr
+	}
+
+	if !ps.InMaintenance() {
+		t.Fatal("InMaintenance() = false with Options.Maintenance")
+	}
+	rr := get()
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "120" {
+		t.Errorf("in maintenance: %d, Retry-After %q; want 503, 120", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if n := upstream.Load(); n != 0 {
+		t.Errorf("handler called %d times in maintenance mode, want 0", n)
+	}
+
+	ps.SetMaintenance(false)
+	if rr := get(); rr.Code != http.StatusOK || rr.Body.String() != "deb" {
+		t.Errorf("after maintenance: %d %q, want the handler's 200", rr.Code, rr.Body.String())
+	}
+	if n := upstream.Load(); n != 1 {
+		t.Errorf("handler called %d times, want 1", n)
+	}
+}
+
+func TestMaintenanceRetryAfterDefault(t *testing.T) {
+	ps := newTestPackageStruct(t, t.TempDir(), 0)
+	if got := ps.MaintenanceRetryAfter(); got != DefaultMaintenanceRetryAfter {
+		t.Errorf("MaintenanceRetryAfter() = %s, want %s", got, DefaultMaintenanceRetryAfter)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// MirrorTLSOptions relaxes or narrows certificate verification for one
+// HTTPS mirror host, typically an internal mirror with a self-signed or
+// private-CA certificate. The zero value is full verification against the
+// system roots, which is also what every host without options gets.
+type MirrorTLSOptions struct {
+	// InsecureSkipVerify accepts any certificate. Dangerous: only for
+	// testing, and logged as a warning at startup.
+	InsecureSkipVerify bool
+	// CAFile is a PEM bundle used instead of the system roots.
+	CAFile string
+	// PinnedSHA256 lists hex SHA-256 fingerprints of the accepted leaf
+	// certificates (colons optional, as printed by "openssl x509
+	// -fingerprint -sha256"). A matching pin replaces CA verification
+	// unless CAFile is also set, in which case both must pass.
+	PinnedSHA256 []string
+}
+
+// mirrorTLSConfigs builds a client TLS config per host, keyed by
+// lower-cased hostname.
+func mirrorTLSConfigs(opts map[string]MirrorTLSOptions) (map[string]*tls.Config, error) {
+	configs := make(map[string]*tls.Config, len(opts))
+	for host, o := range opts {
+		cfg, err := mirrorTLSConfig(o)
+		if err != nil {
+			return nil, fmt.Errorf("mirror TLS for %s: %w", host, err)
+		}
+		configs[strings.ToLower(host)] = cfg
+	}
+	return configs, nil
+}
+
+func mirrorTLSConfig(o MirrorTLSOptions) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.InsecureSkipVerify {
+		cfg.InsecureSkipVerify = true
+		return cfg, nil
+	}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+	}
+	if len(o.PinnedSHA256) == 0 {
+		return cfg, nil
+	}
+
+	pins := make([][]byte, 0, len(o.PinnedSHA256))
+	for _, p := range o.PinnedSHA256 {
+		pin, err := parseCertFingerprint(p)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	roots := cfg.RootCAs
+	// Default verification is switched off and redone in VerifyConnection:
+	// the pin, plus the chain when a CA file was given.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("mirror sent no certificate")
+		}
+		leaf := cs.PeerCertificates[0]
+		if roots != nil {
+			inter := x509.NewCertPool()
+			for _, c := range cs.PeerCertificates[1:] {
+				inter.AddCert(c)
+			}
+			if _, err := leaf.Verify(x509.VerifyOptions{DNSName: cs.ServerName, Roots: roots, Intermediates: inter}); err != nil {
+				return err
+			}
+		}
+		sum := sha256.Sum256(leaf.Raw)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate fingerprint %x matches no pinned_sha256", sum)
+	}
+	return cfg, nil
+}
+
+// parseCertFingerprint decodes a hex SHA-256 certificate fingerprint,
+// with or without colons.
+func parseCertFingerprint(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(s), ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 fingerprint %q", s)
+	}
+	return b, nil
+}
+
+// NewMirrorTLSTransport returns a wrapper for
+// benchmarks.Engine.WithRoundTripper that applies opts to mirror
+// benchmarks the way proxied requests do; see newMirrorTLSTransport. It
+// leaves a transport other than *http.Transport as it is.
+func NewMirrorTLSTransport(opts map[string]MirrorTLSOptions) (func(http.RoundTripper) http.RoundTripper, error) {
+	configs, err := mirrorTLSConfigs(opts)
+	if err != nil {
+		return nil, err
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		tr, ok := next.(*http.Transport)
+		if !ok {
+			return next
+		}
+		return newMirrorTLSTransport(tr, configs)
+	}, nil
+}
+
+// mirrorTLSTransport sends HTTPS requests for the hosts in configs over
+// listed, a copy of the upstream transport that handshakes with the
+// host's config, and every other request over next, which keeps its own
+// TLS handling (handshake timeout, HTTP/2, TLSClientConfig).
+type mirrorTLSTransport struct {
+	next    http.RoundTripper
+	listed  http.RoundTripper
+	configs map[string]*tls.Config
+}
+
+func newMirrorTLSTransport(next *http.Transport, configs map[string]*tls.Config) *mirrorTLSTransport {
+	listed := next.Clone()
+	listed.DialTLSContext = dialMirrorTLS(listed.DialContext, configs)
+	return &mirrorTLSTransport{next: next, listed: listed, configs: configs}
+}
+
+func (t *mirrorTLSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		if _, ok := t.configs[strings.ToLower(req.URL.Hostname())]; ok {
+			return t.listed.RoundTrip(req)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// dialMirrorTLS returns a DialTLSContext that connects with dial and
+// handshakes with the host's config from configs. mirrorTLSTransport
+// sends it listed hosts only.
+func dialMirrorTLS(dial dialFunc, configs map[string]*tls.Config) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg, ok := configs[strings.ToLower(host)]
+		if !ok {
+			return nil, fmt.Errorf("no mirror TLS options for %s", host)
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+		raw, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn := tls.Client(raw, cfg)
+		if err := conn.HandshakeContext(ctx); err != nil {
+			_ = raw.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
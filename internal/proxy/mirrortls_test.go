@@ -0,0 +1,186 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newSelfSignedMirror starts an HTTPS server with httptest's self-signed
+// certificate and returns it with the path of a PEM file holding that
+// certificate.
+func newSelfSignedMirror(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "mirror-ca.pem")
+	f, err := os.Create(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return srv, caFile
+}
+
+// getWithMirrorTLS fetches srv through a transport dialing with opts for
+// the test server's host, the way NewPackageStruct wires it.
+func getWithMirrorTLS(t *testing.T, srv *httptest.Server, o *MirrorTLSOptions) error {
+	t.Helper()
+	opts := map[string]MirrorTLSOptions{}
+	if o != nil {
+		opts["127.0.0.1"] = *o
+	}
+	configs, err := mirrorTLSConfigs(opts)
+	if err != nil {
+		t.Fatalf("mirrorTLSConfigs() error = %v", err)
+	}
+	tr, _ := newUpstreamTransport(false, 0, DNSOptions{})
+	defer tr.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: newMirrorTLSTransport(tr, configs)}).Get(srv.URL + "/ubuntu/dists/noble/InRelease")
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	return nil
+}
+
+func TestMirrorTLSSelfSignedNeedsCAFile(t *testing.T) {
+	srv, caFile := newSelfSignedMirror(t)
+
+	if err := getWithMirrorTLS(t, srv, nil); err == nil {
+		t.Error("self-signed mirror accepted without options; want verification failure")
+	}
+	if err := getWithMirrorTLS(t, srv, &MirrorTLSOptions{CAFile: caFile}); err != nil {
+		t.Errorf("self-signed mirror rejected with its ca_file: %v", err)
+	}
+}
+
+func TestMirrorTLSPinnedFingerprint(t *testing.T) {
+	srv, caFile := newSelfSignedMirror(t)
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	pin := strings.ToUpper(hex.EncodeToString(sum[:]))
+	// openssl style: AB:CD:...
+	var colon []string
+	for i := 0; i < len(pin); i += 2 {
+		colon = append(colon, pin[i:i+2])
+	}
+	wrong := strings.Repeat("00", sha256.Size)
+
+	tests := []struct {
+		name    string
+		opts    MirrorTLSOptions
+		wantErr bool
+	}{
+		{"matching pin", MirrorTLSOptions{PinnedSHA256: []string{pin}}, false},
+		{"matching pin with colons", MirrorTLSOptions{PinnedSHA256: []string{wrong, strings.Join(colon, ":")}}, false},
+		{"wrong pin", MirrorTLSOptions{PinnedSHA256: []string{wrong}}, true},
+		{"pin and ca_file", MirrorTLSOptions{CAFile: caFile, PinnedSHA256: []string{pin}}, false},
+		{"wrong pin with ca_file", MirrorTLSOptions{CAFile: caFile, PinnedSHA256: []string{wrong}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := getWithMirrorTLS(t, srv, &tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMirrorTLSInsecureSkipVerify(t *testing.T) {
+	srv, _ := newSelfSignedMirror(t)
+	if err := getWithMirrorTLS(t, srv, &MirrorTLSOptions{InsecureSkipVerify: true}); err != nil {
+		t.Errorf("insecure_skip_verify mirror rejected: %v", err)
+	}
+}
+
+// TestMirrorTLSLeavesUnlistedHostsToTransport checks that a host without
+// mirror TLS options keeps the upstream transport's own TLS handling: its
+// TLSClientConfig and HTTP/2.
+func TestMirrorTLSLeavesUnlistedHostsToTransport(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	configs, err := mirrorTLSConfigs(map[string]MirrorTLSOptions{"mirror.internal": {InsecureSkipVerify: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, _ := newUpstreamTransport(false, 0, DNSOptions{})
+	tr.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tr.ForceAttemptHTTP2 = true
+	defer tr.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: newMirrorTLSTransport(tr, configs)}).Get(srv.URL + "/ubuntu/dists/noble/InRelease")
+	if err != nil {
+		t.Fatalf("unlisted host lost the transport's TLSClientConfig: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("proto = %s, want HTTP/2 from the transport's own TLS path", resp.Proto)
+	}
+}
+
+func TestMirrorTLSConfigsRejectsBadInput(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for name, o := range map[string]MirrorTLSOptions{
+		"missing ca_file": {CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"empty ca_file":   {CAFile: empty},
+		"short pin":       {PinnedSHA256: []string{"abcd"}},
+	} {
+		if _, err := mirrorTLSConfigs(map[string]MirrorTLSOptions{"mirror.internal": o}); err == nil {
+			t.Errorf("%s: mirrorTLSConfigs() error = nil", name)
+		}
+	}
+}
+
+func TestNewPackageStructMirrorTLSError(t *testing.T) {
+	_, err := NewPackageStruct(Options{
+		State:     newTestState(),
+		Registry:  newTestRegistry(),
+		CacheDir:  t.TempDir(),
+		MirrorTLS: map[string]MirrorTLSOptions{"mirror.internal": {PinnedSHA256: []string{"nope"}}},
+	})
+	if err == nil {
+		t.Fatal("NewPackageStruct() with an invalid pin: error = nil")
+	}
+}
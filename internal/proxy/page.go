@@ -17,7 +17,9 @@ package proxy
 import (
 	"bytes"
 	"embed"
+	"fmt"
 	"html/template"
+	"net/url"
 	"sync"
 )
 
@@ -31,6 +33,44 @@ type HomePageData struct {
 	AvailableSize string
 	MemoryUsage   string
 	Goroutines    string
+	Mirrors       []HomeMirror
+}
+
+// HomeMirror is one row of the home page's mirror table.
+type HomeMirror struct {
+	Distro  string
+	Mirror  string // selected base URL, credentials redacted
+	Latency string // last benchmark latency, or why there is none
+}
+
+// HomeMirrors lists the mirror selected for each active distribution with
+// the latency its benchmark measured. While the startup benchmarks run
+// (Options.Async) the placeholder mirror is listed as "benchmarking".
+func (ap *PackageStruct) HomeMirrors() []HomeMirror {
+	var out []HomeMirror
+	for _, st := range ap.MirrorStatuses() {
+		if st.Mirror == "" {
+			continue
+		}
+		row := HomeMirror{Distro: st.Distro, Mirror: st.Mirror}
+		if u, err := url.Parse(st.Mirror); err == nil {
+			row.Mirror = u.Redacted()
+		}
+		switch {
+		case st.Source == MirrorSourceSpecified:
+			row.Latency = "configured"
+		case (st.Source == MirrorSourceBenchmarked || st.Source == MirrorSourceCached) && st.Benchmarked && st.Benchmark.Err == nil:
+			row.Latency = fmt.Sprintf("%d ms", st.Benchmark.Latency.Milliseconds())
+		case st.Source == MirrorSourceDefault && !st.Benchmarked:
+			row.Latency = "benchmarking"
+		case st.Benchmarked && st.Benchmark.Err != nil:
+			row.Latency = "benchmark failed"
+		default:
+			row.Latency = st.Source
+		}
+		out = append(out, row)
+	}
+	return out
 }
 
 var (
@@ -64,14 +104,17 @@ func GetBaseTemplate(cacheSize string, filesNumber string, availableSize string,
 		return getErrorPage(err)
 	}
 
-	data := HomePageData{
+	return renderHomePage(tmpl, HomePageData{
 		CacheSize:     cacheSize,
 		FilesNumber:   filesNumber,
 		AvailableSize: availableSize,
 		MemoryUsage:   memoryUsage,
 		Goroutines:    goroutines,
-	}
+	})
+}
 
+// renderHomePage renders tmpl with data, or the error page.
+func renderHomePage(tmpl *template.Template, data HomePageData) string {
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, data); err != nil {
 		return getErrorPage(err)
@@ -0,0 +1,114 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// mirrorPaths is the mirrors.path_prefixes table: for each mirror host, the
+// path prefixes of apt-proxy's canonical repository layout and what they
+// are replaced with on that mirror, for mirrors serving a distribution
+// under another tree (/ubuntu-archive/ for /ubuntu/, pool and dists in
+// different places, ...). Mirror URLs, cache keys, failover and
+// benchmarks all use the canonical paths; only requests on the wire are
+// rewritten.
+type mirrorPaths map[string][]pathPrefix
+
+// pathPrefix replaces the path prefix from with to.
+type pathPrefix struct {
+	from, to string
+}
+
+// newMirrorPaths builds the table from host -> from -> to, longest
+// prefixes first, or returns nil for an empty one. Hosts are matched
+// case-insensitively, with their port if they name one.
+func newMirrorPaths(prefixes map[string]map[string]string) mirrorPaths {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	m := make(mirrorPaths, len(prefixes))
+	for host, table := range prefixes {
+		host = strings.ToLower(host)
+		for from, to := range table {
+			m[host] = append(m[host], pathPrefix{from: from, to: to})
+		}
+		sort.Slice(m[host], func(i, j int) bool {
+			a, b := m[host][i].from, m[host][j].from
+			if len(a) != len(b) {
+				return len(a) > len(b)
+			}
+			return a < b
+		})
+	}
+	return m
+}
+
+// translate returns path as served by the mirror at host, and whether a
+// prefix applied.
+func (m mirrorPaths) translate(host, path string) (string, bool) {
+	table, ok := m[strings.ToLower(host)]
+	if !ok {
+		// Entries without a port match the host on any port.
+		if i := strings.LastIndexByte(host, ':'); i > 0 {
+			table, ok = m[strings.ToLower(host[:i])]
+		}
+	}
+	if !ok {
+		return path, false
+	}
+	for _, p := range table {
+		if strings.HasPrefix(path, p.from) {
+			return p.to + path[len(p.from):], true
+		}
+	}
+	return path, false
+}
+
+// mirrorPathTransport sends each request with its path translated for
+// its mirror. It sits directly above the upstream transport, so every
+// layer above sees the canonical URL.
+type mirrorPathTransport struct {
+	next  http.RoundTripper
+	paths mirrorPaths
+}
+
+// NewMirrorPathTransport returns next sending each request with its path
+// translated by the mirrors.path_prefixes table prefixes, for clients
+// outside a PackageStruct such as the mirrors-test benchmark engine.
+func NewMirrorPathTransport(next http.RoundTripper, prefixes map[string]map[string]string) http.RoundTripper {
+	return newMirrorPathTransport(next, newMirrorPaths(prefixes))
+}
+
+// newMirrorPathTransport wraps next, or returns next itself when paths
+// is empty.
+func newMirrorPathTransport(next http.RoundTripper, paths mirrorPaths) http.RoundTripper {
+	if len(paths) == 0 {
+		return next
+	}
+	return &mirrorPathTransport{next: next, paths: paths}
+}
+
+func (t *mirrorPathTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path, ok := t.paths.translate(req.URL.Host, req.URL.Path)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	out := req.Clone(req.Context())
+	out.URL.Path, out.URL.RawPath = path, ""
+	return t.next.RoundTrip(out)
+}
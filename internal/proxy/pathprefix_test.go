@@ -0,0 +1,136 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+	"github.com/soulteary/apt-proxy/internal/state"
+)
+
+func TestMirrorPathsTranslate(t *testing.T) {
+	paths := newMirrorPaths(map[string]map[string]string{
+		"Mirror.Example.com": {
+			"/ubuntu/":      "/ubuntu-archive/",
+			"/ubuntu/pool/": "/ubuntu-pool/",
+		},
+		"other.example.com:8080": {"/debian/": "/pub/debian/"},
+	})
+	for _, tt := range []struct {
+		host, path string
+		want       string
+		wantOK     bool
+	}{
+		{"mirror.example.com", "/ubuntu/dists/noble/InRelease", "/ubuntu-archive/dists/noble/InRelease", true},
+		{"mirror.example.com:443", "/ubuntu/dists/noble/InRelease", "/ubuntu-archive/dists/noble/InRelease", true},
+		{"mirror.example.com", "/ubuntu/pool/main/h/hello/hello_2.10_amd64.deb", "/ubuntu-pool/main/h/hello/hello_2.10_amd64.deb", true},
+		{"mirror.example.com", "/ubuntu-ports/dists/noble/InRelease", "/ubuntu-ports/dists/noble/InRelease", false},
+		{"other.example.com:8080", "/debian/dists/bookworm/Release", "/pub/debian/dists/bookworm/Release", true},
+		{"other.example.com", "/debian/dists/bookworm/Release", "/debian/dists/bookworm/Release", false},
+		{"unlisted.example.com", "/ubuntu/dists/noble/InRelease", "/ubuntu/dists/noble/InRelease", false},
+	} {
+		got, ok := paths.translate(tt.host, tt.path)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("translate(%q, %q) = %q, %v; want %q, %v", tt.host, tt.path, got, ok, tt.want, tt.wantOK)
+		}
+	}
+	if newMirrorPaths(nil) != nil {
+		t.Error("newMirrorPaths(nil) != nil")
+	}
+}
+
+// archiveMirror serves files only under /debian-archive/ and records the
+// paths asked for.
+type archiveMirror struct {
+	*httptest.Server
+	mu    sync.Mutex
+	paths []string
+}
+
+func newArchiveMirror(t *testing.T) *archiveMirror {
+	t.Helper()
+	m := &archiveMirror{}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		m.paths = append(m.paths, r.URL.Path)
+		m.mu.Unlock()
+		if !strings.HasPrefix(r.URL.Path, "/debian-archive/") {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, "served "+r.URL.Path)
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *archiveMirror) requested() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.paths...)
+}
+
+func (m *archiveMirror) prefixes() map[string]map[string]string {
+	u, _ := url.Parse(m.URL)
+	return map[string]map[string]string{u.Host: {"/debian/": "/debian-archive/"}}
+}
+
+func TestMirrorPathPrefixProxied(t *testing.T) {
+	mirror := newArchiveMirror(t)
+	st := state.NewAppState()
+	st.SetMirror(distro.TypeDebian, mirror.URL+"/debian/")
+	ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian, MirrorPathPrefixes: mirror.prefixes()})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+
+	rec := serve(ps, "/debian/dists/bookworm/Release")
+	if rec.Code != http.StatusOK || rec.Body.String() != "served /debian-archive/dists/bookworm/Release" {
+		t.Errorf("response = %d %q, want the file from the mirror's own tree", rec.Code, rec.Body.String())
+	}
+	if got := mirror.requested(); len(got) != 1 || got[0] != "/debian-archive/dists/bookworm/Release" {
+		t.Errorf("mirror asked for %q, want /debian-archive/dists/bookworm/Release", got)
+	}
+}
+
+func TestMirrorPathPrefixBenchmarked(t *testing.T) {
+	mirror := newArchiveMirror(t)
+	reg := newTestRegistry()
+	d, _ := reg.GetByID("debian")
+	local := *d
+	local.Mirrors = []distro.URLWithAlias{{URL: mirror.URL + "/debian/", Scheme: "http"}}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+
+	ps, err := NewPackageStruct(Options{State: state.NewAppState(), Registry: reg, Mode: distro.TypeDebian, MirrorPathPrefixes: mirror.prefixes()})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	probes := mirror.requested()
+	if len(probes) == 0 || !strings.HasPrefix(probes[0], "/debian-archive/") {
+		t.Fatalf("benchmark probed %q, want the mirror's own tree", probes)
+	}
+	if run, ok := ps.bench.LastRun(distro.TypeDebian); !ok || run.Err != nil || run.Mirror != mirror.URL+"/debian/" {
+		t.Errorf("LastRun() = %+v, %v; want the mirror benchmarked under its usual URL", run, ok)
+	}
+}
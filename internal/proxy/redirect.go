@@ -0,0 +1,162 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// DefaultMaxRedirects caps how many upstream redirects are followed for a
+// single proxied request before giving up.
+const DefaultMaxRedirects = 5
+
+// redirectTransport follows upstream 3xx responses (mirror -> CDN) so the
+// cache stores the final body under the original URL instead of the
+// redirect. Redirects that are not followed are marked no-store, keeping
+// them out of the cache either way.
+type redirectTransport struct {
+	next         http.RoundTripper
+	maxRedirects int // 0 passes redirects through untouched (apart from no-store)
+
+	// redirected, when set, is told the original and the final URL of
+	// every followed redirect that ended in a successful response.
+	redirected func(from, to *url.URL)
+}
+
+// newRedirectTransport wraps next. maxRedirects <= 0 disables following.
+func newRedirectTransport(next http.RoundTripper, maxRedirects int) *redirectTransport {
+	if maxRedirects < 0 {
+		maxRedirects = 0
+	}
+	return &redirectTransport{next: next, maxRedirects: maxRedirects}
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	from := req.URL
+	for hops := 0; ; hops++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || !isFollowableRedirect(resp.StatusCode) {
+			if hops > 0 && err == nil && resp.StatusCode < http.StatusBadRequest && t.redirected != nil {
+				t.redirected(from, req.URL)
+			}
+			return resp, err
+		}
+
+		loc, locErr := resp.Location()
+		if t.maxRedirects == 0 || locErr != nil {
+			resp.Header.Set("Cache-Control", "no-store")
+			return resp, nil
+		}
+		if hops >= t.maxRedirects {
+			drainAndClose(resp.Body)
+			return nil, fmt.Errorf("proxy: stopped after %d redirects from %s", t.maxRedirects, req.URL)
+		}
+		drainAndClose(resp.Body)
+
+		next := req.Clone(req.Context())
+		next.URL = loc
+		next.Host = ""
+		if loc.Host != req.URL.Host {
+			next.Header.Del("Authorization")
+		}
+		req = next
+	}
+}
+
+// isFollowableRedirect reports whether status is a redirect carrying a
+// Location to follow. 304 is a cache validation response, not a redirect.
+func isFollowableRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// drainAndClose discards a bounded amount of body so the connection can be
+// reused, then closes it.
+func drainAndClose(body io.ReadCloser) {
+	if body == nil {
+		return
+	}
+	_, _ = io.CopyN(io.Discard, body, 4<<10)
+	_ = body.Close()
+}
+
+// noteRedirect records that from, on a distribution's selected mirror,
+// was redirected to to. When to is the same resource on the mirror's host
+// under another scheme, typically http:// to https://, the rewriter keeps
+// that base as redirected; with Options.AdoptRedirects it becomes the
+// distribution's mirror instead, so later requests skip the redirect.
+// Redirects that change the host or the path (CDNs, per-file redirectors)
+// are only followed.
+func (ap *PackageStruct) noteRedirect(from, to *url.URL) {
+	ap.rewriters.Mu.Lock()
+	mode, p := ap.rewriterForURL(from)
+	if p == nil || (*p).mirror.Scheme != from.Scheme {
+		ap.rewriters.Mu.Unlock()
+		return
+	}
+	old := *p
+	target := redirectedMirror(old.mirror, from, to)
+	if target == nil || (!ap.adoptRedirects && old.redirected != nil && *old.redirected == *target) {
+		ap.rewriters.Mu.Unlock()
+		return
+	}
+	next := *old
+	if ap.adoptRedirects {
+		next.mirror = target
+		next.redirected = nil
+		next.source = MirrorSourceRedirected
+	} else {
+		next.redirected = target
+	}
+	*p = &next
+	ap.rewriters.Mu.Unlock()
+
+	ap.log.Info().
+		Str("distro", distro.DistributionName(mode)).
+		Str("mirror", old.mirror.Redacted()).
+		Str("redirected", target.Redacted()).
+		Bool("adopted", ap.adoptRedirects).
+		Msg("mirror redirects to another scheme")
+}
+
+// redirectedMirror returns the base URL mirror moved to, given that from,
+// under mirror, was redirected to to: mirror with to's scheme and port,
+// as long as the host name and the path below mirror did not change. It
+// returns nil otherwise.
+func redirectedMirror(mirror, from, to *url.URL) *url.URL {
+	if to.Scheme == mirror.Scheme || !strings.EqualFold(to.Hostname(), mirror.Hostname()) {
+		return nil
+	}
+	rel := strings.TrimPrefix(from.Path, mirror.Path)
+	if !strings.HasSuffix(to.Path, rel) {
+		return nil
+	}
+	return &url.URL{
+		Scheme: to.Scheme,
+		User:   mirror.User,
+		Host:   to.Host,
+		Path:   strings.TrimSuffix(to.Path, rel),
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+func newRedirectingUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ubuntu/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/cdn"+r.URL.Path, http.StatusFound)
+	})
+	mux.HandleFunc("/cdn/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "final")
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRedirectTransportFollows(t *testing.T) {
+	upstream := newRedirectingUpstream(t)
+	rt := newRedirectTransport(http.DefaultTransport, DefaultMaxRedirects)
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL+"/ubuntu/Release", nil)
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "final" {
+		t.Errorf("got %d %q, want 200 \"final\"", resp.StatusCode, body)
+	}
+}
+
+func TestRedirectTransportCapsDepth(t *testing.T) {
+	upstream := newRedirectingUpstream(t)
+	rt := newRedirectTransport(http.DefaultTransport, 3)
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL+"/loop", nil)
+	req.RequestURI = ""
+	if resp, err := rt.RoundTrip(req); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected an error after exceeding the redirect cap")
+	}
+}
+
+func TestRedirectTransportDisabledMarksNoStore(t *testing.T) {
+	upstream := newRedirectingUpstream(t)
+	rt := newRedirectTransport(http.DefaultTransport, 0)
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL+"/ubuntu/Release", nil)
+	req.RequestURI = ""
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("status = %d, want 302 passed through", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+}
+
+func TestRedirectedMirror(t *testing.T) {
+	mirror, _ := url.Parse("http://mirror.example.com/debian/")
+	from, _ := url.Parse("http://mirror.example.com/debian/dists/bookworm/InRelease")
+	tests := []struct {
+		to   string
+		want string
+	}{
+		{"https://mirror.example.com/debian/dists/bookworm/InRelease", "https://mirror.example.com/debian/"},
+		{"https://MIRROR.example.com:8443/pub/debian/dists/bookworm/InRelease", "https://MIRROR.example.com:8443/pub/debian/"},
+		{"http://mirror.example.com/mirror/debian/dists/bookworm/InRelease", ""},
+		{"https://cdn.example.net/debian/dists/bookworm/InRelease", ""},
+		{"https://mirror.example.com/by-hash/abc123", ""},
+	}
+	for _, tt := range tests {
+		to, _ := url.Parse(tt.to)
+		got := ""
+		if u := redirectedMirror(mirror, from, to); u != nil {
+			got = u.String()
+		}
+		if got != tt.want {
+			t.Errorf("redirectedMirror(%s) = %q, want %q", tt.to, got, tt.want)
+		}
+	}
+}
+
+// TestCrossSchemeRedirectingMirror proxies through an http:// mirror that
+// redirects everything to https:// on the same host, and checks the
+// target is recorded and, with AdoptRedirects, used from then on.
+func TestCrossSchemeRedirectingMirror(t *testing.T) {
+	for _, adopt := range []bool{false, true} {
+		secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, r.URL.Path)
+		}))
+		defer secure.Close()
+		var plainHits atomic.Int32
+		plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			plainHits.Add(1)
+			http.Redirect(w, r, secure.URL+r.URL.Path, http.StatusMovedPermanently)
+		}))
+		defer plain.Close()
+
+		st := newTestState()
+		st.SetMirror(distro.TypeDebian, plain.URL+"/debian/")
+		ps, err := NewPackageStruct(Options{
+			State:             st,
+			Registry:          newTestRegistry(),
+			Mode:              distro.TypeDebian,
+			MaxRedirects:      DefaultMaxRedirects,
+			AdoptRedirects:    adopt,
+			TransportOverride: secure.Client().Transport,
+		})
+		if err != nil {
+			t.Fatalf("NewPackageStruct: %v", err)
+		}
+
+		for _, path := range []string{"/debian/dists/bookworm/InRelease", "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"} {
+			if rec := serve(ps, path); rec.Code != http.StatusOK || rec.Body.String() != path {
+				t.Fatalf("adopt %v: %s = %d %q, want the https mirror's answer", adopt, path, rec.Code, rec.Body.String())
+			}
+		}
+
+		status := ps.MirrorStatuses()[0]
+		if adopt {
+			if status.Mirror != secure.URL+"/debian/" || status.Source != MirrorSourceRedirected || status.RedirectedTo != "" {
+				t.Errorf("adopt: status = %+v, want the https mirror marked %q", status, MirrorSourceRedirected)
+			}
+			if n := plainHits.Load(); n != 1 {
+				t.Errorf("adopt: http mirror asked %d times, want only the first request", n)
+			}
+		} else {
+			if status.Mirror != plain.URL+"/debian/" || status.RedirectedTo != secure.URL+"/debian/" {
+				t.Errorf("status = %+v, want the http mirror redirecting to %s/debian/", status, secure.URL)
+			}
+			if n := plainHits.Load(); n != 2 {
+				t.Errorf("http mirror asked %d times, want every request", n)
+			}
+		}
+	}
+}
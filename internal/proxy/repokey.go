@@ -0,0 +1,113 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// Cache keys are built from the request URL, and a rewritten request is
+// addressed to the mirror, so a mirror switch would miss on every object
+// cached from the previous one although mirrors serve identical files.
+// The cache layer is therefore handed the request under a repository
+// URL instead, http://<distribution id>/<path relative to the mirror
+// base>, and the reverse proxy sends it to the mirror URL carried in the
+// request context. Requests not rewritten onto a distribution's mirror
+// (ddebs.ubuntu.com, snapshot.debian.org) keep their URL.
+
+// repoPath records where rewriteRequest put a request on its
+// distribution's mirror, and the query string processMatchingRule dropped
+// from the cache key but is to send upstream (cache.forward_query).
+type repoPath struct {
+	mode    int
+	rel     string // path below the mirror base
+	query   string // query string keying the cache
+	set     bool
+	forward string // query string to send the mirror, if the key has none
+}
+
+type repoPathKey struct{}
+
+type upstreamURLKey struct{}
+
+// withRepoPath returns ctx carrying an empty repoPath for rewriteRequest
+// to fill in.
+func withRepoPath(ctx context.Context) context.Context {
+	return context.WithValue(ctx, repoPathKey{}, &repoPath{})
+}
+
+// noteRepoPath records that r, whose query string before the rewrite
+// was query, was rewritten to rel below mode's mirror.
+func noteRepoPath(r *http.Request, mode int, rel, query string) {
+	if p, ok := r.Context().Value(repoPathKey{}).(*repoPath); ok {
+		p.mode, p.rel, p.query, p.set = mode, strings.TrimPrefix(rel, "/"), query, true
+	}
+}
+
+// noteForwardQuery records query, dropped from r's cache key, to be sent
+// to the mirror all the same.
+func noteForwardQuery(r *http.Request, query string) {
+	if p, ok := r.Context().Value(repoPathKey{}).(*repoPath); ok {
+		p.forward = query
+	}
+}
+
+// repoKeyed returns r under its repository URL, carrying the mirror URL
+// for the reverse proxy (see upstreamURL), or r itself when it was not
+// rewritten onto a mirror and has no query string to forward. A mirror
+// configured with a query string of its own sends that one instead of
+// the client's.
+func (ap *PackageStruct) repoKeyed(r *http.Request) *http.Request {
+	p, ok := r.Context().Value(repoPathKey{}).(*repoPath)
+	if !ok || (!p.set && p.forward == "") {
+		return r
+	}
+	mirror := *r.URL
+	if mirror.RawQuery == "" {
+		mirror.RawQuery = p.forward
+	}
+	keyed := r.WithContext(context.WithValue(r.Context(), upstreamURLKey{}, &mirror))
+	if p.set {
+		keyed.URL = &url.URL{
+			Scheme:   "http",
+			Host:     ap.repoHost(p.mode),
+			Path:     "/" + p.rel,
+			RawQuery: p.query,
+		}
+	}
+	return keyed
+}
+
+// repoHost names mode's repository in cache keys: its distribution id.
+func (ap *PackageStruct) repoHost(mode int) string {
+	if ap.registry != nil {
+		if d, ok := ap.registry.GetByType(mode); ok && d.ID != "" {
+			return d.ID
+		}
+	}
+	return strings.ToLower(distro.DistributionName(mode))
+}
+
+// upstreamURL returns the mirror URL a repository-keyed request is sent
+// to.
+func upstreamURL(r *http.Request) (*url.URL, bool) {
+	u, ok := r.Context().Value(upstreamURLKey{}).(*url.URL)
+	return u, ok
+}
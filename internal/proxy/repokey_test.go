@@ -0,0 +1,103 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// keyRecorder records the URL the cache layer is handed and the mirror
+// URL the reverse proxy would fetch it from.
+type keyRecorder struct {
+	key, upstream string
+}
+
+func (k *keyRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.key = r.URL.String()
+	if u, ok := upstreamURL(r); ok {
+		k.upstream = u.String()
+	} else {
+		k.upstream = ""
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestCacheKeyIsMirrorIndependent(t *testing.T) {
+	st := newTestState()
+	ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	rec := &keyRecorder{}
+	ps.DistroHandlers = map[int]http.Handler{distro.TypeDebian: rec}
+
+	const pkg = "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"
+	serve(ps, pkg)
+	if rec.key != "http://debian/pool/main/h/hello/hello_2.10-3_amd64.deb" {
+		t.Errorf("cache URL = %q, want the repository URL", rec.key)
+	}
+	if rec.upstream != "http://mirrors.example.com/debian/pool/main/h/hello/hello_2.10-3_amd64.deb" {
+		t.Errorf("upstream URL = %q, want the package on the configured mirror", rec.upstream)
+	}
+	keyA := rec.key
+
+	st.SetMirror(distro.TypeDebian, "https://other.example.org/mirror/debian/")
+	ps.RefreshMirrors()
+	serve(ps, pkg)
+	if rec.key != keyA {
+		t.Errorf("cache URL after a mirror switch = %q, want %q", rec.key, keyA)
+	}
+	if rec.upstream != "https://other.example.org/mirror/debian/pool/main/h/hello/hello_2.10-3_amd64.deb" {
+		t.Errorf("upstream URL after the switch = %q, want the new mirror", rec.upstream)
+	}
+}
+
+// TestForwardQuery checks which query string the mirror gets for a
+// signed package URL, while the cache key stays path-only.
+func TestForwardQuery(t *testing.T) {
+	const rel = "/pool/main/h/hello/hello_2.10-3_amd64.deb"
+	for _, tt := range []struct {
+		name     string
+		forward  bool
+		mirror   string
+		upstream string
+	}{
+		{"dropped", false, "http://mirrors.example.com/debian/", "http://mirrors.example.com/debian" + rel},
+		{"forwarded", true, "http://mirrors.example.com/debian/", "http://mirrors.example.com/debian" + rel + "?_gda_=1700000000_abc"},
+		{"mirror's own", true, "http://mirrors.example.com/debian/?token=s3cret", "http://mirrors.example.com/debian" + rel + "?token=s3cret"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newTestState()
+			st.SetMirror(distro.TypeDebian, tt.mirror)
+			ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian, ForwardQuery: tt.forward})
+			if err != nil {
+				t.Fatalf("NewPackageStruct: %v", err)
+			}
+			rec := &keyRecorder{}
+			ps.DistroHandlers = map[int]http.Handler{distro.TypeDebian: rec}
+
+			serve(ps, "/debian"+rel+"?_gda_=1700000000_abc")
+			if rec.key != "http://debian"+rel {
+				t.Errorf("cache URL = %q, want the path-only repository URL", rec.key)
+			}
+			if rec.upstream != tt.upstream {
+				t.Errorf("upstream URL = %q, want %q", rec.upstream, tt.upstream)
+			}
+		})
+	}
+}
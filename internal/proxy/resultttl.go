@@ -0,0 +1,68 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"time"
+)
+
+// RefreshExpiredMirrors re-benchmarks every distribution whose mirror was
+// chosen by a benchmark run longer ago than the engine's result TTL
+// (benchmark.result_ttl_min), and returns how many it rebuilt. Configured
+// mirrors, and distributions not yet benchmarked, are left alone. Each
+// rewriter keeps serving its mirror until its replacement is ready.
+func (ap *PackageStruct) RefreshExpiredMirrors() int {
+	if ap == nil || ap.rewriters == nil {
+		return 0
+	}
+	ap.refreshMu.Lock()
+	defer ap.refreshMu.Unlock()
+	ttl := ap.bench.ResultTTL()
+	refreshed := 0
+	for _, m := range modesToInit(ap.mode) {
+		p := rewriterField(ap.rewriters, m)
+		if p == nil {
+			continue
+		}
+		ap.rewriters.Mu.RLock()
+		current := *p
+		ap.rewriters.Mu.RUnlock()
+		if current == nil || current.source == MirrorSourceSpecified {
+			continue
+		}
+		if run, ok := ap.bench.LastRun(m); !ok || time.Since(run.At) < ttl {
+			continue
+		}
+		RefreshRewriterWithEngine(ap.rewriters, m, ap.state, ap.registry, ap.bench)
+		refreshed++
+	}
+	return refreshed
+}
+
+// RunMirrorExpiry calls RefreshExpiredMirrors every interval until ctx is
+// done.
+func (ap *PackageStruct) RunMirrorExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ap.RefreshExpiredMirrors()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
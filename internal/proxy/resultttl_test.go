@@ -0,0 +1,85 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+	"github.com/soulteary/apt-proxy/internal/state"
+)
+
+// TestRefreshExpiredMirrors checks a benchmarked mirror is benchmarked
+// again once Options.BenchmarkResultTTL has passed, and not before.
+func TestRefreshExpiredMirrors(t *testing.T) {
+	var probes atomic.Int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+	}))
+	defer mirror.Close()
+
+	reg := newTestRegistry()
+	deb, _ := reg.GetByID("debian")
+	local := *deb
+	local.Mirrors = []distro.URLWithAlias{{URL: mirror.URL + "/debian/", Scheme: "http"}}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+	const ttl = 50 * time.Millisecond
+	ps, err := NewPackageStruct(Options{State: state.NewAppState(), Registry: reg, Mode: distro.TypeDebian, BenchmarkResultTTL: ttl})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	if got := ps.bench.ResultTTL(); got != ttl {
+		t.Fatalf("engine result TTL = %s, want %s", got, ttl)
+	}
+	startup := probes.Load()
+	if startup == 0 {
+		t.Fatal("the mirror was not benchmarked at startup")
+	}
+
+	if n := ps.RefreshExpiredMirrors(); n != 0 || probes.Load() != startup {
+		t.Fatalf("RefreshExpiredMirrors() before the TTL rebuilt %d and probed %d times, want none", n, probes.Load()-startup)
+	}
+	time.Sleep(ttl + 10*time.Millisecond)
+	if n := ps.RefreshExpiredMirrors(); n != 1 {
+		t.Fatalf("RefreshExpiredMirrors() after the TTL rebuilt %d distributions, want 1", n)
+	}
+	if probes.Load() == startup {
+		t.Error("the expired mirror was not benchmarked again")
+	}
+	statuses := ps.MirrorStatuses()
+	if len(statuses) != 1 || statuses[0].Source != MirrorSourceBenchmarked || statuses[0].Mirror != mirror.URL+"/debian/" {
+		t.Errorf("MirrorStatuses() = %+v, want the mirror freshly benchmarked", statuses)
+	}
+}
+
+// TestRefreshExpiredMirrorsSkipsConfiguredMirrors checks an explicitly
+// configured mirror is never benchmarked by the expiry check.
+func TestRefreshExpiredMirrorsSkipsConfiguredMirrors(t *testing.T) {
+	st := newTestState()
+	ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian, BenchmarkResultTTL: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if n := ps.RefreshExpiredMirrors(); n != 0 {
+		t.Errorf("RefreshExpiredMirrors() rebuilt %d configured mirrors, want 0", n)
+	}
+}
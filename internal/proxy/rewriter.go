@@ -20,6 +20,9 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 
 	logger "github.com/soulteary/logger-kit"
@@ -34,8 +37,41 @@ import (
 type URLRewriter struct {
 	mirror  *url.URL
 	pattern *regexp.Regexp
+
+	// source records how mirror was chosen (one of the MirrorSource
+	// values) and candidates how many mirrors were in the running.
+	source     string
+	candidates int
+
+	// fallback is the runner-up of the benchmark that picked mirror, kept
+	// so an upstream failure can switch to it without benchmarking again.
+	// nil for pinned mirrors and when only one candidate answered.
+	fallback *url.URL
+
+	// ranked lists the mirrors that answered the benchmark that picked
+	// mirror, fastest first, for mirrors.sticky_clients (see mirrorFor).
+	// nil when mirror was not benchmarked.
+	ranked []*url.URL
+
+	// redirected is the base mirror redirects to under another scheme,
+	// once a request has been redirected there (see noteRedirect).
+	redirected *url.URL
+
+	// inputs fingerprints what mirror was chosen from (see mirrorInputs);
+	// a reload rebuilds the rewriter only when it changed.
+	inputs string
 }
 
+// How a distribution's mirror was chosen, as reported in MirrorStatus.
+const (
+	MirrorSourceSpecified   = "specified"   // configured explicitly, never benchmarked
+	MirrorSourceCached      = "cached"      // reused from an earlier benchmark
+	MirrorSourceBenchmarked = "benchmarked" // fastest candidate of a fresh benchmark
+	MirrorSourceDefault     = "default"     // first candidate: benchmark pending or failed
+	MirrorSourceFailover    = "failover"    // warm fallback promoted after the mirror failed
+	MirrorSourceRedirected  = "redirected"  // the mirror's redirect target under another scheme
+)
+
 // URLRewriters manages rewriters for different distributions
 type URLRewriters struct {
 	Ubuntu      *URLRewriter
@@ -43,9 +79,68 @@ type URLRewriters struct {
 	Debian      *URLRewriter
 	Centos      *URLRewriter
 	Alpine      *URLRewriter
+	Gentoo      *URLRewriter
+	Arch        *URLRewriter
 	Mu          sync.RWMutex
+
+	// pending counts async benchmarks started by createRewriterAsync that
+	// have not reported a final result yet (success or give-up). idle is
+	// closed when it drops back to zero; both are guarded by pendingMu.
+	pendingMu sync.Mutex
+	pending   int
+	idle      chan struct{}
+
+	// sources is where candidate mirrors come from when a rewriter is
+	// rebuilt; set once by the constructor. nil uses the package-level
+	// geo lookup.
+	sources *mirrors.Sources
+}
+
+// Pending returns the number of async mirror benchmarks still running.
+func (r *URLRewriters) Pending() int {
+	if r == nil {
+		return 0
+	}
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	return r.pending
+}
+
+// Idle returns a channel that is closed once no async mirror benchmark is
+// running. It is already closed when none is.
+func (r *URLRewriters) Idle() <-chan struct{} {
+	if r == nil {
+		return closedChan
+	}
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	if r.pending == 0 {
+		return closedChan
+	}
+	return r.idle
+}
+
+// addPending adjusts the number of running async benchmarks by delta,
+// closing the Idle channel when the last one finishes.
+func (r *URLRewriters) addPending(delta int) {
+	r.pendingMu.Lock()
+	defer r.pendingMu.Unlock()
+	if r.pending == 0 && delta > 0 {
+		r.idle = make(chan struct{})
+	}
+	r.pending += delta
+	if r.pending == 0 && delta < 0 {
+		close(r.idle)
+	}
 }
 
+// closedChan is returned by Idle when nothing is pending.
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
 // distroDescriptor consolidates per-distro metadata that previously lived in
 // multiple parallel maps (modeRules, rewriterConfigByMode, rewriterFieldByMode).
 // Adding a new distro now means appending one entry to distroDescriptors.
@@ -93,6 +188,20 @@ var distroDescriptors = []distroDescriptor{
 		getMirror:    func(s *state.AppState) *url.URL { return s.GetMirror(distro.TypeAlpine) },
 		rewriter:     func(r *URLRewriters) **URLRewriter { return &r.Alpine },
 	},
+	{
+		mode:         distro.TypeGentoo,
+		name:         "Gentoo",
+		defaultRules: distro.GentooDefaultCacheRules,
+		getMirror:    func(s *state.AppState) *url.URL { return s.GetMirror(distro.TypeGentoo) },
+		rewriter:     func(r *URLRewriters) **URLRewriter { return &r.Gentoo },
+	},
+	{
+		mode:         distro.TypeArch,
+		name:         "Arch Linux",
+		defaultRules: distro.ArchDefaultCacheRules,
+		getMirror:    func(s *state.AppState) *url.URL { return s.GetMirror(distro.TypeArch) },
+		rewriter:     func(r *URLRewriters) **URLRewriter { return &r.Arch },
+	},
 }
 
 // descriptorByMode is a fast lookup index for distroDescriptors. Built once
@@ -123,6 +232,12 @@ func modesToInit(mode int) []int {
 	return []int{mode}
 }
 
+// ServedModes returns the distro modes a proxy running in mode serves, in
+// distroModesOrder.
+func ServedModes(mode int) []int {
+	return slices.Clone(modesToInit(mode))
+}
+
 func rewriterField(r *URLRewriters, mode int) **URLRewriter {
 	if d, ok := descriptorByMode[mode]; ok {
 		return d.rewriter(r)
@@ -148,9 +263,96 @@ func benchEngine(e *benchmarks.Engine) *benchmarks.Engine {
 	return benchmarks.Default()
 }
 
+// candidateMirrors returns the mirrors of src mode may be benchmarked
+// against, split by st's region hint. With mirrors.require_https set, http
+// mirrors are dropped before the split.
+func candidateMirrors(src *mirrors.Sources, reg *distro.Registry, st *state.AppState, mode int) (preferred, rest []string) {
+	candidates := src.MirrorUrlsByMode(reg, mode)
+	if st.RequireHTTPS() {
+		candidates = mirrors.HTTPSOnly(candidates)
+	}
+	return mirrors.SplitByRegion(candidates, st.GetRegion())
+}
+
+// warnNoHTTPSCandidates logs when mirrors.require_https filtered out every
+// candidate of a distribution: many built-in lists are http-only.
+func warnNoHTTPSCandidates(log *logger.Logger, st *state.AppState, name string, candidates int) {
+	if candidates == 0 && st.RequireHTTPS() {
+		log.Warn().Str("distro", name).Msg("mirrors.require_https left no candidate mirrors; configure an https mirror for this distribution")
+	}
+}
+
+// mirrorInputs fingerprints everything a distribution's mirror selection
+// depends on: the benchmark URL, the host pattern, and either the
+// configured mirror or the region-split candidates. Candidate order does
+// not matter to the benchmark, so both sets are sorted.
+func mirrorInputs(benchmarkURL string, pattern *regexp.Regexp, mirror *url.URL, preferred, rest []string) string {
+	parts := []string{benchmarkURL, ""}
+	if pattern != nil {
+		parts[1] = pattern.String()
+	}
+	if mirror != nil {
+		return strings.Join(append(parts, "specified", mirror.String()), "\n")
+	}
+	for _, set := range [][]string{preferred, rest} {
+		sorted := append([]string(nil), set...)
+		sort.Strings(sorted)
+		parts = append(parts, "candidates")
+		parts = append(parts, sorted...)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// currentMirrorInputs returns mirrorInputs for mode under st, reg and src
+// as they are now.
+func currentMirrorInputs(mode int, st *state.AppState, reg *distro.Registry, src *mirrors.Sources) string {
+	d, _ := getRewriterConfig(mode)
+	if d == nil {
+		return ""
+	}
+	benchmarkURL, pattern := mirrors.GetPredefinedConfiguration(reg, mode)
+	if mirror := d.getMirror(st); mirror != nil {
+		return mirrorInputs(benchmarkURL, pattern, mirror, nil, nil)
+	}
+	preferred, rest := candidateMirrors(src, reg, st, mode)
+	return mirrorInputs(benchmarkURL, pattern, nil, preferred, rest)
+}
+
+// runnerUpMirror returns the second-fastest mirror of engine's last run
+// for mode, provided that run is the one that chose fastest.
+func runnerUpMirror(engine *benchmarks.Engine, mode int, fastest string) *url.URL {
+	run, ok := engine.LastRun(mode)
+	if !ok || run.Mirror != fastest || run.RunnerUp == "" {
+		return nil
+	}
+	u, err := url.Parse(run.RunnerUp)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	return u
+}
+
+// rankedMirrors returns the mirrors of engine's last run for mode that
+// answered, fastest first, provided that run is the one that chose
+// fastest.
+func rankedMirrors(engine *benchmarks.Engine, mode int, fastest string) []*url.URL {
+	run, ok := engine.LastRun(mode)
+	if !ok || run.Mirror != fastest || len(run.Ranked) < 2 {
+		return nil
+	}
+	var ranked []*url.URL
+	for _, m := range run.Ranked {
+		if u, err := url.Parse(m); err == nil && u.Host != "" {
+			ranked = append(ranked, u)
+		}
+	}
+	return ranked
+}
+
 // createRewriter creates a new URLRewriter for a specific distribution.
 // It uses the cached benchmark result if available, otherwise runs a synchronous benchmark.
-func createRewriter(mode int, st *state.AppState, reg *distro.Registry, bench *benchmarks.Engine) *URLRewriter {
+// Candidate mirrors come from src.
+func createRewriter(mode int, st *state.AppState, reg *distro.Registry, bench *benchmarks.Engine, src *mirrors.Sources) *URLRewriter {
 	log := logger.Default()
 	d, name := getRewriterConfig(mode)
 	if d == nil {
@@ -162,22 +364,52 @@ func createRewriter(mode int, st *state.AppState, reg *distro.Registry, bench *b
 	mirror := d.getMirror(st)
 
 	if mirror != nil {
-		log.Info().Str("distro", name).Str("mirror", mirror.String()).Msg("using specified mirror")
+		log.Info().Str("distro", name).Str("mirror", mirror.Redacted()).Msg("using specified mirror")
 		rewriter.mirror = mirror
+		rewriter.source = MirrorSourceSpecified
+		rewriter.inputs = mirrorInputs(benchmarkURL, pattern, mirror, nil, nil)
 		return rewriter
 	}
 
-	mirrorURLs := mirrors.GetGeoMirrorUrlsByMode(reg, mode)
-	// Use cache-aware benchmark to avoid repeated testing
-	fastest, err := benchEngine(bench).GetTheFastestMirrorWithCache(mode, mirrorURLs, benchmarkURL)
+	preferred, rest := candidateMirrors(src, reg, st, mode)
+	rewriter.inputs = mirrorInputs(benchmarkURL, pattern, nil, preferred, rest)
+	if len(preferred) == 0 {
+		preferred, rest = rest, nil
+	}
+	candidates := append(append([]string(nil), preferred...), rest...)
+	rewriter.candidates = len(candidates)
+	warnNoHTTPSCandidates(log, st, name, len(candidates))
+	rewriter.source = MirrorSourceBenchmarked
+	if _, ok := benchEngine(bench).CachedMirror(mode); ok {
+		rewriter.source = MirrorSourceCached
+	}
+	// Use cache-aware benchmark to avoid repeated testing. Region-matching
+	// mirrors go first; the rest are only probed when none of them answer.
+	fastest, err := benchEngine(bench).GetTheFastestMirrorWithCache(mode, preferred, benchmarkURL)
+	if err != nil && len(rest) > 0 {
+		log.Warn().Err(err).Str("distro", name).Str("region", st.GetRegion()).Msg("no mirror in region responded, benchmarking the rest")
+		fastest, err = benchEngine(bench).GetTheFastestMirrorWithCache(mode, rest, benchmarkURL)
+	}
 	if err != nil {
-		log.Error().Err(err).Str("distro", name).Msg("error finding fastest mirror")
+		// Fall back to the first candidate, like the async path does while
+		// its benchmark runs. Leaving the mirror unset would turn the
+		// rewrite into a no-op: absolute requests such as
+		// http://deb.debian.org/debian/... would go to the original host
+		// (the CDN) and relative ones back to apt-proxy itself.
+		fallback := benchmarks.GetDefaultMirror(candidates)
+		log.Error().Err(err).Str("distro", name).Str("mirror", fallback).Msg("error finding fastest mirror, using default mirror")
+		if mirror, err := url.Parse(fallback); err == nil && fallback != "" {
+			rewriter.mirror = mirror
+		}
+		rewriter.source = MirrorSourceDefault
 		return rewriter
 	}
 
 	if mirror, err := url.Parse(fastest); err == nil {
 		log.Info().Str("distro", name).Str("mirror", fastest).Msg("using fastest mirror")
 		rewriter.mirror = mirror
+		rewriter.fallback = runnerUpMirror(benchEngine(bench), mode, fastest)
+		rewriter.ranked = rankedMirrors(benchEngine(bench), mode, fastest)
 	}
 
 	return rewriter
@@ -185,6 +417,7 @@ func createRewriter(mode int, st *state.AppState, reg *distro.Registry, bench *b
 
 // createRewriterAsync creates a new URLRewriter for a specific distribution using async benchmark.
 // It immediately returns with a default mirror and updates the mirror in the background.
+// When a benchmark is started the returned rewriter is already installed in rewriters.
 func createRewriterAsync(mode int, st *state.AppState, reg *distro.Registry, rewriters *URLRewriters, bench *benchmarks.Engine) *URLRewriter {
 	log := logger.Default()
 	d, name := getRewriterConfig(mode)
@@ -199,18 +432,27 @@ func createRewriterAsync(mode int, st *state.AppState, reg *distro.Registry, rew
 	mirror := d.getMirror(st)
 
 	if mirror != nil {
-		log.Info().Str("distro", name).Str("mirror", mirror.String()).Msg("using specified mirror")
+		log.Info().Str("distro", name).Str("mirror", mirror.Redacted()).Msg("using specified mirror")
 		rewriter.mirror = mirror
+		rewriter.source = MirrorSourceSpecified
+		rewriter.inputs = mirrorInputs(benchmarkURL, pattern, mirror, nil, nil)
 		return rewriter
 	}
 
-	mirrorURLs := mirrors.GetGeoMirrorUrlsByMode(reg, mode)
+	preferred, rest := candidateMirrors(rewriters.sources, reg, st, mode)
+	rewriter.inputs = mirrorInputs(benchmarkURL, pattern, nil, preferred, rest)
+	mirrorURLs := append(append([]string(nil), preferred...), rest...)
+	rewriter.candidates = len(mirrorURLs)
+	warnNoHTTPSCandidates(log, st, name, len(mirrorURLs))
 
 	// Check if we have a cached result
-	if cached, ok := engine.Cache().GetCachedResult(mode); ok {
+	if cached, ok := engine.CachedMirror(mode); ok {
 		if parsedMirror, err := url.Parse(cached); err == nil {
 			log.Info().Str("distro", name).Str("mirror", cached).Msg("using cached mirror")
 			rewriter.mirror = parsedMirror
+			rewriter.source = MirrorSourceCached
+			rewriter.fallback = runnerUpMirror(engine, mode, cached)
+			rewriter.ranked = rankedMirrors(engine, mode, cached)
 			return rewriter
 		}
 	}
@@ -220,6 +462,7 @@ func createRewriterAsync(mode int, st *state.AppState, reg *distro.Registry, rew
 		log.Info().Str("distro", name).Str("mirror", defaultMirror).Msg("using default mirror (async benchmark pending)")
 		rewriter.mirror = parsedMirror
 	}
+	rewriter.source = MirrorSourceDefault
 
 	// Run benchmark in background and update when complete.
 	//
@@ -229,7 +472,21 @@ func createRewriterAsync(mode int, st *state.AppState, reg *distro.Registry, rew
 	// access mirror/pattern outside the lock; mutating in place would race
 	// with those readers. Allocating a fresh URLRewriter and swapping the
 	// pointer under rewriters.Mu.Lock keeps published structs immutable.
-	engine.GetTheFastestMirrorAsync(mode, mirrorURLs, benchmarkURL, func(result benchmarks.AsyncBenchmarkResult) {
+	rewriters.addPending(1)
+	var onResult benchmarks.AsyncBenchmarkCallback
+	onResult = func(result benchmarks.AsyncBenchmarkResult) {
+		if result.Error != nil && len(rest) > 0 {
+			// Nothing in the preferred region answered: widen the
+			// search to the remaining candidates exactly once.
+			log.Warn().Err(result.Error).Str("distro", name).Str("region", st.GetRegion()).Msg("no mirror in region responded, benchmarking the rest")
+			next := rest
+			rest = nil
+			engine.GetTheFastestMirrorAsync(mode, next, benchmarkURL, onResult)
+			return
+		}
+		// Every path below is final for this distro, whether or not the
+		// mirror was updated.
+		defer rewriters.addPending(-1)
 		if result.Error != nil {
 			log.Error().Err(result.Error).Str("distro", name).Msg("async benchmark failed")
 			return
@@ -251,15 +508,76 @@ func createRewriterAsync(mode int, st *state.AppState, reg *distro.Registry, rew
 		// concurrent RefreshRewriters cannot accidentally lose its newer
 		// pattern when this stale callback fires.
 		oldPattern := (*p).pattern
-		*p = &URLRewriter{mirror: parsedMirror, pattern: oldPattern}
+		*p = &URLRewriter{
+			mirror:     parsedMirror,
+			pattern:    oldPattern,
+			source:     MirrorSourceBenchmarked,
+			candidates: (*p).candidates,
+			fallback:   runnerUpMirror(engine, mode, result.FastestMirror),
+			ranked:     rankedMirrors(engine, mode, result.FastestMirror),
+			inputs:     (*p).inputs,
+		}
 		rewriters.Mu.Unlock()
 
 		log.Info().Str("distro", name).Str("mirror", result.FastestMirror).Msg("async benchmark completed, mirror updated")
-	})
+	}
+	if len(preferred) == 0 {
+		preferred, rest = rest, nil
+	}
+	// Publish the placeholder before the benchmark starts: a callback
+	// that fires quickly must find it, and must not be overwritten by it
+	// afterwards.
+	rewriters.Mu.Lock()
+	if p := rewriterField(rewriters, mode); p != nil {
+		*p = rewriter
+	}
+	rewriters.Mu.Unlock()
+	engine.GetTheFastestMirrorAsync(mode, preferred, benchmarkURL, onResult)
+	if rewriter.mirror != nil && len(mirrorURLs) > 1 {
+		rewriters.addPending(1)
+		go verifyDefaultMirror(mode, rewriter, mirrorURLs, benchmarkURL, rewriters, engine)
+	}
 
 	return rewriter
 }
 
+// verifyDefaultMirror checks that placeholder's mirror, the first
+// candidate, installed while mode's async benchmark runs, serves the
+// distribution's benchmark file. Candidate lists can hold mirrors that
+// lack a tree, such as Ubuntu mirrors without ports, which would answer
+// every request with 404 until the benchmark finishes. If it does not,
+// the first candidate seen serving the file replaces it, unless the
+// benchmark or a refresh has installed a rewriter meanwhile.
+func verifyDefaultMirror(mode int, placeholder *URLRewriter, candidates []string, benchmarkURL string, rewriters *URLRewriters, engine *benchmarks.Engine) {
+	defer rewriters.addPending(-1)
+	log := logger.Default()
+	_, name := getRewriterConfig(mode)
+	defaultMirror := candidates[0]
+	if _, err := engine.FirstServing(candidates[:1], benchmarkURL); err == nil {
+		return
+	}
+	serving, err := engine.FirstServing(candidates[1:], benchmarkURL)
+	if err != nil {
+		log.Warn().Err(err).Str("distro", name).Str("mirror", defaultMirror).Msg("no candidate mirror serves the distribution yet, keeping the default mirror")
+		return
+	}
+	mirror, err := url.Parse(serving)
+	if err != nil {
+		return
+	}
+
+	rewriters.Mu.Lock()
+	defer rewriters.Mu.Unlock()
+	p := rewriterField(rewriters, mode)
+	if p == nil || *p != placeholder {
+		return
+	}
+	replacement := *placeholder
+	replacement.mirror = mirror
+	*p = &replacement
+	log.Warn().Str("distro", name).Str("default", defaultMirror).Str("mirror", serving).Msg("default mirror does not serve the distribution, using another until the benchmark completes")
+}
+
 // CreateNewRewriters initializes rewriters based on mode using synchronous
 // benchmark. May block startup for up to 30 seconds; prefer
 // CreateNewRewritersAsync. Uses the process-wide default benchmarks.Engine;
@@ -271,10 +589,16 @@ func CreateNewRewriters(mode int, st *state.AppState, reg *distro.Registry) *URL
 // CreateNewRewritersWithEngine is the engine-aware variant of
 // CreateNewRewriters. A nil engine falls back to benchmarks.Default().
 func CreateNewRewritersWithEngine(mode int, st *state.AppState, reg *distro.Registry, bench *benchmarks.Engine) *URLRewriters {
-	rewriters := &URLRewriters{}
+	return createNewRewriters(mode, st, reg, bench, nil)
+}
+
+// createNewRewriters is CreateNewRewritersWithEngine taking candidate
+// mirrors from src.
+func createNewRewriters(mode int, st *state.AppState, reg *distro.Registry, bench *benchmarks.Engine, src *mirrors.Sources) *URLRewriters {
+	rewriters := &URLRewriters{sources: src}
 	for _, m := range modesToInit(mode) {
 		if p := rewriterField(rewriters, m); p != nil {
-			*p = createRewriter(m, st, reg, bench)
+			*p = createRewriter(m, st, reg, bench, src)
 		}
 	}
 	return rewriters
@@ -289,15 +613,31 @@ func CreateNewRewritersAsync(mode int, st *state.AppState, reg *distro.Registry)
 // CreateNewRewritersAsyncWithEngine is the engine-aware variant of
 // CreateNewRewritersAsync. A nil engine falls back to benchmarks.Default().
 func CreateNewRewritersAsyncWithEngine(mode int, st *state.AppState, reg *distro.Registry, bench *benchmarks.Engine) *URLRewriters {
-	rewriters := &URLRewriters{}
+	return createNewRewritersAsync(mode, st, reg, bench, nil)
+}
+
+// createNewRewritersAsync is CreateNewRewritersAsyncWithEngine taking
+// candidate mirrors from src.
+func createNewRewritersAsync(mode int, st *state.AppState, reg *distro.Registry, bench *benchmarks.Engine, src *mirrors.Sources) *URLRewriters {
+	rewriters := &URLRewriters{sources: src}
 	for _, m := range modesToInit(mode) {
-		if p := rewriterField(rewriters, m); p != nil {
-			*p = createRewriterAsync(m, st, reg, rewriters, bench)
-		}
+		installRewriterAsync(m, st, reg, rewriters, bench)
 	}
 	return rewriters
 }
 
+// installRewriterAsync builds mode's rewriter with createRewriterAsync and
+// makes sure it is installed, including on the paths (pinned mirror,
+// cached result) that return without starting a benchmark.
+func installRewriterAsync(mode int, st *state.AppState, reg *distro.Registry, rewriters *URLRewriters, bench *benchmarks.Engine) {
+	r := createRewriterAsync(mode, st, reg, rewriters, bench)
+	rewriters.Mu.Lock()
+	defer rewriters.Mu.Unlock()
+	if p := rewriterField(rewriters, mode); p != nil && *p == nil {
+		*p = r
+	}
+}
+
 // GetRewriteRulesByMode returns caching rules for a specific mode.
 // Prefers registry (config-loaded) rules when present.
 func GetRewriteRulesByMode(reg *distro.Registry, mode int) []distro.Rule {
@@ -321,13 +661,76 @@ func GetRewriteRulesByMode(reg *distro.Registry, mode int) []distro.Rule {
 	return rules
 }
 
+// snapshotHost serves the timestamped Debian archives. Nobody mirrors
+// it, so its requests are proxied (and cached) against it directly.
+const snapshotHost = "snapshot.debian.org"
+
+// snapshotPathPattern matches snapshot.debian.org archive paths such as
+// /archive/debian/20240101T000000Z/dists/bookworm/Release. Their
+// "/debian/" segment would otherwise match DebianHostPattern and send the
+// timestamped path to an ordinary mirror, which has no such tree.
+var snapshotPathPattern = regexp.MustCompile(`^/archive/debian(-security)?/[^/]+/`)
+
+// rewriteDdebsRequest points a request for Ubuntu's debug symbol archive,
+// either absolute (http://ddebs.ubuntu.com/...) or relative to apt-proxy
+// (/ddebs/...), at ddebs.ubuntu.com and reports whether it was one.
+func rewriteDdebsRequest(r *http.Request) bool {
+	if r.URL.Host == distro.UbuntuDdebsHost {
+		r.URL.Scheme = "http"
+		return true
+	}
+	m := distro.UbuntuDdebsPattern.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		return false
+	}
+	r.URL.Scheme = "http"
+	r.URL.Host = distro.UbuntuDdebsHost
+	r.URL.Path = m[1]
+	r.URL.RawPath = ""
+	return true
+}
+
+// rootDebianSecurityRequest moves a request for the root of a Debian
+// security host (http://security.debian.org/dists/...) under
+// /debian-security/, where DebianHostPattern matches it, and reports
+// whether it did.
+func rootDebianSecurityRequest(r *http.Request) bool {
+	if !slices.Contains(distro.DebianSecurityHosts, strings.ToLower(r.URL.Hostname())) || distro.DebianHostPattern.MatchString(r.URL.Path) {
+		return false
+	}
+	r.URL.Path = "/debian-security" + r.URL.Path
+	r.URL.RawPath = ""
+	return true
+}
+
 // RewriteRequestByMode rewrites the request URL to point to the configured mirror
 // for the specified distribution mode. It matches the request path against
 // distribution-specific patterns and replaces the URL scheme, host, and path
 // with the mirror's configuration. If rewriters is nil, the function returns early.
+// Debian snapshot archive paths keep their path and go to snapshot.debian.org;
+// requests already aimed at ddebs.ubuntu.com are left alone. The query
+// string is kept, unless the mirror URL carries one of its own.
 func RewriteRequestByMode(r *http.Request, rewriters *URLRewriters, mode int) {
+	rewriteRequestForClient(r, rewriters, mode, "", 0)
+}
+
+// rewriteRequestForClient is RewriteRequestByMode for the client client,
+// sent to one of the sticky fastest mirrors when sticky is 2 or more (see
+// URLRewriter.mirrorFor). It returns the path below the mirror base when
+// the request was put on the distribution's mirror.
+func rewriteRequestForClient(r *http.Request, rewriters *URLRewriters, mode int, client string, sticky int) (string, bool) {
 	if rewriters == nil {
-		return
+		return "", false
+	}
+	if mode == distro.TypeUbuntu && r.URL.Host == distro.UbuntuDdebsHost {
+		return "", false
+	}
+	if mode == distro.TypeDebian && snapshotPathPattern.MatchString(r.URL.Path) {
+		if r.URL.Host != snapshotHost {
+			r.URL.Scheme = "http"
+			r.URL.Host = snapshotHost
+		}
+		return "", false
 	}
 	rewriters.Mu.RLock()
 	defer rewriters.Mu.RUnlock()
@@ -337,13 +740,14 @@ func RewriteRequestByMode(r *http.Request, rewriters *URLRewriters, mode int) {
 		rewriter = *p
 	}
 	if rewriter == nil || rewriter.mirror == nil || rewriter.pattern == nil {
-		return
+		return "", false
 	}
 
-	uri := r.URL.String()
-	matches := rewriter.pattern.FindStringSubmatch(uri)
+	// Match the path only: the query string stays in RawQuery rather
+	// than being folded into the mirror path.
+	matches := rewriter.pattern.FindStringSubmatch(r.URL.EscapedPath())
 	if len(matches) == 0 {
-		return
+		return "", false
 	}
 
 	queryRaw := matches[len(matches)-1]
@@ -353,9 +757,14 @@ func RewriteRequestByMode(r *http.Request, rewriters *URLRewriters, mode int) {
 		unescapedQuery = queryRaw
 	}
 
-	r.URL.Scheme = rewriter.mirror.Scheme
-	r.URL.Host = rewriter.mirror.Host
-	r.URL.Path = rewriter.mirror.Path + unescapedQuery
+	mirror := rewriter.mirrorFor(client, sticky)
+	r.URL.Scheme = mirror.Scheme
+	r.URL.Host = mirror.Host
+	r.URL.Path = mirror.Path + unescapedQuery
+	if mirror.RawQuery != "" {
+		r.URL.RawQuery = mirror.RawQuery
+	}
+	return unescapedQuery, true
 }
 
 // MatchingRule finds a matching rule for the given path
@@ -400,7 +809,7 @@ func RefreshRewritersWithEngine(rewriters *URLRewriters, mode int, st *state.App
 	// during potentially slow network operations (benchmark tests)
 	newByMode := make(map[int]*URLRewriter, len(distroModesOrder))
 	for _, m := range modesToInit(mode) {
-		newByMode[m] = createRewriter(m, st, reg, engine)
+		newByMode[m] = createRewriter(m, st, reg, engine, rewriters.sources)
 	}
 
 	rewriters.Mu.Lock()
@@ -413,3 +822,55 @@ func RefreshRewritersWithEngine(rewriters *URLRewriters, mode int, st *state.App
 
 	log.Info().Msg("mirror configurations refreshed successfully")
 }
+
+// ReloadRewritersWithEngine is the reload counterpart of
+// RefreshRewritersWithEngine: only distributions whose mirror selection
+// inputs changed since their rewriter was built get their cached benchmark
+// result dropped and their rewriter rebuilt. The others keep both, so a
+// reload that touched no mirror setting runs no benchmark. Rewriters that
+// were never built (lazy benchmarking) stay unbuilt.
+func ReloadRewritersWithEngine(rewriters *URLRewriters, mode int, st *state.AppState, reg *distro.Registry, bench *benchmarks.Engine) {
+	if rewriters == nil {
+		return
+	}
+	changed := 0
+	for _, m := range modesToInit(mode) {
+		p := rewriterField(rewriters, m)
+		if p == nil {
+			continue
+		}
+		rewriters.Mu.RLock()
+		current := *p
+		rewriters.Mu.RUnlock()
+		if current == nil || current.inputs == currentMirrorInputs(m, st, reg, rewriters.sources) {
+			continue
+		}
+		RefreshRewriterWithEngine(rewriters, m, st, reg, bench)
+		changed++
+	}
+	logger.Default().Info().Int("changed", changed).Msg("mirror configurations reloaded, benchmark cache kept for unchanged distributions")
+}
+
+// RefreshRewriterWithEngine rebuilds the rewriter of a single distribution:
+// only that distro's cached benchmark result is dropped and only its
+// rewriter is swapped, so the other distros keep their mirrors and cache.
+// mode must be a concrete distro type, not TypeAllDistros.
+func RefreshRewriterWithEngine(rewriters *URLRewriters, mode int, st *state.AppState, reg *distro.Registry, bench *benchmarks.Engine) {
+	if rewriters == nil {
+		return
+	}
+	p := rewriterField(rewriters, mode)
+	if p == nil {
+		return
+	}
+	_, name := getRewriterConfig(mode)
+	logger.Default().Info().Str("distro", name).Msg("refreshing mirror configuration")
+
+	engine := benchEngine(bench)
+	engine.InvalidateMode(mode)
+	r := createRewriter(mode, st, reg, engine, rewriters.sources)
+
+	rewriters.Mu.Lock()
+	*p = r
+	rewriters.Mu.Unlock()
+}
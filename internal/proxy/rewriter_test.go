@@ -15,10 +15,18 @@
 package proxy
 
 import (
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/soulteary/apt-proxy/internal/benchmarks"
 	"github.com/soulteary/apt-proxy/internal/distro"
 	"github.com/soulteary/apt-proxy/internal/state"
 )
@@ -123,6 +131,246 @@ func TestMatchingRule(t *testing.T) {
 	}
 }
 
+func TestMatchingRuleContents(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern *regexp.Regexp
+		rules   []distro.Rule
+		path    string
+	}{
+		{"ubuntu gz", distro.UbuntuHostPattern, distro.UbuntuDefaultCacheRules, "/ubuntu/dists/noble/Contents-amd64.gz"},
+		{"ubuntu component", distro.UbuntuHostPattern, distro.UbuntuDefaultCacheRules, "/ubuntu/dists/noble/main/Contents-arm64.gz"},
+		{"debian xz", distro.DebianHostPattern, distro.DebianDefaultCacheRules, "/debian/dists/bookworm/main/Contents-udeb-amd64.xz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.pattern.MatchString(tt.path) {
+				t.Fatalf("host pattern does not match %q", tt.path)
+			}
+			rule, ok := MatchingRule(tt.path, tt.rules)
+			if !ok {
+				t.Fatalf("no rule matched %q", tt.path)
+			}
+			if rule.CacheControl != "max-age=21600" {
+				t.Errorf("CacheControl = %q, want max-age=21600", rule.CacheControl)
+			}
+		})
+	}
+}
+
+func TestMatchingRuleCommandNotFound(t *testing.T) {
+	tests := []struct {
+		name      string
+		pattern   *regexp.Regexp
+		rules     []distro.Rule
+		path      string
+		wantMatch bool
+	}{
+		{"ubuntu amd64", distro.UbuntuHostPattern, distro.UbuntuDefaultCacheRules, "/ubuntu/dists/noble/main/cnf/Commands-amd64.xz", true},
+		{"ubuntu updates universe", distro.UbuntuHostPattern, distro.UbuntuDefaultCacheRules, "/ubuntu/dists/noble-updates/universe/cnf/Commands-i386.xz", true},
+		{"ubuntu-ports arm64", distro.UbuntuPortsHostPattern, distro.UbuntuPortsDefaultCacheRules, "/ubuntu-ports/dists/noble/main/cnf/Commands-arm64.xz", true},
+		{"debian has none", distro.DebianHostPattern, distro.DebianDefaultCacheRules, "/debian/dists/bookworm/main/cnf/Commands-amd64.xz", false},
+		{"not under cnf", distro.UbuntuHostPattern, distro.UbuntuDefaultCacheRules, "/ubuntu/dists/noble/main/Commands-amd64.xz", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.pattern.MatchString(tt.path) {
+				t.Fatalf("host pattern does not match %q", tt.path)
+			}
+			rule, ok := MatchingRule(tt.path, tt.rules)
+			if ok != tt.wantMatch {
+				t.Fatalf("MatchingRule(%q) match = %v, want %v", tt.path, ok, tt.wantMatch)
+			}
+			if ok && (rule.CacheControl != "max-age=3600" || !rule.IsIndex()) {
+				t.Errorf("CacheControl = %q, want the index max-age=3600", rule.CacheControl)
+			}
+		})
+	}
+}
+
+func TestMatchingRulePdiffs(t *testing.T) {
+	tests := []struct {
+		name      string
+		pattern   *regexp.Regexp
+		rules     []distro.Rule
+		path      string
+		want      string
+		wantIndex bool
+	}{
+		{"ubuntu packages index", distro.UbuntuHostPattern, distro.UbuntuDefaultCacheRules, "/ubuntu/dists/noble-updates/main/binary-amd64/Packages.diff/Index", "max-age=300", true},
+		{"debian translation index", distro.DebianHostPattern, distro.DebianDefaultCacheRules, "/debian/dists/trixie/main/i18n/Translation-en.diff/Index", "max-age=300", true},
+		{"debian contents index", distro.DebianHostPattern, distro.DebianDefaultCacheRules, "/debian/dists/trixie/main/Contents-amd64.diff/Index", "max-age=300", true},
+		{"ubuntu packages patch", distro.UbuntuHostPattern, distro.UbuntuDefaultCacheRules, "/ubuntu/dists/noble-updates/main/binary-amd64/Packages.diff/T-2024-10-26-2019.44-F-2024-10-26-0813.12.gz", "max-age=100000", false},
+		{"debian contents patch", distro.DebianHostPattern, distro.DebianDefaultCacheRules, "/debian/dists/trixie/main/Contents-amd64.diff/T-2024-10-26-2019.44-F-2024-10-25-2008.21.gz", "max-age=100000", false},
+		{"ubuntu-ports sources patch", distro.UbuntuPortsHostPattern, distro.UbuntuPortsDefaultCacheRules, "/ubuntu-ports/dists/noble-updates/main/source/Sources.diff/T-2024-10-26-2019.44-F-2024-10-26-0813.12.gz", "max-age=100000", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.pattern.MatchString(tt.path) {
+				t.Fatalf("host pattern does not match %q", tt.path)
+			}
+			rule, ok := MatchingRule(tt.path, tt.rules)
+			if !ok {
+				t.Fatalf("no rule matched %q", tt.path)
+			}
+			if rule.CacheControl != tt.want {
+				t.Errorf("CacheControl = %q, want %q", rule.CacheControl, tt.want)
+			}
+			if rule.IsIndex() != tt.wantIndex {
+				t.Errorf("IsIndex() = %v, want %v", rule.IsIndex(), tt.wantIndex)
+			}
+		})
+	}
+}
+
+func TestMatchingRuleTranslations(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []distro.Rule
+		path      string
+		wantMatch bool
+	}{
+		{"ubuntu zh_CN gz", distro.UbuntuDefaultCacheRules, "/ubuntu/dists/noble/main/i18n/Translation-zh_CN.gz", true},
+		{"debian de xz", distro.DebianDefaultCacheRules, "/debian/dists/bookworm/main/i18n/Translation-de.xz", true},
+		{"debian en bz2", distro.DebianDefaultCacheRules, "/debian/dists/bookworm/main/i18n/Translation-en.bz2", true},
+		{"ubuntu-ports es", distro.UbuntuPortsDefaultCacheRules, "/ubuntu-ports/dists/noble/main/i18n/Translation-es.gz", true},
+		{"uncompressed", distro.UbuntuDefaultCacheRules, "/ubuntu/dists/noble/main/i18n/Translation-de", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, ok := MatchingRule(tt.path, tt.rules)
+			if ok != tt.wantMatch {
+				t.Fatalf("MatchingRule(%q) match = %v, want %v", tt.path, ok, tt.wantMatch)
+			}
+			if ok && rule.CacheControl != "max-age=3600" {
+				t.Errorf("CacheControl = %q, want the index max-age=3600", rule.CacheControl)
+			}
+		})
+	}
+}
+
+func TestMatchingRuleAlpineEdgeVersusStable(t *testing.T) {
+	rules := distro.AlpineDefaultCacheRules
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"edge main index", "/alpine/edge/main/x86_64/APKINDEX.tar.gz", "max-age=300"},
+		{"edge testing index", "/alpine/edge/testing/aarch64/APKINDEX.tar.gz", "max-age=300"},
+		{"stable index", "/alpine/v3.20/main/x86_64/APKINDEX.tar.gz", "max-age=3600"},
+		{"stable package", "/alpine/v3.20/main/x86_64/musl-1.2.5-r0.apk", "max-age=100000"},
+		{"edge package", "/alpine/edge/community/x86_64/go-1.23.0-r0.apk", "max-age=100000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !distro.AlpineHostPattern.MatchString(tt.path) {
+				t.Fatalf("AlpineHostPattern does not match %q", tt.path)
+			}
+			rule, ok := MatchingRule(tt.path, rules)
+			if !ok {
+				t.Fatalf("no rule matched %q", tt.path)
+			}
+			if rule.CacheControl != tt.want {
+				t.Errorf("CacheControl = %q, want %q", rule.CacheControl, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchingRuleGentoo(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"distfile", "/gentoo/distfiles/3a/bash-5.2.tar.gz", "max-age=31536000"},
+		{"distfile xz", "/gentoo/distfiles/e1/linux-6.6.tar.xz", "max-age=31536000"},
+		{"layout", "/gentoo/distfiles/layout.conf", "max-age=3600"},
+		{"latest snapshot", "/gentoo/snapshots/gentoo-latest.tar.xz", "max-age=3600"},
+		{"latest stage3 pointer", "/gentoo/releases/amd64/autobuilds/latest-stage3-amd64-openrc.txt", "max-age=3600"},
+		{"dated snapshot", "/gentoo/snapshots/gentoo-20240601.tar.xz", "max-age=100000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !distro.GentooHostPattern.MatchString(tt.path) {
+				t.Fatalf("GentooHostPattern does not match %q", tt.path)
+			}
+			rule, ok := MatchingRule(tt.path, distro.GentooDefaultCacheRules)
+			if !ok {
+				t.Fatalf("no rule matched %q", tt.path)
+			}
+			if rule.CacheControl != tt.want {
+				t.Errorf("CacheControl = %q, want %q", rule.CacheControl, tt.want)
+			}
+		})
+	}
+}
+
+// TestMatchingRuleArchPackagesVersusDatabases checks that pacman packages
+// get the long package TTL while the repo databases, rewritten on every
+// repo update, stay short.
+func TestMatchingRuleArchPackagesVersusDatabases(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"package", "/archlinux/core/os/x86_64/bash-5.2.026-2-x86_64.pkg.tar.zst", "max-age=100000"},
+		{"package signature", "/archlinux/core/os/x86_64/bash-5.2.026-2-x86_64.pkg.tar.zst.sig", "max-age=100000"},
+		{"legacy xz package", "/archlinux/extra/os/x86_64/vim-9.0.1000-1-x86_64.pkg.tar.xz", "max-age=100000"},
+		{"sync db", "/archlinux/core/os/x86_64/core.db", "max-age=300"},
+		{"sync db signature", "/archlinux/core/os/x86_64/core.db.sig", "max-age=300"},
+		{"files db", "/archlinux/extra/os/x86_64/extra.files.tar.gz", "max-age=300"},
+		{"lastupdate", "/archlinux/lastupdate", "max-age=60"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !distro.ArchHostPattern.MatchString(tt.path) {
+				t.Fatalf("ArchHostPattern does not match %q", tt.path)
+			}
+			rule, ok := MatchingRule(tt.path, distro.ArchDefaultCacheRules)
+			if !ok {
+				t.Fatalf("no rule matched %q", tt.path)
+			}
+			if rule.CacheControl != tt.want {
+				t.Errorf("CacheControl = %q, want %q", rule.CacheControl, tt.want)
+			}
+		})
+	}
+}
+
+// TestRewriteRequestByModeGentoo checks that distfile paths are sent to
+// the selected mirror, including distfiles.gentoo.org, which serves them
+// from its root rather than under /gentoo/.
+func TestRewriteRequestByModeGentoo(t *testing.T) {
+	for mirror, want := range map[string]string{
+		"https://mirrors.example.com/gentoo/": "https://mirrors.example.com/gentoo/distfiles/3a/bash-5.2.tar.gz",
+		"https://distfiles.gentoo.org/":       "https://distfiles.gentoo.org/distfiles/3a/bash-5.2.tar.gz",
+	} {
+		st := state.NewAppState()
+		st.SetMirror(distro.TypeGentoo, mirror)
+		rewriters := CreateNewRewriters(distro.TypeGentoo, st, newTestRegistry())
+
+		req, err := http.NewRequest(http.MethodGet, "http://localhost/gentoo/distfiles/3a/bash-5.2.tar.gz", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		RewriteRequestByMode(req, rewriters, distro.TypeGentoo)
+		if got := req.URL.String(); got != want {
+			t.Errorf("mirror %s: rewritten URL = %q, want %q", mirror, got, want)
+		}
+	}
+}
+
 func TestRewriteRequestByMode(t *testing.T) {
 	st := newTestState()
 	reg := newTestRegistry()
@@ -137,6 +385,229 @@ func TestRewriteRequestByMode(t *testing.T) {
 	RewriteRequestByMode(req, rewriters, distro.TypeUbuntu)
 }
 
+// TestRewriteRequestByModeKeepsQuery checks that a query string is left in
+// RawQuery instead of being folded into the mirror path.
+func TestRewriteRequestByModeKeepsQuery(t *testing.T) {
+	st := state.NewAppState()
+	st.SetMirror(distro.TypeDebian, "http://mirror.example.com/debian/")
+	rewriters := CreateNewRewriters(distro.TypeDebian, st, newTestRegistry())
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/debian/dists/bookworm/InRelease?arch=arm64", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RewriteRequestByMode(req, rewriters, distro.TypeDebian)
+	if got, want := req.URL.String(), "http://mirror.example.com/debian/dists/bookworm/InRelease?arch=arm64"; got != want {
+		t.Errorf("rewritten URL = %q, want %q", got, want)
+	}
+}
+
+// TestRewriteRequestByModeMirrorQuery checks that a mirror URL with a
+// query string of its own, such as an access token, sends that one in
+// place of the client's.
+func TestRewriteRequestByModeMirrorQuery(t *testing.T) {
+	st := state.NewAppState()
+	st.SetMirror(distro.TypeDebian, "http://mirror.example.com/debian/?token=s3cret")
+	rewriters := CreateNewRewriters(distro.TypeDebian, st, newTestRegistry())
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/debian/dists/bookworm/InRelease?arch=arm64", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RewriteRequestByMode(req, rewriters, distro.TypeDebian)
+	if got, want := req.URL.String(), "http://mirror.example.com/debian/dists/bookworm/InRelease?token=s3cret"; got != want {
+		t.Errorf("rewritten URL = %q, want %q", got, want)
+	}
+}
+
+// TestRewriteRequestByModeDebianSnapshot checks that snapshot.debian.org
+// archive URLs keep their timestamped path and are sent to the snapshot
+// service rather than to the selected Debian mirror.
+func TestRewriteRequestByModeDebianSnapshot(t *testing.T) {
+	st := state.NewAppState()
+	st.SetMirror(distro.TypeDebian, "http://mirror.example.com/debian/")
+	rewriters := CreateNewRewriters(distro.TypeDebian, st, newTestRegistry())
+
+	cases := []struct {
+		url      string
+		wantHost string
+		wantPath string
+	}{
+		{"http://localhost/archive/debian/20240101T000000Z/dists/bookworm/InRelease",
+			"snapshot.debian.org", "/archive/debian/20240101T000000Z/dists/bookworm/InRelease"},
+		{"http://snapshot.debian.org/archive/debian/20240101T000000Z/pool/main/h/hello/hello_2.10-3_amd64.deb",
+			"snapshot.debian.org", "/archive/debian/20240101T000000Z/pool/main/h/hello/hello_2.10-3_amd64.deb"},
+		{"http://localhost/archive/debian-security/20240101T000000Z/dists/bookworm-security/InRelease",
+			"snapshot.debian.org", "/archive/debian-security/20240101T000000Z/dists/bookworm-security/InRelease"},
+		{"http://localhost/debian/dists/bookworm/InRelease",
+			"mirror.example.com", "/debian/dists/bookworm/InRelease"},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		RewriteRequestByMode(req, rewriters, distro.TypeDebian)
+		if req.URL.Host != tc.wantHost || req.URL.Path != tc.wantPath {
+			t.Errorf("%s -> %s%s, want %s%s", tc.url, req.URL.Host, req.URL.Path, tc.wantHost, tc.wantPath)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// TestSnapshotRequestIsCachedAgainstSnapshotHost drives a snapshot URL
+// through PackageStruct: it must get a Debian cache rule and reach the
+// upstream with the timestamped path intact.
+func TestSnapshotRequestIsCachedAgainstSnapshotHost(t *testing.T) {
+	var got *http.Request
+	st := newTestState()
+	ps, err := NewPackageStruct(Options{
+		State:    st,
+		Registry: newTestRegistry(),
+		Mode:     distro.TypeDebian,
+		TransportOverride: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			got = r
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: http.Header{}, Request: r}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	ps.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/archive/debian/20240101T000000Z/dists/bookworm/Release", nil))
+	if got == nil {
+		t.Fatalf("request not proxied; status %d", rec.Code)
+	}
+	if got.URL.Host != "snapshot.debian.org" || got.URL.Path != "/archive/debian/20240101T000000Z/dists/bookworm/Release" {
+		t.Errorf("upstream URL = %s, want snapshot.debian.org with the timestamped path", got.URL)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "max-age=3600" {
+		t.Errorf("Cache-Control = %q, want the Debian Release rule", cc)
+	}
+}
+
+// TestDdebsRequestsGoToDdebsHost checks that Ubuntu debug symbol packages,
+// requested relative to apt-proxy or in absolute form, are fetched from
+// ddebs.ubuntu.com with the package cache rule, and only when Ubuntu is
+// served.
+func TestDdebsRequestsGoToDdebsHost(t *testing.T) {
+	const pkg = "/pool/main/h/hello/hello-dbgsym_2.10-3build1_amd64.ddeb"
+	for _, tc := range []struct {
+		name   string
+		mode   int
+		target string
+	}{
+		{"relative", distro.TypeUbuntu, "/ddebs" + pkg},
+		{"absolute", distro.TypeUbuntu, "http://ddebs.ubuntu.com" + pkg},
+		{"all distros", distro.TypeAllDistros, "/ddebs" + pkg},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got *http.Request
+			st := newTestState()
+			st.SetProxyMode(tc.mode)
+			ps, err := NewPackageStruct(Options{
+				State:    st,
+				Registry: newTestRegistry(),
+				Mode:     tc.mode,
+				TransportOverride: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+					got = r
+					return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: http.Header{}, Request: r}, nil
+				}),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			ps.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			if got == nil {
+				t.Fatalf("request not proxied; status %d", rec.Code)
+			}
+			if got.URL.Host != distro.UbuntuDdebsHost || got.URL.Path != pkg {
+				t.Errorf("upstream URL = %s, want http://%s%s", got.URL, distro.UbuntuDdebsHost, pkg)
+			}
+			if cc := rec.Header().Get("Cache-Control"); cc != "max-age=100000" {
+				t.Errorf("Cache-Control = %q, want the package rule max-age=100000", cc)
+			}
+		})
+	}
+
+	t.Run("not served without ubuntu", func(t *testing.T) {
+		st := newTestState()
+		st.SetProxyMode(distro.TypeDebian)
+		ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule := ps.handleExternalURLs(httptest.NewRequest(http.MethodGet, "/ddebs"+pkg, nil)); rule != nil {
+			t.Errorf("debian-only proxy matched a ddebs request: %+v", rule)
+		}
+	})
+}
+
+// TestDebianHostVariantsGoToMirror checks that absolute requests for the
+// Debian archive reach the selected mirror whichever Debian host the
+// sources name: the CDN front-ends, the debian.net redirectors, and the
+// security hosts with or without the /debian-security/ prefix.
+func TestDebianHostVariantsGoToMirror(t *testing.T) {
+	const release = "/dists/bookworm/Release"
+	for _, target := range []string{
+		"http://deb.debian.org/debian" + release,
+		"http://cdn-fastly.deb.debian.org/debian" + release,
+		"http://ftp.us.debian.org/debian" + release,
+		"http://httpredir.debian.org/debian" + release,
+		"http://cloudflare.debian.net/debian" + release,
+		"http://cloudfront.debian.net/debian" + release,
+		"http://security.debian.org/debian-security" + release,
+		"http://security.debian.org" + release,
+		"http://Security.Debian.Org:80" + release,
+		"http://security-cdn.debian.org" + release,
+	} {
+		t.Run(target, func(t *testing.T) {
+			var got *http.Request
+			st := newTestState()
+			st.SetMirror(distro.TypeDebian, "http://mirror.example/debian/")
+			ps, err := NewPackageStruct(Options{
+				State:    st,
+				Registry: newTestRegistry(),
+				Mode:     distro.TypeDebian,
+				TransportOverride: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+					got = r
+					return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: http.Header{}, Request: r}, nil
+				}),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			ps.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if got == nil {
+				t.Fatalf("request not proxied; status %d", rec.Code)
+			}
+			if got.URL.Host != "mirror.example" || got.URL.Path != "/debian"+release {
+				t.Errorf("upstream URL = %s, want http://mirror.example/debian%s", got.URL, release)
+			}
+		})
+	}
+
+	t.Run("security root with rewriting off", func(t *testing.T) {
+		ps, err := NewPackageStruct(Options{State: newTestState(), Registry: newTestRegistry(), Mode: distro.TypeDebian, DisableRewrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://security.debian.org"+release, nil)
+		ps.handleExternalURLs(r)
+		if r.URL.Path != release {
+			t.Errorf("path = %s, want %s left for security.debian.org", r.URL.Path, release)
+		}
+	})
+}
+
 // TestRewriteRequestByModePathPrefix ensures both Ubuntu and Debian
 // rewriters preserve the mirror's path prefix and append the matched suffix.
 // This guards against a regression where the Debian branch silently dropped
@@ -271,7 +742,7 @@ func TestCreateRewriterWithSpecifiedMirror(t *testing.T) {
 	reg := newTestRegistry()
 	st.SetMirror(distro.TypeUbuntu, "http://custom.mirror.com/ubuntu/")
 
-	rewriter := createRewriter(distro.TypeUbuntu, st, reg, nil)
+	rewriter := createRewriter(distro.TypeUbuntu, st, reg, nil, nil)
 	if rewriter == nil {
 		t.Fatal("createRewriter() returned nil")
 	}
@@ -286,6 +757,87 @@ func TestCreateRewriterWithSpecifiedMirror(t *testing.T) {
 	}
 }
 
+// TestCreateRewriterRequireHTTPS offers a fast http and a slower https
+// Debian mirror: with mirrors.require_https only the https one is
+// benchmarked and selected.
+func TestCreateRewriterRequireHTTPS(t *testing.T) {
+	var plainHits atomic.Int32
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plainHits.Add(1)
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer secure.Close()
+	wrap, err := NewMirrorTLSTransport(map[string]MirrorTLSOptions{"127.0.0.1": {InsecureSkipVerify: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := newTestRegistry()
+	d, _ := reg.GetByID("debian")
+	local := *d
+	local.Mirrors = []distro.URLWithAlias{
+		{URL: plain.URL + "/debian/", Scheme: "http"},
+		{URL: secure.URL + "/debian/", Scheme: "https"},
+	}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		requireHTTPS bool
+		wantMirror   string
+		wantPlain    bool
+	}{
+		{"http allowed", false, plain.URL, true},
+		{"https required", true, secure.URL, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plainHits.Store(0)
+			st := state.NewAppState()
+			st.SetRequireHTTPS(tt.requireHTTPS)
+			engine := benchmarks.NewEngineWithDialTimeout(time.Second).WithRoundTripper(wrap)
+
+			rewriter := createRewriter(distro.TypeDebian, st, reg, engine, nil)
+			if rewriter == nil || rewriter.mirror == nil {
+				t.Fatal("createRewriter() selected no mirror")
+			}
+			if rewriter.source != MirrorSourceBenchmarked {
+				t.Errorf("source = %v, want %v", rewriter.source, MirrorSourceBenchmarked)
+			}
+			if got := strings.TrimSuffix(rewriter.mirror.String(), "/debian/"); got != tt.wantMirror {
+				t.Errorf("mirror = %s, want %s", got, tt.wantMirror)
+			}
+			if got := plainHits.Load() > 0; got != tt.wantPlain {
+				t.Errorf("http mirror benchmarked = %v, want %v", got, tt.wantPlain)
+			}
+		})
+	}
+}
+
+func TestCreateRewriterRequireHTTPSNoCandidates(t *testing.T) {
+	reg := newTestRegistry()
+	d, _ := reg.GetByID("debian")
+	local := *d
+	local.Mirrors = []distro.URLWithAlias{{URL: "http://127.0.0.1:1/debian/", Scheme: "http"}}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+	st := state.NewAppState()
+	st.SetRequireHTTPS(true)
+
+	rewriter := createRewriter(distro.TypeDebian, st, reg, benchmarks.NewEngineWithDialTimeout(time.Second), nil)
+	if rewriter.candidates != 0 || rewriter.mirror != nil {
+		t.Errorf("candidates = %d, mirror = %v; want no candidate and no mirror", rewriter.candidates, rewriter.mirror)
+	}
+}
+
 func TestURLRewriterPattern(t *testing.T) {
 	st := newTestState()
 	reg := newTestRegistry()
@@ -315,3 +867,441 @@ func TestURLRewriterPattern(t *testing.T) {
 		}
 	}
 }
+
+// TestRefreshDistroLeavesOtherDistrosAlone benchmarks Debian against a
+// local mirror, then refreshes only Ubuntu and checks Debian was neither
+// re-benchmarked nor had its rewriter or cached result replaced.
+func TestRefreshDistroLeavesOtherDistrosAlone(t *testing.T) {
+	var debianHits atomic.Int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debian/") {
+			debianHits.Add(1)
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer mirror.Close()
+
+	reg := newTestRegistry()
+	deb, _ := reg.GetByID("debian")
+	local := *deb
+	local.Mirrors = []distro.URLWithAlias{{URL: mirror.URL + "/debian/", Scheme: "http"}}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+	// Every distro except Debian is pinned so nothing else benchmarks.
+	st := state.NewAppState()
+	st.SetMirror(distro.TypeUbuntu, "http://mirrors.example.com/ubuntu/")
+	st.SetMirror(distro.TypeUbuntuPorts, "http://mirrors.example.com/ubuntu-ports/")
+	st.SetMirror(distro.TypeCentOS, "http://mirrors.example.com/centos/")
+	st.SetMirror(distro.TypeAlpine, "http://mirrors.example.com/alpine/")
+	st.SetMirror(distro.TypeGentoo, "http://mirrors.example.com/gentoo/")
+	st.SetMirror(distro.TypeArch, "http://mirrors.example.com/archlinux/")
+
+	ps, err := NewPackageStruct(Options{State: st, Registry: reg, Mode: distro.TypeAllDistros})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	if ps.rewriters.Debian == nil || ps.rewriters.Debian.mirror == nil {
+		t.Fatal("Debian rewriter was not benchmarked against the local mirror")
+	}
+	hitsBefore := debianHits.Load()
+	debianBefore, ubuntuBefore := ps.rewriters.Debian, ps.rewriters.Ubuntu
+	if _, ok := ps.BenchmarkEngine().Cache().GetCachedResult(distro.TypeDebian); !ok {
+		t.Fatal("Debian benchmark result not cached")
+	}
+
+	if err := ps.RefreshDistro(distro.TypeUbuntu); err != nil {
+		t.Fatalf("RefreshDistro(ubuntu) = %v", err)
+	}
+	if ps.rewriters.Ubuntu == ubuntuBefore {
+		t.Error("Ubuntu rewriter was not rebuilt")
+	}
+	if ps.rewriters.Debian != debianBefore {
+		t.Error("Debian rewriter was replaced by an Ubuntu refresh")
+	}
+	if got := debianHits.Load(); got != hitsBefore {
+		t.Errorf("Debian mirror hit %d more times during Ubuntu refresh", got-hitsBefore)
+	}
+	if _, ok := ps.BenchmarkEngine().Cache().GetCachedResult(distro.TypeDebian); !ok {
+		t.Error("Debian benchmark cache entry was dropped by an Ubuntu refresh")
+	}
+
+	if err := ps.RefreshDistro(distro.TypeDebian); err != nil {
+		t.Fatalf("RefreshDistro(debian) = %v", err)
+	}
+	if debianHits.Load() == hitsBefore {
+		t.Error("refreshing Debian should re-benchmark its mirror")
+	}
+}
+
+func TestRefreshDistroRejectsInactiveMode(t *testing.T) {
+	ps, err := NewPackageStruct(Options{State: newTestState(), Registry: newTestRegistry(), Mode: distro.TypeDebian})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	if err := ps.RefreshDistro(distro.TypeUbuntu); err == nil {
+		t.Error("RefreshDistro(ubuntu) on a debian-only proxy should fail")
+	}
+	if err := ps.RefreshDistro(999); err == nil {
+		t.Error("RefreshDistro with an unknown type should fail")
+	}
+}
+
+// TestReloadMirrorsKeepsBenchmarkCache checks that a reload with unchanged
+// mirror settings neither re-benchmarks nor replaces any rewriter, and that
+// changing one distribution's mirrors re-benchmarks only that one.
+func TestReloadMirrorsKeepsBenchmarkCache(t *testing.T) {
+	var debianHits atomic.Int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debian") {
+			debianHits.Add(1)
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer mirror.Close()
+
+	reg := newTestRegistry()
+	setDebianMirrors := func(paths ...string) {
+		deb, _ := reg.GetByID("debian")
+		local := *deb
+		local.Mirrors = nil
+		for _, path := range paths {
+			local.Mirrors = append(local.Mirrors, distro.URLWithAlias{URL: mirror.URL + path, Scheme: "http"})
+		}
+		if err := reg.Register(&local); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setDebianMirrors("/debian/")
+	st := state.NewAppState()
+	st.SetMirror(distro.TypeUbuntu, "http://mirrors.example.com/ubuntu/")
+	st.SetMirror(distro.TypeUbuntuPorts, "http://mirrors.example.com/ubuntu-ports/")
+	st.SetMirror(distro.TypeCentOS, "http://mirrors.example.com/centos/")
+	st.SetMirror(distro.TypeAlpine, "http://mirrors.example.com/alpine/")
+	st.SetMirror(distro.TypeGentoo, "http://mirrors.example.com/gentoo/")
+	st.SetMirror(distro.TypeArch, "http://mirrors.example.com/archlinux/")
+
+	ps, err := NewPackageStruct(Options{State: st, Registry: reg, Mode: distro.TypeAllDistros})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	if ps.rewriters.Debian == nil || ps.rewriters.Debian.mirror == nil {
+		t.Fatal("Debian rewriter was not benchmarked against the local mirror")
+	}
+	hitsBefore := debianHits.Load()
+	debianBefore, ubuntuBefore := ps.rewriters.Debian, ps.rewriters.Ubuntu
+
+	ps.ReloadMirrors()
+	if got := debianHits.Load(); got != hitsBefore {
+		t.Errorf("reload without mirror changes hit the Debian mirror %d more times", got-hitsBefore)
+	}
+	if ps.rewriters.Debian != debianBefore || ps.rewriters.Ubuntu != ubuntuBefore {
+		t.Error("reload without mirror changes replaced a rewriter")
+	}
+	if _, ok := ps.BenchmarkEngine().Cache().GetCachedResult(distro.TypeDebian); !ok {
+		t.Error("reload without mirror changes dropped the Debian benchmark result")
+	}
+
+	setDebianMirrors("/debian/", "/debian-security/")
+	ps.ReloadMirrors()
+	if debianHits.Load() == hitsBefore {
+		t.Error("reload after a Debian mirror change did not re-benchmark Debian")
+	}
+	if ps.rewriters.Debian == debianBefore {
+		t.Error("reload after a Debian mirror change kept the old Debian rewriter")
+	}
+	if ps.rewriters.Ubuntu != ubuntuBefore {
+		t.Error("reload after a Debian mirror change replaced the Ubuntu rewriter")
+	}
+
+	st.SetMirror(distro.TypeUbuntu, "http://mirrors.example.org/ubuntu/")
+	ps.ReloadMirrors()
+	if got := ps.rewriters.Ubuntu.mirror.String(); got != "http://mirrors.example.org/ubuntu/" {
+		t.Errorf("Ubuntu mirror after reload = %q, want the newly specified one", got)
+	}
+}
+
+func TestMirrorInputsIgnoresCandidateOrder(t *testing.T) {
+	a := mirrorInputs("x/Release", nil, nil, []string{"http://a/", "http://b/"}, []string{"http://c/"})
+	b := mirrorInputs("x/Release", nil, nil, []string{"http://b/", "http://a/"}, []string{"http://c/"})
+	if a != b {
+		t.Error("candidate order changed the fingerprint")
+	}
+	if c := mirrorInputs("x/Release", nil, nil, []string{"http://a/"}, []string{"http://b/", "http://c/"}); c == a {
+		t.Error("moving a candidate out of the preferred region did not change the fingerprint")
+	}
+}
+
+// TestDebCDNHostRewrittenToSelectedMirror sends an absolute-form proxy
+// request for the deb.debian.org CDN and checks it is served by the
+// selected Debian mirror instead of being passed through to the CDN.
+func TestDebCDNHostRewrittenToSelectedMirror(t *testing.T) {
+	var gotHost, gotPath string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost, gotPath = r.Host, r.URL.Path
+		_, _ = io.WriteString(w, "Release")
+	}))
+	defer mirror.Close()
+
+	st := newTestState()
+	st.SetMirror(distro.TypeDebian, mirror.URL+"/debian/")
+	st.SetProxyMode(distro.TypeDebian)
+	ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/dists/bookworm/Release", nil)
+	rec := httptest.NewRecorder()
+	ps.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if want := strings.TrimPrefix(mirror.URL, "http://"); gotHost != want {
+		t.Errorf("upstream Host = %q, want selected mirror %q", gotHost, want)
+	}
+	if gotPath != "/debian/dists/bookworm/Release" {
+		t.Errorf("upstream path = %q, want /debian/dists/bookworm/Release", gotPath)
+	}
+}
+
+// TestDebCDNHostFallsBackWhenBenchmarkFails makes every Debian candidate
+// unreachable. The rewriter must still point deb.debian.org requests at a
+// candidate mirror rather than leaving the URL unchanged.
+func TestDebCDNHostFallsBackWhenBenchmarkFails(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+
+	reg := newTestRegistry()
+	deb, _ := reg.GetByID("debian")
+	local := *deb
+	local.Mirrors = []distro.URLWithAlias{{URL: deadURL + "/debian/", Scheme: "http"}}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+	st := state.NewAppState()
+	st.SetProxyMode(distro.TypeDebian)
+	ps, err := NewPackageStruct(Options{State: st, Registry: reg, Mode: distro.TypeDebian})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/pool/main/h/hello/hello_2.10-3_amd64.deb", nil)
+	if rule := ps.handleExternalURLs(req); rule == nil {
+		t.Fatal("deb.debian.org package path matched no rule")
+	}
+	if req.URL.Host == "deb.debian.org" || req.Host == "deb.debian.org" {
+		t.Fatalf("request left pointing at the CDN: %s", req.URL)
+	}
+	if want := strings.TrimPrefix(deadURL, "http://"); req.URL.Host != want {
+		t.Errorf("rewritten host = %q, want fallback candidate %q", req.URL.Host, want)
+	}
+}
+
+// TestLazyBenchmarkSkipsUntouchedDistros serves every distro from one local
+// mirror and checks that with LazyBenchmark only the distros that receive
+// requests are ever benchmarked, including across RefreshMirrors.
+func TestLazyBenchmarkSkipsUntouchedDistros(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]]++
+		mu.Unlock()
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer mirror.Close()
+	hitsFor := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[name]
+	}
+
+	reg := newTestRegistry()
+	for _, id := range []string{"debian", "centos", "alpine"} {
+		d, _ := reg.GetByID(id)
+		local := *d
+		local.Mirrors = []distro.URLWithAlias{{URL: mirror.URL + "/" + id + "/", Scheme: "http"}}
+		if err := reg.Register(&local); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := state.NewAppState()
+	st.SetMirror(distro.TypeUbuntu, "http://mirrors.example.com/ubuntu/")
+	st.SetMirror(distro.TypeUbuntuPorts, "http://mirrors.example.com/ubuntu-ports/")
+
+	ps, err := NewPackageStruct(Options{State: st, Registry: reg, Mode: distro.TypeAllDistros, LazyBenchmark: true})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	if n := hitsFor("debian") + hitsFor("centos") + hitsFor("alpine"); n != 0 {
+		t.Fatalf("mirrors hit %d times during construction, want 0", n)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/dists/bookworm/Release", nil)
+	if rule := ps.handleExternalURLs(req); rule == nil {
+		t.Fatal("Debian path matched no rule")
+	}
+	if hitsFor("debian") == 0 {
+		t.Error("first Debian request did not benchmark the Debian mirror")
+	}
+	if want := strings.TrimPrefix(mirror.URL, "http://"); req.URL.Host != want {
+		t.Errorf("rewritten host = %q, want %q", req.URL.Host, want)
+	}
+	debianHits := hitsFor("debian")
+	req = httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/dists/trixie/Release", nil)
+	ps.handleExternalURLs(req)
+	if got := hitsFor("debian"); got != debianHits {
+		t.Errorf("second Debian request re-benchmarked (%d more hits)", got-debianHits)
+	}
+
+	ps.RefreshMirrors()
+	if hitsFor("debian") == debianHits {
+		t.Error("RefreshMirrors did not re-benchmark the requested Debian mirror")
+	}
+	if n := hitsFor("centos") + hitsFor("alpine"); n != 0 {
+		t.Errorf("untouched distros benchmarked %d times, want 0", n)
+	}
+	if ps.rewriters.Centos != nil || ps.rewriters.Alpine != nil {
+		t.Error("rewriters built for distros that were never requested")
+	}
+}
+
+// TestBenchmarkRunsOncePerDistroAcrossRequests sends a burst of concurrent
+// Debian requests, as one apt update does, and checks the Debian mirror is
+// benchmarked exactly once whichever way the rewriter is built.
+func TestBenchmarkRunsOncePerDistroAcrossRequests(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		async, lazy bool
+	}{
+		{"async", true, false},
+		{"sync", false, false},
+		{"lazy async", true, true},
+		{"lazy sync", false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newTestRegistry()
+			deb, _ := reg.GetByID("debian")
+			var probes atomic.Int32
+			mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/"+strings.TrimPrefix(deb.BenchmarkURL, "/")) {
+					probes.Add(1)
+				}
+				_, _ = io.WriteString(w, "ok")
+			}))
+			defer mirror.Close()
+			local := *deb
+			local.Mirrors = []distro.URLWithAlias{{URL: mirror.URL + "/debian/", Scheme: "http"}}
+			if err := reg.Register(&local); err != nil {
+				t.Fatal(err)
+			}
+
+			ps, err := NewPackageStruct(Options{
+				State:         state.NewAppState(),
+				Registry:      reg,
+				Mode:          distro.TypeDebian,
+				Async:         tt.async,
+				LazyBenchmark: tt.lazy,
+			})
+			if err != nil {
+				t.Fatalf("NewPackageStruct: %v", err)
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 40; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					rec := serve(ps, "/debian/pool/main/h/hello/hello_"+strings.Repeat("1", i%5+1)+"_amd64.deb")
+					if rec.Code != http.StatusOK {
+						t.Errorf("request %d status = %d, want 200", i, rec.Code)
+					}
+				}(i)
+			}
+			wg.Wait()
+			for !ps.MirrorsReady() {
+				time.Sleep(5 * time.Millisecond)
+			}
+			for i := 0; i < 10; i++ {
+				serve(ps, "/debian/dists/bookworm/InRelease")
+			}
+
+			if got := probes.Load(); got != benchmarks.BenchmarkMaxTries {
+				t.Errorf("benchmark probes = %d, want %d (one benchmark)", got, benchmarks.BenchmarkMaxTries)
+			}
+		})
+	}
+}
+
+// TestVerifyDefaultMirrorWithoutPorts installs, as the async path does
+// while the benchmark runs, an Ubuntu mirror lacking the ports tree as
+// the default ports mirror, and checks it is replaced by the candidate
+// that has it; a default that serves ports, or a rewriter replaced in
+// the meantime, is kept.
+func TestVerifyDefaultMirrorWithoutPorts(t *testing.T) {
+	noPorts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ubuntu-ports/") {
+			http.NotFound(w, r)
+		}
+	}))
+	defer noPorts.Close()
+	ports := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ports.Close()
+
+	for _, tt := range []struct {
+		name       string
+		candidates []string
+		replaced   bool // the placeholder is swapped before verification
+		want       string
+	}{
+		{"default without ports", []string{noPorts.URL + "/ubuntu-ports/", ports.URL + "/ubuntu-ports/"}, false, ports.URL + "/ubuntu-ports/"},
+		{"default with ports", []string{ports.URL + "/ubuntu-ports/", noPorts.URL + "/ubuntu-ports/"}, false, ports.URL + "/ubuntu-ports/"},
+		{"benchmark finished first", []string{noPorts.URL + "/ubuntu-ports/", ports.URL + "/ubuntu-ports/"}, true, "http://benchmarked.example/ubuntu-ports/"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			def, _ := url.Parse(tt.candidates[0])
+			placeholder := &URLRewriter{mirror: def, pattern: distro.UbuntuPortsHostPattern, source: MirrorSourceDefault}
+			rewriters := &URLRewriters{UbuntuPorts: placeholder}
+			if tt.replaced {
+				benchmarked, _ := url.Parse("http://benchmarked.example/ubuntu-ports/")
+				rewriters.UbuntuPorts = &URLRewriter{mirror: benchmarked, pattern: distro.UbuntuPortsHostPattern, source: MirrorSourceBenchmarked}
+			}
+
+			rewriters.addPending(1)
+			verifyDefaultMirror(distro.TypeUbuntuPorts, placeholder, tt.candidates, distro.UbuntuPortsBenchmarkURL, rewriters, benchmarks.NewEngine())
+			if got := rewriters.UbuntuPorts.mirror.String(); got != tt.want {
+				t.Errorf("ports mirror = %s, want %s", got, tt.want)
+			}
+			if n := rewriters.Pending(); n != 0 {
+				t.Errorf("Pending() = %d after verification, want 0", n)
+			}
+		})
+	}
+}
+
+func TestURLRewritersIdle(t *testing.T) {
+	rewriters := &URLRewriters{}
+	select {
+	case <-rewriters.Idle():
+	default:
+		t.Fatal("Idle() not closed with no benchmark pending")
+	}
+
+	rewriters.addPending(2)
+	idle := rewriters.Idle()
+	rewriters.addPending(-1)
+	select {
+	case <-idle:
+		t.Fatal("Idle() closed with a benchmark still pending")
+	default:
+	}
+	rewriters.addPending(-1)
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatal("Idle() not closed after the last benchmark finished")
+	}
+}
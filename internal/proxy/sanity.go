@@ -0,0 +1,136 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	logger "github.com/soulteary/logger-kit"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+	apperrors "github.com/soulteary/apt-proxy/internal/errors"
+)
+
+// sanityPeekSize is how much of a package body is inspected. HTML error
+// pages announce themselves in the first few bytes.
+const sanityPeekSize = 512
+
+// packageFilePattern matches binary package downloads, the responses where
+// an HTML page can only be a misconfigured mirror's error page.
+var packageFilePattern = regexp.MustCompile(`\.(deb|udeb|ddeb|rpm|apk)$`)
+
+// sanityTransport rejects 200 responses for package files whose body is an
+// HTML page, so the page is neither cached nor handed to apt as a package.
+// When alternate is set the request is retried once against the mirror it
+// returns.
+type sanityTransport struct {
+	next      http.RoundTripper
+	log       *logger.Logger
+	alternate func(*url.URL) *url.URL
+}
+
+func (t *sanityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !t.isHTMLPackage(req, resp) {
+		return resp, err
+	}
+	drainAndClose(resp.Body)
+	t.log.Warn().Str("url", req.URL.String()).Msg("mirror returned an HTML page for a package, not caching it")
+
+	if t.alternate != nil {
+		if alt := t.alternate(req.URL); alt != nil {
+			retry := req.Clone(req.Context())
+			retry.URL = alt
+			retry.Host = ""
+			resp, err = t.next.RoundTrip(retry)
+			if err != nil || !t.isHTMLPackage(retry, resp) {
+				if err == nil {
+					t.log.Info().Str("url", alt.String()).Msg("package served by alternate mirror")
+				}
+				return resp, err
+			}
+			drainAndClose(resp.Body)
+			t.log.Warn().Str("url", alt.String()).Msg("alternate mirror also returned an HTML page for a package")
+		}
+	}
+	return nil, apperrors.New(apperrors.ErrUpstreamError, "mirror returned an HTML page instead of "+req.URL.Path)
+}
+
+// isHTMLPackage reports whether resp is a successful package download that
+// is really an HTML document. The peeked bytes are put back in front of
+// resp.Body so a clean response streams through unchanged.
+func (t *sanityTransport) isHTMLPackage(req *http.Request, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || req.Method != http.MethodGet || !packageFilePattern.MatchString(req.URL.Path) {
+		return false
+	}
+	if ct, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && ct == "text/html" {
+		return true
+	}
+	br := bufio.NewReaderSize(resp.Body, sanityPeekSize)
+	head, _ := br.Peek(sanityPeekSize)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+	return looksLikeHTML(head)
+}
+
+// looksLikeHTML reports whether b starts, after an optional BOM and
+// whitespace, with an HTML doctype or <html> tag.
+func looksLikeHTML(b []byte) bool {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	b = bytes.TrimLeft(b, " \t\r\n")
+	if len(b) > 16 {
+		b = b[:16]
+	}
+	s := strings.ToLower(string(b))
+	return strings.HasPrefix(s, "<!doctype html") || strings.HasPrefix(s, "<html")
+}
+
+// alternateMirrorURL maps u, a URL on the mirror currently selected for
+// some distribution, onto the fastest other mirror that answered the
+// benchmark that selected it. It returns nil when u is not on a selected
+// mirror or no other mirror answered; a configured mirror was never
+// benchmarked and has no alternate. It only reads the rewriter, so a
+// sanity failure never waits for a mirror lookup.
+func (ap *PackageStruct) alternateMirrorURL(u *url.URL) *url.URL {
+	ap.rewriters.Mu.RLock()
+	mode, p := ap.rewriterForURL(u)
+	var current *url.URL
+	var ranked []*url.URL
+	if p != nil {
+		current, ranked = (*p).mirror, (*p).ranked
+	}
+	ap.rewriters.Mu.RUnlock()
+	if current == nil {
+		return nil
+	}
+
+	for _, alt := range ranked {
+		if alt.Host == current.Host {
+			continue
+		}
+		ap.log.Debug().Str("distro", distro.DistributionName(mode)).Str("mirror", alt.Redacted()).Msg("failing over to alternate mirror")
+		return onMirror(u, current, alt)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+const htmlNotFound = "<!DOCTYPE html>\n<html><body><h1>Not Found</h1></body></html>"
+
+// newHTMLMirror serves an HTML "not found" page with status 200 for .deb
+// files and plain text for everything else.
+func newHTMLMirror(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".deb") {
+			_, _ = io.WriteString(w, htmlNotFound)
+			return
+		}
+		_, _ = io.WriteString(w, "Release")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newSanityPackageStruct serves Debian from mirrorURL or, when it is empty,
+// from the fastest of candidates.
+func newSanityPackageStruct(t *testing.T, mirrorURL string, failover bool, candidates ...string) *PackageStruct {
+	t.Helper()
+	reg := newTestRegistry()
+	if len(candidates) > 0 {
+		deb, _ := reg.GetByID("debian")
+		local := *deb
+		local.Mirrors = nil
+		for _, c := range candidates {
+			local.Mirrors = append(local.Mirrors, distro.URLWithAlias{URL: c, Scheme: "http"})
+		}
+		if err := reg.Register(&local); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := newTestState()
+	st.SetMirror(distro.TypeDebian, mirrorURL)
+	ps, err := NewPackageStruct(Options{
+		State:          st,
+		Registry:       reg,
+		Mode:           distro.TypeDebian,
+		SanityCheck:    true,
+		SanityFailover: failover,
+	})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	return ps
+}
+
+func serve(ps *PackageStruct, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	ps.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestSanityCheckRejectsHTMLPackage(t *testing.T) {
+	mirror := newHTMLMirror(t)
+	ps := newSanityPackageStruct(t, mirror.URL+"/debian/", false)
+
+	rec := serve(ps, "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb")
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "Not Found") {
+		t.Error("HTML error page was passed through as the package body")
+	}
+
+	// Index files are not packages and are left alone.
+	if rec := serve(ps, "/debian/dists/bookworm/Release"); rec.Code != http.StatusOK || rec.Body.String() != "Release" {
+		t.Errorf("Release: status = %d body = %q, want 200 Release", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSanityCheckPassesRealPackage(t *testing.T) {
+	body := "!<arch>\ndebian-binary   " + strings.Repeat("x", 2048)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, body)
+	}))
+	defer mirror.Close()
+	ps := newSanityPackageStruct(t, mirror.URL+"/debian/", false)
+
+	rec := serve(ps, "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb")
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Errorf("status = %d, body intact = %v; want 200 with the package unchanged", rec.Code, rec.Body.String() == body)
+	}
+}
+
+func TestSanityCheckFailsOverToAnotherMirror(t *testing.T) {
+	bad := newHTMLMirror(t)
+	var goodPackages atomic.Int64
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ".deb") {
+			// Lose the benchmark to the bad mirror.
+			time.Sleep(50 * time.Millisecond)
+		} else {
+			goodPackages.Add(1)
+		}
+		_, _ = io.WriteString(w, "!<arch>\n"+r.URL.Path)
+	}))
+	defer good.Close()
+	const pkg = "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"
+
+	ps := newSanityPackageStruct(t, "", true, bad.URL+"/debian/", good.URL+"/mirror/debian/")
+	rec := serve(ps, pkg)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 from the runner-up mirror", rec.Code)
+	}
+	if want := "!<arch>\n/mirror" + pkg; rec.Body.String() != want {
+		t.Errorf("body = %q, want %q", rec.Body.String(), want)
+	}
+
+	// A configured mirror was not benchmarked: there is no alternate to
+	// fail over to without looking the candidates up.
+	goodPackages.Store(0)
+	ps = newSanityPackageStruct(t, bad.URL+"/debian/", true, bad.URL+"/debian/", good.URL+"/mirror/debian/")
+	if rec := serve(ps, pkg); rec.Code != http.StatusBadGateway {
+		t.Errorf("configured mirror: status = %d, want 502", rec.Code)
+	}
+	if n := goodPackages.Load(); n != 0 {
+		t.Errorf("configured mirror: other candidate asked %d times, want 0", n)
+	}
+}
+
+func TestLooksLikeHTML(t *testing.T) {
+	tests := map[string]bool{
+		htmlNotFound:                  true,
+		"\xef\xbb\xbf  <HTML><head>":  true,
+		"\n\n<!doctype html>":         true,
+		"!<arch>\ndebian-binary":      false,
+		"\x1f\x8b\x08\x00 gzip bytes": false,
+		"":                            false,
+	}
+	for in, want := range tests {
+		if got := looksLikeHTML([]byte(in)); got != want {
+			t.Errorf("looksLikeHTML(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package proxy
 
 import (
 	_ "embed"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
@@ -28,13 +29,26 @@ var aptProxyLogoPNG []byte
 // participate in conditional GET handling without touching the filesystem.
 var logoLastModified = time.Now().UTC()
 
+// robotsTxt keeps crawlers out: nothing behind a package proxy is meant
+// to be indexed.
+const robotsTxt = "User-agent: *\nDisallow: /\n"
+
+// allowReadOnly rejects anything but GET and HEAD with 405 and reports
+// whether the request may be served.
+func allowReadOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
 // ServeStaticLogo writes the embedded apt-proxy logo PNG with long-lived
 // caching headers. It is intentionally minimal so it can be wired up via any
 // router that accepts an http.HandlerFunc.
 func ServeStaticLogo(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet && r.Method != http.MethodHead {
-		w.Header().Set("Allow", "GET, HEAD")
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	if !allowReadOnly(w, r) {
 		return
 	}
 
@@ -52,3 +66,29 @@ func ServeStaticLogo(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write(aptProxyLogoPNG)
 }
+
+// ServeFavicon answers /favicon.ico with an empty 204. Browsers opening the
+// home page ask for it; the day-long max-age stops them asking again.
+func ServeFavicon(w http.ResponseWriter, r *http.Request) {
+	if !allowReadOnly(w, r) {
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeRobots answers /robots.txt with a policy that disallows everything.
+func ServeRobots(w http.ResponseWriter, r *http.Request) {
+	if !allowReadOnly(w, r) {
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(robotsTxt)))
+	h.Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = io.WriteString(w, robotsTxt)
+}
@@ -15,6 +15,7 @@
 package proxy
 
 import (
+	"context"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -24,23 +25,35 @@ import (
 	"time"
 
 	"github.com/soulteary/apt-proxy/internal/system"
+	logger "github.com/soulteary/logger-kit"
 	"golang.org/x/sync/singleflight"
 )
 
 const (
 	InternalPageHome string = "/"
 	InternalPagePing string = "/_/ping/"
+
+	// Browsers and crawlers ask for these on their own. They are answered
+	// locally so they neither reach the distribution patterns nor show up
+	// as 404s in the logs.
+	InternalPageFavicon string = "/favicon.ico"
+	InternalPageRobots  string = "/robots.txt"
 )
 
 const (
 	TypeNotFound int = 0
 	TypeHome     int = 1
 	TypePing     int = 2
+	TypeFavicon  int = 3
+	TypeRobots   int = 4
 )
 
 func IsInternalUrls(url string) bool {
+	if url == InternalPageFavicon || url == InternalPageRobots {
+		return true
+	}
 	u := strings.ToLower(url)
-	return !strings.Contains(u, "/ubuntu") && !strings.Contains(u, "/debian") && !strings.Contains(u, "/centos") && !strings.Contains(u, "/alpine")
+	return !strings.Contains(u, "/ubuntu") && !strings.Contains(u, "/debian") && !strings.Contains(u, "/centos") && !strings.Contains(u, "/alpine") && !strings.Contains(u, "/gentoo") && !strings.Contains(u, "/archlinux")
 }
 
 func GetInternalResType(url string) int {
@@ -52,6 +65,14 @@ func GetInternalResType(url string) int {
 		return TypePing
 	}
 
+	if url == InternalPageFavicon {
+		return TypeFavicon
+	}
+
+	if url == InternalPageRobots {
+		return TypeRobots
+	}
+
 	return TypeNotFound
 }
 
@@ -59,39 +80,50 @@ const LabelNoValidValue = "N/A"
 
 // homeStatsTTL is the freshness window for the cached home-page stats.
 // The home page can be hit by liveness probes / dashboards on tight loops;
-// re-walking the cache directory and statting filesystems on every request
-// is expensive on a large cache, so we serve a short-lived snapshot.
+// statting filesystems on every request is wasteful, so we serve a
+// short-lived snapshot.
 const homeStatsTTL = 5 * time.Second
 
+// CacheSizeInterval is how often RunCacheSizeRefresh measures the cache
+// directory for the home page, and how old a measurement may get before
+// a home page request starts a new one in the background.
+const CacheSizeInterval = time.Minute
+
+// DefaultCacheSizeTimeout bounds one measurement of the cache directory
+// (cache.size_scan_timeout_sec).
+const DefaultCacheSizeTimeout = 10 * time.Second
+
 type homeStatsSnapshot struct {
+	cacheDir      string
+	diskAvailable string
+	memoryUsage   string
+	goroutine     string
+	expiresAt     time.Time
+}
+
+// cacheSizeSnapshot is the last measurement of a cache directory: walking
+// a large cache takes long, so it is never done while a request waits.
+type cacheSizeSnapshot struct {
 	cacheDir         string
 	cacheSizeLabel   string
 	filesNumberLabel string
-	diskAvailable    string
-	memoryUsage      string
-	goroutine        string
-	expiresAt        time.Time
+	measuredAt       time.Time
 }
 
 var (
 	homeStatsCache atomic.Pointer[homeStatsSnapshot]
 	homeStatsGroup singleflight.Group
-)
 
-func computeHomeStats(cacheDir string) *homeStatsSnapshot {
-	cacheSizeLabel := LabelNoValidValue
-	if cacheSize, err := system.DirSize(cacheDir); err == nil {
-		cacheSizeLabel = system.ByteCountDecimal(cacheSize)
-	}
+	cacheSizeCache atomic.Pointer[cacheSizeSnapshot]
+	cacheSizeGroup singleflight.Group
+	cacheSizeLazy  atomic.Bool // a request started a measurement
 
-	filesNumberLabel := LabelNoValidValue
-	cacheMetaDir := filepath.Join(cacheDir, "header", "v1")
-	if _, err := os.Stat(cacheMetaDir); !os.IsNotExist(err) {
-		if files, err := os.ReadDir(cacheMetaDir); err == nil {
-			filesNumberLabel = strconv.Itoa(len(files))
-		}
-	}
+	// dirSize measures the cache directory; a variable so tests can make
+	// it slow.
+	dirSize = system.DirSizeContext
+)
 
+func computeHomeStats(cacheDir string) *homeStatsSnapshot {
 	diskAvailableLabel := LabelNoValidValue
 	// Probe the volume hosting the cache directory. Fallback to the working
 	// directory only when the cache directory cannot be statted (e.g. before
@@ -108,18 +140,16 @@ func computeHomeStats(cacheDir string) *homeStatsSnapshot {
 	memoryUsageLabel := system.ByteCountDecimal(memoryUsage)
 
 	return &homeStatsSnapshot{
-		cacheDir:         cacheDir,
-		cacheSizeLabel:   cacheSizeLabel,
-		filesNumberLabel: filesNumberLabel,
-		diskAvailable:    diskAvailableLabel,
-		memoryUsage:      memoryUsageLabel,
-		goroutine:        goroutine,
-		expiresAt:        time.Now().Add(homeStatsTTL),
+		cacheDir:      cacheDir,
+		diskAvailable: diskAvailableLabel,
+		memoryUsage:   memoryUsageLabel,
+		goroutine:     goroutine,
+		expiresAt:     time.Now().Add(homeStatsTTL),
 	}
 }
 
 // getHomeStats returns a (possibly cached) snapshot. Reads are lock-free; on
-// expiry, singleflight collapses concurrent refreshes into a single FS walk.
+// expiry, singleflight collapses concurrent refreshes into a single probe.
 func getHomeStats(cacheDir string) *homeStatsSnapshot {
 	if cur := homeStatsCache.Load(); cur != nil && cur.cacheDir == cacheDir && time.Now().Before(cur.expiresAt) {
 		return cur
@@ -137,13 +167,110 @@ func getHomeStats(cacheDir string) *homeStatsSnapshot {
 	return v.(*homeStatsSnapshot)
 }
 
+// getCacheSize returns the last measurement of cacheDir without waiting
+// for one. When there is none yet, or it is older than CacheSizeInterval
+// (no RunCacheSizeRefresh keeps it fresh), a measurement is started in
+// the background and the page shows the last-known size, or N/A.
+func getCacheSize(cacheDir string) *cacheSizeSnapshot {
+	cur := cacheSizeCache.Load()
+	if cur != nil && cur.cacheDir != cacheDir {
+		cur = nil
+	}
+	if (cur == nil || time.Since(cur.measuredAt) > CacheSizeInterval) && cacheSizeLazy.CompareAndSwap(false, true) {
+		go func() {
+			defer cacheSizeLazy.Store(false)
+			_ = RefreshCacheSize(context.Background(), cacheDir, DefaultCacheSizeTimeout)
+		}()
+	}
+	if cur == nil {
+		return &cacheSizeSnapshot{cacheDir: cacheDir, cacheSizeLabel: LabelNoValidValue, filesNumberLabel: LabelNoValidValue}
+	}
+	return cur
+}
+
+// RefreshCacheSize measures cacheDir for the home page, giving up after
+// timeout. A measurement that times out or fails keeps the last-known
+// size of cacheDir. Concurrent calls for cacheDir share one measurement.
+func RefreshCacheSize(ctx context.Context, cacheDir string, timeout time.Duration) error {
+	_, err, _ := cacheSizeGroup.Do(cacheDir, func() (interface{}, error) {
+		return nil, measureCacheSize(ctx, cacheDir, timeout)
+	})
+	return err
+}
+
+func measureCacheSize(ctx context.Context, cacheDir string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	next := &cacheSizeSnapshot{cacheDir: cacheDir, cacheSizeLabel: LabelNoValidValue, filesNumberLabel: LabelNoValidValue, measuredAt: time.Now()}
+	if prev := cacheSizeCache.Load(); prev != nil && prev.cacheDir == cacheDir {
+		next.cacheSizeLabel, next.filesNumberLabel = prev.cacheSizeLabel, prev.filesNumberLabel
+	}
+
+	cacheSize, err := dirSize(ctx, cacheDir)
+	if ctx.Err() != nil {
+		cacheSizeCache.Store(next)
+		logger.Default().Warn().Str("dir", cacheDir).Dur("timeout", timeout).Msg("measuring the cache directory timed out, the home page shows the last-known size")
+		return ctx.Err()
+	}
+	if err == nil {
+		next.cacheSizeLabel = system.ByteCountDecimal(cacheSize)
+	}
+
+	cacheMetaDir := filepath.Join(cacheDir, "header", "v1")
+	if _, err := os.Stat(cacheMetaDir); !os.IsNotExist(err) {
+		if files, err := os.ReadDir(cacheMetaDir); err == nil {
+			next.filesNumberLabel = strconv.Itoa(len(files))
+		}
+	}
+	cacheSizeCache.Store(next)
+	return err
+}
+
+// RunCacheSizeRefresh measures cacheDir for the home page now and then
+// every interval until ctx is done, each measurement bounded by timeout.
+func RunCacheSizeRefresh(ctx context.Context, cacheDir string, interval, timeout time.Duration) {
+	_ = RefreshCacheSize(ctx, cacheDir, timeout)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = RefreshCacheSize(ctx, cacheDir, timeout)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RenderHomePage renders the home page: the statistics of cacheDir and
+// the table of selected mirrors, omitted when mirrors is empty.
+func RenderHomePage(cacheDir string, mirrors []HomeMirror) string {
+	tmpl, err := getHomeTemplate()
+	if err != nil {
+		return getErrorPage(err)
+	}
+	s, size := getHomeStats(cacheDir), getCacheSize(cacheDir)
+	return renderHomePage(tmpl, HomePageData{
+		CacheSize:     size.cacheSizeLabel,
+		FilesNumber:   size.filesNumberLabel,
+		AvailableSize: s.diskAvailable,
+		MemoryUsage:   s.memoryUsage,
+		Goroutines:    s.goroutine,
+		Mirrors:       mirrors,
+	})
+}
+
 func RenderInternalUrls(url string, cacheDir string) (string, int) {
 	switch GetInternalResType(url) {
 	case TypeHome:
-		s := getHomeStats(cacheDir)
-		return GetBaseTemplate(s.cacheSizeLabel, s.filesNumberLabel, s.diskAvailable, s.memoryUsage, s.goroutine), 200
+		return RenderHomePage(cacheDir, nil), 200
 	case TypePing:
 		return "pong", http.StatusOK
+	case TypeFavicon:
+		return "", http.StatusNoContent
+	case TypeRobots:
+		return robotsTxt, http.StatusOK
 	}
 	return "Not Found", http.StatusNotFound
 }
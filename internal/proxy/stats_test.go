@@ -0,0 +1,136 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stallDirSize makes measuring the cache directory block until the
+// measurement's context is done, as on a huge cache, and returns a
+// channel receiving once a measurement has started.
+func stallDirSize(t *testing.T) <-chan struct{} {
+	t.Helper()
+	started := make(chan struct{}, 1)
+	orig := dirSize
+	dirSize = func(ctx context.Context, _ string) (uint64, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	t.Cleanup(func() { dirSize = orig })
+	return started
+}
+
+// measuredCacheDir returns a cache directory holding 1500 bytes, measured.
+func measuredCacheDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.deb"), make([]byte, 1500), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := RefreshCacheSize(context.Background(), dir, time.Second); err != nil {
+		t.Fatalf("RefreshCacheSize() error = %v", err)
+	}
+	return dir
+}
+
+// TestHomePageRendersWhileCacheSizeStalls renders the home page while a
+// measurement of the cache directory hangs, and checks it answers at once
+// with the last-known size.
+func TestHomePageRendersWhileCacheSizeStalls(t *testing.T) {
+	dir := measuredCacheDir(t)
+	started := stallDirSize(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = RefreshCacheSize(ctx, dir, time.Minute)
+	}()
+	<-started
+
+	begin := time.Now()
+	page, status := RenderInternalUrls("/", dir)
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("home page took %s while the cache size was being measured", elapsed)
+	}
+	if status != 200 || !strings.Contains(page, "1.5 kB") {
+		t.Errorf("home page status %d without the last-known size 1.5 kB", status)
+	}
+	cancel()
+	<-done
+}
+
+func TestRefreshCacheSizeTimeoutKeepsLastKnownSize(t *testing.T) {
+	dir := measuredCacheDir(t)
+	stallDirSize(t)
+
+	if err := RefreshCacheSize(context.Background(), dir, 20*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RefreshCacheSize() error = %v, want a timeout", err)
+	}
+	if got := getCacheSize(dir).cacheSizeLabel; got != "1.5 kB" {
+		t.Errorf("cache size after a timed-out measurement = %q, want the last-known 1.5 kB", got)
+	}
+}
+
+func TestHomePageMeasuresCacheSizeInBackground(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.deb"), make([]byte, 2500), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := getCacheSize(dir).cacheSizeLabel; got != LabelNoValidValue {
+		t.Errorf("cache size before any measurement = %q, want %q", got, LabelNoValidValue)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for getCacheSize(dir).cacheSizeLabel != "2.5 kB" {
+		if time.Now().After(deadline) {
+			t.Fatalf("cache size = %q, want 2.5 kB once measured in the background", getCacheSize(dir).cacheSizeLabel)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunCacheSizeRefreshStopsWithContext(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		RunCacheSizeRefresh(ctx, dir, 10*time.Millisecond, time.Second)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for cur := cacheSizeCache.Load(); cur == nil || cur.cacheDir != dir; cur = cacheSizeCache.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("RunCacheSizeRefresh did not measure the cache directory")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunCacheSizeRefresh did not return once its context was done")
+	}
+}
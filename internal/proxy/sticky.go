@@ -0,0 +1,92 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// mirrorFor returns the mirror the client's requests go to. With sticky
+// below 2, no client or no ranking to choose from, that is the selected
+// mirror. Otherwise it is one of the sticky mirrors (see stickyMirrors),
+// chosen by rendezvous hashing of the client against each of them: the
+// same client always gets the same mirror, clients spread evenly over
+// them, and a change to the set only moves the clients of the mirrors
+// that left it.
+func (r *URLRewriter) mirrorFor(client string, sticky int) *url.URL {
+	if client == "" || sticky < 2 {
+		return r.mirror
+	}
+	var best *url.URL
+	var bestScore uint64
+	for _, m := range r.stickyMirrors(sticky) {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(client))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(m.String()))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best
+}
+
+// stickyMirrors returns the selected mirror followed by the next fastest
+// mirrors of its benchmark, n in all at most. ranked[0] is the mirror as
+// benchmarked; the selected one takes its place, so a mirror adopted
+// after a redirect is used as such.
+func (r *URLRewriter) stickyMirrors(n int) []*url.URL {
+	mirrors := []*url.URL{r.mirror}
+	for i := 1; i < len(r.ranked) && len(mirrors) < n; i++ {
+		mirrors = append(mirrors, r.ranked[i])
+	}
+	return mirrors
+}
+
+// stickyMirrorForURL finds the distribution one of whose sticky mirrors
+// other than the selected one serves u, for mirrors.sticky_clients.
+// Callers hold ap.rewriters.Mu; rewriter is nil when there is none.
+func (ap *PackageStruct) stickyMirrorForURL(u *url.URL) (rewriter *URLRewriter, mirror *url.URL) {
+	sticky := ap.state.StickyClients()
+	if sticky < 2 {
+		return nil, nil
+	}
+	for _, m := range distroModesOrder {
+		p := rewriterField(ap.rewriters, m)
+		if p == nil || *p == nil || (*p).mirror == nil {
+			continue
+		}
+		for _, mirror := range (*p).stickyMirrors(sticky)[1:] {
+			if mirror.Host == u.Host && strings.HasPrefix(u.Path, mirror.Path) {
+				return *p, mirror
+			}
+		}
+	}
+	return nil, nil
+}
+
+// remoteIP is the default Options.ClientIP: the host part of the peer
+// address.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
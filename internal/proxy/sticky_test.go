@@ -0,0 +1,148 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMirrorForSticksToClient(t *testing.T) {
+	var ranked []*url.URL
+	for _, m := range []string{"http://a.example/debian/", "http://b.example/debian/", "http://c.example/debian/"} {
+		u, _ := url.Parse(m)
+		ranked = append(ranked, u)
+	}
+	r := &URLRewriter{mirror: ranked[0], ranked: ranked}
+
+	used := map[string]int{}
+	for i := 0; i < 60; i++ {
+		client := fmt.Sprintf("10.0.%d.%d", i/10, i%10)
+		first := r.mirrorFor(client, 3)
+		for j := 0; j < 5; j++ {
+			if got := r.mirrorFor(client, 3); got != first {
+				t.Fatalf("client %s got %s, then %s", client, first, got)
+			}
+		}
+		used[first.Host]++
+		if got := r.mirrorFor(client, 2); got != ranked[0] && got != ranked[1] {
+			t.Errorf("client %s got %s with sticky_clients 2, want one of the two fastest", client, got)
+		}
+		if got := r.mirrorFor(client, 0); got != ranked[0] {
+			t.Errorf("client %s got %s with sticky_clients off, want the fastest", client, got)
+		}
+	}
+	if len(used) != 3 {
+		t.Errorf("60 clients spread over %v, want all three mirrors used", used)
+	}
+	if got := (&URLRewriter{mirror: ranked[0]}).mirrorFor("10.0.0.1", 3); got != ranked[0] {
+		t.Errorf("without a ranking got %s, want the selected mirror", got)
+	}
+}
+
+// serveFrom proxies path for a client at ip.
+func serveFrom(ps *PackageStruct, ip, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = ip + ":40000"
+	rec := httptest.NewRecorder()
+	ps.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestStickyClientsKeepAClientOnOneMirror benchmarks three mirrors and
+// checks that each client's requests all reach the same one, while the
+// clients use more than one.
+func TestStickyClientsKeepAClientOnOneMirror(t *testing.T) {
+	mirrors := []*pathRecorder{newPathRecorder(t, 0), newPathRecorder(t, 20*time.Millisecond), newPathRecorder(t, 40*time.Millisecond)}
+	ps := newDebianCandidatesStruct(t, mirrors[2].URL+"/debian/", mirrors[1].URL+"/debian/", mirrors[0].URL+"/debian/")
+	if n := len(ps.rewriters.Debian.ranked); n != 3 {
+		t.Fatalf("benchmark ranked %d mirrors, want 3", n)
+	}
+	ps.state.SetStickyClients(3)
+	for _, m := range mirrors {
+		m.takePaths()
+	}
+
+	spread := false
+	for i := 0; i < 20; i++ {
+		client := fmt.Sprintf("192.0.2.%d", i+1)
+		for _, path := range []string{"/debian/dists/bookworm/InRelease", "/debian/dists/bookworm/main/binary-amd64/Packages.xz", "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"} {
+			if rec := serveFrom(ps, client, path); rec.Code != http.StatusOK {
+				t.Fatalf("client %s: GET %s = %d, want 200", client, path, rec.Code)
+			}
+		}
+		var got []int
+		for j, m := range mirrors {
+			if n := len(m.takePaths()); n > 0 {
+				got = append(got, n)
+				if j > 0 {
+					spread = true
+				}
+			}
+		}
+		if len(got) != 1 || got[0] != 3 {
+			t.Errorf("client %s requests split over mirrors as %v, want all 3 on one", client, got)
+		}
+	}
+	if !spread {
+		t.Error("every client used the fastest mirror with mirrors.sticky_clients 3")
+	}
+
+	ps.state.SetStickyClients(0)
+	for i := 0; i < 5; i++ {
+		serveFrom(ps, fmt.Sprintf("192.0.2.%d", i+1), "/debian/dists/bookworm/InRelease")
+	}
+	if n := len(mirrors[0].takePaths()); n != 5 {
+		t.Errorf("fastest mirror got %d of 5 requests with sticky_clients off, want all", n)
+	}
+}
+
+// TestStickyMirrorFailureRetriesSelected takes a client's sticky mirror
+// down and checks the request is answered by the selected mirror, which
+// stays selected.
+func TestStickyMirrorFailureRetriesSelected(t *testing.T) {
+	primary := newPathRecorder(t, 0)
+	other := newPathRecorder(t, 30*time.Millisecond)
+	ps := newDebianCandidatesStruct(t, other.URL+"/debian/", primary.URL+"/debian/")
+	ps.state.SetStickyClients(2)
+	rw := ps.rewriters.Debian
+
+	client := ""
+	for i := 1; i < 256 && client == ""; i++ {
+		if ip := fmt.Sprintf("198.51.100.%d", i); rw.mirrorFor(ip, 2).Host == other.Listener.Addr().String() {
+			client = ip
+		}
+	}
+	if client == "" {
+		t.Fatal("no client sticks to the second mirror")
+	}
+	other.down.Store(true)
+	primary.takePaths()
+
+	const pkg = "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"
+	if rec := serveFrom(ps, client, pkg); rec.Code != http.StatusOK || rec.Body.String() != pkg {
+		t.Fatalf("status = %d body = %q, want 200 from the selected mirror", rec.Code, rec.Body.String())
+	}
+	if got := primary.takePaths(); len(got) != 1 || got[0] != pkg {
+		t.Errorf("selected mirror received %q, want the package request", got)
+	}
+	if ps.rewriters.Debian != rw {
+		t.Error("a sticky mirror failure replaced the selected mirror")
+	}
+}
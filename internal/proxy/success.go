@@ -0,0 +1,56 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// successTransport reports whether each proxied request to a selected
+// mirror succeeded to record, so selection can avoid mirrors that answer
+// benchmarks but fail real fetches (see benchmarks.SuccessTracker). It
+// sits below failoverTransport, so a request retried on the fallback
+// counts once for each mirror. Requests the client gave up on are not
+// counted.
+type successTransport struct {
+	next   http.RoundTripper
+	record func(u *url.URL, ok bool)
+}
+
+func (t *successTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if t.record != nil && req.Context().Err() == nil {
+		t.record(req.URL, !upstreamFailed(resp, err))
+	}
+	return resp, err
+}
+
+// recordMirrorOutcome adds the outcome of a request for u to the success
+// rate of the selected or sticky mirror serving it, if any.
+func (ap *PackageStruct) recordMirrorOutcome(u *url.URL, ok bool) {
+	ap.rewriters.Mu.RLock()
+	_, p := ap.rewriterForURL(u)
+	var mirror string
+	if p != nil {
+		mirror = (*p).mirror.String()
+	} else if _, sticky := ap.stickyMirrorForURL(u); sticky != nil {
+		mirror = sticky.String()
+	}
+	ap.rewriters.Mu.RUnlock()
+	if mirror != "" {
+		ap.bench.Success().Record(mirror, ok)
+	}
+}
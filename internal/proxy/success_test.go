@@ -0,0 +1,113 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+	"github.com/soulteary/apt-proxy/internal/state"
+)
+
+// TestMinSuccessRatePassesOverFlakyMirror has the benchmark winner fail
+// half of the real package fetches and checks the next selection picks
+// the slower, reliable mirror.
+func TestMinSuccessRatePassesOverFlakyMirror(t *testing.T) {
+	var fetches atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/pool/") && fetches.Add(1)%2 == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer flaky.Close()
+	// The reliable mirror is down for the startup benchmark, so the flaky
+	// one has no warm fallback to fail over to.
+	var up atomic.Bool
+	reliable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(30 * time.Millisecond)
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer reliable.Close()
+
+	reg := newTestRegistry()
+	deb, _ := reg.GetByID("debian")
+	local := *deb
+	local.Mirrors = []distro.URLWithAlias{
+		{URL: reliable.URL + "/debian/", Scheme: "http"},
+		{URL: flaky.URL + "/debian/", Scheme: "http"},
+	}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+	// Without the retrying transport every failed fetch is one failure.
+	ps, err := NewPackageStruct(Options{
+		State:             state.NewAppState(),
+		Registry:          reg,
+		Mode:              distro.TypeDebian,
+		MinSuccessRate:    0.9,
+		TransportOverride: &http.Transport{},
+	})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	if got := ps.rewriters.Debian.mirror.Host; got != flaky.Listener.Addr().String() {
+		t.Fatalf("startup mirror = %s, want the only answering %s", got, flaky.URL)
+	}
+
+	for i := 0; i < 20; i++ {
+		serve(ps, "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb")
+	}
+	rate, samples := ps.BenchmarkEngine().Success().Rate(flaky.URL + "/debian/")
+	if samples != 20 || rate != 0.5 {
+		t.Fatalf("recorded success rate = %v over %d requests, want 0.5 over 20", rate, samples)
+	}
+
+	up.Store(true)
+	if err := ps.RefreshDistro(distro.TypeDebian); err != nil {
+		t.Fatalf("RefreshDistro: %v", err)
+	}
+	if got := ps.rewriters.Debian.mirror.Host; got != reliable.Listener.Addr().String() {
+		t.Errorf("mirror after refresh = %s, want the reliable %s", got, reliable.URL)
+	}
+}
+
+// TestMinSuccessRateOffKeepsFastestMirror checks the failures are still
+// recorded but ignored without mirrors.min_success_rate.
+func TestMinSuccessRateOffKeepsFastestMirror(t *testing.T) {
+	flaky := newPathRecorder(t, 0)
+	reliable := newPathRecorder(t, 30*time.Millisecond)
+	ps := newDebianCandidatesStruct(t, reliable.URL+"/debian/", flaky.URL+"/debian/")
+	for i := 0; i < 20; i++ {
+		ps.BenchmarkEngine().Success().Record(flaky.URL+"/debian/", false)
+	}
+	if err := ps.RefreshDistro(distro.TypeDebian); err != nil {
+		t.Fatalf("RefreshDistro: %v", err)
+	}
+	if got := ps.rewriters.Debian.mirror.Host; got != flaky.Listener.Addr().String() {
+		t.Errorf("mirror after refresh = %s, want the fastest %s", got, flaky.URL)
+	}
+}
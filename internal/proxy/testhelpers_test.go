@@ -30,6 +30,8 @@ func newTestState() *state.AppState {
 	st.SetMirror(distro.TypeDebian, "http://mirrors.example.com/debian/")
 	st.SetMirror(distro.TypeCentOS, "http://mirrors.example.com/centos/")
 	st.SetMirror(distro.TypeAlpine, "http://mirrors.example.com/alpine/")
+	st.SetMirror(distro.TypeGentoo, "http://mirrors.example.com/gentoo/")
+	st.SetMirror(distro.TypeArch, "http://mirrors.example.com/archlinux/")
 	return st
 }
 
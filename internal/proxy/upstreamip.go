@@ -0,0 +1,66 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// UpstreamIPHeader is set on responses the mirror was contacted for to
+// the IP address apt-proxy connected to, as resolved from the mirror's
+// host name, for diagnosing geo-DNS. Responses served from the cache
+// without revalidation carry none. The daemon logs it and removes it
+// from client responses unless proxy.upstream_ip_header is set.
+const UpstreamIPHeader = "X-Upstream-IP"
+
+// upstreamIP holds the remote IP of the last connection a request was
+// sent over.
+type upstreamIP struct {
+	ip atomic.Pointer[string]
+}
+
+// withUpstreamIP returns ctx tracing the connections of requests made
+// with it into ip. The trace travels with the request through the cache
+// layer to the transport.
+func withUpstreamIP(ctx context.Context, ip *upstreamIP) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Conn == nil {
+				return
+			}
+			if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				ip.ip.Store(&host)
+			}
+		},
+	})
+}
+
+// setHeader sets UpstreamIPHeader on h once a connection was made, and
+// removes one a mirror sent, or that was cached with its response,
+// otherwise.
+func (u *upstreamIP) setHeader(h http.Header) {
+	if u == nil {
+		return
+	}
+	if ip := u.ip.Load(); ip != nil {
+		h.Set(UpstreamIPHeader, *ip)
+	} else {
+		h.Del(UpstreamIPHeader)
+	}
+}
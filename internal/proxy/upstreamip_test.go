@@ -0,0 +1,53 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+func TestUpstreamIPHeader(t *testing.T) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(UpstreamIPHeader, "192.0.2.1")
+		_, _ = w.Write([]byte("deb"))
+	}))
+	defer mirror.Close()
+	st := newTestState()
+	st.SetMirror(distro.TypeDebian, mirror.URL+"/debian/")
+	ps, err := NewPackageStruct(Options{State: st, Registry: newTestRegistry(), Mode: distro.TypeDebian})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+
+	rec := serve(ps, "/debian/pool/main/h/hello/hello_2.10_amd64.deb")
+	if got := rec.Header().Get(UpstreamIPHeader); got != "127.0.0.1" {
+		t.Errorf("%s = %q, want the address of the mirror connected to", UpstreamIPHeader, got)
+	}
+
+	// A handler answering without contacting the mirror, like a cache
+	// hit, leaves no address, and a stored one is dropped.
+	ps.DistroHandlers = map[int]http.Handler{distro.TypeDebian: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(UpstreamIPHeader, "127.0.0.1")
+		w.WriteHeader(http.StatusOK)
+	})}
+	rec = serve(ps, "/debian/pool/main/h/hello/hello_2.10_amd64.deb")
+	if got := rec.Header().Get(UpstreamIPHeader); got != "" {
+		t.Errorf("%s = %q without an upstream request, want none", UpstreamIPHeader, got)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"github.com/soulteary/apt-proxy/internal/distro"
+)
+
+// rebuildSnapshot is what a mirror rebuild may lose: the rewriter of each
+// served distribution.
+type rebuildSnapshot struct {
+	rewriters map[int]*URLRewriter
+}
+
+// snapshot records the rewriters before a rebuild, for heal. The caller
+// holds refreshMu.
+func (ap *PackageStruct) snapshot() rebuildSnapshot {
+	snap := rebuildSnapshot{rewriters: make(map[int]*URLRewriter)}
+	ap.rewriters.Mu.RLock()
+	defer ap.rewriters.Mu.RUnlock()
+	for _, m := range modesToInit(ap.mode) {
+		if p := rewriterField(ap.rewriters, m); p != nil && *p != nil {
+			snap.rewriters[m] = *p
+		}
+	}
+	return snap
+}
+
+// heal is the watchdog run after every rebuild of the mirror selection
+// (RefreshMirrors, ReloadMirrors, RefreshDistro). A distribution the
+// rebuild left without a mirror, where it had one before, gets its
+// previous rewriter back: without one its requests would go to the host
+// they name, or back to apt-proxy itself. The caller holds refreshMu.
+func (ap *PackageStruct) heal(before rebuildSnapshot) {
+	ap.rewriters.Mu.Lock()
+	defer ap.rewriters.Mu.Unlock()
+	for m, previous := range before.rewriters {
+		p := rewriterField(ap.rewriters, m)
+		if p == nil || (*p != nil && (*p).mirror != nil) || previous.mirror == nil {
+			continue
+		}
+		*p = previous
+		ap.log.Error().Str("distro", distro.DistributionName(m)).Str("mirror", previous.mirror.Redacted()).
+			Msg("mirror rebuild left no mirror, keeping the previous one")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/distro"
+	"github.com/soulteary/apt-proxy/internal/state"
+)
+
+// newHealingStruct returns a Debian PackageStruct using upstream, as
+// configured, whose only candidate mirror is http: once the configured
+// mirror is dropped with mirrors.require_https on, a rebuild finds none.
+func newHealingStruct(t *testing.T, upstream string) (*PackageStruct, *state.AppState) {
+	t.Helper()
+	reg := newTestRegistry()
+	deb, _ := reg.GetByID("debian")
+	local := *deb
+	local.Mirrors = []distro.URLWithAlias{{URL: "http://127.0.0.1:1/debian/", Scheme: "http"}}
+	if err := reg.Register(&local); err != nil {
+		t.Fatal(err)
+	}
+	st := state.NewAppState()
+	st.SetMirror(distro.TypeDebian, upstream)
+	ps, err := NewPackageStruct(Options{State: st, Registry: reg, Mode: distro.TypeDebian})
+	if err != nil {
+		t.Fatalf("NewPackageStruct: %v", err)
+	}
+	return ps, st
+}
+
+// TestHealKeepsMirrorAfterFailedRebuild breaks the rebuild of Debian's
+// mirror selection and checks that the watchdog keeps the previous
+// mirror, so requests still reach it.
+func TestHealKeepsMirrorAfterFailedRebuild(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		rebuild func(*PackageStruct)
+	}{
+		{"refresh", (*PackageStruct).RefreshMirrors},
+		{"reload", (*PackageStruct).ReloadMirrors},
+		{"refresh distro", func(ps *PackageStruct) { _ = ps.RefreshDistro(distro.TypeDebian) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mirror := newPathRecorder(t, 0)
+			ps, st := newHealingStruct(t, mirror.URL+"/debian/")
+			st.SetMirror(distro.TypeDebian, "")
+			st.SetRequireHTTPS(true)
+
+			tt.rebuild(ps)
+			if rw := ps.rewriters.Debian; rw == nil || rw.mirror == nil || rw.mirror.Host != mirror.Listener.Addr().String() {
+				t.Fatalf("Debian rewriter after failed rebuild = %+v, want the previous mirror %s", rw, mirror.URL)
+			}
+			const pkg = "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb"
+			if rec := serve(ps, pkg); rec.Code != http.StatusOK || rec.Body.String() != pkg {
+				t.Errorf("status = %d body = %q, want the package from the previous mirror", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHealZeroPackageStruct(t *testing.T) {
+	ps := &PackageStruct{}
+	ps.RefreshMirrors()
+	ps.ReloadMirrors()
+	if ps.Handler != nil || ps.rewriters != nil {
+		t.Errorf("zero PackageStruct changed by a rebuild: %+v", ps)
+	}
+}
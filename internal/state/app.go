@@ -23,6 +23,7 @@ package state
 
 import (
 	"net/url"
+	"strings"
 	"sync/atomic"
 
 	logger "github.com/soulteary/logger-kit"
@@ -110,11 +111,16 @@ func (m *MirrorState) Clone() *MirrorState {
 // proxy mode and the mirror configuration for every supported distro.
 type AppState struct {
 	proxyMode   atomic.Int64
+	region      atomic.Pointer[string]
+	httpsOnly   atomic.Bool
+	sticky      atomic.Int64
 	Ubuntu      *MirrorState
 	UbuntuPorts *MirrorState
 	Debian      *MirrorState
 	CentOS      *MirrorState
 	Alpine      *MirrorState
+	Gentoo      *MirrorState
+	Arch        *MirrorState
 }
 
 // NewAppState constructs a fresh AppState with empty MirrorStates for
@@ -126,6 +132,8 @@ func NewAppState() *AppState {
 		Debian:      NewMirrorState(distro.TypeDebian),
 		CentOS:      NewMirrorState(distro.TypeCentOS),
 		Alpine:      NewMirrorState(distro.TypeAlpine),
+		Gentoo:      NewMirrorState(distro.TypeGentoo),
+		Arch:        NewMirrorState(distro.TypeArch),
 	}
 }
 
@@ -139,6 +147,44 @@ func (s *AppState) GetProxyMode() int {
 	return int(s.proxyMode.Load())
 }
 
+// SetRegion stores the mirror region hint (e.g. "cn", "us", "eu") used to
+// bias fastest-mirror selection. An empty string clears the hint.
+func (s *AppState) SetRegion(region string) {
+	region = strings.ToLower(strings.TrimSpace(region))
+	s.region.Store(&region)
+}
+
+// GetRegion returns the mirror region hint, or "" when none is set.
+func (s *AppState) GetRegion() string {
+	if r := s.region.Load(); r != nil {
+		return *r
+	}
+	return ""
+}
+
+// SetRequireHTTPS controls whether only https mirrors may be benchmarked
+// or selected (mirrors.require_https).
+func (s *AppState) SetRequireHTTPS(on bool) {
+	s.httpsOnly.Store(on)
+}
+
+// RequireHTTPS reports whether plain http mirrors are excluded.
+func (s *AppState) RequireHTTPS() bool {
+	return s.httpsOnly.Load()
+}
+
+// SetStickyClients sets how many of a distribution's fastest mirrors
+// clients are spread over, each client IP always on the same one
+// (mirrors.sticky_clients). Below 2 every client uses the fastest.
+func (s *AppState) SetStickyClients(n int) {
+	s.sticky.Store(int64(n))
+}
+
+// StickyClients returns the mirrors.sticky_clients setting.
+func (s *AppState) StickyClients() int {
+	return int(s.sticky.Load())
+}
+
 // SetMirror sets the mirror URL for a specific distro type. Unknown
 // types are ignored.
 func (s *AppState) SetMirror(distType int, input string) {
@@ -177,6 +223,10 @@ func (s *AppState) mirrorByType(distType int) *MirrorState {
 		return s.CentOS
 	case distro.TypeAlpine:
 		return s.Alpine
+	case distro.TypeGentoo:
+		return s.Gentoo
+	case distro.TypeArch:
+		return s.Arch
 	default:
 		return nil
 	}
@@ -189,6 +239,8 @@ func (s *AppState) ResetAll() {
 	s.Debian.Reset()
 	s.CentOS.Reset()
 	s.Alpine.Reset()
+	s.Gentoo.Reset()
+	s.Arch.Reset()
 }
 
 // Clone returns a deep copy of the AppState. The clone shares no
@@ -200,7 +252,12 @@ func (s *AppState) Clone() *AppState {
 		Debian:      s.Debian.Clone(),
 		CentOS:      s.CentOS.Clone(),
 		Alpine:      s.Alpine.Clone(),
+		Gentoo:      s.Gentoo.Clone(),
+		Arch:        s.Arch.Clone(),
 	}
 	clone.proxyMode.Store(s.proxyMode.Load())
+	clone.region.Store(s.region.Load())
+	clone.httpsOnly.Store(s.httpsOnly.Load())
+	clone.sticky.Store(s.sticky.Load())
 	return clone
 }
@@ -56,6 +56,45 @@ func TestAppStateProxyMode(t *testing.T) {
 	}
 }
 
+func TestAppStateRegion(t *testing.T) {
+	st := NewAppState()
+
+	if region := st.GetRegion(); region != "" {
+		t.Errorf("GetRegion() = %q, want empty", region)
+	}
+
+	st.SetRegion(" US ")
+	if region := st.GetRegion(); region != "us" {
+		t.Errorf("GetRegion() = %q, want %q", region, "us")
+	}
+
+	if region := st.Clone().GetRegion(); region != "us" {
+		t.Errorf("Clone().GetRegion() = %q, want %q", region, "us")
+	}
+}
+
+func TestAppStateRequireHTTPS(t *testing.T) {
+	st := NewAppState()
+	if st.RequireHTTPS() {
+		t.Error("RequireHTTPS() = true on a fresh state")
+	}
+	st.SetRequireHTTPS(true)
+	if !st.Clone().RequireHTTPS() {
+		t.Error("Clone().RequireHTTPS() = false, want true")
+	}
+}
+
+func TestAppStateStickyClients(t *testing.T) {
+	st := NewAppState()
+	if n := st.StickyClients(); n != 0 {
+		t.Errorf("StickyClients() = %d on a fresh state, want 0", n)
+	}
+	st.SetStickyClients(3)
+	if n := st.Clone().StickyClients(); n != 3 {
+		t.Errorf("Clone().StickyClients() = %d, want 3", n)
+	}
+}
+
 func TestAppStateSetMirror(t *testing.T) {
 	st := NewAppState()
 
@@ -68,6 +107,8 @@ func TestAppStateSetMirror(t *testing.T) {
 		{distro.TypeDebian, "https://mirrors.example.com/debian/"},
 		{distro.TypeCentOS, "https://mirrors.example.com/centos/"},
 		{distro.TypeAlpine, "https://mirrors.example.com/alpine/"},
+		{distro.TypeGentoo, "https://mirrors.example.com/gentoo/"},
+		{distro.TypeArch, "https://mirrors.example.com/archlinux/"},
 	}
 
 	for _, tt := range tests {
@@ -15,6 +15,7 @@
 package system
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
 	"path/filepath"
@@ -23,11 +24,20 @@ import (
 // DirSize returns the total size in bytes of all files under path.
 // Uses filepath.WalkDir for fewer syscalls and better performance (Go 1.16+).
 func DirSize(path string) (uint64, error) {
+	return DirSizeContext(context.Background(), path)
+}
+
+// DirSizeContext is DirSize, giving up with ctx's error once ctx is done.
+// The size returned then covers only the files walked so far.
+func DirSizeContext(ctx context.Context, path string) (uint64, error) {
 	var size int64
 	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if d.IsDir() {
 			return nil
 		}
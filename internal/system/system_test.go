@@ -15,6 +15,8 @@
 package system
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -99,6 +101,18 @@ func TestDirSizeMissingPath(t *testing.T) {
 	}
 }
 
+func TestDirSizeContextCanceled(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("abc"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DirSizeContext(ctx, dir); !errors.Is(err, context.Canceled) {
+		t.Errorf("DirSizeContext() with a canceled context error = %v, want context.Canceled", err)
+	}
+}
+
 // TestDiskAvailable just checks the call returns non-zero and no error for
 // the temp directory. The exact value is platform-specific.
 func TestDiskAvailable(t *testing.T) {
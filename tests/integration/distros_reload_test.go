@@ -0,0 +1,251 @@
+// Copyright 2022 Su Yang
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+
+package integration
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/soulteary/apt-proxy/internal/api"
+)
+
+const distrosConfigV1 = `distributions:
+  - id: ubuntu
+    name: Ubuntu
+    type: 1
+    url_pattern: "/ubuntu/(.+)$"
+    benchmark_url: "dists/noble/main/binary-amd64/Release"
+    cache_rules:
+      - pattern: "Packages\\.(bz2|gz|lzma)$"
+        cache_control: "max-age=3600"
+        rewrite: true
+`
+
+// distrosConfigV2 moves Ubuntu to a new URL prefix and adds a custom
+// distribution, so a reload has both a visible routing effect and a
+// visible count change.
+const distrosConfigV2 = `distributions:
+  - id: ubuntu
+    name: Ubuntu
+    type: 1
+    url_pattern: "/ubuntu-alt/(.+)$"
+    benchmark_url: "dists/noble/main/binary-amd64/Release"
+    cache_rules:
+      - pattern: "Packages\\.(bz2|gz|lzma)$"
+        cache_control: "max-age=3600"
+        rewrite: true
+  - id: custom
+    name: Custom
+    type: 42
+    url_pattern: "/custom/(.+)$"
+    benchmark_url: "dists/stable/Release"
+    cache_rules:
+      - pattern: "Packages\\.gz$"
+        cache_control: "max-age=3600"
+        rewrite: true
+`
+
+func postDistrosReload(t *testing.T, ts *testServer) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/distros/reload", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("X-API-Key", ts.apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to reload distros: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+	return resp, body
+}
+
+// TestDistrosReloadAppliesModifiedConfig rewrites distributions.yaml on
+// disk, reloads it over the API and checks that both the registry and the
+// live URL routing pick up the change.
+func TestDistrosReloadAppliesModifiedConfig(t *testing.T) {
+	var lastPath atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastPath.Store(r.URL.Path)
+		_, _ = w.Write([]byte("packages"))
+	}))
+	defer upstream.Close()
+
+	cfgPath := filepath.Join(t.TempDir(), "distributions.yaml")
+	if err := os.WriteFile(cfgPath, []byte(distrosConfigV1), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	ts := newTestServer(t, &testServerOptions{upstream: upstream.URL, distributionsConfig: cfgPath})
+	defer ts.cleanup()
+
+	resp, body := postDistrosReload(t, ts)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("initial reload status = %d, body=%s", resp.StatusCode, body)
+	}
+	var before api.DistrosReloadResponse
+	if err := json.Unmarshal(body, &before); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if err := os.WriteFile(cfgPath, []byte(distrosConfigV2), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	resp, body = postDistrosReload(t, ts)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("reload status = %d, body=%s", resp.StatusCode, body)
+	}
+	var after api.DistrosReloadResponse
+	if err := json.Unmarshal(body, &after); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if after.Count != before.Count+1 {
+		t.Errorf("count after reload = %d, want %d", after.Count, before.Count+1)
+	}
+
+	// The new Ubuntu prefix must route to the Ubuntu mirror path.
+	getResp, err := http.Get(ts.URL + "/ubuntu-alt/dists/jammy/main/binary-amd64/Packages.gz")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, getResp.Body)
+	_ = getResp.Body.Close()
+	if got, _ := lastPath.Load().(string); got != "/ubuntu/dists/jammy/main/binary-amd64/Packages.gz" {
+		t.Errorf("upstream path = %q, want rewritten ubuntu path", got)
+	}
+}
+
+// TestDistrosReloadParseErrorKeepsRegistry checks that a broken YAML file
+// is reported as 400 and leaves the loaded distributions untouched.
+func TestDistrosReloadParseErrorKeepsRegistry(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "distributions.yaml")
+	if err := os.WriteFile(cfgPath, []byte(distrosConfigV2), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	ts := newTestServer(t, &testServerOptions{distributionsConfig: cfgPath})
+	defer ts.cleanup()
+
+	if err := os.WriteFile(cfgPath, []byte("distributions: [\n  - id: broken\n"), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	resp, body := postDistrosReload(t, ts)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("reload status = %d, want 400; body=%s", resp.StatusCode, body)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/distros", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("X-API-Key", ts.apiKey)
+	listResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/distros: %v", err)
+	}
+	defer listResp.Body.Close()
+	var list api.DistrosResponse
+	if err := json.NewDecoder(listResp.Body).Decode(&list); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	found := false
+	for _, d := range list.Distributions {
+		if d.ID == "custom" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("custom distribution lost after failed reload: %+v", list.Distributions)
+	}
+}
+
+// TestDistrosReloadBadEntryKeepsRouting reloads a file whose last entry
+// fails to register and checks that neither the registry nor the URL
+// routing takes any of it: the custom distribution stays listed and the
+// old Ubuntu prefix still reaches the mirror.
+func TestDistrosReloadBadEntryKeepsRouting(t *testing.T) {
+	var lastPath atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastPath.Store(r.URL.Path)
+		_, _ = w.Write([]byte("packages"))
+	}))
+	defer upstream.Close()
+
+	cfgPath := filepath.Join(t.TempDir(), "distributions.yaml")
+	if err := os.WriteFile(cfgPath, []byte(distrosConfigV2), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	ts := newTestServer(t, &testServerOptions{upstream: upstream.URL, distributionsConfig: cfgPath})
+	defer ts.cleanup()
+
+	// Debian's built-in entry already holds type 2.
+	bad := distrosConfigV1 + `  - id: clash
+    name: Clash
+    type: 2
+    url_pattern: "/clash/(.+)$"
+    benchmark_url: "dists/stable/Release"
+`
+	if err := os.WriteFile(cfgPath, []byte(bad), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	resp, body := postDistrosReload(t, ts)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("reload status = %d, want 400; body=%s", resp.StatusCode, body)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/distros", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("X-API-Key", ts.apiKey)
+	listResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/distros: %v", err)
+	}
+	defer listResp.Body.Close()
+	var list api.DistrosResponse
+	if err := json.NewDecoder(listResp.Body).Decode(&list); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	patterns := map[string]string{}
+	for _, d := range list.Distributions {
+		patterns[d.ID] = d.URLPattern
+	}
+	if patterns["custom"] == "" || patterns["ubuntu"] != "/ubuntu-alt/(.+)$" {
+		t.Fatalf("registry after failed reload = %v, want the previous distributions", patterns)
+	}
+
+	getResp, err := http.Get(ts.URL + "/ubuntu-alt/dists/jammy/main/binary-amd64/Packages.gz")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, getResp.Body)
+	_ = getResp.Body.Close()
+	if got, _ := lastPath.Load().(string); got != "/ubuntu/dists/jammy/main/binary-amd64/Packages.gz" {
+		t.Errorf("upstream path = %q, want the registry's Ubuntu prefix still routed", got)
+	}
+}
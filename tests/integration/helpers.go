@@ -28,6 +28,7 @@ import (
 
 	"github.com/soulteary/apt-proxy/internal/api"
 	"github.com/soulteary/apt-proxy/internal/distro"
+	"github.com/soulteary/apt-proxy/internal/mirrors"
 	"github.com/soulteary/apt-proxy/internal/proxy"
 	"github.com/soulteary/apt-proxy/internal/state"
 	httpcache "github.com/soulteary/httpcache-kit"
@@ -81,6 +82,9 @@ type testServerOptions struct {
 	// mirror target; when set, mirrorPrefix is ignored. Used by tests
 	// that want to assert on the actual proxied request.
 	upstream string
+	// distributionsConfig points the registry at a distributions.yaml.
+	// It is loaded at startup and re-read by POST /api/distros/reload.
+	distributionsConfig string
 }
 
 // newTestServer creates a new test server with a temporary cache directory.
@@ -115,7 +119,14 @@ func newTestServer(t *testing.T, opts *testServerOptions) *testServer {
 	st.SetMirror(distro.TypeDebian, prefix+"/debian/")
 	st.SetMirror(distro.TypeCentOS, prefix+"/centos/")
 	st.SetMirror(distro.TypeAlpine, prefix+"/alpine/")
+	st.SetMirror(distro.TypeGentoo, prefix+"/gentoo/")
+	st.SetMirror(distro.TypeArch, prefix+"/archlinux/")
 	reg := distro.NewBuiltinRegistry()
+	if opts.distributionsConfig != "" {
+		if err := reg.Reload(opts.distributionsConfig); err != nil {
+			t.Fatalf("failed to load distributions config: %v", err)
+		}
+	}
 
 	cache, err := httpcache.NewDiskCacheWithConfig(cacheDir, httpcache.DefaultCacheConfig())
 	if err != nil {
@@ -124,14 +135,16 @@ func newTestServer(t *testing.T, opts *testServerOptions) *testServer {
 	}
 
 	log := getSharedTestLogger()
+	sources := mirrors.NewSources(mirrors.NewGeoLookup(mirrors.GeoLookupOptions{}))
 
 	proxyRouter, err := proxy.NewPackageStruct(proxy.Options{
-		State:    st,
-		Registry: reg,
-		CacheDir: cacheDir,
-		Logger:   log,
-		Mode:     distro.TypeAllDistros,
-		Async:    true,
+		State:         st,
+		Registry:      reg,
+		CacheDir:      cacheDir,
+		Logger:        log,
+		Mode:          distro.TypeAllDistros,
+		Async:         true,
+		MirrorSources: sources,
 	})
 	if err != nil {
 		os.RemoveAll(cacheDir)
@@ -142,7 +155,14 @@ func newTestServer(t *testing.T, opts *testServerOptions) *testServer {
 	proxyRouter.Handler = cachedHandler
 
 	cacheHandler := api.NewCacheHandler(cache, log)
-	mirrorsHandler := api.NewMirrorsHandler(log, proxyRouter.RefreshMirrors)
+	mirrorsHandler := api.NewMirrorsHandler(log, sources.Geo(), proxyRouter.RefreshMirrors, nil)
+	distrosHandler := api.NewDistrosHandler(reg, log, func() (int, error) {
+		if err := reg.Reload(opts.distributionsConfig); err != nil {
+			return 0, err
+		}
+		proxyRouter.RefreshMirrors()
+		return len(reg.GetAll()), nil
+	})
 	authMiddleware := api.NewAuthMiddleware(api.AuthConfig{
 		APIKey: apiKey,
 		Logger: log,
@@ -156,7 +176,10 @@ func newTestServer(t *testing.T, opts *testServerOptions) *testServer {
 	mux.HandleFunc("/api/cache/stats", authMiddleware.WrapFunc(cacheHandler.HandleCacheStats))
 	mux.HandleFunc("/api/cache/purge", authMiddleware.WrapFunc(cacheHandler.HandleCachePurge))
 	mux.HandleFunc("/api/cache/cleanup", authMiddleware.WrapFunc(cacheHandler.HandleCacheCleanup))
+	mux.HandleFunc("/api/mirrors", authMiddleware.WrapFunc(mirrorsHandler.HandleMirrors))
 	mux.HandleFunc("/api/mirrors/refresh", authMiddleware.WrapFunc(mirrorsHandler.HandleMirrorsRefresh))
+	mux.HandleFunc("/api/distros", authMiddleware.WrapFunc(distrosHandler.HandleDistros))
+	mux.HandleFunc("/api/distros/reload", authMiddleware.WrapFunc(distrosHandler.HandleDistrosReload))
 	// Catch-all for proxied requests so multi-server tests can fire real
 	// HTTP traffic at the mirror upstream. We route through the
 	// PackageStruct's own ServeHTTP (not the bare cached handler) so the